@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/bosley/libas/scribe"
+	"github.com/google/uuid"
+)
+
+// runExport writes transcriptions and recordings of a recordings directory
+// to a portable archive
+func runExport(args []string) error {
+	fs := newFlagSet("export")
+	recordingsDir := fs.String("recordings", "recordings", "Recordings directory to export from")
+	from := fs.String("from", "", "First day to export (YYYYMMDD)")
+	to := fs.String("to", "", "Last day to export (YYYYMMDD)")
+	clients := fs.String("client", "", "Comma separated client IDs to export (every client when empty)")
+	withAudio := fs.Bool("audio", true, "Include the recordings the transcriptions were made from")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected the archive to write, \"-\" for stdout")
+	}
+	for _, day := range []string{*from, *to} {
+		if _, err := time.Parse("20060102", day); day != "" && err != nil {
+			return usageError(fs, "invalid day %q, expected YYYYMMDD", day)
+		}
+	}
+	clientIDs := splitList(*clients)
+	for _, clientID := range clientIDs {
+		if _, err := uuid.Parse(clientID); err != nil {
+			return usageError(fs, "invalid client ID %q", clientID)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if path := fs.Arg(0); path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create archive: %w", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	stats, err := scribe.Export(out, *recordingsDir, scribe.ExportOptions{
+		From:      *from,
+		To:        *to,
+		ClientIDs: clientIDs,
+		Audio:     *withAudio,
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Exported archive",
+		"transcriptions", stats.Transcriptions,
+		"audioFiles", stats.AudioFiles)
+	return nil
+}
+
+// runImport loads an archive written by export into a recordings directory
+func runImport(args []string) error {
+	fs := newFlagSet("import")
+	recordingsDir := fs.String("recordings", "recordings", "Recordings directory to import into")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected the archive to read, \"-\" for stdin")
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	stats, err := scribe.Import(in, *recordingsDir)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Imported archive",
+		"transcriptions", stats.Transcriptions,
+		"audioFiles", stats.AudioFiles,
+		"skipped", stats.Skipped)
+	return nil
+}
@@ -0,0 +1,147 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+	"time"
+)
+
+// Sounds Classify tells apart
+const (
+	SoundSpeech  = "speech"
+	SoundMusic   = "music"
+	SoundKnock   = "knock"
+	SoundNoise   = "noise"
+	SoundSilence = "silence"
+)
+
+const (
+	// Analysis window for classification, rounded down to a power of two
+	// samples for the transform
+	classifyFrame = 32 * time.Millisecond
+
+	// Frames quieter than this are silence
+	classifyThresholdDB = -45.0
+
+	// Bursts no longer than this are knocks, bangs and claps, shorter than
+	// any word
+	knockMaxBurst = 150 * time.Millisecond
+
+	// Recordings shorter than this are left to whisper
+	classifyMinLength = 500 * time.Millisecond
+)
+
+// Classification is the sound a recording most likely holds
+type Classification struct {
+	Label string
+
+	// How clearly the deciding feature showed, 0 to 1
+	Score float64
+}
+
+// Classify tells speech apart from music, knocks, steady noise and silence
+// by the level and spectral flatness of short frames. The heuristics are
+// rough and err towards speech, so recordings they are unsure of are still
+// transcribed.
+func Classify(samples []int16, sampleRate int) Classification {
+	frameLen := 1
+	for frameLen*2 <= durationToSamples(classifyFrame, sampleRate) {
+		frameLen *= 2
+	}
+	if len(samples) < durationToSamples(classifyMinLength, sampleRate) || frameLen < 16 {
+		return Classification{Label: SoundSpeech}
+	}
+
+	window := make([]float64, frameLen)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameLen-1))
+	}
+
+	frames := len(samples) / frameLen
+	active := make([]bool, frames)
+	var levels, flatness []float64
+	spectrum := make([]complex128, frameLen)
+	for i := range active {
+		frame := samples[i*frameLen : (i+1)*frameLen]
+		var sum float64
+		for _, s := range frame {
+			sum += float64(s) * float64(s)
+		}
+		level := 20 * math.Log10(math.Sqrt(sum/float64(frameLen))/32768+1e-10)
+		if level < classifyThresholdDB {
+			continue
+		}
+		active[i] = true
+		levels = append(levels, level)
+
+		for j, s := range frame {
+			spectrum[j] = complex(float64(s)/32768*window[j], 0)
+		}
+		fft(spectrum)
+		flatness = append(flatness, spectralFlatness(spectrum[1:frameLen/2]))
+	}
+
+	activeRatio := float64(len(levels)) / float64(frames)
+	if activeRatio < 0.02 {
+		return Classification{Label: SoundSilence, Score: 1 - activeRatio}
+	}
+
+	// Knocks are a few short bursts in silence
+	maxBurst := max(durationToSamples(knockMaxBurst, sampleRate)/frameLen, 1)
+	longest, run := 0, 0
+	for _, a := range active {
+		if a {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	if longest <= maxBurst && activeRatio < 0.25 {
+		return Classification{Label: SoundKnock, Score: 1 - activeRatio}
+	}
+
+	// Music and noise go on at a steady level, speech pauses between
+	// syllables and words
+	if activeRatio < 0.9 || stddev(levels) > 4 {
+		return Classification{Label: SoundSpeech, Score: min(stddev(levels)/12, 1)}
+	}
+	meanFlatness := mean(flatness)
+	switch {
+	case meanFlatness < 0.1:
+		return Classification{Label: SoundMusic, Score: 1 - meanFlatness}
+	case meanFlatness > 0.3:
+		return Classification{Label: SoundNoise, Score: min(meanFlatness*2, 1)}
+	}
+	return Classification{Label: SoundSpeech}
+}
+
+// spectralFlatness is the geometric over the arithmetic mean of the power
+// spectrum, near 0 for tones and near 0.5 for white noise
+func spectralFlatness(bins []complex128) float64 {
+	var logSum, sum float64
+	for _, bin := range bins {
+		power := real(bin*cmplx.Conj(bin)) + 1e-12
+		logSum += math.Log(power)
+		sum += power
+	}
+	n := float64(len(bins))
+	return math.Exp(logSum/n) / (sum / n)
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func stddev(values []float64) float64 {
+	m := mean(values)
+	var sum float64
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
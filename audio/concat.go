@@ -0,0 +1,74 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// Concat joins recordings, in the order given, into a single 16-bit WAV
+// file at outPath with gap of silence between them. Recordings are decoded
+// one at a time, and any at a different rate than the first are resampled
+// to match it.
+func Concat(paths []string, outPath string, gap time.Duration) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no recordings to concatenate")
+	}
+
+	file, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("failed to create WAV file: %w", err)
+	}
+
+	if err := concatInto(file, paths, gap); err != nil {
+		file.Close()
+		os.Remove(outPath)
+		return err
+	}
+
+	return file.Close()
+}
+
+func concatInto(file *os.File, paths []string, gap time.Duration) error {
+	var (
+		sampleRate int
+		silence    []byte
+		dataSize   int64
+	)
+
+	for i, path := range paths {
+		pcm, err := ReadAudio(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		if i == 0 {
+			sampleRate = pcm.SampleRate
+			silence = make([]byte, 2*durationToSamples(gap, sampleRate))
+			if err := WriteWavHeader(file, uint32(sampleRate), 0); err != nil {
+				return fmt.Errorf("failed to write WAV header: %w", err)
+			}
+		} else if len(silence) > 0 {
+			if _, err := file.Write(silence); err != nil {
+				return fmt.Errorf("failed to write samples: %w", err)
+			}
+			dataSize += int64(len(silence))
+		}
+
+		samples := pcm.Samples
+		if pcm.SampleRate != sampleRate {
+			samples = Resample(samples, pcm.SampleRate, sampleRate)
+		}
+		if _, err := file.Write(encodeInt16(samples)); err != nil {
+			return fmt.Errorf("failed to write samples: %w", err)
+		}
+		dataSize += int64(len(samples)) * 2
+
+		if dataSize > math.MaxUint32-36 {
+			return fmt.Errorf("concatenated audio exceeds the WAV size limit")
+		}
+	}
+
+	return UpdateWavHeader(file, uint32(dataSize))
+}
@@ -0,0 +1,150 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Most samples decoders return unless told otherwise, about 4.6 hours at
+// 16kHz or 512 MiB of 16-bit audio
+const MaxSamples = 1 << 28
+
+// ErrTooLong is returned when decoded audio would pass the allowed number
+// of samples
+var ErrTooLong = errors.New("audio is too long")
+
+// Format identifies an audio container
+type Format string
+
+const (
+	FormatUnknown Format = ""
+	FormatWAV     Format = "wav"
+	FormatFLAC    Format = "flac"
+	FormatMP3     Format = "mp3"
+	FormatOGG     Format = "ogg"
+)
+
+// DetectFormat identifies an audio file from its leading bytes
+func DetectFormat(header []byte) Format {
+	switch {
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return FormatWAV
+	case len(header) >= 4 && string(header[0:4]) == "fLaC":
+		return FormatFLAC
+	case len(header) >= 4 && string(header[0:4]) == "OggS":
+		return FormatOGG
+	case len(header) >= 3 && string(header[0:3]) == "ID3":
+		// ID3 tags are mostly found on MP3 but some encoders add them to FLAC
+		if bytes.Contains(header, []byte("fLaC")) {
+			return FormatFLAC
+		}
+		return FormatMP3
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		return FormatMP3
+	}
+	return FormatUnknown
+}
+
+// ReadAudio decodes an audio file to 16-bit mono samples. WAV and FLAC are
+// decoded natively; MP3, OGG and anything the native decoders reject are
+// decoded with ffmpeg when it is installed.
+func ReadAudio(path string) (*PCM, error) {
+	return ReadAudioLimit(path, MaxSamples)
+}
+
+// ReadAudioLimit is ReadAudio failing with ErrTooLong past maxSamples. FLAC
+// and ffmpeg output stop decoding at the limit, WAV is bounded by the size
+// of the file.
+func ReadAudioLimit(path string, maxSamples int) (*PCM, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat audio file: %w", err)
+	}
+	reader := bufio.NewReader(file)
+	header, _ := reader.Peek(64)
+
+	var nativeErr error
+	switch format := DetectFormat(header); format {
+	case FormatWAV:
+		pcm, err := DecodeWav(reader)
+		if err == nil {
+			if len(pcm.Samples) > maxSamples {
+				return nil, fmt.Errorf("WAV file passes %d samples: %w", maxSamples, ErrTooLong)
+			}
+			return pcm, nil
+		}
+		nativeErr = err
+	case FormatFLAC:
+		pcm, err := DecodeFLAC(reader, flacMaxSamples(info.Size(), maxSamples))
+		if err == nil {
+			return pcm, nil
+		}
+		if errors.Is(err, ErrTooLong) {
+			return nil, err
+		}
+		nativeErr = err
+	case FormatUnknown:
+		nativeErr = fmt.Errorf("unrecognized audio format")
+	default:
+		nativeErr = fmt.Errorf("no native decoder for %s", format)
+	}
+
+	if !FFmpegAvailable() {
+		return nil, fmt.Errorf("%v: %w", nativeErr, ErrFFmpegUnavailable)
+	}
+
+	return decodeWithFFmpeg(path, maxSamples)
+}
+
+// decodeWithFFmpeg decodes any audio file ffmpeg understands to mono
+// samples at the recording sample rate, stopping ffmpeg past maxSamples
+func decodeWithFFmpeg(path string, maxSamples int) (*PCM, error) {
+	cmd, err := ffmpegCommand(
+		"-i", path,
+		"-ar", fmt.Sprintf("%d", RecordingSampleRate),
+		"-ac", "1",
+		"-f", "s16le",
+		"-")
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	// One byte past the limit tells a stream at the limit from a longer one
+	output, err := io.ReadAll(io.LimitReader(stdout, 2*int64(maxSamples)+1))
+	if err == nil && len(output) > 2*maxSamples {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("ffmpeg output passes %d samples: %w", maxSamples, ErrTooLong)
+	}
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg decoding failed: %w: %s", err, lastLine(stderr.Bytes()))
+	}
+
+	return &PCM{
+		Samples:    decodeInt16(output, 1),
+		SampleRate: RecordingSampleRate,
+	}, nil
+}
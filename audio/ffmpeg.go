@@ -0,0 +1,76 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// ErrFFmpegUnavailable is returned when a file needs ffmpeg and none was found
+var ErrFFmpegUnavailable = errors.New("ffmpeg is not available")
+
+// Resolved ffmpeg binary, detected on first use unless configured
+var ffmpeg struct {
+	sync.Mutex
+	path     string
+	resolved bool
+}
+
+// ConfigureFFmpeg sets the ffmpeg binary used for formats without a native
+// codec and checks that it runs, returning the resolved path. An empty path
+// searches PATH. When ffmpeg cannot be found WAV and FLAC keep working
+// through the native codecs and other formats fail with
+// ErrFFmpegUnavailable.
+func ConfigureFFmpeg(path string) (string, error) {
+	resolved, err := findFFmpeg(path)
+
+	ffmpeg.Lock()
+	defer ffmpeg.Unlock()
+	ffmpeg.path, ffmpeg.resolved = resolved, true
+	return resolved, err
+}
+
+// FFmpegAvailable reports whether an ffmpeg binary was found
+func FFmpegAvailable() bool {
+	_, err := ffmpegPath()
+	return err == nil
+}
+
+func findFFmpeg(path string) (string, error) {
+	if path == "" {
+		path = "ffmpeg"
+	}
+
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFFmpegUnavailable, err)
+	}
+	if output, err := exec.Command(resolved, "-version").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%w: %s does not run: %v: %s", ErrFFmpegUnavailable, resolved, err, lastLine(output))
+	}
+	return resolved, nil
+}
+
+func ffmpegPath() (string, error) {
+	ffmpeg.Lock()
+	defer ffmpeg.Unlock()
+
+	if !ffmpeg.resolved {
+		ffmpeg.path, _ = findFFmpeg("")
+		ffmpeg.resolved = true
+	}
+	if ffmpeg.path == "" {
+		return "", ErrFFmpegUnavailable
+	}
+	return ffmpeg.path, nil
+}
+
+// ffmpegCommand prepares an ffmpeg invocation with the configured binary
+func ffmpegCommand(args ...string) (*exec.Cmd, error) {
+	path, err := ffmpegPath()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(path, args...), nil
+}
@@ -0,0 +1,281 @@
+package audio
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Samples per FLAC frame written by the encoder
+	flacBlockSize = 4096
+
+	// Highest fixed predictor order defined by the format
+	flacMaxFixedOrder = 4
+
+	// Highest residual partition order tried by the encoder
+	flacMaxPartitionOrder = 6
+)
+
+// ArchiveFLAC losslessly converts a WAV file to FLAC next to the original
+// and removes the WAV file, returning the FLAC path. 16-bit PCM is encoded
+// natively; other encodings fall back to ffmpeg when it is installed.
+func ArchiveFLAC(wavPath string) (string, error) {
+	if _, err := os.Stat(wavPath); err != nil {
+		return "", fmt.Errorf("failed to stat WAV file: %w", err)
+	}
+
+	flacPath := strings.TrimSuffix(wavPath, filepath.Ext(wavPath)) + ".flac"
+	tmpPath := flacPath + ".tmp"
+
+	if nativeErr := encodeFLACFile(wavPath, tmpPath); nativeErr != nil {
+		os.Remove(tmpPath)
+		cmd, err := ffmpegCommand("-i", wavPath, "-c:a", "flac", "-f", "flac", "-y", tmpPath)
+		if err != nil {
+			return "", fmt.Errorf("native FLAC encoding failed (%v): %w", nativeErr, err)
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			os.Remove(tmpPath)
+			return "", fmt.Errorf("ffmpeg FLAC encoding failed: %w: %s", err, lastLine(output))
+		}
+	}
+
+	if err := os.Rename(tmpPath, flacPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to finalize FLAC file: %w", err)
+	}
+
+	if err := os.Remove(wavPath); err != nil {
+		return flacPath, fmt.Errorf("failed to remove archived WAV file: %w", err)
+	}
+
+	return flacPath, nil
+}
+
+func encodeFLACFile(wavPath, flacPath string) error {
+	pcm, err := ReadWav(wavPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(flacPath)
+	if err != nil {
+		return fmt.Errorf("failed to create FLAC file: %w", err)
+	}
+
+	buffered := bufio.NewWriter(file)
+	if err := EncodeFLAC(buffered, pcm); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write FLAC file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// ReadFLAC decodes a FLAC file to 16-bit mono samples, up to maxSamples
+// and what the size of the file can code, see DecodeFLAC
+func ReadFLAC(path string, maxSamples int) (*PCM, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open FLAC file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat FLAC file: %w", err)
+	}
+	return DecodeFLAC(bufio.NewReader(file), flacMaxSamples(info.Size(), maxSamples))
+}
+
+// flacMaxSamples returns the most samples a FLAC file of size bytes can
+// hold, at most limit
+func flacMaxSamples(size int64, limit int) int {
+	if size > int64(limit/flacMaxSamplesPerByte) {
+		return limit
+	}
+	return int(size) * flacMaxSamplesPerByte
+}
+
+// bitWriter packs values most significant bit first
+type bitWriter struct {
+	buf   []byte
+	cur   uint64
+	nbits uint
+}
+
+func (w *bitWriter) writeBits(value uint64, n uint) {
+	for n > 0 {
+		take := n
+		if take > 32 {
+			take = 32
+		}
+		n -= take
+		w.cur = w.cur<<take | (value>>n)&(1<<take-1)
+		w.nbits += take
+		for w.nbits >= 8 {
+			w.nbits -= 8
+			w.buf = append(w.buf, byte(w.cur>>w.nbits))
+		}
+	}
+}
+
+func (w *bitWriter) writeSigned(value int64, n uint) {
+	w.writeBits(uint64(value)&(1<<n-1), n)
+}
+
+func (w *bitWriter) writeUnary(q uint64) {
+	for q >= 32 {
+		w.writeBits(0, 32)
+		q -= 32
+	}
+	w.writeBits(1, uint(q)+1)
+}
+
+// align pads with zero bits up to the next byte boundary
+func (w *bitWriter) align() {
+	if w.nbits > 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// bitReader reads values most significant bit first
+type bitReader struct {
+	r     io.ByteReader
+	cur   uint64
+	nbits uint
+
+	// Bytes consumed, used for frame CRCs
+	crc8  byte
+	crc16 uint16
+}
+
+func (r *bitReader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	r.crc8 = crc8Table[r.crc8^b]
+	r.crc16 = r.crc16<<8 ^ crc16Table[byte(r.crc16>>8)^b]
+	return b, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var value uint64
+	for n > 0 {
+		if r.nbits == 0 {
+			b, err := r.readByte()
+			if err != nil {
+				return 0, err
+			}
+			r.cur = uint64(b)
+			r.nbits = 8
+		}
+		take := n
+		if take > r.nbits {
+			take = r.nbits
+		}
+		r.nbits -= take
+		n -= take
+		value = value<<take | (r.cur>>r.nbits)&(1<<take-1)
+	}
+	return value, nil
+}
+
+func (r *bitReader) readSigned(n uint) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	value, err := r.readBits(n)
+	if err != nil {
+		return 0, err
+	}
+	// Sign extend
+	shift := 64 - n
+	return int64(value<<shift) >> shift, nil
+}
+
+func (r *bitReader) readUnary() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			return q, nil
+		}
+		q++
+	}
+}
+
+// align discards bits up to the next byte boundary
+func (r *bitReader) align() {
+	r.nbits = 0
+}
+
+func (r *bitReader) resetCRC() {
+	r.crc8 = 0
+	r.crc16 = 0
+}
+
+var (
+	crc8Table  [256]byte
+	crc16Table [256]uint16
+
+	errNotFLAC = errors.New("not a FLAC stream")
+)
+
+func init() {
+	// CRC-8 polynomial x^8 + x^2 + x^1 + x^0, CRC-16 polynomial
+	// x^16 + x^15 + x^2 + x^0, as used by FLAC frame headers and footers
+	for i := 0; i < 256; i++ {
+		c8 := byte(i)
+		c16 := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		crc8Table[i] = c8
+		crc16Table[i] = c16
+	}
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc = crc8Table[crc^b]
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,527 @@
+package audio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Samples a FLAC frame can code per byte at most, a mono frame of 65536
+// samples in a constant subframe taking 12 bytes. No file decodes to more
+// samples than its size times this.
+const flacMaxSamplesPerByte = 65536/12 + 1
+
+// DecodeFLAC decodes a FLAC stream, mixing multiple channels down to mono
+// and scaling other bit depths to 16 bits. Decoding fails with ErrTooLong
+// once the samples pass maxSamples or the count STREAMINFO declares, so a
+// corrupt or hostile stream cannot exhaust memory.
+func DecodeFLAC(r io.Reader, maxSamples int) (*PCM, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	reader := &bitReader{r: br}
+
+	info, err := readFLACMetadata(reader)
+	if err != nil {
+		return nil, err
+	}
+	if info.totalSamples > 0 && info.totalSamples < uint64(maxSamples) {
+		maxSamples = int(info.totalSamples)
+	}
+
+	// The declared count is not trusted for the allocation, samples grow
+	// as frames are decoded
+	samples := make([]int16, 0, min(maxSamples, flacBlockSize))
+	for {
+		// Frames are byte aligned, a clean end of stream falls between them
+		first, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FLAC frame: %w", err)
+		}
+
+		block, err := decodeFLACFrame(reader, first, info)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF && len(samples) > 0 {
+				// Truncated file, keep the frames that were complete
+				break
+			}
+			return nil, fmt.Errorf("failed to decode FLAC frame: %w", err)
+		}
+		if len(samples)+len(block) > maxSamples {
+			return nil, fmt.Errorf("FLAC stream passes %d samples: %w", maxSamples, ErrTooLong)
+		}
+		samples = append(samples, block...)
+	}
+
+	return &PCM{Samples: samples, SampleRate: info.sampleRate}, nil
+}
+
+// flacInfo holds the STREAMINFO fields the decoder needs
+type flacInfo struct {
+	sampleRate    int
+	bitsPerSample int
+	totalSamples  uint64
+}
+
+func readFLACMetadata(r *bitReader) (*flacInfo, error) {
+	marker, err := r.readBits(32)
+	if err != nil {
+		return nil, errNotFLAC
+	}
+
+	// Skip an ID3v2 tag some tools put in front of the stream
+	if marker>>8 == 0x494433 {
+		if _, err := r.readBits(16); err != nil {
+			return nil, errNotFLAC
+		}
+		var size uint64
+		for i := 0; i < 4; i++ {
+			b, err := r.readBits(8)
+			if err != nil {
+				return nil, errNotFLAC
+			}
+			size = size<<7 | b&0x7F
+		}
+		for ; size > 0; size-- {
+			if _, err := r.readBits(8); err != nil {
+				return nil, errNotFLAC
+			}
+		}
+		if marker, err = r.readBits(32); err != nil {
+			return nil, errNotFLAC
+		}
+	}
+
+	if marker != 0x664C6143 {
+		return nil, errNotFLAC
+	}
+
+	var info *flacInfo
+	for last := false; !last; {
+		header, err := r.readBits(32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FLAC metadata: %w", err)
+		}
+		last = header>>31 == 1
+		blockType := (header >> 24) & 0x7F
+		length := header & 0xFFFFFF
+
+		if blockType != 0 {
+			for ; length > 0; length-- {
+				if _, err := r.readBits(8); err != nil {
+					return nil, fmt.Errorf("failed to skip FLAC metadata: %w", err)
+				}
+			}
+			continue
+		}
+
+		if length != 34 {
+			return nil, fmt.Errorf("invalid STREAMINFO length %d", length)
+		}
+		fields := []uint{16, 16, 24, 24, 20, 3, 5, 36}
+		values := make([]uint64, len(fields))
+		for i, n := range fields {
+			if values[i], err = r.readBits(n); err != nil {
+				return nil, fmt.Errorf("failed to read STREAMINFO: %w", err)
+			}
+		}
+		// MD5 signature
+		if _, err := r.readBits(64); err != nil {
+			return nil, fmt.Errorf("failed to read STREAMINFO: %w", err)
+		}
+		if _, err := r.readBits(64); err != nil {
+			return nil, fmt.Errorf("failed to read STREAMINFO: %w", err)
+		}
+
+		info = &flacInfo{
+			sampleRate:    int(values[4]),
+			bitsPerSample: int(values[6]) + 1,
+			totalSamples:  values[7],
+		}
+	}
+
+	if info == nil {
+		return nil, fmt.Errorf("missing STREAMINFO block")
+	}
+	return info, nil
+}
+
+// decodeFLACFrame decodes one frame whose first byte was already consumed
+func decodeFLACFrame(r *bitReader, first byte, info *flacInfo) ([]int16, error) {
+	r.resetCRC()
+	r.crc8 = crc8Table[first]
+	r.crc16 = crc16Table[first]
+
+	second, err := r.readBits(8)
+	if err != nil {
+		return nil, err
+	}
+	if first != 0xFF || second&0xFE != 0xF8 {
+		return nil, fmt.Errorf("lost frame sync")
+	}
+
+	header, err := r.readBits(16)
+	if err != nil {
+		return nil, err
+	}
+	blockCode := header >> 12
+	rateCode := (header >> 8) & 0xF
+	channelCode := (header >> 4) & 0xF
+	sizeCode := (header >> 1) & 0x7
+
+	if err := skipUTF8Number(r); err != nil {
+		return nil, err
+	}
+
+	var blockSize int
+	switch {
+	case blockCode == 1:
+		blockSize = 192
+	case blockCode >= 2 && blockCode <= 5:
+		blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		n, err := r.readBits(8)
+		if err != nil {
+			return nil, err
+		}
+		blockSize = int(n) + 1
+	case blockCode == 7:
+		n, err := r.readBits(16)
+		if err != nil {
+			return nil, err
+		}
+		blockSize = int(n) + 1
+	case blockCode >= 8:
+		blockSize = 256 << (blockCode - 8)
+	default:
+		return nil, fmt.Errorf("reserved block size")
+	}
+
+	// Rates coded in the header only matter when they differ from STREAMINFO,
+	// which a single PCM buffer cannot represent anyway
+	switch rateCode {
+	case 12:
+		_, err = r.readBits(8)
+	case 13, 14:
+		_, err = r.readBits(16)
+	case 15:
+		err = fmt.Errorf("invalid sample rate")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bitsPerSample := info.bitsPerSample
+	switch sizeCode {
+	case 0:
+	case 1:
+		bitsPerSample = 8
+	case 2:
+		bitsPerSample = 12
+	case 4:
+		bitsPerSample = 16
+	case 5:
+		bitsPerSample = 20
+	case 6:
+		bitsPerSample = 24
+	case 7:
+		bitsPerSample = 32
+	default:
+		return nil, fmt.Errorf("reserved sample size")
+	}
+
+	expected := r.crc8
+	crc, err := r.readBits(8)
+	if err != nil {
+		return nil, err
+	}
+	if byte(crc) != expected {
+		return nil, fmt.Errorf("frame header CRC mismatch")
+	}
+
+	channels := int(channelCode) + 1
+	if channelCode >= 8 {
+		if channelCode > 10 {
+			return nil, fmt.Errorf("reserved channel assignment")
+		}
+		channels = 2
+	}
+
+	decoded := make([][]int64, channels)
+	for c := range decoded {
+		bps := bitsPerSample
+		// The side channel carries one extra bit
+		if (channelCode == 8 || channelCode == 10) && c == 1 || channelCode == 9 && c == 0 {
+			bps++
+		}
+		if decoded[c], err = decodeFLACSubframe(r, blockSize, bps); err != nil {
+			return nil, err
+		}
+	}
+
+	r.align()
+	expectedCRC := r.crc16
+	footer, err := r.readBits(16)
+	if err != nil {
+		return nil, err
+	}
+	if uint16(footer) != expectedCRC {
+		return nil, fmt.Errorf("frame CRC mismatch")
+	}
+
+	switch channelCode {
+	case 8: // Left, side
+		for i := range decoded[1] {
+			decoded[1][i] = decoded[0][i] - decoded[1][i]
+		}
+	case 9: // Side, right
+		for i := range decoded[0] {
+			decoded[0][i] += decoded[1][i]
+		}
+	case 10: // Mid, side
+		for i := range decoded[0] {
+			mid := decoded[0][i]<<1 | decoded[1][i]&1
+			side := decoded[1][i]
+			decoded[0][i] = (mid + side) >> 1
+			decoded[1][i] = (mid - side) >> 1
+		}
+	}
+
+	out := make([]int16, blockSize)
+	for i := range out {
+		var sum int64
+		for c := range decoded {
+			sum += decoded[c][i]
+		}
+		sum /= int64(channels)
+		if bitsPerSample > 16 {
+			sum >>= uint(bitsPerSample - 16)
+		} else {
+			sum <<= uint(16 - bitsPerSample)
+		}
+		out[i] = int16(sum)
+	}
+	return out, nil
+}
+
+func decodeFLACSubframe(r *bitReader, blockSize, bps int) ([]int64, error) {
+	header, err := r.readBits(8)
+	if err != nil {
+		return nil, err
+	}
+	if header&0x80 != 0 {
+		return nil, fmt.Errorf("invalid subframe padding")
+	}
+	kind := (header >> 1) & 0x3F
+
+	wasted := 0
+	if header&1 == 1 {
+		k, err := r.readUnary()
+		if err != nil {
+			return nil, err
+		}
+		wasted = int(k) + 1
+		bps -= wasted
+	}
+
+	samples := make([]int64, blockSize)
+	switch {
+	case kind == 0: // CONSTANT
+		value, err := r.readSigned(uint(bps))
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = value
+		}
+
+	case kind == 1: // VERBATIM
+		for i := range samples {
+			if samples[i], err = r.readSigned(uint(bps)); err != nil {
+				return nil, err
+			}
+		}
+
+	case kind >= 8 && kind <= 12: // FIXED
+		order := int(kind & 0x7)
+		if err := decodeWarmup(r, samples, order, bps); err != nil {
+			return nil, err
+		}
+		if err := decodeResidual(r, samples, order); err != nil {
+			return nil, err
+		}
+		restoreFixed(samples, order)
+
+	case kind >= 32: // LPC
+		order := int(kind&0x1F) + 1
+		if err := decodeWarmup(r, samples, order, bps); err != nil {
+			return nil, err
+		}
+		precision, err := r.readBits(4)
+		if err != nil {
+			return nil, err
+		}
+		if precision == 15 {
+			return nil, fmt.Errorf("invalid LPC precision")
+		}
+		shift, err := r.readSigned(5)
+		if err != nil {
+			return nil, err
+		}
+		if shift < 0 {
+			return nil, fmt.Errorf("negative LPC shift")
+		}
+		coeffs := make([]int64, order)
+		for i := range coeffs {
+			if coeffs[i], err = r.readSigned(uint(precision + 1)); err != nil {
+				return nil, err
+			}
+		}
+		if err := decodeResidual(r, samples, order); err != nil {
+			return nil, err
+		}
+		for i := order; i < len(samples); i++ {
+			var sum int64
+			for j, c := range coeffs {
+				sum += c * samples[i-j-1]
+			}
+			samples[i] += sum >> uint(shift)
+		}
+
+	default:
+		return nil, fmt.Errorf("reserved subframe type %d", kind)
+	}
+
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= uint(wasted)
+		}
+	}
+	return samples, nil
+}
+
+func decodeWarmup(r *bitReader, samples []int64, order, bps int) error {
+	if order > len(samples) {
+		return fmt.Errorf("predictor order %d exceeds block size", order)
+	}
+	for i := 0; i < order; i++ {
+		value, err := r.readSigned(uint(bps))
+		if err != nil {
+			return err
+		}
+		samples[i] = value
+	}
+	return nil
+}
+
+// decodeResidual reads the partitioned Rice coded residual into samples
+// after the warm-up samples
+func decodeResidual(r *bitReader, samples []int64, predictorOrder int) error {
+	method, err := r.readBits(2)
+	if err != nil {
+		return err
+	}
+	paramBits := uint(4)
+	switch method {
+	case 0:
+	case 1:
+		paramBits = 5
+	default:
+		return fmt.Errorf("reserved residual coding method")
+	}
+	escape := uint64(1)<<paramBits - 1
+
+	order, err := r.readBits(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << order
+	partitionSize := len(samples) >> order
+	if partitionSize<<order != len(samples) || partitionSize < predictorOrder {
+		return fmt.Errorf("invalid residual partition order")
+	}
+
+	i := predictorOrder
+	for p := 0; p < partitions; p++ {
+		end := (p + 1) * partitionSize
+
+		k, err := r.readBits(paramBits)
+		if err != nil {
+			return err
+		}
+
+		if k == escape {
+			n, err := r.readBits(5)
+			if err != nil {
+				return err
+			}
+			for ; i < end; i++ {
+				if samples[i], err = r.readSigned(uint(n)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		for ; i < end; i++ {
+			q, err := r.readUnary()
+			if err != nil {
+				return err
+			}
+			low, err := r.readBits(uint(k))
+			if err != nil {
+				return err
+			}
+			u := q<<k | low
+			samples[i] = int64(u>>1) ^ -int64(u&1)
+		}
+	}
+	return nil
+}
+
+// restoreFixed undoes the fixed polynomial predictor in place
+func restoreFixed(samples []int64, order int) {
+	for i := order; i < len(samples); i++ {
+		switch order {
+		case 1:
+			samples[i] += samples[i-1]
+		case 2:
+			samples[i] += 2*samples[i-1] - samples[i-2]
+		case 3:
+			samples[i] += 3*samples[i-1] - 3*samples[i-2] + samples[i-3]
+		case 4:
+			samples[i] += 4*samples[i-1] - 6*samples[i-2] + 4*samples[i-3] - samples[i-4]
+		}
+	}
+}
+
+func skipUTF8Number(r *bitReader) error {
+	first, err := r.readBits(8)
+	if err != nil {
+		return err
+	}
+	extra := 0
+	for mask := uint64(0x80); first&mask != 0 && mask > 1; mask >>= 1 {
+		extra++
+	}
+	if extra == 1 || extra > 7 {
+		return fmt.Errorf("invalid frame number")
+	}
+	if extra > 0 {
+		extra--
+	}
+	for ; extra > 0; extra-- {
+		b, err := r.readBits(8)
+		if err != nil {
+			return err
+		}
+		if b&0xC0 != 0x80 {
+			return fmt.Errorf("invalid frame number")
+		}
+	}
+	return nil
+}
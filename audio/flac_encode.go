@@ -0,0 +1,264 @@
+package audio
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// EncodeFLAC writes mono 16-bit samples as a FLAC stream. Each block uses
+// the best fixed predictor with partitioned Rice coding of the residual.
+func EncodeFLAC(w io.Writer, pcm *PCM) error {
+	if pcm.SampleRate <= 0 || pcm.SampleRate >= 1<<20 {
+		return fmt.Errorf("unsupported sample rate %d", pcm.SampleRate)
+	}
+
+	if _, err := w.Write(flacStreamInfo(pcm)); err != nil {
+		return fmt.Errorf("failed to write FLAC header: %w", err)
+	}
+
+	residual := make([]int64, flacBlockSize)
+	for frame, start := 0, 0; start < len(pcm.Samples); frame, start = frame+1, start+flacBlockSize {
+		end := start + flacBlockSize
+		if end > len(pcm.Samples) {
+			end = len(pcm.Samples)
+		}
+		if _, err := w.Write(encodeFLACFrame(frame, pcm.Samples[start:end], residual)); err != nil {
+			return fmt.Errorf("failed to write FLAC frame: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// flacStreamInfo builds the stream marker and the STREAMINFO block
+func flacStreamInfo(pcm *PCM) []byte {
+	var bw bitWriter
+	bw.writeBits(uint64('f')<<24|uint64('L')<<16|uint64('a')<<8|uint64('C'), 32)
+
+	// Last metadata block, type STREAMINFO, 34 bytes
+	bw.writeBits(1, 1)
+	bw.writeBits(0, 7)
+	bw.writeBits(34, 24)
+
+	blockSize := uint64(flacBlockSize)
+	if len(pcm.Samples) < flacBlockSize {
+		blockSize = uint64(len(pcm.Samples))
+		if blockSize < 16 {
+			blockSize = 16
+		}
+	}
+	bw.writeBits(blockSize, 16) // Minimum block size
+	bw.writeBits(blockSize, 16) // Maximum block size
+	bw.writeBits(0, 24)         // Minimum frame size, unknown
+	bw.writeBits(0, 24)         // Maximum frame size, unknown
+	bw.writeBits(uint64(pcm.SampleRate), 20)
+	bw.writeBits(0, 3)  // Channels - 1
+	bw.writeBits(15, 5) // Bits per sample - 1
+	bw.writeBits(uint64(len(pcm.Samples)), 36)
+
+	// MD5 of the unencoded little endian samples
+	raw := make([]byte, len(pcm.Samples)*2)
+	for i, sample := range pcm.Samples {
+		binary.LittleEndian.PutUint16(raw[i*2:], uint16(sample))
+	}
+	sum := md5.Sum(raw)
+	for _, b := range sum {
+		bw.writeBits(uint64(b), 8)
+	}
+
+	return bw.bytes()
+}
+
+func encodeFLACFrame(frame int, block []int16, residual []int64) []byte {
+	var bw bitWriter
+
+	// Frame header
+	bw.writeBits(0x3FFE, 14) // Sync code
+	bw.writeBits(0, 1)       // Reserved
+	bw.writeBits(0, 1)       // Fixed block size
+	if len(block) == flacBlockSize {
+		bw.writeBits(0xC, 4) // 4096 samples
+	} else {
+		bw.writeBits(0x7, 4) // 16-bit block size - 1 at end of header
+	}
+	bw.writeBits(0, 4) // Sample rate from STREAMINFO
+	bw.writeBits(0, 4) // Mono
+	bw.writeBits(4, 3) // 16 bits per sample
+	bw.writeBits(0, 1) // Reserved
+	writeUTF8Number(&bw, uint64(frame))
+	if len(block) != flacBlockSize {
+		bw.writeBits(uint64(len(block)-1), 16)
+	}
+	bw.writeBits(uint64(crc8(bw.bytes())), 8)
+
+	encodeFLACSubframe(&bw, block, residual[:len(block)])
+
+	// Frame footer
+	bw.align()
+	bw.writeBits(uint64(crc16(bw.bytes())), 16)
+
+	return bw.bytes()
+}
+
+// encodeFLACSubframe writes a CONSTANT subframe for silence, otherwise the
+// fixed predictor order with the smallest residual
+func encodeFLACSubframe(bw *bitWriter, block []int16, residual []int64) {
+	constant := true
+	for _, sample := range block[1:] {
+		if sample != block[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		bw.writeBits(0, 1) // Padding
+		bw.writeBits(0, 6) // CONSTANT
+		bw.writeBits(0, 1) // No wasted bits
+		bw.writeSigned(int64(block[0]), 16)
+		return
+	}
+
+	bestOrder := 0
+	bestCost := uint64(math.MaxUint64)
+	for order := 0; order <= flacMaxFixedOrder && order < len(block); order++ {
+		fixedResidual(block, order, residual)
+		var cost uint64
+		for _, r := range residual[order:] {
+			if r < 0 {
+				cost += uint64(-r)
+			} else {
+				cost += uint64(r)
+			}
+		}
+		if cost < bestCost {
+			bestCost = cost
+			bestOrder = order
+		}
+	}
+	fixedResidual(block, bestOrder, residual)
+
+	bw.writeBits(0, 1)                      // Padding
+	bw.writeBits(uint64(0x08|bestOrder), 6) // FIXED with order
+	bw.writeBits(0, 1)                      // No wasted bits
+	for _, sample := range block[:bestOrder] {
+		bw.writeSigned(int64(sample), 16)
+	}
+	writeResidual(bw, residual, bestOrder)
+}
+
+// fixedResidual computes the residual of the fixed polynomial predictor
+func fixedResidual(block []int16, order int, residual []int64) {
+	for i := order; i < len(block); i++ {
+		s := func(j int) int64 { return int64(block[i-j]) }
+		switch order {
+		case 0:
+			residual[i] = s(0)
+		case 1:
+			residual[i] = s(0) - s(1)
+		case 2:
+			residual[i] = s(0) - 2*s(1) + s(2)
+		case 3:
+			residual[i] = s(0) - 3*s(1) + 3*s(2) - s(3)
+		case 4:
+			residual[i] = s(0) - 4*s(1) + 6*s(2) - 4*s(3) + s(4)
+		}
+	}
+}
+
+// writeResidual picks the partition order and per-partition Rice
+// parameters giving the smallest output
+func writeResidual(bw *bitWriter, residual []int64, predictorOrder int) {
+	blockSize := len(residual)
+
+	bestOrder := 0
+	var bestParams []uint
+	bestBits := uint64(math.MaxUint64)
+	for order := 0; order <= flacMaxPartitionOrder; order++ {
+		partitions := 1 << order
+		if blockSize%partitions != 0 || blockSize/partitions <= predictorOrder {
+			break
+		}
+		params := make([]uint, partitions)
+		var bits uint64
+		for p := 0; p < partitions; p++ {
+			start, end := partitionBounds(p, blockSize, order, predictorOrder)
+			k, cost := bestRiceParameter(residual[start:end])
+			params[p] = k
+			bits += cost + 4
+		}
+		if bits < bestBits {
+			bestBits = bits
+			bestOrder = order
+			bestParams = params
+		}
+	}
+
+	bw.writeBits(0, 2) // Rice coding with 4-bit parameters
+	bw.writeBits(uint64(bestOrder), 4)
+	for p, k := range bestParams {
+		start, end := partitionBounds(p, blockSize, bestOrder, predictorOrder)
+		bw.writeBits(uint64(k), 4)
+		for _, r := range residual[start:end] {
+			u := zigzag(r)
+			bw.writeUnary(u >> k)
+			if k > 0 {
+				bw.writeBits(u&(1<<k-1), k)
+			}
+		}
+	}
+}
+
+func partitionBounds(partition, blockSize, order, predictorOrder int) (int, int) {
+	size := blockSize >> order
+	start := partition * size
+	end := start + size
+	if partition == 0 {
+		start = predictorOrder
+	}
+	return start, end
+}
+
+// bestRiceParameter returns the Rice parameter with the fewest bits for the
+// residual and that bit count
+func bestRiceParameter(residual []int64) (uint, uint64) {
+	bestK := uint(0)
+	bestBits := uint64(math.MaxUint64)
+	for k := uint(0); k < 15; k++ {
+		bits := uint64(0)
+		for _, r := range residual {
+			bits += (zigzag(r) >> k) + 1 + uint64(k)
+		}
+		if bits < bestBits {
+			bestBits = bits
+			bestK = k
+		}
+	}
+	return bestK, bestBits
+}
+
+func zigzag(r int64) uint64 {
+	return uint64((r << 1) ^ (r >> 63))
+}
+
+// writeUTF8Number encodes the frame number with FLAC's UTF-8 like scheme
+func writeUTF8Number(bw *bitWriter, n uint64) {
+	if n < 0x80 {
+		bw.writeBits(n, 8)
+		return
+	}
+
+	// Count continuation bytes needed, each carries 6 bits
+	extra := 1
+	for n >= 1<<(uint(extra)*5+6) {
+		extra++
+	}
+
+	lead := uint64(0xFF<<(7-uint(extra))) & 0xFF
+	bw.writeBits(lead|n>>(uint(extra)*6), 8)
+	for i := extra - 1; i >= 0; i-- {
+		bw.writeBits(0x80|(n>>(uint(i)*6))&0x3F, 8)
+	}
+}
@@ -0,0 +1,233 @@
+package audio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+func encodeFLAC(t testing.TB, pcm *audio.PCM) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := audio.EncodeFLAC(&buf, pcm); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// setTotalSamples rewrites the sample count in the STREAMINFO block of an
+// encoded stream, the low 36 bits of the 8 bytes after the block sizes
+func setTotalSamples(data []byte, n uint64) []byte {
+	data = slices.Clone(data)
+	fields := binary.BigEndian.Uint64(data[18:26])
+	fields = fields&^(1<<36-1) | n&(1<<36-1)
+	binary.BigEndian.PutUint64(data[18:26], fields)
+	return data
+}
+
+func TestFLACRoundTrip(t *testing.T) {
+	kinds := map[string]func(rate int, d time.Duration) *audio.PCM{
+		"speech":  func(rate int, d time.Duration) *audio.PCM { return audiotest.Speech(rate, d, -3) },
+		"noise":   func(rate int, d time.Duration) *audio.PCM { return audiotest.Noise(rate, d, -6, 1) },
+		"tone":    func(rate int, d time.Duration) *audio.PCM { return audiotest.Tone(rate, 1000, d, 0) },
+		"silence": func(rate int, d time.Duration) *audio.PCM { return audiotest.Silence(rate, d) },
+	}
+	for _, rate := range []int{8000, 16000, 44100, 48000, 96000} {
+		for _, length := range []int{1, 2, 5, 4095, 4096, 4097, 3*4096 + 17} {
+			for name, generate := range kinds {
+				pcm := generate(rate, time.Duration(length)*time.Second/time.Duration(rate)+time.Second/time.Duration(2*rate))
+				pcm.Samples = pcm.Samples[:length]
+
+				decoded, err := audio.DecodeFLAC(bytes.NewReader(encodeFLAC(t, pcm)), audio.MaxSamples)
+				if err != nil {
+					t.Errorf("%s of %d samples at %d Hz: %v", name, length, rate, err)
+					continue
+				}
+				if decoded.SampleRate != rate {
+					t.Errorf("%s of %d samples at %d Hz: decoded at %d Hz", name, length, rate, decoded.SampleRate)
+				}
+				if !slices.Equal(decoded.Samples, pcm.Samples) {
+					t.Errorf("%s of %d samples at %d Hz: samples differ", name, length, rate)
+				}
+			}
+		}
+	}
+}
+
+func TestReadAudioLimit(t *testing.T) {
+	pcm := audiotest.Speech(16000, 2*time.Second, -6)
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "speech.flac")
+	if err := os.WriteFile(flacPath, encodeFLAC(t, pcm), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wavPath, err := audiotest.WriteWav(dir, "speech.wav", pcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := map[string]func(path string, maxSamples int) (*audio.PCM, error){
+		"ReadFLAC":       audio.ReadFLAC,
+		"ReadAudioLimit": audio.ReadAudioLimit,
+	}
+	for name, read := range readers {
+		for _, path := range []string{flacPath, wavPath} {
+			if name == "ReadFLAC" && path == wavPath {
+				continue
+			}
+			decoded, err := read(path, len(pcm.Samples))
+			if err != nil {
+				t.Fatalf("%s of %s: %v", name, filepath.Base(path), err)
+			}
+			if !slices.Equal(decoded.Samples, pcm.Samples) {
+				t.Errorf("%s of %s: samples differ", name, filepath.Base(path))
+			}
+			if _, err := read(path, len(pcm.Samples)-1); !errors.Is(err, audio.ErrTooLong) {
+				t.Errorf("%s of %s past the limit: got %v, want ErrTooLong", name, filepath.Base(path), err)
+			}
+		}
+	}
+
+	out := filepath.Join(dir, "whisper.wav")
+	if err := audio.ConvertForWhisper(flacPath, out, audio.ConvertOptions{MaxSamples: 16000}); !errors.Is(err, audio.ErrTooLong) {
+		t.Errorf("ConvertForWhisper past the limit: got %v, want ErrTooLong", err)
+	}
+}
+
+func TestDecodeFLACMalformed(t *testing.T) {
+	valid := encodeFLAC(t, audiotest.Noise(16000, time.Second, -6, 1))
+	const firstFrame = 42 // Marker and STREAMINFO
+
+	flipped := func(at int) []byte {
+		data := slices.Clone(valid)
+		data[at] ^= 0x10
+		return data
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		maxSamples int
+		// Samples decoded, or -1 for an error
+		want int
+		// Error the failure wraps, if any in particular
+		err error
+	}{
+		{"empty", nil, audio.MaxSamples, -1, nil},
+		{"not FLAC", []byte("RIFF\x00\x00\x00\x00WAVE"), audio.MaxSamples, -1, nil},
+		{"truncated STREAMINFO", valid[:30], audio.MaxSamples, -1, nil},
+		{"truncated in the first frame", valid[:firstFrame+100], audio.MaxSamples, -1, nil},
+		{"truncated in the third frame", valid[:len(valid)*2/3], audio.MaxSamples, 2 * 4096, nil},
+		{"bad frame header CRC", flipped(firstFrame + 5), audio.MaxSamples, -1, nil},
+		{"bad frame CRC", flipped(firstFrame + 200), audio.MaxSamples, -1, nil},
+		{"lost sync", flipped(firstFrame), audio.MaxSamples, -1, nil},
+		{"huge declared length without frames", setTotalSamples(valid[:firstFrame], 1<<36-1), audio.MaxSamples, 0, nil},
+		{"huge declared length", setTotalSamples(valid, 1<<36-1), audio.MaxSamples, 16000, nil},
+		{"more samples than declared", setTotalSamples(valid, 5000), audio.MaxSamples, -1, audio.ErrTooLong},
+		{"more samples than allowed", valid, 8000, -1, audio.ErrTooLong},
+	}
+	for _, tt := range tests {
+		pcm, err := audio.DecodeFLAC(bytes.NewReader(tt.data), tt.maxSamples)
+		switch {
+		case tt.want < 0 && err == nil:
+			t.Errorf("%s: decoded %d samples, want an error", tt.name, len(pcm.Samples))
+		case tt.want < 0 && tt.err != nil && !errors.Is(err, tt.err):
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		case tt.want >= 0 && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want >= 0 && len(pcm.Samples) != tt.want:
+			t.Errorf("%s: decoded %d samples, want %d", tt.name, len(pcm.Samples), tt.want)
+		}
+	}
+}
+
+// Frames of 65536 samples in 13 bytes come close to the most samples per
+// byte the format can code, and still decode within the size bound ReadFLAC
+// sets, while a smaller limit stops them
+func TestReadFLACSizeLimit(t *testing.T) {
+	const frames = 100
+	data := setTotalSamples(encodeFLAC(t, &audio.PCM{Samples: []int16{0}, SampleRate: 16000})[:42], 0)
+	for i := range frames {
+		data = append(data, constantFrame(i)...)
+	}
+	path := filepath.Join(t.TempDir(), "dense.flac")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pcm, err := audio.ReadFLAC(path, audio.MaxSamples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcm.Samples) != frames*65536 {
+		t.Fatalf("decoded %d samples, want %d", len(pcm.Samples), frames*65536)
+	}
+
+	if _, err := audio.DecodeFLAC(bytes.NewReader(data), frames*65536-1); !errors.Is(err, audio.ErrTooLong) {
+		t.Fatalf("got %v, want ErrTooLong", err)
+	}
+}
+
+// constantFrame builds a mono 16-bit frame of 65536 zero samples, numbered
+// below 128 to keep the number a single byte
+func constantFrame(number int) []byte {
+	frame := []byte{0xFF, 0xF8, 0x70, 0x08, byte(number), 0xFF, 0xFF}
+	frame = append(frame, crc8(frame))
+	frame = append(frame, 0x00, 0x00, 0x00) // CONSTANT subframe of 0
+	crc := crc16(frame)
+	return append(frame, byte(crc>>8), byte(crc))
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func FuzzDecodeFLAC(f *testing.F) {
+	for _, pcm := range []*audio.PCM{
+		audiotest.Speech(16000, 300*time.Millisecond, -6),
+		audiotest.Silence(8000, 10*time.Millisecond),
+		{Samples: []int16{1, -1, 32767, -32768}, SampleRate: 44100},
+	} {
+		f.Add(encodeFLAC(f, pcm))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const limit = 1 << 20
+		pcm, err := audio.DecodeFLAC(bytes.NewReader(data), limit)
+		if err == nil && len(pcm.Samples) > limit {
+			panic(fmt.Sprintf("decoded %d samples past the limit", len(pcm.Samples)))
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package audio
+
+import "math"
+
+const (
+	// Cutoff that removes rumble and handling noise without touching speech
+	DefaultHighPassHz = 80
+
+	// Corner of the DC blocker used when no cutoff is configured
+	dcBlockerHz = 10
+)
+
+// HighPassFilter removes DC offset and low-frequency rumble. It keeps its
+// state between calls so a stream can be filtered chunk by chunk.
+type HighPassFilter struct {
+	filter biquad
+}
+
+// NewHighPassFilter creates a second order Butterworth high-pass filter. A
+// cutoff of zero or less gives a first order DC blocker instead.
+func NewHighPassFilter(sampleRate int, cutoffHz float64) *HighPassFilter {
+	rate := float64(sampleRate)
+	if cutoffHz <= 0 {
+		r := 1 - 2*math.Pi*dcBlockerHz/rate
+		return &HighPassFilter{filter: biquad{b0: 1, b1: -1, a1: -r}}
+	}
+
+	k := math.Tan(math.Pi * cutoffHz / rate)
+	q := 1 / math.Sqrt2
+	norm := 1 / (1 + k/q + k*k)
+	return &HighPassFilter{filter: biquad{
+		b0: norm,
+		b1: -2 * norm,
+		b2: norm,
+		a1: 2 * (k*k - 1) * norm,
+		a2: (1 - k/q + k*k) * norm,
+	}}
+}
+
+// Process filters samples in place
+func (f *HighPassFilter) Process(samples []int16) {
+	for i, s := range samples {
+		samples[i] = clampInt16(f.filter.process(float64(s)))
+	}
+}
+
+// Reset clears the filter history, for example between recordings
+func (f *HighPassFilter) Reset() {
+	f.filter.x1, f.filter.x2 = 0, 0
+	f.filter.y1, f.filter.y2 = 0, 0
+}
+
+// HighPass returns a filtered copy of the samples, see NewHighPassFilter
+func HighPass(samples []int16, sampleRate int, cutoffHz float64) []int16 {
+	out := make([]int16, len(samples))
+	copy(out, samples)
+	NewHighPassFilter(sampleRate, cutoffHz).Process(out)
+	return out
+}
@@ -0,0 +1,178 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// DefaultTargetLUFS is the EBU R128 programme loudness target
+	DefaultTargetLUFS = -23.0
+
+	// Largest boost applied by NormalizeLoudness, keeps near-silent
+	// recordings from turning into amplified noise
+	maxNormalizeGainDB = 30.0
+
+	// Sample peak ceiling after normalization, in dBFS
+	normalizeCeilingDB = -1.0
+
+	// Gating block length and hop as defined by ITU-R BS.1770
+	gatingBlock = 400 * time.Millisecond
+	gatingStep  = 100 * time.Millisecond
+
+	absoluteGateLUFS = -70.0
+	relativeGateLU   = -10.0
+)
+
+// IntegratedLoudness measures the gated integrated loudness of mono 16-bit
+// samples in LUFS following ITU-R BS.1770 / EBU R128. Silence returns
+// negative infinity.
+func IntegratedLoudness(samples []int16, sampleRate int) float64 {
+	if len(samples) == 0 || sampleRate <= 0 {
+		return math.Inf(-1)
+	}
+
+	weighted := kWeight(samples, sampleRate)
+
+	blockLen := durationToSamples(gatingBlock, sampleRate)
+	stepLen := durationToSamples(gatingStep, sampleRate)
+	if blockLen > len(weighted) {
+		// Too short for a full block, measure the whole recording
+		blockLen = len(weighted)
+	}
+
+	powers := make([]float64, 0, len(weighted)/stepLen+1)
+	for start := 0; start+blockLen <= len(weighted); start += stepLen {
+		var sum float64
+		for _, v := range weighted[start : start+blockLen] {
+			sum += v * v
+		}
+		powers = append(powers, sum/float64(blockLen))
+	}
+
+	gated := func(threshold float64) (float64, int) {
+		var sum float64
+		count := 0
+		for _, p := range powers {
+			if blockLoudness(p) > threshold {
+				sum += p
+				count++
+			}
+		}
+		if count == 0 {
+			return 0, 0
+		}
+		return sum / float64(count), count
+	}
+
+	mean, count := gated(absoluteGateLUFS)
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	mean, count = gated(blockLoudness(mean) + relativeGateLU)
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	return blockLoudness(mean)
+}
+
+// NormalizeLoudness returns a copy of the samples with a constant gain
+// bringing their integrated loudness to targetLUFS. The gain is limited so
+// peaks stay below -1 dBFS and quiet recordings are boosted by at most 30 dB.
+func NormalizeLoudness(samples []int16, sampleRate int, targetLUFS float64) []int16 {
+	out := make([]int16, len(samples))
+	copy(out, samples)
+
+	loudness := IntegratedLoudness(samples, sampleRate)
+	if math.IsInf(loudness, -1) {
+		return out
+	}
+
+	gainDB := math.Min(targetLUFS-loudness, maxNormalizeGainDB)
+
+	peak := 0
+	for _, s := range samples {
+		if v := abs(int(s)); v > peak {
+			peak = v
+		}
+	}
+	if peak > 0 {
+		peakDB := 20 * math.Log10(float64(peak)/32768)
+		gainDB = math.Min(gainDB, normalizeCeilingDB-peakDB)
+	}
+
+	gain := math.Pow(10, gainDB/20)
+	for i, s := range samples {
+		out[i] = clampInt16(float64(s) * gain)
+	}
+	return out
+}
+
+func blockLoudness(meanSquare float64) float64 {
+	return -0.691 + 10*math.Log10(meanSquare)
+}
+
+// kWeight applies the BS.1770 K-weighting pre-filter (a high shelf followed
+// by a high-pass), scaling samples to [-1, 1]
+func kWeight(samples []int16, sampleRate int) []float64 {
+	rate := float64(sampleRate)
+
+	// Stage 1, high shelf modelling the acoustic effect of the head
+	f0 := 1681.974450955533
+	g := 3.999843853973347
+	q := 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, g/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// Stage 2, RLB high-pass
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / rate)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	out := make([]float64, len(samples))
+	for i, s := range samples {
+		out[i] = highPass.process(shelf.process(float64(s) / 32768))
+	}
+	return out
+}
+
+// biquad is a direct form I second order IIR filter
+type biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+
+	x1, x2 float64
+	y1, y2 float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
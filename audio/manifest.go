@@ -0,0 +1,197 @@
+package audio
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Name of the per-day checksum manifest kept in each day directory
+const ManifestFile = "manifest.jsonl"
+
+// Serializes appends from the server and scribe, which share day directories
+var manifestMu sync.Mutex
+
+// ManifestEntry is one line of a day's manifest. Later entries for the same
+// file replace earlier ones.
+type ManifestEntry struct {
+	// Path relative to the day directory, <clientID>/<file>
+	File string `json:"file"`
+
+	// Hex encoded SHA-256 of the file contents
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Size in bytes
+	Size int64 `json:"size,omitempty"`
+
+	// When the entry was written
+	Time time.Time `json:"time"`
+
+	// Set when the file was deliberately deleted or replaced
+	Removed bool `json:"removed,omitempty"`
+}
+
+// VerifyReport lists the outcome of checking a day's manifest
+type VerifyReport struct {
+	Day       string   `json:"day"`
+	Verified  int      `json:"verified"`
+	Corrupted []string `json:"corrupted"`
+	Missing   []string `json:"missing"`
+}
+
+// OK reports whether every file in the manifest is intact
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupted) == 0 && len(r.Missing) == 0
+}
+
+// RecordChecksum hashes a finalized recording, stored as
+// <day>/<clientID>/<file>, and appends it to the day's manifest
+func RecordChecksum(path string) error {
+	sum, size, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+
+	dayDir, rel := manifestLocation(path)
+	return appendManifest(dayDir, ManifestEntry{
+		File:   rel,
+		SHA256: sum,
+		Size:   size,
+		Time:   time.Now(),
+	})
+}
+
+// RecordRemoval notes in the manifest that a recording was removed on
+// purpose, so verification does not report it missing
+func RecordRemoval(path string) error {
+	dayDir, rel := manifestLocation(path)
+	return appendManifest(dayDir, ManifestEntry{
+		File:    rel,
+		Time:    time.Now(),
+		Removed: true,
+	})
+}
+
+// VerifyManifest re-hashes every file listed in a day directory's manifest
+func VerifyManifest(dayDir string) (*VerifyReport, error) {
+	entries, err := ReadManifest(dayDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{
+		Day:       filepath.Base(dayDir),
+		Corrupted: make([]string, 0),
+		Missing:   make([]string, 0),
+	}
+
+	files := make([]string, 0, len(entries))
+	for file := range entries {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		entry := entries[file]
+		if entry.Removed {
+			continue
+		}
+
+		sum, _, err := hashFile(filepath.Join(dayDir, filepath.FromSlash(file)))
+		switch {
+		case os.IsNotExist(err):
+			report.Missing = append(report.Missing, file)
+		case err != nil:
+			return nil, err
+		case sum != entry.SHA256:
+			report.Corrupted = append(report.Corrupted, file)
+		default:
+			report.Verified++
+		}
+	}
+
+	return report, nil
+}
+
+// ReadManifest returns the latest entry for each file in a day's manifest.
+// A missing manifest is empty.
+func ReadManifest(dayDir string) (map[string]ManifestEntry, error) {
+	entries := make(map[string]ManifestEntry)
+
+	file, err := os.Open(filepath.Join(dayDir, ManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A crash may leave a partial trailing line
+			continue
+		}
+		entries[entry.File] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	return entries, nil
+}
+
+// manifestLocation splits a recording path into its day directory and the
+// path relative to it
+func manifestLocation(path string) (string, string) {
+	clientDir := filepath.Dir(path)
+	dayDir := filepath.Dir(clientDir)
+	rel := filepath.ToSlash(filepath.Join(filepath.Base(clientDir), filepath.Base(path)))
+	return dayDir, rel
+}
+
+func appendManifest(dayDir string, entry ManifestEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest entry: %w", err)
+	}
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(dayDir, ManifestFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
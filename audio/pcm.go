@@ -0,0 +1,213 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// PCM holds decoded 16-bit mono samples
+type PCM struct {
+	Samples    []int16
+	SampleRate int
+}
+
+// ReadWav decodes a PCM or IEEE float WAV file to 16-bit samples, mixing
+// multiple channels down to mono. Files whose header was never finalized
+// (size fields of zero) are read up to the end of the file.
+func ReadWav(path string) (*PCM, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAV file: %w", err)
+	}
+	defer file.Close()
+
+	return DecodeWav(bufio.NewReader(file))
+}
+
+// DecodeWav decodes a WAV stream, see ReadWav
+func DecodeWav(r io.Reader) (*PCM, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, fmt.Errorf("failed to read RIFF header: %w", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a WAV file")
+	}
+
+	var (
+		format     WavFormat
+		haveFormat bool
+	)
+
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, fmt.Errorf("failed to find data chunk: %w", err)
+		}
+		id := string(chunk[0:4])
+		size := binary.LittleEndian.Uint32(chunk[4:8])
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("invalid fmt chunk size %d", size)
+			}
+			fmtChunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return nil, fmt.Errorf("failed to read fmt chunk: %w", err)
+			}
+			format = parseFormatChunk(fmtChunk)
+			haveFormat = true
+
+		case "data":
+			if !haveFormat {
+				return nil, fmt.Errorf("data chunk before fmt chunk")
+			}
+			if err := format.validate(); err != nil {
+				return nil, err
+			}
+
+			var data []byte
+			var err error
+			if size == 0 || size == 0xFFFFFFFF {
+				// Header was never updated, take everything that is there
+				data, err = io.ReadAll(r)
+			} else {
+				// The size is not trusted for the buffer, a truncated
+				// recording keeps what was written
+				data, err = io.ReadAll(io.LimitReader(r, int64(size)))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read samples: %w", err)
+			}
+
+			return &PCM{
+				Samples:    decodeSamples(data, format),
+				SampleRate: int(format.SampleRate),
+			}, nil
+
+		default:
+			// Skip chunks we do not care about (LIST, fact, ...)
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return nil, fmt.Errorf("failed to skip %q chunk: %w", id, err)
+			}
+		}
+	}
+}
+
+// WriteWav writes mono 16-bit samples as a WAV file
+func WriteWav(path string, pcm *PCM) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create WAV file: %w", err)
+	}
+
+	if err := EncodeWav(file, pcm); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return file.Close()
+}
+
+// EncodeWav writes mono 16-bit samples as a WAV stream
+func EncodeWav(w io.Writer, pcm *PCM) error {
+	buffered := bufio.NewWriter(w)
+	dataSize := uint32(len(pcm.Samples) * 2)
+	if err := writeWavHeader(buffered, PCM16Format(uint32(pcm.SampleRate)), dataSize); err != nil {
+		return fmt.Errorf("failed to write WAV header: %w", err)
+	}
+	if _, err := buffered.Write(encodeInt16(pcm.Samples)); err != nil {
+		return fmt.Errorf("failed to write samples: %w", err)
+	}
+	return buffered.Flush()
+}
+
+// parseFormatChunk reads the fields of a fmt chunk, taking the real format
+// from WAVE_FORMAT_EXTENSIBLE headers
+func parseFormatChunk(chunk []byte) WavFormat {
+	format := WavFormat{
+		AudioFormat:   binary.LittleEndian.Uint16(chunk[0:2]),
+		Channels:      binary.LittleEndian.Uint16(chunk[2:4]),
+		SampleRate:    binary.LittleEndian.Uint32(chunk[4:8]),
+		BitsPerSample: binary.LittleEndian.Uint16(chunk[14:16]),
+	}
+	if format.AudioFormat == 0xFFFE && len(chunk) >= 26 {
+		// The sub-format GUID starts with the format code
+		format.AudioFormat = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+	return format
+}
+
+// decodeInt16 converts little endian interleaved 16-bit samples to mono
+func decodeInt16(data []byte, numChannels int) []int16 {
+	frameSize := 2 * numChannels
+	frames := len(data) / frameSize
+	samples := make([]int16, frames)
+	for i := 0; i < frames; i++ {
+		var sum int
+		for c := 0; c < numChannels; c++ {
+			offset := i*frameSize + c*2
+			sum += int(int16(binary.LittleEndian.Uint16(data[offset:])))
+		}
+		samples[i] = int16(sum / numChannels)
+	}
+	return samples
+}
+
+// decodeSamples converts interleaved samples of any supported format to
+// 16-bit mono
+func decodeSamples(data []byte, format WavFormat) []int16 {
+	if format.AudioFormat == WavFormatPCM && format.BitsPerSample == 16 {
+		return decodeInt16(data, int(format.Channels))
+	}
+
+	numChannels := int(format.Channels)
+	width := int(format.BlockAlign()) / numChannels
+	frameSize := width * numChannels
+	frames := len(data) / frameSize
+	samples := make([]int16, frames)
+	for i := 0; i < frames; i++ {
+		var sum float64
+		for c := 0; c < numChannels; c++ {
+			sum += decodeSample(data[i*frameSize+c*width:], format)
+		}
+		samples[i] = clampInt16(sum / float64(numChannels))
+	}
+	return samples
+}
+
+// decodeSample reads one sample scaled to the int16 range
+func decodeSample(b []byte, format WavFormat) float64 {
+	if format.AudioFormat == WavFormatFloat {
+		if format.BitsPerSample == 64 {
+			return math.Float64frombits(binary.LittleEndian.Uint64(b)) * 32768
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) * 32768
+	}
+
+	switch format.BitsPerSample {
+	case 8:
+		return float64(int(b[0])-128) * 256
+	case 16:
+		return float64(int16(binary.LittleEndian.Uint16(b)))
+	case 24:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float64(v) / 256
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / 65536
+	}
+}
+
+func encodeInt16(samples []int16) []byte {
+	data := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+	}
+	return data
+}
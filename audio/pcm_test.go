@@ -0,0 +1,48 @@
+package audio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+// The data chunk size in a WAV header bounds what is read but does not size
+// the buffer, so a header claiming gigabytes decodes the samples there are
+func TestDecodeWavDataSize(t *testing.T) {
+	pcm := audiotest.Speech(16000, 100*time.Millisecond, -6)
+	var buf bytes.Buffer
+	if err := audio.EncodeWav(&buf, pcm); err != nil {
+		t.Fatal(err)
+	}
+	const dataSize = 40 // Offset of the data chunk size in the header
+
+	tests := []struct {
+		name string
+		size uint32
+		want int
+	}{
+		{"exact", uint32(2 * len(pcm.Samples)), len(pcm.Samples)},
+		{"shorter", 20, 10},
+		{"odd", 21, 10},
+		{"never updated", 0, len(pcm.Samples)},
+		{"streamed", 0xFFFFFFFF, len(pcm.Samples)},
+		{"past the file", 0xFFFFFFFE, len(pcm.Samples)},
+	}
+	for _, tt := range tests {
+		data := slices.Clone(buf.Bytes())
+		binary.LittleEndian.PutUint32(data[dataSize:], tt.size)
+		decoded, err := audio.DecodeWav(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(decoded.Samples, pcm.Samples[:tt.want]) {
+			t.Errorf("%s: decoded %d samples, want the first %d", tt.name, len(decoded.Samples), tt.want)
+		}
+	}
+}
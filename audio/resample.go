@@ -0,0 +1,179 @@
+package audio
+
+import (
+	"math"
+)
+
+const (
+	// Zero crossings of the sinc kernel on each side of a sample. More
+	// crossings give a steeper low-pass filter at a higher CPU cost.
+	sincZeroCrossings = 16
+
+	// Fraction of the output Nyquist frequency kept by the low-pass filter,
+	// leaving room for the transition band below the aliasing point
+	sincRolloff = 0.945
+
+	// Shape of the Kaiser window applied to the sinc kernel
+	kaiserBeta = 8.6
+
+	// Kernel table entries per input sample, values in between are
+	// linearly interpolated
+	kernelResolution = 512
+)
+
+// Resample converts mono 16-bit PCM between sample rates using a
+// Kaiser-windowed sinc interpolator. When downsampling the kernel is
+// widened so it also acts as the anti-aliasing filter.
+func Resample(samples []int16, fromRate, toRate int) []int16 {
+	if fromRate == toRate || len(samples) == 0 {
+		out := make([]int16, len(samples))
+		copy(out, samples)
+		return out
+	}
+
+	ratio := float64(toRate) / float64(fromRate)
+
+	// Cutoff relative to the input rate, limited by whichever Nyquist is lower
+	cutoff := sincRolloff
+	if ratio < 1 {
+		cutoff *= ratio
+	}
+
+	// Kernel half-width in input samples
+	halfWidth := float64(sincZeroCrossings) / cutoff
+	taps := int(math.Ceil(halfWidth))
+
+	// Tabulate the kernel once, it is symmetric so only |x| is stored
+	table := make([]float64, taps*kernelResolution+2)
+	for i := range table {
+		x := float64(i) / kernelResolution
+		table[i] = cutoff * sinc(cutoff*x) * kaiser(x/halfWidth)
+	}
+
+	outLen := int(float64(len(samples)) * ratio)
+	out := make([]int16, outLen)
+
+	step := 1 / ratio
+	for n := 0; n < outLen; n++ {
+		// Position of the output sample on the input timeline
+		t := float64(n) * step
+		center := int(math.Floor(t))
+
+		var sum, weights float64
+		for k := center - taps + 1; k <= center+taps; k++ {
+			if k < 0 || k >= len(samples) {
+				continue
+			}
+			x := math.Abs(t-float64(k)) * kernelResolution
+			if x >= float64(len(table)-1) {
+				continue
+			}
+			i := int(x)
+			frac := x - float64(i)
+			w := table[i] + (table[i+1]-table[i])*frac
+			sum += float64(samples[k]) * w
+			weights += w
+		}
+
+		// Normalize to unity gain, this also covers the edges where part of
+		// the kernel falls outside the input
+		if weights != 0 {
+			sum /= weights
+		}
+
+		out[n] = clampInt16(sum)
+	}
+
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	px := math.Pi * x
+	return math.Sin(px) / px
+}
+
+// kaiser evaluates the Kaiser window for x in [-1, 1]
+func kaiser(x float64) float64 {
+	if x < -1 || x > 1 {
+		return 0
+	}
+	return besselI0(kaiserBeta*math.Sqrt(1-x*x)) / besselI0(kaiserBeta)
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum := 1.0
+	term := 1.0
+	halfX := x / 2
+	for k := 1; k < 50; k++ {
+		term *= (halfX / float64(k)) * (halfX / float64(k))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+func clampInt16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// StreamResampler converts a live stream between sample rates chunk by
+// chunk with linear interpolation, carrying its position across chunks so
+// there are no seams. It is cheap enough for capture callbacks; use
+// Resample for recordings.
+type StreamResampler struct {
+	step float64
+
+	// Output samples produced and input samples consumed so far, counted
+	// rather than carried as a float offset so chunk sizes can't change
+	// the rounding, and the last sample of the previous chunk
+	produced int64
+	consumed int64
+	last     float64
+}
+
+// NewStreamResampler creates a resampler from one rate to another
+func NewStreamResampler(fromRate, toRate int) *StreamResampler {
+	return &StreamResampler{step: float64(fromRate) / float64(toRate)}
+}
+
+// Process resamples the next chunk of the stream. Output is produced up to
+// the last input sample, the rest follows with the next chunk.
+func (r *StreamResampler) Process(chunk []int16) []int16 {
+	out := make([]int16, 0, int(float64(len(chunk))/r.step)+1)
+	for {
+		// Position of the next output sample relative to the chunk start
+		position := float64(r.produced)*r.step - float64(r.consumed)
+		if position >= float64(len(chunk)-1) {
+			break
+		}
+		i := int(math.Floor(position))
+		frac := position - float64(i)
+
+		// Index -1 is the last sample of the previous chunk
+		prev := r.last
+		if i >= 0 {
+			prev = float64(chunk[i])
+		}
+		out = append(out, clampInt16(prev+(float64(chunk[i+1])-prev)*frac))
+		r.produced++
+	}
+
+	if len(chunk) > 0 {
+		r.last = float64(chunk[len(chunk)-1])
+		r.consumed += int64(len(chunk))
+	}
+	return out
+}
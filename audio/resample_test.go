@@ -0,0 +1,142 @@
+package audio_test
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+// Output samples left out at each end, where part of the kernel falls
+// outside the input
+const edge = 64
+
+// snr returns the ratio in dB of the reference to the difference between
+// it and got, leaving out the edges
+func snr(got, reference []int16) float64 {
+	var signal, noise float64
+	for i := edge; i < len(reference)-edge; i++ {
+		d := float64(got[i]) - float64(reference[i])
+		signal += float64(reference[i]) * float64(reference[i])
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+// gain returns the level in dB of a tone at freq in samples relative to a
+// peak of level dBFS, leaving out the edges
+func gain(samples []int16, sampleRate int, freq, level float64) float64 {
+	var c, s float64
+	for i := edge; i < len(samples)-edge; i++ {
+		t := float64(i) / float64(sampleRate)
+		c += float64(samples[i]) * math.Cos(2*math.Pi*freq*t)
+		s += float64(samples[i]) * math.Sin(2*math.Pi*freq*t)
+	}
+	amplitude := 2 * math.Hypot(c, s) / float64(len(samples)-2*edge)
+	return 20 * math.Log10(amplitude/(math.MaxInt16*math.Pow(10, level/20)))
+}
+
+func readWav(t *testing.T, name string) *audio.PCM {
+	t.Helper()
+	pcm, err := audio.ReadWav(filepath.Join("testdata", "resample", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pcm
+}
+
+// The inputs hold tones at 440 Hz, 3 kHz and 6.5 kHz, which the reference
+// holds at 16 kHz, and one at 11 kHz that must not alias into it. See
+// testdata/resample/generate.go.
+func TestResampleReference(t *testing.T) {
+	reference := readWav(t, "reference_16000.wav")
+	for _, rate := range []int{44100, 48000} {
+		input := readWav(t, fmt.Sprintf("input_%d.wav", rate))
+		got := audio.Resample(input.Samples, rate, 16000)
+		if len(got) != len(reference.Samples) {
+			t.Fatalf("%d Hz: got %d samples, want %d", rate, len(got), len(reference.Samples))
+		}
+		if ratio := snr(got, reference.Samples); ratio < 50 {
+			t.Errorf("%d Hz: SNR against the reference is %.1f dB, want at least 50", rate, ratio)
+		}
+	}
+}
+
+func TestResamplePassband(t *testing.T) {
+	tests := []struct {
+		from, to int
+		freq     float64
+		// Frequency the tone is heard at after resampling, and the lowest
+		// and highest gain in dB allowed there
+		heard       float64
+		least, most float64
+	}{
+		{44100, 16000, 100, 100, -0.05, 0.05},
+		{44100, 16000, 1000, 1000, -0.05, 0.05},
+		{44100, 16000, 4000, 4000, -0.05, 0.05},
+		{44100, 16000, 6500, 6500, -0.1, 0.05},
+		{44100, 16000, 7000, 7000, -1.5, 0.05},
+		// Stopband, folded around 8 kHz
+		{44100, 16000, 9000, 7000, math.Inf(-1), -90},
+		{44100, 16000, 12000, 4000, math.Inf(-1), -90},
+		{48000, 16000, 1000, 1000, -0.05, 0.05},
+		{48000, 16000, 6500, 6500, -0.1, 0.05},
+		{48000, 16000, 9000, 7000, math.Inf(-1), -90},
+		{48000, 16000, 20000, 4000, math.Inf(-1), -90},
+		{16000, 48000, 1000, 1000, -0.05, 0.05},
+		{16000, 48000, 6500, 6500, -0.1, 0.05},
+	}
+	for _, tt := range tests {
+		input := audiotest.Tone(tt.from, tt.freq, time.Second/2, -6)
+		got := gain(audio.Resample(input.Samples, tt.from, tt.to), tt.to, tt.heard, -6)
+		if got < tt.least || got > tt.most {
+			t.Errorf("%.0f Hz from %d to %d Hz: gain %.2f dB at %.0f Hz, want %.2f to %.2f", tt.freq, tt.from, tt.to, got, tt.heard, tt.least, tt.most)
+		}
+	}
+}
+
+// Streaming in chunks of any size gives what one call gives
+func TestStreamResamplerChunks(t *testing.T) {
+	for _, rate := range []int{44100, 48000} {
+		input := readWav(t, fmt.Sprintf("input_%d.wav", rate))
+		whole := audio.NewStreamResampler(rate, 16000).Process(input.Samples)
+
+		for _, size := range []int{1, 7, 160, 441, 480, 1024, 4096} {
+			r := audio.NewStreamResampler(rate, 16000)
+			var chunked []int16
+			for start := 0; start < len(input.Samples); start += size {
+				chunked = append(chunked, r.Process(input.Samples[start:min(start+size, len(input.Samples))])...)
+			}
+			if len(chunked) != len(whole) {
+				t.Errorf("%d Hz in chunks of %d: got %d samples, want %d", rate, size, len(chunked), len(whole))
+				continue
+			}
+			for i := range whole {
+				if chunked[i] != whole[i] {
+					t.Errorf("%d Hz in chunks of %d: sample %d is %d, want %d", rate, size, i, chunked[i], whole[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+// The stream resampler interpolates linearly without filtering, so it is
+// only checked on speech frequencies
+func TestStreamResamplerTone(t *testing.T) {
+	reference := audiotest.Tone(16000, 1000, time.Second/2, -6)
+	for _, rate := range []int{44100, 48000} {
+		input := audiotest.Tone(rate, 1000, time.Second/2, -6)
+		got := audio.NewStreamResampler(rate, 16000).Process(input.Samples)
+		if len(got) < len(reference.Samples)-1 {
+			t.Fatalf("%d Hz: got %d samples, want %d", rate, len(got), len(reference.Samples))
+		}
+		if ratio := snr(got, reference.Samples); ratio < 50 {
+			t.Errorf("%d Hz: SNR of a 1 kHz tone is %.1f dB, want at least 50", rate, ratio)
+		}
+	}
+}
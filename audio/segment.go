@@ -0,0 +1,192 @@
+package audio
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Segment is a buffer of mono 16-bit audio handed between pipeline stages
+// in memory, along with where and when it was recorded
+type Segment struct {
+	PCM
+
+	// Client that recorded the audio
+	ClientID string
+
+	// When recording of the first sample started
+	StartedAt time.Time
+}
+
+// ConvertOptions adjusts how audio is prepared for whisper
+type ConvertOptions struct {
+	// Cutoff of the high-pass filter removing DC offset and rumble, zero
+	// disables it
+	HighPassHz float64
+
+	// Normalize loudness before resampling
+	NormalizeLoudness bool
+
+	// Integrated loudness target in LUFS, zero uses DefaultTargetLUFS
+	TargetLUFS float64
+
+	// Remove leading and trailing silence
+	TrimSilence bool
+
+	// Silence detection used when trimming
+	Silence SilenceOptions
+
+	// Most samples decoded from the input, zero uses MaxSamples
+	MaxSamples int
+}
+
+// Passthrough reports whether the options leave audio untouched apart from
+// resampling
+func (o ConvertOptions) Passthrough() bool {
+	return o.HighPassHz == 0 && !o.NormalizeLoudness && !o.TrimSilence
+}
+
+// maxSamples returns the decoding limit of the options
+func (o ConvertOptions) maxSamples() int {
+	if o.MaxSamples > 0 {
+		return o.MaxSamples
+	}
+	return MaxSamples
+}
+
+// NewSegment wraps samples recorded at the given rate
+func NewSegment(samples []int16, sampleRate int) *Segment {
+	return &Segment{PCM: PCM{Samples: samples, SampleRate: sampleRate}}
+}
+
+// SegmentFromBytes builds a segment from little endian 16-bit mono samples
+// as streamed by clients
+func SegmentFromBytes(data []byte, sampleRate int) *Segment {
+	return NewSegment(decodeInt16(data, 1), sampleRate)
+}
+
+// Duration of the audio held by the segment
+func (seg *Segment) Duration() time.Duration {
+	if seg.SampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(len(seg.Samples)) * time.Second / time.Duration(seg.SampleRate)
+}
+
+// Resample returns the segment converted to another sample rate
+func (seg *Segment) Resample(sampleRate int) *Segment {
+	return seg.with(Resample(seg.Samples, seg.SampleRate, sampleRate), sampleRate, 0)
+}
+
+// HighPass returns the segment with frequencies below cutoffHz removed
+func (seg *Segment) HighPass(cutoffHz float64) *Segment {
+	return seg.with(HighPass(seg.Samples, seg.SampleRate, cutoffHz), seg.SampleRate, 0)
+}
+
+// Normalize returns the segment with its loudness brought to targetLUFS,
+// see NormalizeLoudness
+func (seg *Segment) Normalize(targetLUFS float64) *Segment {
+	return seg.with(NormalizeLoudness(seg.Samples, seg.SampleRate, targetLUFS), seg.SampleRate, 0)
+}
+
+// PrepareForWhisper runs the configured clean up stages and resamples the
+// segment to the rate whisper expects
+func (seg *Segment) PrepareForWhisper(opts ConvertOptions) *Segment {
+	out := seg
+	if opts.HighPassHz > 0 {
+		// Offset and rumble would otherwise count towards loudness and
+		// hide silence
+		out = out.HighPass(opts.HighPassHz)
+	}
+
+	if opts.NormalizeLoudness {
+		target := opts.TargetLUFS
+		if target == 0 {
+			target = DefaultTargetLUFS
+		}
+		out = out.Normalize(target)
+	}
+
+	if opts.TrimSilence {
+		// Keep recordings without detectable speech whole rather than
+		// trusting the threshold over the client's VAD
+		if trimmed := TrimSilence(out, opts.Silence); len(trimmed.Samples) > 0 {
+			out = trimmed
+		}
+	}
+
+	return out.Resample(WhisperSampleRate)
+}
+
+// Save writes the segment as a WAV file. The file is written under a .tmp
+// name and renamed into place so watchers never see it half written.
+func (seg *Segment) Save(path string) error {
+	tmpPath := path + ".tmp"
+	if err := WriteWav(tmpPath, &seg.PCM); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to finalize WAV file: %w", err)
+	}
+	return nil
+}
+
+// with copies the metadata onto new samples starting offset samples into
+// the original
+func (seg *Segment) with(samples []int16, sampleRate int, offset int) *Segment {
+	startedAt := seg.StartedAt
+	if offset > 0 && !startedAt.IsZero() && seg.SampleRate > 0 {
+		startedAt = startedAt.Add(time.Duration(offset) * time.Second / time.Duration(seg.SampleRate))
+	}
+	return &Segment{
+		PCM:       PCM{Samples: samples, SampleRate: sampleRate},
+		ClientID:  seg.ClientID,
+		StartedAt: startedAt,
+	}
+}
+
+// WhisperPath returns the name used for the whisper-ready copy of a recording
+func WhisperPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, ".wav") + "_whisper.wav"
+}
+
+// SaveForWhisper prepares a recorded segment for whisper, writes it next to
+// the raw recording and removes the raw file
+func SaveForWhisper(seg *Segment, recordingPath string, opts ConvertOptions) error {
+	if err := seg.PrepareForWhisper(opts).Save(WhisperPath(recordingPath)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(recordingPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove raw recording: %w", err)
+	}
+	return nil
+}
+
+// ResampleForWhisper reads a recording from disk and saves its whisper-ready
+// copy, see SaveForWhisper
+func ResampleForWhisper(inputPath string, opts ConvertOptions) error {
+	pcm, err := ReadAudioLimit(inputPath, opts.maxSamples())
+	if err != nil {
+		return fmt.Errorf("failed to resample audio: %w", err)
+	}
+
+	if err := SaveForWhisper(&Segment{PCM: *pcm}, inputPath, opts); err != nil {
+		return fmt.Errorf("failed to resample audio: %w", err)
+	}
+	return nil
+}
+
+// ConvertForWhisper writes the input as a 16kHz mono WAV file. Any format
+// ReadAudio understands is accepted, up to opts.MaxSamples.
+func ConvertForWhisper(inputPath, outputPath string, opts ConvertOptions) error {
+	pcm, err := ReadAudioLimit(inputPath, opts.maxSamples())
+	if err != nil {
+		return err
+	}
+
+	seg := &Segment{PCM: *pcm}
+	return WriteWav(outputPath, &seg.PrepareForWhisper(opts).PCM)
+}
@@ -0,0 +1,204 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Analysis window for silence detection
+	silenceFrame = 20 * time.Millisecond
+
+	defaultSilenceThresholdDB = -45.0
+	defaultMinSilence         = 700 * time.Millisecond
+	defaultMinSpeech          = 250 * time.Millisecond
+	defaultSilencePadding     = 200 * time.Millisecond
+)
+
+// SilenceOptions controls silence detection. Zero values use the defaults.
+type SilenceOptions struct {
+	// Frames with an RMS level below this many dBFS are silence, default -45
+	ThresholdDB float64
+
+	// Shortest pause that separates two utterances, default 700ms
+	MinSilence time.Duration
+
+	// Utterances shorter than this are dropped as clicks, default 250ms
+	MinSpeech time.Duration
+
+	// Silence kept before and after speech, default 200ms
+	Padding time.Duration
+}
+
+func (o SilenceOptions) withDefaults() SilenceOptions {
+	if o.ThresholdDB == 0 {
+		o.ThresholdDB = defaultSilenceThresholdDB
+	}
+	if o.MinSilence == 0 {
+		o.MinSilence = defaultMinSilence
+	}
+	if o.MinSpeech == 0 {
+		o.MinSpeech = defaultMinSpeech
+	}
+	if o.Padding == 0 {
+		o.Padding = defaultSilencePadding
+	}
+	return o
+}
+
+// TrimSilence removes leading and trailing silence, keeping the configured
+// padding around speech. A recording without speech trims to nothing.
+func TrimSilence(seg *Segment, opts SilenceOptions) *Segment {
+	opts = opts.withDefaults()
+
+	frameLen := durationToSamples(silenceFrame, seg.SampleRate)
+	speech := speechFrames(seg.Samples, frameLen, opts.ThresholdDB)
+
+	first, last := -1, -1
+	for i, isSpeech := range speech {
+		if isSpeech {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return seg.with(nil, seg.SampleRate, 0)
+	}
+
+	start, end := padRegion(first*frameLen, (last+1)*frameLen, len(seg.Samples), durationToSamples(opts.Padding, seg.SampleRate))
+	return seg.slice(start, end)
+}
+
+// SplitOnSilence cuts a recording into utterances separated by pauses of at
+// least MinSilence. Each utterance keeps the configured padding and its
+// StartedAt is offset to where it begins in the recording.
+func SplitOnSilence(seg *Segment, opts SilenceOptions) []*Segment {
+	opts = opts.withDefaults()
+
+	frameLen := durationToSamples(silenceFrame, seg.SampleRate)
+	speech := speechFrames(seg.Samples, frameLen, opts.ThresholdDB)
+	minSilence := int(opts.MinSilence / silenceFrame)
+	minSpeech := durationToSamples(opts.MinSpeech, seg.SampleRate)
+	padding := durationToSamples(opts.Padding, seg.SampleRate)
+
+	var parts []*Segment
+	emit := func(firstFrame, lastFrame int) {
+		start, end := firstFrame*frameLen, (lastFrame+1)*frameLen
+		if end-start < minSpeech {
+			return
+		}
+		start, end = padRegion(start, end, len(seg.Samples), padding)
+		parts = append(parts, seg.slice(start, end))
+	}
+
+	first, last := -1, -1
+	for i, isSpeech := range speech {
+		if !isSpeech {
+			continue
+		}
+		if first >= 0 && i-last-1 >= minSilence {
+			emit(first, last)
+			first = -1
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+	if first >= 0 {
+		emit(first, last)
+	}
+
+	return parts
+}
+
+// TrimSilenceFile trims a WAV file in place. Files without detectable speech
+// are left untouched.
+func TrimSilenceFile(path string, opts SilenceOptions) error {
+	pcm, err := ReadWav(path)
+	if err != nil {
+		return err
+	}
+
+	trimmed := TrimSilence(&Segment{PCM: *pcm}, opts)
+	if len(trimmed.Samples) == 0 || len(trimmed.Samples) == len(pcm.Samples) {
+		return nil
+	}
+
+	return trimmed.Save(path)
+}
+
+// SplitFile splits an audio file into utterances written next to it as
+// <name>_partNNN.wav and returns their paths
+func SplitFile(path string, opts SilenceOptions) ([]string, error) {
+	pcm, err := ReadAudio(path)
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	parts := SplitOnSilence(&Segment{PCM: *pcm}, opts)
+	paths := make([]string, 0, len(parts))
+	for i, part := range parts {
+		partPath := fmt.Sprintf("%s_part%03d.wav", base, i+1)
+		if err := part.Save(partPath); err != nil {
+			return paths, err
+		}
+		paths = append(paths, partPath)
+	}
+
+	return paths, nil
+}
+
+// speechFrames flags each analysis frame whose RMS level exceeds the threshold
+func speechFrames(samples []int16, frameLen int, thresholdDB float64) []bool {
+	if frameLen <= 0 {
+		return nil
+	}
+
+	threshold := 32768 * math.Pow(10, thresholdDB/20)
+	thresholdSquared := threshold * threshold
+
+	frames := make([]bool, (len(samples)+frameLen-1)/frameLen)
+	for i := range frames {
+		start := i * frameLen
+		end := start + frameLen
+		if end > len(samples) {
+			end = len(samples)
+		}
+		var sum float64
+		for _, s := range samples[start:end] {
+			sum += float64(s) * float64(s)
+		}
+		frames[i] = sum/float64(end-start) > thresholdSquared
+	}
+	return frames
+}
+
+func padRegion(start, end, length, padding int) (int, int) {
+	start -= padding
+	if start < 0 {
+		start = 0
+	}
+	end += padding
+	if end > length {
+		end = length
+	}
+	return start, end
+}
+
+// slice copies part of the segment, offsetting its start time
+func (seg *Segment) slice(start, end int) *Segment {
+	samples := make([]int16, end-start)
+	copy(samples, seg.Samples[start:end])
+	return seg.with(samples, seg.SampleRate, start)
+}
+
+func durationToSamples(d time.Duration, sampleRate int) int {
+	return int(int64(sampleRate) * int64(d) / int64(time.Second))
+}
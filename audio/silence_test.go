@@ -0,0 +1,85 @@
+package audio_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+// Speech fades in and out over its syllables, so detected edges may sit
+// this far inside the generated ones, plus a frame of rounding
+const edgeTolerance = 80 * time.Millisecond
+
+func near(got, want time.Duration) bool {
+	return got >= want-edgeTolerance && got <= want+edgeTolerance
+}
+
+func TestSplitOnSilence(t *testing.T) {
+	started := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		sampleRate int
+		count      int
+		speech     time.Duration
+		gap        time.Duration
+		noise      float64 // dBFS under the speech
+		opts       audio.SilenceOptions
+		want       int
+	}{
+		{"three utterances", 16000, 3, time.Second, time.Second, -70, audio.SilenceOptions{}, 3},
+		{"at 44.1kHz", 44100, 2, 1500 * time.Millisecond, time.Second, -70, audio.SilenceOptions{}, 2},
+		{"quiet room noise", 16000, 3, time.Second, time.Second, -55, audio.SilenceOptions{}, 3},
+		{"pauses shorter than MinSilence", 16000, 3, time.Second, 500 * time.Millisecond, -70, audio.SilenceOptions{}, 1},
+		{"shorter MinSilence", 16000, 3, time.Second, 500 * time.Millisecond, -70, audio.SilenceOptions{MinSilence: 300 * time.Millisecond}, 3},
+		{"noise above the threshold", 16000, 2, time.Second, time.Second, -30, audio.SilenceOptions{}, 1},
+	}
+	for _, tt := range tests {
+		speech, utterances := audiotest.Utterances(tt.sampleRate, tt.count, tt.speech, tt.gap, -12)
+		pcm := audiotest.Mix(speech, audiotest.Noise(tt.sampleRate, time.Duration(len(speech.Samples))*time.Second/time.Duration(tt.sampleRate), tt.noise, 1))
+		seg := audio.NewSegment(pcm.Samples, pcm.SampleRate)
+		seg.StartedAt = started
+
+		parts := audio.SplitOnSilence(seg, tt.opts)
+		if len(parts) != tt.want {
+			t.Errorf("%s: split into %d parts, want %d", tt.name, len(parts), tt.want)
+			continue
+		}
+		if tt.want != tt.count {
+			continue
+		}
+
+		// Each part is an utterance with the default padding around it
+		padding := 200 * time.Millisecond
+		for i, part := range parts {
+			start := part.StartedAt.Sub(started)
+			if !near(start, utterances[i].Start-padding) {
+				t.Errorf("%s: part %d starts at %s, want %s", tt.name, i+1, start, utterances[i].Start-padding)
+			}
+			if end := start + part.Duration(); !near(end, utterances[i].End+padding) {
+				t.Errorf("%s: part %d ends at %s, want %s", tt.name, i+1, end, utterances[i].End+padding)
+			}
+		}
+	}
+}
+
+func TestTrimSilence(t *testing.T) {
+	speech, utterances := audiotest.Utterances(16000, 1, 2*time.Second, 3*time.Second, -12)
+	pcm := audiotest.Mix(speech, audiotest.Noise(16000, 8*time.Second, -70, 1))
+	seg := audio.NewSegment(pcm.Samples, pcm.SampleRate)
+	seg.StartedAt = time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	trimmed := audio.TrimSilence(seg, audio.SilenceOptions{Padding: 100 * time.Millisecond})
+	if start := trimmed.StartedAt.Sub(seg.StartedAt); !near(start, utterances[0].Start-100*time.Millisecond) {
+		t.Errorf("trimmed audio starts at %s, want %s", start, utterances[0].Start-100*time.Millisecond)
+	}
+	if got, want := trimmed.Duration(), utterances[0].End-utterances[0].Start+200*time.Millisecond; !near(got, want) {
+		t.Errorf("trimmed to %s, want %s", got, want)
+	}
+
+	silent := audio.NewSegment(audiotest.Noise(16000, time.Second, -70, 2).Samples, 16000)
+	if trimmed := audio.TrimSilence(silent, audio.SilenceOptions{}); len(trimmed.Samples) != 0 {
+		t.Errorf("kept %d samples of silence", len(trimmed.Samples))
+	}
+}
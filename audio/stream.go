@@ -0,0 +1,83 @@
+package audio
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// StreamDecoder reads a live stream decoded by ffmpeg
+type StreamDecoder struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	stop   func() bool
+
+	closeOnce sync.Once
+	waitErr   error
+}
+
+// DecodeStream starts decoding a stream ffmpeg can read, such as the URL of
+// an internet radio, Icecast or HLS stream, to mono samples at sampleRate.
+// The decoder stops when ctx ends or it is closed.
+func DecodeStream(ctx context.Context, url string, sampleRate int) (*StreamDecoder, error) {
+	cmd, err := ffmpegCommand(
+		"-hide_banner",
+		"-loglevel", "error",
+		"-i", url,
+		"-vn",
+		"-ar", strconv.Itoa(sampleRate),
+		"-ac", "1",
+		"-f", "s16le",
+		"-")
+	if err != nil {
+		return nil, err
+	}
+	d := &StreamDecoder{cmd: cmd}
+	cmd.Stderr = &d.stderr
+	if d.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, fmt.Errorf("failed to decode stream: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	d.stop = context.AfterFunc(ctx, func() { cmd.Process.Kill() })
+	return d, nil
+}
+
+// Read fills samples with the next samples of the stream, returning how
+// many it read. Once the stream ends the error says why.
+func (d *StreamDecoder) Read(samples []int16) (int, error) {
+	buf := make([]byte, 2*len(samples))
+	n, err := io.ReadFull(d.stdout, buf)
+	n /= 2
+	for i := 0; i < n; i++ {
+		samples[i] = int16(uint16(buf[2*i]) | uint16(buf[2*i+1])<<8)
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err == io.EOF {
+		if waitErr := d.Close(); waitErr != nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// Close stops ffmpeg, returning why it failed if it did on its own
+func (d *StreamDecoder) Close() error {
+	d.closeOnce.Do(func() {
+		d.stop()
+		d.cmd.Process.Kill()
+		d.stdout.Close()
+		if err := d.cmd.Wait(); err != nil && d.stderr.Len() > 0 {
+			d.waitErr = fmt.Errorf("ffmpeg decoding failed: %w: %s", err, lastLine(d.stderr.Bytes()))
+		}
+	})
+	return d.waitErr
+}
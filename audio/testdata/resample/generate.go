@@ -0,0 +1,53 @@
+// Command generate writes the inputs and reference outputs of the resampler
+// tests: tones in the passband with one above 8 kHz that resampling to
+// 16 kHz must remove. The references are the passband tones evaluated at
+// the output sample times, what an ideal resampler would produce.
+//
+//	go run ./audio/testdata/resample
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+
+	"github.com/bosley/libas/audio"
+)
+
+const (
+	outputRate = 16000
+	seconds    = 0.5
+)
+
+// Frequencies (Hz) and peak levels (linear), the last above 8 kHz
+var tones = []struct{ freq, amplitude float64 }{
+	{440, 0.2},
+	{3000, 0.2},
+	{6500, 0.2},
+	{11000, 0.2},
+}
+
+func main() {
+	dir := filepath.Join("audio", "testdata", "resample")
+	for _, rate := range []int{44100, 48000} {
+		write(filepath.Join(dir, fmt.Sprintf("input_%d.wav", rate)), rate, len(tones))
+	}
+	write(filepath.Join(dir, fmt.Sprintf("reference_%d.wav", outputRate)), outputRate, len(tones)-1)
+}
+
+// write evaluates the first count tones at rate
+func write(path string, rate, count int) {
+	pcm := &audio.PCM{Samples: make([]int16, int(seconds*float64(rate))), SampleRate: rate}
+	for i := range pcm.Samples {
+		t := float64(i) / float64(rate)
+		var v float64
+		for _, tone := range tones[:count] {
+			v += tone.amplitude * math.Sin(2*math.Pi*tone.freq*t)
+		}
+		pcm.Samples[i] = int16(math.Round(v * math.MaxInt16))
+	}
+	if err := audio.WriteWav(path, pcm); err != nil {
+		log.Fatal(err)
+	}
+}
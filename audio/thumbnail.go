@@ -0,0 +1,143 @@
+package audio
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/cmplx"
+)
+
+const (
+	// FFT size used for spectrogram columns
+	spectrogramWindow = 512
+
+	// Range of magnitudes mapped onto the spectrogram palette
+	spectrogramFloorDB = -90.0
+)
+
+var waveformColor = color.RGBA{R: 0x00, G: 0x7b, B: 0xff, A: 0xff}
+
+// RenderWaveform draws the peak envelope of the samples, one column per
+// pixel, on a transparent background
+func RenderWaveform(samples []int16, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if len(samples) == 0 || width <= 0 || height <= 0 {
+		return img
+	}
+
+	mid := float64(height-1) / 2
+	for x := 0; x < width; x++ {
+		start := x * len(samples) / width
+		end := (x + 1) * len(samples) / width
+		if end <= start {
+			end = start + 1
+		}
+
+		low, high := int16(0), int16(0)
+		for _, s := range samples[start:end] {
+			if s < low {
+				low = s
+			}
+			if s > high {
+				high = s
+			}
+		}
+
+		top := int(math.Round(mid - float64(high)/32768*mid))
+		bottom := int(math.Round(mid - float64(low)/32768*mid))
+		for y := top; y <= bottom; y++ {
+			img.SetRGBA(x, y, waveformColor)
+		}
+	}
+
+	return img
+}
+
+// RenderSpectrogram draws a short-time Fourier transform of the samples with
+// time along the x axis and frequency, up to the Nyquist rate, up the y axis
+func RenderSpectrogram(samples []int16, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if width <= 0 || height <= 0 {
+		return img
+	}
+
+	window := make([]float64, spectrogramWindow)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(spectrogramWindow-1))
+	}
+
+	bins := spectrogramWindow / 2
+	frame := make([]complex128, spectrogramWindow)
+	for x := 0; x < width; x++ {
+		// Center one window on each column
+		center := (2*x + 1) * len(samples) / (2 * width)
+		start := center - spectrogramWindow/2
+		for i := range frame {
+			v := 0.0
+			if j := start + i; j >= 0 && j < len(samples) {
+				v = float64(samples[j]) / 32768 * window[i]
+			}
+			frame[i] = complex(v, 0)
+		}
+		fft(frame)
+
+		for y := 0; y < height; y++ {
+			bin := (height - 1 - y) * bins / height
+			magnitude := cmplx.Abs(frame[bin]) / float64(bins)
+			level := 0.0
+			if magnitude > 0 {
+				level = (20*math.Log10(magnitude) - spectrogramFloorDB) / -spectrogramFloorDB
+			}
+			img.SetRGBA(x, y, spectrogramColor(level))
+		}
+	}
+
+	return img
+}
+
+// spectrogramColor maps a level in [0, 1] from dark blue through red to
+// light yellow
+func spectrogramColor(level float64) color.RGBA {
+	level = math.Max(0, math.Min(1, level))
+	channel := func(v float64) uint8 {
+		return uint8(math.Max(0, math.Min(1, v)) * 255)
+	}
+	return color.RGBA{
+		R: channel(level * 2),
+		G: channel(level*2 - 1),
+		B: channel(0.3 + level - math.Max(0, level*3-1.5)),
+		A: 0xff,
+	}
+}
+
+// fft is an in-place iterative radix-2 Cooley-Tukey transform, len(x) must
+// be a power of two
+func fft(x []complex128) {
+	n := len(x)
+
+	// Bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := x[start+k]
+				odd := x[start+k+size/2] * w
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
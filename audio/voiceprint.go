@@ -0,0 +1,145 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+	"time"
+)
+
+const (
+	// Analysis window and hop for voice prints
+	voicePrintFrame = 32 * time.Millisecond
+	voicePrintHop   = 16 * time.Millisecond
+
+	// Frames quieter than this are left out
+	voicePrintThresholdDB = -40.0
+
+	// Mel filters spanning 100Hz to 4kHz, where voices differ most
+	voicePrintFilters = 24
+	voicePrintLowHz   = 100.0
+	voicePrintHighHz  = 4000.0
+
+	// Cepstral coefficients kept, the first (the level) is dropped
+	voicePrintCoefficients = 13
+
+	// Voice prints of recordings with fewer loud frames are not to be
+	// trusted
+	voicePrintMinFrames = 30
+)
+
+// VoicePrint summarizes the timbre of the loud frames of a recording as the
+// mean of their mel-frequency cepstral coefficients. It is a crude speaker
+// embedding that tells a few voices in the same room apart by cosine
+// similarity, nil when the recording holds too little speech.
+func VoicePrint(samples []int16, sampleRate int) []float64 {
+	frameLen := 1
+	for frameLen*2 <= durationToSamples(voicePrintFrame, sampleRate) {
+		frameLen *= 2
+	}
+	hop := durationToSamples(voicePrintHop, sampleRate)
+	if frameLen < 64 || hop <= 0 {
+		return nil
+	}
+
+	window := make([]float64, frameLen)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameLen-1))
+	}
+	filters := melFilters(frameLen, sampleRate)
+
+	threshold := 32768 * math.Pow(10, voicePrintThresholdDB/20)
+	spectrum := make([]complex128, frameLen)
+	energies := make([]float64, voicePrintFilters)
+	var frames [][]float64
+	for start := 0; start+frameLen <= len(samples); start += hop {
+		frame := samples[start : start+frameLen]
+		var sum float64
+		for _, s := range frame {
+			sum += float64(s) * float64(s)
+		}
+		if math.Sqrt(sum/float64(frameLen)) < threshold {
+			continue
+		}
+
+		// Pre-emphasis lifts the formants over the fundamental
+		previous := 0.0
+		for i, s := range frame {
+			v := float64(s) / 32768
+			spectrum[i] = complex((v-0.97*previous)*window[i], 0)
+			previous = v
+		}
+		fft(spectrum)
+
+		for f, filter := range filters {
+			energy := 1e-10
+			for bin, weight := range filter {
+				if weight > 0 {
+					energy += weight * cmplx.Abs(spectrum[bin]) * cmplx.Abs(spectrum[bin])
+				}
+			}
+			energies[f] = math.Log(energy)
+		}
+		frames = append(frames, cepstrum(energies))
+	}
+	if len(frames) < voicePrintMinFrames {
+		return nil
+	}
+
+	// Mean of each coefficient, weighted up with its order as the low ones
+	// mostly follow the microphone and room. Centering leaves the shape of
+	// the voice's envelope for cosine similarity to compare.
+	print := make([]float64, voicePrintCoefficients-1)
+	for _, coefficients := range frames {
+		for c, coefficient := range coefficients {
+			print[c] += coefficient * float64(c+1) / float64(len(frames))
+		}
+	}
+	center := mean(print)
+	for c := range print {
+		print[c] -= center
+	}
+	return print
+}
+
+// melFilters builds triangular filters evenly spaced on the mel scale, each
+// a weight per FFT bin
+func melFilters(frameLen, sampleRate int) [][]float64 {
+	mel := func(hz float64) float64 { return 2595 * math.Log10(1+hz/700) }
+	hz := func(m float64) float64 { return 700 * (math.Pow(10, m/2595) - 1) }
+
+	high := math.Min(voicePrintHighHz, float64(sampleRate)/2)
+	low, span := mel(voicePrintLowHz), mel(high)-mel(voicePrintLowHz)
+	edges := make([]float64, voicePrintFilters+2)
+	for i := range edges {
+		edges[i] = hz(low+span*float64(i)/float64(voicePrintFilters+1)) * float64(frameLen) / float64(sampleRate)
+	}
+
+	filters := make([][]float64, voicePrintFilters)
+	for f := range filters {
+		filters[f] = make([]float64, frameLen/2)
+		left, center, right := edges[f], edges[f+1], edges[f+2]
+		for bin := range filters[f] {
+			b := float64(bin)
+			switch {
+			case b > left && b <= center:
+				filters[f][bin] = (b - left) / (center - left)
+			case b > center && b < right:
+				filters[f][bin] = (right - b) / (right - center)
+			}
+		}
+	}
+	return filters
+}
+
+// cepstrum takes the DCT-II of log filter energies, dropping the first
+// coefficient
+func cepstrum(energies []float64) []float64 {
+	coefficients := make([]float64, voicePrintCoefficients-1)
+	n := float64(len(energies))
+	for c := range coefficients {
+		for i, energy := range energies {
+			coefficients[c] += energy * math.Cos(math.Pi*float64(c+1)*(float64(i)+0.5)/n)
+		}
+	}
+	return coefficients
+}
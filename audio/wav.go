@@ -1,15 +1,18 @@
+// Package audio holds the codecs, resampling and processing libas uses to
+// prepare recordings for whisper
 package audio
 
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"strings"
 )
 
 const (
-	recordingSampleRate = 44100 // Rate at which audio is being recorded
-	whisperSampleRate   = 16000 // Rate required by Whisper
+	RecordingSampleRate = 44100 // Rate at which audio is being recorded
+	WhisperSampleRate   = 16000 // Rate required by Whisper
 	channels            = 1     // Mono audio
 	bitsPerSample       = 16    // Using int16 for samples
 )
@@ -30,26 +33,93 @@ type WavHeader struct {
 	Subchunk2Size uint32
 }
 
-func WriteWavHeader(file *os.File, dataSize uint32) error {
+// WAV sample encodings
+const (
+	WavFormatPCM   = 1 // Signed integer samples (8-bit unsigned)
+	WavFormatFloat = 3 // IEEE 754 float samples
+)
+
+// WavFormat describes how samples are laid out in a WAV file
+type WavFormat struct {
+	// WavFormatPCM or WavFormatFloat
+	AudioFormat uint16
+
+	Channels      uint16
+	SampleRate    uint32
+	BitsPerSample uint16
+}
+
+// PCM16Format is the mono 16-bit layout used for recordings
+func PCM16Format(sampleRate uint32) WavFormat {
+	return WavFormat{AudioFormat: WavFormatPCM, Channels: channels, SampleRate: sampleRate, BitsPerSample: bitsPerSample}
+}
+
+// PCM24Format is a mono 24-bit integer layout
+func PCM24Format(sampleRate uint32) WavFormat {
+	return WavFormat{AudioFormat: WavFormatPCM, Channels: channels, SampleRate: sampleRate, BitsPerSample: 24}
+}
+
+// Float32Format is a mono 32-bit IEEE float layout
+func Float32Format(sampleRate uint32) WavFormat {
+	return WavFormat{AudioFormat: WavFormatFloat, Channels: channels, SampleRate: sampleRate, BitsPerSample: 32}
+}
+
+// BlockAlign is the size in bytes of one frame, a sample for every channel
+func (f WavFormat) BlockAlign() uint16 {
+	return f.Channels * ((f.BitsPerSample + 7) / 8)
+}
+
+func (f WavFormat) validate() error {
+	if f.Channels == 0 {
+		return fmt.Errorf("invalid channel count")
+	}
+	switch {
+	case f.AudioFormat == WavFormatPCM && (f.BitsPerSample == 8 || f.BitsPerSample == 16 || f.BitsPerSample == 24 || f.BitsPerSample == 32):
+	case f.AudioFormat == WavFormatFloat && (f.BitsPerSample == 32 || f.BitsPerSample == 64):
+	default:
+		return fmt.Errorf("unsupported WAV encoding (format %d, %d bits)", f.AudioFormat, f.BitsPerSample)
+	}
+	return nil
+}
+
+// WriteWavHeader writes the header of a mono 16-bit PCM file
+func WriteWavHeader(file *os.File, sampleRate, dataSize uint32) error {
+	return writeWavHeader(file, PCM16Format(sampleRate), dataSize)
+}
+
+// WriteWavHeaderFormat writes the header of a file in any supported format.
+// Every format uses the same 44 byte header, so UpdateWavHeader applies to
+// all of them.
+func WriteWavHeaderFormat(file *os.File, format WavFormat, dataSize uint32) error {
+	return writeWavHeader(file, format, dataSize)
+}
+
+func writeWavHeader(w io.Writer, format WavFormat, dataSize uint32) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+
+	blockAlign := format.BlockAlign()
 	header := WavHeader{
 		ChunkID:       [4]byte{'R', 'I', 'F', 'F'},
 		ChunkSize:     dataSize + 36,
 		Format:        [4]byte{'W', 'A', 'V', 'E'},
 		Subchunk1ID:   [4]byte{'f', 'm', 't', ' '},
 		Subchunk1Size: 16,
-		AudioFormat:   1,
-		NumChannels:   channels,
-		SampleRate:    recordingSampleRate,
-		ByteRate:      recordingSampleRate * uint32(channels) * uint32(bitsPerSample) / 8,
-		BlockAlign:    channels * bitsPerSample / 8,
-		BitsPerSample: bitsPerSample,
+		AudioFormat:   format.AudioFormat,
+		NumChannels:   format.Channels,
+		SampleRate:    format.SampleRate,
+		ByteRate:      format.SampleRate * uint32(blockAlign),
+		BlockAlign:    blockAlign,
+		BitsPerSample: format.BitsPerSample,
 		Subchunk2ID:   [4]byte{'d', 'a', 't', 'a'},
 		Subchunk2Size: dataSize,
 	}
 
-	return binary.Write(file, binary.LittleEndian, header)
+	return binary.Write(w, binary.LittleEndian, header)
 }
 
+// UpdateWavHeader fills in the size fields once all samples are written
 func UpdateWavHeader(file *os.File, dataSize uint32) error {
 	// Update ChunkSize (file size - 8)
 	if _, err := file.Seek(4, 0); err != nil {
@@ -70,22 +140,44 @@ func UpdateWavHeader(file *os.File, dataSize uint32) error {
 	return nil
 }
 
-// ResampleForWhisper resamples the WAV file to 16kHz for Whisper
-func ResampleForWhisper(inputPath string) error {
-	outputPath := inputPath[:len(inputPath)-4] + "_whisper.wav"
-
-	cmd := exec.Command("ffmpeg",
-		"-i", inputPath,
-		"-ar", fmt.Sprintf("%d", whisperSampleRate),
-		"-ac", "1",
-		"-y", // Overwrite output file
-		outputPath)
+// RepairWavHeader sets the size fields of a 16-bit mono recording from the
+// size of the file, for recordings whose header was never updated. A header
+// that never reached the disk is written again at fallbackRate, reported
+// by rewritten. A trailing half sample is cut off.
+func RepairWavHeader(path string, fallbackRate int) (rewritten bool, err error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to open WAV file: %w", err)
+	}
+	defer file.Close()
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to resample audio: %w", err)
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat WAV file: %w", err)
+	}
+	if info.Size() < 44 {
+		return false, fmt.Errorf("file of %d bytes is too short for a WAV header", info.Size())
+	}
+	dataSize := uint32(info.Size()-44) &^ 1
+	if err := file.Truncate(44 + int64(dataSize)); err != nil {
+		return false, fmt.Errorf("failed to truncate WAV file: %w", err)
 	}
 
-	os.Remove(inputPath)
+	var magic [12]byte
+	if _, err := io.ReadFull(file, magic[:]); err != nil {
+		return false, fmt.Errorf("failed to read RIFF header: %w", err)
+	}
+	if string(magic[0:4]) != "RIFF" || string(magic[8:12]) != "WAVE" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return false, fmt.Errorf("failed to seek to header: %w", err)
+		}
+		return true, writeWavHeader(file, PCM16Format(uint32(fallbackRate)), dataSize)
+	}
+	return false, UpdateWavHeader(file, dataSize)
+}
 
-	return nil
+// lastLine returns the final non-empty line of command output
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return lines[len(lines)-1]
 }
@@ -0,0 +1,162 @@
+// Package calendar reads events from iCalendar feeds, such as the secret
+// iCal address of a Google calendar, and from CalDAV calendars (Nextcloud,
+// iCloud, Fastmail, Radicale). Access is read-only.
+package calendar
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Largest calendar read, feeds of old calendars run to megabytes
+const maxCalendarSize = 32 << 20
+
+// Config for a calendar
+type Config struct {
+	// URL of an iCalendar feed, or of a CalDAV calendar collection when
+	// CalDAV is set
+	URL string
+
+	// Query the URL as a CalDAV calendar for the events in a time range
+	// instead of downloading it whole
+	CalDAV bool
+
+	// Basic authentication credentials, none when User is empty
+	User     string
+	Password string
+}
+
+// Client reads the events of one calendar
+type Client struct {
+	config Config
+	http   *http.Client
+}
+
+// New creates a client for the configured calendar
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid calendar URL")
+	}
+	return &Client{config: cfg, http: &http.Client{Timeout: time.Minute}}, nil
+}
+
+// URL describes the calendar for logs, without credentials or the secret
+// path of a feed
+func (c *Client) URL() string {
+	u, err := url.Parse(c.config.URL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	if c.config.CalDAV {
+		return u.Scheme + "://" + u.Host + u.Path
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Events returns the occurrences of timed events overlapping [from, to)
+func (c *Client) Events(ctx context.Context, from, to time.Time) ([]Event, error) {
+	if c.config.CalDAV {
+		return c.query(ctx, from, to)
+	}
+
+	body, err := c.request(ctx, http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bytes.NewReader(body), from, to)
+}
+
+// query asks a CalDAV server for the events in a time range (RFC 4791
+// calendar-query). Recurring events come back whole and are expanded here.
+func (c *Client) query(ctx context.Context, from, to time.Time) ([]Event, error) {
+	const layout = "20060102T150405Z"
+	request := `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><C:calendar-data/></D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="` + from.UTC().Format(layout) + `" end="` + to.UTC().Format(layout) + `"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+
+	headers := map[string]string{"Depth": "1", "Content-Type": "application/xml; charset=utf-8"}
+	body, err := c.request(ctx, "REPORT", []byte(request), headers)
+	if err != nil {
+		return nil, err
+	}
+
+	var multistatus struct {
+		Responses []struct {
+			Propstats []struct {
+				Status       string `xml:"status"`
+				CalendarData string `xml:"prop>calendar-data"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(body, &multistatus); err != nil {
+		return nil, fmt.Errorf("failed to parse CalDAV response: %w", err)
+	}
+
+	events := make([]Event, 0)
+	for _, response := range multistatus.Responses {
+		for _, propstat := range response.Propstats {
+			if propstat.CalendarData == "" {
+				continue
+			}
+			found, err := Parse(strings.NewReader(propstat.CalendarData), from, to)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, found...)
+		}
+	}
+	return events, nil
+}
+
+func (c *Client) request(ctx context.Context, method string, body []byte, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if c.config.User != "" {
+		req.SetBasicAuth(c.config.User, c.config.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// The URL of a feed is its secret, keep it out of errors
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("calendar request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("calendar returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCalendarSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+	if len(data) > maxCalendarSize {
+		return nil, fmt.Errorf("calendar is larger than %d MiB", maxCalendarSize>>20)
+	}
+	return data, nil
+}
@@ -0,0 +1,150 @@
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const meeting = `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:%[1]s@example.com
+DTSTART:20240304T100000Z
+DTEND:20240304T110000Z
+SUMMARY:%[1]s
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestEventsFeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if r.Method != http.MethodGet || r.URL.Path != "/private-s3cret/basic.ics" || !ok || user != "me" || password != "pw" {
+			t.Errorf("got %s %s as %q", r.Method, r.URL.Path, user)
+		}
+		fmt.Fprintf(w, meeting, "Planning")
+	}))
+	defer server.Close()
+
+	c, err := New(Config{URL: server.URL + "/private-s3cret/basic.ics", User: "me", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.URL(); strings.Contains(got, "s3cret") || got != server.URL {
+		t.Errorf("URL() reveals the feed's path: %s", got)
+	}
+
+	from := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	events, err := c.Events(context.Background(), from, from.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Title != "Planning" {
+		t.Errorf("got %v", events)
+	}
+}
+
+func TestEventsCalDAV(t *testing.T) {
+	from := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != "REPORT" || r.Header.Get("Depth") != "1" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/xml") {
+			t.Errorf("got %s with Depth %q and %q", r.Method, r.Header.Get("Depth"), r.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(string(body), `<C:time-range start="20240304T000000Z" end="20240305T000000Z"/>`) {
+			t.Errorf("query without the time range: %s", body)
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav">
+  <d:response>
+    <d:href>/cal/a.ics</d:href>
+    <d:propstat>
+      <d:prop><cal:calendar-data>%s</cal:calendar-data></d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/cal/b.ics</d:href>
+    <d:propstat>
+      <d:prop><cal:calendar-data/></d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>
+    <d:propstat>
+      <d:prop><cal:calendar-data><![CDATA[%s]]></cal:calendar-data></d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`, fmt.Sprintf(meeting, "Retro &amp; planning"), fmt.Sprintf(meeting, "Sync"))
+	}))
+	defer server.Close()
+
+	c, err := New(Config{URL: server.URL + "/cal/", CalDAV: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.URL(); got != server.URL+"/cal/" {
+		t.Errorf("got URL %s", got)
+	}
+	events, err := c.Events(context.Background(), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Title != "Retro & planning" || events[1].Title != "Sync" {
+		t.Errorf("got %v", events)
+	}
+}
+
+func TestEventsErrors(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		"status": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no", http.StatusUnauthorized)
+		},
+		"too large": func(w http.ResponseWriter, r *http.Request) {
+			io.CopyN(w, strings.NewReader(strings.Repeat(" ", maxCalendarSize+1)), maxCalendarSize+1)
+		},
+		"bad rule": func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "BEGIN:VEVENT\nDTSTART:20240304T100000Z\nRRULE:FREQ=MINUTELY\nEND:VEVENT\n")
+		},
+	}
+	for name, handler := range tests {
+		server := httptest.NewServer(handler)
+		c, _ := New(Config{URL: server.URL + "/s3cret.ics"})
+		if events, err := c.Events(context.Background(), time.Now(), time.Now().Add(time.Hour)); err == nil {
+			t.Errorf("%s: got %v", name, events)
+		}
+		server.Close()
+	}
+
+	// Invalid CalDAV responses
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, "<d:multistatus")
+	}))
+	c, _ := New(Config{URL: server.URL, CalDAV: true})
+	if _, err := c.Events(context.Background(), time.Now(), time.Now().Add(time.Hour)); err == nil {
+		t.Error("parsed a truncated CalDAV response")
+	}
+	server.Close()
+
+	// The feed's secret path stays out of errors
+	c, _ = New(Config{URL: server.URL + "/private-s3cret/basic.ics"})
+	if _, err := c.Events(context.Background(), time.Now(), time.Now().Add(time.Hour)); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, u := range []string{"", "calendar.ics", "ftp://example.com/a.ics", "https:///a.ics", "http://[::1"} {
+		if _, err := New(Config{URL: u}); err == nil {
+			t.Errorf("accepted %q", u)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package calendar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is one occurrence of a calendar event
+type Event struct {
+	Title string
+	Start time.Time
+	End   time.Time
+}
+
+// property is a content line of an iCalendar object
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// component is a VEVENT's properties by name
+type component map[string][]property
+
+func (c component) get(name string) (property, bool) {
+	if props := c[name]; len(props) > 0 {
+		return props[0], true
+	}
+	return property{}, false
+}
+
+// Parse reads an iCalendar (RFC 5545) object and returns the occurrences of
+// its timed events that overlap [from, to), recurrences expanded. All-day
+// and cancelled events are left out.
+func Parse(r io.Reader, from, to time.Time) ([]Event, error) {
+	vevents, err := readEvents(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Modified occurrences replace the ones their recurrence ID names
+	overrides := make(map[string]map[time.Time]bool)
+	for _, vevent := range vevents {
+		uid, _ := vevent.get("UID")
+		if id, ok := vevent.get("RECURRENCE-ID"); ok {
+			if t, _, err := parseTime(id); err == nil {
+				if overrides[uid.value] == nil {
+					overrides[uid.value] = make(map[time.Time]bool)
+				}
+				overrides[uid.value][t.UTC()] = true
+			}
+		}
+	}
+
+	events := make([]Event, 0)
+	for _, vevent := range vevents {
+		if status, _ := vevent.get("STATUS"); strings.EqualFold(status.value, "CANCELLED") {
+			continue
+		}
+		dtstart, ok := vevent.get("DTSTART")
+		if !ok {
+			continue
+		}
+		start, allDay, err := parseTime(dtstart)
+		if err != nil || allDay {
+			continue
+		}
+
+		duration := time.Duration(0)
+		if dtend, ok := vevent.get("DTEND"); ok {
+			end, _, err := parseTime(dtend)
+			if err != nil {
+				continue
+			}
+			duration = end.Sub(start)
+		} else if value, ok := vevent.get("DURATION"); ok {
+			if duration, err = parseDuration(value.value); err != nil {
+				continue
+			}
+		}
+
+		summary, _ := vevent.get("SUMMARY")
+		title := unescapeText(summary.value)
+		uid, _ := vevent.get("UID")
+		_, isOverride := vevent.get("RECURRENCE-ID")
+
+		starts := []time.Time{start}
+		if rule, ok := vevent.get("RRULE"); ok && !isOverride {
+			recurrence, err := parseRule(rule.value, start.Location())
+			if err != nil {
+				return nil, fmt.Errorf("event %q: %w", title, err)
+			}
+			starts = recurrence.expand(start, to)
+		}
+
+		excluded := make(map[time.Time]bool)
+		for _, exdate := range vevent["EXDATE"] {
+			for _, value := range strings.Split(exdate.value, ",") {
+				t, _, err := parseTime(property{params: exdate.params, value: value})
+				if err == nil {
+					excluded[t.UTC()] = true
+				}
+			}
+		}
+
+		for _, occurrence := range starts {
+			key := occurrence.UTC()
+			if excluded[key] || (!isOverride && overrides[uid.value][key]) {
+				continue
+			}
+			end := occurrence.Add(duration)
+			if end.After(from) && occurrence.Before(to) {
+				events = append(events, Event{Title: title, Start: occurrence, End: end})
+			}
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events, nil
+}
+
+// readEvents returns the properties of each VEVENT, ignoring the alarms and
+// other components nested in them
+func readEvents(r io.Reader) ([]component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]component, 0)
+	var current component
+	depth := 0 // Components open inside the current VEVENT
+	for _, line := range lines {
+		prop, ok := parseLine(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case prop.name == "BEGIN" && current == nil && strings.EqualFold(prop.value, "VEVENT"):
+			current = make(component)
+		case prop.name == "BEGIN" && current != nil:
+			depth++
+		case prop.name == "END" && current != nil && depth > 0:
+			depth--
+		case prop.name == "END" && current != nil:
+			events = append(events, current)
+			current = nil
+		case current != nil && depth == 0:
+			current[prop.name] = append(current[prop.name], prop)
+		}
+	}
+	return events, nil
+}
+
+// unfold joins content lines continued on lines starting with whitespace
+func unfold(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+	return lines, nil
+}
+
+// parseLine splits NAME;PARAM=VALUE:value, honoring quoted parameters
+func parseLine(line string) (property, bool) {
+	colon, semicolon, quoted := -1, -1, false
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if !quoted && c == ';' && semicolon < 0 {
+			semicolon = i
+		}
+		if !quoted && c == ':' {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return property{}, false
+	}
+
+	prop := property{params: make(map[string]string), value: line[colon+1:]}
+	head := line[:colon]
+	if semicolon >= 0 {
+		for _, param := range splitParams(head[semicolon+1:]) {
+			if key, value, ok := strings.Cut(param, "="); ok {
+				prop.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+			}
+		}
+		head = head[:semicolon]
+	}
+	prop.name = strings.ToUpper(head)
+	return prop, true
+}
+
+// splitParams splits parameters at semicolons outside quoted values
+func splitParams(params string) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i, c := range params {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			parts = append(parts, params[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, params[start:])
+}
+
+// parseTime reads a DATE or DATE-TIME value in UTC, its TZID or local
+// time, reporting whether it is a date
+func parseTime(prop property) (time.Time, bool, error) {
+	value := prop.value
+	if prop.params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, location(prop.params["TZID"]))
+	return t, false, err
+}
+
+// location resolves a TZID. Calendars from Outlook use Windows zone names,
+// which fall back to the local zone like floating times.
+func location(tzid string) *time.Location {
+	if tzid == "" {
+		return time.Local
+	}
+	// Some producers prefix IANA names with a vendor path
+	tzid = strings.TrimPrefix(tzid, "/mozilla.org/20050126_1/")
+	if loc, err := time.LoadLocation(tzid); err == nil {
+		return loc
+	}
+	return time.Local
+}
+
+// parseDuration reads an RFC 5545 duration such as PT1H30M or P1W
+func parseDuration(value string) (time.Duration, error) {
+	sign := time.Duration(1)
+	switch {
+	case strings.HasPrefix(value, "-"):
+		sign, value = -1, value[1:]
+	case strings.HasPrefix(value, "+"):
+		value = value[1:]
+	}
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	var total time.Duration
+	number := ""
+	inTime, found := false, false
+	for _, c := range value[1:] {
+		if c >= '0' && c <= '9' {
+			number += string(c)
+			continue
+		}
+		if c == 'T' {
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		number, found = "", true
+		switch {
+		case c == 'W':
+			total += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D':
+			total += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			total += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			total += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			total += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if number != "" || !found {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return sign * total, nil
+}
+
+// unescapeText undoes the escaping of TEXT values
+func unescapeText(value string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
@@ -0,0 +1,270 @@
+package calendar
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// feed is a calendar as Google and Outlook export them, with CRLF line
+// endings and lines folded at 75 octets
+const feed = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Google Inc//Google Calendar 70.9054//EN
+BEGIN:VTIMEZONE
+TZID:Europe/Berlin
+BEGIN:DAYLIGHT
+DTSTART:19700329T020000
+RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU
+TZOFFSETTO:+0200
+END:DAYLIGHT
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:standup@example.com
+DTSTART;TZID=Europe/Berlin:20240304T093000
+DTEND;TZID=Europe/Berlin:20240304T094500
+RRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR;UNTIL=20240331T000000Z
+EXDATE;TZID=Europe/Berlin:20240306T093000,20240308T093000
+EXDATE:20240311T083000Z
+SUMMARY:Stand-up
+BEGIN:VALARM
+ACTION:DISPLAY
+SUMMARY:Alarm summary
+TRIGGER:-PT10M
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:standup@example.com
+RECURRENCE-ID;TZID=Europe/Berlin:20240313T093000
+DTSTART;TZID=Europe/Berlin:20240313T140000
+DTEND;TZID=Europe/Berlin:20240313T141500
+SUMMARY:Stand-up (moved)
+END:VEVENT
+BEGIN:VEVENT
+UID:standup@example.com
+RECURRENCE-ID:20240315T083000Z
+DTSTART:20240315T083000Z
+STATUS:CANCELLED
+SUMMARY:Stand-up
+END:VEVENT
+BEGIN:VEVENT
+UID:review@example.com
+DTSTART:20240305T150000Z
+DURATION:PT1H30M
+SUMMARY:Design review\, part 2\; the \"API\"\\n
+  plus a folded line
+LOCATION:Room 1
+END:VEVENT
+BEGIN:VEVENT
+UID:holiday@example.com
+DTSTART;VALUE=DATE:20240306
+DTEND;VALUE=DATE:20240307
+SUMMARY:Holiday
+END:VEVENT
+BEGIN:VEVENT
+UID:cancelled@example.com
+DTSTART:20240307T100000Z
+DTEND:20240307T110000Z
+STATUS:CANCELLED
+SUMMARY:Cancelled
+END:VEVENT
+BEGIN:VEVENT
+UID:quoted@example.com
+DTSTART;TZID="Europe/Berlin":20240307T120000
+DTEND;TZID="Europe/Berlin":20240307T123000
+ATTENDEE;CN="Doe, Jane: Ops";ROLE=REQ-PARTICIPANT:mailto:jane@example.com
+summary:Lunch
+END:VEVENT
+BEGIN:VEVENT
+UID:moment@example.com
+DTSTART:20240307T160000Z
+SUMMARY:No end
+END:VEVENT
+BEGIN:VEVENT
+UID:broken@example.com
+DTSTART:not a time
+SUMMARY:Broken
+END:VEVENT
+BEGIN:VEVENT
+UID:nostart@example.com
+SUMMARY:No start
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestParse(t *testing.T) {
+	berlin := mustLocation(t, "Europe/Berlin")
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, berlin)
+	}
+
+	events, err := Parse(strings.NewReader(strings.ReplaceAll(feed, "\n", "\r\n")), at(1, 0, 0), at(31, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{"Stand-up", at(4, 9, 30), at(4, 9, 45)},
+		{`Design review, part 2; the \"API\"\n plus a folded line`, at(5, 16, 0), at(5, 17, 30)},
+		{"Lunch", at(7, 12, 0), at(7, 12, 30)},
+		{"No end", at(7, 17, 0), at(7, 17, 0)},
+		{"Stand-up (moved)", at(13, 14, 0), at(13, 14, 15)},
+		{"Stand-up", at(18, 9, 30), at(18, 9, 45)},
+		{"Stand-up", at(20, 9, 30), at(20, 9, 45)},
+		{"Stand-up", at(22, 9, 30), at(22, 9, 45)},
+		{"Stand-up", at(25, 9, 30), at(25, 9, 45)},
+		{"Stand-up", at(27, 9, 30), at(27, 9, 45)},
+		{"Stand-up", at(29, 9, 30), at(29, 9, 45)},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(events), len(want), events)
+	}
+	for i, event := range events {
+		w := want[i]
+		if event.Title != w.Title || !event.Start.Equal(w.Start) || !event.End.Equal(w.End) {
+			t.Errorf("event %d: got %s %s-%s, want %s %s-%s", i, event.Title, event.Start, event.End, w.Title, w.Start, w.End)
+		}
+	}
+
+	// Occurrences overlapping the range count, ones ending at its start
+	// don't, and the rule stops at the range's end
+	events, err = Parse(strings.NewReader(feed), at(4, 9, 40), at(5, 15, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || !events[0].Start.Equal(at(4, 9, 30)) {
+		t.Errorf("got %v", events)
+	}
+	events, _ = Parse(strings.NewReader(feed), at(4, 9, 45), at(5, 16, 0))
+	if len(events) != 0 {
+		t.Errorf("got %v", events)
+	}
+
+	// The moved occurrence is found by its new time
+	events, _ = Parse(strings.NewReader(feed), at(13, 9, 0), at(13, 10, 0))
+	if len(events) != 0 {
+		t.Errorf("moved occurrence found at its old time: %v", events)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	from, to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	calendar := "BEGIN:VEVENT\nDTSTART:20240101T100000Z\nRRULE:FREQ=HOURLY\nSUMMARY:Often\nEND:VEVENT\n"
+	if _, err := Parse(strings.NewReader(calendar), from, to); err == nil || !strings.Contains(err.Error(), `"Often"`) {
+		t.Errorf("got %v, want an error naming the event", err)
+	}
+
+	// Not a calendar, or an unfinished one, has no events
+	for _, calendar := range []string{"", "not a calendar", "BEGIN:VEVENT\nDTSTART:20240101T100000Z\n"} {
+		events, err := Parse(strings.NewReader(calendar), from, to)
+		if err != nil || len(events) != 0 {
+			t.Errorf("%q: got %v, %v", calendar, events, err)
+		}
+	}
+
+	// Lines longer than the scanner's buffer
+	calendar = "BEGIN:VEVENT\nDESCRIPTION:" + strings.Repeat("x", 2<<20) + "\nEND:VEVENT\n"
+	if _, err := Parse(strings.NewReader(calendar), from, to); err == nil {
+		t.Error("parsed a calendar with a 2 MiB line")
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		params map[string]string
+		value  string
+	}{
+		{"SUMMARY:Hello: world", "SUMMARY", nil, "Hello: world"},
+		{"dtstart;tzid=Europe/Berlin:20240101T100000", "DTSTART", map[string]string{"TZID": "Europe/Berlin"}, "20240101T100000"},
+		{`DTSTART;TZID="America/New_York";X-A=1:20240101T100000`, "DTSTART", map[string]string{"TZID": "America/New_York", "X-A": "1"}, "20240101T100000"},
+		{`ATTENDEE;CN="Doe; Jane: Ops":mailto:jane@example.com`, "ATTENDEE", map[string]string{"CN": "Doe; Jane: Ops"}, "mailto:jane@example.com"},
+		{"DESCRIPTION:", "DESCRIPTION", nil, ""},
+		{"X-FLAG;NOVALUE:1", "X-FLAG", nil, "1"},
+	}
+	for _, tt := range tests {
+		prop, ok := parseLine(tt.line)
+		if !ok || prop.name != tt.name || prop.value != tt.value || len(prop.params) != len(tt.params) {
+			t.Errorf("%s: got %+v", tt.line, prop)
+			continue
+		}
+		for key, value := range tt.params {
+			if prop.params[key] != value {
+				t.Errorf("%s: %s is %q, want %q", tt.line, key, prop.params[key], value)
+			}
+		}
+	}
+	for _, line := range []string{"", "no colon", `X;P="a:b`} {
+		if prop, ok := parseLine(line); ok {
+			t.Errorf("%q: got %+v", line, prop)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	newYork := mustLocation(t, "America/New_York")
+	tests := []struct {
+		prop   property
+		want   time.Time
+		allDay bool
+	}{
+		{property{value: "20240102T030405Z"}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{property{value: "20240102T030405", params: map[string]string{"TZID": "America/New_York"}}, time.Date(2024, 1, 2, 3, 4, 5, 0, newYork), false},
+		{property{value: "20240102T030405", params: map[string]string{"TZID": "/mozilla.org/20050126_1/America/New_York"}}, time.Date(2024, 1, 2, 3, 4, 5, 0, newYork), false},
+		{property{value: "20240102T030405", params: map[string]string{"TZID": "W. Europe Standard Time"}}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local), false},
+		{property{value: "20240102T030405"}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local), false},
+		{property{value: "20240102", params: map[string]string{"VALUE": "DATE"}}, time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local), true},
+		{property{value: "20240102"}, time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local), true},
+	}
+	for _, tt := range tests {
+		got, allDay, err := parseTime(tt.prop)
+		if err != nil || !got.Equal(tt.want) || got.Location().String() != tt.want.Location().String() || allDay != tt.allDay {
+			t.Errorf("%+v: got %s, %v, %v", tt.prop, got, allDay, err)
+		}
+	}
+	for _, value := range []string{"", "2024-01-02", "20240102T0304", "20241302T000000Z", "2024010"} {
+		if got, _, err := parseTime(property{value: value}); err == nil {
+			t.Errorf("%q: parsed as %s", value, got)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"PT1H30M":   90 * time.Minute,
+		"PT15M":     15 * time.Minute,
+		"PT0S":      0,
+		"P1D":       24 * time.Hour,
+		"P1DT2H3S":  26*time.Hour + 3*time.Second,
+		"P2W":       14 * 24 * time.Hour,
+		"+PT45S":    45 * time.Second,
+		"-PT10M":    -10 * time.Minute,
+		"P0DT0H10M": 10 * time.Minute,
+	}
+	for value, want := range tests {
+		if got, err := parseDuration(value); err != nil || got != want {
+			t.Errorf("%s: got %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "P", "PT", "1H", "PT15", "P1H", "P1M", "PTH", "PT1X", "P1.5D", "--PT1M"} {
+		if got, err := parseDuration(value); err == nil {
+			t.Errorf("%q: parsed as %v", value, got)
+		}
+	}
+}
+
+func TestUnescapeText(t *testing.T) {
+	tests := map[string]string{
+		`plain`:                 "plain",
+		`a\, b\; c`:             "a, b; c",
+		`line\nbreak\Nand more`: "line break and more",
+		`back\\slash`:           `back\slash`,
+		`not\\n a break`:        `not\n a break`,
+	}
+	for value, want := range tests {
+		if got := unescapeText(value); got != want {
+			t.Errorf("%s: got %q, want %q", value, got, want)
+		}
+	}
+}
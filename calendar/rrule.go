@@ -0,0 +1,340 @@
+package calendar
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Periods of a rule looked at before giving up, bounding rules that
+// produce nothing such as the 31st of every other February
+const maxPeriods = 100000
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// weekdayNum is a BYDAY entry, e.g. -1FR for the last Friday. Ordinal zero
+// means every such weekday.
+type weekdayNum struct {
+	ordinal int
+	day     time.Weekday
+}
+
+// rule is the subset of RFC 5545 recurrence rules calendars use for
+// meetings: DAILY, WEEKLY, MONTHLY and YEARLY with INTERVAL, COUNT, UNTIL,
+// BYDAY, BYMONTHDAY, BYMONTH, BYSETPOS and WKST
+type rule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []int
+	bySetPos   []int
+	weekStart  time.Weekday
+}
+
+func parseRule(value string, loc *time.Location) (*rule, error) {
+	r := &rule{interval: 1, weekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		key, val, _ := strings.Cut(part, "=")
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.freq = strings.ToUpper(val)
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(val)
+			if err == nil && r.interval < 1 {
+				err = fmt.Errorf("interval must be positive")
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(val)
+			if err == nil && r.count < 1 {
+				err = fmt.Errorf("count must be positive")
+			}
+		case "UNTIL":
+			switch {
+			case strings.HasSuffix(val, "Z"):
+				r.until, err = time.Parse("20060102T150405Z", val)
+			case len(val) == 8:
+				// A date includes the whole day
+				r.until, err = time.ParseInLocation("20060102", val, loc)
+				r.until = r.until.AddDate(0, 0, 1).Add(-time.Second)
+			default:
+				r.until, err = time.ParseInLocation("20060102T150405", val, loc)
+			}
+		case "BYDAY":
+			for _, entry := range strings.Split(val, ",") {
+				if len(entry) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY %q", val)
+				}
+				day, ok := weekdays[strings.ToUpper(entry[len(entry)-2:])]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %q", val)
+				}
+				ordinal := 0
+				if prefix := entry[:len(entry)-2]; prefix != "" {
+					if ordinal, err = strconv.Atoi(prefix); err != nil {
+						return nil, fmt.Errorf("invalid BYDAY %q", val)
+					}
+				}
+				r.byDay = append(r.byDay, weekdayNum{ordinal: ordinal, day: day})
+			}
+		case "BYMONTHDAY":
+			r.byMonthDay, err = parseInts(val)
+		case "BYMONTH":
+			r.byMonth, err = parseInts(val)
+		case "BYSETPOS":
+			r.bySetPos, err = parseInts(val)
+		case "WKST":
+			day, ok := weekdays[strings.ToUpper(val)]
+			if !ok {
+				err = fmt.Errorf("invalid WKST %q", val)
+			}
+			r.weekStart = day
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid recurrence rule %q: %w", value, err)
+		}
+	}
+
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+		return r, nil
+	}
+	return nil, fmt.Errorf("unsupported recurrence frequency %q", r.freq)
+}
+
+func parseInts(value string) ([]int, error) {
+	values := make([]int, 0)
+	for _, item := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+// expand returns the occurrences starting at start and before to, keeping
+// start's time of day in its location across daylight saving changes
+func (r *rule) expand(start, to time.Time) []time.Time {
+	starts := make([]time.Time, 0)
+	for period := 0; period < maxPeriods; period++ {
+		for _, day := range r.days(start, period) {
+			occurrence := time.Date(day.Year(), day.Month(), day.Day(),
+				start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+			if occurrence.Before(start) {
+				continue
+			}
+			if !occurrence.Before(to) || (!r.until.IsZero() && occurrence.After(r.until)) {
+				return starts
+			}
+			starts = append(starts, occurrence)
+			if r.count > 0 && len(starts) == r.count {
+				return starts
+			}
+		}
+	}
+	return starts
+}
+
+// days returns the dates of one period of the rule in order, a period
+// being INTERVAL days, weeks, months or years after start's
+func (r *rule) days(start time.Time, period int) []time.Time {
+	y, m, d := start.Date()
+	loc := start.Location()
+	step := period * r.interval
+
+	var days []time.Time
+	switch r.freq {
+	case "DAILY":
+		days = []time.Time{time.Date(y, m, d+step, 0, 0, 0, 0, loc)}
+		days = r.filterWeekdays(days)
+		days = r.filterMonthDays(days)
+
+	case "WEEKLY":
+		offset := (int(start.Weekday()) - int(r.weekStart) + 7) % 7
+		weekStart := time.Date(y, m, d-offset+7*step, 0, 0, 0, 0, loc)
+		byDay := r.byDay
+		if len(byDay) == 0 {
+			byDay = []weekdayNum{{day: start.Weekday()}}
+		}
+		for i := 0; i < 7; i++ {
+			day := weekStart.AddDate(0, 0, i)
+			for _, entry := range byDay {
+				if entry.day == day.Weekday() {
+					days = append(days, day)
+					break
+				}
+			}
+		}
+
+	case "MONTHLY":
+		days = r.monthDays(time.Date(y, m+time.Month(step), 1, 0, 0, 0, 0, loc), d)
+
+	case "YEARLY":
+		if len(r.byMonth) == 0 && len(r.byMonthDay) == 0 && len(r.byDay) > 0 {
+			// Weekdays of the whole year, e.g. 20MO for its 20th Monday
+			first := time.Date(y+step, time.January, 1, 0, 0, 0, 0, loc)
+			length := time.Date(y+step, time.December, 31, 0, 0, 0, 0, loc).YearDay()
+			days = selectedDays(first, length, r.weekdaysIn(first, length))
+			break
+		}
+
+		months := r.byMonth
+		switch {
+		case len(months) == 0 && len(r.byMonthDay) > 0:
+			months = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+		case len(months) == 0:
+			months = []int{int(m)}
+		}
+		for _, month := range months {
+			days = append(days, r.monthDays(time.Date(y+step, time.Month(month), 1, 0, 0, 0, 0, loc), d)...)
+		}
+		sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	}
+	return r.setPositions(r.filterMonths(days))
+}
+
+// monthDays returns the days of the month starting at first that the rule
+// selects, the day of the month of the start when it selects none
+func (r *rule) monthDays(first time.Time, startDay int) []time.Time {
+	last := first.AddDate(0, 1, -1).Day()
+	selected := make(map[int]bool)
+
+	for _, day := range r.byMonthDay {
+		if day < 0 {
+			day = last + 1 + day
+		}
+		if day >= 1 && day <= last {
+			selected[day] = true
+		}
+	}
+	if len(r.byDay) > 0 {
+		weekdays := r.weekdaysIn(first, last)
+		if len(r.byMonthDay) == 0 {
+			selected = weekdays
+		}
+		// BYDAY limits BYMONTHDAY, e.g. to Friday the 13th
+		for day := range selected {
+			if !weekdays[day] {
+				delete(selected, day)
+			}
+		}
+	}
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 && startDay <= last {
+		selected[startDay] = true
+	}
+	return selectedDays(first, last, selected)
+}
+
+// weekdaysIn returns the days, counted from 1, of the length days starting
+// at first that BYDAY selects, ordinals counting within them
+func (r *rule) weekdaysIn(first time.Time, length int) map[int]bool {
+	selected := make(map[int]bool)
+	for _, entry := range r.byDay {
+		var matches []int
+		for day := 1; day <= length; day++ {
+			if first.AddDate(0, 0, day-1).Weekday() == entry.day {
+				matches = append(matches, day)
+			}
+		}
+		switch {
+		case entry.ordinal == 0:
+			for _, day := range matches {
+				selected[day] = true
+			}
+		case entry.ordinal > 0 && entry.ordinal <= len(matches):
+			selected[matches[entry.ordinal-1]] = true
+		case entry.ordinal < 0 && -entry.ordinal <= len(matches):
+			selected[matches[len(matches)+entry.ordinal]] = true
+		}
+	}
+	return selected
+}
+
+// selectedDays returns the selected days of the length days starting at
+// first in order
+func selectedDays(first time.Time, length int, selected map[int]bool) []time.Time {
+	days := make([]time.Time, 0, len(selected))
+	for day := 1; day <= length; day++ {
+		if selected[day] {
+			days = append(days, first.AddDate(0, 0, day-1))
+		}
+	}
+	return days
+}
+
+func (r *rule) filterWeekdays(days []time.Time) []time.Time {
+	if len(r.byDay) == 0 {
+		return days
+	}
+	kept := days[:0]
+	for _, day := range days {
+		for _, entry := range r.byDay {
+			if entry.day == day.Weekday() {
+				kept = append(kept, day)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+func (r *rule) filterMonthDays(days []time.Time) []time.Time {
+	if len(r.byMonthDay) == 0 {
+		return days
+	}
+	kept := days[:0]
+	for _, day := range days {
+		last := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+		for _, monthDay := range r.byMonthDay {
+			if monthDay == day.Day() || last+1+monthDay == day.Day() {
+				kept = append(kept, day)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+func (r *rule) filterMonths(days []time.Time) []time.Time {
+	if len(r.byMonth) == 0 || r.freq == "YEARLY" {
+		return days
+	}
+	kept := days[:0]
+	for _, day := range days {
+		for _, month := range r.byMonth {
+			if int(day.Month()) == month {
+				kept = append(kept, day)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// setPositions keeps the BYSETPOS entries of a period's days, e.g. -1 for
+// the last weekday of a month
+func (r *rule) setPositions(days []time.Time) []time.Time {
+	if len(r.bySetPos) == 0 {
+		return days
+	}
+	kept := make([]time.Time, 0, len(r.bySetPos))
+	for i, day := range days {
+		for _, position := range r.bySetPos {
+			if position == i+1 || position == i-len(days) {
+				kept = append(kept, day)
+				break
+			}
+		}
+	}
+	return kept
+}
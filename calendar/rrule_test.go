@@ -0,0 +1,230 @@
+package calendar
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// TestExpand runs the examples of RFC 5545 section 3.8.5.3 within the
+// supported subset, all starting at 09:00 New York time
+func TestExpand(t *testing.T) {
+	newYork := mustLocation(t, "America/New_York")
+	tests := []struct {
+		name  string
+		start string
+		rule  string
+		to    string // Exclusive, 2030 when empty
+		want  string // Dates, or the count and the first and last for long lists
+	}{
+		{"daily for 10 occurrences", "19970902", "FREQ=DAILY;COUNT=10", "",
+			"19970902 19970903 19970904 19970905 19970906 19970907 19970908 19970909 19970910 19970911"},
+		{"daily until December 24", "19970902", "FREQ=DAILY;UNTIL=19971224T000000Z", "",
+			"113: 19970902 ... 19971223"},
+		{"every other day", "19970902", "FREQ=DAILY;INTERVAL=2", "19970912",
+			"19970902 19970904 19970906 19970908 19970910"},
+		{"every 10 days, 5 occurrences", "19970902", "FREQ=DAILY;INTERVAL=10;COUNT=5", "",
+			"19970902 19970912 19970922 19971002 19971012"},
+		{"every day in January for 3 years", "19980101", "FREQ=DAILY;UNTIL=20000131T140000Z;BYMONTH=1", "",
+			"93: 19980101 ... 20000131"},
+		{"weekly for 10 occurrences", "19970902", "FREQ=WEEKLY;COUNT=10", "",
+			"19970902 19970909 19970916 19970923 19970930 19971007 19971014 19971021 19971028 19971104"},
+		{"weekly on Tuesday and Thursday for five weeks", "19970902", "FREQ=WEEKLY;UNTIL=19971007T000000Z;WKST=SU;BYDAY=TU,TH", "",
+			"19970902 19970904 19970909 19970911 19970916 19970918 19970923 19970925 19970930 19971002"},
+		{"weekly on Tuesday and Thursday, 10 occurrences", "19970902", "FREQ=WEEKLY;COUNT=10;WKST=SU;BYDAY=TU,TH", "",
+			"19970902 19970904 19970909 19970911 19970916 19970918 19970923 19970925 19970930 19971002"},
+		{"every other week on Monday, Wednesday and Friday", "19970901", "FREQ=WEEKLY;INTERVAL=2;UNTIL=19971224T000000Z;WKST=SU;BYDAY=MO,WE,FR", "",
+			"19970901 19970903 19970905 19970915 19970917 19970919 19970929 19971001 19971003 19971013 19971015 19971017 " +
+				"19971027 19971029 19971031 19971110 19971112 19971114 19971124 19971126 19971128 19971208 19971210 19971212 19971222"},
+		{"every other week on Tuesday and Thursday, 8 occurrences", "19970902", "FREQ=WEEKLY;INTERVAL=2;COUNT=8;WKST=SU;BYDAY=TU,TH", "",
+			"19970902 19970904 19970916 19970918 19970930 19971002 19971014 19971016"},
+		{"week starting Monday", "19970805", "FREQ=WEEKLY;INTERVAL=2;COUNT=4;BYDAY=TU,SU;WKST=MO", "",
+			"19970805 19970810 19970819 19970824"},
+		{"week starting Sunday", "19970805", "FREQ=WEEKLY;INTERVAL=2;COUNT=4;BYDAY=TU,SU;WKST=SU", "",
+			"19970805 19970817 19970819 19970831"},
+		{"monthly on the first Friday", "19970905", "FREQ=MONTHLY;COUNT=10;BYDAY=1FR", "",
+			"19970905 19971003 19971107 19971205 19980102 19980206 19980306 19980403 19980501 19980605"},
+		{"monthly on the first Friday until December 24", "19970905", "FREQ=MONTHLY;UNTIL=19971224T000000Z;BYDAY=1FR", "",
+			"19970905 19971003 19971107 19971205"},
+		{"every other month on the first and last Sunday", "19970907", "FREQ=MONTHLY;INTERVAL=2;COUNT=10;BYDAY=1SU,-1SU", "",
+			"19970907 19970928 19971102 19971130 19980104 19980125 19980301 19980329 19980503 19980531"},
+		{"monthly on the second to last Monday", "19970922", "FREQ=MONTHLY;COUNT=6;BYDAY=-2MO", "",
+			"19970922 19971020 19971117 19971222 19980119 19980216"},
+		{"monthly on the third to last day", "19970928", "FREQ=MONTHLY;BYMONTHDAY=-3", "19980301",
+			"19970928 19971029 19971128 19971229 19980129 19980226"},
+		{"monthly on the 2nd and 15th", "19970902", "FREQ=MONTHLY;COUNT=10;BYMONTHDAY=2,15", "",
+			"19970902 19970915 19971002 19971015 19971102 19971115 19971202 19971215 19980102 19980115"},
+		{"monthly on the first and last day", "19970930", "FREQ=MONTHLY;COUNT=10;BYMONTHDAY=1,-1", "",
+			"19970930 19971001 19971031 19971101 19971130 19971201 19971231 19980101 19980131 19980201"},
+		{"every 18 months on the 10th to 15th", "19970910", "FREQ=MONTHLY;INTERVAL=18;COUNT=10;BYMONTHDAY=10,11,12,13,14,15", "",
+			"19970910 19970911 19970912 19970913 19970914 19970915 19990310 19990311 19990312 19990313"},
+		{"every Tuesday, every other month", "19970902", "FREQ=MONTHLY;INTERVAL=2;BYDAY=TU", "19980101",
+			"19970902 19970909 19970916 19970923 19970930 19971104 19971111 19971118 19971125"},
+		{"monthly on the 15th and 30th skips February 30", "20070115", "FREQ=MONTHLY;BYMONTHDAY=15,30;COUNT=5", "",
+			"20070115 20070130 20070215 20070315 20070330"},
+		{"monthly on the 31st skips short months", "20070131", "FREQ=MONTHLY;COUNT=4", "",
+			"20070131 20070331 20070531 20070731"},
+		{"yearly in June and July", "19970610", "FREQ=YEARLY;COUNT=10;BYMONTH=6,7", "",
+			"19970610 19970710 19980610 19980710 19990610 19990710 20000610 20000710 20010610 20010710"},
+		{"every other year in January to March", "19970310", "FREQ=YEARLY;INTERVAL=2;COUNT=10;BYMONTH=1,2,3", "",
+			"19970310 19990110 19990210 19990310 20010110 20010210 20010310 20030110 20030210 20030310"},
+		{"the 20th Monday of the year", "19970519", "FREQ=YEARLY;BYDAY=20MO", "20000101",
+			"19970519 19980518 19990517"},
+		{"yearly on the first of every month", "20240101", "FREQ=YEARLY;BYMONTHDAY=1;COUNT=3", "",
+			"20240101 20240201 20240301"},
+		{"yearly on February 29", "20240229", "FREQ=YEARLY;COUNT=2", "",
+			"20240229 20280229"},
+		{"every Thursday in March", "19970313", "FREQ=YEARLY;BYMONTH=3;BYDAY=TH", "19990101",
+			"19970313 19970320 19970327 19980305 19980312 19980319 19980326"},
+		{"Friday the 13th", "19970902", "FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13;COUNT=5", "",
+			"19980213 19980313 19981113 19990813 20001013"},
+		{"the first Saturday after the first Sunday", "19970913", "FREQ=MONTHLY;BYDAY=SA;BYMONTHDAY=7,8,9,10,11,12,13;COUNT=10", "",
+			"19970913 19971011 19971108 19971213 19980110 19980207 19980307 19980411 19980509 19980613"},
+		{"US presidential election day", "19961105", "FREQ=YEARLY;INTERVAL=4;BYMONTH=11;BYDAY=TU;BYMONTHDAY=2,3,4,5,6,7,8;COUNT=3", "",
+			"19961105 20001107 20041102"},
+		{"the third Tuesday, Wednesday or Thursday", "19970904", "FREQ=MONTHLY;COUNT=3;BYDAY=TU,WE,TH;BYSETPOS=3", "",
+			"19970904 19971007 19971106"},
+		{"the second to last weekday", "19970929", "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-2", "19980401",
+			"19970929 19971030 19971127 19971230 19980129 19980226 19980330"},
+		{"weekdays", "20240101", "FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;COUNT=6", "",
+			"20240101 20240102 20240103 20240104 20240105 20240108"},
+		{"a start off the rule is skipped", "20240103", "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=3", "",
+			"20240105 20240108 20240112"},
+		{"COUNT counts before the range ends", "20240101", "FREQ=DAILY;COUNT=10", "20240104",
+			"20240101 20240102 20240103"},
+		{"UNTIL includes a matching occurrence", "20240101", "FREQ=DAILY;UNTIL=20240103T140000Z", "",
+			"20240101 20240102 20240103"},
+		{"UNTIL as a date includes the day", "20240101", "FREQ=DAILY;UNTIL=20240103", "",
+			"20240101 20240102 20240103"},
+		{"UNTIL in local time", "20240101", "FREQ=DAILY;UNTIL=20240103T085959", "",
+			"20240101 20240102"},
+		{"UNTIL before the start", "20240101", "FREQ=DAILY;UNTIL=20231231T000000Z", "",
+			""},
+		{"a rule that never matches", "20240101", "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30", "",
+			""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, err := time.ParseInLocation("20060102T15", tt.start+"T09", newYork)
+			if err != nil {
+				t.Fatal(err)
+			}
+			to := time.Date(2030, 1, 1, 0, 0, 0, 0, newYork)
+			if tt.to != "" {
+				to, _ = time.ParseInLocation("20060102", tt.to, newYork)
+			}
+			r, err := parseRule(tt.rule, newYork)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			occurrences := r.expand(start, to)
+			dates := make([]string, 0, len(occurrences))
+			for _, occurrence := range occurrences {
+				if occurrence.Hour() != 9 || occurrence.Minute() != 0 || occurrence.Location() != newYork {
+					t.Errorf("occurrence at %s", occurrence)
+				}
+				dates = append(dates, occurrence.Format("20060102"))
+			}
+			got := strings.Join(dates, " ")
+			if len(dates) > 30 {
+				got = fmt.Sprintf("%d: %s ... %s", len(dates), dates[0], dates[len(dates)-1])
+			}
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestExpandDaylightSaving keeps the wall clock time across the changes,
+// so the gap between occurrences is 23 or 25 hours on those days
+func TestExpandDaylightSaving(t *testing.T) {
+	berlin := mustLocation(t, "Europe/Berlin")
+	r, err := parseRule("FREQ=DAILY;COUNT=3", berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, start := range []time.Time{
+		time.Date(2024, 3, 30, 10, 30, 0, 0, berlin),
+		time.Date(2024, 10, 26, 10, 30, 0, 0, berlin),
+	} {
+		occurrences := r.expand(start, start.AddDate(1, 0, 0))
+		if len(occurrences) != 3 {
+			t.Fatalf("got %v", occurrences)
+		}
+		gaps := []time.Duration{occurrences[1].Sub(occurrences[0]), occurrences[2].Sub(occurrences[1])}
+		for _, occurrence := range occurrences {
+			if occurrence.Hour() != 10 || occurrence.Minute() != 30 {
+				t.Errorf("occurrence at %s", occurrence)
+			}
+		}
+		if gaps[0] == 24*time.Hour || gaps[1] != 24*time.Hour {
+			t.Errorf("from %s: gaps %v", start, gaps)
+		}
+	}
+
+	// UTC rules stay on UTC
+	r, _ = parseRule("FREQ=WEEKLY;COUNT=2", time.UTC)
+	start := time.Date(2024, 3, 28, 9, 0, 0, 0, time.UTC)
+	if got := r.expand(start, start.AddDate(1, 0, 0)); len(got) != 2 || got[1].Sub(got[0]) != 7*24*time.Hour {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := parseRule("freq=weekly;interval=2;count=3;byday=+1mo,-1FR,TU;bymonthday=1,-1;bymonth=3;bysetpos=1;wkst=su;x-name=ignored", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rule{
+		freq: "WEEKLY", interval: 2, count: 3,
+		byDay:      []weekdayNum{{1, time.Monday}, {-1, time.Friday}, {0, time.Tuesday}},
+		byMonthDay: []int{1, -1}, byMonth: []int{3}, bySetPos: []int{1}, weekStart: time.Sunday,
+	}
+	if r.freq != want.freq || r.interval != want.interval || r.count != want.count || !slices.Equal(r.byDay, want.byDay) ||
+		!slices.Equal(r.byMonthDay, want.byMonthDay) || !slices.Equal(r.byMonth, want.byMonth) ||
+		!slices.Equal(r.bySetPos, want.bySetPos) || r.weekStart != want.weekStart {
+		t.Errorf("got %+v", r)
+	}
+
+	invalid := []string{
+		"",
+		"COUNT=3",
+		"FREQ=HOURLY",
+		"FREQ=SECONDLY;COUNT=3",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;INTERVAL=-1",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;COUNT=-2",
+		"FREQ=DAILY;COUNT=many",
+		"FREQ=DAILY;UNTIL=tomorrow",
+		"FREQ=DAILY;UNTIL=20241301T000000Z",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=WEEKLY;BYDAY=M",
+		"FREQ=WEEKLY;BYDAY=MO,",
+		"FREQ=MONTHLY;BYDAY=aMO",
+		"FREQ=MONTHLY;BYMONTHDAY=first",
+		"FREQ=YEARLY;BYMONTH=3,",
+		"FREQ=MONTHLY;BYSETPOS=last",
+		"FREQ=WEEKLY;WKST=XX",
+	}
+	for _, value := range invalid {
+		if r, err := parseRule(value, time.UTC); err == nil {
+			t.Errorf("%q: parsed as %+v", value, r)
+		}
+	}
+}
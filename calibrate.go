@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	libascli "github.com/bosley/libas/client"
+)
+
+// runCalibrate records the background and a sample of speech and
+// recommends VAD settings for capture
+func runCalibrate(args []string) error {
+	fs := newFlagSet("calibrate")
+	deviceID := fs.Int("device", 0, "Audio input device ID to use, see \"libas devices\"")
+	highPass := fs.Float64("highpass", audio.DefaultHighPassHz, "High-pass cutoff in Hz applied before measuring (0 disables), as for capture")
+	noiseDuration := fs.Duration("noise-duration", 5*time.Second, "How long to record the background")
+	speechDuration := fs.Duration("speech-duration", 10*time.Second, "How long to record speech")
+	write := fs.Bool("write", false, "Write the recommended settings to the [capture] table of the -config file")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	configPath := fs.Lookup("config").Value.String()
+	if configPath == "" {
+		configPath = os.Getenv(envName("config"))
+	}
+	if *write && configPath == "" {
+		return usageError(fs, "-write needs a -config file")
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	stdin := bufio.NewReader(os.Stdin)
+	prompt := func(message string) {
+		fmt.Printf("%s Press Enter to start.", message)
+		stdin.ReadString('\n')
+	}
+
+	prompt(fmt.Sprintf("Step 1: stay quiet for %s while the background is recorded.", *noiseDuration))
+	noise, err := libascli.RecordAmplitudes(ctx, *deviceID, *highPass, *noiseDuration)
+	if err != nil {
+		return fmt.Errorf("failed to record background: %w", err)
+	}
+
+	prompt(fmt.Sprintf("Step 2: speak normally, with your usual pauses, for %s.", *speechDuration))
+	speech, err := libascli.RecordAmplitudes(ctx, *deviceID, *highPass, *speechDuration)
+	if err != nil {
+		return fmt.Errorf("failed to record speech: %w", err)
+	}
+
+	calibration, err := libascli.Calibrate(noise, speech)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Printf("Background:  mean amplitude %.1f, 99th percentile %.1f\n", calibration.NoiseMean, calibration.NoiseP99)
+	fmt.Printf("Speech:      median amplitude %.1f, 20th percentile %.1f (%.1fx the background)\n",
+		calibration.SpeechMedian, calibration.SpeechP20, calibration.SpeechMedian/calibration.NoiseMean)
+	if calibration.Marginal {
+		fmt.Println("\nSpeech was barely louder than the background. The threshold keeps noise out but quiet")
+		fmt.Println("speech may be missed, consider moving the microphone closer or raising its gain.")
+	}
+
+	settings := map[string]string{
+		"vad-threshold":     strconv.FormatFloat(calibration.VADThreshold, 'f', -1, 64),
+		"silence-timeout":   strconv.Quote(calibration.SilenceTimeout.String()),
+		"background-buffer": strconv.Itoa(calibration.BackgroundBufferSize),
+	}
+
+	fmt.Println("\nRecommended capture settings:")
+	fmt.Printf("  vad-threshold = %s\n", settings["vad-threshold"])
+	fmt.Printf("  silence-timeout = %s\n", settings["silence-timeout"])
+	fmt.Printf("  background-buffer = %s  (%s)\n", settings["background-buffer"],
+		(time.Duration(calibration.BackgroundBufferSize) * libascli.ChunkDuration).Round(100*time.Millisecond))
+
+	if !*write {
+		fmt.Printf("\nUse them with \"libas capture -vad-threshold %s -silence-timeout %s -background-buffer %s\" or run again with -write.\n",
+			settings["vad-threshold"], calibration.SilenceTimeout, settings["background-buffer"])
+		return nil
+	}
+
+	if err := updateConfigFile(configPath, "capture", settings); err != nil {
+		return err
+	}
+	fmt.Printf("\nWrote them to the [capture] table of %s\n", configPath)
+	return nil
+}
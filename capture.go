@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bosley/libas/audio"
+	libascli "github.com/bosley/libas/client"
+)
+
+// parseCapture reads the configuration of the microphone client
+func parseCapture(args []string) (libascli.Config, error) {
+	fs := newFlagSet("capture")
+	serverAddr := fs.String("server", "localhost:8443", "Server address (host:port)")
+	insecureMode := fs.Bool("insecure", false, "Skip certificate verification")
+	certFile := fs.String("cert", "", "Path to the server certificate (required unless -insecure)")
+	deviceID := fs.Int("device", 0, "Audio input device ID to use, see \"libas devices\"")
+	highPass := fs.Float64("highpass", audio.DefaultHighPassHz, "High-pass cutoff in Hz applied before voice detection (0 disables)")
+	vadThreshold := fs.Float64("vad-threshold", 2.22, "Ratio of chunk amplitude over background noise that counts as speech")
+	silenceTimeout := fs.Duration("silence-timeout", time.Second, "Silence after which a transmission ends")
+	backgroundBuffer := fs.Int("background-buffer", 50, "Number of recent audio chunks averaged into the background noise level")
+	playSpeech := fs.Bool("play-speech", false, "Play speech the scribe sends and audio routed from other clients on the default output device")
+	consentNotice := fs.String("consent-notice", "", "Play \"beep\" or an audio file on the default output device whenever a transmission starts")
+	cfg, err := parseFlags(fs, args)
+	if err != nil {
+		return libascli.Config{}, err
+	}
+
+	if !*insecureMode && *certFile == "" {
+		return libascli.Config{}, usageError(fs, "server certificate file must be provided when not in insecure mode")
+	}
+
+	token, err := requireToken(cfg, fs.Name())
+	if err != nil {
+		return libascli.Config{}, err
+	}
+
+	return libascli.Config{
+		ServerAddr:     *serverAddr,
+		Insecure:       *insecureMode,
+		CertFile:       *certFile,
+		Token:          token,
+		DeviceID:       *deviceID,
+		HighPassHz:     *highPass,
+		VADThreshold:   *vadThreshold,
+		SilenceTimeout: *silenceTimeout,
+
+		BackgroundBufferSize: *backgroundBuffer,
+		PlaySpeech:           *playSpeech,
+		ConsentNotice:        *consentNotice,
+	}, nil
+}
+
+func runCapture(args []string) error {
+	cfg, err := parseCapture(args)
+	if err != nil {
+		return err
+	}
+
+	client, err := libascli.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	return client.Run(ctx)
+}
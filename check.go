@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	libascli "github.com/bosley/libas/client"
+	"github.com/bosley/libas/leader"
+	"github.com/bosley/libas/redis"
+	"github.com/bosley/libas/scribe"
+	libaserv "github.com/bosley/libas/server"
+)
+
+const (
+	// Certificates expiring sooner than this are reported as a warning
+	certExpiryWarning = 30 * 24 * time.Hour
+
+	// How long the whisper executable may take to print its usage
+	whisperProbeTimeout = 10 * time.Second
+
+	// How long to wait when connecting to the audio server
+	dialTimeout = 5 * time.Second
+
+	// Magic number at the start of whisper.cpp ggml model files
+	ggmlMagic = 0x67676d6c
+)
+
+// checkStatus is the outcome of one readiness check
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "ok"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "FAIL"
+)
+
+type checkResult struct {
+	status checkStatus
+	name   string
+	detail string
+}
+
+// checkReport collects the results of the checks run for a command
+type checkReport []checkResult
+
+// add records a result, skipping repeats from checks shared by the server
+// and scribe
+func (r *checkReport) add(status checkStatus, name, format string, args ...any) {
+	result := checkResult{status: status, name: name, detail: fmt.Sprintf(format, args...)}
+	for _, existing := range *r {
+		if existing == result {
+			return
+		}
+	}
+	*r = append(*r, result)
+}
+
+func (r checkReport) failures() int {
+	failed := 0
+	for _, result := range r {
+		if result.status == checkFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func (r checkReport) print() {
+	for _, result := range r {
+		fmt.Printf("%-4s  %-20s %s\n", result.status, result.name, result.detail)
+	}
+}
+
+// runCheck validates the configuration a command would start with and
+// prints a readiness report without starting anything
+func runCheck(args []string) error {
+	fs := newFlagSet("check")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError(fs, "expected the command to check")
+	}
+	command, commandArgs := fs.Arg(0), fs.Args()[1:]
+
+	var report checkReport
+	switch command {
+	case "serve":
+		serverConfig, scribeConfig, opts, err := parseServe(commandArgs)
+		if err != nil {
+			return err
+		}
+		checkServer(&report, serverConfig)
+		checkScribe(&report, scribeConfig)
+		checkRunOptions(&report, opts)
+
+	case "ingest":
+		serverConfig, opts, err := parseIngest(commandArgs)
+		if err != nil {
+			return err
+		}
+		checkServer(&report, serverConfig)
+		checkRunOptions(&report, opts)
+
+	case "scribe":
+		scribeConfig, opts, err := parseScribe(commandArgs)
+		if err != nil {
+			return err
+		}
+		checkScribe(&report, scribeConfig)
+		checkRunOptions(&report, opts)
+
+	case "worker":
+		workerConfig, err := parseWorker(commandArgs)
+		if err != nil {
+			return err
+		}
+		checkWhisper(&report, workerConfig.whisper.Path)
+		checkModel(&report, workerConfig.whisper.Model)
+		checkQueue(&report, workerConfig.worker.Redis)
+
+	case "capture":
+		captureConfig, err := parseCapture(commandArgs)
+		if err != nil {
+			return err
+		}
+		if !captureConfig.Insecure {
+			checkCACertificate(&report, captureConfig.CertFile)
+		}
+		checkDial(&report, "server", captureConfig.ServerAddr)
+		checkConsentNotice(&report, captureConfig.ConsentNotice)
+
+	default:
+		return usageError(fs, "%s has nothing to check", command)
+	}
+
+	report.print()
+	if failed := report.failures(); failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(report))
+	}
+	return nil
+}
+
+func checkServer(report *checkReport, cfg libaserv.Config) {
+	checkKeyPair(report, "audio certificate", cfg.CertFile, cfg.KeyFile)
+	checkDirectory(report, cfg.RecordingsDir)
+	checkListen(report, "audio address", cfg.Addr)
+}
+
+func checkScribe(report *checkReport, cfg scribe.Config) {
+	checkKeyPair(report, "scribe certificate", cfg.CertFile, cfg.KeyFile)
+	if queue, ok := cfg.Transcriber.(scribe.QueueTranscriber); ok {
+		checkQueue(report, queue.Redis)
+	}
+	if cfg.WhisperPath != "" {
+		checkWhisper(report, cfg.WhisperPath)
+		checkModel(report, cfg.WhisperModel)
+	}
+	if audio.FFmpegAvailable() {
+		report.add(checkOK, "ffmpeg", "available, MP3 and OGG can be decoded")
+	} else {
+		report.add(checkWarn, "ffmpeg", "not found, only WAV and FLAC can be decoded")
+	}
+	checkDirectory(report, cfg.RecordingsDir)
+	checkListen(report, "scribe address", cfg.HTTPAddr)
+	if len(cfg.Report.To) > 0 {
+		checkDial(report, "smtp server", cfg.Report.SMTPAddr)
+	}
+	if fields := strings.Fields(cfg.Report.SummaryCommand); len(fields) > 0 {
+		if _, err := exec.LookPath(fields[0]); err != nil {
+			report.add(checkFail, "report summary", "%v", err)
+		} else {
+			report.add(checkOK, "report summary", "%s found", fields[0])
+		}
+	}
+}
+
+// checkKeyPair loads a certificate and key and reports when the certificate
+// expires
+func checkKeyPair(report *checkReport, name, certFile, keyFile string) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		report.add(checkFail, name, "%v", err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		report.add(checkFail, name, "failed to parse %s: %v", certFile, err)
+		return
+	}
+	checkValidity(report, name, leaf)
+}
+
+// checkCACertificate checks the certificate a client trusts for the server
+func checkCACertificate(report *checkReport, certFile string) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		report.add(checkFail, "server certificate", "%v", err)
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		report.add(checkFail, "server certificate", "no PEM certificate in %s", certFile)
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		report.add(checkFail, "server certificate", "failed to parse %s: %v", certFile, err)
+		return
+	}
+	checkValidity(report, "server certificate", cert)
+}
+
+func checkValidity(report *checkReport, name string, cert *x509.Certificate) {
+	now := time.Now()
+	expiry := cert.NotAfter.Format("2006-01-02")
+	switch {
+	case now.Before(cert.NotBefore):
+		report.add(checkFail, name, "not valid before %s", cert.NotBefore.Format("2006-01-02"))
+	case now.After(cert.NotAfter):
+		report.add(checkFail, name, "expired on %s", expiry)
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		report.add(checkWarn, name, "expires soon, on %s", expiry)
+	default:
+		report.add(checkOK, name, "%s, valid until %s", cert.Subject.CommonName, expiry)
+	}
+}
+
+// checkWhisper runs the whisper executable for its usage text, which
+// whisper.cpp prints instead of a version
+func checkWhisper(report *checkReport, whisperPath string) {
+	path, err := exec.LookPath(whisperPath)
+	if err != nil {
+		report.add(checkFail, "whisper", "%v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), whisperProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, path, "--help").CombinedOutput()
+	if ctx.Err() != nil {
+		report.add(checkFail, "whisper", "%s did not respond within %s", path, whisperProbeTimeout)
+		return
+	}
+	if err != nil && !strings.Contains(strings.ToLower(string(output)), "usage") {
+		report.add(checkFail, "whisper", "%s failed to run: %v", path, err)
+		return
+	}
+
+	detail := path
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			detail += ", " + line
+			break
+		}
+	}
+	report.add(checkOK, "whisper", "%s", detail)
+}
+
+// checkQueue pings the Redis server recordings are handed to workers
+// through
+func checkQueue(report *checkReport, client *redis.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		report.add(checkFail, "queue", "%v", err)
+		return
+	}
+	report.add(checkOK, "queue", "Redis answered")
+}
+
+// checkModel verifies the model file is readable and looks like a ggml model
+func checkModel(report *checkReport, modelPath string) {
+	file, err := os.Open(modelPath)
+	if err != nil {
+		report.add(checkFail, "whisper model", "%v", err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		report.add(checkFail, "whisper model", "%v", err)
+		return
+	}
+
+	var magic [4]byte
+	if _, err := file.Read(magic[:]); err != nil || binary.LittleEndian.Uint32(magic[:]) != ggmlMagic {
+		report.add(checkWarn, "whisper model", "%s is not a ggml model file", modelPath)
+		return
+	}
+	report.add(checkOK, "whisper model", "%s, %d MB", modelPath, info.Size()>>20)
+}
+
+// checkConsentNotice verifies the audio file played as transmissions start
+// decodes, when one is set
+func checkConsentNotice(report *checkReport, notice string) {
+	if notice == "" || notice == libascli.ConsentBeep {
+		return
+	}
+	pcm, err := audio.ReadAudio(notice)
+	if err != nil {
+		report.add(checkFail, "consent notice", "%v", err)
+		return
+	}
+	report.add(checkOK, "consent notice", "%s, %s", notice, time.Duration(len(pcm.Samples))*time.Second/time.Duration(pcm.SampleRate))
+}
+
+// checkDirectory verifies a directory exists, or can be created, and that
+// files can be written to it
+func checkDirectory(report *checkReport, dir string) {
+	name := "recordings"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// Report whether the directory could be created, without creating it
+		parent := filepath.Dir(filepath.Clean(dir))
+		if _, err := os.Stat(parent); err != nil {
+			report.add(checkFail, name, "%s does not exist and neither does %s", dir, parent)
+			return
+		}
+		dir = parent
+		name = "recordings parent"
+	}
+
+	probe, err := os.CreateTemp(dir, ".libas-check-*")
+	if err != nil {
+		report.add(checkFail, name, "%s is not writable: %v", dir, err)
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	report.add(checkOK, name, "%s is writable", dir)
+}
+
+// checkRunOptions verifies the diagnostics address is free when one is set
+// and reports the leader lease
+func checkRunOptions(report *checkReport, opts runOptions) {
+	if opts.debugAddr != "" {
+		checkListen(report, "diagnostics address", opts.debugAddr)
+	}
+	if opts.elector != nil {
+		checkLeaderLease(report, opts.elector)
+	}
+}
+
+// checkLeaderLease reports who holds the leader lease
+func checkLeaderLease(report *checkReport, elector *leader.Elector) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	holder, err := elector.Holder(ctx)
+	switch {
+	case err != nil:
+		report.add(checkFail, "leader lease", "%v", err)
+	case holder == "":
+		report.add(checkOK, "leader lease", "free, %s would take it", elector.Name())
+	case holder == elector.Name():
+		report.add(checkOK, "leader lease", "held by this server, %s", holder)
+	default:
+		report.add(checkOK, "leader lease", "held by %s, this server would stand by", holder)
+	}
+}
+
+// checkListen verifies the address can be bound, which fails when another
+// process, such as a running libas, already listens there
+func checkListen(report *checkReport, name, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		report.add(checkFail, name, "cannot listen on %s: %v", addr, err)
+		return
+	}
+	listener.Close()
+	report.add(checkOK, name, "%s is free", addr)
+}
+
+// checkDial verifies a server accepts connections
+func checkDial(report *checkReport, name, addr string) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		report.add(checkFail, name, "cannot connect to %s: %v", addr, err)
+		return
+	}
+	conn.Close()
+	report.add(checkOK, name, "%s accepts connections", addr)
+}
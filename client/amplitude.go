@@ -0,0 +1,29 @@
+package client
+
+// Samples summed per call of sumAbs, keeping the 32 bit lanes of the SIMD
+// version from overflowing
+const sumAbsBlock = 1 << 16
+
+// calculateChunkAmplitude returns the mean absolute sample value of a chunk
+func calculateChunkAmplitude(chunk []int16) float64 {
+	var total uint64
+	for samples := chunk; len(samples) > 0; {
+		n := min(len(samples), sumAbsBlock)
+		total += sumAbs(samples[:n])
+		samples = samples[n:]
+	}
+	return float64(total) / float64(len(chunk))
+}
+
+// sumAbsGeneric sums the absolute sample values in integers, which is exact
+// and without the float conversions. Unrolling it by hand measured slower.
+func sumAbsGeneric(samples []int16) uint64 {
+	var total uint64
+	for _, sample := range samples {
+		// |x| as x^sign - sign, without a branch
+		x := int32(sample)
+		sign := x >> 31
+		total += uint64((x ^ sign) - sign)
+	}
+	return total
+}
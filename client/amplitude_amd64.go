@@ -0,0 +1,15 @@
+//go:build libas_simd
+
+package client
+
+// sumAbs8 sums the absolute values of the samples eight at a time with
+// SSE2, ignoring the last len(samples)%8. It is implemented in
+// amplitude_amd64.s.
+//
+//go:noescape
+func sumAbs8(samples []int16) uint64
+
+func sumAbs(samples []int16) uint64 {
+	n := len(samples) &^ 7
+	return sumAbs8(samples[:n]) + sumAbsGeneric(samples[n:])
+}
@@ -0,0 +1,47 @@
+//go:build libas_simd
+
+#include "textflag.h"
+
+// func sumAbs8(samples []int16) uint64
+TEXT ·sumAbs8(SB), NOSPLIT, $0-32
+	MOVQ samples_base+0(FP), SI
+	MOVQ samples_len+8(FP), CX
+	SHRQ $3, CX
+	PXOR X3, X3 // four 32 bit sums
+	PXOR X7, X7
+
+loop:
+	TESTQ CX, CX
+	JZ    done
+	MOVOU (SI), X0
+
+	// |x| as x^sign - sign, -32768 comes out as 32768 when unsigned
+	MOVO  X0, X1
+	PSRAW $15, X1
+	PXOR  X1, X0
+	PSUBW X1, X0
+
+	// Widen to 32 bits and add to the sums
+	MOVO      X0, X2
+	PUNPCKLWL X7, X0
+	PUNPCKHWL X7, X2
+	PADDL     X0, X3
+	PADDL     X2, X3
+
+	ADDQ $16, SI
+	DECQ CX
+	JMP  loop
+
+done:
+	MOVQ  X3, AX
+	PSRLO $8, X3
+	MOVQ  X3, BX
+	MOVL  AX, CX
+	SHRQ  $32, AX
+	ADDQ  CX, AX
+	MOVL  BX, CX
+	SHRQ  $32, BX
+	ADDQ  CX, AX
+	ADDQ  BX, AX
+	MOVQ  AX, ret+24(FP)
+	RET
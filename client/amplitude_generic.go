@@ -0,0 +1,7 @@
+//go:build !amd64 || !libas_simd
+
+package client
+
+func sumAbs(samples []int16) uint64 {
+	return sumAbsGeneric(samples)
+}
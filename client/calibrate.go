@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/gordonklaus/portaudio"
+)
+
+const (
+	// Margin kept between the loudest background chunks and the threshold
+	noiseMargin = 1.2
+
+	// Pause added on top of the longest usual gap between words
+	silenceTimeoutMargin = 250 * time.Millisecond
+
+	// Bounds of the recommended silence timeout
+	minSilenceTimeout = 500 * time.Millisecond
+	maxSilenceTimeout = 3 * time.Second
+
+	// Bounds of the recommended background buffer, in chunks
+	minBackgroundBufferSize = 20
+	maxBackgroundBufferSize = 500
+)
+
+// ChunkDuration is the length of the audio chunks the VAD classifies
+const ChunkDuration = time.Duration(framesPerBuffer) * time.Second / sampleRate
+
+// Calibration holds VAD settings recommended from recordings of the
+// background and of speech, with the measurements behind them
+type Calibration struct {
+	VADThreshold         float64
+	SilenceTimeout       time.Duration
+	BackgroundBufferSize int
+
+	// Mean and 99th percentile chunk amplitude of the background
+	NoiseMean float64
+	NoiseP99  float64
+
+	// 20th percentile and median amplitude of the chunks that held speech
+	SpeechP20    float64
+	SpeechMedian float64
+
+	// Set when speech was barely louder than the background, in which case
+	// the threshold only keeps noise out and quiet speech may be missed
+	Marginal bool
+}
+
+// RecordAmplitudes records from the input device with the given ID, zero
+// for the default device, and returns the amplitude of each chunk after the
+// same high-pass filter capture applies
+func RecordAmplitudes(ctx context.Context, deviceID int, highPassHz float64, duration time.Duration) ([]float64, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize PortAudio: %w", err)
+	}
+	defer portaudio.Terminate()
+
+	params, err := inputParameters(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var highPass *audio.HighPassFilter
+	if highPassHz > 0 {
+		highPass = audio.NewHighPassFilter(int(params.SampleRate), highPassHz)
+	}
+
+	var mu sync.Mutex
+	amplitudes := make([]float64, 0, int(duration/ChunkDuration)+1)
+	stream, err := portaudio.OpenStream(params, func(in []int16) {
+		if highPass != nil {
+			highPass.Process(in)
+		}
+		mu.Lock()
+		amplitudes = append(amplitudes, calculateChunkAmplitude(in))
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start audio stream: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+
+	if err := stream.Stop(); err != nil {
+		return nil, fmt.Errorf("failed to stop audio stream: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return amplitudes, nil
+}
+
+// Calibrate recommends VAD settings from the chunk amplitudes of a
+// recording of the background alone and one of natural speech
+func Calibrate(noise, speech []float64) (*Calibration, error) {
+	if len(noise) == 0 || len(speech) == 0 {
+		return nil, fmt.Errorf("no audio was recorded")
+	}
+
+	c := &Calibration{
+		NoiseMean: mean(noise),
+		NoiseP99:  percentile(noise, 0.99),
+	}
+	if c.NoiseMean <= 0 {
+		return nil, fmt.Errorf("the input is silent, check the device")
+	}
+
+	// Chunks louder than any background chunk are taken as speech
+	voiced := make([]float64, 0, len(speech))
+	for _, amplitude := range speech {
+		if amplitude > c.NoiseP99 {
+			voiced = append(voiced, amplitude)
+		}
+	}
+	if len(voiced) == 0 {
+		return nil, fmt.Errorf("no speech was louder than the background")
+	}
+	c.SpeechP20 = percentile(voiced, 0.2)
+	c.SpeechMedian = percentile(voiced, 0.5)
+
+	// Place the threshold between the loudest noise and quiet speech,
+	// relative to the background level the VAD compares against
+	lower := noiseMargin * c.NoiseP99 / c.NoiseMean
+	upper := c.SpeechP20 / c.NoiseMean
+	if upper > lower {
+		c.VADThreshold = math.Sqrt(lower * upper)
+	} else {
+		c.VADThreshold = lower
+		c.Marginal = true
+	}
+	c.VADThreshold = math.Round(c.VADThreshold*100) / 100
+
+	// Classify the speech recording with that threshold and look at the
+	// runs of speech and the pauses between them
+	speaking, pauses := runs(speech, c.VADThreshold*c.NoiseMean)
+
+	c.SilenceTimeout = defaultSilenceTimeout
+	if len(pauses) > 0 {
+		longest := time.Duration(percentile(pauses, 0.9) * float64(ChunkDuration))
+		c.SilenceTimeout = min(max(longest+silenceTimeoutMargin, minSilenceTimeout), maxSilenceTimeout)
+		c.SilenceTimeout = c.SilenceTimeout.Round(50 * time.Millisecond)
+	}
+
+	// The background average should span twice a typical utterance so
+	// speech does not pull the background up before it ends
+	c.BackgroundBufferSize = defaultBackgroundBufferSize
+	if len(speaking) > 0 {
+		size := int(2 * percentile(speaking, 0.5))
+		c.BackgroundBufferSize = min(max(size, minBackgroundBufferSize), maxBackgroundBufferSize)
+	}
+
+	return c, nil
+}
+
+// runs returns the lengths, in chunks, of stretches above the level and of
+// the pauses between them. Leading and trailing silence is not a pause.
+func runs(amplitudes []float64, level float64) (speaking, pauses []float64) {
+	current, above, seenSpeech := 0, false, false
+	for _, amplitude := range amplitudes {
+		if (amplitude > level) == above {
+			current++
+			continue
+		}
+		if above {
+			speaking = append(speaking, float64(current))
+		} else if seenSpeech {
+			pauses = append(pauses, float64(current))
+		}
+		seenSpeech = seenSpeech || above
+		above = !above
+		current = 1
+	}
+	if above {
+		speaking = append(speaking, float64(current))
+	}
+	return speaking, pauses
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// percentile returns the value below which the fraction p of values fall
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[int(p*float64(len(sorted)-1))]
+}
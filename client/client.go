@@ -1,31 +1,60 @@
-package libascli
+// Package client captures a microphone, detects speech and streams it to
+// a libas audio server. Create one with New and call Run.
+package client
 
 import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log/slog"
 	"math"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/protocol"
 	"github.com/google/uuid"
 	"github.com/gordonklaus/portaudio"
 )
 
 const (
-	calibrationDuration  = 5 * time.Second
-	silenceThreshold     = 1 * time.Second
-	vadThreshold         = 2.22 // TODO: make this configurable at a later date, I want to be able to change this while we are running on a per client basis  in case there's a multiple instantiations of clients in a single application
-	backgroundBufferSize = 50   // TODO: as above so below
+	calibrationDuration         = 5 * time.Second
+	defaultSilenceTimeout       = 1 * time.Second
+	defaultVADThreshold         = 2.22 // TODO: make this configurable at a later date, I want to be able to change this while we are running on a per client basis  in case there's a multiple instantiations of clients in a single application
+	defaultBackgroundBufferSize = 50   // TODO: as above so below
 
 	sampleRate      = 44100
 	channels        = 1
 	framesPerBuffer = 1024
+
+	// Rate whisper consumes, requested from the server when the capture
+	// device supports it so recordings need no resampling
+	whisperSampleRate = 16000
+
+	// How long to wait for the server to accept a capture format. Older
+	// servers never answer and expect 44.1kHz.
+	formatReplyTimeout = 3 * time.Second
+
+	// Length of the transmissions continuous recording is cut into
+	continuousTransmission = 5 * time.Minute
+
+	// Speech waiting to be played, more is dropped
+	speechQueueSize = 4
+
+	// How long voice detection stays muted after speech has played, so
+	// its echo is not recorded
+	speechTail = 500 * time.Millisecond
+
+	// Captured chunks waiting for the audio worker, about one and a half
+	// seconds at 44.1kHz. Chunks arriving while it is full are dropped.
+	captureQueueSize = 64
 )
 
 type AudioProcessor struct {
@@ -37,21 +66,84 @@ type AudioProcessor struct {
 	totalBytes       int
 	logCounter       int
 	clientID         uuid.UUID
+
+	// Removes DC offset and rumble before the VAD sees the audio, cutoff in
+	// Hz with zero disabling the filter
+	highPassHz float64
+	highPass   *audio.HighPassFilter
+
+	// Speech threshold as a ratio over background noise, stored as IEEE 754
+	// bits since the server can change it while audio is processed, and how
+	// long silence lasts before a transmission ends
+	vadThreshold   atomic.Uint64
+	silenceTimeout time.Duration
+
+	// Number of recent chunks averaged into the background noise level
+	backgroundBufferSize int
+
+	// Speech from the server waiting to be played, nil unless the client
+	// plays speech, and whether voice detection is muted while it plays
+	speech   chan *audio.PCM
+	speaking atomic.Bool
+
+	// Plays live audio routed from another client, nil unless the client
+	// plays speech
+	live *livePlayer
+
+	// Set while the server has muted the client, which then does not
+	// transmit
+	silenced atomic.Bool
+
+	// Set while the server has the client record continuously, e.g. for a
+	// meeting, transmitting back to back whether or not anyone speaks, and
+	// when the current transmission started
+	continuous       atomic.Bool
+	transmissionFrom time.Time
+
+	// Intervals between health reports the server asks for
+	health chan time.Duration
+
+	// Played as a transmission starts, nil for none, and whether it is
+	// playing
+	consent  *audio.PCM
+	noticing atomic.Bool
 }
 
 func NewAudioProcessor() *AudioProcessor {
-	return &AudioProcessor{
-		backgroundBuffer: make([]float64, 0, backgroundBufferSize),
+	ap := &AudioProcessor{
+		backgroundBuffer:     make([]float64, 0, defaultBackgroundBufferSize),
+		silenceTimeout:       defaultSilenceTimeout,
+		backgroundBufferSize: defaultBackgroundBufferSize,
 	}
+	ap.setVADThreshold(defaultVADThreshold)
+	return ap
 }
 
-func (ap *AudioProcessor) calibrateBackgroundNoise() {
+func (ap *AudioProcessor) setVADThreshold(threshold float64) {
+	ap.vadThreshold.Store(math.Float64bits(threshold))
+}
+
+func (ap *AudioProcessor) vad() float64 {
+	return math.Float64frombits(ap.vadThreshold.Load())
+}
+
+// calibrateBackgroundNoise measures the background on the capture device
+func (ap *AudioProcessor) calibrateBackgroundNoise(params portaudio.StreamParameters) {
 	slog.Debug("Calibrating background noise")
 
 	var totalAmplitude float64
 	var sampleCount int
 
-	stream, err := portaudio.OpenDefaultStream(channels, 0, sampleRate, framesPerBuffer, func(in []int16) {
+	// Calibrate on the same filtered signal the VAD will see
+	var highPass *audio.HighPassFilter
+	if ap.highPassHz > 0 {
+		highPass = audio.NewHighPassFilter(int(params.SampleRate), ap.highPassHz)
+	}
+
+	stream, err := portaudio.OpenStream(params, func(in []int16) {
+		if highPass != nil {
+			highPass.Process(in)
+		}
 		amplitude := calculateChunkAmplitude(in)
 		totalAmplitude += amplitude
 		sampleCount++
@@ -79,13 +171,30 @@ func (ap *AudioProcessor) calibrateBackgroundNoise() {
 	slog.Debug("Background noise calibration complete", "averageAmplitude", ap.backgroundNoise)
 }
 
-func (ap *AudioProcessor) processAudioChunk(ctx context.Context, cancel context.CancelFunc, conn net.Conn, chunk []int16, connClosed chan struct{}) {
+func (ap *AudioProcessor) processAudioChunk(ctx context.Context, out *sender, chunk []int16) {
 	select {
 	case <-ctx.Done():
 		return
 	default:
+		if ap.silenced.Load() {
+			if ap.isTransmitting {
+				ap.isTransmitting = false
+				slog.Info("Muted by the server, stopping transmission")
+				out.endTransmission()
+			}
+			return
+		}
+
+		if ap.highPass != nil {
+			ap.highPass.Process(chunk)
+		}
 		chunkAmplitude := calculateChunkAmplitude(chunk)
-		ap.updateBackgroundNoise(chunkAmplitude)
+
+		// Speech the client plays is neither background nor a transmission
+		muted := ap.speaking.Load() || (ap.live != nil && ap.live.playing())
+		if !muted {
+			ap.updateBackgroundNoise(chunkAmplitude)
+		}
 
 		ap.logCounter++
 		if ap.logCounter%10 == 0 {
@@ -96,55 +205,50 @@ func (ap *AudioProcessor) processAudioChunk(ctx context.Context, cancel context.
 		}
 
 		energyRatio := chunkAmplitude / ap.backgroundNoise
-		isSpeech := energyRatio > vadThreshold
+		continuous := ap.continuous.Load()
+		isSpeech := (!muted && energyRatio > ap.vad()) || continuous
 
 		if isSpeech {
 			ap.lastNoiseTime = time.Now()
+			if ap.isTransmitting && continuous && time.Since(ap.transmissionFrom) >= continuousTransmission {
+				// Recorded back to back, without noticing it again
+				slog.Info("Recording continuously, starting next transmission", "totalSamples", ap.totalSamples)
+				out.endTransmission()
+				out.startTransmission()
+				ap.transmissionFrom = time.Now()
+				ap.totalSamples = 0
+				ap.totalBytes = 0
+			}
 			if !ap.isTransmitting {
 				ap.isTransmitting = true
+				ap.transmissionFrom = time.Now()
 				ap.totalSamples = 0
 				ap.totalBytes = 0
 				slog.Info("Speech detected, starting transmission",
 					"chunkAmplitude", chunkAmplitude,
 					"backgroundNoise", ap.backgroundNoise,
-					"ratio", energyRatio)
-				sendStartTransmission(conn)
-			}
-			if err := sendAudioChunk(ctx, conn, chunk); err != nil {
-				if isConnectionClosed(err) {
-					select {
-					case connClosed <- struct{}{}: // Signal connection closure
-					default: // Channel already closed or full
-					}
-					return
-				}
-				slog.Error("Error sending audio chunk", "error", err)
+					"ratio", energyRatio,
+					"continuous", continuous)
+				out.startTransmission()
+				ap.noticeRecording(ctx)
 			}
+			out.audioChunk(chunk)
 			ap.totalSamples += len(chunk)
 			ap.totalBytes += len(chunk) * 2 // 2 bytes per sample
 		} else if ap.isTransmitting {
 			// Continue transmitting during short pauses
-			if err := sendAudioChunk(ctx, conn, chunk); err != nil {
-				if isConnectionClosed(err) {
-					select {
-					case connClosed <- struct{}{}: // Signal connection closure
-					default: // Channel already closed or full
-					}
-					return
-				}
-				slog.Error("Error sending audio chunk", "error", err)
-			}
+			out.audioChunk(chunk)
 			ap.totalSamples += len(chunk)
 			ap.totalBytes += len(chunk) * 2
 
 			// Check for extended silence
-			if time.Since(ap.lastNoiseTime) > silenceThreshold {
+			if time.Since(ap.lastNoiseTime) > ap.silenceTimeout {
 				ap.isTransmitting = false
 				slog.Info("Extended silence detected, stopping transmission",
 					"totalSamples", ap.totalSamples,
 					"totalBytes", ap.totalBytes,
 					"durationSeconds", time.Since(ap.lastNoiseTime).Seconds())
-				sendEndTransmission(conn)
+				out.endTransmission()
 			}
 		}
 
@@ -158,7 +262,7 @@ func (ap *AudioProcessor) processAudioChunk(ctx context.Context, cancel context.
 }
 
 func (ap *AudioProcessor) updateBackgroundNoise(amplitude float64) {
-	if len(ap.backgroundBuffer) >= backgroundBufferSize {
+	if len(ap.backgroundBuffer) >= ap.backgroundBufferSize {
 		ap.backgroundBuffer = ap.backgroundBuffer[1:]
 	}
 	ap.backgroundBuffer = append(ap.backgroundBuffer, amplitude)
@@ -171,50 +275,12 @@ func (ap *AudioProcessor) updateBackgroundNoise(amplitude float64) {
 	ap.backgroundNoise = sum / float64(len(ap.backgroundBuffer))
 }
 
-func calculateChunkAmplitude(chunk []int16) float64 {
-	var totalAmplitude float64
-	for _, sample := range chunk {
-		totalAmplitude += math.Abs(float64(sample))
-	}
-	return totalAmplitude / float64(len(chunk))
-}
-
-func sendStartTransmission(conn net.Conn) {
-	_, err := conn.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF}) // Start marker
-	if err != nil {
-		slog.Error("Failed to send start transmission marker", "error", err)
-	}
-}
-
-func sendEndTransmission(conn net.Conn) {
-	_, err := conn.Write([]byte{0x00, 0x00, 0x00, 0x00}) // End marker
-	if err != nil {
-		slog.Error("Failed to send end transmission marker", "error", err)
-	}
-}
-
-func sendAudioChunk(ctx context.Context, conn net.Conn, chunk []int16) error {
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
-		// Send chunk size
-		sizeBuf := make([]byte, 4)
-		binary.BigEndian.PutUint32(sizeBuf, uint32(len(chunk)*2))
-		if _, err := conn.Write(sizeBuf); err != nil {
-			return err
-		}
-
-		// Send audio data
-		bytes := make([]byte, len(chunk)*2)
-		for i, sample := range chunk {
-			binary.LittleEndian.PutUint16(bytes[i*2:], uint16(sample))
-		}
-		if _, err := conn.Write(bytes); err != nil {
-			return err
-		}
-		return nil
-	}
+// samplePool holds the copies of captured chunks queued for the audio worker
+var samplePool = sync.Pool{
+	New: func() any {
+		buf := make([]int16, 0, framesPerBuffer)
+		return &buf
+	},
 }
 
 // Helper function to check for connection closure
@@ -230,7 +296,14 @@ func isConnectionClosed(err error) bool {
 	return false
 }
 
-func ListAudioDevices() ([]portaudio.DeviceInfo, error) {
+// AudioDevice is an input device and the ID that selects it for capture
+type AudioDevice struct {
+	ID int
+	portaudio.DeviceInfo
+}
+
+// ListAudioDevices returns the input devices
+func ListAudioDevices() ([]AudioDevice, error) {
 	err := portaudio.Initialize()
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize PortAudio: %w", err)
@@ -242,35 +315,62 @@ func ListAudioDevices() ([]portaudio.DeviceInfo, error) {
 		return nil, fmt.Errorf("failed to get devices: %w", err)
 	}
 
-	// Filter to only input devices
-	inputDevices := make([]portaudio.DeviceInfo, 0)
-	for _, device := range devices {
+	// Filter to only input devices, keeping the index Config.DeviceID selects them by
+	inputDevices := make([]AudioDevice, 0)
+	for i, device := range devices {
 		if device.MaxInputChannels > 0 {
-			inputDevices = append(inputDevices, *device)
+			inputDevices = append(inputDevices, AudioDevice{ID: i, DeviceInfo: *device})
 		}
 	}
 
 	return inputDevices, nil
 }
 
-func Launch(ctx context.Context, serverAddr string, insecureMode bool, token, serverCertFile string, deviceID int) {
-	slog.Debug("Starting client",
-		"serverAddress", serverAddr,
-		"deviceID", deviceID)
+// Client streams the voice detected on an input device to an audio server
+type Client struct {
+	config    Config
+	tlsConfig *tls.Config
+	consent   *audio.PCM
+}
 
-	// Create TLS configuration
-	tlsConfig, err := createTLSConfig(insecureMode, serverCertFile)
+// New creates a client, loading the server certificate unless the
+// configuration skips verification, and the consent notice
+func New(cfg Config) (*Client, error) {
+	if cfg.ServerAddr == "" {
+		return nil, fmt.Errorf("a server address is required")
+	}
+
+	tlsConfig, err := createTLSConfig(cfg.Insecure, cfg.CertFile)
 	if err != nil {
-		slog.Error("Failed to create TLS config", "error", err)
-		return
+		return nil, fmt.Errorf("failed to create TLS config: %w", err)
 	}
 
+	consent, err := loadConsentNotice(cfg.ConsentNotice)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{config: cfg, tlsConfig: tlsConfig, consent: consent}, nil
+}
+
+// Run connects to the server and streams until ctx is cancelled, returning
+// an error when the connection cannot be set up or is lost
+func (c *Client) Run(ctx context.Context) error {
+	cfg := c.config
+	slog.Debug("Starting client",
+		"serverAddress", cfg.ServerAddr,
+		"deviceID", cfg.DeviceID,
+		"highPassHz", cfg.HighPassHz)
+
+	deviceID := cfg.DeviceID
+
 	// Create a new context with cancellation for this launch
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Create connection monitor channel
+	// Create connection monitor channel, lost is closed once it reports
 	connClosed := make(chan struct{})
+	lost := make(chan struct{})
 
 	// Start a goroutine to monitor connection status
 	go func() {
@@ -279,7 +379,7 @@ func Launch(ctx context.Context, serverAddr string, insecureMode bool, token, se
 		case <-ctx.Done():
 			return
 		case <-connClosed:
-			slog.Error("Server connection lost")
+			close(lost)
 			cancel() // Cancel context to trigger shutdown
 			return
 		}
@@ -287,100 +387,124 @@ func Launch(ctx context.Context, serverAddr string, insecureMode bool, token, se
 
 	// Establish a persistent TLS connection
 	dialer := &tls.Dialer{
-		Config: tlsConfig,
+		Config: c.tlsConfig,
 	}
-	conn, err := dialer.DialContext(ctx, "tcp", serverAddr)
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.ServerAddr)
 	if err != nil {
-		slog.Error("Failed to connect to server", "error", err)
-		return
+		return fmt.Errorf("failed to connect to server: %w", err)
 	}
 	defer conn.Close()
 
 	// Send the token to the server
-	_, err = conn.Write([]byte(token))
-	if err != nil {
-		slog.Error("Failed to send token to server", "error", err)
-		return
+	if err := protocol.NewClientEncoder(conn).Token(cfg.Token); err != nil {
+		return fmt.Errorf("failed to send token to server: %w", err)
 	}
 
-	// Receive client ID from server
-	clientID, err := receiveClientID(conn)
+	// Receive client ID from server, which hangs up instead on a wrong token
+	clientID, err := protocol.NewServerDecoder(conn).ClientID()
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: server closed the connection after the token, check that it matches", fault.ErrAuthFailed)
+	}
 	if err != nil {
-		slog.Error("Failed to receive client ID", "error", err)
-		return
+		return fmt.Errorf("failed to receive client ID: %w", err)
 	}
 	slog.Info("Received client ID", "clientID", clientID)
 
 	err = portaudio.Initialize()
 	if err != nil {
-		slog.Error("Failed to initialize PortAudio", "error", err)
-		return
+		return fmt.Errorf("failed to initialize PortAudio: %w", err)
 	}
 	defer portaudio.Terminate()
 
-	var inputParams portaudio.StreamParameters
-	if deviceID > 0 { // Only use specific device if explicitly requested (non-zero)
-		devices, err := portaudio.Devices()
-		if err != nil {
-			slog.Error("Failed to get audio devices", "error", err)
-			return
-		}
-
-		if deviceID >= len(devices) {
-			slog.Error("Invalid device ID", "deviceID", deviceID)
-			return
-		}
-
-		device := devices[deviceID]
-		if device.MaxInputChannels == 0 {
-			slog.Error("Specified device is not an input device",
-				"deviceID", deviceID,
-				"deviceName", device.Name)
-			return
-		}
-
-		slog.Info("Using specified audio device",
-			"deviceID", deviceID,
-			"deviceName", device.Name,
-			"sampleRate", device.DefaultSampleRate,
-			"inputChannels", device.MaxInputChannels)
+	inputParams, err := inputParameters(deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to select audio device: %w", err)
+	}
 
-		inputParams = portaudio.StreamParameters{
-			Input: portaudio.StreamDeviceParameters{
-				Device:   device,
-				Channels: channels,
-				Latency:  device.DefaultLowInputLatency,
-			},
-			SampleRate:      sampleRate,
-			FramesPerBuffer: framesPerBuffer,
-		}
+	// Devices that only run at their own rate, such as WASAPI in shared
+	// mode, are resampled to the rate the server records at
+	var resampler *audio.StreamResampler
+	deviceRate := inputParams.SampleRate
+	streamRate := negotiateSampleRate(conn, inputParams)
+	if streamRate == whisperSampleRate || deviceRate == sampleRate {
+		inputParams.SampleRate = streamRate
 	} else {
-		// Use default device
-		defaultDevice, err := portaudio.DefaultInputDevice()
-		if err != nil {
-			slog.Error("Failed to get default input device", "error", err)
-			return
-		}
-
-		slog.Info("Using default audio device",
-			"deviceName", defaultDevice.Name,
-			"sampleRate", defaultDevice.DefaultSampleRate,
-			"inputChannels", defaultDevice.MaxInputChannels)
-
-		inputParams = portaudio.StreamParameters{
-			Input: portaudio.StreamDeviceParameters{
-				Device:   defaultDevice,
-				Channels: channels,
-				Latency:  defaultDevice.DefaultLowInputLatency,
-			},
-			SampleRate:      sampleRate,
-			FramesPerBuffer: framesPerBuffer,
-		}
+		slog.Info("Resampling capture for the server",
+			"deviceRate", deviceRate,
+			"sampleRate", streamRate)
+		resampler = audio.NewStreamResampler(int(deviceRate), int(streamRate))
 	}
 
 	ap := NewAudioProcessor()
 	ap.clientID = clientID
-	ap.calibrateBackgroundNoise()
+	ap.consent = c.consent
+	ap.highPassHz = cfg.HighPassHz
+	if cfg.HighPassHz > 0 {
+		ap.highPass = audio.NewHighPassFilter(int(streamRate), cfg.HighPassHz)
+	}
+	if cfg.VADThreshold > 0 {
+		ap.setVADThreshold(cfg.VADThreshold)
+	}
+	if cfg.SilenceTimeout > 0 {
+		ap.silenceTimeout = cfg.SilenceTimeout
+	}
+	if cfg.BackgroundBufferSize > 0 {
+		ap.backgroundBufferSize = cfg.BackgroundBufferSize
+	}
+	ap.calibrateBackgroundNoise(inputParams)
+
+	if err := protocol.NewClientEncoder(conn).Announce(protocol.Mute, protocol.Continuous, protocol.Health); err != nil {
+		return fmt.Errorf("failed to announce mute support: %w", err)
+	}
+	ap.health = make(chan time.Duration, 1)
+	if cfg.PlaySpeech {
+		if err := protocol.NewClientEncoder(conn).Announce(protocol.Speech, protocol.Live); err != nil {
+			return fmt.Errorf("failed to announce speech playback: %w", err)
+		}
+		ap.speech = make(chan *audio.PCM, speechQueueSize)
+		go ap.speak(ctx)
+		ap.live = &livePlayer{}
+		go ap.live.run(ctx)
+	}
+
+	// The server only sends settings once the capture format is settled
+	go ap.readSettings(conn)
+
+	// Audio is written by its own goroutine, so a stalled network only
+	// backs up the send queue
+	out := newSender(conn, connClosed)
+	go out.run(ctx)
+	go reportHealth(ctx, out, ap.health)
+
+	// The stream callback only copies the audio out, resampling, voice
+	// detection and sending run on a worker so a slow network or CPU
+	// spike cannot make the device overrun
+	captured := make(chan *[]int16, captureQueueSize)
+	var dropped atomic.Int64
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case buf := <-captured:
+				if n := dropped.Swap(0); n > 0 {
+					slog.Warn("Audio processing fell behind, dropped chunks", "chunks", n)
+				}
+				in := *buf
+				if resampler != nil {
+					in = resampler.Process(in)
+				}
+				ap.processAudioChunk(ctx, out, in)
+				samplePool.Put(buf)
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-workerDone
+	}()
 
 	// Open the stream with our parameters
 	stream, err := portaudio.OpenStream(inputParams, func(in []int16) {
@@ -388,20 +512,26 @@ func Launch(ctx context.Context, serverAddr string, insecureMode bool, token, se
 		case <-ctx.Done():
 			return
 		default:
-			ap.processAudioChunk(ctx, cancel, conn, in, connClosed)
+		}
+
+		buf := samplePool.Get().(*[]int16)
+		*buf = append((*buf)[:0], in...)
+		select {
+		case captured <- buf:
+		default:
+			samplePool.Put(buf)
+			dropped.Add(1)
 		}
 	})
 	if err != nil {
-		slog.Error("Failed to open audio stream", "error", err)
-		return
+		return fmt.Errorf("failed to open audio stream: %w", err)
 	}
 	defer stream.Close()
 
 	// Start the audio stream
 	err = stream.Start()
 	if err != nil {
-		slog.Error("Failed to start audio stream", "error", err)
-		return
+		return fmt.Errorf("failed to start audio stream: %w", err)
 	}
 
 	// Wait for context cancellation
@@ -413,15 +543,208 @@ func Launch(ctx context.Context, serverAddr string, insecureMode bool, token, se
 	if err != nil {
 		slog.Error("Failed to stop audio stream", "error", err)
 	}
+
+	select {
+	case <-lost:
+		return fmt.Errorf("server connection lost")
+	default:
+		return nil
+	}
 }
 
-func receiveClientID(conn net.Conn) (uuid.UUID, error) {
-	idBytes := make([]byte, 16)
-	_, err := io.ReadFull(conn, idBytes)
+// inputParameters describes a mono 44.1kHz capture stream from the device
+// with the given ID, where zero selects the default input device. Devices
+// that refuse 44.1kHz are opened at their default rate.
+func inputParameters(deviceID int) (portaudio.StreamParameters, error) {
+	var device *portaudio.DeviceInfo
+	if deviceID > 0 { // Only use specific device if explicitly requested (non-zero)
+		devices, err := portaudio.Devices()
+		if err != nil {
+			return portaudio.StreamParameters{}, fmt.Errorf("failed to get audio devices: %w", err)
+		}
+
+		if deviceID >= len(devices) {
+			return portaudio.StreamParameters{}, fmt.Errorf("invalid device ID %d", deviceID)
+		}
+
+		device = devices[deviceID]
+		if device.MaxInputChannels == 0 {
+			return portaudio.StreamParameters{}, fmt.Errorf("device %d (%s) is not an input device", deviceID, device.Name)
+		}
+
+		slog.Info("Using specified audio device",
+			"deviceID", deviceID,
+			"deviceName", device.Name,
+			"sampleRate", device.DefaultSampleRate,
+			"inputChannels", device.MaxInputChannels)
+	} else {
+		// Use default device
+		var err error
+		device, err = portaudio.DefaultInputDevice()
+		if err != nil {
+			return portaudio.StreamParameters{}, fmt.Errorf("failed to get default input device: %w", err)
+		}
+
+		slog.Info("Using default audio device",
+			"deviceName", device.Name,
+			"sampleRate", device.DefaultSampleRate,
+			"inputChannels", device.MaxInputChannels)
+	}
+
+	params := portaudio.StreamParameters{
+		Input: portaudio.StreamDeviceParameters{
+			Device:   device,
+			Channels: channels,
+			Latency:  device.DefaultLowInputLatency,
+		},
+		SampleRate:      sampleRate,
+		FramesPerBuffer: framesPerBuffer,
+	}
+
+	// WASAPI shared mode only opens devices at the rate set in the Windows
+	// sound settings, fall back to it when 44.1kHz is refused
+	if err := portaudio.IsFormatSupported(params, func(in []int16) {}); err != nil && device.DefaultSampleRate != sampleRate {
+		slog.Info("Device does not support 44.1kHz capture, using its own rate",
+			"sampleRate", device.DefaultSampleRate,
+			"error", err)
+		params.SampleRate = device.DefaultSampleRate
+	}
+	return params, nil
+}
+
+// negotiateSampleRate asks the server to accept 16kHz capture when the input
+// device supports it, returning the rate to record at
+func negotiateSampleRate(conn net.Conn, params portaudio.StreamParameters) float64 {
+	params.SampleRate = whisperSampleRate
+	if err := portaudio.IsFormatSupported(params, func(in []int16) {}); err != nil {
+		slog.Debug("Device does not support 16kHz capture", "error", err)
+		return sampleRate
+	}
+
+	if err := protocol.NewClientEncoder(conn).Format(whisperSampleRate); err != nil {
+		slog.Error("Failed to send capture format", "error", err)
+		return sampleRate
+	}
+
+	conn.SetReadDeadline(time.Now().Add(formatReplyTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	accepted, err := protocol.NewServerDecoder(conn).FormatReply()
 	if err != nil {
-		return uuid.Nil, err
+		slog.Info("Server did not accept capture format, recording at 44.1kHz", "error", err)
+		return sampleRate
+	}
+	if accepted != whisperSampleRate {
+		slog.Info("Server declined 16kHz capture", "sampleRate", accepted)
+		return sampleRate
+	}
+
+	slog.Info("Capturing at 16kHz, recordings need no resampling")
+	return whisperSampleRate
+}
+
+// readSettings applies the settings the server sends until the connection
+// closes
+func (ap *AudioProcessor) readSettings(conn net.Conn) {
+	decoder := protocol.NewServerDecoder(conn)
+	for {
+		message, err := decoder.Next()
+		if errors.Is(err, fault.ErrProtocol) {
+			slog.Warn("Invalid message from server, ignoring further settings", "error", err)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		switch message.Kind {
+		case protocol.VAD:
+			threshold := message.Threshold
+			if threshold <= 0 || math.IsInf(threshold, 0) || math.IsNaN(threshold) {
+				slog.Warn("Ignoring invalid VAD threshold from server", "threshold", threshold)
+				continue
+			}
+			ap.setVADThreshold(threshold)
+			slog.Info("Server changed VAD threshold", "threshold", threshold)
+		case protocol.Speech, protocol.Live:
+			ap.receiveSpeech(message)
+		case protocol.Mute:
+			ap.silenced.Store(true)
+			if !message.Until.IsZero() {
+				slog.Warn("Server muted the client, not transmitting", "until", message.Until)
+			} else {
+				slog.Warn("Server muted the client, not transmitting until unmuted")
+			}
+		case protocol.Unmute:
+			ap.silenced.Store(false)
+			slog.Info("Server unmuted the client")
+		case protocol.Continuous:
+			ap.continuous.Store(message.On)
+			if message.On {
+				slog.Info("Server started continuous recording")
+			} else {
+				slog.Info("Server stopped continuous recording")
+			}
+		case protocol.Health:
+			// Only the latest interval matters
+			select {
+			case <-ap.health:
+			default:
+			}
+			ap.health <- message.Interval
+		case protocol.Refused:
+			reason := "unknown reason"
+			if message.Reason == protocol.RefusedStorageFull {
+				reason = "server recordings volume is nearly full"
+			}
+			slog.Error("Server refused the transmission, its audio is not recorded", "reason", reason)
+		}
+	}
+}
+
+// receiveSpeech queues speech or a chunk of live audio from the server for
+// playing
+func (ap *AudioProcessor) receiveSpeech(message protocol.Message) {
+	if ap.speech == nil {
+		slog.Warn("Server sent speech though the client does not play it")
+		return
+	}
+	if message.Kind == protocol.Live {
+		ap.live.play(message.Samples, message.SampleRate)
+		return
+	}
+
+	select {
+	case ap.speech <- &audio.PCM{Samples: message.Samples, SampleRate: message.SampleRate}:
+		slog.Info("Received speech", "duration", time.Duration(len(message.Samples))*time.Second/time.Duration(message.SampleRate))
+	default:
+		slog.Warn("Speech queue is full, dropping speech from server")
+	}
+}
+
+// speak plays the speech the server sends one after another, muting voice
+// detection meanwhile so the client does not record itself
+func (ap *AudioProcessor) speak(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case speech := <-ap.speech:
+			ap.speaking.Store(true)
+			if err := playSpeech(ctx, speech); err != nil {
+				slog.Error("Failed to play speech", "error", err)
+			}
+			if len(ap.speech) > 0 {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(speechTail):
+			}
+			ap.speaking.Store(false)
+		}
 	}
-	return uuid.FromBytes(idBytes)
 }
 
 func createTLSConfig(insecureMode bool, serverCertFile string) (*tls.Config, error) {
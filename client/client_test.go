@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+// transmission is where the VAD started and stopped transmitting
+type transmission struct {
+	start, end time.Duration
+}
+
+// detect feeds pcm to a processor chunk by chunk as capture would, after a
+// second of the noise alone to settle the background level, and returns the
+// transmissions it made. Chunks are processed faster than real time, so the
+// test waits out the silence timeout at the start of each pause between
+// utterances.
+func detect(t *testing.T, ap *AudioProcessor, pcm *audio.PCM, utterances []audiotest.Utterance, noise float64) []transmission {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	out := newSender(local, make(chan struct{}, 1))
+	ctx := context.Background()
+
+	background := audiotest.Noise(pcm.SampleRate, time.Second, noise, 2)
+	for start := 0; start+framesPerBuffer <= len(background.Samples); start += framesPerBuffer {
+		ap.processAudioChunk(ctx, out, background.Samples[start:start+framesPerBuffer])
+	}
+	if ap.isTransmitting {
+		t.Fatal("transmitting on background noise")
+	}
+
+	var transmissions []transmission
+	next := 0 // utterance whose end is still ahead
+	for start := 0; start+framesPerBuffer <= len(pcm.Samples); start += framesPerBuffer {
+		at := time.Duration(start) * time.Second / time.Duration(pcm.SampleRate)
+		if next < len(utterances) && at >= utterances[next].End {
+			time.Sleep(ap.silenceTimeout)
+			next++
+		}
+
+		was := ap.isTransmitting
+		ap.processAudioChunk(ctx, out, slices.Clone(pcm.Samples[start:start+framesPerBuffer]))
+		switch {
+		case !was && ap.isTransmitting:
+			transmissions = append(transmissions, transmission{start: at})
+		case was && !ap.isTransmitting:
+			transmissions[len(transmissions)-1].end = at
+		}
+	}
+	return transmissions
+}
+
+func TestVoiceDetection(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate int
+		level      float64 // dBFS of the speech
+		noise      float64 // dBFS of the background
+		highPassHz float64
+		want       int
+	}{
+		{"quiet room", 16000, -12, -60, 0, 3},
+		{"at 44.1kHz", 44100, -12, -60, 0, 3},
+		{"noisy room", 16000, -12, -35, 0, 3},
+		{"high-pass filtered", 16000, -12, -60, 80, 3},
+		{"speech below the threshold", 16000, -40, -35, 0, 0},
+	}
+	for _, tt := range tests {
+		ap := NewAudioProcessor()
+		ap.silenceTimeout = 20 * time.Millisecond
+		if tt.highPassHz > 0 {
+			ap.highPass = audio.NewHighPassFilter(tt.sampleRate, tt.highPassHz)
+		}
+		speech, utterances := audiotest.Utterances(tt.sampleRate, 3, time.Second, 1500*time.Millisecond, tt.level)
+		pcm := audiotest.Mix(speech, audiotest.Noise(tt.sampleRate, 6*time.Second, tt.noise, 1))
+
+		transmissions := detect(t, ap, pcm, utterances, tt.noise)
+		if len(transmissions) != tt.want {
+			t.Errorf("%s: made %d transmissions %v, want %d", tt.name, len(transmissions), transmissions, tt.want)
+			continue
+		}
+
+		// Speech fades in over its first syllable, and transmitting goes on
+		// into the pause until a chunk with the timeout past
+		chunk := time.Duration(framesPerBuffer) * time.Second / time.Duration(tt.sampleRate)
+		for i, tr := range transmissions {
+			u := utterances[i]
+			if tr.start < u.Start-chunk || tr.start > u.Start+125*time.Millisecond {
+				t.Errorf("%s: transmission %d started at %s, speech at %s", tt.name, i+1, tr.start, u.Start)
+			}
+			if tr.end < u.End-125*time.Millisecond || tr.end > u.End+3*chunk {
+				t.Errorf("%s: transmission %d ended at %s, speech at %s", tt.name, i+1, tr.end, u.End)
+			}
+		}
+	}
+}
+
+// A muted client does not transmit until unmuted
+func TestVoiceDetectionSilenced(t *testing.T) {
+	ap := NewAudioProcessor()
+	ap.silenceTimeout = 20 * time.Millisecond
+	speech, utterances := audiotest.Utterances(16000, 2, time.Second, time.Second, -12)
+	pcm := audiotest.Mix(speech, audiotest.Noise(16000, 5*time.Second, -60, 1))
+
+	ap.silenced.Store(true)
+	if transmissions := detect(t, ap, pcm, utterances, -60); len(transmissions) != 0 {
+		t.Errorf("made %d transmissions while muted", len(transmissions))
+	}
+	ap.silenced.Store(false)
+	if transmissions := detect(t, ap, pcm, utterances, -60); len(transmissions) != 2 {
+		t.Errorf("made %d transmissions once unmuted, want 2", len(transmissions))
+	}
+}
@@ -0,0 +1,46 @@
+package client
+
+import "time"
+
+// Config for the capture client
+type Config struct {
+	// Server address (host:port)
+	ServerAddr string
+
+	// Skip certificate verification
+	Insecure bool
+
+	// Server certificate to trust when not insecure
+	CertFile string
+
+	// Shared secret sent before streaming
+	Token string
+
+	// Input device index, zero uses the default device
+	DeviceID int
+
+	// High-pass cutoff in Hz applied before voice detection, zero disables
+	// the filter
+	HighPassHz float64
+
+	// Ratio of chunk amplitude over background noise that counts as speech,
+	// zero uses 2.22
+	VADThreshold float64
+
+	// Silence after which a transmission ends, zero uses one second
+	SilenceTimeout time.Duration
+
+	// Number of recent chunks averaged into the background noise level the
+	// VAD threshold is relative to, zero uses 50 (about 1.2 seconds)
+	BackgroundBufferSize int
+
+	// Play speech the server sends, e.g. text posted to the scribe's say
+	// endpoint, and live audio routed from other clients on the default
+	// output device
+	PlaySpeech bool
+
+	// Played on the default output device whenever a transmission starts,
+	// to let people know they are recorded: ConsentBeep for a short tone or
+	// the path of an audio file, empty for none
+	ConsentNotice string
+}
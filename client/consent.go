@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/bosley/libas/audio"
+)
+
+const (
+	// Config.ConsentNotice value that plays a short tone
+	ConsentBeep = "beep"
+
+	// The tone: a 1kHz sine faded in and out to avoid clicks
+	beepFrequency = 1000
+	beepDuration  = 0.25 // seconds
+	beepFade      = 0.01 // seconds
+	beepLevel     = 0.3
+)
+
+// loadConsentNotice reads the audio of Config.ConsentNotice, nil when empty
+func loadConsentNotice(notice string) (*audio.PCM, error) {
+	switch notice {
+	case "":
+		return nil, nil
+	case ConsentBeep:
+		return consentBeep(), nil
+	}
+
+	pcm, err := audio.ReadAudio(notice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consent notice: %w", err)
+	}
+	if len(pcm.Samples) == 0 {
+		return nil, fmt.Errorf("consent notice %s holds no audio", notice)
+	}
+	return pcm, nil
+}
+
+// consentBeep synthesizes the tone played for ConsentBeep
+func consentBeep() *audio.PCM {
+	samples := make([]int16, int(beepDuration*sampleRate))
+	fade := int(beepFade * sampleRate)
+	for i := range samples {
+		gain := beepLevel
+		if i < fade {
+			gain *= float64(i) / float64(fade)
+		} else if remaining := len(samples) - 1 - i; remaining < fade {
+			gain *= float64(remaining) / float64(fade)
+		}
+		samples[i] = int16(gain * math.MaxInt16 * math.Sin(2*math.Pi*beepFrequency*float64(i)/sampleRate))
+	}
+	return &audio.PCM{Samples: samples, SampleRate: sampleRate}
+}
+
+// noticeRecording plays the consent notice, if any, as a transmission
+// starts, without holding up the audio. A transmission starting while the
+// notice still plays gets none.
+func (ap *AudioProcessor) noticeRecording(ctx context.Context) {
+	if ap.consent == nil || !ap.noticing.CompareAndSwap(false, true) {
+		return
+	}
+	slog.Info("Playing recording consent notice", "clientID", ap.clientID)
+	go func() {
+		defer ap.noticing.Store(false)
+		if err := playSpeech(ctx, ap.consent); err != nil {
+			slog.Error("Failed to play recording consent notice", "error", err, "clientID", ap.clientID)
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/gordonklaus/portaudio"
+)
+
+const (
+	// Window over which levels are measured in a device test
+	levelWindow = 50 * time.Millisecond
+
+	// Share of the quietest windows that make up the noise floor
+	noiseFloorPercentile = 0.1
+)
+
+// DeviceTest reports what a short recording from an input device sounded
+// like. Levels are in dBFS.
+type DeviceTest struct {
+	Device     string
+	SampleRate float64
+	Duration   time.Duration
+
+	// Level of the quietest tenth of the recording, ideally below -50
+	NoiseFloorDB float64
+
+	// Loudest sample and the overall RMS level
+	PeakDB float64
+	RMSDB  float64
+
+	// Samples at full scale, a sign the input gain is too high
+	ClippedSamples int
+
+	// The recording, for playback
+	Recording *audio.PCM
+}
+
+// ClippingRatio is the share of samples at full scale
+func (t *DeviceTest) ClippingRatio() float64 {
+	if len(t.Recording.Samples) == 0 {
+		return 0
+	}
+	return float64(t.ClippedSamples) / float64(len(t.Recording.Samples))
+}
+
+// TestDevice records from the input device with the given ID, zero for the
+// default device, the way capture would and measures the recording
+func TestDevice(ctx context.Context, deviceID int, duration time.Duration) (*DeviceTest, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize PortAudio: %w", err)
+	}
+	defer portaudio.Terminate()
+
+	params, err := inputParameters(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	samples := make([]int16, 0, int(params.SampleRate*duration.Seconds()))
+	stream, err := portaudio.OpenStream(params, func(in []int16) {
+		mu.Lock()
+		samples = append(samples, in...)
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start audio stream: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+
+	if err := stream.Stop(); err != nil {
+		return nil, fmt.Errorf("failed to stop audio stream: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	pcm := &audio.PCM{Samples: samples, SampleRate: int(params.SampleRate)}
+
+	test := measureRecording(pcm)
+	test.Device = params.Input.Device.Name
+	return test, nil
+}
+
+// measureRecording computes the levels reported by a device test
+func measureRecording(pcm *audio.PCM) *DeviceTest {
+	test := &DeviceTest{
+		SampleRate: float64(pcm.SampleRate),
+		Duration:   time.Duration(len(pcm.Samples)) * time.Second / time.Duration(max(pcm.SampleRate, 1)),
+		Recording:  pcm,
+	}
+
+	var peak int
+	var sumSquares float64
+	for _, sample := range pcm.Samples {
+		s := int(sample)
+		if s < 0 {
+			s = -s
+		}
+		peak = max(peak, s)
+		if s >= math.MaxInt16 {
+			test.ClippedSamples++
+		}
+		sumSquares += float64(s) * float64(s)
+	}
+	test.PeakDB = dbFS(float64(min(peak, math.MaxInt16)))
+	if len(pcm.Samples) > 0 {
+		test.RMSDB = dbFS(math.Sqrt(sumSquares / float64(len(pcm.Samples))))
+	}
+
+	// The noise floor is what the quietest windows have in common
+	window := max(int(float64(pcm.SampleRate)*levelWindow.Seconds()), 1)
+	levels := make([]float64, 0, len(pcm.Samples)/window)
+	for start := 0; start+window <= len(pcm.Samples); start += window {
+		var sum float64
+		for _, sample := range pcm.Samples[start : start+window] {
+			sum += float64(sample) * float64(sample)
+		}
+		levels = append(levels, dbFS(math.Sqrt(sum/float64(window))))
+	}
+	if len(levels) > 0 {
+		sort.Float64s(levels)
+		test.NoiseFloorDB = levels[int(float64(len(levels)-1)*noiseFloorPercentile)]
+	} else {
+		test.NoiseFloorDB = test.RMSDB
+	}
+
+	return test
+}
+
+// dbFS converts a 16-bit amplitude to decibels relative to full scale,
+// bottoming out at -96 dB
+func dbFS(amplitude float64) float64 {
+	if amplitude < 1 {
+		return -96
+	}
+	return 20 * math.Log10(amplitude/math.MaxInt16)
+}
+
+// PlayPCM plays samples on the default output device and returns once they
+// have been played or the context is cancelled
+func PlayPCM(ctx context.Context, pcm *audio.PCM) error {
+	if err := portaudio.Initialize(); err != nil {
+		return fmt.Errorf("failed to initialize PortAudio: %w", err)
+	}
+	defer portaudio.Terminate()
+
+	done := make(chan struct{})
+	var once sync.Once
+	position := 0
+	stream, err := portaudio.OpenDefaultStream(0, 1, float64(pcm.SampleRate), framesPerBuffer, func(out []int16) {
+		n := copy(out, pcm.Samples[position:])
+		position += n
+		for i := n; i < len(out); i++ {
+			out[i] = 0
+		}
+		if position >= len(pcm.Samples) {
+			once.Do(func() { close(done) })
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open audio stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Start(); err != nil {
+		return fmt.Errorf("failed to start audio stream: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-done:
+		// Let the last buffer drain
+		time.Sleep(time.Duration(framesPerBuffer) * time.Second / time.Duration(pcm.SampleRate))
+	}
+	return stream.Stop()
+}
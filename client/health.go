@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where Linux, Raspberry Pi OS included, exposes the health of the device
+const (
+	thermalZone   = "/sys/class/thermal/thermal_zone0/temp"
+	powerSupplies = "/sys/class/power_supply"
+	wirelessStats = "/proc/net/wireless"
+)
+
+// readHealth reads the battery charge in percent, the temperature in
+// degrees Celsius and the Wi-Fi signal in dBm, leaving out what the device
+// does not have
+func readHealth() map[string]float64 {
+	metrics := make(map[string]float64)
+	if millidegrees, err := readNumber(thermalZone); err == nil {
+		metrics["temperature"] = millidegrees / 1000
+	}
+	if battery, ok := readBattery(); ok {
+		metrics["battery"] = battery
+	}
+	if signal, ok := readSignal(); ok {
+		metrics["signal"] = signal
+	}
+	return metrics
+}
+
+// readBattery reads the charge of the first battery among the power
+// supplies
+func readBattery() (float64, bool) {
+	supplies, _ := filepath.Glob(filepath.Join(powerSupplies, "*"))
+	for _, supply := range supplies {
+		kind, err := os.ReadFile(filepath.Join(supply, "type"))
+		if err != nil || strings.TrimSpace(string(kind)) != "Battery" {
+			continue
+		}
+		if capacity, err := readNumber(filepath.Join(supply, "capacity")); err == nil {
+			return capacity, true
+		}
+	}
+	return 0, false
+}
+
+// readSignal reads the signal level of the first wireless interface, the
+// lines after the two of headers being "wlan0: 0000 54. -56. -256 ..."
+func readSignal() (float64, bool) {
+	data, err := os.ReadFile(wirelessStats)
+	if err != nil {
+		return 0, false
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[min(2, len(lines)):] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		if level, err := strconv.ParseFloat(strings.TrimSuffix(fields[3], "."), 64); err == nil {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+func readNumber(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
+
+// reportHealth sends the health of the device at the interval the server
+// last asked for, the first report right away
+func reportHealth(ctx context.Context, out *sender, intervals <-chan time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	ticker.Stop()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case interval := <-intervals:
+			ticker.Stop()
+			if interval <= 0 {
+				slog.Info("Server stopped health reports")
+				continue
+			}
+			ticker.Reset(interval)
+			slog.Debug("Reporting health to server", "interval", interval)
+		case <-ticker.C:
+		}
+		out.healthReport(readHealth())
+	}
+}
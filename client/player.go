@@ -1,59 +1,42 @@
-package libascli
+package client
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log/slog"
-	"os"
+	"sync"
+	"time"
 
+	"github.com/bosley/libas/audio"
 	"github.com/gordonklaus/portaudio"
-	"github.com/youpy/go-wav"
 )
 
+// PlayAudioFile plays a WAV, FLAC, MP3 or OGG file on the default output
+// device. Compressed formats other than FLAC need ffmpeg.
 func PlayAudioFile(filename string) error {
+	pcm, err := audio.ReadAudio(filename)
+	if err != nil {
+		return fmt.Errorf("failed to decode audio file: %w", err)
+	}
+
 	// Initialize PortAudio
 	if err := portaudio.Initialize(); err != nil {
 		return fmt.Errorf("failed to initialize PortAudio: %w", err)
 	}
 	defer portaudio.Terminate()
 
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("failed to open audio file: %w", err)
-	}
-	defer file.Close()
-
-	reader := wav.NewReader(file)
-
-	format, err := reader.Format()
-	if err != nil {
-		return err
-	}
-	buffer := make([]int16, framesPerBuffer)
-
+	position := 0
 	stream, err := portaudio.OpenDefaultStream(
 		0,
-		int(format.NumChannels),
-		float64(format.SampleRate),
+		1,
+		float64(pcm.SampleRate),
 		framesPerBuffer,
 		func(out []int16) {
-			samples, err := reader.ReadSamples(uint32(len(buffer)))
-			if err == io.EOF {
-				for i := range out {
-					out[i] = 0
-				}
-				return
-			}
-			if err != nil {
-				slog.Error("Error reading from WAV file", "error", err)
-				return
-			}
+			n := copy(out, pcm.Samples[position:])
+			position += n
 
-			for i := 0; i < len(samples) && i < len(out); i++ {
-				out[i] = int16(samples[i].Values[0])
-			}
 			// Fill remaining buffer with silence if needed
-			for i := len(samples); i < len(out); i++ {
+			for i := n; i < len(out); i++ {
 				out[i] = 0
 			}
 		},
@@ -73,22 +56,158 @@ func PlayAudioFile(filename string) error {
 	return stream.Stop()
 }
 
-func readInt16(r io.Reader, data []int16) (n int, err error) {
-	buf := make([]byte, 2*len(data))
-	n, err = io.ReadFull(r, buf)
+// playSpeech plays speech on the default output device, returning once it
+// has played or ctx is cancelled
+func playSpeech(ctx context.Context, speech *audio.PCM) error {
+	done := make(chan struct{})
+	var finished sync.Once
+	position := 0
+	stream, err := portaudio.OpenDefaultStream(
+		0,
+		1,
+		float64(speech.SampleRate),
+		framesPerBuffer,
+		func(out []int16) {
+			n := copy(out, speech.Samples[position:])
+			position += n
+			for i := n; i < len(out); i++ {
+				out[i] = 0
+			}
+			if n == 0 {
+				finished.Do(func() { close(done) })
+			}
+		},
+	)
 	if err != nil {
-		if err == io.EOF {
-			return 0, err
+		return fmt.Errorf("failed to open output stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Start(); err != nil {
+		return fmt.Errorf("failed to start output stream: %w", err)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return stream.Stop()
+}
+
+const (
+	// Live audio buffered before playback starts, riding out network jitter
+	livePrebuffer = 100 * time.Millisecond
+
+	// Live audio buffered beyond this is dropped, oldest first, so playback
+	// stays close to the speaker
+	liveMaxDelay = time.Second
+
+	// How long the output stays open without live audio, muting voice
+	// detection so the routed voice is not sent back
+	liveIdle = time.Second
+)
+
+// livePlayer plays live audio routed from another client as it arrives,
+// keeping an output stream open while it flows
+type livePlayer struct {
+	mu       sync.Mutex
+	stream   *portaudio.Stream
+	rate     int
+	buffered []int16
+	last     time.Time // when audio last arrived
+}
+
+// play queues a chunk of live audio, opening the output once enough is
+// buffered
+func (p *livePlayer) play(samples []int16, rate int) {
+	var stale *portaudio.Stream
+	defer func() { closeStream(stale) }()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stream != nil && p.rate != rate {
+		stale, p.stream = p.stream, nil
+	}
+	p.rate = rate
+	p.buffered = append(p.buffered, samples...)
+	if limit := samplesIn(liveMaxDelay, rate); len(p.buffered) > limit {
+		p.buffered = append(p.buffered[:0], p.buffered[len(p.buffered)-limit:]...)
+	}
+	p.last = time.Now()
+	if p.stream != nil || len(p.buffered) < samplesIn(livePrebuffer, rate) {
+		return
+	}
+
+	stream, err := portaudio.OpenDefaultStream(0, 1, float64(rate), framesPerBuffer, p.fill)
+	if err == nil {
+		if err = stream.Start(); err != nil {
+			stream.Close()
 		}
-		if err == io.ErrUnexpectedEOF {
-			err = io.EOF
+	}
+	if err != nil {
+		p.buffered = p.buffered[:0]
+		slog.Error("Failed to play live audio", "error", err)
+		return
+	}
+	p.stream = stream
+}
+
+// fill is the output callback, playing silence when the buffer runs dry
+func (p *livePlayer) fill(out []int16) {
+	p.mu.Lock()
+	n := copy(out, p.buffered)
+	p.buffered = p.buffered[:copy(p.buffered, p.buffered[n:])]
+	p.mu.Unlock()
+	for i := n; i < len(out); i++ {
+		out[i] = 0
+	}
+}
+
+// playing tells whether live audio is being played
+func (p *livePlayer) playing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stream != nil
+}
+
+// run closes the output once live audio stopped arriving, and when ctx is
+// cancelled
+func (p *livePlayer) run(ctx context.Context) {
+	ticker := time.NewTicker(liveIdle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.mu.Lock()
+			stream := p.stream
+			p.stream = nil
+			p.mu.Unlock()
+			closeStream(stream)
+			return
+		case <-ticker.C:
+			var idle *portaudio.Stream
+			p.mu.Lock()
+			if p.stream != nil && len(p.buffered) == 0 && time.Since(p.last) > liveIdle {
+				idle, p.stream = p.stream, nil
+			}
+			p.mu.Unlock()
+			closeStream(idle)
 		}
-		n /= 2 // Convert byte count to int16 count
-	} else {
-		n /= 2 // Convert byte count to int16 count
 	}
-	for i := 0; i < n; i++ {
-		data[i] = int16(buf[i*2]) | int16(buf[i*2+1])<<8
+}
+
+// closeStream stops and closes an output stream, if any. Stopping waits for
+// the callback, so the player must not be locked.
+func closeStream(stream *portaudio.Stream) {
+	if stream == nil {
+		return
 	}
-	return
+	if err := stream.Stop(); err != nil {
+		slog.Debug("Failed to stop output stream", "error", err)
+	}
+	stream.Close()
+}
+
+// samplesIn is the number of samples lasting d at rate
+func samplesIn(d time.Duration, rate int) int {
+	return int(time.Duration(rate) * d / time.Second)
 }
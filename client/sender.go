@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/bosley/libas/protocol"
+)
+
+// Audio chunks waiting to be written, about six seconds at 44.1kHz. When
+// the server stalls for longer the oldest chunks are dropped, so the live
+// end of a transmission still arrives once it recovers.
+const sendQueueSize = 256
+
+// Markers framing a transmission
+var (
+	startMarker = protocol.AppendMarker(nil, protocol.Start)
+	endMarker   = protocol.AppendMarker(nil, protocol.End)
+)
+
+// chunkPool holds the buffers chunks are encoded into before sending
+var chunkPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4+2*framesPerBuffer)
+		return &buf
+	},
+}
+
+// sender writes transmissions to the server from its own goroutine. Frames
+// queued while a write is in progress are coalesced into the next one,
+// which over TLS means fewer records and syscalls.
+type sender struct {
+	writer *bufio.Writer
+
+	// Signalled once when writing to the server fails
+	closed chan<- struct{}
+
+	mu      sync.Mutex
+	frames  []frame
+	queued  int // audio chunks in frames
+	dropped int
+	wake    chan struct{}
+}
+
+// frame is a marker or, when buf is set, an encoded audio chunk
+type frame struct {
+	marker []byte
+	buf    *[]byte
+}
+
+func newSender(conn net.Conn, closed chan<- struct{}) *sender {
+	return &sender{
+		writer: bufio.NewWriterSize(conn, 64<<10),
+		closed: closed,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (s *sender) startTransmission() {
+	s.enqueue(frame{marker: startMarker})
+}
+
+func (s *sender) endTransmission() {
+	s.enqueue(frame{marker: endMarker})
+}
+
+// audioChunk queues a chunk as its size followed by the samples
+func (s *sender) audioChunk(chunk []int16) {
+	buf := chunkPool.Get().(*[]byte)
+	*buf = protocol.AppendChunk((*buf)[:0], chunk)
+	s.enqueue(frame{buf: buf})
+}
+
+// healthReport queues a report of the device's health
+func (s *sender) healthReport(metrics map[string]float64) {
+	report, err := protocol.AppendHealthReport(nil, metrics)
+	if err != nil {
+		slog.Warn("Failed to report health", "error", err)
+		return
+	}
+	s.enqueue(frame{marker: report})
+}
+
+// enqueue adds a frame, dropping the oldest audio chunk when the queue is
+// full. Markers are never dropped as the server needs them to split
+// transmissions.
+func (s *sender) enqueue(f frame) {
+	s.mu.Lock()
+	if f.buf != nil {
+		if s.queued >= sendQueueSize {
+			for i, queued := range s.frames {
+				if queued.buf != nil {
+					chunkPool.Put(queued.buf)
+					s.frames = append(s.frames[:i], s.frames[i+1:]...)
+					s.queued--
+					s.dropped++
+					break
+				}
+			}
+		}
+		s.queued++
+	}
+	s.frames = append(s.frames, f)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run writes queued frames until ctx is cancelled or a write fails, which
+// signals closed
+func (s *sender) run(ctx context.Context) {
+	var batch []frame
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		}
+
+		s.mu.Lock()
+		batch, s.frames = s.frames, batch[:0]
+		s.queued = 0
+		dropped := s.dropped
+		s.dropped = 0
+		s.mu.Unlock()
+
+		if dropped > 0 {
+			slog.Warn("Server connection stalled, dropped oldest audio", "chunks", dropped)
+		}
+
+		err := s.write(batch)
+		for i := range batch {
+			if batch[i].buf != nil {
+				chunkPool.Put(batch[i].buf)
+			}
+			batch[i] = frame{}
+		}
+		if err == nil {
+			continue
+		}
+		if !isConnectionClosed(err) {
+			slog.Error("Error sending audio", "error", err)
+		}
+		// Part of the batch may have been written, so the stream can't be
+		// continued and the client reconnects
+		select {
+		case s.closed <- struct{}{}: // Signal connection closure
+		default: // Channel already closed or full
+		}
+		return
+	}
+}
+
+// write sends a batch of frames with as few writes as the buffer allows
+func (s *sender) write(batch []frame) error {
+	for _, f := range batch {
+		data := f.marker
+		if f.buf != nil {
+			data = *f.buf
+		}
+		if _, err := s.writer.Write(data); err != nil {
+			return err
+		}
+	}
+	return s.writer.Flush()
+}
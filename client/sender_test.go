@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/protocol"
+)
+
+func chunkOf(n int, value int16) []int16 {
+	chunk := make([]int16, n)
+	for i := range chunk {
+		chunk[i] = value
+	}
+	return chunk
+}
+
+func TestSenderWritesInOrder(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s := newSender(local, make(chan struct{}, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	chunks := [][]int16{chunkOf(framesPerBuffer, 1), chunkOf(framesPerBuffer, -2), chunkOf(3, 3)}
+	s.startTransmission()
+	for _, chunk := range chunks {
+		s.audioChunk(chunk)
+	}
+	s.endTransmission()
+	s.healthReport(map[string]float64{"rssi": -61})
+
+	decoder := protocol.NewClientDecoder(remote)
+	want := []protocol.Kind{protocol.Start, protocol.Chunk, protocol.Chunk, protocol.Chunk, protocol.End, protocol.HealthReport}
+	var received [][]int16
+	for i, kind := range want {
+		message, err := decoder.Next()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if message.Kind != kind {
+			t.Fatalf("message %d is %s, want %s", i, message.Kind, kind)
+		}
+		switch kind {
+		case protocol.Chunk:
+			samples, err := decoder.Samples()
+			if err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, samples)
+		case protocol.HealthReport:
+			if message.Metrics["rssi"] != -61 {
+				t.Errorf("got metrics %v", message.Metrics)
+			}
+		}
+	}
+	if !slices.EqualFunc(received, chunks, slices.Equal) {
+		t.Error("received chunks differ from those sent")
+	}
+}
+
+// A stalled server loses the oldest audio but never the markers
+func TestSenderDropsOldestChunks(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s := newSender(local, make(chan struct{}, 1))
+
+	const extra = 10
+	s.startTransmission()
+	for i := range sendQueueSize + extra {
+		s.audioChunk([]int16{int16(i)})
+	}
+	s.endTransmission()
+
+	if s.queued != sendQueueSize || s.dropped != extra {
+		t.Fatalf("queued %d and dropped %d chunks, want %d and %d", s.queued, s.dropped, sendQueueSize, extra)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	decoder := protocol.NewClientDecoder(remote)
+	if message, err := decoder.Next(); err != nil || message.Kind != protocol.Start {
+		t.Fatalf("got %v, %v, want start", message.Kind, err)
+	}
+	for i := extra; i < sendQueueSize+extra; i++ {
+		if _, err := decoder.Next(); err != nil {
+			t.Fatal(err)
+		}
+		samples, err := decoder.Samples()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != 1 || samples[0] != int16(i) {
+			t.Fatalf("got chunk %v, want [%d]", samples, i)
+		}
+	}
+	if message, err := decoder.Next(); err != nil || message.Kind != protocol.End {
+		t.Fatalf("got %v, %v, want end", message.Kind, err)
+	}
+}
+
+func BenchmarkSenderAudioChunk(b *testing.B) {
+	s := &sender{writer: bufio.NewWriterSize(io.Discard, 64<<10), wake: make(chan struct{}, 1)}
+	chunk := chunkOf(framesPerBuffer, 1000)
+	batch := make([]frame, 0, 1)
+	b.ReportAllocs()
+	b.SetBytes(int64(4 + 2*len(chunk)))
+	for range b.N {
+		s.audioChunk(chunk)
+		batch, s.frames = s.frames, batch[:0]
+		s.queued = 0
+		if err := s.write(batch); err != nil {
+			b.Fatal(err)
+		}
+		chunkPool.Put(batch[0].buf)
+		batch[0] = frame{}
+	}
+}
+
+// Any failed write ends the sender and signals the client to reconnect
+func TestSenderWriteErrorCloses(t *testing.T) {
+	local, remote := net.Pipe()
+	remote.Close()
+	closed := make(chan struct{}, 1)
+	s := newSender(local, closed)
+	done := make(chan struct{})
+	go func() {
+		s.run(context.Background())
+		close(done)
+	}()
+
+	s.startTransmission()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write error not signalled")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender still running after a write error")
+	}
+}
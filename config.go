@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configFile holds the settings loaded with -config. Keys in a [command]
+// table are flag names of that command; keys before the first table apply
+// to every command that has the flag.
+type configFile map[string]map[string]any
+
+func loadConfigFile(path string) (configFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	tables, err := parseTOML(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return configFile(tables), nil
+}
+
+// lookup finds a setting for a command, preferring its own table
+func (c configFile) lookup(command, key string) (any, bool) {
+	if value, ok := c[command][key]; ok {
+		return value, true
+	}
+	value, ok := c[""][key]
+	return value, ok
+}
+
+// parseFlags parses a command's arguments and fills in every flag not given
+// on the command line from the environment (LIBAS_<FLAG>) and then from the
+// config file, so flags take precedence over the environment and the
+// environment over the file. The logger is then configured from the result.
+func parseFlags(fs *flag.FlagSet, args []string) (configFile, error) {
+	fs.Parse(args)
+
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		path = os.Getenv(envName("config"))
+	}
+
+	cfg := configFile{}
+	if path != "" {
+		var err error
+		if cfg, err = loadConfigFile(path); err != nil {
+			return nil, err
+		}
+		for key := range cfg[fs.Name()] {
+			if fs.Lookup(key) == nil && key != "token" {
+				return nil, fmt.Errorf("unknown setting %q in [%s] of %s", key, fs.Name(), path)
+			}
+		}
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", envName(f.Name), setErr)
+			}
+			return
+		}
+
+		if value, ok := cfg.lookup(fs.Name(), f.Name); ok {
+			if setErr := f.Value.Set(configString(value)); setErr != nil {
+				err = fmt.Errorf("invalid %s in config file: %w", f.Name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, configureLogging(fs)
+}
+
+// envName is the environment variable overriding a flag, -cors-origins is
+// read from LIBAS_CORS_ORIGINS
+func envName(flagName string) string {
+	return "LIBAS_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// configString formats a config value the way it would be written as a flag,
+// arrays become comma separated lists
+func configString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = configString(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// updateConfigFile sets keys of a table in a config file, keeping the rest
+// of the file, comments included, as it is. Values must already be TOML,
+// e.g. a quoted string. Keys missing from the table are added at its end and
+// a missing table or file is created.
+func updateConfigFile(path, table string, values map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+
+	// Find the table and where its last setting is
+	start, end := -1, len(lines)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "[") {
+			continue
+		}
+		if start >= 0 {
+			end = i
+			break
+		}
+		if trimmed == "["+table+"]" {
+			start = i
+		}
+	}
+	if start < 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+table+"]")
+		start, end = len(lines)-1, len(lines)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	insertAt := start + 1
+	for i := start + 1; i < end; i++ {
+		if strings.TrimSpace(stripComment(lines[i])) != "" {
+			insertAt = i + 1
+		}
+	}
+
+	added := make([]string, 0)
+	for _, key := range keys {
+		replaced := false
+		for i := start + 1; i < end; i++ {
+			name, _, ok := strings.Cut(stripComment(lines[i]), "=")
+			if ok && strings.TrimSpace(name) == key {
+				lines[i] = key + " = " + values[key]
+				replaced = true
+			}
+		}
+		if !replaced {
+			added = append(added, key+" = "+values[key])
+		}
+	}
+	lines = append(lines[:insertAt], append(added, lines[insertAt:]...)...)
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	libaserv "github.com/bosley/libas/server"
+)
+
+// Label of goroutines started by a component, inherited by the goroutines
+// they start, so profiles and /debug/vars tell subsystems apart
+const subsystemLabel = "subsystem"
+
+// addDebugFlag adds the diagnostics address of serve, ingest and scribe
+func addDebugFlag(fs *flag.FlagSet) *string {
+	return fs.String("debug-addr", "", "Loopback address pprof and expvar diagnostics are served on, e.g. localhost:6060")
+}
+
+// validateDebugAddr refuses diagnostics addresses reachable from other
+// hosts, as profiles expose memory contents and cost CPU time
+func validateDebugAddr(fs *flag.FlagSet, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return usageError(fs, "invalid -debug-addr %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return usageError(fs, "-debug-addr must be a loopback address such as localhost:6060")
+	}
+	return nil
+}
+
+// diagnosticsComponent serves net/http/pprof under /debug/pprof/ and
+// expvar under /debug/vars. vars are published alongside the goroutines
+// per subsystem, open files, memstats and cmdline.
+func diagnosticsComponent(addr string, vars map[string]func() any) component {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	expvar.Publish("goroutines", expvar.Func(func() any { return goroutinesBySubsystem() }))
+	expvar.Publish("openFiles", expvar.Func(func() any { return openFiles() }))
+	for name, fn := range vars {
+		expvar.Publish(name, expvar.Func(fn))
+	}
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return component{
+		name: "diagnostics",
+		run: func(ctx context.Context, ready func()) error {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen for diagnostics: %w", err)
+			}
+			slog.Info("Serving diagnostics", "addr", listener.Addr().String())
+			ready()
+
+			go func() {
+				<-ctx.Done()
+				server.Close()
+			}()
+			if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// serverStats reports the audio server's load
+func serverStats(server *libaserv.Server) map[string]int {
+	return map[string]int{"clients": len(server.Clients().List())}
+}
+
+// goroutinesBySubsystem counts goroutines by their subsystem label, those
+// started outside a component, e.g. by event sinks, as other
+func goroutinesBySubsystem() map[string]int {
+	var buf bytes.Buffer
+	if err := runtimepprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return map[string]int{"total": runtime.NumGoroutine()}
+	}
+
+	counts := map[string]int{"total": 0}
+	unlabelled := 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if labels, ok := strings.CutPrefix(line, "# labels: "); ok {
+			var set map[string]string
+			json.Unmarshal([]byte(labels), &set)
+			if name := set[subsystemLabel]; name != "" {
+				counts[name] += unlabelled
+				unlabelled = 0
+			}
+			continue
+		}
+		// Each record starts with the number of goroutines sharing a stack
+		count, _, ok := strings.Cut(line, " @ ")
+		if n, err := strconv.Atoi(count); ok && err == nil {
+			counts["other"] += unlabelled
+			counts["total"] += n
+			unlabelled = n
+		}
+	}
+	counts["other"] += unlabelled
+	return counts
+}
+
+// openFiles counts the descriptors the process has open, or returns -1
+// where they cannot be listed
+func openFiles() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// Reading the directory takes a descriptor too
+			return len(entries) - 1
+		}
+	}
+	return -1
+}
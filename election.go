@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bosley/libas/leader"
+	libaserv "github.com/bosley/libas/server"
+)
+
+// runOptions are how serve, ingest and scribe run, beside what they serve
+type runOptions struct {
+	// Loopback address diagnostics are served on, empty when off
+	debugAddr string
+
+	// Election the command waits to win before starting, nil without
+	// -leader-lock
+	elector *leader.Elector
+}
+
+// runFlags configure runOptions
+type runFlags struct {
+	debugAddr   *string
+	leaderLock  *string
+	leaderName  *string
+	leaderLease *time.Duration
+	leaderHook  *string
+}
+
+func addRunFlags(fs *flag.FlagSet) *runFlags {
+	return &runFlags{
+		debugAddr:   addDebugFlag(fs),
+		leaderLock:  fs.String("leader-lock", "", "Lease file on storage shared with a standby server, or a redis:// URL; the server holding the lease runs while the other waits to take over"),
+		leaderName:  fs.String("leader-name", "", "Name this server holds the leader lease under (defaults to the host name)"),
+		leaderLease: fs.Duration("leader-lease", 30*time.Second, "How long the leader lease lasts unless renewed, and so how soon the standby takes over"),
+		leaderHook:  fs.String("leader-hook", "", "Command run with primary appended once the leader lease is taken and standby once it is given up, e.g. to move a virtual IP"),
+	}
+}
+
+func (f *runFlags) options(fs *flag.FlagSet) (runOptions, error) {
+	if err := validateDebugAddr(fs, *f.debugAddr); err != nil {
+		return runOptions{}, err
+	}
+	opts := runOptions{debugAddr: *f.debugAddr}
+	if *f.leaderLock == "" {
+		return opts, nil
+	}
+	name := *f.leaderName
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	elector, err := leader.New(leader.Config{
+		Lock:  *f.leaderLock,
+		Name:  name,
+		Lease: *f.leaderLease,
+		Hook:  *f.leaderHook,
+	})
+	if err != nil {
+		return runOptions{}, usageError(fs, "invalid -leader-lock: %v", err)
+	}
+	opts.elector = elector
+	return opts, nil
+}
+
+// campaign waits for the leader lease when an election is configured,
+// returning once it is held or ctx ends. Systemd is told the standby is up
+// meanwhile, so it is not restarted for taking long to start.
+func (o runOptions) campaign(ctx context.Context) error {
+	if o.elector == nil {
+		return nil
+	}
+	standby, stop := context.WithCancel(ctx)
+	defer stop()
+	libaserv.SdNotify("READY=1\nSTATUS=Standing by for the leader lease")
+	go libaserv.Watchdog(standby)
+
+	if err := o.elector.Campaign(ctx); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to take leader lease: %w", err)
+	}
+	return nil
+}
+
+// resign gives the leader lease up when it is held
+func (o runOptions) resign() {
+	if o.elector != nil {
+		o.elector.Resign(context.Background())
+	}
+}
+
+// leaderComponent holds the leader lease for the components after it.
+// Added first, it is stopped last and gives the lease up once they stopped.
+// Losing the lease stops them, as the standby takes over.
+func leaderComponent(elector *leader.Elector) component {
+	return component{
+		name: "leader",
+		run: func(ctx context.Context, ready func()) error {
+			ready()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-elector.Lost():
+				return fmt.Errorf("lost leader lease")
+			}
+		},
+		stop: elector.Resign,
+	}
+}
@@ -0,0 +1,192 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firing alerts are sent again this often, as Alertmanager resolves alerts
+// it stops hearing about. Their end time lies a few resends ahead, so they
+// resolve by themselves if the scribe goes away.
+const alertmanagerResend = time.Minute
+
+// Alertmanager posts alert events to a Prometheus Alertmanager, so health
+// alerts are grouped, silenced and routed like any other. Other events are
+// ignored.
+type Alertmanager struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	active map[string]alertmanagerAlert // by labels, firing health alerts
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// alertmanagerAlert is an alert in the Alertmanager API
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// NewAlertmanager creates a sink for the Alertmanager at a base URL such as
+// http://localhost:9093
+func NewAlertmanager(target string) (*Alertmanager, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Alertmanager URL %q", target)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/alerts"
+
+	a := &Alertmanager{
+		url:    u.String(),
+		client: &http.Client{Timeout: 10 * time.Second},
+		active: make(map[string]alertmanagerAlert),
+		done:   make(chan struct{}),
+	}
+	go a.resend()
+	return a, nil
+}
+
+func (a *Alertmanager) String() string {
+	return redact(a.url)
+}
+
+// Publish posts an alert event. Alerts without a status, which never
+// resolve, are left to Alertmanager's resolve_timeout.
+func (a *Alertmanager) Publish(ctx context.Context, event Event) error {
+	if event.Type != Alert {
+		return nil
+	}
+
+	var data AlertData
+	decodeData(event.Data, &data)
+
+	alert := alertmanagerAlert{
+		Labels:      map[string]string{"alertname": "libas_alert", "service": "libas"},
+		Annotations: map[string]string{"summary": data.Message},
+		StartsAt:    event.Time,
+	}
+	if data.Name != "" {
+		alert.Labels["alertname"] = data.Name
+	}
+	for name, value := range data.Labels {
+		alert.Labels[name] = value
+	}
+	if event.ClientID != "" && alert.Labels["clientId"] == "" {
+		alert.Labels["clientId"] = event.ClientID
+	}
+	if data.Error != "" {
+		alert.Annotations["description"] = data.Error
+	}
+	if data.StartsAt != nil {
+		alert.StartsAt = *data.StartsAt
+	}
+
+	key := fingerprint(alert.Labels)
+	a.mu.Lock()
+	switch data.Status {
+	case AlertFiring:
+		a.active[key] = alert
+		alert.EndsAt = alertmanagerExpiry()
+	case AlertResolved:
+		delete(a.active, key)
+		endsAt := event.Time
+		alert.EndsAt = &endsAt
+	}
+	a.mu.Unlock()
+
+	return a.post(ctx, []alertmanagerAlert{alert})
+}
+
+// resend posts the firing alerts again until the sink is closed
+func (a *Alertmanager) resend() {
+	ticker := time.NewTicker(alertmanagerResend)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		a.mu.Lock()
+		alerts := make([]alertmanagerAlert, 0, len(a.active))
+		for _, alert := range a.active {
+			alert.EndsAt = alertmanagerExpiry()
+			alerts = append(alerts, alert)
+		}
+		a.mu.Unlock()
+		if len(alerts) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		// A failure is retried on the next tick
+		a.post(ctx, alerts)
+		cancel()
+	}
+}
+
+func (a *Alertmanager) post(ctx context.Context, alerts []alertmanagerAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("failed to encode alerts: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Alertmanager request failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Alertmanager returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops resending firing alerts
+func (a *Alertmanager) Close() error {
+	a.closeOnce.Do(func() { close(a.done) })
+	return nil
+}
+
+// alertmanagerExpiry returns the end time of a firing alert
+func alertmanagerExpiry() *time.Time {
+	expiry := time.Now().Add(4 * alertmanagerResend)
+	return &expiry
+}
+
+// fingerprint identifies an alert by its sorted labels
+func fingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, labels[name])
+	}
+	return b.String()
+}
@@ -0,0 +1,54 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errChannelFull = errors.New("channel full, event dropped")
+
+// Channel hands events to an embedding program over a Go channel. Events
+// are dropped rather than blocking delivery when the channel is full.
+type Channel struct {
+	events chan Event
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewChannel creates a channel sink buffering up to size events
+func NewChannel(size int) *Channel {
+	return &Channel{events: make(chan Event, size)}
+}
+
+// Events receives the published events, it is closed with the sink
+func (c *Channel) Events() <-chan Event {
+	return c.events
+}
+
+// Publish queues an event on the channel
+func (c *Channel) Publish(ctx context.Context, event Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	select {
+	case c.events <- event:
+		return nil
+	default:
+		return errChannelFull
+	}
+}
+
+// Close closes the events channel
+func (c *Channel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.events)
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bosley/libas/version"
+)
+
+// DefaultDiscoveryPrefix is where Home Assistant looks for MQTT discovery
+// messages unless configured otherwise
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// Longest state Home Assistant accepts, the full text is in the attributes
+const haStateLimit = 255
+
+// Bounds of the VAD threshold entity
+const (
+	haVADMin  = 1.0
+	haVADMax  = 20.0
+	haVADStep = 0.01
+)
+
+// HomeAssistant registers each audio client as a Home Assistant device
+// through MQTT discovery. A device has a sensor with the last
+// transcription, its text as the state and the rest as attributes, a
+// connectivity binary sensor and a number setting the client's VAD
+// threshold.
+//
+// Clients get a new ID each time they connect, so devices are keyed by the
+// client's host and follow it across reconnects. A threshold set from Home
+// Assistant is applied again when the client reconnects.
+type HomeAssistant struct {
+	mqtt            *MQTT
+	discoveryPrefix string
+
+	// Changes the VAD threshold of a connected client
+	setVAD func(clientID string, threshold float64) error
+
+	subscribe sync.Once
+
+	mu      sync.Mutex
+	hosts   map[string]string // Host by client ID
+	devices map[string]*haDevice
+}
+
+// haDevice is what is known about one client host
+type haDevice struct {
+	node      string // Host as an MQTT and entity ID segment
+	host      string
+	clientID  string // Latest connection
+	connected bool
+
+	// Set from Home Assistant, zero until then
+	vad float64
+
+	discovered bool
+}
+
+// NewHomeAssistant creates a Home Assistant sink from an mqtt:// or
+// mqtts:// URL whose path is the prefix of the state topics
+func NewHomeAssistant(u *url.URL, discoveryPrefix string) (*HomeAssistant, error) {
+	m, err := NewMQTT(u)
+	if err != nil {
+		return nil, err
+	}
+	if discoveryPrefix == "" {
+		discoveryPrefix = DefaultDiscoveryPrefix
+	}
+
+	h := &HomeAssistant{
+		mqtt:            m,
+		discoveryPrefix: strings.Trim(discoveryPrefix, "/"),
+		hosts:           make(map[string]string),
+		devices:         make(map[string]*haDevice),
+	}
+	m.SetStatusTopic(h.availabilityTopic())
+	return h, nil
+}
+
+// HandleVAD applies thresholds set in Home Assistant to connected clients.
+// Without it devices have no VAD entity. Call it before publishing.
+func (h *HomeAssistant) HandleVAD(setVAD func(clientID string, threshold float64) error) {
+	h.setVAD = setVAD
+}
+
+func (h *HomeAssistant) String() string {
+	return "homeassistant+" + h.mqtt.String()
+}
+
+func (h *HomeAssistant) availabilityTopic() string {
+	return h.mqtt.Prefix() + "/status"
+}
+
+func (h *HomeAssistant) topic(d *haDevice, entity string) string {
+	return h.mqtt.Prefix() + "/" + d.node + "/" + entity
+}
+
+// Publish updates the device of the event's client
+func (h *HomeAssistant) Publish(ctx context.Context, event Event) error {
+	h.subscribe.Do(func() { h.listen(ctx) })
+
+	switch event.Type {
+	case ClientConnected:
+		var presence struct {
+			Addr string `json:"addr"`
+		}
+		decodeData(event.Data, &presence)
+		d := h.connected(event.ClientID, presence.Addr)
+		return h.publishDevice(ctx, d)
+
+	case ClientDisconnected:
+		d := h.device(event.ClientID)
+		h.mu.Lock()
+		// The host may already have reconnected
+		if d.clientID == event.ClientID {
+			d.connected = false
+		}
+		h.mu.Unlock()
+		return h.publishDevice(ctx, d)
+
+	case Transcription:
+		var transcription struct {
+			Sequence   uint64    `json:"sequence"`
+			Timestamp  time.Time `json:"timestamp"`
+			Text       string    `json:"text"`
+			AudioFile  string    `json:"audioFile"`
+			Confidence float32   `json:"confidence"`
+		}
+		decodeData(event.Data, &transcription)
+		d := h.device(event.ClientID)
+		if err := h.discover(ctx, d); err != nil {
+			return err
+		}
+
+		attributes, _ := json.Marshal(map[string]any{
+			"text":       transcription.Text,
+			"timestamp":  transcription.Timestamp,
+			"clientId":   event.ClientID,
+			"sequence":   transcription.Sequence,
+			"audioFile":  transcription.AudioFile,
+			"confidence": transcription.Confidence,
+		})
+		if err := h.mqtt.PublishMessage(ctx, h.topic(d, "transcription/attributes"), attributes, true); err != nil {
+			return err
+		}
+		return h.mqtt.PublishMessage(ctx, h.topic(d, "transcription"), []byte(truncate(transcription.Text, haStateLimit)), true)
+	}
+	return nil
+}
+
+// listen subscribes to Home Assistant restarts and VAD commands
+func (h *HomeAssistant) listen(ctx context.Context) {
+	if err := h.mqtt.Subscribe(ctx, h.discoveryPrefix+"/status", h.handleStatus); err != nil {
+		slog.Warn("Failed to subscribe to Home Assistant status", "error", err)
+	}
+	if h.setVAD == nil {
+		return
+	}
+	if err := h.mqtt.Subscribe(ctx, h.mqtt.Prefix()+"/+/vad/set", h.handleVAD); err != nil {
+		slog.Warn("Failed to subscribe to Home Assistant commands", "error", err)
+	}
+}
+
+// handleStatus publishes discovery again when Home Assistant comes online,
+// in case it lost the retained messages
+func (h *HomeAssistant) handleStatus(topic string, payload []byte) {
+	if string(payload) != "online" {
+		return
+	}
+
+	h.mu.Lock()
+	devices := make([]*haDevice, 0, len(h.devices))
+	for _, d := range h.devices {
+		d.discovered = false
+		devices = append(devices, d)
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, d := range devices {
+		if err := h.publishDevice(ctx, d); err != nil {
+			slog.Warn("Failed to publish Home Assistant device", "host", d.host, "error", err)
+		}
+	}
+}
+
+// handleVAD applies a threshold set in Home Assistant to the client
+// connected from a device's host
+func (h *HomeAssistant) handleVAD(topic string, payload []byte) {
+	node := strings.TrimSuffix(strings.TrimPrefix(topic, h.mqtt.Prefix()+"/"), "/vad/set")
+	threshold, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	// Written so NaN fails too
+	if err != nil || !(threshold >= haVADMin && threshold <= haVADMax) {
+		slog.Warn("Ignoring invalid VAD threshold from Home Assistant", "node", node, "value", string(payload))
+		return
+	}
+
+	h.mu.Lock()
+	var d *haDevice
+	for _, candidate := range h.devices {
+		if candidate.node == node {
+			d = candidate
+		}
+	}
+	if d == nil {
+		h.mu.Unlock()
+		slog.Warn("VAD threshold set for unknown Home Assistant device", "node", node)
+		return
+	}
+	d.vad = threshold
+	clientID, connected := d.clientID, d.connected
+	h.mu.Unlock()
+
+	// Applied when the client next connects otherwise
+	if connected {
+		if err := h.setVAD(clientID, threshold); err != nil {
+			slog.Error("Failed to set VAD threshold", "clientID", clientID, "error", err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := h.mqtt.PublishMessage(ctx, h.topic(d, "vad"), []byte(strconv.FormatFloat(threshold, 'f', -1, 64)), true); err != nil {
+		slog.Warn("Failed to publish VAD threshold", "host", d.host, "error", err)
+	}
+}
+
+// connected records a client connecting from an address, applying the
+// threshold its host was given
+func (h *HomeAssistant) connected(clientID, addr string) *haDevice {
+	host := addr
+	if split, _, err := net.SplitHostPort(addr); err == nil {
+		host = split
+	}
+	if host == "" {
+		host = clientID
+	}
+
+	h.mu.Lock()
+	h.hosts[clientID] = host
+	d := h.deviceLocked(clientID)
+	d.clientID = clientID
+	d.connected = true
+	vad := d.vad
+	h.mu.Unlock()
+
+	if vad > 0 && h.setVAD != nil {
+		if err := h.setVAD(clientID, vad); err != nil {
+			slog.Warn("Failed to restore VAD threshold", "clientID", clientID, "error", err)
+		}
+	}
+	return d
+}
+
+// device returns the device of a client, keyed by the client ID itself
+// when it was not seen connecting, e.g. for uploads
+func (h *HomeAssistant) device(clientID string) *haDevice {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.deviceLocked(clientID)
+}
+
+func (h *HomeAssistant) deviceLocked(clientID string) *haDevice {
+	host, ok := h.hosts[clientID]
+	if !ok {
+		host = clientID
+	}
+	d, ok := h.devices[host]
+	if !ok {
+		d = &haDevice{node: haNode(host), host: host, clientID: clientID}
+		h.devices[host] = d
+	}
+	return d
+}
+
+// publishDevice publishes a device's discovery, when not done yet, and its
+// connectivity
+func (h *HomeAssistant) publishDevice(ctx context.Context, d *haDevice) error {
+	if err := h.discover(ctx, d); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	state := "OFF"
+	if d.connected {
+		state = "ON"
+	}
+	vad := d.vad
+	h.mu.Unlock()
+
+	if err := h.mqtt.PublishMessage(ctx, h.topic(d, "connected"), []byte(state), true); err != nil {
+		return err
+	}
+	if vad > 0 {
+		return h.mqtt.PublishMessage(ctx, h.topic(d, "vad"), []byte(strconv.FormatFloat(vad, 'f', -1, 64)), true)
+	}
+	return nil
+}
+
+// discover publishes the discovery messages of a device's entities once
+func (h *HomeAssistant) discover(ctx context.Context, d *haDevice) error {
+	h.mu.Lock()
+	discovered := d.discovered
+	h.mu.Unlock()
+	if discovered {
+		return nil
+	}
+
+	device := map[string]any{
+		"identifiers":  []string{"libas_" + d.node},
+		"name":         "libas " + d.host,
+		"manufacturer": "libas",
+		"model":        "Audio client",
+		"sw_version":   version.Get().Version,
+	}
+	entity := func(id, name string) map[string]any {
+		return map[string]any{
+			"name":               name,
+			"unique_id":          "libas_" + d.node + "_" + id,
+			"object_id":          "libas_" + d.node + "_" + id,
+			"device":             device,
+			"availability_topic": h.availabilityTopic(),
+		}
+	}
+
+	transcription := entity("transcription", "Last transcription")
+	transcription["state_topic"] = h.topic(d, "transcription")
+	transcription["json_attributes_topic"] = h.topic(d, "transcription/attributes")
+	transcription["icon"] = "mdi:text-to-speech"
+
+	connected := entity("connected", "Connected")
+	connected["state_topic"] = h.topic(d, "connected")
+	connected["device_class"] = "connectivity"
+	connected["entity_category"] = "diagnostic"
+
+	configs := map[string]map[string]any{
+		"sensor/libas_" + d.node + "/transcription":    transcription,
+		"binary_sensor/libas_" + d.node + "/connected": connected,
+	}
+	if h.setVAD != nil {
+		vad := entity("vad_threshold", "VAD threshold")
+		vad["state_topic"] = h.topic(d, "vad")
+		vad["command_topic"] = h.topic(d, "vad/set")
+		vad["min"] = haVADMin
+		vad["max"] = haVADMax
+		vad["step"] = haVADStep
+		vad["mode"] = "box"
+		vad["entity_category"] = "config"
+		vad["icon"] = "mdi:microphone-settings"
+		configs["number/libas_"+d.node+"/vad_threshold"] = vad
+	}
+
+	for path, config := range configs {
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("failed to encode discovery message: %w", err)
+		}
+		if err := h.mqtt.PublishMessage(ctx, h.discoveryPrefix+"/"+path+"/config", payload, true); err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	d.discovered = true
+	h.mu.Unlock()
+	slog.Info("Registered Home Assistant device", "host", d.host)
+	return nil
+}
+
+// Close marks the devices unavailable and disconnects
+func (h *HomeAssistant) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.mqtt.PublishMessage(ctx, h.availabilityTopic(), []byte("offline"), true)
+	return h.mqtt.Close()
+}
+
+// haNode turns a host into an ID segment Home Assistant accepts
+func haNode(host string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// decodeData reads an event's data into a struct through its JSON form, as
+// the data types belong to the packages publishing them
+func decodeData(data any, v any) {
+	encoded, err := json.Marshal(data)
+	if err == nil {
+		json.Unmarshal(encoded, v)
+	}
+}
+
+// truncate shortens s to at most limit bytes without splitting a rune
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
@@ -0,0 +1,249 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// retained returns the last message on a topic and how many were sent
+func (b *fakeMQTT) retained(topic string) (mqttMessage, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var last mqttMessage
+	count := 0
+	for _, message := range b.messages {
+		if message.topic == topic {
+			last = message
+			count++
+		}
+	}
+	return last, count
+}
+
+func TestHomeAssistant(t *testing.T) {
+	b := (&fakeMQTT{}).start(t)
+	h, err := NewHomeAssistant(b.url("/home/libas"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var applied []string
+	h.HandleVAD(func(clientID string, threshold float64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, fmt.Sprintf("%s %g", clientID, threshold))
+		return nil
+	})
+	appliedSoFar := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(applied)
+	}
+
+	ctx := context.Background()
+	publish := func(event Event) {
+		t.Helper()
+		if err := h.Publish(ctx, event); err != nil {
+			t.Fatalf("%s: %v", event.Type, err)
+		}
+	}
+	state := func(topic string) string {
+		message, _ := b.retained(topic)
+		if !message.retain {
+			t.Errorf("%s is not retained", topic)
+		}
+		return message.payload
+	}
+
+	publish(Event{Type: ClientConnected, ClientID: "c1", Data: map[string]any{"addr": "10.0.0.5:40000"}})
+
+	b.mu.Lock()
+	subscriptions := slices.Clone(b.subscriptions)
+	connect := b.connects[0]
+	b.mu.Unlock()
+	for _, filter := range []string{"homeassistant/status", "home/libas/+/vad/set"} {
+		if !slices.Contains(subscriptions, filter) {
+			t.Errorf("not subscribed to %s: %v", filter, subscriptions)
+		}
+	}
+	if connect.willTopic != "home/libas/status" || connect.willMessage != "offline" || state("home/libas/status") != "online" {
+		t.Errorf("got will %s %s and status %s", connect.willTopic, connect.willMessage, state("home/libas/status"))
+	}
+
+	// Discovery, keyed by the host
+	configs := map[string]string{
+		"homeassistant/sensor/libas_10_0_0_5/transcription/config":    "home/libas/10_0_0_5/transcription",
+		"homeassistant/binary_sensor/libas_10_0_0_5/connected/config": "home/libas/10_0_0_5/connected",
+		"homeassistant/number/libas_10_0_0_5/vad_threshold/config":    "home/libas/10_0_0_5/vad",
+	}
+	for topic, stateTopic := range configs {
+		var config struct {
+			UniqueID          string `json:"unique_id"`
+			StateTopic        string `json:"state_topic"`
+			CommandTopic      string `json:"command_topic"`
+			AvailabilityTopic string `json:"availability_topic"`
+			Device            struct {
+				Identifiers []string `json:"identifiers"`
+				Name        string   `json:"name"`
+			} `json:"device"`
+		}
+		if err := json.Unmarshal([]byte(state(topic)), &config); err != nil {
+			t.Errorf("%s: %v", topic, err)
+			continue
+		}
+		if config.StateTopic != stateTopic || config.AvailabilityTopic != "home/libas/status" ||
+			!strings.HasPrefix(config.UniqueID, "libas_10_0_0_5_") ||
+			!slices.Equal(config.Device.Identifiers, []string{"libas_10_0_0_5"}) || config.Device.Name != "libas 10.0.0.5" {
+			t.Errorf("%s: got %+v", topic, config)
+		}
+		if strings.HasPrefix(topic, "homeassistant/number/") && config.CommandTopic != "home/libas/10_0_0_5/vad/set" {
+			t.Errorf("VAD command topic is %s", config.CommandTopic)
+		}
+	}
+	if got := state("home/libas/10_0_0_5/connected"); got != "ON" {
+		t.Errorf("connected is %s", got)
+	}
+
+	// The state is cut at a rune boundary, the attributes keep the whole text
+	text := strings.Repeat("a", 254) + "é"
+	publish(Event{Type: Transcription, ClientID: "c1", Data: map[string]any{"text": text, "sequence": 7}})
+	if got := state("home/libas/10_0_0_5/transcription"); got != text[:254] {
+		t.Errorf("state is %d bytes, want 254", len(got))
+	}
+	var attributes struct {
+		Text     string `json:"text"`
+		ClientID string `json:"clientId"`
+		Sequence uint64 `json:"sequence"`
+	}
+	json.Unmarshal([]byte(state("home/libas/10_0_0_5/transcription/attributes")), &attributes)
+	if attributes.Text != text || attributes.ClientID != "c1" || attributes.Sequence != 7 {
+		t.Errorf("got attributes %+v", attributes)
+	}
+
+	// A threshold set in Home Assistant goes to the connected client
+	b.send("home/libas/10_0_0_5/vad/set", " 3.5\n")
+	waitFor(t, "the threshold to be applied", func() bool {
+		_, count := b.retained("home/libas/10_0_0_5/vad")
+		return count == 1
+	})
+	if got := appliedSoFar(); !slices.Equal(got, []string{"c1 3.5"}) {
+		t.Errorf("applied %v", got)
+	}
+	if got := state("home/libas/10_0_0_5/vad"); got != "3.5" {
+		t.Errorf("VAD state is %s", got)
+	}
+	for _, payload := range []string{"0.5", "25", "NaN", "three", ""} {
+		h.handleVAD("home/libas/10_0_0_5/vad/set", []byte(payload))
+	}
+	h.handleVAD("home/libas/other/vad/set", []byte("4"))
+	if got := appliedSoFar(); len(got) != 1 {
+		t.Errorf("invalid thresholds applied: %v", got)
+	}
+
+	// The host reconnecting keeps its device and gets its threshold back
+	_, discoveries := b.retained("homeassistant/sensor/libas_10_0_0_5/transcription/config")
+	publish(Event{Type: ClientDisconnected, ClientID: "c1"})
+	if got := state("home/libas/10_0_0_5/connected"); got != "OFF" {
+		t.Errorf("connected is %s after disconnecting", got)
+	}
+	publish(Event{Type: ClientConnected, ClientID: "c2", Data: map[string]any{"addr": "10.0.0.5:40001"}})
+	publish(Event{Type: ClientDisconnected, ClientID: "c1"}) // Late news of the old connection
+	if got := state("home/libas/10_0_0_5/connected"); got != "ON" {
+		t.Errorf("connected is %s after reconnecting", got)
+	}
+	if got := appliedSoFar(); !slices.Equal(got, []string{"c1 3.5", "c2 3.5"}) {
+		t.Errorf("applied %v", got)
+	}
+	if _, count := b.retained("homeassistant/sensor/libas_10_0_0_5/transcription/config"); count != discoveries {
+		t.Errorf("discovery sent again on reconnect")
+	}
+
+	// Home Assistant restarting gets discovery again
+	b.send("homeassistant/status", "offline")
+	b.send("homeassistant/status", "online")
+	waitFor(t, "discovery to be sent again", func() bool {
+		_, count := b.retained("homeassistant/sensor/libas_10_0_0_5/transcription/config")
+		return count == discoveries+1
+	})
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := state("home/libas/status"); got != "offline" {
+		t.Errorf("status is %s after Close", got)
+	}
+}
+
+func TestHomeAssistantWithoutVAD(t *testing.T) {
+	b := (&fakeMQTT{}).start(t)
+	h, err := NewHomeAssistant(b.url(""), "/ha/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// Uploads name a client that was never seen connecting
+	err = h.Publish(context.Background(), Event{Type: Transcription, ClientID: "upload:phone", Data: map[string]any{"text": "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message, _ := b.retained("libas/upload_phone/transcription"); message.payload != "hi" {
+		t.Errorf("got %+v", message)
+	}
+	if _, count := b.retained("ha/sensor/libas_upload_phone/transcription/config"); count != 1 {
+		t.Errorf("transcription sensor not discovered under the custom prefix")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, message := range b.messages {
+		if strings.HasPrefix(message.topic, "ha/number/") {
+			t.Errorf("VAD entity discovered without a handler: %s", message.topic)
+		}
+	}
+	if slices.Contains(b.subscriptions, "libas/+/vad/set") {
+		t.Error("subscribed to VAD commands without a handler")
+	}
+}
+
+func TestHANode(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.5":     "10_0_0_5",
+		"fe80::1%eth0": "fe80__1_eth0",
+		"kitchen-pi":   "kitchen-pi",
+		"Kitchen_Pi":   "Kitchen_Pi",
+		"upload:phone": "upload_phone",
+		"ü/#+":         "____",
+		"":             "",
+	}
+	for host, want := range tests {
+		if got := haNode(host); got != want {
+			t.Errorf("%q: got %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s     string
+		limit int
+		want  string
+	}{
+		{"hello", 5, "hello"},
+		{"hello", 4, "hell"},
+		{"hello", 0, ""},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本", 5, "日"},
+		{"日本", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.limit); got != tt.want {
+			t.Errorf("%q to %d: got %q, want %q", tt.s, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// Attempts at publishing one event, safe to repeat as JetStream drops
+	// duplicates by event ID
+	jetStreamAttempts = 3
+
+	// JetStream error code for creating a stream that already exists
+	jsErrStreamNameInUse = 10058
+)
+
+// Stream names may not contain subject tokens or whitespace
+var streamName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// JetStream publishes events to a NATS JetStream stream, persisted so
+// consumers can replay them. Subjects are those of the NATS sink and the
+// stream, created when missing, captures every subject under the prefix.
+type JetStream struct {
+	*NATS
+	stream string
+	maxAge time.Duration
+
+	// Whether the stream is known to exist
+	mu      sync.Mutex
+	ensured bool
+}
+
+// jsAPIError is the error of a JetStream API response or publish ack
+type jsAPIError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+// NewJetStream creates a JetStream sink from a NATS URL, publishing to a
+// stream keeping events for maxAge ("" or "0" forever)
+func NewJetStream(u *url.URL, stream, maxAge string) (*JetStream, error) {
+	if !streamName.MatchString(stream) {
+		return nil, fmt.Errorf("invalid JetStream stream name %q", stream)
+	}
+	n, err := NewNATS(u)
+	if err != nil {
+		return nil, err
+	}
+
+	js := &JetStream{NATS: n, stream: stream}
+	if maxAge != "" {
+		if js.maxAge, err = time.ParseDuration(maxAge); err != nil || js.maxAge < 0 {
+			return nil, fmt.Errorf("invalid JetStream max-age %q", maxAge)
+		}
+	}
+	return js, nil
+}
+
+func (js *JetStream) String() string {
+	return js.NATS.String() + "?stream=" + js.stream
+}
+
+// Publish stores an event in the stream, waiting for the server's
+// acknowledgement
+func (js *JetStream) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	headers := make(map[string]string)
+	if event.ID != "" {
+		headers["Nats-Msg-Id"] = event.ID
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = js.publish(ctx, js.Subject(event), headers, payload)
+		if err == nil || attempt == jetStreamAttempts || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (js *JetStream) publish(ctx context.Context, subject string, headers map[string]string, payload []byte) error {
+	conn, err := js.connection(ctx)
+	if err != nil {
+		return err
+	}
+	if err := js.ensureStream(ctx, conn); err != nil {
+		return err
+	}
+
+	reply, err := conn.request(ctx, subject, headers, payload)
+	if err != nil {
+		js.reset(conn)
+		return err
+	}
+	if reply.status == 503 {
+		// The stream was deleted, create it again on the next attempt
+		js.mu.Lock()
+		js.ensured = false
+		js.mu.Unlock()
+		return fmt.Errorf("no JetStream stream captures %s", subject)
+	}
+
+	var ack struct {
+		Stream string      `json:"stream"`
+		Seq    uint64      `json:"seq"`
+		Error  *jsAPIError `json:"error"`
+	}
+	if err := json.Unmarshal(reply.data, &ack); err != nil {
+		return fmt.Errorf("invalid JetStream acknowledgement: %w", err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("JetStream rejected event: %s", ack.Error.Description)
+	}
+	return nil
+}
+
+// ensureStream creates the stream unless it was already seen to exist
+func (js *JetStream) ensureStream(ctx context.Context, conn *natsConn) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.ensured {
+		return nil
+	}
+
+	config, _ := json.Marshal(map[string]any{
+		"name":      js.stream,
+		"subjects":  []string{js.prefix + ".>"},
+		"storage":   "file",
+		"retention": "limits",
+		"max_age":   js.maxAge.Nanoseconds(),
+	})
+	reply, err := conn.request(ctx, "$JS.API.STREAM.CREATE."+js.stream, nil, config)
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream stream: %w", err)
+	}
+	if reply.status == 503 {
+		return fmt.Errorf("JetStream is not enabled on the NATS server")
+	}
+
+	var response struct {
+		Error *jsAPIError `json:"error"`
+	}
+	if err := json.Unmarshal(reply.data, &response); err != nil {
+		return fmt.Errorf("invalid JetStream response: %w", err)
+	}
+	if response.Error != nil && response.Error.ErrCode != jsErrStreamNameInUse {
+		return fmt.Errorf("failed to create JetStream stream %s: %s", js.stream, response.Error.Description)
+	}
+
+	js.ensured = true
+	return nil
+}
@@ -0,0 +1,635 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// How often an idle connection is pinged, the broker drops it after one
+// and a half intervals of silence
+const mqttKeepAlive = 60 * time.Second
+
+const (
+	// Largest remaining length the four length bytes can encode
+	mqttMaxRemainingLength = 1<<28 - 1
+
+	// Largest packet read from the broker. Only acknowledgements and the
+	// short messages of the subscribed command topics are expected.
+	mqttMaxReadLength = 1 << 20
+)
+
+// MQTT publishes events to an MQTT 3.1.1 broker with QoS 1, on topics
+// <prefix>/<type>/<client ID>. The connection is opened on first use and
+// again after it fails, right away when there are subscriptions.
+type MQTT struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	prefix   string
+	clientID string
+
+	// Topic set to "online" while connected and "offline" by the broker
+	// once the connection is lost, empty for none
+	statusTopic string
+
+	mu     sync.Mutex
+	conn   *mqttConn
+	closed bool
+
+	// Handlers by topic filter, locked apart from the connection since the
+	// reader dispatches messages while a subscription waits for its SUBACK
+	subscriptionsMu sync.Mutex
+	subscriptions   map[string]func(topic string, payload []byte)
+}
+
+// NewMQTT creates an MQTT sink from an mqtt:// or mqtts:// URL whose path
+// is the topic prefix, "libas" when empty
+func NewMQTT(u *url.URL) (*MQTT, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("MQTT URL %q has no broker", u.Redacted())
+	}
+
+	m := &MQTT{
+		addr:          u.Host,
+		useTLS:        u.Scheme == "mqtts",
+		prefix:        strings.Trim(u.Path, "/"),
+		subscriptions: make(map[string]func(string, []byte)),
+	}
+	if u.Port() == "" {
+		port := "1883"
+		if m.useTLS {
+			port = "8883"
+		}
+		m.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if m.prefix == "" {
+		m.prefix = "libas"
+	}
+	if u.User != nil {
+		m.username = u.User.Username()
+		m.password, _ = u.User.Password()
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	m.clientID = "libas-" + hex.EncodeToString(id)
+	return m, nil
+}
+
+func (m *MQTT) String() string {
+	scheme := "mqtt"
+	if m.useTLS {
+		scheme = "mqtts"
+	}
+	return scheme + "://" + m.addr + "/" + m.prefix
+}
+
+// Prefix is the topic prefix from the URL
+func (m *MQTT) Prefix() string {
+	return m.prefix
+}
+
+// SetStatusTopic keeps a retained "online" or "offline" on a topic, using
+// the broker's last will for the latter. Call it before connecting.
+func (m *MQTT) SetStatusTopic(topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statusTopic = topic
+}
+
+// Topic is where an event is published
+func (m *MQTT) Topic(event Event) string {
+	topic := m.prefix + "/" + event.Type
+	if event.ClientID != "" {
+		topic += "/" + event.ClientID
+	}
+	return topic
+}
+
+// Publish sends an event as JSON
+func (m *MQTT) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	return m.PublishMessage(ctx, m.Topic(event), payload, false)
+}
+
+// PublishMessage sends a payload to a topic with QoS 1, reconnecting once
+// when the connection turns out to be broken
+func (m *MQTT) PublishMessage(ctx context.Context, topic string, payload []byte, retain bool) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *mqttConn
+		if conn, err = m.connection(ctx); err != nil {
+			return err
+		}
+		if err = conn.publish(ctx, topic, payload, retain); err == nil || ctx.Err() != nil {
+			return err
+		}
+		m.drop(conn)
+	}
+	return err
+}
+
+// Subscribe calls handler, on its own goroutine, for each message on a
+// topic filter, which may use the + and # wildcards. The subscription is
+// renewed whenever the connection is.
+func (m *MQTT) Subscribe(ctx context.Context, filter string, handler func(topic string, payload []byte)) error {
+	m.subscriptionsMu.Lock()
+	m.subscriptions[filter] = handler
+	m.subscriptionsMu.Unlock()
+
+	conn, err := m.connection(ctx)
+	if err != nil {
+		// Subscribed once a reconnect succeeds
+		m.reconnectLater(nil)
+		return err
+	}
+	return conn.subscribe(ctx, filter)
+}
+
+// connection returns the open connection, dialing one when needed
+func (m *MQTT) connection(ctx context.Context) (*mqttConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, fmt.Errorf("MQTT sink closed")
+	}
+	if m.conn != nil && !m.conn.isClosed() {
+		return m.conn, nil
+	}
+
+	conn, err := m.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.conn = conn
+
+	// The broker forgets subscriptions with a clean session
+	for _, filter := range m.filters() {
+		if err := conn.subscribe(ctx, filter); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if m.statusTopic != "" {
+		if err := conn.publish(ctx, m.statusTopic, []byte("online"), true); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// drop closes a connection that failed so the next use redials
+func (m *MQTT) drop(conn *mqttConn) {
+	conn.close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == conn {
+		m.conn = nil
+	}
+}
+
+// reconnectLater redials in the background with backoff when there are
+// subscriptions to keep, after conn was lost
+func (m *MQTT) reconnectLater(conn *mqttConn) {
+	if len(m.filters()) == 0 {
+		return
+	}
+	m.mu.Lock()
+	if m.closed || (conn != nil && m.conn != conn) {
+		m.mu.Unlock()
+		return
+	}
+	m.conn = nil
+	m.mu.Unlock()
+
+	go func() {
+		backoff := time.Second
+		for {
+			time.Sleep(backoff)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			_, err := m.connection(ctx)
+			cancel()
+			if err == nil {
+				slog.Info("Reconnected to MQTT broker", "broker", m.addr)
+				return
+			}
+
+			m.mu.Lock()
+			closed := m.closed
+			m.mu.Unlock()
+			if closed {
+				return
+			}
+			slog.Warn("Failed to reconnect to MQTT broker", "broker", m.addr, "error", err)
+			backoff = min(backoff*2, time.Minute)
+		}
+	}()
+}
+
+func (m *MQTT) filters() []string {
+	m.subscriptionsMu.Lock()
+	defer m.subscriptionsMu.Unlock()
+	filters := make([]string, 0, len(m.subscriptions))
+	for filter := range m.subscriptions {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// dispatch hands a received message to the matching subscriptions
+func (m *MQTT) dispatch(topic string, payload []byte) {
+	m.subscriptionsMu.Lock()
+	defer m.subscriptionsMu.Unlock()
+	for filter, handler := range m.subscriptions {
+		if topicMatches(filter, topic) {
+			go handler(topic, payload)
+		}
+	}
+}
+
+func (m *MQTT) dial(ctx context.Context) (*mqttConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var raw net.Conn
+	var err error
+	if m.useTLS {
+		host, _, _ := net.SplitHostPort(m.addr)
+		raw, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", m.addr)
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", m.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	raw.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Protocol name, level 4 (3.1.1), flags and keep alive
+	var body []byte
+	body = appendString(body, "MQTT")
+	flags := byte(0x02) // Clean session
+	if m.statusTopic != "" {
+		flags |= 0x04 | 0x08 | 0x20 // Will with QoS 1, retained
+	}
+	if m.username != "" {
+		flags |= 0x80
+		if m.password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = appendString(body, m.clientID)
+	if m.statusTopic != "" {
+		body = appendString(body, m.statusTopic)
+		body = appendString(body, "offline")
+	}
+	if m.username != "" {
+		body = appendString(body, m.username)
+		if m.password != "" {
+			body = appendString(body, m.password)
+		}
+	}
+
+	reader := bufio.NewReader(raw)
+	if err := writePacket(raw, mqttConnect<<4, body); err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	packetType, _, reply, err := readPacket(reader)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	if packetType != mqttConnack || len(reply) < 2 {
+		raw.Close()
+		return nil, fmt.Errorf("unexpected MQTT packet %d instead of CONNACK", packetType)
+	}
+	if code := reply[1]; code != 0 {
+		raw.Close()
+		return nil, fmt.Errorf("MQTT broker refused connection with code %d", code)
+	}
+	raw.SetDeadline(time.Time{})
+
+	conn := &mqttConn{
+		conn:    raw,
+		reader:  reader,
+		owner:   m,
+		pending: make(map[uint16]chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go conn.read()
+	go conn.ping()
+	return conn, nil
+}
+
+// Close disconnects from the broker
+func (m *MQTT) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.conn != nil {
+		writePacket(m.conn.conn, mqttDisconnect<<4, nil)
+		m.conn.close()
+		m.conn = nil
+	}
+	return nil
+}
+
+// mqttConn is one connection to the broker. A reader goroutine receives
+// acknowledgements and messages.
+type mqttConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	owner  *MQTT
+
+	writeMu sync.Mutex
+
+	// Acknowledgements awaited, by packet ID
+	mu       sync.Mutex
+	packetID uint16
+	pending  map[uint16]chan struct{}
+
+	// Closed with err set once the connection is unusable
+	done chan struct{}
+	err  error
+	once sync.Once
+}
+
+// read handles packets from the broker until the connection fails
+func (c *mqttConn) read() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 2))
+		packetType, flags, body, err := readPacket(c.reader)
+		if err != nil {
+			c.fail(err)
+			c.owner.reconnectLater(c)
+			return
+		}
+
+		switch packetType {
+		case mqttPuback, mqttSuback:
+			if len(body) >= 2 {
+				c.acknowledge(binary.BigEndian.Uint16(body))
+			}
+		case mqttPublish:
+			c.receive(flags, body)
+		}
+	}
+}
+
+// receive acknowledges and dispatches a message from the broker
+func (c *mqttConn) receive(flags byte, body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+length {
+		return
+	}
+	topic := string(body[2 : 2+length])
+	payload := body[2+length:]
+
+	if qos := (flags >> 1) & 0x03; qos > 0 {
+		if len(payload) < 2 {
+			return
+		}
+		c.write(mqttPuback<<4, payload[:2])
+		payload = payload[2:]
+	}
+	c.owner.dispatch(topic, payload)
+}
+
+// ping keeps an idle connection alive
+func (c *mqttConn) ping() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(mqttPingreq<<4, nil); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return writePacket(c.conn, header, body)
+}
+
+// nextPacket reserves a packet ID and the channel its acknowledgement
+// closes
+func (c *mqttConn) nextPacket() (uint16, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	ack := make(chan struct{})
+	c.pending[c.packetID] = ack
+	return c.packetID, ack
+}
+
+func (c *mqttConn) acknowledge(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ack, ok := c.pending[id]; ok {
+		close(ack)
+		delete(c.pending, id)
+	}
+}
+
+// send writes a packet carrying a packet ID and waits for its
+// acknowledgement
+func (c *mqttConn) send(ctx context.Context, header byte, body func(id uint16) []byte) error {
+	id, ack := c.nextPacket()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(header, body(id)); err != nil {
+		c.fail(err)
+		return err
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *mqttConn) publish(ctx context.Context, topic string, payload []byte, retain bool) error {
+	flags := byte(0x02) // QoS 1
+	if retain {
+		flags |= 0x01
+	}
+	err := c.send(ctx, mqttPublish<<4|flags, func(id uint16) []byte {
+		body := appendString(nil, topic)
+		body = binary.BigEndian.AppendUint16(body, id)
+		return append(body, payload...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to MQTT: %w", err)
+	}
+	return nil
+}
+
+func (c *mqttConn) subscribe(ctx context.Context, filter string) error {
+	err := c.send(ctx, mqttSubscribe<<4|0x02, func(id uint16) []byte {
+		body := binary.BigEndian.AppendUint16(nil, id)
+		body = appendString(body, filter)
+		return append(body, 1) // QoS 1
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", filter, err)
+	}
+	return nil
+}
+
+func (c *mqttConn) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *mqttConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *mqttConn) close() {
+	c.fail(errors.New("connection closed"))
+}
+
+// topicMatches reports whether a topic matches a filter with + and #
+// wildcards
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// writePacket writes a fixed header with the remaining length and the body
+func writePacket(w io.Writer, header byte, body []byte) error {
+	packet, err := appendRemainingLength([]byte{header}, len(body))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(packet, body...))
+	return err
+}
+
+// appendRemainingLength appends the variable length encoding of a packet's
+// remaining length
+func appendRemainingLength(packet []byte, length int) ([]byte, error) {
+	if length > mqttMaxRemainingLength {
+		return nil, fmt.Errorf("MQTT packet of %d bytes is too large", length)
+	}
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			return packet, nil
+		}
+	}
+}
+
+// readPacket reads one packet, returning its type, flags and body
+func readPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("malformed MQTT packet length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxReadLength {
+		return 0, 0, nil, fmt.Errorf("MQTT packet of %d bytes is too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
@@ -0,0 +1,447 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemainingLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{mqttMaxRemainingLength, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tt := range tests {
+		got, err := appendRemainingLength(nil, tt.length)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%d: got % x, %v, want % x", tt.length, got, err, tt.want)
+		}
+	}
+	if got, err := appendRemainingLength(nil, mqttMaxRemainingLength+1); err == nil {
+		t.Errorf("encoded a length past the protocol limit as % x", got)
+	}
+
+	// Packets up to the read limit come back whole
+	for _, length := range []int{0, 127, 128, 16384, mqttMaxReadLength} {
+		var buf bytes.Buffer
+		body := bytes.Repeat([]byte{0xab}, length)
+		if err := writePacket(&buf, mqttPublish<<4|0x03, body); err != nil {
+			t.Fatal(err)
+		}
+		packetType, flags, got, err := readPacket(bufio.NewReader(&buf))
+		if err != nil || packetType != mqttPublish || flags != 0x03 || !bytes.Equal(got, body) {
+			t.Errorf("%d bytes: got type %d flags %#x, %d bytes, %v", length, packetType, flags, len(got), err)
+		}
+	}
+}
+
+func TestReadMalformedPacket(t *testing.T) {
+	tooLarge, _ := appendRemainingLength([]byte{mqttPublish << 4}, mqttMaxReadLength+1)
+	tests := map[string][]byte{
+		"empty":               {},
+		"no length":           {mqttPuback << 4},
+		"five length bytes":   {mqttPuback << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"unterminated length": {mqttPuback << 4, 0x80, 0x80},
+		"truncated body":      {mqttPuback << 4, 0x02, 0x00},
+		"past the read limit": append(tooLarge, make([]byte, 16)...),
+		"largest length":      {mqttPublish << 4, 0xff, 0xff, 0xff, 0x7f},
+	}
+	for name, data := range tests {
+		if packetType, _, body, err := readPacket(bufio.NewReader(bytes.NewReader(data))); err == nil {
+			t.Errorf("%s: read type %d with %d bytes", name, packetType, len(body))
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"libas/transcription/kitchen", "libas/transcription/kitchen", true},
+		{"libas/transcription/kitchen", "libas/transcription/garage", false},
+		{"libas/+/vad/set", "libas/kitchen/vad/set", true},
+		{"libas/+/vad/set", "libas/kitchen/vad", false},
+		{"libas/+/vad/set", "libas/a/b/vad/set", false},
+		{"libas/#", "libas", true},
+		{"libas/#", "libas/a/b", true},
+		{"#", "anything/at/all", true},
+		{"libas/+", "libas", false},
+		{"libas/+", "libas/", true},
+		{"libas", "libas/status", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("%s matching %s: got %v", tt.filter, tt.topic, got)
+		}
+	}
+}
+
+// mqttConnectPacket is what a client sent in its CONNECT packet
+type mqttConnectPacket struct {
+	protocol    string
+	level       byte
+	flags       byte
+	keepAlive   uint16
+	clientID    string
+	willTopic   string
+	willMessage string
+	username    string
+	password    string
+}
+
+// mqttMessage is a message a client published
+type mqttMessage struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// fakeMQTT is an MQTT 3.1.1 broker recording what clients send
+type fakeMQTT struct {
+	t    *testing.T
+	addr string
+
+	// CONNACK return code, 0 accepts
+	refuse byte
+
+	mu            sync.Mutex
+	connects      []mqttConnectPacket
+	messages      []mqttMessage
+	subscriptions []string
+	pubacks       int
+	conn          net.Conn
+	writeMu       sync.Mutex
+}
+
+// start listens for clients until the test ends
+func (b *fakeMQTT) start(t *testing.T) *fakeMQTT {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	b.t, b.addr = t, listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeMQTT) url(path string) *url.URL {
+	return &url.URL{Scheme: "mqtt", Host: b.addr, Path: path, User: url.UserPassword("libas", "secret")}
+}
+
+func (b *fakeMQTT) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	write := func(header byte, body []byte) {
+		b.writeMu.Lock()
+		defer b.writeMu.Unlock()
+		writePacket(conn, header, body)
+	}
+	str := func(body []byte) (string, []byte) {
+		if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+			b.t.Errorf("truncated string in packet")
+			return "", nil
+		}
+		n := 2 + int(binary.BigEndian.Uint16(body))
+		return string(body[2:n]), body[n:]
+	}
+
+	for {
+		packetType, flags, body, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+		switch packetType {
+		case mqttConnect:
+			var c mqttConnectPacket
+			c.protocol, body = str(body)
+			if len(body) < 4 {
+				b.t.Errorf("truncated CONNECT")
+				return
+			}
+			c.level, c.flags, c.keepAlive = body[0], body[1], binary.BigEndian.Uint16(body[2:])
+			c.clientID, body = str(body[4:])
+			if c.flags&0x04 != 0 {
+				c.willTopic, body = str(body)
+				c.willMessage, body = str(body)
+			}
+			if c.flags&0x80 != 0 {
+				c.username, body = str(body)
+			}
+			if c.flags&0x40 != 0 {
+				c.password, body = str(body)
+			}
+			if len(body) != 0 {
+				b.t.Errorf("%d bytes left over in CONNECT", len(body))
+			}
+			b.mu.Lock()
+			b.connects = append(b.connects, c)
+			b.conn = conn
+			refuse := b.refuse
+			b.mu.Unlock()
+			write(mqttConnack<<4, []byte{0, refuse})
+			if refuse != 0 {
+				return
+			}
+
+		case mqttPublish:
+			topic, rest := str(body)
+			if qos := flags >> 1 & 0x03; qos != 1 || len(rest) < 2 {
+				b.t.Errorf("PUBLISH with QoS %d", qos)
+				return
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, mqttMessage{topic: topic, payload: string(rest[2:]), retain: flags&0x01 != 0})
+			b.mu.Unlock()
+			write(mqttPuback<<4, rest[:2])
+
+		case mqttSubscribe:
+			if flags != 0x02 || len(body) < 2 {
+				b.t.Errorf("SUBSCRIBE with flags %#x", flags)
+				return
+			}
+			filter, rest := str(body[2:])
+			if len(rest) != 1 || rest[0] != 1 {
+				b.t.Errorf("SUBSCRIBE to %s asked for QoS % x", filter, rest)
+			}
+			b.mu.Lock()
+			b.subscriptions = append(b.subscriptions, filter)
+			b.mu.Unlock()
+			write(mqttSuback<<4, append(body[:2:2], 1))
+
+		case mqttPuback:
+			b.mu.Lock()
+			b.pubacks++
+			b.mu.Unlock()
+
+		case mqttPingreq:
+			write(mqttPingresp<<4, nil)
+
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// send publishes a message with QoS 1 to the last connected client
+func (b *fakeMQTT) send(topic, payload string) {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	body := appendString(nil, topic)
+	body = append(body, 0, 9) // Packet ID
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	writePacket(conn, mqttPublish<<4|0x02, append(body, payload...))
+}
+
+// dropClient closes the connection of the last connected client
+func (b *fakeMQTT) dropClient() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn.Close()
+}
+
+// published returns the messages received so far
+func (b *fakeMQTT) published() []mqttMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqttMessage{}, b.messages...)
+}
+
+// waitFor polls until done reports true, failing the test after a while
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	b := (&fakeMQTT{}).start(t)
+	m, err := NewMQTT(b.url("/home/libas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetStatusTopic("home/libas/status")
+
+	ctx := context.Background()
+	event := Event{Type: Transcription, ClientID: "kitchen", Data: map[string]string{"text": "hello"}}
+	if err := m.Publish(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(ctx, Event{Type: Alert}); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	connect := b.connects[0]
+	b.mu.Unlock()
+	want := mqttConnectPacket{
+		protocol: "MQTT", level: 4, flags: 0x02 | 0x04 | 0x08 | 0x20 | 0x80 | 0x40,
+		keepAlive: uint16(mqttKeepAlive / time.Second), clientID: connect.clientID,
+		willTopic: "home/libas/status", willMessage: "offline", username: "libas", password: "secret",
+	}
+	if connect != want || !strings.HasPrefix(connect.clientID, "libas-") {
+		t.Errorf("got CONNECT %+v, want %+v", connect, want)
+	}
+
+	messages := b.published()
+	if len(messages) != 3 {
+		t.Fatalf("broker got %d messages, want 3: %+v", len(messages), messages)
+	}
+	if messages[0] != (mqttMessage{topic: "home/libas/status", payload: "online", retain: true}) {
+		t.Errorf("got status %+v", messages[0])
+	}
+	var decoded Event
+	if err := json.Unmarshal([]byte(messages[1].payload), &decoded); err != nil || messages[1].topic != "home/libas/transcription/kitchen" ||
+		messages[1].retain || decoded.ClientID != "kitchen" {
+		t.Errorf("got %+v, %v", messages[1], err)
+	}
+	if messages[2].topic != "home/libas/alert" {
+		t.Errorf("event without a client went to %s", messages[2].topic)
+	}
+
+	// A lost connection is redialed by the next publish
+	b.dropClient()
+	waitFor(t, "the client to notice", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.conn == nil || m.conn.isClosed()
+	})
+	if err := m.Publish(ctx, Event{Type: Alert}); err != nil {
+		t.Fatalf("publish after the connection was lost: %v", err)
+	}
+	if messages := b.published(); len(messages) != 5 || messages[3].payload != "online" {
+		t.Errorf("after reconnecting got %+v", messages[3:])
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(ctx, Event{Type: Alert}); err == nil {
+		t.Error("published after Close")
+	}
+}
+
+func TestMQTTSubscribe(t *testing.T) {
+	b := (&fakeMQTT{}).start(t)
+	m, err := NewMQTT(b.url(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	received := make(chan string, 4)
+	err = m.Subscribe(context.Background(), m.Prefix()+"/+/vad/set", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.send("libas/other/topic", "ignored")
+	b.send("libas/kitchen/vad/set", "3.5")
+	select {
+	case got := <-received:
+		if got != "libas/kitchen/vad/set 3.5" {
+			t.Errorf("got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not dispatched")
+	}
+	waitFor(t, "the messages to be acknowledged", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.pubacks == 2
+	})
+
+	// Subscriptions are renewed on the new connection
+	b.mu.Lock()
+	subscribed := len(b.subscriptions)
+	b.mu.Unlock()
+	b.dropClient()
+	waitFor(t, "the subscription to be renewed", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.subscriptions) > subscribed
+	})
+	b.send("libas/garage/vad/set", "4")
+	select {
+	case got := <-received:
+		if got != "libas/garage/vad/set 4" {
+			t.Errorf("got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not dispatched after reconnecting")
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	b := (&fakeMQTT{refuse: 5}).start(t) // Not authorized
+	m, err := NewMQTT(b.url(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.Publish(context.Background(), Event{Type: Alert}); err == nil || !strings.Contains(err.Error(), "code 5") {
+		t.Errorf("got %v, want the refusal", err)
+	}
+}
+
+func TestNewMQTT(t *testing.T) {
+	tests := []struct {
+		url    string
+		addr   string
+		prefix string
+	}{
+		{"mqtt://broker", "broker:1883", "libas"},
+		{"mqtts://broker/home/libas/", "broker:8883", "home/libas"},
+		{"mqtt://broker:1884/x", "broker:1884", "x"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		m, err := NewMQTT(u)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if m.addr != tt.addr || m.Prefix() != tt.prefix {
+			t.Errorf("%s: got %s and prefix %s", tt.url, m.addr, m.Prefix())
+		}
+	}
+	if _, err := NewMQTT(&url.URL{Scheme: "mqtt", Path: "/libas"}); err == nil {
+		t.Error("accepted a URL without a broker")
+	}
+}
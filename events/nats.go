@@ -0,0 +1,434 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/version"
+)
+
+// NATS publishes events to a NATS server on subjects
+// <prefix>.<type>.<client ID>. The connection is opened on first use and
+// again after it fails.
+type NATS struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	token    string
+	prefix   string
+
+	mu   sync.Mutex
+	conn *natsConn
+}
+
+// NewNATS creates a NATS sink from a nats:// or tls:// URL whose path is
+// the subject prefix, "libas" when empty. A user without a password is
+// sent as a token.
+func NewNATS(u *url.URL) (*NATS, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("NATS URL %q has no server", u.Redacted())
+	}
+
+	n := &NATS{
+		addr:   u.Host,
+		useTLS: u.Scheme == "tls",
+		prefix: strings.ReplaceAll(strings.Trim(u.Path, "/"), "/", "."),
+	}
+	if u.Port() == "" {
+		n.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if n.prefix == "" {
+		n.prefix = "libas"
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			n.username, n.password = u.User.Username(), password
+		} else {
+			n.token = u.User.Username()
+		}
+	}
+	return n, nil
+}
+
+func (n *NATS) String() string {
+	scheme := "nats"
+	if n.useTLS {
+		scheme = "tls"
+	}
+	return scheme + "://" + n.addr + "/" + n.prefix
+}
+
+// Subject is where an event is published
+func (n *NATS) Subject(event Event) string {
+	subject := n.prefix + "." + event.Type
+	if event.ClientID != "" {
+		subject += "." + event.ClientID
+	}
+	return subject
+}
+
+// Publish sends an event as JSON
+func (n *NATS) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	conn, err := n.connection(ctx)
+	if err != nil {
+		return err
+	}
+	if err := conn.publish(ctx, n.Subject(event), payload); err != nil {
+		n.reset(conn)
+		return err
+	}
+	return nil
+}
+
+// connection returns the open connection, dialing one when needed
+func (n *NATS) connection(ctx context.Context) (*natsConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn != nil && !n.conn.isClosed() {
+		return n.conn, nil
+	}
+	conn, err := dialNATS(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+	return conn, nil
+}
+
+// reset drops a connection that failed so the next publish redials
+func (n *NATS) reset(conn *natsConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	conn.close()
+	if n.conn == conn {
+		n.conn = nil
+	}
+}
+
+// Close disconnects from the server
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn != nil {
+		n.conn.close()
+		n.conn = nil
+	}
+	return nil
+}
+
+// natsConn is one connection speaking the NATS client protocol. A reader
+// goroutine answers the server's PINGs and reports errors.
+type natsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+
+	// Replies to requests arrive on subjects under the inbox
+	inbox     string
+	repliesMu sync.Mutex
+	replies   map[string]chan natsMsg
+	nextReply uint64
+
+	// Signalled for each PONG, confirming what was written before the PING
+	pongs chan struct{}
+
+	// Closed with err set once the connection is unusable
+	done chan struct{}
+	err  error
+	once sync.Once
+}
+
+// natsMsg is a message received on the inbox
+type natsMsg struct {
+	// Status of a header-only message, such as 503 when a request had no
+	// responders, zero for a normal message
+	status int
+	data   []byte
+}
+
+// natsInfo is the part of the server's INFO line the client needs
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+func dialNATS(ctx context.Context, n *NATS) (*natsConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	raw, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	raw.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// The server introduces itself before any TLS handshake
+	reader := bufio.NewReader(raw)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		raw.Close()
+		return nil, fmt.Errorf("failed to read NATS server info: %v", err)
+	}
+	var info natsInfo
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+
+	conn := raw
+	if n.useTLS || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(n.addr)
+		tlsConn := tls.Client(raw, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("failed to start TLS with NATS: %w", err)
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(tlsConn)
+	}
+
+	options := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "libas",
+		"lang":     "go",
+		"version":  version.Get().Version,
+		"protocol": 1,
+		"headers":  true,
+
+		// Requests nobody listens to fail at once with status 503
+		"no_responders": true,
+	}
+	if n.username != "" {
+		options["user"] = n.username
+		options["pass"] = n.password
+	}
+	if n.token != "" {
+		options["auth_token"] = n.token
+	}
+	connect, _ := json.Marshal(options)
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	c := &natsConn{
+		conn:    conn,
+		reader:  reader,
+		inbox:   "_INBOX." + hex.EncodeToString(id),
+		replies: make(map[string]chan natsMsg),
+		pongs:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, c.inbox); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	go c.read()
+
+	// The PONG confirms the server accepted CONNECT
+	if err := c.flush(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	return c, nil
+}
+
+// read handles server messages until the connection fails
+func (c *natsConn) read() {
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "PING":
+			c.write([]byte("PONG\r\n"))
+		case line == "PONG":
+			select {
+			case c.pongs <- struct{}{}:
+			default:
+			}
+		case strings.HasPrefix(line, "MSG ") || strings.HasPrefix(line, "HMSG "):
+			if err := c.readMessage(line); err != nil {
+				c.fail(err)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			message := strings.Trim(strings.TrimPrefix(line, "-ERR "), "'")
+			slog.Warn("NATS server reported an error", "error", message)
+			c.fail(fmt.Errorf("NATS error: %s", message))
+			return
+		}
+	}
+}
+
+// readMessage reads the payload of a MSG or HMSG line and hands it to the
+// request waiting for it
+func (c *natsConn) readMessage(line string) error {
+	// MSG <subject> <sid> [reply] <size>
+	// HMSG <subject> <sid> [reply] <header size> <total size>
+	fields := strings.Fields(line)
+	headers := fields[0] == "HMSG"
+	minFields := 4
+	if headers {
+		minFields = 5
+	}
+	if len(fields) < minFields {
+		return fmt.Errorf("malformed NATS message %q", line)
+	}
+
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return fmt.Errorf("malformed NATS message %q", line)
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize > total {
+			return fmt.Errorf("malformed NATS message %q", line)
+		}
+	}
+
+	payload := make([]byte, total+2)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+
+	msg := natsMsg{data: payload[headerSize:total]}
+	if headers {
+		// NATS/1.0 503 with an empty body reports a status
+		status := strings.Fields(strings.SplitN(string(payload[:headerSize]), "\r\n", 2)[0])
+		if len(status) > 1 && len(msg.data) == 0 {
+			msg.status, _ = strconv.Atoi(status[1])
+		}
+	}
+
+	c.repliesMu.Lock()
+	reply, ok := c.replies[fields[1]]
+	delete(c.replies, fields[1])
+	c.repliesMu.Unlock()
+	if ok {
+		reply <- msg
+	}
+	return nil
+}
+
+// request publishes a message with headers and waits for its reply
+func (c *natsConn) request(ctx context.Context, subject string, headers map[string]string, payload []byte) (natsMsg, error) {
+	c.repliesMu.Lock()
+	c.nextReply++
+	replyTo := fmt.Sprintf("%s.%d", c.inbox, c.nextReply)
+	reply := make(chan natsMsg, 1)
+	c.replies[replyTo] = reply
+	c.repliesMu.Unlock()
+
+	defer func() {
+		c.repliesMu.Lock()
+		delete(c.replies, replyTo)
+		c.repliesMu.Unlock()
+	}()
+
+	var header strings.Builder
+	header.WriteString("NATS/1.0\r\n")
+	for key, value := range headers {
+		fmt.Fprintf(&header, "%s: %s\r\n", key, value)
+	}
+	header.WriteString("\r\n")
+
+	message := fmt.Appendf(nil, "HPUB %s %s %d %d\r\n%s", subject, replyTo, header.Len(), header.Len()+len(payload), header.String())
+	message = append(message, payload...)
+	message = append(message, "\r\n"...)
+	if err := c.write(message); err != nil {
+		c.fail(err)
+		return natsMsg{}, fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-c.done:
+		return natsMsg{}, c.err
+	case <-ctx.Done():
+		return natsMsg{}, ctx.Err()
+	}
+}
+
+func (c *natsConn) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// publish writes a message and waits for the server to have read it
+func (c *natsConn) publish(ctx context.Context, subject string, payload []byte) error {
+	message := fmt.Appendf(nil, "PUB %s %d\r\n", subject, len(payload))
+	message = append(message, payload...)
+	message = append(message, "\r\nPING\r\n"...)
+	if err := c.write(message); err != nil {
+		c.fail(err)
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	if err := c.waitPong(ctx); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	return nil
+}
+
+// flush waits for the PONG answering a PING already written
+func (c *natsConn) flush(ctx context.Context) error {
+	if err := c.waitPong(ctx); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *natsConn) waitPong(ctx context.Context) error {
+	select {
+	case <-c.pongs:
+		return nil
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *natsConn) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *natsConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *natsConn) close() {
+	c.fail(fmt.Errorf("connection closed"))
+}
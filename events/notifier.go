@@ -0,0 +1,402 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Attempts at posting one notification
+	notifierAttempts = 3
+
+	// Notifications posted per minute when NotifyOptions.PerMinute is zero
+	defaultNotifyPerMinute = 20
+
+	// Longest transcription quoted in a notification
+	notifyTextLimit = 1500
+)
+
+// Embed colors of Discord notifications
+const (
+	discordBlue   = 0x3b82f6
+	discordOrange = 0xf59e0b
+	discordRed    = 0xef4444
+	discordGreen  = 0x22c55e
+)
+
+// NotifyOptions choose what a chat notifier posts
+type NotifyOptions struct {
+	// Post transcriptions containing one of these words, case-insensitive
+	Keywords []string
+
+	// Post every transcription of these clients, by client ID or by the
+	// host they connect from
+	Clients []string
+
+	// Event types posted, transcriptions and alerts when empty
+	Types []string
+
+	// Notifications posted per minute, 20 when zero. The rest are counted
+	// and mentioned in the next one posted.
+	PerMinute int
+}
+
+// Notifier posts events as chat messages to a Slack incoming webhook or a
+// Discord channel webhook. Without keywords or clients every transcription
+// is posted; with them a transcription is posted when it matches a keyword
+// or comes from one of the clients.
+type Notifier struct {
+	service string // "slack" or "discord"
+	url     string
+	client  *http.Client
+
+	keywords []string
+	clients  map[string]bool
+	types    map[string]bool
+
+	mu         sync.Mutex
+	hosts      map[string]string // Host by client ID, from presence events
+	tokens     float64
+	perMinute  float64
+	refilled   time.Time
+	suppressed int
+	retryAt    time.Time // Set by the service's rate limit
+}
+
+// notification is the service independent content of a message
+type notification struct {
+	title      string
+	text       string
+	client     string
+	keywords   []string
+	time       time.Time
+	color      int
+	suppressed int
+}
+
+// NewSlack creates a notifier posting to a Slack incoming webhook URL
+func NewSlack(webhookURL string, opts NotifyOptions) (*Notifier, error) {
+	return newNotifier("slack", webhookURL, opts)
+}
+
+// NewDiscord creates a notifier posting to a Discord channel webhook URL
+func NewDiscord(webhookURL string, opts NotifyOptions) (*Notifier, error) {
+	return newNotifier("discord", webhookURL, opts)
+}
+
+func newNotifier(service, webhookURL string, opts NotifyOptions) (*Notifier, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s webhook URL %q", service, redactPath(webhookURL))
+	}
+
+	n := &Notifier{
+		service:   service,
+		url:       webhookURL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		clients:   make(map[string]bool),
+		types:     make(map[string]bool),
+		hosts:     make(map[string]string),
+		perMinute: float64(opts.PerMinute),
+	}
+	for _, keyword := range opts.Keywords {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			n.keywords = append(n.keywords, keyword)
+		}
+	}
+	for _, client := range opts.Clients {
+		n.clients[strings.TrimSpace(client)] = true
+	}
+
+	types := opts.Types
+	if len(types) == 0 {
+		types = []string{Transcription, Alert}
+	}
+	for _, t := range types {
+		known := false
+		for _, candidate := range Types {
+			known = known || t == candidate
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		n.types[t] = true
+	}
+
+	if n.perMinute <= 0 {
+		n.perMinute = defaultNotifyPerMinute
+	}
+	n.tokens = n.perMinute
+	n.refilled = time.Now()
+	return n, nil
+}
+
+func (n *Notifier) String() string {
+	return n.service + "://" + redactPath(n.url)
+}
+
+// Publish posts an event when it is selected and the rate limit allows
+func (n *Notifier) Publish(ctx context.Context, event Event) error {
+	// Presence is followed even when not posted, to match clients by host
+	if event.Type == ClientConnected {
+		var presence struct {
+			Addr string `json:"addr"`
+		}
+		decodeData(event.Data, &presence)
+		if host, _, err := net.SplitHostPort(presence.Addr); err == nil {
+			n.mu.Lock()
+			n.hosts[event.ClientID] = host
+			n.mu.Unlock()
+		}
+	}
+	if !n.types[event.Type] {
+		return nil
+	}
+
+	note, ok := n.describe(event)
+	if !ok {
+		return nil
+	}
+	if !n.allow(&note) {
+		return nil
+	}
+
+	body, err := json.Marshal(n.format(note))
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	return n.post(ctx, body)
+}
+
+// describe turns an event into a notification, reporting false for a
+// transcription that is not selected
+func (n *Notifier) describe(event Event) (notification, bool) {
+	n.mu.Lock()
+	host := n.hosts[event.ClientID]
+	n.mu.Unlock()
+
+	note := notification{time: event.Time, client: host, color: discordBlue}
+	if note.client == "" && event.ClientID != "" {
+		note.client = shortID(event.ClientID)
+	}
+
+	switch event.Type {
+	case Transcription:
+		var transcription struct {
+			Text string `json:"text"`
+		}
+		decodeData(event.Data, &transcription)
+
+		text := strings.ToLower(transcription.Text)
+		for _, keyword := range n.keywords {
+			if strings.Contains(text, keyword) {
+				note.keywords = append(note.keywords, keyword)
+			}
+		}
+		chosen := n.clients[event.ClientID] || (host != "" && n.clients[host])
+		if (len(n.keywords) > 0 || len(n.clients) > 0) && len(note.keywords) == 0 && !chosen {
+			return note, false
+		}
+
+		note.title = "Transcription"
+		if len(note.keywords) > 0 {
+			note.title = "Keyword alert"
+			note.color = discordOrange
+		}
+		note.text = truncate(transcription.Text, notifyTextLimit)
+
+	case Alert:
+		var alert AlertData
+		decodeData(event.Data, &alert)
+		note.title = "Alert"
+		note.text = alert.Message
+		if alert.Error != "" {
+			note.text += ": " + alert.Error
+		}
+		note.color = discordRed
+		if alert.Status == AlertResolved {
+			note.title = "Resolved"
+			note.color = discordGreen
+		}
+
+	case JobFailed:
+		var failure JobFailure
+		decodeData(event.Data, &failure)
+		note.title = "Transcription failed"
+		note.text = failure.AudioFile + ": " + failure.Error
+		note.color = discordRed
+
+	case Sound:
+		var sound struct {
+			Sound string `json:"sound"`
+		}
+		decodeData(event.Data, &sound)
+		note.title = "Sound"
+		note.text = sound.Sound
+
+	case ClientConnected:
+		note.title = "Client connected"
+	case ClientDisconnected:
+		note.title = "Client disconnected"
+	case ClientMuted:
+		note.title = "Client muted"
+	case ClientUnmuted:
+		note.title = "Client unmuted"
+	}
+	return note, true
+}
+
+// allow takes a token from the rate limit, counting the notification as
+// suppressed when there is none
+func (n *Notifier) allow(note *notification) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	n.tokens = min(n.perMinute, n.tokens+now.Sub(n.refilled).Minutes()*n.perMinute)
+	n.refilled = now
+
+	if n.tokens < 1 || now.Before(n.retryAt) {
+		n.suppressed++
+		return false
+	}
+	n.tokens--
+	note.suppressed = n.suppressed
+	n.suppressed = 0
+	return true
+}
+
+// format builds the message body the service expects
+func (n *Notifier) format(note notification) any {
+	header := note.title
+	if note.client != "" {
+		header += " from " + note.client
+	}
+	footer := ""
+	if len(note.keywords) > 0 {
+		footer = "Matched " + strings.Join(note.keywords, ", ")
+	}
+	if note.suppressed > 0 {
+		if footer != "" {
+			footer += " · "
+		}
+		footer += fmt.Sprintf("%d earlier notifications suppressed by the rate limit", note.suppressed)
+	}
+
+	if n.service == "discord" {
+		embed := map[string]any{
+			"title":       header,
+			"description": note.text,
+			"color":       note.color,
+			"timestamp":   note.time.UTC().Format(time.RFC3339),
+		}
+		if footer != "" {
+			embed["footer"] = map[string]string{"text": footer}
+		}
+		// Transcribed speech must not ping anyone
+		return map[string]any{
+			"embeds":           []any{embed},
+			"allowed_mentions": map[string]any{"parse": []string{}},
+		}
+	}
+
+	text := "*" + slackEscape(header) + "* at " + note.time.Local().Format("15:04:05")
+	if note.text != "" {
+		text += "\n>" + strings.ReplaceAll(slackEscape(note.text), "\n", "\n>")
+	}
+	if footer != "" {
+		text += "\n_" + slackEscape(footer) + "_"
+	}
+	return map[string]any{"text": text}
+}
+
+// post sends a notification, waiting out the service's rate limit before
+// a retry
+func (n *Notifier) post(ctx context.Context, body []byte) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := n.send(ctx, body)
+		if err == nil || retryAfter < 0 || attempt == notifierAttempts {
+			return err
+		}
+
+		wait := max(backoff, retryAfter)
+		backoff *= 2
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// send makes one attempt, returning how long to wait before retrying or a
+// negative duration when a failure would repeat
+func (n *Notifier) send(ctx context.Context, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%s request failed: %w", n.service, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := time.Second
+		if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+			wait = time.Duration(seconds * float64(time.Second))
+		}
+		n.mu.Lock()
+		n.retryAt = time.Now().Add(wait)
+		n.mu.Unlock()
+		return wait, fmt.Errorf("%s rate limited the notification", n.service)
+	}
+	if resp.StatusCode >= 500 {
+		return 0, fmt.Errorf("%s returned %s", n.service, resp.Status)
+	}
+	return -1, fmt.Errorf("%s returned %s", n.service, resp.Status)
+}
+
+// Close does nothing, requests are not kept open
+func (n *Notifier) Close() error {
+	return nil
+}
+
+// slackEscape escapes the characters Slack reads as markup
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// shortID is the first block of a client ID, enough to tell clients apart
+// in a message
+func shortID(clientID string) string {
+	if i := strings.IndexByte(clientID, '-'); i > 0 {
+		return clientID[:i]
+	}
+	return clientID
+}
+
+// redactPath hides the path of a webhook URL, which holds its token
+func redactPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Host
+}
@@ -0,0 +1,116 @@
+package events
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Hashes of the supported SCRAM mechanisms
+var scramHashes = map[string]func() hash.Hash{
+	"SCRAM-SHA-256": sha256.New,
+	"SCRAM-SHA-512": sha512.New,
+}
+
+// scramAuthenticate runs a SCRAM exchange (RFC 5802) over exchange, which
+// sends a client message and returns the server's reply
+func scramAuthenticate(mechanism, username, password string, exchange func([]byte) ([]byte, error)) error {
+	newHash := scramHashes[mechanism]
+
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	clientNonce := base64.RawStdEncoding.EncodeToString(nonce)
+
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+	clientFirst := "n=" + name + ",r=" + clientNonce
+	reply, err := exchange([]byte("n,," + clientFirst))
+	if err != nil {
+		return err
+	}
+	serverFirst := string(reply)
+
+	fields := scramFields(serverFirst)
+	serverNonce := fields["r"]
+	salt, err := base64.StdEncoding.DecodeString(fields["s"])
+	if err != nil || !strings.HasPrefix(serverNonce, clientNonce) {
+		return fmt.Errorf("invalid SCRAM server challenge")
+	}
+	iterations, err := strconv.Atoi(fields["i"])
+	if err != nil || iterations < 1 {
+		return fmt.Errorf("invalid SCRAM iteration count")
+	}
+
+	salted := pbkdf2(newHash, []byte(password), salt, iterations)
+	clientKey := hmacSum(newHash, salted, []byte("Client Key"))
+	storedKey := newHash()
+	storedKey.Write(clientKey)
+
+	// c=biws is the base64 of the "n,," header without channel binding
+	clientFinal := "c=biws,r=" + serverNonce
+	authMessage := []byte(clientFirst + "," + serverFirst + "," + clientFinal)
+	signature := hmacSum(newHash, storedKey.Sum(nil), authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+
+	reply, err = exchange([]byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+
+	// The server proves it knows the password too
+	serverKey := hmacSum(newHash, salted, []byte("Server Key"))
+	expected := base64.StdEncoding.EncodeToString(hmacSum(newHash, serverKey, authMessage))
+	final := scramFields(string(reply))
+	if message, failed := final["e"]; failed {
+		return fmt.Errorf("SCRAM authentication failed: %s", message)
+	}
+	if !hmac.Equal([]byte(final["v"]), []byte(expected)) {
+		return fmt.Errorf("SCRAM server signature does not match")
+	}
+	return nil
+}
+
+// scramFields splits a SCRAM message into its attributes
+func scramFields(message string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(message, ",") {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+func hmacSum(newHash func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a key as long as the hash output (RFC 8018)
+func pbkdf2(newHash func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
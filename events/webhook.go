@@ -0,0 +1,178 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// Attempts at delivering one event to a webhook
+	webhookAttempts = 3
+
+	// Header carrying the hex HMAC-SHA256 of the body when a secret is set
+	SignatureHeader = "X-Libas-Signature"
+)
+
+// WebhookOptions configures a webhook sink
+type WebhookOptions struct {
+	// Sign bodies with HMAC-SHA256 when set
+	Secret string
+
+	// Render the body from the event instead of encoding the event as
+	// JSON, to match the payload a Zapier, IFTTT or n8n trigger expects.
+	// See ParseWebhookTemplate.
+	Template *template.Template
+
+	// Content-Type of templated bodies, application/json when empty
+	ContentType string
+
+	// Sent with every request, e.g. an API key
+	Header http.Header
+}
+
+// Webhook POSTs each event to a URL, as JSON or rendered by a template,
+// with optional headers. Responses other than 2xx are
+// retried with backoff, except client errors which would fail again.
+type Webhook struct {
+	url     string
+	options WebhookOptions
+	client  *http.Client
+}
+
+// NewWebhook creates a webhook sink
+func NewWebhook(target string, opts WebhookOptions) (*Webhook, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", target)
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = "application/json"
+	}
+	return &Webhook{
+		url:     target,
+		options: opts,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// ParseWebhookTemplate parses a webhook body template. It is executed with
+// the Event, so {{.Type}}, {{.ClientID}}, {{.Time}} and the fields of
+// {{.Data}}, e.g. {{.Data.Text}} for transcriptions, can be used, along
+// with these functions:
+//
+//	json   encodes a value as JSON, quoting strings: {"text": {{json .Data.Text}}}
+//	join   joins strings with a separator: {{join .Data.Events ", "}}
+//	lower  and upper change the case of a string
+func ParseWebhookTemplate(text string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"json": func(value any) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+	tmpl, err := template.New("webhook").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %w", err)
+	}
+	return tmpl, nil
+}
+
+func (w *Webhook) String() string {
+	return redact(w.url)
+}
+
+// Publish delivers an event
+func (w *Webhook) Publish(ctx context.Context, event Event) error {
+	body, err := w.body(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// body renders the request body for an event
+func (w *Webhook) body(event Event) ([]byte, error) {
+	if w.options.Template == nil {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode event: %w", err)
+		}
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	if err := w.options.Template.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render webhook template for %s event: %w", event.Type, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// post sends one attempt, reporting whether a failure is worth retrying
+func (w *Webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for key, values := range w.options.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", w.options.ContentType)
+	if w.options.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.options.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook request failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
+
+// Close does nothing, requests are not kept open
+func (w *Webhook) Close() error {
+	return nil
+}
+
+// redact hides the password of a URL for logs
+func redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package fault
+
+import (
+	"errors"
+	"syscall"
+)
+
+// diskFull reports whether err is the system's out of space or quota error
+func diskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
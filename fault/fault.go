@@ -0,0 +1,73 @@
+// Package fault classifies the failures of libas, so embedders can tell
+// them apart with errors.Is rather than by their messages, and reports them
+// to an error tracker such as Sentry.
+package fault
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Classes of failure. Errors returned or reported by libas wrap one of these
+// when they fall in a class, keeping the underlying error in the chain.
+var (
+	// A client presented a wrong token or a user could not be signed in
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// A peer sent something the audio protocol does not allow
+	ErrProtocol = errors.New("protocol violation")
+
+	// A write failed because the disk or the user's quota is full
+	ErrStorageFull = errors.New("storage full")
+
+	// Whisper could not be started or could not load its model
+	ErrTranscriberUnavailable = errors.New("transcriber unavailable")
+)
+
+// Wrap marks err as belonging to a class, e.g. Wrap(ErrProtocol, err)
+func Wrap(class, err error) error {
+	if err == nil || errors.Is(err, class) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", class, err)
+}
+
+// Storage marks err as ErrStorageFull when it reports a full disk or quota,
+// returning other errors unchanged
+func Storage(err error) error {
+	if err != nil && diskFull(err) {
+		return Wrap(ErrStorageFull, err)
+	}
+	return err
+}
+
+// Kind names the class of err for reports and logs: auth_failed, protocol,
+// storage_full, transcriber_unavailable, or error for the rest
+func Kind(err error) string {
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		return "auth_failed"
+	case errors.Is(err, ErrProtocol):
+		return "protocol"
+	case errors.Is(err, ErrStorageFull):
+		return "storage_full"
+	case errors.Is(err, ErrTranscriberUnavailable):
+		return "transcriber_unavailable"
+	}
+	return "error"
+}
+
+// Reporter receives failures an operator should know about, with tags such
+// as op, naming what failed, and clientId. Report is called from the
+// goroutine that failed and must not block.
+type Reporter interface {
+	Report(err error, tags map[string]string)
+}
+
+// ReporterFunc adapts a function to a Reporter
+type ReporterFunc func(err error, tags map[string]string)
+
+// Report calls f
+func (f ReporterFunc) Report(err error, tags map[string]string) {
+	f(err, tags)
+}
@@ -0,0 +1,233 @@
+package fault
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/version"
+)
+
+// Reports waiting to be sent before new ones are dropped
+const sentryQueueSize = 100
+
+// SentryOptions describe the reporting process
+type SentryOptions struct {
+	// Deployment reports are filed under, e.g. production
+	Environment string
+
+	// Defaults to libas@<version>
+	Release string
+
+	// Defaults to the host name
+	ServerName string
+}
+
+// Sentry sends reports to Sentry, or a tracker speaking its protocol such as
+// GlitchTip, through the envelope endpoint of a DSN. Reports are sent in the
+// background and grouped by their kind and op.
+type Sentry struct {
+	endpoint string
+	auth     string
+	dsn      string
+	options  SentryOptions
+	client   *http.Client
+
+	queue chan sentryEvent
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+
+	// Set from the Retry-After of a 429, reports are dropped until then
+	retryAfter time.Time
+}
+
+// sentryEvent is the subset of Sentry's event payload libas fills
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Fingerprint []string          `json:"fingerprint"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// NewSentry creates a reporter for a DSN such as
+// https://<key>@o123.ingest.sentry.io/456
+func NewSentry(dsn string, opts SentryOptions) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if _, err := strconv.ParseUint(project, 10, 64); slash < 0 || err != nil {
+		return nil, fmt.Errorf("invalid Sentry DSN, expected a project ID at the end of the path")
+	}
+
+	if opts.Release == "" {
+		opts.Release = "libas@" + version.Get().Version
+	}
+	if opts.ServerName == "" {
+		opts.ServerName, _ = os.Hostname()
+	}
+
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path[:slash] + "/api/" + project + "/envelope/"}
+	s := &Sentry{
+		endpoint: endpoint.String(),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=libas/%s",
+			u.User.Username(), version.Get().Version),
+		dsn:     u.Redacted(),
+		options: opts,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan sentryEvent, sentryQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Sentry) String() string {
+	return s.dsn
+}
+
+// Report queues an error, dropping it when the queue is full
+func (s *Sentry) Report(err error, tags map[string]string) {
+	if err == nil {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	kind := Kind(err)
+	event := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC(),
+		Platform:    "go",
+		Level:       "error",
+		Logger:      "libas",
+		Release:     s.options.Release,
+		Environment: s.options.Environment,
+		ServerName:  s.options.ServerName,
+		Tags:        map[string]string{"kind": kind},
+		Fingerprint: []string{kind, tags["op"]},
+	}
+	for name, value := range tags {
+		event.Tags[name] = value
+	}
+	event.Exception.Values = []sentryException{{Type: kind, Value: err.Error()}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		slog.Warn("Error report queue full, dropping report", "error", err)
+	}
+}
+
+// run sends queued reports until Close
+func (s *Sentry) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		if err := s.send(event); err != nil {
+			slog.Warn("Failed to send error report", "dsn", s.dsn, "error", err)
+		}
+	}
+}
+
+func (s *Sentry) send(event sentryEvent) error {
+	s.mu.Lock()
+	limited := time.Now().Before(s.retryAfter)
+	s.mu.Unlock()
+	if limited {
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(map[string]any{"event_id": event.EventID, "sent_at": time.Now().UTC()})
+	item, _ := json.Marshal(map[string]any{"type": "event", "length": len(payload)})
+
+	var body bytes.Buffer
+	for _, line := range [][]byte{header, item, payload} {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		s.mu.Lock()
+		s.retryAfter = time.Now().Add(wait)
+		s.mu.Unlock()
+		return fmt.Errorf("rate limited for %s", wait)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Sentry returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close sends the queued reports, giving up when ctx is done. Reports made
+// after Close are not sent.
+func (s *Sentry) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -8,12 +8,5 @@ require (
 	github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/websocket v1.5.3
-	github.com/youpy/go-wav v0.3.2
-)
-
-require (
-	github.com/stretchr/testify v1.9.0 // indirect
-	github.com/youpy/go-riff v0.1.0 // indirect
-	github.com/zaf/g711 v0.0.0-20190814101024-76a4a538f52b // indirect
-	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/sys v0.4.0
 )
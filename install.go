@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// Commands that can run as a service, and whether they report readiness
+// and ping the watchdog through sd_notify
+var serviceCommands = map[string]bool{
+	"serve":   true,
+	"scribe":  true,
+	"ingest":  true,
+	"worker":  false,
+	"capture": false,
+}
+
+// Watchdog timeout written to systemd units of notifying commands
+const serviceWatchdogSec = 30
+
+// service describes the unit or plist written by install-service
+type service struct {
+	Name        string
+	Command     string
+	Executable  string
+	Args        []string
+	WorkingDir  string
+	Notify      bool
+	WatchdogSec int
+	LogPath     string
+	UserService bool
+}
+
+var systemdTemplate = template.Must(template.New("systemd").Funcs(template.FuncMap{
+	"quote": systemdQuote,
+}).Parse(`[Unit]
+Description=libas {{.Command}}
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+{{- if .Notify}}
+Type=notify
+WatchdogSec={{.WatchdogSec}}
+{{- else}}
+Type=simple
+{{- end}}
+ExecStart={{quote .Executable}}{{range .Args}} {{quote .}}{{end}}
+WorkingDirectory={{quote .WorkingDir}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy={{if .UserService}}default.target{{else}}multi-user.target{{end}}
+`))
+
+var launchdTemplate = template.Must(template.New("launchd").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Name}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{xml .Executable}}</string>
+{{- range .Args}}
+		<string>{{xml .}}</string>
+{{- end}}
+	</array>
+	<key>WorkingDirectory</key>
+	<string>{{xml .WorkingDir}}</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>{{xml .LogPath}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .LogPath}}</string>
+</dict>
+</plist>
+`))
+
+// runInstallService writes a systemd unit, or a launchd plist on macOS,
+// that runs a command with the flags given after it from the current
+// directory. On Windows the command is registered as a service instead.
+func runInstallService(args []string) error {
+	fs := newFlagSet("install-service")
+	output := fs.String("output", "", "Where to write the service file, \"-\" prints it (defaults to the system location)")
+	userService := fs.Bool("user", false, "Install a per-user service instead of a system one (always the case for launchd)")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return usageError(fs, "expected the command to run as a service")
+	}
+	command := fs.Arg(0)
+	notify, ok := serviceCommands[command]
+	if !ok {
+		return usageError(fs, "%s cannot run as a service", command)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate libas executable: %w", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return fmt.Errorf("failed to locate libas executable: %w", err)
+	}
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	svc := service{
+		Command:     command,
+		Executable:  executable,
+		Args:        fs.Args(),
+		WorkingDir:  workingDir,
+		Notify:      notify,
+		WatchdogSec: serviceWatchdogSec,
+		UserService: *userService,
+	}
+
+	// Windows services are registered with the service control manager
+	// rather than written to a file
+	if runtime.GOOS == "windows" {
+		svc.Name = "libas-" + command
+		return installWindowsService(svc)
+	}
+
+	tmpl, path, err := servicePlacement(&svc)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		path = *output
+	}
+
+	if path == "-" {
+		return tmpl.Execute(os.Stdout, svc)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create service directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+	if err := tmpl.Execute(file, svc); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+
+	fmt.Printf("Wrote %s\n\n", path)
+	printServiceInstructions(svc, path)
+	return nil
+}
+
+// servicePlacement picks the template and default location for this system
+func servicePlacement(svc *service) (*template.Template, string, error) {
+	home, _ := os.UserHomeDir()
+
+	switch runtime.GOOS {
+	case "darwin":
+		svc.Name = "com.libas." + svc.Command
+		svc.LogPath = filepath.Join(home, "Library", "Logs", "libas-"+svc.Command+".log")
+		return launchdTemplate, filepath.Join(home, "Library", "LaunchAgents", svc.Name+".plist"), nil
+
+	case "linux":
+		svc.Name = "libas-" + svc.Command
+		if svc.UserService {
+			return systemdTemplate, filepath.Join(home, ".config", "systemd", "user", svc.Name+".service"), nil
+		}
+		return systemdTemplate, filepath.Join("/etc", "systemd", "system", svc.Name+".service"), nil
+
+	default:
+		return nil, "", fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+	}
+}
+
+func printServiceInstructions(svc service, path string) {
+	switch runtime.GOOS {
+	case "darwin":
+		fmt.Printf("Start it with:\n  launchctl load -w %s\n", path)
+	default:
+		systemctl := "systemctl"
+		if svc.UserService {
+			systemctl += " --user"
+		}
+		fmt.Printf("Start it with:\n  %s daemon-reload\n  %s enable --now %s\n", systemctl, systemctl, svc.Name)
+	}
+
+	if svc.Command != "scribe" && os.Getenv("LIBAS_TOKEN") != "" {
+		fmt.Println("\nLIBAS_TOKEN is not copied into the service, set token in the -config file instead.")
+	}
+}
+
+// systemdQuote quotes a word of ExecStart when it needs it
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\$%;") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;").Replace(s)
+}
@@ -0,0 +1,158 @@
+// Package audiotest generates audio with known content for exercising
+// voice detection, resampling, segmentation and the recording pipeline:
+// tones, noise, silence and speech-like utterances at any sample rate.
+// Generation is deterministic, so the same call always yields the same
+// samples.
+package audiotest
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bosley/libas/audio"
+)
+
+// Utterance is where a stretch of speech lies in generated audio
+type Utterance struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Silence returns digital silence
+func Silence(sampleRate int, d time.Duration) *audio.PCM {
+	return &audio.PCM{Samples: make([]int16, samples(sampleRate, d)), SampleRate: sampleRate}
+}
+
+// Tone returns a sine wave at freq Hz peaking at level dBFS
+func Tone(sampleRate int, freq float64, d time.Duration, level float64) *audio.PCM {
+	pcm := Silence(sampleRate, d)
+	amplitude := amplitude(level)
+	for i := range pcm.Samples {
+		t := float64(i) / float64(sampleRate)
+		pcm.Samples[i] = clip(amplitude * math.Sin(2*math.Pi*freq*t))
+	}
+	return pcm
+}
+
+// Noise returns white noise with an RMS level of level dBFS. The same seed
+// gives the same noise.
+func Noise(sampleRate int, d time.Duration, level float64, seed int64) *audio.PCM {
+	pcm := Silence(sampleRate, d)
+	rng := rand.New(rand.NewSource(seed))
+	amplitude := amplitude(level)
+	for i := range pcm.Samples {
+		pcm.Samples[i] = clip(amplitude * rng.NormFloat64())
+	}
+	return pcm
+}
+
+// Speech returns a voiced sound shaped like speech, peaking at level dBFS:
+// a tone at a drifting pitch with harmonics, rising and falling in four
+// syllables a second. Whisper does not hear words in it, but level and
+// voice detectors treat it like talking.
+func Speech(sampleRate int, d time.Duration, level float64) *audio.PCM {
+	voice := make([]float64, samples(sampleRate, d))
+	var phase, peak float64
+	for i := range voice {
+		t := float64(i) / float64(sampleRate)
+		// Pitch drifting between 110 and 150 Hz like intonation
+		pitch := 130 + 20*math.Sin(2*math.Pi*0.7*t)
+		phase += 2 * math.Pi * pitch / float64(sampleRate)
+
+		for harmonic := 1.0; harmonic <= 8; harmonic++ {
+			voice[i] += math.Sin(phase*harmonic) / harmonic
+		}
+		voice[i] *= 0.5 - 0.5*math.Cos(2*math.Pi*4*t)
+		peak = max(peak, math.Abs(voice[i]))
+	}
+
+	pcm := Silence(sampleRate, d)
+	if peak == 0 {
+		return pcm
+	}
+	scale := amplitude(level) / peak
+	for i, v := range voice {
+		pcm.Samples[i] = clip(v * scale)
+	}
+	return pcm
+}
+
+// Utterances returns count stretches of speech of length d separated by
+// gap of silence, with gap of silence before the first and after the last,
+// and where each utterance lies
+func Utterances(sampleRate, count int, d, gap time.Duration, level float64) (*audio.PCM, []Utterance) {
+	parts := []*audio.PCM{Silence(sampleRate, gap)}
+	var utterances []Utterance
+	var at time.Duration
+	for i := 0; i < count; i++ {
+		at += gap
+		utterances = append(utterances, Utterance{Start: at, End: at + d})
+		at += d
+		parts = append(parts, Speech(sampleRate, d, level), Silence(sampleRate, gap))
+	}
+	return Concat(parts...), utterances
+}
+
+// Concat joins audio end to end at the sample rate of the first part,
+// resampling the others
+func Concat(parts ...*audio.PCM) *audio.PCM {
+	if len(parts) == 0 {
+		return &audio.PCM{}
+	}
+	out := &audio.PCM{SampleRate: parts[0].SampleRate}
+	for _, part := range parts {
+		samples := part.Samples
+		if part.SampleRate != out.SampleRate {
+			samples = audio.Resample(samples, part.SampleRate, out.SampleRate)
+		}
+		out.Samples = append(out.Samples, samples...)
+	}
+	return out
+}
+
+// Mix adds other onto pcm, e.g. noise under speech, resampling it to pcm's
+// rate. The result is as long as pcm.
+func Mix(pcm, other *audio.PCM) *audio.PCM {
+	samples := other.Samples
+	if other.SampleRate != pcm.SampleRate {
+		samples = audio.Resample(samples, other.SampleRate, pcm.SampleRate)
+	}
+	out := &audio.PCM{Samples: make([]int16, len(pcm.Samples)), SampleRate: pcm.SampleRate}
+	for i, sample := range pcm.Samples {
+		sum := float64(sample)
+		if i < len(samples) {
+			sum += float64(samples[i])
+		}
+		out.Samples[i] = clip(sum)
+	}
+	return out
+}
+
+// WriteWav writes audio to name in dir as a 16-bit WAV, returning the path
+func WriteWav(dir, name string, pcm *audio.PCM) (string, error) {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create fixture directory: %w", err)
+	}
+	if err := audio.WriteWav(path, pcm); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func samples(sampleRate int, d time.Duration) int {
+	return int(d * time.Duration(sampleRate) / time.Second)
+}
+
+// amplitude converts dBFS to a sample amplitude
+func amplitude(level float64) float64 {
+	return math.MaxInt16 * math.Pow(10, level/20)
+}
+
+func clip(v float64) int16 {
+	return int16(max(math.MinInt16, min(math.MaxInt16, math.Round(v))))
+}
@@ -0,0 +1,13 @@
+// Package disk reports the free space of the volume holding the
+// recordings, for the components that stop or alert before it runs out
+package disk
+
+// FreePercent returns the percentage of the volume holding path that is
+// available
+func FreePercent(path string) (float64, error) {
+	free, total, err := Space(path)
+	if err != nil || total == 0 {
+		return 0, err
+	}
+	return float64(free) / float64(total) * 100, nil
+}
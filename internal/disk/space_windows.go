@@ -0,0 +1,18 @@
+//go:build windows
+
+package disk
+
+import "golang.org/x/sys/windows"
+
+// Space returns the bytes available to the process and the size of the
+// volume holding path
+func Space(path string) (free, total uint64, err error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(name, &free, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
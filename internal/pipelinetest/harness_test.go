@@ -0,0 +1,260 @@
+// Package pipelinetest runs an audio server and a scribe in one process
+// over a temporary recordings directory, with a stub in place of whisper,
+// so the whole pipeline from a streaming client to the transcriptions
+// broadcast over WebSocket is tested without a model or a microphone.
+// Start a harness, teach its stub the text of each fixture, speak the
+// fixtures and expect their transcriptions.
+package pipelinetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/testcert"
+	"github.com/bosley/libas/loadgen"
+	"github.com/bosley/libas/scribe"
+	"github.com/bosley/libas/scribeclient"
+	"github.com/bosley/libas/server"
+)
+
+// Shared secret between the harness's clients and server
+const token = "pipelinetest"
+
+// stub is a Transcriber answering with text registered for exact audio,
+// standing in for whisper
+type stub struct {
+	mu    sync.Mutex
+	texts map[[sha256.Size]byte]string
+}
+
+// newStub creates a stub that knows no audio
+func newStub() *stub {
+	return &stub{texts: make(map[[sha256.Size]byte]string)}
+}
+
+// add registers the text pcm transcribes to. The server passes 16kHz audio
+// through unprocessed, so pcm is matched after resampling to 16kHz.
+func (s *stub) add(pcm *audio.PCM, text string) {
+	samples := audio.Resample(pcm.Samples, pcm.SampleRate, audio.WhisperSampleRate)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.texts[fingerprint(samples)] = text
+}
+
+// Transcribe returns the text registered for the audio in path
+func (s *stub) Transcribe(ctx context.Context, path string) (string, error) {
+	pcm, err := audio.ReadAudio(path)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text, ok := s.texts[fingerprint(pcm.Samples)]
+	if !ok {
+		return "", fmt.Errorf("no text registered for %s (%d samples)", filepath.Base(path), len(pcm.Samples))
+	}
+	return text, nil
+}
+
+func fingerprint(samples []int16) [sha256.Size]byte {
+	buf := make([]byte, 2*len(samples))
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(sample))
+	}
+	return sha256.Sum256(buf)
+}
+
+// harness is a running server and scribe sharing a recordings directory
+type harness struct {
+	// Transcriber of the scribe
+	stub *stub
+
+	serverAddr string
+	tlsConfig  *tls.Config
+	sub        *scribeclient.Subscription
+
+	mu             sync.Mutex
+	changed        chan struct{}
+	transcriptions map[string][]string // texts by client ID
+}
+
+// startHarness runs a server and a scribe on loopback ports over the
+// test's temporary directory, stopping them when the test ends
+func startHarness(t *testing.T) *harness {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var done sync.WaitGroup
+	h := &harness{
+		stub:           newStub(),
+		changed:        make(chan struct{}),
+		transcriptions: make(map[string][]string),
+	}
+	t.Cleanup(func() {
+		if h.sub != nil {
+			h.sub.Close()
+		}
+		cancel()
+		done.Wait()
+	})
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	roots, err := testcert.Write(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.tlsConfig = &tls.Config{RootCAs: roots}
+	recordingsDir := filepath.Join(dir, "recordings")
+
+	srv, err := server.New(server.Config{
+		Addr:          "127.0.0.1:0",
+		RecordingsDir: recordingsDir,
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		Token:         token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.serverAddr = listener.Addr().String()
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		srv.Serve(ctx, listener)
+	}()
+
+	scr, err := scribe.New(scribe.Config{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		RecordingsDir: recordingsDir,
+		HTTPAddr:      "127.0.0.1:0",
+		Transcriber:   h.stub,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scribeErr := make(chan error, 1)
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		scribeErr <- scr.Start(ctx)
+	}()
+	select {
+	case <-scr.Ready():
+	case err := <-scribeErr:
+		t.Fatalf("scribe failed to start: %v", err)
+	}
+
+	client, err := scribeclient.New(scribeclient.Config{
+		BaseURL: "https://" + scr.Addr().String(),
+		RootCAs: roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.sub, err = client.Subscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.sub.Send(scribeclient.SubscriptionCommand{Action: "subscribe", ClientIDs: []string{"*"}}); err != nil {
+		t.Fatalf("failed to subscribe to transcriptions: %v", err)
+	}
+	if msg, err := h.sub.Next(); err != nil {
+		t.Fatalf("failed to subscribe to transcriptions: %v", err)
+	} else if msg.Type != "ack" {
+		t.Fatalf("scribe refused subscription: %s", msg.Error())
+	}
+	go h.follow()
+
+	return h
+}
+
+// follow collects the transcriptions broadcast by the scribe
+func (h *harness) follow() {
+	for {
+		msg, err := h.sub.Next()
+		if err != nil {
+			return
+		}
+		transcription, err := msg.Transcription()
+		if err != nil {
+			continue
+		}
+		h.mu.Lock()
+		h.transcriptions[msg.ClientID] = append(h.transcriptions[msg.ClientID], transcription.Text)
+		close(h.changed)
+		h.changed = make(chan struct{})
+		h.mu.Unlock()
+	}
+}
+
+// speak connects a client and streams each fixture as a transmission in
+// real time at 16kHz, returning the client ID. Fixtures must be at least a
+// second and a half long as the server drops shorter transmissions.
+func (h *harness) speak(ctx context.Context, fixtures ...*audio.PCM) (string, error) {
+	conn, err := loadgen.Dial(ctx, h.serverAddr, h.tlsConfig, token, audio.WhisperSampleRate)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if conn.SampleRate != audio.WhisperSampleRate {
+		return "", fmt.Errorf("server declined 16kHz capture")
+	}
+
+	for i, fixture := range fixtures {
+		if i > 0 {
+			// Recordings are named by the second they start
+			time.Sleep(time.Second)
+		}
+		samples := audio.Resample(fixture.Samples, fixture.SampleRate, audio.WhisperSampleRate)
+		_, dropped, err := conn.Transmit(samples)
+		if err != nil {
+			return conn.ClientID, fmt.Errorf("failed to stream fixture %d: %w", i+1, err)
+		}
+		if dropped > 0 {
+			return conn.ClientID, fmt.Errorf("dropped %d chunks of fixture %d, the machine is too busy", dropped, i+1)
+		}
+	}
+	return conn.ClientID, nil
+}
+
+// expect waits until the client's transcriptions are texts, in order,
+// failing on a different transcription or once timeout passes
+func (h *harness) expect(clientID string, timeout time.Duration, texts ...string) error {
+	deadline := time.After(timeout)
+	for {
+		h.mu.Lock()
+		got := h.transcriptions[clientID]
+		changed := h.changed
+		h.mu.Unlock()
+
+		for i, text := range got {
+			if i >= len(texts) {
+				return fmt.Errorf("unexpected transcription %q", text)
+			}
+			if text != texts[i] {
+				return fmt.Errorf("transcription %d is %q, expected %q", i+1, text, texts[i])
+			}
+		}
+		if len(got) == len(texts) {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("received %d of %d transcriptions within %s", len(got), len(texts), timeout)
+		}
+	}
+}
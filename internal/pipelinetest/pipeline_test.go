@@ -0,0 +1,60 @@
+package pipelinetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+// How long to wait for the transcriptions after speaking
+const expectTimeout = 30 * time.Second
+
+// TestPipeline streams generated speech from clients speaking at once and
+// checks each gets its transcriptions back over the WebSocket, in order
+func TestPipeline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams speech in real time")
+	}
+	h := startHarness(t)
+
+	// Each fixture differs, so the stub tells them apart
+	const clients = 2
+	fixtures := make([][]*audio.PCM, clients)
+	texts := make([][]string, clients)
+	for i := range fixtures {
+		for j, level := range []float64{-6, -12} {
+			fixture := audiotest.Concat(
+				audiotest.Silence(audio.WhisperSampleRate, 250*time.Millisecond),
+				audiotest.Speech(audio.WhisperSampleRate, time.Duration(1500+100*i)*time.Millisecond, level),
+				audiotest.Silence(audio.WhisperSampleRate, 250*time.Millisecond),
+			)
+			text := fmt.Sprintf("client %d utterance %d", i+1, j+1)
+			h.stub.add(fixture, text)
+			fixtures[i] = append(fixtures[i], fixture)
+			texts[i] = append(texts[i], text)
+		}
+	}
+
+	errs := make(chan error, clients)
+	for i := range fixtures {
+		go func() {
+			clientID, err := h.speak(context.Background(), fixtures[i]...)
+			if err == nil {
+				err = h.expect(clientID, expectTimeout, texts[i]...)
+			}
+			if err != nil {
+				err = fmt.Errorf("client %d: %w", i+1, err)
+			}
+			errs <- err
+		}()
+	}
+	for range fixtures {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
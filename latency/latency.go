@@ -0,0 +1,251 @@
+// Package latency measures how long speech takes to become a transcription
+// on screen, stage by stage, as histograms per client. The server and
+// scribe share a Recorder when they run in one process, so the time from
+// the end of speech carries over to the transcription. A nil *Recorder is
+// valid and records nothing.
+package latency
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stage is one step of a recording's way from the end of speech to the
+// transcription reaching subscribers
+type Stage string
+
+const (
+	// From the end of speech to the whisper copy of the recording being
+	// written, by the server
+	Finalize Stage = "finalize"
+
+	// From the whisper copy being written to scribe queueing it
+	Queue Stage = "queue"
+
+	// From being queued to whisper returning the text, including the wait
+	// for a worker
+	Transcribe Stage = "transcribe"
+
+	// From the text to the transcription being stored and sent to
+	// subscribers
+	Broadcast Stage = "broadcast"
+
+	// From the end of speech to the transcription reaching subscribers,
+	// recorded when the server and scribe share the recorder
+	Total Stage = "total"
+)
+
+// Upper bounds of the histogram buckets, the last bucket takes the rest
+var bucketBounds = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+const (
+	// How long the end of speech handed off for a recording waits for scribe
+	handoffTTL = 10 * time.Minute
+
+	// Clients reconnect under new IDs, so those without a recording for
+	// this long are forgotten
+	clientTTL = 24 * time.Hour
+)
+
+// Recorder collects the latency histograms
+type Recorder struct {
+	mu      sync.Mutex
+	clients map[string]*clientStages
+	pruned  time.Time
+
+	handoffMu sync.Mutex
+	handoff   map[string]time.Time // end of speech by whisper file path
+}
+
+// New creates an empty recorder
+func New() *Recorder {
+	return &Recorder{
+		clients: make(map[string]*clientStages),
+		handoff: make(map[string]time.Time),
+	}
+}
+
+// Observe records how long a client's recording spent in a stage
+func (r *Recorder) Observe(clientID string, stage Stage, d time.Duration) {
+	if r == nil {
+		return
+	}
+	d = max(d, 0)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.pruned) > time.Minute {
+		r.pruned = now
+		for id, client := range r.clients {
+			if now.Sub(client.updated) > clientTTL {
+				delete(r.clients, id)
+			}
+		}
+	}
+
+	client := r.clients[clientID]
+	if client == nil {
+		client = &clientStages{stages: make(map[Stage]*histogram)}
+		r.clients[clientID] = client
+	}
+	client.updated = now
+	h := client.stages[stage]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(bucketBounds)+1)}
+		client.stages[stage] = h
+	}
+	h.observe(d)
+}
+
+// Handoff remembers when speech ended for the whisper file at path, for
+// scribe to measure the total once the transcription is sent. Hand off
+// before the file appears.
+func (r *Recorder) Handoff(path string, speechEnded time.Time) {
+	if r == nil || speechEnded.IsZero() {
+		return
+	}
+	r.handoffMu.Lock()
+	defer r.handoffMu.Unlock()
+
+	for key, ended := range r.handoff {
+		if time.Since(ended) > handoffTTL {
+			delete(r.handoff, key)
+		}
+	}
+	r.handoff[path] = speechEnded
+}
+
+// Resume takes when speech ended for the whisper file at path
+func (r *Recorder) Resume(path string) (time.Time, bool) {
+	if r == nil {
+		return time.Time{}, false
+	}
+	r.handoffMu.Lock()
+	defer r.handoffMu.Unlock()
+	ended, ok := r.handoff[path]
+	delete(r.handoff, path)
+	return ended, ok
+}
+
+// Summary describes the latency of one stage in milliseconds. Percentiles
+// are interpolated within buckets.
+type Summary struct {
+	Count   uint64   `json:"count"`
+	MeanMs  float64  `json:"meanMs"`
+	P50Ms   float64  `json:"p50Ms"`
+	P90Ms   float64  `json:"p90Ms"`
+	P99Ms   float64  `json:"p99Ms"`
+	MaxMs   float64  `json:"maxMs"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+// Bucket counts the recordings that took at most LeMs milliseconds, zero
+// for the last bucket which has no bound. Counts are not cumulative.
+type Bucket struct {
+	LeMs  float64 `json:"leMs,omitempty"`
+	Count uint64  `json:"count"`
+}
+
+// Snapshot summarizes every client's stages, keyed by client ID and stage
+func (r *Recorder) Snapshot() map[string]map[Stage]Summary {
+	snapshot := make(map[string]map[Stage]Summary)
+	if r == nil {
+		return snapshot
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for clientID, client := range r.clients {
+		summaries := make(map[Stage]Summary, len(client.stages))
+		for stage, h := range client.stages {
+			summaries[stage] = h.summary()
+		}
+		snapshot[clientID] = summaries
+	}
+	return snapshot
+}
+
+type clientStages struct {
+	stages  map[Stage]*histogram
+	updated time.Time
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     time.Duration
+	max     time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(bucketBounds), func(i int) bool { return d <= bucketBounds[i] })
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+func (h *histogram) summary() Summary {
+	s := Summary{
+		Count:   h.count,
+		MaxMs:   milliseconds(h.max),
+		Buckets: make([]Bucket, len(h.buckets)),
+	}
+	if h.count > 0 {
+		s.MeanMs = milliseconds(h.sum) / float64(h.count)
+	}
+	for i, count := range h.buckets {
+		s.Buckets[i].Count = count
+		if i < len(bucketBounds) {
+			s.Buckets[i].LeMs = milliseconds(bucketBounds[i])
+		}
+	}
+	s.P50Ms = h.percentile(0.5)
+	s.P90Ms = h.percentile(0.9)
+	s.P99Ms = h.percentile(0.99)
+	return s
+}
+
+// percentile estimates the duration below which the fraction q of the
+// recordings fall, assuming they spread evenly within a bucket. The last
+// bucket ends at the slowest recording.
+func (h *histogram) percentile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	seen := 0.0
+	for i, count := range h.buckets {
+		if count == 0 || seen+float64(count) < rank {
+			seen += float64(count)
+			continue
+		}
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = bucketBounds[i-1]
+		}
+		upper := h.max
+		if i < len(bucketBounds) {
+			upper = min(bucketBounds[i], h.max)
+		}
+		fraction := (rank - seen) / float64(count)
+		return milliseconds(lower) + fraction*milliseconds(upper-lower)
+	}
+	return milliseconds(h.max)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,169 @@
+package ldap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// BER tags used by LDAP (RFC 4511)
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	// Application tags of the operations
+	appBindRequest     = 0x60
+	appBindResponse    = 0x61
+	appUnbindRequest   = 0x42
+	appSearchRequest   = 0x63
+	appSearchEntry     = 0x64
+	appSearchDone      = 0x65
+	appSearchReference = 0x73
+)
+
+// Largest message read, bounding what a misbehaving server can make us
+// allocate
+const maxMessageSize = 16 << 20
+
+// element is one decoded BER value. Constructed values are parsed into
+// children on demand.
+type element struct {
+	tag   byte
+	value []byte
+}
+
+// encode writes a tag, length and value
+func encode(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+func encodeConstructed(tag byte, children ...[]byte) []byte {
+	var value []byte
+	for _, child := range children {
+		value = append(value, child...)
+	}
+	return encode(tag, value)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+// encodeInt writes a non-negative integer in the fewest octets
+func encodeInt(tag byte, n int) []byte {
+	var value []byte
+	for {
+		value = append([]byte{byte(n)}, value...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	if value[0]&0x80 != 0 {
+		value = append([]byte{0}, value...)
+	}
+	return encode(tag, value)
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0})
+}
+
+// readElement reads one element from a stream
+func readElement(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+
+	length := int(first)
+	if first&0x80 != 0 {
+		octets := int(first & 0x7f)
+		if octets == 0 || octets > 4 {
+			return element{}, fmt.Errorf("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < octets; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return element{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return element{}, fmt.Errorf("LDAP message of %d bytes is too large", length)
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return element{}, err
+	}
+	return element{tag: tag, value: value}, nil
+}
+
+// children parses the elements inside a constructed element
+func (e element) children() ([]element, error) {
+	var children []element
+	data := e.value
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated BER element")
+		}
+		tag, first := data[0], data[1]
+		data = data[2:]
+
+		length := int(first)
+		if first&0x80 != 0 {
+			octets := int(first & 0x7f)
+			if octets == 0 || octets > 4 || len(data) < octets {
+				return nil, fmt.Errorf("invalid BER length")
+			}
+			length = 0
+			for _, b := range data[:octets] {
+				length = length<<8 | int(b)
+			}
+			data = data[octets:]
+		}
+		if length > len(data) {
+			return nil, fmt.Errorf("truncated BER element")
+		}
+		children = append(children, element{tag: tag, value: data[:length]})
+		data = data[length:]
+	}
+	return children, nil
+}
+
+// int decodes an integer or enumerated value
+func (e element) int() int {
+	n := 0
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
@@ -0,0 +1,195 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Context tags of search filter choices (RFC 4511 section 4.5.1)
+const (
+	filterAnd       = 0xa0
+	filterOr        = 0xa1
+	filterNot       = 0xa2
+	filterEquality  = 0xa3
+	filterSubstring = 0xa4
+	filterGreater   = 0xa5
+	filterLess      = 0xa6
+	filterPresent   = 0x87
+	filterApprox    = 0xa8
+
+	substringInitial = 0x80
+	substringAny     = 0x81
+	substringFinal   = 0x82
+)
+
+// EscapeFilter escapes a value for use in a search filter (RFC 4515)
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter encodes a string search filter such as
+// (&(objectClass=person)(uid=jo*)) as BER
+func compileFilter(filter string) ([]byte, error) {
+	p := &filterParser{input: filter}
+	encoded, err := p.filter()
+	if err != nil {
+		return nil, fmt.Errorf("invalid search filter %q: %w", filter, err)
+	}
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("invalid search filter %q: trailing characters", filter)
+	}
+	return encoded, nil
+}
+
+type filterParser struct {
+	input string
+	pos   int
+}
+
+func (p *filterParser) filter() ([]byte, error) {
+	if p.pos >= len(p.input) || p.input[p.pos] != '(' {
+		return nil, fmt.Errorf("expected ( at %d", p.pos)
+	}
+	p.pos++
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+
+	var encoded []byte
+	var err error
+	switch p.input[p.pos] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if p.input[p.pos] == '|' {
+			tag = filterOr
+		}
+		p.pos++
+		var children [][]byte
+		for p.pos < len(p.input) && p.input[p.pos] == '(' {
+			child, err := p.filter()
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child)
+		}
+		encoded = encodeConstructed(tag, children...)
+	case '!':
+		p.pos++
+		child, err := p.filter()
+		if err != nil {
+			return nil, err
+		}
+		encoded = encodeConstructed(filterNot, child)
+	default:
+		encoded, err = p.item()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+		return nil, fmt.Errorf("expected ) at %d", p.pos)
+	}
+	p.pos++
+	return encoded, nil
+}
+
+// item parses attr=value, attr>=value, attr<=value and attr~=value, with
+// attr=* testing presence and * in a value matching substrings
+func (p *filterParser) item() ([]byte, error) {
+	end := strings.IndexByte(p.input[p.pos:], ')')
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated item")
+	}
+	item := p.input[p.pos : p.pos+end]
+	p.pos += end
+
+	i := strings.IndexByte(item, '=')
+	if i < 1 {
+		return nil, fmt.Errorf("invalid item %q", item)
+	}
+	attr, value := item[:i], item[i+1:]
+
+	tag := byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag = filterGreater
+	case '<':
+		tag = filterLess
+	case '~':
+		tag = filterApprox
+	}
+	if tag != filterEquality {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("invalid item %q", item)
+	}
+
+	if tag == filterEquality && value == "*" {
+		return encodeString(filterPresent, attr), nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var substrings [][]byte
+		for j, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := unescapeFilter(part)
+			if err != nil {
+				return nil, err
+			}
+			partTag := byte(substringAny)
+			switch j {
+			case 0:
+				partTag = substringInitial
+			case len(parts) - 1:
+				partTag = substringFinal
+			}
+			substrings = append(substrings, encodeString(partTag, unescaped))
+		}
+		return encodeConstructed(filterSubstring, encodeString(tagOctetString, attr),
+			encodeConstructed(tagSequence, substrings...)), nil
+	}
+
+	unescaped, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	return encodeConstructed(tag, encodeString(tagOctetString, attr), encodeString(tagOctetString, unescaped)), nil
+}
+
+// unescapeFilter decodes the \XX escapes of a filter value
+func unescapeFilter(value string) (string, error) {
+	if !strings.Contains(value, "\\") {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("truncated escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
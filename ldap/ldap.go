@@ -0,0 +1,342 @@
+// Package ldap looks up the groups of users in an LDAP directory, such as
+// OpenLDAP, Active Directory, FreeIPA or lldap, with a simple bind and a
+// search. Access is read-only.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time allowed for one lookup, connecting included
+const lookupTimeout = 10 * time.Second
+
+// Config for a directory
+type Config struct {
+	// ldaps://host:636, or ldap://host:389 which sends the bind password
+	// unencrypted and is only fit for a directory on the same host
+	URL string
+
+	// Account the directory is searched as, anonymous when BindDN is empty
+	BindDN       string
+	BindPassword string
+
+	// Subtree users and groups are searched in, e.g. dc=example,dc=com
+	BaseDN string
+
+	// Finds a user's entry, {user} standing for the user name. Defaults
+	// to (uid={user}); Active Directory would use (sAMAccountName={user})
+	// or (userPrincipalName={user}).
+	UserFilter string
+
+	// Attribute of the user's entry listing their groups, memberOf when
+	// empty
+	GroupAttribute string
+
+	// Finds group entries listing the user instead, {dn} standing for the
+	// user's DN and {user} for the name, e.g.
+	// (&(objectClass=groupOfNames)(member={dn})). Their cn is the group.
+	GroupFilter string
+
+	// Certificates trusted for ldaps:// instead of the system pool
+	RootCAs *x509.CertPool
+}
+
+// Client looks up users in one directory, connecting for each lookup
+type Client struct {
+	config Config
+	addr   string
+	tls    *tls.Config
+}
+
+// New creates a client for the configured directory
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q", cfg.URL)
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid={user})"
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	if _, err := compileFilter(strings.ReplaceAll(cfg.UserFilter, "{user}", "x")); err != nil {
+		return nil, err
+	}
+
+	c := &Client{config: cfg, addr: u.Host}
+	switch u.Scheme {
+	case "ldaps":
+		c.tls = &tls.Config{ServerName: u.Hostname(), RootCAs: cfg.RootCAs}
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "636")
+		}
+	case "ldap":
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported LDAP scheme %q, expected ldaps or ldap", u.Scheme)
+	}
+	return c, nil
+}
+
+// Groups returns the groups a user belongs to: the values of the group
+// attribute or the cn of the entries matching the group filter. For values
+// that are DNs the first RDN's value is returned too, so
+// cn=admins,ou=groups,dc=example,dc=com also reads as admins. A user
+// missing from the directory has no groups.
+func (c *Client) Groups(ctx context.Context, user string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if err := conn.bind(c.config.BindDN, c.config.BindPassword); err != nil {
+		return nil, err
+	}
+
+	escaped := EscapeFilter(user)
+	filter := strings.ReplaceAll(c.config.UserFilter, "{user}", escaped)
+	users, err := conn.search(c.config.BaseDN, filter, []string{c.config.GroupAttribute}, 2)
+	if err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("user filter matches more than one entry for %q", user)
+	}
+
+	values := users[0].attributes[strings.ToLower(c.config.GroupAttribute)]
+	if c.config.GroupFilter != "" {
+		filter := strings.ReplaceAll(c.config.GroupFilter, "{dn}", EscapeFilter(users[0].dn))
+		filter = strings.ReplaceAll(filter, "{user}", escaped)
+		groups, err := conn.search(c.config.BaseDN, filter, []string{"cn"}, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			values = append(values, group.dn)
+			values = append(values, group.attributes["cn"]...)
+		}
+	}
+
+	groups := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		groups = append(groups, value)
+		if name, ok := firstRDN(value); ok {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// firstRDN returns the value of a DN's first relative name, e.g. admins
+// for cn=admins,ou=groups
+func firstRDN(dn string) (string, bool) {
+	rdn, rest, found := strings.Cut(dn, ",")
+	_, value, ok := strings.Cut(rdn, "=")
+	if !ok || !found || rest == "" || strings.Contains(rdn, "\\") {
+		return "", false
+	}
+	return strings.TrimSpace(value), true
+}
+
+// conn is one connection to the directory
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	id     int
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := &net.Dialer{}
+	var nc net.Conn
+	var err error
+	if c.tls != nil {
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP directory: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	return &conn{Conn: nc, reader: bufio.NewReader(nc)}, nil
+}
+
+// send writes an operation in a new message, returning its ID
+func (c *conn) send(op []byte) (int, error) {
+	c.id++
+	message := encodeConstructed(tagSequence, encodeInt(tagInteger, c.id), op)
+	if _, err := c.Write(message); err != nil {
+		return 0, fmt.Errorf("failed to write to LDAP directory: %w", err)
+	}
+	return c.id, nil
+}
+
+// receive reads the next operation answering message id
+func (c *conn) receive(id int) (element, error) {
+	for {
+		message, err := readElement(c.reader)
+		if err != nil {
+			return element{}, fmt.Errorf("failed to read from LDAP directory: %w", err)
+		}
+		parts, err := message.children()
+		if err != nil || message.tag != tagSequence || len(parts) < 2 {
+			return element{}, fmt.Errorf("malformed LDAP message")
+		}
+		// Unsolicited notifications have ID 0, e.g. before a disconnect
+		if parts[0].int() == id {
+			return parts[1], nil
+		}
+	}
+}
+
+func (c *conn) bind(dn, password string) error {
+	op := encodeConstructed(appBindRequest,
+		encodeInt(tagInteger, 3),
+		encodeString(tagOctetString, dn),
+		encodeString(0x80, password))
+	id, err := c.send(op)
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if response.tag != appBindResponse {
+		return fmt.Errorf("unexpected LDAP response to bind")
+	}
+	if err := result(response); err != nil {
+		return fmt.Errorf("LDAP bind failed: %w", err)
+	}
+	return nil
+}
+
+// entry is a search result, attribute names lowercased
+type entry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// search finds the entries matching filter below base, at most limit of
+// them unless limit is zero
+func (c *conn) search(base, filter string, attributes []string, limit int) ([]entry, error) {
+	compiled, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([][]byte, 0, len(attributes))
+	for _, attr := range attributes {
+		attrs = append(attrs, encodeString(tagOctetString, attr))
+	}
+	op := encodeConstructed(appSearchRequest,
+		encodeString(tagOctetString, base),
+		encodeInt(tagEnumerated, 2), // whole subtree
+		encodeInt(tagEnumerated, 0), // never dereference aliases
+		encodeInt(tagInteger, limit),
+		encodeInt(tagInteger, int(lookupTimeout/time.Second)),
+		encodeBool(false),
+		compiled,
+		encodeConstructed(tagSequence, attrs...))
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]entry, 0)
+	for {
+		response, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch response.tag {
+		case appSearchEntry:
+			found, err := parseEntry(response)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, found)
+		case appSearchReference:
+			// Referrals to other servers are not followed
+		case appSearchDone:
+			if err := result(response); err != nil {
+				// Reaching the limit still returns the entries found
+				if limit > 0 && len(entries) >= limit {
+					return entries, nil
+				}
+				return nil, fmt.Errorf("LDAP search failed: %w", err)
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response to search")
+		}
+	}
+}
+
+func parseEntry(e element) (entry, error) {
+	parts, err := e.children()
+	if err != nil || len(parts) < 2 {
+		return entry{}, fmt.Errorf("malformed LDAP search entry")
+	}
+	found := entry{dn: string(parts[0].value), attributes: make(map[string][]string)}
+	attributes, err := parts[1].children()
+	if err != nil {
+		return entry{}, fmt.Errorf("malformed LDAP search entry")
+	}
+	for _, attribute := range attributes {
+		fields, err := attribute.children()
+		if err != nil || len(fields) < 2 {
+			return entry{}, fmt.Errorf("malformed LDAP attribute")
+		}
+		values, err := fields[1].children()
+		if err != nil {
+			return entry{}, fmt.Errorf("malformed LDAP attribute")
+		}
+		name := strings.ToLower(string(fields[0].value))
+		for _, value := range values {
+			found.attributes[name] = append(found.attributes[name], string(value.value))
+		}
+	}
+	return found, nil
+}
+
+// result turns an LDAPResult that is not a success into an error
+func result(e element) error {
+	parts, err := e.children()
+	if err != nil || len(parts) < 3 {
+		return fmt.Errorf("malformed LDAP result")
+	}
+	code := parts[0].int()
+	if code == 0 {
+		return nil
+	}
+	if message := string(parts[2].value); message != "" {
+		return fmt.Errorf("result code %d: %s", code, message)
+	}
+	return fmt.Errorf("result code %d", code)
+}
+
+func (c *conn) close() {
+	c.send(encode(appUnbindRequest, nil))
+	c.Close()
+}
@@ -0,0 +1,320 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompileFilter(t *testing.T) {
+	str := func(s string) []byte { return encodeString(tagOctetString, s) }
+	equality := func(attr, value string) []byte { return encodeConstructed(filterEquality, str(attr), str(value)) }
+
+	tests := []struct {
+		filter string
+		want   []byte
+	}{
+		{"(uid=jo)", equality("uid", "jo")},
+		{"(uid=*)", encodeString(filterPresent, "uid")},
+		{"(uid=\\2a)", equality("uid", "*")},
+		{"(cn=a\\28b\\29)", equality("cn", "a(b)")},
+		{"(age>=21)", encodeConstructed(filterGreater, str("age"), str("21"))},
+		{"(age<=65)", encodeConstructed(filterLess, str("age"), str("65"))},
+		{"(cn~=jo)", encodeConstructed(filterApprox, str("cn"), str("jo"))},
+		{"(cn=jo*)", encodeConstructed(filterSubstring, str("cn"), encodeConstructed(tagSequence, encodeString(substringInitial, "jo")))},
+		{"(cn=*o*e*)", encodeConstructed(filterSubstring, str("cn"), encodeConstructed(tagSequence, encodeString(substringAny, "o"), encodeString(substringAny, "e")))},
+		{"(cn=j*e)", encodeConstructed(filterSubstring, str("cn"), encodeConstructed(tagSequence, encodeString(substringInitial, "j"), encodeString(substringFinal, "e")))},
+		{"(&(objectClass=person)(uid=jo))", encodeConstructed(filterAnd, equality("objectClass", "person"), equality("uid", "jo"))},
+		{"(|(uid=jo)(!(uid=al)))", encodeConstructed(filterOr, equality("uid", "jo"), encodeConstructed(filterNot, equality("uid", "al")))},
+	}
+	for _, tt := range tests {
+		got, err := compileFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, filter := range []string{
+		"", "uid=jo", "(uid=jo", "(uid=jo))", "(=jo)", "(>=jo)", "(uid)", "(&(uid=jo)", "(!uid=jo)",
+		"(uid=\\2)", "(uid=\\zz)", "(uid=jo)(uid=al)",
+	} {
+		if encoded, err := compileFilter(filter); err == nil {
+			t.Errorf("%q compiled to % x", filter, encoded)
+		}
+	}
+}
+
+// Escaped user names match themselves and cannot change the filter
+func TestEscapeFilter(t *testing.T) {
+	for _, name := range []string{"jo", "*", "jo)(uid=*", "a\\b", "nul\x00", "(&)"} {
+		filter := "(uid=" + EscapeFilter(name) + ")"
+		got, err := compileFilter(filter)
+		if err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+		want := encodeConstructed(filterEquality, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, name))
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q: filter %s is not an equality match of the name", name, filter)
+		}
+	}
+}
+
+func TestBER(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 24, 1<<31 - 1} {
+		encoded := encodeInt(tagInteger, n)
+		e, err := readElement(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if e.tag != tagInteger || e.int() != n {
+			t.Errorf("%d: decoded tag %#x value %d", n, e.tag, e.int())
+		}
+	}
+	if got := (element{value: []byte{0xff}}).int(); got != -1 {
+		t.Errorf("0xff decoded to %d, want -1", got)
+	}
+
+	// Lengths in the short and each long form
+	for _, size := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000} {
+		value := bytes.Repeat([]byte{'x'}, size)
+		encoded := encodeConstructed(tagSequence, encode(tagOctetString, value), encodeBool(true))
+		e, err := readElement(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		children, err := e.children()
+		if err != nil || len(children) != 2 || !bytes.Equal(children[0].value, value) || children[1].value[0] != 0xff {
+			t.Errorf("%d bytes: got children %v, %v", size, len(children), err)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"indefinite length": {tagSequence, 0x80},
+		"5 length octets":   {tagSequence, 0x85, 0, 0, 0, 0, 1},
+		"past the limit":    {tagSequence, 0x84, 0x01, 0x00, 0x00, 0x01},
+		"truncated value":   {tagSequence, 0x03, 1, 2},
+		"truncated length":  {tagSequence, 0x82, 1},
+	} {
+		if e, err := readElement(bufio.NewReader(bytes.NewReader(data))); err == nil {
+			t.Errorf("%s: read %+v", name, e)
+		}
+	}
+	for name, value := range map[string][]byte{
+		"truncated child":  {tagInteger, 2, 1},
+		"lone tag":         {tagInteger},
+		"truncated length": {tagOctetString, 0x82, 1},
+	} {
+		if children, err := (element{tag: tagSequence, value: value}).children(); err == nil {
+			t.Errorf("%s: parsed %+v", name, children)
+		}
+	}
+}
+
+func TestFirstRDN(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want string
+	}{
+		{"cn=admins,ou=groups,dc=example,dc=com", "admins"},
+		{"CN=Domain Admins,CN=Users,DC=corp,DC=example", "Domain Admins"},
+		{"admins", ""},
+		{"cn=admins", ""},
+		{"cn=a\\,b,ou=groups", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := firstRDN(tt.dn); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
+
+// directory is an LDAP server answering searches by their filter, with
+// the entries listed for it. Other filters fail the search.
+type directory struct {
+	t        *testing.T
+	password string
+	entries  map[string][]entry
+	addr     string
+}
+
+func newDirectory(t *testing.T, password string, entries map[string][]entry) *directory {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	d := &directory{t: t, password: password, entries: entries, addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *directory) serve(conn net.Conn) {
+	defer conn.Close()
+	filters := make(map[string][]entry)
+	for filter, entries := range d.entries {
+		compiled, err := compileFilter(filter)
+		if err != nil {
+			d.t.Errorf("directory filter %s: %v", filter, err)
+			return
+		}
+		filters[string(compiled)] = entries
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := readElement(reader)
+		if err != nil {
+			return
+		}
+		parts, err := message.children()
+		if err != nil || len(parts) < 2 {
+			d.t.Errorf("malformed message from client")
+			return
+		}
+		id, op := parts[0].int(), parts[1]
+		fields, _ := op.children()
+		reply := func(ops ...[]byte) {
+			for _, op := range ops {
+				conn.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, id), op))
+			}
+		}
+		done := func(tag byte, code int, message string) []byte {
+			return encodeConstructed(tag, encodeInt(tagEnumerated, code), encodeString(tagOctetString, ""), encodeString(tagOctetString, message))
+		}
+
+		switch op.tag {
+		case appBindRequest:
+			if len(fields) != 3 || string(fields[2].value) != d.password {
+				reply(done(appBindResponse, 49, "invalid credentials"))
+				continue
+			}
+			reply(done(appBindResponse, 0, ""))
+		case appSearchRequest:
+			if len(fields) != 8 {
+				d.t.Errorf("search request of %d fields", len(fields))
+				return
+			}
+			filter := encode(fields[6].tag, fields[6].value)
+			entries, ok := filters[string(filter)]
+			if !ok {
+				reply(done(appSearchDone, 1, "unexpected filter"))
+				continue
+			}
+			// Unsolicited notice of another message ID, ignored by clients
+			conn.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, 0), done(appSearchDone, 0, "")))
+			reply(encodeConstructed(appSearchReference, encodeString(tagOctetString, "ldap://elsewhere.example.com/")))
+			for _, found := range entries {
+				var attributes [][]byte
+				for name, values := range found.attributes {
+					var encoded [][]byte
+					for _, value := range values {
+						encoded = append(encoded, encodeString(tagOctetString, value))
+					}
+					attributes = append(attributes, encodeConstructed(tagSequence, encodeString(tagOctetString, name), encodeConstructed(tagSet, encoded...)))
+				}
+				reply(encodeConstructed(appSearchEntry, encodeString(tagOctetString, found.dn), encodeConstructed(tagSequence, attributes...)))
+			}
+			reply(done(appSearchDone, 0, ""))
+		case appUnbindRequest:
+			return
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	jo := entry{dn: "uid=jo,ou=people,dc=example,dc=com", attributes: map[string][]string{
+		"memberOf": {"cn=admins,ou=groups,dc=example,dc=com", "kitchen"},
+	}}
+	d := newDirectory(t, "secret", map[string][]entry{
+		"(uid=jo)":   {jo},
+		"(uid=\\2a)": {},
+		"(uid=twin)": {jo, jo},
+		"(&(objectClass=groupOfNames)(member=uid=jo,ou=people,dc=example,dc=com))": {
+			{dn: "cn=ops,ou=groups,dc=example,dc=com", attributes: map[string][]string{"cn": {"ops"}}},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		config Config
+		user   string
+		want   []string
+		ok     bool
+	}{
+		{"member attribute", Config{}, "jo", []string{"cn=admins,ou=groups,dc=example,dc=com", "admins", "kitchen"}, true},
+		{"group filter", Config{GroupFilter: "(&(objectClass=groupOfNames)(member={dn}))"}, "jo",
+			[]string{"cn=admins,ou=groups,dc=example,dc=com", "admins", "kitchen", "cn=ops,ou=groups,dc=example,dc=com", "ops", "ops"}, true},
+		{"missing user, name escaped", Config{}, "*", nil, true},
+		{"several entries", Config{UserFilter: "(uid=twin)"}, "", nil, false},
+		{"unknown filter", Config{UserFilter: "(mail={user})"}, "jo", nil, false},
+		{"wrong password", Config{BindPassword: "guess"}, "jo", nil, false},
+	}
+	for _, tt := range tests {
+		cfg := tt.config
+		cfg.URL = "ldap://" + d.addr
+		cfg.BindDN = "cn=libas,dc=example,dc=com"
+		if cfg.BindPassword == "" {
+			cfg.BindPassword = "secret"
+		}
+		c, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups, err := c.Groups(context.Background(), tt.user)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !tt.ok && err == nil:
+			t.Errorf("%s: got groups %q, want an error", tt.name, groups)
+		case tt.ok && !slices.Equal(groups, tt.want):
+			t.Errorf("%s: got groups %q, want %q", tt.name, groups, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, tt := range []struct {
+		url  string
+		addr string
+	}{
+		{"ldaps://ldap.example.com", "ldap.example.com:636"},
+		{"ldap://ldap.example.com", "ldap.example.com:389"},
+		{"ldaps://ldap.example.com:3269", "ldap.example.com:3269"},
+	} {
+		c, err := New(Config{URL: tt.url})
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || (c.tls != nil) != strings.HasPrefix(tt.url, "ldaps") {
+			t.Errorf("%s: connects to %s, TLS %v", tt.url, c.addr, c.tls != nil)
+		}
+	}
+	for _, cfg := range []Config{
+		{URL: "ldap.example.com"},
+		{URL: "http://ldap.example.com"},
+		{URL: "ldaps://ldap.example.com", UserFilter: "(uid={user}"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("accepted %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Package leader elects which of a pair of libas servers sharing their
+// recordings runs, through a lease in a file on the shared storage or in
+// Redis. The standby waits for the lease to expire and takes over once the
+// primary stops renewing it.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Lease length when Config leaves it zero
+	defaultLease = 30 * time.Second
+
+	// Time the hook may take
+	hookTimeout = 30 * time.Second
+)
+
+// Config of an election
+type Config struct {
+	// Where the lease is kept: a file path on storage both servers share,
+	// e.g. /srv/recordings/leader.lease, or a redis:// or rediss:// URL
+	Lock string
+
+	// Name the lease is held under, unique to each server
+	Name string
+
+	// How long the lease lasts without being renewed, defaults to 30
+	// seconds. It is renewed every third of it; the standby takes over
+	// within a lease of the primary failing.
+	Lease time.Duration
+
+	// Command run with "primary" appended once the lease is taken and with
+	// "standby" once it is given up, e.g. to move a virtual IP
+	Hook string
+}
+
+// lock keeps the lease
+type lock interface {
+	// claim takes or renews the lease for holder unless another holds
+	// it, returning who holds it
+	claim(ctx context.Context, holder string, lease time.Duration) (string, error)
+
+	// release gives the lease up if holder holds it
+	release(ctx context.Context, holder string) error
+
+	// holder returns who holds the lease, empty when nobody does
+	holder(ctx context.Context) (string, error)
+}
+
+// Elector takes the lease and holds it
+type Elector struct {
+	config Config
+	lock   lock
+
+	mu   sync.Mutex
+	stop context.CancelFunc
+	done chan struct{}
+	lost chan struct{}
+}
+
+// New creates an elector for the configured lock
+func New(cfg Config) (*Elector, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("a leader election needs the name of this server")
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = defaultLease
+	}
+	if cfg.Lease < 3*time.Second {
+		return nil, fmt.Errorf("leader lease must be at least 3s")
+	}
+	var l lock
+	var err error
+	if strings.HasPrefix(cfg.Lock, "redis://") || strings.HasPrefix(cfg.Lock, "rediss://") {
+		l, err = newRedisLock(cfg.Lock)
+	} else if cfg.Lock != "" {
+		l = fileLock{path: cfg.Lock}
+	} else {
+		err = fmt.Errorf("a leader election needs a lock")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Elector{config: cfg, lock: l, lost: make(chan struct{})}, nil
+}
+
+// Name returns the name the lease is held under
+func (e *Elector) Name() string {
+	return e.config.Name
+}
+
+// Holder returns who holds the lease, empty when nobody does
+func (e *Elector) Holder(ctx context.Context) (string, error) {
+	return e.lock.holder(ctx)
+}
+
+// Campaign blocks until this server holds the lease or ctx ends, then
+// runs the hook and keeps renewing the lease until Resign. Lost is closed
+// if the lease is lost meanwhile.
+func (e *Elector) Campaign(ctx context.Context) error {
+	interval := e.config.Lease / 3
+	standingBy := ""
+	for {
+		holder, err := e.lock.claim(ctx, e.config.Name, e.config.Lease)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			slog.Warn("Failed to claim leader lease", "error", err, "lock", e.config.Lock)
+		case err == nil && holder == e.config.Name:
+			slog.Info("Took leader lease", "name", e.config.Name, "lock", e.config.Lock)
+			e.runHook(ctx, "primary")
+			e.hold(interval)
+			return nil
+		case err == nil && holder != standingBy:
+			slog.Info("Standing by while another server holds the leader lease", "leader", holder, "lock", e.config.Lock)
+			standingBy = holder
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// hold renews the lease in the background until Resign
+func (e *Elector) hold(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	e.mu.Lock()
+	e.stop, e.done = cancel, done
+	e.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		renewed := time.Now()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			holder, err := e.lock.claim(ctx, e.config.Name, e.config.Lease)
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case err == nil && holder == e.config.Name:
+				renewed = time.Now()
+				continue
+			case err == nil:
+				slog.Error("Leader lease taken over", "leader", holder, "lock", e.config.Lock)
+			case time.Since(renewed) < e.config.Lease/2:
+				slog.Warn("Failed to renew leader lease", "error", err, "lock", e.config.Lock)
+				continue
+			default:
+				// Gives up before the standby can take over
+				slog.Error("Failed to renew leader lease, giving it up", "error", err, "lock", e.config.Lock)
+			}
+			close(e.lost)
+			return
+		}
+	}()
+}
+
+// Lost is closed when the lease held is lost to another server or can no
+// longer be renewed
+func (e *Elector) Lost() <-chan struct{} {
+	return e.lost
+}
+
+// Resign stops renewing the lease, gives it up and runs the hook
+func (e *Elector) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	stop, done := e.stop, e.done
+	e.stop = nil
+	e.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	stop()
+	<-done
+
+	err := e.lock.release(ctx, e.config.Name)
+	if err != nil {
+		err = fmt.Errorf("failed to release leader lease: %w", err)
+	}
+	e.runHook(ctx, "standby")
+	slog.Info("Gave up leader lease", "name", e.config.Name)
+	return err
+}
+
+// runHook runs the hook command for a role, logging failures
+func (e *Elector) runHook(ctx context.Context, role string) {
+	args := strings.Fields(e.config.Hook)
+	if len(args) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], role)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		slog.Error("Leader hook failed", "error", err, "role", role, "command", e.config.Hook)
+	}
+}
@@ -0,0 +1,154 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bosley/libas/redis"
+)
+
+// Key the lease is kept under in Redis
+const redisKey = "libas:leader"
+
+// fileLease is the content of a lease file
+type fileLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// fileLock keeps the lease in a file on shared storage. The clocks of the
+// servers must agree, e.g. through NTP.
+type fileLock struct {
+	path string
+}
+
+func (l fileLock) read() (fileLease, error) {
+	var lease fileLease
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, fmt.Errorf("failed to read lease: %w", err)
+	}
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return lease, fmt.Errorf("failed to parse lease: %w", err)
+	}
+	return lease, nil
+}
+
+func (l fileLock) claim(ctx context.Context, holder string, lease time.Duration) (string, error) {
+	current, err := l.read()
+	if err != nil {
+		return "", err
+	}
+	if current.Holder != "" && current.Holder != holder && time.Now().Before(current.Expires) {
+		return current.Holder, nil
+	}
+
+	data, err := json.Marshal(fileLease{Holder: holder, Expires: time.Now().Add(lease)})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal lease: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to write lease: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write lease: %w", err)
+	}
+
+	// Of two servers claiming an expired lease at once the last rename
+	// wins, so the lease is only taken once it reads back
+	if current.Holder != holder {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if current, err = l.read(); err != nil {
+			return "", err
+		}
+		return current.Holder, nil
+	}
+	return holder, nil
+}
+
+func (l fileLock) release(ctx context.Context, holder string) error {
+	current, err := l.read()
+	if err != nil || current.Holder != holder {
+		return err
+	}
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lease: %w", err)
+	}
+	return nil
+}
+
+func (l fileLock) holder(ctx context.Context) (string, error) {
+	current, err := l.read()
+	if err != nil || time.Now().After(current.Expires) {
+		return "", err
+	}
+	return current.Holder, nil
+}
+
+// Scripts claiming and releasing the lease atomically
+const (
+	redisClaim = `local v = redis.call("GET", KEYS[1])
+if v == false or v == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return ARGV[1]
+end
+return v`
+
+	redisRelease = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+)
+
+// redisLock keeps the lease in a Redis key expiring with it
+type redisLock struct {
+	client *redis.Client
+}
+
+func newRedisLock(rawURL string) (redisLock, error) {
+	client, err := redis.New(rawURL, nil)
+	if err != nil {
+		return redisLock{}, err
+	}
+	return redisLock{client: client}, nil
+}
+
+func (l redisLock) claim(ctx context.Context, holder string, lease time.Duration) (string, error) {
+	reply, err := l.client.Do(ctx, "EVAL", redisClaim, 1, redisKey, holder, lease.Milliseconds())
+	if err != nil {
+		return "", err
+	}
+	current, _ := reply.([]byte)
+	return string(current), nil
+}
+
+func (l redisLock) release(ctx context.Context, holder string) error {
+	_, err := l.client.Do(ctx, "EVAL", redisRelease, 1, redisKey, holder)
+	return err
+}
+
+func (l redisLock) holder(ctx context.Context) (string, error) {
+	reply, err := l.client.Do(ctx, "GET", redisKey)
+	current, _ := reply.([]byte)
+	return string(current), err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/loadgen"
+	"github.com/bosley/libas/scribeclient"
+)
+
+// runLoadgen streams speech from simulated clients to a server and prints
+// how it held up
+func runLoadgen(args []string) error {
+	fs := newFlagSet("loadgen")
+	serverAddr := fs.String("server", "localhost:8443", "Server address (host:port)")
+	insecureMode := fs.Bool("insecure", false, "Skip certificate verification of the server and scribe")
+	certFile := fs.String("cert", "", "Certificate to trust for the server and scribe (required unless -insecure)")
+	clients := fs.Int("clients", 10, "Number of simulated clients")
+	duration := fs.Duration("duration", time.Minute, "How long the clients stream")
+	fixtures := fs.String("fixtures", "", "Comma separated audio files or directories of WAV and FLAC files the clients play, synthetic speech if empty")
+	sampleRate := fs.Int("sample-rate", audio.WhisperSampleRate, "Capture rate the clients ask for, 16000 or 44100")
+	pause := fs.Duration("pause", 2*time.Second, "Silence between a client's transmissions, at least 1s")
+	recordingsDir := fs.String("recordings", "", "Recordings directory of the server, to check the recordings against what was sent")
+	scribeURL := fs.String("scribe", "", "Base URL of the scribe HTTP API, to measure transcription latency")
+	idToken := fs.String("id-token", "", "ID token for scribes requiring sign-in, better set with LIBAS_ID_TOKEN")
+	settle := fs.Duration("settle", 30*time.Second, "How long to wait after streaming for recordings and transcriptions")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	cfg, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *clients <= 0 {
+		return usageError(fs, "-clients must be at least 1")
+	}
+	if *sampleRate != audio.WhisperSampleRate && *sampleRate != audio.RecordingSampleRate {
+		return usageError(fs, "-sample-rate must be %d or %d", audio.WhisperSampleRate, audio.RecordingSampleRate)
+	}
+	if !*insecureMode && *certFile == "" {
+		return usageError(fs, "server certificate file must be provided when not in insecure mode")
+	}
+
+	token, err := requireToken(cfg, fs.Name())
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecureMode}
+	if !*insecureMode {
+		pem, err := os.ReadFile(*certFile)
+		if err != nil {
+			return fmt.Errorf("failed to read certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", *certFile)
+		}
+	}
+
+	fixturePCM, err := loadgen.ReadFixtures(splitList(*fixtures))
+	if err != nil {
+		return err
+	}
+
+	var scribe *scribeclient.Client
+	if *scribeURL != "" {
+		scribe, err = scribeclient.New(scribeclient.Config{
+			BaseURL:            *scribeURL,
+			InsecureSkipVerify: *insecureMode,
+			RootCAs:            tlsConfig.RootCAs,
+			BearerToken:        *idToken,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	report, err := loadgen.Run(ctx, loadgen.Config{
+		ServerAddr:    *serverAddr,
+		TLS:           tlsConfig,
+		Token:         token,
+		Clients:       *clients,
+		Duration:      *duration,
+		Fixtures:      fixturePCM,
+		SampleRate:    *sampleRate,
+		Pause:         *pause,
+		RecordingsDir: *recordingsDir,
+		Scribe:        scribe,
+		Settle:        *settle,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	report.Print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,184 @@
+package loadgen
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/protocol"
+)
+
+const formatReplyTimeout = 3 * time.Second
+
+// Conn is a connection to a server speaking the capture protocol, for
+// streaming audio that does not come from a microphone
+type Conn struct {
+	net.Conn
+
+	// Assigned by the server
+	ClientID string
+
+	// Rate the server accepted, audio must be sent at it
+	SampleRate int
+}
+
+// Dial connects and authenticates to a server, asking for 16kHz capture
+// when sampleRate is 16000. Servers declining it are sent 44.1kHz.
+func Dial(ctx context.Context, addr string, tlsConfig *tls.Config, token string, sampleRate int) (*Conn, error) {
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+
+	if err := protocol.NewClientEncoder(conn).Token(token); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send token to server: %w", err)
+	}
+	id, err := protocol.NewServerDecoder(conn).ClientID()
+	if err != nil {
+		conn.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: server closed the connection after the token, check that it matches", fault.ErrAuthFailed)
+		}
+		return nil, fmt.Errorf("failed to receive client ID: %w", err)
+	}
+
+	c := &Conn{Conn: conn, ClientID: id.String(), SampleRate: audio.RecordingSampleRate}
+	if sampleRate == audio.WhisperSampleRate {
+		c.SampleRate = c.negotiate()
+	}
+
+	// The server may send settings, which are not acted on
+	go io.Copy(io.Discard, conn)
+	return c, nil
+}
+
+// negotiate asks the server to accept 16kHz, falling back to 44.1kHz
+func (c *Conn) negotiate() int {
+	if err := protocol.NewClientEncoder(c).Format(audio.WhisperSampleRate); err != nil {
+		return audio.RecordingSampleRate
+	}
+
+	c.SetReadDeadline(time.Now().Add(formatReplyTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	rate, err := protocol.NewServerDecoder(c).FormatReply()
+	if err != nil || rate != audio.WhisperSampleRate {
+		return audio.RecordingSampleRate
+	}
+	return audio.WhisperSampleRate
+}
+
+// Transmit sends samples at the connection's rate as one transmission,
+// returning how many samples were sent and how many chunks were dropped.
+// Chunks are due when a microphone would have captured them, one more than
+// a chunk late is dropped as a capture client would lose it to an overrun.
+func (c *Conn) Transmit(samples []int16) (sent, dropped int, err error) {
+	if _, err := c.Write(protocol.AppendMarker(nil, protocol.Start)); err != nil {
+		return 0, 0, err
+	}
+
+	chunkDuration := time.Duration(framesPerBuffer) * time.Second / time.Duration(c.SampleRate)
+	buf := make([]byte, 0, 4+2*framesPerBuffer)
+	start := time.Now()
+	for i := 0; i*framesPerBuffer < len(samples); i++ {
+		chunk := samples[i*framesPerBuffer : min((i+1)*framesPerBuffer, len(samples))]
+
+		due := start.Add(time.Duration(i+1) * chunkDuration)
+		if late := time.Since(due); late > chunkDuration {
+			dropped++
+			continue
+		}
+		time.Sleep(time.Until(due))
+
+		if _, err := c.Write(protocol.AppendChunk(buf[:0], chunk)); err != nil {
+			return sent, dropped, err
+		}
+		sent += len(chunk)
+	}
+
+	if _, err := c.Write(protocol.AppendMarker(nil, protocol.End)); err != nil {
+		return sent, dropped, err
+	}
+	return sent, dropped, nil
+}
+
+// simulatedClient streams fixtures to the server like a capture client
+// hearing speech
+type simulatedClient struct {
+	config   *Config
+	fixtures map[int][][]int16
+	index    int
+	result   *clientResult
+	latency  *latencyTracker
+}
+
+// clientResult is what one client sent
+type clientResult struct {
+	clientID      string
+	err           error
+	transmissions []sentTransmission
+	chunks        int
+	dropped       int
+	bytes         int64
+}
+
+// sentTransmission is a transmission as sent, for checking its recording
+type sentTransmission struct {
+	samples    int
+	sampleRate int
+	endedAt    time.Time
+}
+
+func (c *simulatedClient) run(ctx context.Context, deadline time.Time) {
+	conn, err := Dial(ctx, c.config.ServerAddr, c.config.TLS, c.config.Token, c.config.SampleRate)
+	if err != nil {
+		slog.Error("Simulated client failed to connect", "client", c.index, "error", err)
+		c.result.err = err
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	c.result.clientID = conn.ClientID
+
+	fixtures := c.fixtures[conn.SampleRate]
+	for n := c.index; time.Now().Before(deadline) && ctx.Err() == nil; n++ {
+		fixture := fixtures[n%len(fixtures)]
+		sent, dropped, err := conn.Transmit(fixture)
+		c.result.dropped += dropped
+		c.result.chunks += (sent + framesPerBuffer - 1) / framesPerBuffer
+		c.result.bytes += int64(2*sent + 4*((sent+framesPerBuffer-1)/framesPerBuffer))
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Simulated client lost the server", "client", c.index, "clientID", conn.ClientID, "error", err)
+				c.result.err = err
+			}
+			return
+		}
+
+		ended := time.Now()
+		c.result.transmissions = append(c.result.transmissions, sentTransmission{
+			samples:    sent,
+			sampleRate: conn.SampleRate,
+			endedAt:    ended,
+		})
+		if c.latency != nil {
+			c.latency.ended(conn.ClientID, ended)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.config.Pause):
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package loadgen simulates audio clients streaming speech to a libas
+// server, to measure how a build holds up under load. Create a Config and
+// call Run; the Report it returns covers throughput, audio dropped because
+// the server could not keep up, whether the recordings match what was sent
+// and, given a scribe, how long transcription took.
+package loadgen
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+	"github.com/bosley/libas/scribeclient"
+)
+
+// Samples per chunk, as sent by the capture client
+const framesPerBuffer = 1024
+
+// Config describes a load test
+type Config struct {
+	// Server address (host:port)
+	ServerAddr string
+
+	// TLS settings for the server, e.g. its certificate as a root
+	TLS *tls.Config
+
+	// Shared secret sent before streaming
+	Token string
+
+	// Number of simulated clients
+	Clients int
+
+	// How long the clients stream, each finishes its transmission in
+	// progress
+	Duration time.Duration
+
+	// Speech the clients play in turn, each at least a second and a half
+	// long as the server drops shorter transmissions. Empty uses Synthetic.
+	Fixtures []*audio.PCM
+
+	// Capture rate the clients ask for, 16000 or 44100. Servers declining
+	// 16kHz are sent 44.1kHz.
+	SampleRate int
+
+	// Silence between a client's transmissions, at least a second as
+	// recordings are named by the second they start
+	Pause time.Duration
+
+	// Recordings directory of the server, when set the whisper copies of
+	// the transmissions are checked against what was sent
+	RecordingsDir string
+
+	// Scribe transcribing the server's recordings, when set the time from
+	// the end of each transmission to its transcription is measured
+	Scribe *scribeclient.Client
+
+	// How long to wait after streaming for recordings and transcriptions
+	Settle time.Duration
+}
+
+// Run connects the clients and streams until the duration is up or ctx is
+// cancelled, then waits for the results to settle
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Clients <= 0 {
+		return nil, fmt.Errorf("at least one client is required")
+	}
+	if cfg.SampleRate != audio.WhisperSampleRate && cfg.SampleRate != audio.RecordingSampleRate {
+		return nil, fmt.Errorf("unsupported sample rate %d, use %d or %d", cfg.SampleRate, audio.WhisperSampleRate, audio.RecordingSampleRate)
+	}
+	if cfg.Pause < time.Second {
+		cfg.Pause = time.Second
+	}
+	if len(cfg.Fixtures) == 0 {
+		cfg.Fixtures = []*audio.PCM{Synthetic(audio.WhisperSampleRate)}
+	}
+
+	// Fixtures at both rates, for servers that decline 16kHz
+	fixtures := make(map[int][][]int16)
+	for _, rate := range []int{audio.WhisperSampleRate, audio.RecordingSampleRate} {
+		for i, fixture := range cfg.Fixtures {
+			if time.Duration(len(fixture.Samples))*time.Second/time.Duration(fixture.SampleRate) < 1500*time.Millisecond {
+				return nil, fmt.Errorf("fixture %d is shorter than 1.5 seconds", i+1)
+			}
+			fixtures[rate] = append(fixtures[rate], audio.Resample(fixture.Samples, fixture.SampleRate, rate))
+		}
+	}
+
+	var latency *latencyTracker
+	if cfg.Scribe != nil {
+		var err error
+		if latency, err = followTranscriptions(ctx, cfg.Scribe); err != nil {
+			return nil, fmt.Errorf("failed to subscribe to scribe: %w", err)
+		}
+		defer latency.close()
+	}
+
+	slog.Info("Starting load test",
+		"clients", cfg.Clients,
+		"duration", cfg.Duration,
+		"sampleRate", cfg.SampleRate,
+		"fixtures", len(cfg.Fixtures))
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	deadline := time.Now().Add(cfg.Duration)
+	started := time.Now()
+
+	results := make([]*clientResult, cfg.Clients)
+	var wg sync.WaitGroup
+	for i := range results {
+		results[i] = &clientResult{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Spread the clients over a pause so they do not all start
+			// and end transmissions together
+			select {
+			case <-streamCtx.Done():
+				return
+			case <-time.After(time.Duration(i) * cfg.Pause / time.Duration(cfg.Clients)):
+			}
+			sim := &simulatedClient{config: &cfg, fixtures: fixtures, index: i, result: results[i], latency: latency}
+			sim.run(streamCtx, deadline)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	report := newReport(results, elapsed)
+	if ctx.Err() == nil && report.Transmissions > 0 && (latency != nil || cfg.RecordingsDir != "") {
+		slog.Info("Streaming finished, waiting for results", "settle", cfg.Settle)
+		settle(ctx, cfg.Settle, latency, report.Transmissions)
+	}
+	if cfg.RecordingsDir != "" {
+		report.Recordings = checkRecordings(cfg.RecordingsDir, results)
+	}
+	if latency != nil {
+		report.Latency = latency.summary(report.Transmissions)
+	}
+	return report, nil
+}
+
+// settle waits until every transmission is transcribed, or for the whole
+// settle time when there is no scribe to tell
+func settle(ctx context.Context, wait time.Duration, latency *latencyTracker, transmissions int) {
+	timeout := time.After(wait)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout:
+			return
+		case <-ticker.C:
+			if latency != nil && latency.transcribed() >= transmissions {
+				return
+			}
+		}
+	}
+}
+
+// Synthetic returns three seconds of speech-like sound: a voiced tone with
+// harmonics, shaped into syllables, between short pauses
+func Synthetic(sampleRate int) *audio.PCM {
+	return audiotest.Concat(
+		audiotest.Silence(sampleRate, 250*time.Millisecond),
+		audiotest.Speech(sampleRate, 2500*time.Millisecond, -6),
+		audiotest.Silence(sampleRate, 250*time.Millisecond),
+	)
+}
+
+// ReadFixtures loads audio files as fixtures, taking the WAV and FLAC files
+// of a directory
+func ReadFixtures(paths []string) ([]*audio.PCM, error) {
+	var fixtures []*audio.PCM
+	for _, path := range paths {
+		files := []string{path}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read fixture directory: %w", err)
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				ext := strings.ToLower(filepath.Ext(entry.Name()))
+				if !entry.IsDir() && (ext == ".wav" || ext == ".flac") {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+		for _, file := range files {
+			pcm, err := audio.ReadAudio(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read fixture %s: %w", file, err)
+			}
+			fixtures = append(fixtures, pcm)
+		}
+	}
+	return fixtures, nil
+}
@@ -0,0 +1,239 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/scribeclient"
+)
+
+// Report summarises a load test
+type Report struct {
+	Clients        int           `json:"clients"`
+	FailedClients  int           `json:"failedClients"`
+	Elapsed        time.Duration `json:"elapsed"`
+	Transmissions  int           `json:"transmissions"`
+	Chunks         int           `json:"chunks"`
+	DroppedChunks  int           `json:"droppedChunks"`
+	Bytes          int64         `json:"bytes"`
+	BytesPerSecond float64       `json:"bytesPerSecond"`
+
+	ChunksPerSecond float64 `json:"chunksPerSecond"`
+
+	// Set when the recordings directory was checked
+	Recordings *RecordingCheck `json:"recordings,omitempty"`
+
+	// Set when a scribe was followed
+	Latency *LatencySummary `json:"latency,omitempty"`
+}
+
+// RecordingCheck compares the whisper copies on disk with the
+// transmissions sent
+type RecordingCheck struct {
+	Checked int `json:"checked"`
+
+	// Transmissions without a recording
+	Missing int `json:"missing"`
+
+	// Recordings whose length differs from the transmission's by more than
+	// a chunk
+	WrongLength int `json:"wrongLength"`
+}
+
+// LatencySummary gives the time from the end of a transmission to its
+// transcription
+type LatencySummary struct {
+	Transcribed int           `json:"transcribed"`
+	Pending     int           `json:"pending"`
+	P50         time.Duration `json:"p50"`
+	P90         time.Duration `json:"p90"`
+	P99         time.Duration `json:"p99"`
+	Max         time.Duration `json:"max"`
+}
+
+func newReport(results []*clientResult, elapsed time.Duration) *Report {
+	report := &Report{Clients: len(results), Elapsed: elapsed}
+	for _, result := range results {
+		if result.err != nil {
+			report.FailedClients++
+		}
+		report.Transmissions += len(result.transmissions)
+		report.Chunks += result.chunks
+		report.DroppedChunks += result.dropped
+		report.Bytes += result.bytes
+	}
+	if elapsed > 0 {
+		report.BytesPerSecond = float64(report.Bytes) / elapsed.Seconds()
+		report.ChunksPerSecond = float64(report.Chunks) / elapsed.Seconds()
+	}
+	return report
+}
+
+// Print writes the report for people
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Clients        %d (%d failed)\n", r.Clients, r.FailedClients)
+	fmt.Fprintf(w, "Elapsed        %s\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Transmissions  %d\n", r.Transmissions)
+	dropped := 0.0
+	if total := r.Chunks + r.DroppedChunks; total > 0 {
+		dropped = float64(r.DroppedChunks) / float64(total) * 100
+	}
+	fmt.Fprintf(w, "Chunks         %d sent, %d dropped (%.2f%%)\n", r.Chunks, r.DroppedChunks, dropped)
+	fmt.Fprintf(w, "Throughput     %.1f KiB/s, %.1f chunks/s\n",
+		r.BytesPerSecond/1024, r.ChunksPerSecond)
+	if r.Recordings != nil {
+		fmt.Fprintf(w, "Recordings     %d checked, %d missing, %d wrong length\n",
+			r.Recordings.Checked, r.Recordings.Missing, r.Recordings.WrongLength)
+	}
+	if l := r.Latency; l != nil {
+		fmt.Fprintf(w, "Transcribed    %d, %d pending\n", l.Transcribed, l.Pending)
+		if l.Transcribed > 0 {
+			fmt.Fprintf(w, "Latency        p50 %s, p90 %s, p99 %s, max %s\n",
+				l.P50.Round(time.Millisecond), l.P90.Round(time.Millisecond),
+				l.P99.Round(time.Millisecond), l.Max.Round(time.Millisecond))
+		}
+	}
+}
+
+// checkRecordings matches each client's whisper copies, in the order they
+// were recorded, with the transmissions it sent
+func checkRecordings(dir string, results []*clientResult) *RecordingCheck {
+	check := &RecordingCheck{}
+	for _, result := range results {
+		if result.clientID == "" {
+			continue
+		}
+		var files []string
+		for _, pattern := range []string{"*_whisper.wav", "*_whisper.flac"} {
+			matches, _ := filepath.Glob(filepath.Join(dir, "*", result.clientID, pattern))
+			files = append(files, matches...)
+		}
+		// Named by day and time, so the path sorts chronologically
+		sort.Strings(files)
+
+		for i, sent := range result.transmissions {
+			if i >= len(files) {
+				check.Missing += len(result.transmissions) - i
+				break
+			}
+			check.Checked++
+			pcm, err := audio.ReadAudio(files[i])
+			if err != nil {
+				slog.Warn("Failed to read recording", "file", files[i], "error", err)
+				check.WrongLength++
+				continue
+			}
+			want := time.Duration(sent.samples) * time.Second / time.Duration(sent.sampleRate)
+			got := time.Duration(len(pcm.Samples)) * time.Second / time.Duration(pcm.SampleRate)
+			tolerance := time.Duration(framesPerBuffer) * time.Second / time.Duration(sent.sampleRate)
+			if diff := got - want; diff > tolerance || diff < -tolerance {
+				slog.Warn("Recording length differs from transmission",
+					"file", files[i],
+					"sent", want,
+					"recorded", got)
+				check.WrongLength++
+			}
+		}
+	}
+	return check
+}
+
+// latencyTracker pairs transcriptions with the transmissions they came
+// from, in order per client
+type latencyTracker struct {
+	sub *scribeclient.Subscription
+
+	mu        sync.Mutex
+	pending   map[string][]time.Time // end times by client
+	latencies []time.Duration
+}
+
+// followTranscriptions subscribes to every client's transcriptions
+func followTranscriptions(ctx context.Context, client *scribeclient.Client) (*latencyTracker, error) {
+	sub, err := client.Subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := sub.Send(scribeclient.SubscriptionCommand{Action: "subscribe", ClientIDs: []string{"*"}}); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	t := &latencyTracker{sub: sub, pending: make(map[string][]time.Time)}
+	go t.run()
+	return t, nil
+}
+
+func (t *latencyTracker) run() {
+	for {
+		msg, err := t.sub.Next()
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case "transcription":
+			t.transcription(msg.ClientID, time.Now())
+		case "error":
+			slog.Warn("Scribe refused subscription", "error", msg.Error())
+		}
+	}
+}
+
+// ended records the end of a transmission
+func (t *latencyTracker) ended(clientID string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[clientID] = append(t.pending[clientID], at)
+}
+
+// transcription pairs a transcription with the client's oldest pending
+// transmission, ignoring clients not run by the load test
+func (t *latencyTracker) transcription(clientID string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := t.pending[clientID]
+	if len(pending) == 0 {
+		return
+	}
+	t.latencies = append(t.latencies, at.Sub(pending[0]))
+	t.pending[clientID] = pending[1:]
+}
+
+func (t *latencyTracker) transcribed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.latencies)
+}
+
+func (t *latencyTracker) summary(transmissions int) *LatencySummary {
+	t.mu.Lock()
+	latencies := append([]time.Duration(nil), t.latencies...)
+	t.mu.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	summary := &LatencySummary{Transcribed: len(latencies), Pending: transmissions - len(latencies)}
+	if len(latencies) > 0 {
+		summary.P50 = percentile(latencies, 50)
+		summary.P90 = percentile(latencies, 90)
+		summary.P99 = percentile(latencies, 99)
+		summary.Max = latencies[len(latencies)-1]
+	}
+	return summary
+}
+
+func (t *latencyTracker) close() {
+	t.sub.Close()
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Subsystems whose level can be set on its own with -log-levels, named
+// after the package that logs
+var logSubsystems = []string{"main", "server", "client", "scribe", "audio"}
+
+func addLogFlags(fs *flag.FlagSet) {
+	fs.String("log-level", "info", "Minimum level logged: debug, info, warn or error")
+	fs.String("log-levels", "", "Comma separated per-subsystem levels overriding -log-level, e.g. scribe=debug,server=warn ("+strings.Join(logSubsystems, ", ")+")")
+	fs.String("log-format", "text", "Log format: text or json")
+	fs.String("log-file", "", "Write logs to this file instead of stderr")
+	fs.Int("log-max-size", 100, "Rotate -log-file once it reaches this many megabytes (0 disables rotation)")
+	fs.Int("log-max-files", 5, "Rotated log files to keep")
+}
+
+// configureLogging installs the default logger described by the log flags
+// of a parsed flag set
+func configureLogging(fs *flag.FlagSet) error {
+	value := func(name string) string {
+		return fs.Lookup(name).Value.String()
+	}
+
+	level, err := parseLevel(value("log-level"))
+	if err != nil {
+		return fmt.Errorf("invalid -log-level: %w", err)
+	}
+
+	overrides := make(map[string]slog.Level)
+	for _, item := range splitList(value("log-levels")) {
+		subsystem, levelName, ok := strings.Cut(item, "=")
+		if !ok || !validSubsystem(subsystem) {
+			return fmt.Errorf("invalid -log-levels entry %q, expected <subsystem>=<level>", item)
+		}
+		if overrides[subsystem], err = parseLevel(levelName); err != nil {
+			return fmt.Errorf("invalid -log-levels entry %q: %w", item, err)
+		}
+	}
+
+	var out io.Writer = os.Stderr
+	if path := value("log-file"); path != "" {
+		var maxSize, maxFiles int
+		fmt.Sscan(value("log-max-size"), &maxSize)
+		fmt.Sscan(value("log-max-files"), &maxFiles)
+		if out, err = openRotatingFile(path, int64(maxSize)<<20, maxFiles); err != nil {
+			return err
+		}
+	}
+
+	minLevel := level
+	for _, l := range overrides {
+		minLevel = min(minLevel, l)
+	}
+	opts := &slog.HandlerOptions{Level: minLevel}
+
+	var handler slog.Handler
+	switch value("log-format") {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q, expected text or json", value("log-format"))
+	}
+
+	if len(overrides) > 0 {
+		handler = &subsystemHandler{
+			Handler:   handler,
+			level:     level,
+			overrides: overrides,
+		}
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+func validSubsystem(name string) bool {
+	for _, subsystem := range logSubsystems {
+		if subsystem == name {
+			return true
+		}
+	}
+	return false
+}
+
+// subsystemHandler filters records by the level of the package that logged
+// them, so the packages keep using the default logger
+type subsystemHandler struct {
+	slog.Handler
+	level     slog.Level
+	overrides map[string]slog.Level
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	level := h.level
+	if override, ok := h.overrides[callerPackage(r.PC)]; ok {
+		level = override
+	}
+	if r.Level < level {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level, overrides: h.overrides}
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{Handler: h.Handler.WithGroup(name), level: h.level, overrides: h.overrides}
+}
+
+// callerPackage returns the last element of the package path of the function
+// at pc, "github.com/bosley/libas/scribe.(*Scribe).worker" is "scribe"
+func callerPackage(pc uintptr) string {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	name := frame.Function
+	if slash := strings.LastIndexByte(name, '/'); slash >= 0 {
+		name = name[slash+1:]
+	}
+	pkg, _, _ := strings.Cut(name, ".")
+	return pkg
+}
+
+// rotatingFile is a log file that is renamed to <path>.1, <path>.2, ...
+// once it grows past maxSize, keeping maxFiles old files
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the oversized file rather than losing records
+			fmt.Fprintf(os.Stderr, "libas: failed to rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			r.open()
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		r.open()
+		return err
+	}
+
+	return r.open()
+}
@@ -7,139 +7,225 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
-	libascli "github.com/bosley/libas/client"
-	"github.com/bosley/libas/scribe"
-	libaserv "github.com/bosley/libas/server"
+	"github.com/bosley/libas/audio"
 )
 
-var (
-	verbose bool
-	token   string
-)
+// command is one libas subcommand
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+// Populated in init, the commands refer back to the table for their usage
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "Run the audio server and scribe transcription service", runServe},
+		{"scribe", "[flags]", "Run only the transcription service over an existing recordings directory", runScribe},
+		{"ingest", "[flags]", "Run only the audio server, recording without transcription", runIngest},
+		{"worker", "[flags]", "Transcribe the recordings a scribe started with -queue hands out through Redis", runWorker},
+		{"capture", "[flags]", "Stream the microphone to a server", runCapture},
+		{"calibrate", "[flags]", "Measure background noise and speech and recommend capture VAD settings", runCalibrate},
+		{"play", "[flags] <file>", "Play an audio file", runPlay},
+		{"devices", "", "List audio input devices", runDevices},
+		{"transcribe", "[flags] <file>...", "Transcribe audio files with whisper and print the text", runTranscribe},
+		{"split", "[flags] <file>", "Split an audio file into utterances on silence", runSplit},
+		{"tail", "[flags]", "Print live transcriptions from a scribe", runTail},
+		{"search", "[flags] <query>", "Search stored transcriptions on a scribe", runSearch},
+		{"export", "[flags] <archive>", "Write transcriptions and recordings to a portable archive", runExport},
+		{"import", "[flags] <archive>", "Load an archive written by export into a recordings directory", runImport},
+		{"loadgen", "[flags]", "Stream speech from simulated clients to a server and report how it held up", runLoadgen},
+		{"replay", "[flags]", "Send a session dumped by a server with -dump-dir to a server again", runReplay},
+		{"pseudonyms", "[flags] [pseudonym]...", "Print the client IDs pseudonyms handed out with -pseudonym-key stood for", runPseudonyms},
+		{"check", "<command> [command flags]", "Validate the configuration of a command without starting it", runCheck},
+		{"version", "[flags]", "Print the version, commit and protocol revision", runVersion},
+		{"install-service", "[flags] <command> [command flags]", "Write a systemd unit or launchd plist, or register a Windows service, running a command", runInstallService},
+	}
+}
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
-	slog.SetDefault(logger)
-
-	clientList := libaserv.NewClientList()
-
-	serverAddr := flag.String("server", "", "Server address (host:port)")
-	playFile := flag.String("play", "", "Play audio file")
-	insecureMode := flag.Bool("insecure", false, "Enable insecure mode (skip certificate verification)")
-	serverCertFile := flag.String("cert", "", "Path to server certificate file")
-	serverKeyFile := flag.String("key", "", "Path to server key file")
-	whisperPath := flag.String("whisper", "", "Path to whisper executable (required for server mode)")
-	whisperModel := flag.String("model", "", "Path to whisper model file (required for server mode)")
-	listDevices := flag.Bool("list-devices", false, "List available audio input devices")
-	deviceID := flag.Int("device", 0, "Audio input device ID to use")
-	flag.Parse()
-
-	if *playFile != "" {
-		err := libascli.PlayAudioFile(*playFile)
-		if err != nil {
-			slog.Error("Failed to play audio file", "error", err)
-		}
+	// Replaced by the command's -log-* flags once they are parsed
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "-version" || name == "--version" {
+		name = "version"
+	}
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage()
 		return
 	}
 
-	if *listDevices {
-		devices, err := libascli.ListAudioDevices()
-		if err != nil {
-			slog.Error("Failed to list audio devices", "error", err)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if err := runCommand(cmd, os.Args[2:]); err != nil {
+			slog.Error("Command failed", "command", name, "error", err)
 			os.Exit(1)
 		}
+		slog.Debug("Program exiting")
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "libas: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-		fmt.Println("Available audio input devices:")
-		for i, device := range devices {
-			fmt.Printf("[%d] %s\n", i, device.Name)
-			fmt.Printf("    Max Input Channels: %d\n", device.MaxInputChannels)
-			fmt.Printf("    Default Sample Rate: %f\n", device.DefaultSampleRate)
-			fmt.Println()
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: libas <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run \"libas <command> -h\" for the flags of a command.")
+}
+
+// newFlagSet creates the flag set of a subcommand with usage text naming it
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.String("config", "", "TOML config file, flags override LIBAS_* environment variables which override the file (env LIBAS_CONFIG)")
+	addLogFlags(fs)
+	fs.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintf(fs.Output(), "Usage: libas %s %s\n\n%s\n", cmd.name, cmd.args, cmd.summary)
+			}
 		}
-		return
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// usageError prints the flags of a subcommand and reports what was wrong
+func usageError(fs *flag.FlagSet, format string, args ...any) error {
+	fs.Usage()
+	fmt.Fprintln(fs.Output())
+	return fmt.Errorf(format, args...)
+}
+
+// processingFlags are the recording clean up options shared by the
+// commands that prepare audio for whisper
+type processingFlags struct {
+	highPass         *float64
+	normalize        *bool
+	loudnessTarget   *float64
+	trimSilence      *bool
+	silenceThreshold *float64
+}
+
+func addProcessingFlags(fs *flag.FlagSet) *processingFlags {
+	return &processingFlags{
+		highPass:         fs.Float64("highpass", audio.DefaultHighPassHz, "High-pass cutoff in Hz removing DC offset and rumble (0 disables)"),
+		normalize:        fs.Bool("normalize", false, "Normalize loudness before transcription"),
+		loudnessTarget:   fs.Float64("loudness-target", audio.DefaultTargetLUFS, "Loudness normalization target in LUFS"),
+		trimSilence:      fs.Bool("trim-silence", false, "Trim leading and trailing silence before transcription"),
+		silenceThreshold: fs.Float64("silence-threshold", -45, "Level in dBFS below which audio counts as silence"),
+	}
+}
+
+func (p *processingFlags) convertOptions() audio.ConvertOptions {
+	return audio.ConvertOptions{
+		HighPassHz:        *p.highPass,
+		NormalizeLoudness: *p.normalize,
+		TargetLUFS:        *p.loudnessTarget,
+		TrimSilence:       *p.trimSilence,
+		Silence:           audio.SilenceOptions{ThresholdDB: *p.silenceThreshold},
+	}
+}
+
+func addFFmpegFlag(fs *flag.FlagSet) *string {
+	return fs.String("ffmpeg", "", "Path to the ffmpeg executable used for MP3 and OGG (searches PATH by default)")
+}
+
+// configureFFmpeg resolves the ffmpeg binary once at startup. A missing
+// ffmpeg is only an error when a path was given explicitly, otherwise the
+// native codecs are used and formats that need ffmpeg are rejected.
+func configureFFmpeg(path string) error {
+	resolved, err := audio.ConfigureFFmpeg(path)
+	if err != nil {
+		if path != "" {
+			return err
+		}
+		slog.Warn("FFmpeg not found, only WAV and FLAC audio can be decoded", "error", err)
+		return nil
 	}
+	slog.Debug("Using FFmpeg", "path", resolved)
+	return nil
+}
 
-	token = os.Getenv("LIBAS_TOKEN")
-	if token == "" {
-		slog.Error("LIBAS_TOKEN environment variable is not set")
-		os.Exit(1)
+// runCommand runs a command, under the service manager when it started the
+// process as a Windows service
+func runCommand(cmd command, args []string) error {
+	run := func() error { return cmd.run(args) }
+	if isService, err := runService(cmd.name, run); isService || err != nil {
+		return err
 	}
+	return run()
+}
+
+// Closed when the Windows service manager asks the process to stop
+var serviceStop = make(chan struct{})
+
+// shutdownContext is cancelled on SIGINT or SIGTERM, or when a Windows
+// service is stopped
+func shutdownContext() (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		<-sigChan
-		slog.Debug("Received shutdown signal")
-		cancel()
-	}()
-
-	if *serverAddr == "" {
-		if *insecureMode {
-			slog.Warn("Running server in insecure mode. This should not be used in production!")
-			slog.Error("Non-TLS server mode not implemented yet")
+		select {
+		case <-sigChan:
+			slog.Debug("Received shutdown signal")
+		case <-serviceStop:
+			slog.Debug("Received service stop request")
+		case <-ctx.Done():
 			return
 		}
-		if *serverCertFile == "" || *serverKeyFile == "" {
-			slog.Error("Server certificate and key files must be provided when running in secure mode")
-			flag.Usage()
-			os.Exit(1)
-		}
-		if *whisperPath == "" {
-			slog.Error("Whisper executable path must be provided when running in server mode")
-			flag.Usage()
-			os.Exit(1)
-		}
-		if *whisperModel == "" {
-			slog.Error("Whisper model path must be provided when running in server mode")
-			flag.Usage()
-			os.Exit(1)
-		}
+		cancel()
+	}()
 
-		// Initialize Scribe
-		scribeConfig := scribe.Config{
-			CertFile:      *serverCertFile,
-			KeyFile:       *serverKeyFile,
-			RecordingsDir: "recordings",
-			HTTPAddr:      ":8444",
-			WhisperPath:   *whisperPath,
-			WhisperModel:  *whisperModel,
-			Workers:       2,
-		}
+	return ctx, cancel
+}
 
-		scribeService, err := scribe.New(scribeConfig)
-		if err != nil {
-			slog.Error("Failed to initialize Scribe", "error", err)
-			os.Exit(1)
+// requireToken reads the shared secret used between clients and the server
+// from LIBAS_TOKEN or the token setting of the config file
+func requireToken(cfg configFile, command string) (string, error) {
+	if token := os.Getenv("LIBAS_TOKEN"); token != "" {
+		return token, nil
+	}
+	if value, ok := cfg.lookup(command, "token"); ok {
+		if token := configString(value); token != "" {
+			return token, nil
 		}
+	}
+	return "", fmt.Errorf("LIBAS_TOKEN environment variable is not set and the config file has no token")
+}
 
-		// Start Scribe in its own goroutine
-		go func() {
-			if err := scribeService.Start(ctx); err != nil {
-				slog.Error("Scribe service failed", "error", err)
-			}
-		}()
-
-		// Ensure Scribe is stopped on shutdown
-		defer func() {
-			if err := scribeService.Stop(context.Background()); err != nil {
-				slog.Error("Failed to stop Scribe service", "error", err)
-			}
-		}()
-
-		// Launch your existing server
-		libaserv.Launch(ctx, *serverCertFile, token, *serverKeyFile, clientList)
-	} else {
-		if !*insecureMode && *serverCertFile == "" {
-			slog.Error("Server certificate file must be provided when not in insecure mode")
-			flag.Usage()
-			os.Exit(1)
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
-		libascli.Launch(ctx, *serverAddr, *insecureMode, token, *serverCertFile, *deviceID)
 	}
-
-	slog.Debug("Program exiting")
+	return items
 }
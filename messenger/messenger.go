@@ -0,0 +1,103 @@
+// Package messenger receives the voice notes sent or forwarded to a chat
+// bot, over the Telegram Bot API or a signal-cli REST API server, and
+// replies to them
+package messenger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	// Largest voice note downloaded
+	maxNoteSize = 100 << 20
+
+	// Largest API response read beside downloads
+	maxResponseSize = 4 << 20
+)
+
+// File extensions of the audio types voice notes come in
+var extensions = map[string]string{
+	"audio/ogg":   ".ogg",
+	"audio/opus":  ".opus",
+	"audio/mpeg":  ".mp3",
+	"audio/mp4":   ".m4a",
+	"audio/x-m4a": ".m4a",
+	"audio/aac":   ".aac",
+	"audio/wav":   ".wav",
+	"audio/x-wav": ".wav",
+	"audio/flac":  ".flac",
+	"audio/amr":   ".amr",
+	"audio/3gpp":  ".3gp",
+	"audio/webm":  ".webm",
+}
+
+// VoiceNote is a voice note or audio file sent to the bot
+type VoiceNote struct {
+	// Who sent it, the same for all their notes: the Telegram user ID or
+	// the Signal account UUID
+	Sender string
+
+	// Handle of the sender, the Telegram username or the Signal phone
+	// number, empty when they hide it
+	Handle string
+
+	// Name the sender goes by, for logs
+	Name string
+
+	// File extension of the audio, e.g. .ogg, empty when unknown
+	Ext string
+
+	// Chat and message replies go to, and the file of the audio
+	chat    string
+	message int64
+	file    string
+}
+
+// extension returns the file extension of audio by its MIME type, or by
+// its file name when the type is unknown
+func extension(mimeType, fileName string) string {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		if ext, ok := extensions[mediaType]; ok {
+			return ext
+		}
+	}
+	return strings.ToLower(path.Ext(fileName))
+}
+
+// do sends a request, keeping its URL, which holds the Telegram token, out
+// of errors
+func do(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// download hands out the body of a download, failing when it is larger
+// than a voice note gets
+func download(resp *http.Response) (io.ReadCloser, error) {
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download failed with %s", resp.Status)
+	}
+	if resp.ContentLength > maxNoteSize {
+		resp.Body.Close()
+		return nil, fmt.Errorf("voice note of %d bytes is too large", resp.ContentLength)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, maxNoteSize), resp.Body}, nil
+}
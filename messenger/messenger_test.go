@@ -0,0 +1,57 @@
+package messenger
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExtension(t *testing.T) {
+	tests := []struct {
+		mimeType, fileName, want string
+	}{
+		{"audio/ogg", "", ".ogg"},
+		{"audio/ogg; codecs=opus", "voice.oga", ".ogg"},
+		{"AUDIO/MPEG", "", ".mp3"},
+		{"audio/x-unknown", "Memo.M4A", ".m4a"},
+		{"", "memo", ""},
+		{"not a type", "", ""},
+	}
+	for _, tt := range tests {
+		if got := extension(tt.mimeType, tt.fileName); got != tt.want {
+			t.Errorf("%q, %q: got %q, want %q", tt.mimeType, tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	response := func(status int, length int64, body string) *http.Response {
+		return &http.Response{
+			StatusCode:    status,
+			Status:        http.StatusText(status),
+			ContentLength: length,
+			Body:          io.NopCloser(strings.NewReader(body)),
+		}
+	}
+
+	body, err := download(response(http.StatusOK, -1, "voice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(body); string(data) != "voice" {
+		t.Errorf("got %q", data)
+	}
+	if _, err := download(response(http.StatusNotFound, -1, "")); err == nil {
+		t.Error("downloaded a missing file")
+	}
+	if _, err := download(response(http.StatusOK, maxNoteSize+1, "")); err == nil {
+		t.Error("downloaded a note over the limit")
+	}
+
+	// Without a length the body is cut at the limit
+	body, _ = download(response(http.StatusOK, -1, strings.Repeat("x", maxNoteSize+1)))
+	if n, _ := io.Copy(io.Discard, body); n != maxNoteSize {
+		t.Errorf("read %d bytes", n)
+	}
+}
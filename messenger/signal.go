@@ -0,0 +1,178 @@
+package messenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How long a poll for messages waits for them
+const signalPoll = 30 * time.Second
+
+// Signal receives the voice notes sent to a number registered with a
+// signal-cli REST API server (bbernhard/signal-cli-rest-api) in its normal
+// or native mode. Notes sent to groups are left alone, only those sent to
+// the number directly are answered.
+type Signal struct {
+	url    string
+	number string
+	http   *http.Client
+}
+
+type signalMessage struct {
+	Envelope struct {
+		Source       string `json:"source"`
+		SourceNumber string `json:"sourceNumber"`
+		SourceUUID   string `json:"sourceUuid"`
+		SourceName   string `json:"sourceName"`
+		DataMessage  *struct {
+			Timestamp int64 `json:"timestamp"`
+			GroupInfo *struct {
+				GroupID string `json:"groupId"`
+			} `json:"groupInfo"`
+			Attachments []struct {
+				ID          string `json:"id"`
+				ContentType string `json:"contentType"`
+				Filename    string `json:"filename"`
+			} `json:"attachments"`
+		} `json:"dataMessage"`
+	} `json:"envelope"`
+}
+
+// NewSignal creates the client of a number registered with the REST API
+// server at serverURL, e.g. http://localhost:8080
+func NewSignal(serverURL, number string) (*Signal, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid signal-cli REST API URL %q", serverURL)
+	}
+	if number == "" {
+		return nil, fmt.Errorf("Signal bots need the number registered with the REST API")
+	}
+	return &Signal{
+		url:    strings.TrimSuffix(serverURL, "/"),
+		number: number,
+		http:   &http.Client{Timeout: signalPoll + 30*time.Second},
+	}, nil
+}
+
+// Name names the service in logs and client identities
+func (s *Signal) Name() string {
+	return "signal"
+}
+
+// Receive waits for the next messages sent to the number, returning the
+// audio attachments among them, none when the wait ran out
+func (s *Signal) Receive(ctx context.Context) ([]VoiceNote, error) {
+	query := url.Values{"timeout": {fmt.Sprint(int(signalPoll / time.Second))}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		s.url+"/v1/receive/"+url.PathEscape(s.number)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Signal request: %w", err)
+	}
+	var messages []signalMessage
+	if err := s.do(req, &messages); err != nil {
+		return nil, err
+	}
+
+	var notes []VoiceNote
+	for _, message := range messages {
+		envelope := message.Envelope
+		data := envelope.DataMessage
+		if data == nil || data.GroupInfo != nil {
+			continue
+		}
+		sender := envelope.SourceUUID
+		if sender == "" {
+			sender = envelope.Source
+		}
+		chat := envelope.SourceNumber
+		if chat == "" {
+			chat = sender
+		}
+		for _, attachment := range data.Attachments {
+			if !strings.HasPrefix(attachment.ContentType, "audio/") {
+				continue
+			}
+			notes = append(notes, VoiceNote{
+				Sender:  sender,
+				Handle:  envelope.SourceNumber,
+				Name:    envelope.SourceName,
+				Ext:     extension(attachment.ContentType, attachment.Filename),
+				chat:    chat,
+				message: data.Timestamp,
+				file:    attachment.ID,
+			})
+		}
+	}
+	return notes, nil
+}
+
+// Download fetches the audio of a voice note
+func (s *Signal) Download(ctx context.Context, note VoiceNote) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/v1/attachments/"+url.PathEscape(note.file), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Signal request: %w", err)
+	}
+	resp, err := do(s.http, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download voice note: %w", err)
+	}
+	return download(resp)
+}
+
+// Reply answers a voice note, quoting it
+func (s *Signal) Reply(ctx context.Context, note VoiceNote, text string) error {
+	body, err := json.Marshal(map[string]any{
+		"number":          s.number,
+		"recipients":      []string{note.chat},
+		"message":         text,
+		"quote_timestamp": note.message,
+		"quote_author":    note.chat,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal Signal message: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/v2/send", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Signal request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return s.do(req, nil)
+}
+
+// do sends a request to the REST API, decoding its response into result
+func (s *Signal) do(req *http.Request, result any) error {
+	resp, err := do(s.http, req)
+	if err != nil {
+		return fmt.Errorf("Signal request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to read Signal response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &failure) == nil && failure.Error != "" {
+			return fmt.Errorf("Signal REST API answered %s: %s", resp.Status, failure.Error)
+		}
+		return fmt.Errorf("Signal REST API answered %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), result); err != nil {
+		return fmt.Errorf("failed to parse Signal response: %w", err)
+	}
+	return nil
+}
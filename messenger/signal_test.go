@@ -0,0 +1,162 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const signalNumber = "+4915112345678"
+
+// fakeSignalAPI is a signal-cli REST API server answering receives with
+// messages, recording the messages sent
+type fakeSignalAPI struct {
+	messages string
+
+	mu   sync.Mutex
+	sent []map[string]any
+}
+
+func (f *fakeSignalAPI) start(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeSignalAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/receive/"+signalNumber:
+		if r.URL.Query().Get("timeout") != "30" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"unexpected timeout"}`)
+			return
+		}
+		io.WriteString(w, f.messages+"\n")
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/attachments/att 1":
+		io.WriteString(w, "voice")
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/send":
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		f.sent = append(f.sent, body)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"timestamp":"1700000000001"}`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"User `+signalNumber+` is not registered."}`)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	api := (&fakeSignalAPI{messages: `[
+		{"envelope":{"source":"+4917000000001","sourceNumber":"+4917000000001","sourceUuid":"a1b2","sourceName":"Ada","dataMessage":{"timestamp":1700000000000,"groupInfo":null,"attachments":[
+			{"id":"att 1","contentType":"audio/aac","filename":null},
+			{"id":"img","contentType":"image/jpeg","filename":"photo.jpg"},
+			{"id":"att 2","contentType":"audio/x-unknown","filename":"memo.OPUS"}
+		]}}},
+		{"envelope":{"source":"c3d4","sourceNumber":null,"sourceUuid":"c3d4","sourceName":"Hidden","dataMessage":{"timestamp":1700000000002,"attachments":[{"id":"att 3","contentType":"audio/ogg; codecs=opus"}]}}},
+		{"envelope":{"source":"+4917000000001","sourceUuid":"a1b2","dataMessage":{"timestamp":1700000000003,"groupInfo":{"groupId":"g1","type":"DELIVER"},"attachments":[{"id":"att 4","contentType":"audio/aac"}]}}},
+		{"envelope":{"source":"+4917000000001","sourceUuid":"a1b2","receiptMessage":{"isDelivery":true}}},
+		{"envelope":{"source":"+4917000000001","sourceUuid":"a1b2","dataMessage":{"timestamp":1700000000004,"message":"hello"}}}
+	]`}).start(t)
+	bot, err := NewSignal(api.URL+"/", signalNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := api.Config.Handler.(*fakeSignalAPI)
+
+	notes, err := bot.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []VoiceNote{
+		{Sender: "a1b2", Handle: "+4917000000001", Name: "Ada", Ext: ".aac", chat: "+4917000000001", message: 1700000000000, file: "att 1"},
+		{Sender: "a1b2", Handle: "+4917000000001", Name: "Ada", Ext: ".opus", chat: "+4917000000001", message: 1700000000000, file: "att 2"},
+		{Sender: "c3d4", Name: "Hidden", Ext: ".ogg", chat: "c3d4", message: 1700000000002, file: "att 3"},
+	}
+	if len(notes) != len(want) {
+		t.Fatalf("got %+v", notes)
+	}
+	for i := range want {
+		if notes[i] != want[i] {
+			t.Errorf("note %d: got %+v, want %+v", i, notes[i], want[i])
+		}
+	}
+
+	body, err := bot.Download(context.Background(), notes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "voice" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	if err := bot.Reply(context.Background(), notes[2], "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.sent) != 1 {
+		t.Fatalf("sent %v", fake.sent)
+	}
+	sent := fake.sent[0]
+	if sent["number"] != signalNumber || sent["message"] != "Hello" || sent["quote_timestamp"] != float64(1700000000002) || sent["quote_author"] != "c3d4" {
+		t.Errorf("sent %v", sent)
+	}
+	if recipients, _ := sent["recipients"].([]any); len(recipients) != 1 || recipients[0] != "c3d4" {
+		t.Errorf("sent to %v", sent["recipients"])
+	}
+}
+
+func TestSignalErrors(t *testing.T) {
+	api := (&fakeSignalAPI{messages: `[]`}).start(t)
+
+	// The REST API's error is reported
+	bot, _ := NewSignal(api.URL, "+4900000000000")
+	if _, err := bot.Receive(context.Background()); err == nil || !strings.Contains(err.Error(), "is not registered") {
+		t.Errorf("got %v", err)
+	}
+	bot, _ = NewSignal(api.URL, signalNumber)
+	if _, err := bot.Download(context.Background(), VoiceNote{file: "gone"}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v", err)
+	}
+
+	for _, handler := range []http.HandlerFunc{
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "<html>Bad Gateway</html>", http.StatusBadGateway)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `[{"envelope":`)
+		},
+	} {
+		server := httptest.NewServer(handler)
+		bot, _ := NewSignal(server.URL, signalNumber)
+		if notes, err := bot.Receive(context.Background()); err == nil {
+			t.Errorf("got %v", notes)
+		}
+		server.Close()
+	}
+}
+
+func TestNewSignal(t *testing.T) {
+	for _, u := range []string{"", "localhost:8080", "ftp://localhost", "http://", "http://[::1"} {
+		if _, err := NewSignal(u, signalNumber); err == nil {
+			t.Errorf("accepted %q", u)
+		}
+	}
+	if _, err := NewSignal("http://localhost:8080", ""); err == nil {
+		t.Error("accepted a bot without a number")
+	}
+	bot, err := NewSignal("http://localhost:8080/", signalNumber)
+	if err != nil || bot.url != "http://localhost:8080" || bot.Name() != "signal" {
+		t.Errorf("got %+v, %v", bot, err)
+	}
+}
@@ -0,0 +1,227 @@
+package messenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// Bot API server used when NewTelegram is given none
+	defaultTelegramAPI = "https://api.telegram.org"
+
+	// How long a poll for updates waits for messages
+	telegramPoll = 50 * time.Second
+
+	// Longest text of a message in UTF-16 code units, as Telegram counts,
+	// longer replies are split
+	maxTelegramText = 4096
+)
+
+// Telegram receives the voice notes sent to a bot by long polling the Bot
+// API, which needs no public address for a webhook
+type Telegram struct {
+	token string
+	api   string
+	http  *http.Client
+
+	// Update to receive next, the updates before it are confirmed by
+	// asking for it
+	offset int64
+}
+
+// telegramResponse is the envelope of every Bot API response
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	From      *struct {
+		ID        int64  `json:"id"`
+		IsBot     bool   `json:"is_bot"`
+		Username  string `json:"username"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	} `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Voice *telegramFile `json:"voice"`
+	Audio *telegramFile `json:"audio"`
+}
+
+type telegramFile struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FilePath string `json:"file_path"`
+}
+
+// NewTelegram creates the client of a bot from the token @BotFather gave
+// it. apiURL is the Bot API server, https://api.telegram.org when empty;
+// a local one downloads voice notes beyond the 20 MB the public one allows.
+func NewTelegram(token, apiURL string) (*Telegram, error) {
+	if token == "" {
+		return nil, fmt.Errorf("Telegram bots need a token")
+	}
+	if apiURL == "" {
+		apiURL = defaultTelegramAPI
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid Telegram Bot API URL %q", apiURL)
+	}
+	return &Telegram{
+		token: token,
+		api:   strings.TrimSuffix(apiURL, "/"),
+		http:  &http.Client{Timeout: telegramPoll + 30*time.Second},
+	}, nil
+}
+
+// Name names the service in logs and client identities
+func (t *Telegram) Name() string {
+	return "telegram"
+}
+
+// Receive waits for the next messages sent to the bot, returning the voice
+// notes and audio files among them, none when the wait ran out
+func (t *Telegram) Receive(ctx context.Context) ([]VoiceNote, error) {
+	var updates []telegramUpdate
+	err := t.call(ctx, "getUpdates", map[string]any{
+		"offset":          t.offset,
+		"timeout":         int(telegramPoll / time.Second),
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []VoiceNote
+	for _, update := range updates {
+		t.offset = max(t.offset, update.UpdateID+1)
+		m := update.Message
+		if m == nil || m.From == nil || m.From.IsBot {
+			continue
+		}
+		file, ext := m.Voice, ".ogg"
+		if file == nil {
+			if file = m.Audio; file == nil {
+				continue
+			}
+			ext = extension(file.MimeType, file.FileName)
+		}
+		notes = append(notes, VoiceNote{
+			Sender:  strconv.FormatInt(m.From.ID, 10),
+			Handle:  m.From.Username,
+			Name:    strings.TrimSpace(m.From.FirstName + " " + m.From.LastName),
+			Ext:     ext,
+			chat:    strconv.FormatInt(m.Chat.ID, 10),
+			message: m.MessageID,
+			file:    file.FileID,
+		})
+	}
+	return notes, nil
+}
+
+// Download fetches the audio of a voice note
+func (t *Telegram) Download(ctx context.Context, note VoiceNote) (io.ReadCloser, error) {
+	var file telegramFile
+	if err := t.call(ctx, "getFile", map[string]any{"file_id": note.file}, &file); err != nil {
+		return nil, err
+	}
+	if file.FilePath == "" {
+		return nil, fmt.Errorf("Telegram gave no path for the voice note")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.api+"/file/bot"+t.token+"/"+file.FilePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Telegram request: %w", err)
+	}
+	resp, err := do(t.http, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download voice note: %w", err)
+	}
+	return download(resp)
+}
+
+// Reply answers a voice note in its chat, splitting text Telegram finds
+// too long into several messages
+func (t *Telegram) Reply(ctx context.Context, note VoiceNote, text string) error {
+	for text != "" {
+		var part string
+		part, text = splitTelegramText(text)
+		err := t.call(ctx, "sendMessage", map[string]any{
+			"chat_id": note.chat,
+			"text":    part,
+			"reply_parameters": map[string]any{
+				"message_id":                  note.message,
+				"allow_sending_without_reply": true,
+			},
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitTelegramText cuts the first message off text, which is as long as
+// Telegram allows
+func splitTelegramText(text string) (string, string) {
+	units := 0
+	for i, r := range text {
+		if units += utf16.RuneLen(r); units > maxTelegramText {
+			return text[:i], text[i:]
+		}
+	}
+	return text, ""
+}
+
+// call calls a method of the Bot API, decoding its result into result
+func (t *Telegram) call(ctx context.Context, method string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Telegram request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.api+"/bot"+t.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Telegram request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := do(t.http, req)
+	if err != nil {
+		return fmt.Errorf("Telegram request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var response telegramResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&response); err != nil {
+		return fmt.Errorf("failed to parse Telegram response (%s): %w", resp.Status, err)
+	}
+	if !response.OK {
+		return fmt.Errorf("Telegram %s failed: %s", method, response.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("failed to parse Telegram %s result: %w", method, err)
+	}
+	return nil
+}
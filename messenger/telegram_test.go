@@ -0,0 +1,218 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+)
+
+const telegramToken = "123456:s3cret"
+
+// fakeBotAPI is a Telegram Bot API server answering getUpdates with
+// updates, recording the messages sent
+type fakeBotAPI struct {
+	updates string
+
+	mu      sync.Mutex
+	offsets []int64
+	sent    []map[string]any
+}
+
+func (f *fakeBotAPI) start(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/file/bot"+telegramToken+"/voice/file_1.oga" {
+		io.WriteString(w, "OggS voice")
+		return
+	}
+	method, ok := strings.CutPrefix(r.URL.Path, "/bot"+telegramToken+"/")
+	if !ok || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"ok":false,"error_code":401,"description":"Unauthorized"}`)
+		return
+	}
+	var params map[string]any
+	json.NewDecoder(r.Body).Decode(&params)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch method {
+	case "getUpdates":
+		f.offsets = append(f.offsets, int64(params["offset"].(float64)))
+		if params["timeout"] != float64(50) || params["allowed_updates"].([]any)[0] != "message" {
+			io.WriteString(w, `{"ok":false,"description":"Bad Request: unexpected parameters"}`)
+			return
+		}
+		io.WriteString(w, `{"ok":true,"result":`+f.updates+`}`)
+	case "getFile":
+		if params["file_id"] != "voice-1" {
+			io.WriteString(w, `{"ok":false,"description":"Bad Request: invalid file_id"}`)
+			return
+		}
+		io.WriteString(w, `{"ok":true,"result":{"file_id":"voice-1","file_path":"voice/file_1.oga"}}`)
+	case "sendMessage":
+		f.sent = append(f.sent, params)
+		io.WriteString(w, `{"ok":true,"result":{"message_id":99}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"ok":false,"error_code":404,"description":"Not Found"}`)
+	}
+}
+
+func TestTelegram(t *testing.T) {
+	api := (&fakeBotAPI{updates: `[
+		{"update_id":10,"message":{"message_id":1,"from":{"id":42,"is_bot":false,"first_name":"Ada","last_name":"Lovelace","username":"ada"},"chat":{"id":42},"voice":{"file_id":"voice-1","mime_type":"audio/ogg"}}},
+		{"update_id":11,"message":{"message_id":2,"from":{"id":43,"is_bot":false,"first_name":"Bob"},"chat":{"id":-100},"audio":{"file_id":"audio-1","mime_type":"audio/mpeg","file_name":"memo.bin"}}},
+		{"update_id":12,"message":{"message_id":3,"from":{"id":43,"is_bot":false,"first_name":"Bob"},"chat":{"id":43},"audio":{"file_id":"audio-2","mime_type":"application/octet-stream","file_name":"Memo.M4A"}}},
+		{"update_id":14,"message":{"message_id":4,"from":{"id":44,"is_bot":true,"first_name":"Other bot"},"chat":{"id":44},"voice":{"file_id":"voice-2"}}},
+		{"update_id":13,"message":{"message_id":5,"from":{"id":42,"is_bot":false,"first_name":"Ada"},"chat":{"id":42},"text":"hello"}},
+		{"update_id":15,"message":{"message_id":6,"sender_chat":{"id":-200},"chat":{"id":-200},"voice":{"file_id":"voice-3"}}},
+		{"update_id":16,"edited_message":{"message_id":1}}
+	]`}).start(t)
+	bot, err := NewTelegram(telegramToken, api.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := api.Config.Handler.(*fakeBotAPI)
+
+	notes, err := bot.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []VoiceNote{
+		{Sender: "42", Handle: "ada", Name: "Ada Lovelace", Ext: ".ogg", chat: "42", message: 1, file: "voice-1"},
+		{Sender: "43", Name: "Bob", Ext: ".mp3", chat: "-100", message: 2, file: "audio-1"},
+		{Sender: "43", Name: "Bob", Ext: ".m4a", chat: "43", message: 3, file: "audio-2"},
+	}
+	if len(notes) != len(want) {
+		t.Fatalf("got %+v", notes)
+	}
+	for i := range want {
+		if notes[i] != want[i] {
+			t.Errorf("note %d: got %+v, want %+v", i, notes[i], want[i])
+		}
+	}
+
+	// The next poll confirms every update received, out of order or not
+	if _, err := bot.Receive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	if len(fake.offsets) != 2 || fake.offsets[0] != 0 || fake.offsets[1] != 17 {
+		t.Errorf("polled with offsets %v", fake.offsets)
+	}
+	fake.mu.Unlock()
+
+	body, err := bot.Download(context.Background(), notes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "OggS voice" {
+		t.Errorf("downloaded %q", data)
+	}
+	if _, err := bot.Download(context.Background(), notes[1]); err == nil || !strings.Contains(err.Error(), "invalid file_id") {
+		t.Errorf("got %v", err)
+	}
+
+	if err := bot.Reply(context.Background(), notes[1], "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	sent := fake.sent[0]
+	reply := sent["reply_parameters"].(map[string]any)
+	if sent["chat_id"] != "-100" || sent["text"] != "Hello" || reply["message_id"] != float64(2) || reply["allow_sending_without_reply"] != true {
+		t.Errorf("sent %v", sent)
+	}
+	fake.mu.Unlock()
+}
+
+func TestTelegramReplySplit(t *testing.T) {
+	api := (&fakeBotAPI{}).start(t)
+	bot, _ := NewTelegram(telegramToken, api.URL)
+	fake := api.Config.Handler.(*fakeBotAPI)
+
+	// Emoji take two UTF-16 code units, invalid UTF-8 is sent as it is
+	text := strings.Repeat("😀", maxTelegramText/2) + "a\xffb" + strings.Repeat("x", maxTelegramText)
+	if err := bot.Reply(context.Background(), VoiceNote{chat: "42", message: 1}, text); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var parts []string
+	for _, sent := range fake.sent {
+		part := sent["text"].(string)
+		if n := len(utf16.Encode([]rune(part))); n > maxTelegramText {
+			t.Errorf("sent %d code units", n)
+		}
+		parts = append(parts, part)
+	}
+	want := []string{strings.Repeat("😀", maxTelegramText/2), "a�b" + strings.Repeat("x", maxTelegramText-3), "xxx"}
+	if len(parts) != len(want) {
+		t.Fatalf("sent %d messages", len(parts))
+	}
+	for i := range want {
+		if parts[i] != want[i] {
+			t.Errorf("message %d: got %.20q… of %d bytes", i, parts[i], len(parts[i]))
+		}
+	}
+
+	if first, rest := splitTelegramText(""); first != "" || rest != "" {
+		t.Errorf("got %q, %q", first, rest)
+	}
+}
+
+func TestTelegramErrors(t *testing.T) {
+	api := (&fakeBotAPI{updates: `[]`}).start(t)
+
+	// A wrong token is reported by the API
+	bot, _ := NewTelegram("654321:wrong", api.URL)
+	if _, err := bot.Receive(context.Background()); err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("got %v", err)
+	}
+
+	// A proxy's error page is no Bot API response
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>Bad Gateway</html>", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	bot, _ = NewTelegram(telegramToken, proxy.URL)
+	if _, err := bot.Receive(context.Background()); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("got %v", err)
+	}
+
+	// The token, part of every URL, stays out of errors
+	proxy.Close()
+	if _, err := bot.Receive(context.Background()); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("got %v", err)
+	}
+	if err := bot.Reply(context.Background(), VoiceNote{chat: "42"}, "Hello"); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestNewTelegram(t *testing.T) {
+	if _, err := NewTelegram("", ""); err == nil {
+		t.Error("accepted a bot without a token")
+	}
+	for _, u := range []string{"api.telegram.org", "ftp://api.telegram.org", "https://", "http://[::1"} {
+		if _, err := NewTelegram(telegramToken, u); err == nil {
+			t.Errorf("accepted %q", u)
+		}
+	}
+	bot, err := NewTelegram(telegramToken, "")
+	if err != nil || bot.api != defaultTelegramAPI || bot.Name() != "telegram" {
+		t.Errorf("got %+v, %v", bot, err)
+	}
+}
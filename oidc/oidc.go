@@ -0,0 +1,265 @@
+// Package oidc signs users in with an OpenID Connect provider (Keycloak,
+// Authentik, Google, Microsoft Entra, Okta) using the authorization code
+// flow with PKCE, and verifies the ID tokens it issues
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest discovery document, key set or token response read
+	maxResponseSize = 1 << 20
+
+	// Discovery documents and key sets are fetched again after this long
+	refreshInterval = time.Hour
+
+	// Unknown key IDs refetch the key set at most this often, so forged
+	// tokens cannot hammer the provider
+	minKeyRefresh = time.Minute
+
+	// Clock difference tolerated when checking token times
+	leeway = time.Minute
+)
+
+// ErrInvalidToken is returned, wrapped, for tokens that fail verification
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// Config for a provider
+type Config struct {
+	// Issuer URL, e.g. https://accounts.google.com. The discovery document
+	// is read from <Issuer>/.well-known/openid-configuration.
+	Issuer string
+
+	// Credentials of the client registered with the provider
+	ClientID     string
+	ClientSecret string
+
+	// Where the provider sends users back to after signing in
+	RedirectURL string
+
+	// Scopes requested besides openid, e.g. profile, email or groups
+	Scopes []string
+}
+
+// Provider signs users in with one OpenID Connect provider
+type Provider struct {
+	config Config
+	http   *http.Client
+
+	mu          sync.Mutex
+	discovery   *discovery
+	discovered  time.Time
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+// discovery holds the fields of the discovery document that are used
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// New creates a provider. Its discovery document is read on first use.
+func New(cfg Config) (*Provider, error) {
+	u, err := url.Parse(cfg.Issuer)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid issuer URL %q", cfg.Issuer)
+	}
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("a client ID is required")
+	}
+	if _, err := url.Parse(cfg.RedirectURL); err != nil || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("invalid redirect URL %q", cfg.RedirectURL)
+	}
+	return &Provider{config: cfg, http: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Login holds the secrets of one sign-in, kept by the caller (e.g. in a
+// cookie) between AuthURL and Exchange
+type Login struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// NewLogin creates random secrets for a sign-in
+func NewLogin() (Login, error) {
+	var values [3]string
+	for i := range values {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return Login{}, fmt.Errorf("failed to generate login secrets: %w", err)
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	return Login{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// AuthURL is where to send the user to sign in
+func (p *Provider) AuthURL(ctx context.Context, login Login) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.config.Scopes...), " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the code the provider redirected back with for an ID
+// token, verifying it and that it belongs to the login
+func (p *Provider) Exchange(ctx context.Context, code string, login Login) (*Token, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {login.Verifier},
+	}
+	// client_secret_basic is the default, some providers only take the
+	// secret in the form
+	postSecret := len(d.TokenAuthMethods) > 0 && !contains(d.TokenAuthMethods, "client_secret_basic") &&
+		contains(d.TokenAuthMethods, "client_secret_post")
+	if postSecret || p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+		if p.config.ClientSecret != "" {
+			form.Set("client_secret", p.config.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !postSecret && p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var response struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := p.do(req, &response, true); err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("provider refused authorization code: %s %s", response.Error, response.Description)
+	}
+	if response.IDToken == "" {
+		return nil, fmt.Errorf("provider returned no ID token")
+	}
+
+	token, err := p.Verify(ctx, response.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if token.Nonce != login.Nonce {
+		return nil, fmt.Errorf("%w: nonce does not match the login", ErrInvalidToken)
+	}
+	return token, nil
+}
+
+// discover returns the provider's discovery document, fetching it when
+// missing or old
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discovered) < refreshInterval {
+		return p.discovery, nil
+	}
+
+	target := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	var d discovery
+	if err := p.do(req, &d, false); err != nil {
+		if p.discovery != nil {
+			// Keep signing users in through a provider hiccup
+			return p.discovery, nil
+		}
+		return nil, fmt.Errorf("failed to read OpenID Connect discovery document: %w", err)
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("provider names its issuer %q instead of %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("OpenID Connect discovery document lacks endpoints")
+	}
+
+	p.discovery, p.discovered = &d, time.Now()
+	return p.discovery, nil
+}
+
+// do sends a request and decodes its JSON response. Error responses are
+// decoded too when errorBody is set, as token endpoints describe errors in
+// their body.
+func (p *Provider) do(req *http.Request, out any, errorBody bool) error {
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if errorBody && json.Unmarshal(data, out) == nil {
+			return nil
+		}
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", req.URL.Host, err)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
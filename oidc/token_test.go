@@ -0,0 +1,243 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProvider is an issuer serving discovery and the public halves of its
+// signing keys, by key ID
+type testProvider struct {
+	server *httptest.Server
+	keys   map[string]crypto.Signer
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testProvider{keys: map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey, "ed": edKey}}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	keys := []jwk{
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: encode(rsaKey.N.Bytes()), E: encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(ecKey.X.FillBytes(make([]byte, 32))), Y: encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: encode(edKey.Public().(ed25519.PublicKey))},
+		// Encryption keys are not used to verify
+		{Kty: "RSA", Kid: "enc", Use: "enc", N: encode(rsaKey.N.Bytes()), E: encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discovery{
+			Issuer:                tp.server.URL,
+			AuthorizationEndpoint: tp.server.URL + "/authorize",
+			TokenEndpoint:         tp.server.URL + "/token",
+			JWKSURI:               tp.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	tp.server = httptest.NewServer(mux)
+	t.Cleanup(tp.server.Close)
+	return tp
+}
+
+// claims returns the claims of a valid token for the client
+func (tp *testProvider) claims() map[string]any {
+	return map[string]any{
+		"iss":   tp.server.URL,
+		"sub":   "248289761001",
+		"aud":   "libas",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": "n-0S6_WzA2Mj",
+	}
+}
+
+// sign encodes claims as a token signed with alg by the key with the ID.
+// "none" leaves the signature empty and HS256 signs with secret.
+func (tp *testProvider) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := tp.keys[kid]; alg {
+	case "none":
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte("client secret"))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	default:
+		t.Fatalf("cannot sign with %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	tp := newTestProvider(t)
+	p, err := New(Config{Issuer: tp.server.URL, ClientID: "libas", ClientSecret: "client secret", RedirectURL: "https://scribe.example.com/auth/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(changes map[string]any) map[string]any {
+		claims := tp.claims()
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	valid := tp.sign(t, "RS256", "rsa", tp.claims())
+	parts := strings.Split(valid, ".")
+	ecParts := strings.Split(tp.sign(t, "ES256", "ec", tp.claims()), ".")
+	forged, _ := json.Marshal(with(map[string]any{"sub": "admin"}))
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", valid, true},
+		{"PS256", tp.sign(t, "PS256", "rsa", tp.claims()), true},
+		{"ES256", tp.sign(t, "ES256", "ec", tp.claims()), true},
+		{"EdDSA", tp.sign(t, "EdDSA", "ed", tp.claims()), true},
+		{"audience list", tp.sign(t, "RS256", "rsa", with(map[string]any{"aud": []string{"other", "libas"}, "azp": "libas"})), true},
+		{"expired within the leeway", tp.sign(t, "RS256", "rsa", with(map[string]any{"exp": time.Now().Add(-leeway / 2).Unix()})), true},
+
+		{"alg none", tp.sign(t, "none", "rsa", tp.claims()), false},
+		{"HS256 with the client secret", tp.sign(t, "HS256", "rsa", tp.claims()), false},
+		{"RS256 with an EC key", headerFor(t, "RS256", "ec") + "." + ecParts[1] + "." + ecParts[2], false},
+		{"ES256 with an RSA key", headerFor(t, "ES256", "rsa") + "." + parts[1] + "." + parts[2], false},
+		{"claims changed after signing", parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2], false},
+		{"signature of another key", headerFor(t, "ES256", "ec") + "." + parts[1] + "." + ecParts[2], false},
+		{"unknown key", headerFor(t, "RS256", "other") + "." + parts[1] + "." + parts[2], false},
+		{"encryption key", headerFor(t, "RS256", "enc") + "." + parts[1] + "." + parts[2], false},
+		{"other issuer", tp.sign(t, "RS256", "rsa", with(map[string]any{"iss": "https://evil.example.com"})), false},
+		{"no issuer", tp.sign(t, "RS256", "rsa", with(map[string]any{"iss": nil})), false},
+		{"other audience", tp.sign(t, "RS256", "rsa", with(map[string]any{"aud": "other"})), false},
+		{"no audience", tp.sign(t, "RS256", "rsa", with(map[string]any{"aud": nil})), false},
+		{"authorized for another client", tp.sign(t, "RS256", "rsa", with(map[string]any{"aud": []string{"other", "libas"}, "azp": "other"})), false},
+		{"expired", tp.sign(t, "RS256", "rsa", with(map[string]any{"exp": time.Now().Add(-2 * leeway).Unix()})), false},
+		{"no expiry", tp.sign(t, "RS256", "rsa", with(map[string]any{"exp": nil})), false},
+		{"expiry as a string", tp.sign(t, "RS256", "rsa", with(map[string]any{"exp": "2099-01-01"})), false},
+		{"not valid yet", tp.sign(t, "RS256", "rsa", with(map[string]any{"nbf": time.Now().Add(2 * leeway).Unix()})), false},
+		{"two segments", parts[0] + "." + parts[1], false},
+		{"malformed signature", parts[0] + "." + parts[1] + ".!", false},
+		{"header without alg or key", "e30." + parts[1] + "." + parts[2], false},
+	}
+	for _, tt := range tests {
+		token, err := p.Verify(context.Background(), tt.token)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.ok && (token.Subject != "248289761001" || token.Nonce != "n-0S6_WzA2Mj"):
+			t.Errorf("%s: got subject %q and nonce %q", tt.name, token.Subject, token.Nonce)
+		case !tt.ok && !errors.Is(err, ErrInvalidToken):
+			t.Errorf("%s: got %v, want ErrInvalidToken", tt.name, err)
+		}
+	}
+}
+
+// headerFor encodes a token header naming alg and kid
+func headerFor(t *testing.T, alg, kid string) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(header)
+}
+
+func TestTokenClaims(t *testing.T) {
+	token := &Token{Claims: map[string]any{
+		"name":   "Jo",
+		"groups": []any{"admins", 7, "ops"},
+		"role":   "viewer",
+	}}
+	if got := token.String("name"); got != "Jo" {
+		t.Errorf("name is %q", got)
+	}
+	if got := token.String("groups"); got != "" {
+		t.Errorf("list read as string %q", got)
+	}
+	if got := token.Strings("groups"); len(got) != 2 || got[0] != "admins" || got[1] != "ops" {
+		t.Errorf("groups are %q", got)
+	}
+	if got := token.Strings("role"); len(got) != 1 || got[0] != "viewer" {
+		t.Errorf("single group is %q", got)
+	}
+	if got := token.Strings("missing"); got != nil {
+		t.Errorf("missing claim is %q", got)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  jwk
+	}{
+		{"unknown type", jwk{Kty: "oct"}},
+		{"unknown curve", jwk{Kty: "EC", Crv: "P-192", X: "AQ", Y: "AQ"}},
+		{"point off the curve", jwk{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}},
+		{"short Ed25519 key", jwk{Kty: "OKP", Crv: "Ed25519", X: "AQ"}},
+		{"X25519 key", jwk{Kty: "OKP", Crv: "X25519", X: base64.RawURLEncoding.EncodeToString(make([]byte, 32))}},
+		{"huge RSA exponent", jwk{Kty: "RSA", N: "AQ", E: "AQAAAAAA"}},
+		{"malformed modulus", jwk{Kty: "RSA", N: "!", E: "AQAB"}},
+	}
+	for _, tt := range tests {
+		if key, err := tt.key.publicKey(); err == nil {
+			t.Errorf("%s: parsed as %T", tt.name, key)
+		}
+	}
+}
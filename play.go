@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	libascli "github.com/bosley/libas/client"
+)
+
+func runPlay(args []string) error {
+	fs := newFlagSet("play")
+	ffmpegPath := addFFmpegFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected one audio file")
+	}
+
+	if err := configureFFmpeg(*ffmpegPath); err != nil {
+		return fmt.Errorf("invalid ffmpeg path: %w", err)
+	}
+
+	if err := libascli.PlayAudioFile(fs.Arg(0)); err != nil {
+		return fmt.Errorf("failed to play audio file: %w", err)
+	}
+	return nil
+}
+
+func runDevices(args []string) error {
+	fs := newFlagSet("devices")
+	testID := fs.Int("test", -1, "Record from this device ID (0 for the default device), play it back and report levels")
+	duration := fs.Duration("duration", 5*time.Second, "How long -test records")
+	playback := fs.Bool("playback", true, "Play the -test recording back")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *testID >= 0 {
+		return testDevice(*testID, *duration, *playback)
+	}
+
+	devices, err := libascli.ListAudioDevices()
+	if err != nil {
+		return fmt.Errorf("failed to list audio devices: %w", err)
+	}
+
+	fmt.Println("Available audio input devices (capture uses the default device unless -device is given):")
+	for _, device := range devices {
+		fmt.Printf("[%d] %s\n", device.ID, device.Name)
+		if device.HostApi != nil {
+			// Windows lists each device once per host API (MME, DirectSound, WASAPI)
+			fmt.Printf("    Host API: %s\n", device.HostApi.Name)
+		}
+		fmt.Printf("    Max Input Channels: %d\n", device.MaxInputChannels)
+		fmt.Printf("    Default Sample Rate: %f\n", device.DefaultSampleRate)
+		fmt.Println()
+	}
+	return nil
+}
+
+// testDevice records from a device and reports whether its levels suit
+// voice detection
+func testDevice(deviceID int, duration time.Duration, playback bool) error {
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	fmt.Printf("Recording %s, speak normally after a moment of silence...\n", duration)
+	test, err := libascli.TestDevice(ctx, deviceID, duration)
+	if err != nil {
+		return fmt.Errorf("failed to test device: %w", err)
+	}
+
+	fmt.Printf("\nDevice:       %s\n", test.Device)
+	fmt.Printf("Recorded:     %s at %.0f Hz\n", test.Duration.Round(time.Millisecond), test.SampleRate)
+	fmt.Printf("Noise floor:  %.1f dBFS\n", test.NoiseFloorDB)
+	fmt.Printf("Level:        %.1f dBFS RMS, %.1f dBFS peak\n", test.RMSDB, test.PeakDB)
+	fmt.Printf("Clipping:     %d samples (%.3f%%)\n", test.ClippedSamples, 100*test.ClippingRatio())
+
+	fmt.Println()
+	switch {
+	case len(test.Recording.Samples) == 0:
+		fmt.Println("No audio was recorded, check the device and its permissions.")
+	case test.ClippingRatio() > 0.001:
+		fmt.Println("The input clips, lower the input gain.")
+	case test.PeakDB < -30:
+		fmt.Println("The input is very quiet, raise the input gain or move closer to the microphone.")
+	case test.NoiseFloorDB > -40:
+		fmt.Println("The background is loud, voice detection may trigger on noise.")
+	default:
+		fmt.Println("Levels look good.")
+	}
+
+	if playback && len(test.Recording.Samples) > 0 && ctx.Err() == nil {
+		fmt.Println("\nPlaying the recording back...")
+		if err := libascli.PlayPCM(ctx, test.Recording); err != nil {
+			return fmt.Errorf("failed to play recording: %w", err)
+		}
+	}
+	return nil
+}
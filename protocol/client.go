@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/bosley/libas/fault"
+	"github.com/google/uuid"
+)
+
+// ClientEncoder writes what a client sends
+type ClientEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewClientEncoder creates an encoder writing to a server connection
+func NewClientEncoder(w io.Writer) *ClientEncoder {
+	return &ClientEncoder{w: w}
+}
+
+// Token sends the server's token, which opens the connection
+func (e *ClientEncoder) Token(token string) error {
+	_, err := io.WriteString(e.w, token)
+	return err
+}
+
+// Format requests a capture rate, to be answered by the server with the
+// rate it accepted
+func (e *ClientEncoder) Format(rate int) error {
+	return e.write(AppendFormat(e.buf[:0], rate))
+}
+
+// Announce tells the server the kinds of messages the client acts on:
+// Speech, Live, Mute or Continuous
+func (e *ClientEncoder) Announce(kinds ...Kind) error {
+	buf := e.buf[:0]
+	for _, kind := range kinds {
+		buf = AppendMarker(buf, kind)
+	}
+	return e.write(buf)
+}
+
+// Start starts a transmission
+func (e *ClientEncoder) Start() error {
+	return e.write(AppendMarker(e.buf[:0], Start))
+}
+
+// Chunk sends a chunk of the transmission
+func (e *ClientEncoder) Chunk(samples []int16) error {
+	return e.write(AppendChunk(e.buf[:0], samples))
+}
+
+// End ends the transmission
+func (e *ClientEncoder) End() error {
+	return e.write(AppendMarker(e.buf[:0], End))
+}
+
+// HealthReport reports metrics of the device, which the server asked for
+func (e *ClientEncoder) HealthReport(metrics map[string]float64) error {
+	message, err := AppendHealthReport(e.buf[:0], metrics)
+	if err != nil {
+		return err
+	}
+	return e.write(message)
+}
+
+func (e *ClientEncoder) write(message []byte) error {
+	e.buf = message
+	_, err := e.w.Write(message)
+	return err
+}
+
+// ServerDecoder reads what a server sends
+type ServerDecoder struct {
+	r   io.Reader
+	buf [12]byte
+}
+
+// NewServerDecoder creates a decoder reading from a server connection
+func NewServerDecoder(r io.Reader) *ServerDecoder {
+	return &ServerDecoder{r: r}
+}
+
+// ClientID reads the ID the server answered the token with. A server that
+// refuses the token hangs up instead, which is io.EOF.
+func (d *ServerDecoder) ClientID() (uuid.UUID, error) {
+	var id uuid.UUID
+	if _, err := io.ReadFull(d.r, id[:]); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+// FormatReply reads the capture rate the server accepted
+func (d *ServerDecoder) FormatReply() (int, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:4]); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(d.buf[:4])), nil
+}
+
+// Next reads the next message. A marker this revision does not know is
+// an error wrapping fault.ErrProtocol, as its length is unknown and
+// nothing after it can be read.
+func (d *ServerDecoder) Next() (Message, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:4]); err != nil {
+		return Message{}, err
+	}
+	switch marker := binary.BigEndian.Uint32(d.buf[:4]); marker {
+	case vadMarker:
+		value, err := d.read(8)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{Kind: VAD, Threshold: math.Float64frombits(binary.BigEndian.Uint64(value))}, nil
+	case refusedMarker:
+		value, err := d.read(4)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{Kind: Refused, Reason: binary.BigEndian.Uint32(value)}, nil
+	case speechMarker, liveMarker:
+		kind := Speech
+		if marker == liveMarker {
+			kind = Live
+		}
+		return d.audio(kind)
+	case muteMarker:
+		value, err := d.read(8)
+		if err != nil {
+			return Message{}, err
+		}
+		message := Message{Kind: Mute}
+		if millis := int64(binary.BigEndian.Uint64(value)); millis > 0 {
+			message.Until = time.UnixMilli(millis)
+		}
+		return message, nil
+	case unmuteMarker:
+		return Message{Kind: Unmute}, nil
+	case continuousMarker:
+		value, err := d.read(4)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{Kind: Continuous, On: binary.BigEndian.Uint32(value) != 0}, nil
+	case healthMarker:
+		value, err := d.read(4)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{Kind: Health, Interval: time.Duration(binary.BigEndian.Uint32(value)) * time.Second}, nil
+	default:
+		return Message{}, fmt.Errorf("%w: unknown marker %#08x", fault.ErrProtocol, marker)
+	}
+}
+
+// audio reads speech or live audio past its marker
+func (d *ServerDecoder) audio(kind Kind) (Message, error) {
+	header, err := d.read(8)
+	if err != nil {
+		return Message{}, err
+	}
+	rate := binary.BigEndian.Uint32(header[0:4])
+	size := binary.BigEndian.Uint32(header[4:8])
+	if rate == 0 || size > MaxSpeechSize || size%2 != 0 {
+		return Message{}, fmt.Errorf("%w: %s of %d bytes at %dHz", fault.ErrProtocol, kind, size, rate)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return Message{}, unexpected(err)
+	}
+	return Message{Kind: kind, SampleRate: int(rate), Samples: decodeSamples(data)}, nil
+}
+
+// read reads the n bytes following a marker
+func (d *ServerDecoder) read(n int) ([]byte, error) {
+	if _, err := io.ReadFull(d.r, d.buf[4:4+n]); err != nil {
+		return nil, unexpected(err)
+	}
+	return d.buf[4 : 4+n], nil
+}
+
+// unexpected is the error of a message cut short
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
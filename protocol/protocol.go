@@ -0,0 +1,297 @@
+// Package protocol is the codec of the audio stream protocol between
+// capture clients and the server, so clients for microcontrollers, phones
+// and other languages can be written against it rather than against the
+// capture client.
+//
+// A client connects over TLS and sends the server's token as is, without
+// a length. The server hangs up on a wrong token, or else answers with the
+// client's ID, the 16 bytes of a UUID. From then on every message starts
+// with a big endian uint32: a marker, or within a transmission the size of
+// an audio chunk. Audio is mono 16-bit little endian PCM, all other
+// numbers are big endian. On a trusted LAN, servers may also accept plain
+// TCP connections authenticating every frame with a pre-shared key instead
+// of TLS and the token, see PSKConn.
+//
+// Clients send:
+//
+//	FFFFFFFE rate:u32             request a capture rate, answered by the bare rate accepted
+//	FFFFFFFB                      announce playing speech
+//	FFFFFFFA                      announce playing live audio
+//	FFFFFFF9                      announce not transmitting while muted
+//	FFFFFFF7                      announce recording continuously on request
+//	FFFFFFF6                      announce reporting health on request
+//	FFFFFFFF                      start a transmission
+//	size:u32 samples              an audio chunk of a transmission, up to 1 MiB
+//	00000000                      end the transmission
+//	FFFFFFF5 size:u32 json        report health, up to 4 KiB, within a transmission too
+//
+// A capture rate request comes first, as the server answers it with the
+// rate alone, 16000 or 44100. Clients that send none capture at 44100.
+// Servers ignore markers they do not know outside a transmission, so
+// announcing what a client supports is safe with older servers. Once the
+// client sent anything past its ID, the server may send:
+//
+//	FFFFFFFD threshold:f64        change the speech threshold, IEEE 754 bits
+//	FFFFFFFC reason:u32           refuse the transmission, 1 when storage is full
+//	FFFFFFFB rate:u32 size:u32 samples   speech to play, up to 16 MiB
+//	FFFFFFFA rate:u32 size:u32 samples   a chunk of live audio from another client
+//	FFFFFFF9 until:u64            mute until unix milliseconds, zero for no end
+//	FFFFFFF8                      unmute
+//	FFFFFFF7 on:u32               start (1) or stop (0) recording continuously
+//	FFFFFFF6 interval:u32         report health every interval seconds, zero to stop
+//
+// Speech and live audio only go to clients that announced playing them,
+// mutes and continuous recording only to those that announced obeying
+// them, and requests for health reports to those that announced reporting
+// it. A health report is a JSON object of metric names to numbers, such as
+// battery in percent, temperature in degrees Celsius and signal in dBm.
+// This is revision 7, version.Protocol, of the protocol. Vectors
+// holds encoded messages to check other codecs against, PSKVectors frames.
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// Size of the client ID the server answers the token with
+	ClientIDSize = 16
+
+	// Largest audio chunk servers accept, far above the 2 KiB the capture
+	// client sends, so a corrupt size cannot make them allocate gigabytes
+	MaxChunkSize = 1 << 20
+
+	// Largest speech or chunk of live audio clients accept, about six
+	// minutes at 22.05kHz
+	MaxSpeechSize = 16 << 20
+
+	// Largest health report
+	MaxHealthSize = 4 << 10
+
+	// Reason of a refusal: the server's recordings volume is nearly full
+	RefusedStorageFull = 1
+)
+
+// Markers opening messages
+const (
+	startMarker      = 0xFFFFFFFF
+	endMarker        = 0x00000000
+	formatMarker     = 0xFFFFFFFE
+	vadMarker        = 0xFFFFFFFD
+	refusedMarker    = 0xFFFFFFFC
+	speechMarker     = 0xFFFFFFFB
+	liveMarker       = 0xFFFFFFFA
+	muteMarker       = 0xFFFFFFF9
+	unmuteMarker     = 0xFFFFFFF8
+	continuousMarker = 0xFFFFFFF7
+	healthMarker     = 0xFFFFFFF6
+	reportMarker     = 0xFFFFFFF5
+)
+
+// Kind of a message
+type Kind uint8
+
+const (
+	Start Kind = iota + 1
+	End
+	Chunk
+	Format
+	VAD
+	Refused
+	Speech
+	Live
+	Mute
+	Unmute
+	Continuous
+	Health
+	HealthReport
+)
+
+var kindNames = map[Kind]string{
+	Start:        "start",
+	End:          "end",
+	Chunk:        "chunk",
+	Format:       "format",
+	VAD:          "vad",
+	Refused:      "refused",
+	Speech:       "speech",
+	Live:         "live",
+	Mute:         "mute",
+	Unmute:       "unmute",
+	Continuous:   "continuous",
+	Health:       "health",
+	HealthReport: "health report",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Markers of the kinds a client announces, they open messages of the same
+// kind from the server
+var announcements = map[Kind]uint32{
+	Speech:     speechMarker,
+	Live:       liveMarker,
+	Mute:       muteMarker,
+	Continuous: continuousMarker,
+	Health:     healthMarker,
+}
+
+// Message is a message after the handshake. Which fields are set depends
+// on its Kind and on who sent it: an announcement from a client carries
+// nothing, the message of the same kind from the server does.
+type Message struct {
+	Kind Kind
+
+	// Size in bytes of an audio chunk, whose samples follow
+	Size int
+
+	// Rate of a capture rate request, speech or live audio
+	SampleRate int
+
+	// Samples of speech or live audio
+	Samples []int16
+
+	// Speech threshold, as a ratio over the background noise
+	Threshold float64
+
+	// Why a transmission was refused
+	Reason uint32
+
+	// End of a mute, zero for none
+	Until time.Time
+
+	// Whether continuous recording starts
+	On bool
+
+	// Time between health reports, zero for none
+	Interval time.Duration
+
+	// Metrics of a health report
+	Metrics map[string]float64
+}
+
+// AppendMarker appends a message that is only a marker: Start, End or
+// Unmute, or an announcement of Speech, Live, Mute, Continuous or Health
+func AppendMarker(dst []byte, kind Kind) []byte {
+	switch kind {
+	case Start:
+		return binary.BigEndian.AppendUint32(dst, startMarker)
+	case End:
+		return binary.BigEndian.AppendUint32(dst, endMarker)
+	case Unmute:
+		return binary.BigEndian.AppendUint32(dst, unmuteMarker)
+	}
+	if marker, ok := announcements[kind]; ok {
+		return binary.BigEndian.AppendUint32(dst, marker)
+	}
+	panic("protocol: " + kind.String() + " is not a marker")
+}
+
+// AppendFormat appends a request for a capture rate
+func AppendFormat(dst []byte, rate int) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, formatMarker)
+	return binary.BigEndian.AppendUint32(dst, uint32(rate))
+}
+
+// AppendChunk appends an audio chunk: its size in bytes and the samples
+func AppendChunk(dst []byte, samples []int16) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(2*len(samples)))
+	return appendSamples(dst, samples)
+}
+
+// AppendVAD appends a change of the speech threshold
+func AppendVAD(dst []byte, threshold float64) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, vadMarker)
+	return binary.BigEndian.AppendUint64(dst, math.Float64bits(threshold))
+}
+
+// AppendRefused appends the refusal of a transmission
+func AppendRefused(dst []byte, reason uint32) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, refusedMarker)
+	return binary.BigEndian.AppendUint32(dst, reason)
+}
+
+// AppendAudio appends speech or a chunk of live audio, kind being Speech
+// or Live
+func AppendAudio(dst []byte, kind Kind, rate int, samples []int16) []byte {
+	dst = AppendAudioHeader(dst, kind, rate, 2*len(samples))
+	return appendSamples(dst, samples)
+}
+
+// AppendAudioHeader appends what precedes the samples of speech or a chunk
+// of live audio, for audio already encoded as size bytes of samples
+func AppendAudioHeader(dst []byte, kind Kind, rate, size int) []byte {
+	if kind != Speech && kind != Live {
+		panic("protocol: " + kind.String() + " is not audio")
+	}
+	dst = binary.BigEndian.AppendUint32(dst, announcements[kind])
+	dst = binary.BigEndian.AppendUint32(dst, uint32(rate))
+	return binary.BigEndian.AppendUint32(dst, uint32(size))
+}
+
+// AppendMute appends a mute until the given time, or without an end when
+// it is zero
+func AppendMute(dst []byte, until time.Time) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, muteMarker)
+	var millis uint64
+	if !until.IsZero() {
+		millis = uint64(until.UnixMilli())
+	}
+	return binary.BigEndian.AppendUint64(dst, millis)
+}
+
+// AppendContinuous appends the start or stop of continuous recording
+func AppendContinuous(dst []byte, on bool) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, continuousMarker)
+	var value uint32
+	if on {
+		value = 1
+	}
+	return binary.BigEndian.AppendUint32(dst, value)
+}
+
+// AppendHealth appends a request for health reports every interval, in
+// whole seconds, or to stop them when it is zero
+func AppendHealth(dst []byte, interval time.Duration) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, healthMarker)
+	return binary.BigEndian.AppendUint32(dst, uint32(interval/time.Second))
+}
+
+// AppendHealthReport appends a health report of the metrics, which have to
+// be finite and fit in MaxHealthSize
+func AppendHealthReport(dst []byte, metrics map[string]float64) ([]byte, error) {
+	report, err := json.Marshal(metrics)
+	if err != nil {
+		return dst, fmt.Errorf("failed to encode health report: %w", err)
+	}
+	if len(report) > MaxHealthSize {
+		return dst, fmt.Errorf("health report of %d bytes exceeds %d", len(report), MaxHealthSize)
+	}
+	dst = binary.BigEndian.AppendUint32(dst, reportMarker)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(report)))
+	return append(dst, report...), nil
+}
+
+func appendSamples(dst []byte, samples []int16) []byte {
+	for _, sample := range samples {
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(sample))
+	}
+	return dst
+}
+
+// decodeSamples decodes little endian samples, an odd last byte is dropped
+func decodeSamples(data []byte) []int16 {
+	samples := make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+	return samples
+}
@@ -0,0 +1,195 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// vector is a message as it goes over the wire, for checking codecs
+// against. Those a client sends are decoded as one stream in order, so the
+// chunk is within the transmission started before it.
+type vector struct {
+	name string
+
+	// Whether a client sends it, otherwise the server does
+	fromClient bool
+
+	// The bytes on the wire in hex, spaced for reading
+	wire string
+
+	message Message
+}
+
+// vectors are the messages of the current revision, the reference for
+// codecs in other languages
+var vectors = []vector{
+	{"format request for 16kHz", true, "FFFFFFFE 00003E80", Message{Kind: Format, SampleRate: 16000}},
+	{"announce playing speech", true, "FFFFFFFB", Message{Kind: Speech}},
+	{"announce playing live audio", true, "FFFFFFFA", Message{Kind: Live}},
+	{"announce not transmitting while muted", true, "FFFFFFF9", Message{Kind: Mute}},
+	{"announce recording continuously", true, "FFFFFFF7", Message{Kind: Continuous}},
+	{"announce reporting health", true, "FFFFFFF6", Message{Kind: Health}},
+	{"start of a transmission", true, "FFFFFFFF", Message{Kind: Start}},
+	{"chunk of three samples", true, "00000006 0100 FFFF 3412", Message{Kind: Chunk, Size: 6, Samples: []int16{1, -1, 0x1234}}},
+	{"health report within the transmission", true, "FFFFFFF5 00000021 7B2262617474657279223A38372C2274656D7065726174757265223A34382E357D", Message{Kind: HealthReport, Metrics: map[string]float64{"battery": 87, "temperature": 48.5}}},
+	{"end of the transmission", true, "00000000", Message{Kind: End}},
+
+	{"speech threshold of 2.5", false, "FFFFFFFD 4004000000000000", Message{Kind: VAD, Threshold: 2.5}},
+	{"transmission refused for storage", false, "FFFFFFFC 00000001", Message{Kind: Refused, Reason: RefusedStorageFull}},
+	{"speech at 22.05kHz", false, "FFFFFFFB 00005622 00000006 0000 FF7F 0080", Message{Kind: Speech, SampleRate: 22050, Samples: []int16{0, 32767, -32768}}},
+	{"live audio at 16kHz", false, "FFFFFFFA 00003E80 00000002 0001", Message{Kind: Live, SampleRate: 16000, Samples: []int16{256}}},
+	{"mute until 2023-11-14 22:13:20 UTC", false, "FFFFFFF9 0000018BCFE56800", Message{Kind: Mute, Until: time.UnixMilli(1700000000000)}},
+	{"mute without end", false, "FFFFFFF9 0000000000000000", Message{Kind: Mute}},
+	{"unmute", false, "FFFFFFF8", Message{Kind: Unmute}},
+	{"start continuous recording", false, "FFFFFFF7 00000001", Message{Kind: Continuous, On: true}},
+	{"stop continuous recording", false, "FFFFFFF7 00000000", Message{Kind: Continuous}},
+	{"report health every minute", false, "FFFFFFF6 0000003C", Message{Kind: Health, Interval: time.Minute}},
+}
+
+// Key and nonce of the PSK vectors
+var (
+	pskVectorKey   = []byte("0123456789abcdef")
+	pskVectorNonce = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+)
+
+// pskVector is a frame of a PSK connection as it goes over the wire
+type pskVector struct {
+	name       string
+	fromClient bool
+	seq        uint64
+
+	// The payload and the frame in hex, spaced for reading
+	payload string
+	wire    string
+}
+
+// pskVectors are frames under pskVectorKey and pskVectorNonce
+var pskVectors = []pskVector{
+	{"first frame of the client", true, 0, "", "00000000 9ABF27E196A1A280B09122C7F810F45A"},
+	{"start of a transmission", true, 1, "FFFFFFFF", "00000004 FFFFFFFF D7216334E446D19A952362DE67690F57"},
+	{"unmute", false, 0, "FFFFFFF8", "00000004 FFFFFFF8 9464F8E740A3A0C5EDD1AE436044C7D6"},
+}
+
+// bytes decodes the wire of a vector
+func (v vector) bytes() []byte {
+	return decodeHex(v.name, v.wire)
+}
+
+func decodeHex(name, s string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic("protocol: invalid vector " + name)
+	}
+	return data
+}
+
+func TestEncode(t *testing.T) {
+	for _, v := range vectors {
+		var encoded bytes.Buffer
+		if v.fromClient {
+			encodeClient(NewClientEncoder(&encoded), v.message)
+		} else {
+			encodeServer(NewServerEncoder(&encoded), v.message)
+		}
+		if !bytes.Equal(encoded.Bytes(), v.bytes()) {
+			t.Errorf("%s: encoded as %X, want %s", v.name, encoded.Bytes(), v.wire)
+		}
+	}
+}
+
+// The client vectors are decoded as one stream, as a server reads them
+func TestDecodeClient(t *testing.T) {
+	var stream bytes.Buffer
+	for _, v := range vectors {
+		if v.fromClient {
+			stream.Write(v.bytes())
+		}
+	}
+	decoder := NewClientDecoder(&stream)
+	for _, v := range vectors {
+		if !v.fromClient {
+			continue
+		}
+		message, err := decoder.Next()
+		if err == nil && message.Kind == Chunk {
+			message.Samples, err = decoder.Samples()
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %v", v.name, err)
+		}
+		if !reflect.DeepEqual(message, v.message) {
+			t.Fatalf("%s: decoded as %+v, want %+v", v.name, message, v.message)
+		}
+	}
+	if _, err := decoder.Next(); err != io.EOF {
+		t.Errorf("client stream not consumed: %v", err)
+	}
+}
+
+func TestDecodeServer(t *testing.T) {
+	for _, v := range vectors {
+		if v.fromClient {
+			continue
+		}
+		message, err := NewServerDecoder(bytes.NewReader(v.bytes())).Next()
+		if err != nil {
+			t.Errorf("%s: failed to decode: %v", v.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(message, v.message) {
+			t.Errorf("%s: decoded as %+v, want %+v", v.name, message, v.message)
+		}
+	}
+}
+
+func TestPSKFrames(t *testing.T) {
+	for _, v := range pskVectors {
+		frame := AppendFrame(nil, pskVectorKey, pskVectorNonce, v.fromClient, v.seq, decodeHex(v.name, v.payload))
+		if !bytes.Equal(frame, decodeHex(v.name, v.wire)) {
+			t.Errorf("%s: framed as %X, want %s", v.name, frame, v.wire)
+		}
+	}
+}
+
+func encodeClient(e *ClientEncoder, m Message) {
+	switch m.Kind {
+	case Format:
+		e.Format(m.SampleRate)
+	case Start:
+		e.Start()
+	case Chunk:
+		e.Chunk(m.Samples)
+	case End:
+		e.End()
+	case HealthReport:
+		e.HealthReport(m.Metrics)
+	default:
+		e.Announce(m.Kind)
+	}
+}
+
+func encodeServer(e *ServerEncoder, m Message) {
+	switch m.Kind {
+	case VAD:
+		e.VAD(m.Threshold)
+	case Refused:
+		e.Refused(m.Reason)
+	case Speech:
+		e.Speech(m.SampleRate, m.Samples)
+	case Live:
+		e.Live(m.SampleRate, m.Samples)
+	case Mute:
+		e.Mute(m.Until)
+	case Unmute:
+		e.Unmute()
+	case Continuous:
+		e.Continuous(m.On)
+	case Health:
+		e.Health(m.Interval)
+	}
+}
@@ -0,0 +1,201 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/bosley/libas/fault"
+)
+
+const (
+	// Size of the nonce a server opens a PSK connection with
+	NonceSize = 16
+
+	// Size of the truncated HMAC-SHA256 closing each frame
+	TagSize = 16
+
+	// Largest frame payload, a chunk with its size
+	MaxFrameSize = MaxChunkSize + 4
+
+	// Shortest pre-shared key accepted
+	MinKeySize = 16
+)
+
+// Directions mixed into tags, so a frame cannot be reflected back to its
+// sender
+const (
+	clientDirection = 'C'
+	serverDirection = 'S'
+)
+
+// PSKConn carries the protocol over a plain connection on a trusted LAN,
+// for microcontrollers that cannot afford TLS. Each direction is a series
+// of frames, the payload authenticated with a key both sides were given:
+//
+//	size:u32 payload tag
+//
+// The tag is the first 16 bytes of HMAC-SHA256 under the key of the nonce
+// the server opened the connection with, the direction ('C' from the
+// client, 'S' from the server), the frame's sequence number in its
+// direction from zero as a u64, the size and the payload. The first frame
+// of the client is empty and stands for the token, the protocol then goes
+// on as over TLS from the client ID. Frames may split or join messages
+// freely. Audio is authenticated but not encrypted.
+type PSKConn struct {
+	net.Conn
+	key   []byte
+	nonce []byte
+
+	// Reads happen on one goroutine
+	readDirection byte
+	readSeq       uint64
+	readBuf       []byte
+	pending       []byte
+
+	writeMu        sync.Mutex
+	writeDirection byte
+	writeSeq       uint64
+	writeBuf       []byte
+}
+
+// ServerPSK opens a PSK connection accepted by a server, sending a fresh
+// nonce and checking the client's first frame. A client without the key is
+// an error wrapping fault.ErrAuthFailed.
+func ServerPSK(conn net.Conn, key []byte) (*PSKConn, error) {
+	if len(key) < MinKeySize {
+		return nil, fmt.Errorf("pre-shared key of %d bytes is shorter than %d", len(key), MinKeySize)
+	}
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return nil, err
+	}
+	c := newPSKConn(conn, key, nonce, clientDirection, serverDirection)
+	hello, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if len(hello) != 0 {
+		return nil, fmt.Errorf("%w: first frame of %d bytes is not empty", fault.ErrProtocol, len(hello))
+	}
+	return c, nil
+}
+
+// ClientPSK opens a PSK connection to a server, reading its nonce and
+// sending the empty first frame. A server that does not share the key
+// hangs up.
+func ClientPSK(conn net.Conn, key []byte) (*PSKConn, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return nil, err
+	}
+	c := newPSKConn(conn, key, nonce, serverDirection, clientDirection)
+	if _, err := c.Write(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newPSKConn(conn net.Conn, key, nonce []byte, readDirection, writeDirection byte) *PSKConn {
+	return &PSKConn{
+		Conn:           conn,
+		key:            key,
+		nonce:          nonce,
+		readDirection:  readDirection,
+		writeDirection: writeDirection,
+	}
+}
+
+// Read reads the payload of authentic frames. A frame failing its tag is an
+// error wrapping fault.ErrAuthFailed, one too large wraps
+// fault.ErrProtocol.
+func (c *PSKConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = payload
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p as one frame, or several when larger than MaxFrameSize
+func (c *PSKConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for {
+		payload := p[:min(len(p), MaxFrameSize)]
+		c.writeBuf = AppendFrame(c.writeBuf[:0], c.key, c.nonce, c.writeDirection == clientDirection, c.writeSeq, payload)
+		if _, err := c.Conn.Write(c.writeBuf); err != nil {
+			return written, err
+		}
+		c.writeSeq++
+		written += len(payload)
+		p = p[len(payload):]
+		if len(p) == 0 {
+			return written, nil
+		}
+	}
+}
+
+// readFrame reads the next frame, returning its payload
+func (c *PSKConn) readFrame() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("%w: frame of %d bytes exceeds %d", fault.ErrProtocol, size, MaxFrameSize)
+	}
+	if cap(c.readBuf) < int(size)+TagSize {
+		c.readBuf = make([]byte, int(size)+TagSize)
+	}
+	frame := c.readBuf[:int(size)+TagSize]
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return nil, unexpected(err)
+	}
+	payload, tag := frame[:size], frame[size:]
+	if !hmac.Equal(tag, frameTag(c.key, c.nonce, c.readDirection, c.readSeq, payload)) {
+		return nil, fmt.Errorf("%w: frame %d failed authentication", fault.ErrAuthFailed, c.readSeq)
+	}
+	c.readSeq++
+	return payload, nil
+}
+
+// AppendFrame appends a PSK frame carrying payload, the seq-th frame sent
+// by the client or the server in the connection opened with nonce
+func AppendFrame(dst, key, nonce []byte, fromClient bool, seq uint64, payload []byte) []byte {
+	direction := byte(serverDirection)
+	if fromClient {
+		direction = clientDirection
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = append(dst, payload...)
+	return append(dst, frameTag(key, nonce, direction, seq, payload)...)
+}
+
+// frameTag authenticates the payload of a frame
+func frameTag(key, nonce []byte, direction byte, seq uint64, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	var header [13]byte
+	header[0] = direction
+	binary.BigEndian.PutUint64(header[1:9], seq)
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(payload)))
+	mac.Write(header[:])
+	mac.Write(payload)
+	return mac.Sum(nil)[:TagSize]
+}
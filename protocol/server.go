@@ -0,0 +1,209 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bosley/libas/fault"
+	"github.com/google/uuid"
+)
+
+// ServerEncoder writes what a server sends
+type ServerEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewServerEncoder creates an encoder writing to a client connection
+func NewServerEncoder(w io.Writer) *ServerEncoder {
+	return &ServerEncoder{w: w}
+}
+
+// ClientID accepts the token, telling the client its ID
+func (e *ServerEncoder) ClientID(id uuid.UUID) error {
+	_, err := e.w.Write(id[:])
+	return err
+}
+
+// FormatReply answers a capture rate request with the rate accepted
+func (e *ServerEncoder) FormatReply(rate int) error {
+	return e.write(binary.BigEndian.AppendUint32(e.buf[:0], uint32(rate)))
+}
+
+// VAD changes the speech threshold of the client
+func (e *ServerEncoder) VAD(threshold float64) error {
+	return e.write(AppendVAD(e.buf[:0], threshold))
+}
+
+// Refused tells the client its transmission is not recorded
+func (e *ServerEncoder) Refused(reason uint32) error {
+	return e.write(AppendRefused(e.buf[:0], reason))
+}
+
+// Speech has the client play speech
+func (e *ServerEncoder) Speech(rate int, samples []int16) error {
+	return e.write(AppendAudio(e.buf[:0], Speech, rate, samples))
+}
+
+// Live has the client play a chunk of live audio
+func (e *ServerEncoder) Live(rate int, samples []int16) error {
+	return e.write(AppendAudio(e.buf[:0], Live, rate, samples))
+}
+
+// Mute stops the client transmitting until the given time, or until
+// unmuted when it is zero
+func (e *ServerEncoder) Mute(until time.Time) error {
+	return e.write(AppendMute(e.buf[:0], until))
+}
+
+// Unmute lets the client transmit again
+func (e *ServerEncoder) Unmute() error {
+	return e.write(AppendMarker(e.buf[:0], Unmute))
+}
+
+// Continuous starts or stops continuous recording on the client
+func (e *ServerEncoder) Continuous(on bool) error {
+	return e.write(AppendContinuous(e.buf[:0], on))
+}
+
+// Health asks the client to report its health every interval, or to stop
+// when it is zero
+func (e *ServerEncoder) Health(interval time.Duration) error {
+	return e.write(AppendHealth(e.buf[:0], interval))
+}
+
+func (e *ServerEncoder) write(message []byte) error {
+	e.buf = message
+	_, err := e.w.Write(message)
+	return err
+}
+
+// ClientDecoder reads what a client sends. The samples of an audio chunk
+// are left to read from the decoder itself, so they can go straight where
+// they are kept; Next skips what was not read.
+type ClientDecoder struct {
+	r   io.Reader
+	buf [4]byte
+
+	// Within a transmission, where words are chunk sizes
+	transmitting bool
+
+	// Bytes of the current chunk not read yet
+	remaining int
+}
+
+// NewClientDecoder creates a decoder reading from a client connection
+func NewClientDecoder(r io.Reader) *ClientDecoder {
+	return &ClientDecoder{r: r}
+}
+
+// Token reads the token opening the connection, of the length of the
+// server's
+func (d *ClientDecoder) Token(length int) (string, error) {
+	token := make([]byte, length)
+	if _, err := io.ReadFull(d.r, token); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// Next reads the next message. Outside a transmission, markers this
+// revision does not know are skipped. A chunk larger than MaxChunkSize or a
+// health report that is too large or not an object of numbers is an error
+// wrapping fault.ErrProtocol, the stream is taken to be corrupt.
+func (d *ClientDecoder) Next() (Message, error) {
+	if d.remaining > 0 {
+		n, err := io.CopyN(io.Discard, d.r, int64(d.remaining))
+		d.remaining -= int(n)
+		if err != nil {
+			return Message{}, unexpected(err)
+		}
+	}
+	for {
+		word, err := d.word()
+		if err != nil {
+			return Message{}, err
+		}
+		switch {
+		case word == startMarker:
+			d.transmitting = true
+			return Message{Kind: Start}, nil
+		case word == endMarker:
+			d.transmitting = false
+			return Message{Kind: End}, nil
+		case word == reportMarker:
+			return d.healthReport()
+		case d.transmitting:
+			if word > MaxChunkSize {
+				return Message{}, fmt.Errorf("%w: chunk of %d bytes exceeds %d", fault.ErrProtocol, word, MaxChunkSize)
+			}
+			d.remaining = int(word)
+			return Message{Kind: Chunk, Size: int(word)}, nil
+		case word == formatMarker:
+			rate, err := d.word()
+			if err != nil {
+				return Message{}, unexpected(err)
+			}
+			return Message{Kind: Format, SampleRate: int(rate)}, nil
+		}
+		for kind, marker := range announcements {
+			if word == marker {
+				return Message{Kind: kind}, nil
+			}
+		}
+	}
+}
+
+// Read reads the samples of the current chunk as bytes, returning io.EOF
+// at its end
+func (d *ClientDecoder) Read(p []byte) (int, error) {
+	if d.remaining == 0 {
+		return 0, io.EOF
+	}
+	n, err := d.r.Read(p[:min(len(p), d.remaining)])
+	d.remaining -= n
+	if err == io.EOF && d.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Samples reads the samples of the current chunk, dropping the last byte
+// of a chunk of odd size
+func (d *ClientDecoder) Samples() ([]int16, error) {
+	data := make([]byte, d.remaining)
+	if _, err := io.ReadFull(d, data); err != nil {
+		return nil, unexpected(err)
+	}
+	return decodeSamples(data), nil
+}
+
+// healthReport reads a health report past its marker
+func (d *ClientDecoder) healthReport() (Message, error) {
+	size, err := d.word()
+	if err != nil {
+		return Message{}, unexpected(err)
+	}
+	if size > MaxHealthSize {
+		return Message{}, fmt.Errorf("%w: health report of %d bytes exceeds %d", fault.ErrProtocol, size, MaxHealthSize)
+	}
+	report := make([]byte, size)
+	if _, err := io.ReadFull(d.r, report); err != nil {
+		return Message{}, unexpected(err)
+	}
+	var metrics map[string]float64
+	if err := json.Unmarshal(report, &metrics); err != nil || metrics == nil {
+		return Message{}, fmt.Errorf("%w: invalid health report %q", fault.ErrProtocol, report)
+	}
+	return Message{Kind: HealthReport, Metrics: metrics}, nil
+}
+
+func (d *ClientDecoder) word() (uint32, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(d.buf[:]), nil
+}
@@ -0,0 +1,63 @@
+package pseudonym
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// LogHandler wraps a handler, masking the client IDs in the message and
+// attribute values of every record, e.g. a "clientID" given as a UUID
+func (p *Pseudonymizer) LogHandler(handler slog.Handler) slog.Handler {
+	return &logHandler{Handler: handler, p: p}
+}
+
+type logHandler struct {
+	slog.Handler
+	p *Pseudonymizer
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	masked := slog.NewRecord(r.Time, r.Level, h.p.Mask(r.Message), r.PC)
+	r.Attrs(func(attr slog.Attr) bool {
+		masked.AddAttrs(h.mask(attr))
+		return true
+	})
+	return h.Handler.Handle(ctx, masked)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	masked := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		masked[i] = h.mask(attr)
+	}
+	return &logHandler{Handler: h.Handler.WithAttrs(masked), p: h.p}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithGroup(name), p: h.p}
+}
+
+// mask replaces the client IDs in a value that is or prints as a string
+func (h *logHandler) mask(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, h.p.Mask(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		masked := make([]any, len(group))
+		for i, member := range group {
+			masked[i] = h.mask(member)
+		}
+		return slog.Group(attr.Key, masked...)
+	case slog.KindAny:
+		switch v := value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, h.p.Mask(v.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, h.p.Mask(v.String()))
+		}
+	}
+	return attr
+}
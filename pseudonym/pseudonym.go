@@ -0,0 +1,267 @@
+// Package pseudonym replaces client IDs with pseudonyms that change every
+// rotation period, so transcripts and logs can be shared without telling
+// which device is whose. Every pseudonym handed out is recorded in a mapping
+// file encrypted with the key, to find out later whom one stood for.
+package pseudonym
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Pseudonyms change this often unless Config.Rotation is set
+	DefaultRotation = 24 * time.Hour
+
+	// Shortest key accepted, in bytes
+	MinKeySize = 16
+)
+
+// Client IDs, and so pseudonyms, are UUIDs
+var uuidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// Config of a Pseudonymizer
+type Config struct {
+	// Secret pseudonyms are derived from and the mapping is encrypted with,
+	// at least MinKeySize bytes
+	Key []byte
+
+	// How long a client keeps its pseudonym, DefaultRotation when zero.
+	// Periods start at multiples of it since the Unix epoch, at midnight
+	// UTC for whole days.
+	Rotation time.Duration
+
+	// File every pseudonym handed out is recorded in, encrypted. No record
+	// is kept when empty.
+	MappingFile string
+}
+
+// Mapping records the client a pseudonym stood for
+type Mapping struct {
+	Pseudonym string    `json:"pseudonym"`
+	ClientID  string    `json:"clientId"`
+	From      time.Time `json:"from"`
+	Until     time.Time `json:"until"`
+}
+
+// Pseudonymizer hands out pseudonyms, the same for a client throughout a
+// rotation period. It is safe for concurrent use.
+type Pseudonymizer struct {
+	idKey    []byte
+	aead     cipher.AEAD
+	rotation time.Duration
+	path     string
+
+	mu       sync.Mutex
+	period   int64
+	current  map[string]string // client ID to pseudonym, this period
+	clients  map[string]string // pseudonym to client ID, this and the last period
+	previous map[string]string // pseudonyms of the last period
+	mappings []Mapping
+	recorded map[string]bool // pseudonyms in mappings
+}
+
+// New creates a pseudonymizer, reading the mapping file when it exists
+func New(cfg Config) (*Pseudonymizer, error) {
+	if len(cfg.Key) < MinKeySize {
+		return nil, fmt.Errorf("pseudonym key must hold at least %d bytes", MinKeySize)
+	}
+	if cfg.Rotation == 0 {
+		cfg.Rotation = DefaultRotation
+	}
+	if cfg.Rotation < time.Minute {
+		return nil, fmt.Errorf("pseudonyms must rotate at most once a minute")
+	}
+
+	aead, err := mappingCipher(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pseudonymizer{
+		idKey:    derive(cfg.Key, "libas pseudonyms"),
+		aead:     aead,
+		rotation: cfg.Rotation,
+		path:     cfg.MappingFile,
+		current:  make(map[string]string),
+		clients:  make(map[string]string),
+		previous: make(map[string]string),
+		recorded: make(map[string]bool),
+	}
+	if p.path != "" {
+		if p.mappings, err = readMappings(aead, p.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, mapping := range p.mappings {
+			p.recorded[mapping.Pseudonym] = true
+		}
+	}
+	return p, nil
+}
+
+// Pseudonym returns the pseudonym of a client for the current period, a
+// UUID like client IDs
+func (p *Pseudonymizer) Pseudonym(clientID string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	period := time.Now().Unix() / int64(p.rotation/time.Second)
+	if period != p.period {
+		p.rotate(period)
+	}
+	if pseudonym, ok := p.current[clientID]; ok {
+		return pseudonym
+	}
+
+	mac := hmac.New(sha256.New, p.idKey)
+	binary.Write(mac, binary.BigEndian, period)
+	mac.Write([]byte(clientID))
+	id, _ := uuid.FromBytes(mac.Sum(nil)[:16])
+	id[6] = id[6]&0x0f | 0x40 // version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	pseudonym := id.String()
+
+	p.current[clientID] = pseudonym
+	p.clients[pseudonym] = clientID
+	if p.path != "" && !p.recorded[pseudonym] {
+		p.recorded[pseudonym] = true
+		from := time.Unix(period*int64(p.rotation/time.Second), 0).UTC()
+		p.mappings = append(p.mappings, Mapping{
+			Pseudonym: pseudonym,
+			ClientID:  clientID,
+			From:      from,
+			Until:     from.Add(p.rotation),
+		})
+		// A failed write is tried again with the next new pseudonym.
+		// Nothing is logged, as logs are pseudonymized through here.
+		writeMappings(p.aead, p.path, p.mappings)
+	}
+	return pseudonym
+}
+
+// rotate starts a new period, keeping the pseudonyms of the last one
+// resolvable so pages loaded just before still work
+func (p *Pseudonymizer) rotate(period int64) {
+	for pseudonym := range p.previous {
+		delete(p.clients, pseudonym)
+	}
+	p.previous = make(map[string]string)
+	if period == p.period+1 {
+		for _, pseudonym := range p.current {
+			p.previous[pseudonym] = p.clients[pseudonym]
+		}
+	} else {
+		p.clients = make(map[string]string)
+	}
+	p.current = make(map[string]string)
+	p.period = period
+}
+
+// ClientID resolves a pseudonym of the current or the last period
+func (p *Pseudonymizer) ClientID(pseudonym string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clientID, ok := p.clients[strings.ToLower(pseudonym)]
+	return clientID, ok
+}
+
+// Mask replaces every client ID in text with its pseudonym. Pseudonyms
+// ClientID resolves are left as they are.
+func (p *Pseudonymizer) Mask(text string) string {
+	return uuidPattern.ReplaceAllStringFunc(text, func(id string) string {
+		if _, ok := p.ClientID(id); ok {
+			return id
+		}
+		return p.Pseudonym(strings.ToLower(id))
+	})
+}
+
+// Unmask replaces the pseudonyms in text that ClientID resolves with their
+// client IDs, leaving other UUIDs as they are
+func (p *Pseudonymizer) Unmask(text string) string {
+	return uuidPattern.ReplaceAllStringFunc(text, func(pseudonym string) string {
+		if clientID, ok := p.ClientID(pseudonym); ok {
+			return clientID
+		}
+		return pseudonym
+	})
+}
+
+// ReadMappings decrypts a mapping file written with the key
+func ReadMappings(key []byte, path string) ([]Mapping, error) {
+	aead, err := mappingCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return readMappings(aead, path)
+}
+
+// derive makes a key for one purpose from the secret
+func derive(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// mappingCipher encrypts the mapping file with AES-256-GCM
+func mappingCipher(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(derive(secret, "libas pseudonym mapping"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mapping cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func readMappings(aead cipher.AEAD, path string) ([]Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pseudonym mapping: %w", err)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("pseudonym mapping %s is truncated", path)
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt pseudonym mapping %s, is the key right?", path)
+	}
+
+	var mappings []Mapping
+	if err := json.Unmarshal(plain, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to parse pseudonym mapping: %w", err)
+	}
+	return mappings, nil
+}
+
+func writeMappings(aead cipher.AEAD, path string, mappings []Mapping) error {
+	plain, err := json.Marshal(mappings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pseudonym mapping: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, aead.Seal(nonce, nonce, plain, nil), 0600); err != nil {
+		return fmt.Errorf("failed to write pseudonym mapping: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write pseudonym mapping: %w", err)
+	}
+	return nil
+}
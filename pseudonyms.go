@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bosley/libas/pseudonym"
+)
+
+// File in the recordings directory the pseudonyms handed out with
+// -pseudonym-key are recorded in, encrypted with the key
+const pseudonymMappingFile = "pseudonyms.enc"
+
+// runPseudonyms decrypts the pseudonym mapping, printing the client every
+// pseudonym given, or every pseudonym ever handed out, stood for
+func runPseudonyms(args []string) error {
+	fs := newFlagSet("pseudonyms")
+	keyFile := fs.String("pseudonym-key", "", "File holding the secret the scribe pseudonymized client IDs with (required)")
+	recordingsDir := fs.String("recordings", "recordings", "Directory recordings and transcriptions are stored in")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		return usageError(fs, "-pseudonym-key must be provided")
+	}
+
+	key, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read pseudonym key: %w", err)
+	}
+	mappings, err := pseudonym.ReadMappings(bytes.TrimSpace(key), filepath.Join(*recordingsDir, pseudonymMappingFile))
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, arg := range fs.Args() {
+		wanted[strings.ToLower(arg)] = true
+	}
+	found := 0
+	for _, mapping := range mappings {
+		if len(wanted) > 0 && !wanted[mapping.Pseudonym] {
+			continue
+		}
+		found++
+		fmt.Printf("%s  %s  %s to %s\n",
+			mapping.Pseudonym,
+			mapping.ClientID,
+			mapping.From.Local().Format("2006-01-02 15:04"),
+			mapping.Until.Local().Format("2006-01-02 15:04"))
+	}
+	if len(wanted) > 0 && found == 0 {
+		return fmt.Errorf("no such pseudonym was handed out")
+	}
+	return nil
+}
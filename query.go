@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/scribeclient"
+)
+
+// Delay before tail reconnects after losing the scribe
+const tailReconnectDelay = 2 * time.Second
+
+// apiFlags select the scribe API the query commands talk to
+type apiFlags struct {
+	url      *string
+	cert     *string
+	insecure *bool
+	idToken  *string
+	json     *bool
+}
+
+func addAPIFlags(fs *flag.FlagSet) *apiFlags {
+	return &apiFlags{
+		url:      fs.String("url", "https://localhost:8444", "Base URL of the scribe HTTP API"),
+		cert:     fs.String("cert", "", "Certificate to trust for the scribe, e.g. its self-signed server.crt"),
+		insecure: fs.Bool("insecure", false, "Skip certificate verification"),
+		idToken:  fs.String("id-token", "", "ID token from the scribe's sign-in provider, for scribes requiring sign-in, better set with LIBAS_ID_TOKEN"),
+		json:     fs.Bool("json", false, "Print one JSON object per transcription"),
+	}
+}
+
+func (f *apiFlags) client() (*scribeclient.Client, error) {
+	cfg := scribeclient.Config{
+		BaseURL:            *f.url,
+		InsecureSkipVerify: *f.insecure,
+		BearerToken:        *f.idToken,
+	}
+	if *f.cert != "" {
+		pem, err := os.ReadFile(*f.cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read certificate: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *f.cert)
+		}
+	}
+	return scribeclient.New(cfg)
+}
+
+// print writes one transcription as a line of text or JSON
+func (f *apiFlags) print(record scribeclient.StoredTranscription) {
+	if *f.json {
+		line, _ := json.Marshal(record)
+		fmt.Println(string(line))
+		return
+	}
+	text := strings.TrimSpace(record.Message.Text)
+	if len(record.Message.Events) > 0 {
+		text = "[" + strings.Join(record.Message.Events, ", ") + "] " + text
+	}
+	fmt.Printf("%s  %s  %s\n",
+		record.Message.Timestamp.Local().Format("2006-01-02 15:04:05"),
+		record.ClientID,
+		text)
+}
+
+// runTail follows live transcriptions, reconnecting and replaying what was
+// missed when the connection drops
+func runTail(args []string) error {
+	fs := newFlagSet("tail")
+	api := addAPIFlags(fs)
+	clients := fs.String("client", "*", "Comma separated client IDs to follow, * for every client")
+	since := fs.Duration("since", 0, "Also print today's transcriptions from this long ago")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	clientIDs := splitList(*clients)
+	if len(clientIDs) == 0 {
+		return usageError(fs, "expected at least one client ID")
+	}
+
+	client, err := api.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	var lastSequence uint64
+	for first := true; ; first = false {
+		sub, err := client.Subscribe(ctx)
+		if err != nil {
+			if first {
+				return err
+			}
+		} else {
+			commands := []scribeclient.SubscriptionCommand{{Action: "subscribe", ClientIDs: clientIDs}}
+			if lastSequence > 0 {
+				commands = append(commands, scribeclient.SubscriptionCommand{Action: "replay", Sequence: lastSequence})
+			} else if first && *since > 0 {
+				commands = append(commands, scribeclient.SubscriptionCommand{Action: "backfill", Since: time.Now().Add(-*since)})
+			}
+
+			err = followSubscription(ctx, sub, commands, func(record scribeclient.StoredTranscription) {
+				if record.Message.Sequence > lastSequence {
+					lastSequence = record.Message.Sequence
+				}
+				api.print(record)
+			})
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		slog.Warn("Lost connection to scribe, reconnecting", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tailReconnectDelay):
+		}
+	}
+}
+
+// followSubscription sends the commands and hands every transcription to fn
+// until the connection fails or the context is cancelled
+func followSubscription(ctx context.Context, sub *scribeclient.Subscription, commands []scribeclient.SubscriptionCommand, fn func(scribeclient.StoredTranscription)) error {
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer func() {
+		if stop() {
+			sub.Close()
+		}
+	}()
+
+	for _, cmd := range commands {
+		if err := sub.Send(cmd); err != nil {
+			return err
+		}
+	}
+
+	for {
+		msg, err := sub.Next()
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case "transcription":
+			transcription, err := msg.Transcription()
+			if err != nil {
+				slog.Warn("Skipping malformed transcription", "error", err)
+				continue
+			}
+			fn(scribeclient.StoredTranscription{ClientID: msg.ClientID, Message: transcription})
+		case "error":
+			return fmt.Errorf("scribe rejected subscription: %s", msg.Error())
+		}
+	}
+}
+
+// runSearch prints stored transcriptions containing every word of the query
+func runSearch(args []string) error {
+	fs := newFlagSet("search")
+	api := addAPIFlags(fs)
+	clientID := fs.String("client", "", "Only search this client's transcriptions")
+	event := fs.String("event", "", "Only return transcriptions made during calendar events whose title contains this")
+	from := fs.String("from", "", "First day to search (YYYYMMDD)")
+	to := fs.String("to", "", "Last day to search (YYYYMMDD)")
+	limit := fs.Int("limit", 0, "Maximum number of results, keeping the newest (server default when 0)")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	query := strings.Join(fs.Args(), " ")
+	if strings.TrimSpace(query) == "" && *event == "" {
+		return usageError(fs, "expected a search query or -event")
+	}
+
+	client, err := api.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	results, err := client.Search(ctx, query, scribeclient.SearchOptions{
+		ClientID: *clientID,
+		Event:    *event,
+		From:     *from,
+		To:       *to,
+		Limit:    *limit,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range results {
+		api.print(record)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/loadgen"
+	"github.com/bosley/libas/server"
+)
+
+// runReplay sends a session dumped by a server with -dump-dir to a server
+// again, byte for byte
+func runReplay(args []string) error {
+	fs := newFlagSet("replay")
+	session := fs.String("session", "", "Session dump written by a server with -dump-dir (required)")
+	serverAddr := fs.String("server", "localhost:8443", "Server address (host:port)")
+	insecureMode := fs.Bool("insecure", false, "Skip certificate verification of the server")
+	certFile := fs.String("cert", "", "Certificate to trust for the server (required unless -insecure)")
+	speed := fs.Float64("speed", 1, "Playback speed, 1 keeps the original timing and 0 sends as fast as possible")
+	cfg, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *session == "" {
+		return usageError(fs, "-session is required")
+	}
+	if *speed < 0 {
+		return usageError(fs, "-speed must not be negative")
+	}
+	if !*insecureMode && *certFile == "" {
+		return usageError(fs, "server certificate file must be provided when not in insecure mode")
+	}
+
+	token, err := requireToken(cfg, fs.Name())
+	if err != nil {
+		return err
+	}
+
+	dump, err := server.ReadDump(*session)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecureMode}
+	if !*insecureMode {
+		pem, err := os.ReadFile(*certFile)
+		if err != nil {
+			return fmt.Errorf("failed to read certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", *certFile)
+		}
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	// The dump holds the session's own format request, so none is made
+	conn, err := loadgen.Dial(ctx, *serverAddr, tlsConfig, token, audio.RecordingSampleRate)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slog.Info("Replaying session",
+		"session", *session,
+		"originalClientID", dump.Header.ClientID,
+		"clientID", conn.ClientID,
+		"records", len(dump.Records),
+		"speed", *speed)
+
+	started := time.Now()
+	sent := 0
+	for _, record := range dump.Records {
+		if *speed > 0 {
+			due := started.Add(time.Duration(float64(record.At) / *speed))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+		if _, err := conn.Write(record.Data); err != nil {
+			return fmt.Errorf("failed to replay session: %w", err)
+		}
+		sent += len(record.Data)
+	}
+
+	slog.Info("Session replayed", "clientID", conn.ClientID, "bytes", sent, "elapsed", time.Since(started))
+	return nil
+}
@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Most bytes read from an upload at once when rate limited, keeping the
+// flow even rather than bursting a large buffer and then waiting
+const limitChunk = 32 * 1024
+
+// limiter spaces reads so they average rate bytes per second. Each read
+// reserves the time its bytes take at that rate after the reads before it.
+type limiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// reserve returns when n bytes may be sent
+func (l *limiter) reserve(n int) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return at
+}
+
+// limitedReader reads an upload body no faster than its limiter allows
+type limitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := r.reader.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+
+	if wait := time.Until(r.limiter.reserve(n)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	return n, err
+}
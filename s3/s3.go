@@ -0,0 +1,331 @@
+// Package s3 stores files in Amazon S3 and S3-compatible object stores
+// (MinIO, Backblaze B2, Cloudflare R2) with AWS Signature Version 4, using
+// path-style bucket addressing
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion = "us-east-1"
+
+	// Payload hash sent instead of hashing uploads up front, so files can be
+	// streamed from disk
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// Config for an S3 bucket
+type Config struct {
+	// Endpoint URL, e.g. https://s3.eu-west-1.amazonaws.com or
+	// http://minio.local:9000
+	Endpoint string
+
+	// Region the bucket is in, defaults to us-east-1 (what MinIO expects)
+	Region string
+
+	// Bucket objects are stored in
+	Bucket string
+
+	// Key prepended to every object key, e.g. "libas/"
+	Prefix string
+
+	// Credentials of the access key
+	AccessKey string
+	SecretKey string
+
+	// Storage class of new objects, e.g. GLACIER or DEEP_ARCHIVE for cold
+	// storage, empty for the bucket default
+	StorageClass string
+
+	// Bytes per second uploads may send, shared by concurrent uploads,
+	// zero for no limit
+	RateLimit int64
+}
+
+// Enabled reports whether a bucket is configured
+func (c Config) Enabled() bool {
+	return c.Bucket != ""
+}
+
+// Client stores objects in one bucket
+type Client struct {
+	config   Config
+	endpoint *url.URL
+	http     *http.Client
+	limiter  *limiter
+}
+
+// New creates a client for the configured bucket
+func New(cfg Config) (*Client, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("an S3 endpoint and bucket are required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("S3 access and secret keys are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultRegion
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+
+	if cfg.RateLimit < 0 {
+		return nil, fmt.Errorf("S3 rate limit must not be negative")
+	}
+
+	c := &Client{
+		config:   cfg,
+		endpoint: endpoint,
+		http:     &http.Client{},
+	}
+	if cfg.RateLimit > 0 {
+		c.limiter = &limiter{rate: cfg.RateLimit}
+	}
+	return c, nil
+}
+
+// Key is the full object key of a name, including the configured prefix
+func (c *Client) Key(name string) string {
+	return c.config.Prefix + name
+}
+
+// URL is where an object is stored, for logs and reports
+func (c *Client) URL(name string) string {
+	return c.objectURL(c.Key(name)).String()
+}
+
+// PutFile uploads a file as the object name (the prefix is added)
+func (c *Client) PutFile(ctx context.Context, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return c.Put(ctx, name, file, info.Size())
+}
+
+// Put uploads size bytes of body as the object name (the prefix is added)
+func (c *Client) Put(ctx context.Context, name string, body io.Reader, size int64) error {
+	if c.limiter != nil {
+		body = &limitedReader{ctx: ctx, reader: body, limiter: c.limiter}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(c.Key(name)).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if c.config.StorageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", c.config.StorageClass)
+	}
+	c.sign(req, unsignedPayload, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to upload %s: %s: %s", name, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// List returns the names of the objects whose names start with prefix (the
+// configured prefix is added and stripped again)
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {c.Key(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := c.objectURL("")
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = encodePath(u.Path)
+		u.RawQuery = canonicalQuery(query)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		c.sign(req, hexSHA256(""), time.Now())
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if resp.StatusCode != http.StatusOK {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to list %s: %s: %s", prefix, resp.Status, strings.TrimSpace(string(message)))
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse listing of %s: %w", prefix, err)
+		}
+
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, c.config.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Delete removes the object name (the prefix is added). Deleting an object
+// that does not exist succeeds.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(c.Key(name)).String(), nil)
+	if err != nil {
+		return err
+	}
+	c.sign(req, hexSHA256(""), time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to delete %s: %s: %s", name, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (c *Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.config.Bucket + "/" + key
+	u.RawPath = encodePath(u.Path)
+	return &u
+}
+
+// sign adds the AWS Signature Version 4 authorization to a request, signing
+// the host and every header already set
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.config.SecretKey), date)
+	key = hmacSHA256(key, c.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// encodePath percent-encodes a path the way S3 signs it, everything but
+// unreserved characters and slashes
+func encodePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		if ch == '/' || ch == '-' || ch == '_' || ch == '.' || ch == '~' ||
+			('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, encodePath(key)+"="+strings.ReplaceAll(encodePath(value), "/", "%2F"))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,363 @@
+package scribe
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/version"
+	"github.com/google/uuid"
+)
+
+// Entries of an export archive, a gzipped tar of a description, the
+// transcriptions as JSON lines and recordings under audio/<day>/<client>/
+const (
+	archiveInfoFile           = "export.json"
+	archiveTranscriptionsFile = "transcriptions.jsonl"
+	archiveAudioDir           = "audio"
+
+	// Revision of the archive layout, bumped on incompatible changes
+	archiveFormat = 1
+)
+
+// ExportOptions select what Export writes
+type ExportOptions struct {
+	// First and last day (YYYYMMDD) to export, empty for no bound
+	From string
+	To   string
+
+	// Clients to export, empty for every client
+	ClientIDs []string
+
+	// Include the recordings the transcriptions were made from
+	Audio bool
+}
+
+// ArchiveInfo describes an export archive
+type ArchiveInfo struct {
+	Format     int       `json:"format"`
+	ExportedAt time.Time `json:"exportedAt"`
+	Version    string    `json:"version"`
+	From       string    `json:"from,omitempty"`
+	To         string    `json:"to,omitempty"`
+	ClientIDs  []string  `json:"clientIds,omitempty"`
+}
+
+// ArchiveStats counts what an export or import handled
+type ArchiveStats struct {
+	Transcriptions int
+	AudioFiles     int
+
+	// Transcriptions and recordings an import already had
+	Skipped int
+}
+
+// Export writes the transcriptions, and optionally the recordings, of a
+// recordings directory to w as a gzipped tar archive
+func Export(w io.Writer, recordingsDir string, opts ExportOptions) (ArchiveStats, error) {
+	var stats ArchiveStats
+
+	st, err := newStore(recordingsDir)
+	if err != nil {
+		return stats, err
+	}
+	days, err := st.days()
+	if err != nil {
+		return stats, err
+	}
+
+	clients := make(map[string]bool)
+	for _, clientID := range opts.ClientIDs {
+		clients[clientID] = true
+	}
+
+	// Transcriptions are buffered so the archive starts with them, and with
+	// the description, before any audio
+	type recording struct{ day, clientID, file string }
+	var transcriptions strings.Builder
+	recordings := make([]recording, 0)
+	seen := make(map[recording]bool)
+
+	for _, day := range days {
+		if (opts.From != "" && day < opts.From) || (opts.To != "" && day > opts.To) {
+			continue
+		}
+		err := st.readDay(day, func(record StoredTranscription) bool {
+			if len(clients) > 0 && !clients[record.ClientID] {
+				return true
+			}
+			line, _ := json.Marshal(record)
+			transcriptions.Write(append(line, '\n'))
+			stats.Transcriptions++
+
+			file := recording{day, record.ClientID, record.Message.AudioFile}
+			if opts.Audio && file.file != "" && !seen[file] {
+				seen[file] = true
+				recordings = append(recordings, file)
+			}
+			return true
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	info, _ := json.MarshalIndent(ArchiveInfo{
+		Format:     archiveFormat,
+		ExportedAt: time.Now(),
+		Version:    version.Get().Version,
+		From:       opts.From,
+		To:         opts.To,
+		ClientIDs:  opts.ClientIDs,
+	}, "", "  ")
+	if err := writeTarFile(tw, archiveInfoFile, info); err != nil {
+		return stats, err
+	}
+	if err := writeTarFile(tw, archiveTranscriptionsFile, []byte(transcriptions.String())); err != nil {
+		return stats, err
+	}
+
+	for _, rec := range recordings {
+		// Archived recordings keep their WAV name in the journal
+		src := filepath.Join(recordingsDir, rec.day, rec.clientID, rec.file)
+		if _, err := os.Stat(src); err != nil {
+			src = strings.TrimSuffix(src, ".wav") + ".flac"
+		}
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+
+		name := path.Join(archiveAudioDir, rec.day, rec.clientID, filepath.Base(src))
+		if err := copyToTar(tw, name, src); err != nil {
+			return stats, err
+		}
+		stats.AudioFiles++
+	}
+
+	if err := tw.Close(); err != nil {
+		return stats, fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return stats, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return stats, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+func copyToTar(tw *tar.Writer, name, src string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat recording: %w", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := io.Copy(tw, file); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// Import loads an archive written by Export into a recordings directory.
+// Transcriptions get new sequence numbers; ones the directory already has,
+// and recordings that already exist, are skipped so importing twice is
+// harmless. Scribe should not be running on the directory, it would
+// transcribe recordings imported into today again.
+func Import(r io.Reader, recordingsDir string) (ArchiveStats, error) {
+	var stats ArchiveStats
+
+	st, err := newStore(recordingsDir)
+	if err != nil {
+		return stats, err
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gz.Close()
+
+	// Transcriptions already stored, by day, loaded when first needed
+	existing := make(map[string]map[string]bool)
+	known := func(record StoredTranscription) (bool, error) {
+		day := record.Message.Timestamp.Format("20060102")
+		if existing[day] == nil {
+			existing[day] = make(map[string]bool)
+			if err := st.readDay(day, func(stored StoredTranscription) bool {
+				existing[day][transcriptionKey(stored)] = true
+				return true
+			}); err != nil {
+				return false, err
+			}
+		}
+		key := transcriptionKey(record)
+		found := existing[day][key]
+		existing[day][key] = true
+		return found, nil
+	}
+
+	tr := tar.NewReader(gz)
+	sawInfo := false
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		switch {
+		case header.Name == archiveInfoFile:
+			var info ArchiveInfo
+			if err := json.NewDecoder(tr).Decode(&info); err != nil {
+				return stats, fmt.Errorf("failed to read archive description: %w", err)
+			}
+			if info.Format != archiveFormat {
+				return stats, fmt.Errorf("unsupported archive format %d", info.Format)
+			}
+			sawInfo = true
+
+		case header.Name == archiveTranscriptionsFile:
+			scanner := bufio.NewScanner(tr)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				var record StoredTranscription
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					return stats, fmt.Errorf("invalid transcription in archive: %w", err)
+				}
+				if _, err := uuid.Parse(record.ClientID); err != nil {
+					return stats, fmt.Errorf("invalid client ID %q in archive", record.ClientID)
+				}
+
+				found, err := known(record)
+				if err != nil {
+					return stats, err
+				}
+				if found {
+					stats.Skipped++
+					continue
+				}
+				if _, err := st.append(record.ClientID, record.Message); err != nil {
+					return stats, err
+				}
+				stats.Transcriptions++
+			}
+			if err := scanner.Err(); err != nil {
+				return stats, fmt.Errorf("failed to read archive: %w", err)
+			}
+
+		case strings.HasPrefix(header.Name, archiveAudioDir+"/") && header.Typeflag == tar.TypeReg:
+			imported, err := importRecording(tr, recordingsDir, header.Name)
+			if err != nil {
+				return stats, err
+			}
+			if imported {
+				stats.AudioFiles++
+			} else {
+				stats.Skipped++
+			}
+		}
+	}
+
+	if !sawInfo {
+		return stats, fmt.Errorf("not a libas export archive")
+	}
+	return stats, nil
+}
+
+// transcriptionKey identifies a transcription across instances, where
+// sequence numbers differ
+func transcriptionKey(record StoredTranscription) string {
+	return record.ClientID + "|" + record.Message.AudioFile + "|" + record.Message.Timestamp.UTC().Format(time.RFC3339Nano)
+}
+
+// importRecording writes an audio/<day>/<client>/<file> archive entry into
+// the recordings directory unless the file exists, recording its checksum
+func importRecording(r io.Reader, recordingsDir, name string) (bool, error) {
+	parts := strings.Split(strings.TrimPrefix(name, archiveAudioDir+"/"), "/")
+	if len(parts) != 3 {
+		return false, fmt.Errorf("unexpected archive entry %s", name)
+	}
+	day, clientID, file := parts[0], parts[1], parts[2]
+	if _, err := time.Parse("20060102", day); err != nil {
+		return false, fmt.Errorf("unexpected archive entry %s", name)
+	}
+	if _, err := uuid.Parse(clientID); err != nil {
+		return false, fmt.Errorf("unexpected archive entry %s", name)
+	}
+	if file != filepath.Base(file) || file == "." || file == ".." {
+		return false, fmt.Errorf("unexpected archive entry %s", name)
+	}
+
+	dst := filepath.Join(recordingsDir, day, clientID, file)
+	if _, err := os.Stat(dst); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, fmt.Errorf("failed to create client directory: %w", err)
+	}
+
+	// Written under a temporary name so a watcher never sees half a file
+	tmpPath := dst + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to create recording: %w", err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to write recording: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to write recording: %w", err)
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to write recording: %w", err)
+	}
+
+	if err := audio.RecordChecksum(dst); err != nil {
+		return true, fmt.Errorf("failed to record checksum: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,525 @@
+package scribe
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/ldap"
+	"github.com/bosley/libas/oidc"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How long a sign-in lasts when AuthConfig.SessionTimeout is zero
+	defaultSessionTimeout = 12 * time.Hour
+
+	// Time allowed between starting a sign-in and coming back from the
+	// provider
+	loginTimeout = 10 * time.Minute
+
+	// Cookies holding the session and a sign-in in progress
+	sessionCookie = "libas_session"
+	loginCookie   = "libas_login"
+
+	// Verified bearer tokens remembered, so API clients polling with the
+	// same token are not looked up in the directory each time
+	maxBearerCache = 1024
+)
+
+// adminRoutes may only be used by admins when sign-in is on
+var adminRoutes = map[string]bool{
+	"/api/integrity":  true,
+	"/api/intercom":   true,
+	"/api/meetings":   true,
+	"/api/prompts":    true,
+	"/api/retention":  true,
+	"/api/speakers":   true,
+	"/api/transcribe": true,
+	"/api/uploads":    true,
+}
+
+// isAdminRoute reports whether only admins may use a path when sign-in is on
+func isAdminRoute(path string) bool {
+	return adminRoutes[path] ||
+		strings.HasPrefix(path, "/api/prompts/") ||
+		strings.HasPrefix(path, "/api/speakers/") ||
+		strings.HasPrefix(path, "/api/intercom/") ||
+		strings.HasPrefix(path, "/api/meetings/") ||
+		strings.HasPrefix(path, "/api/uploads/") ||
+		(strings.HasPrefix(path, "/api/clients/") && strings.HasSuffix(path, "/data"))
+}
+
+// errNoAccess is returned for users in none of the configured groups
+var errNoAccess = fmt.Errorf("%w: user is in no group with access", fault.ErrAuthFailed)
+
+// AuthConfig turns on sign-in with an OpenID Connect provider for the
+// dashboard and the API. Without an Issuer anyone who can reach the API may
+// use all of it.
+type AuthConfig struct {
+	// OpenID Connect issuer, e.g. https://auth.example.com/realms/home
+	Issuer string
+
+	// Credentials of the client registered with the provider
+	ClientID     string
+	ClientSecret string
+
+	// URL browsers reach the scribe at, e.g. https://scribe.example.com:8444.
+	// The provider must allow <PublicURL>/auth/callback as redirect URI.
+	PublicURL string
+
+	// Scopes requested besides openid, profile and email when empty. Some
+	// providers need "groups" to include the groups claim.
+	Scopes []string
+
+	// Claim of the ID token listing a user's groups, "groups" when empty
+	GroupsClaim string
+
+	// Groups whose members may view every client and use the admin
+	// endpoints (integrity, retention, transcribe)
+	AdminGroups []string
+
+	// Groups whose members may also change the clients they may view: mute
+	// them, correct their transcriptions, clear their vocabulary and speak
+	// through them. Everyone else may only read them.
+	OperatorGroups []string
+
+	// Clients the members of each group may view, by client ID or by the
+	// host they connect from. "*" as a client is every client, and "*" as
+	// a group is everyone who signs in.
+	ViewerGroups map[string][]string
+
+	// Directory further groups of users are looked up in, by the
+	// preferred_username of their token, when URL is set
+	LDAP ldap.Config
+
+	// How long a sign-in lasts, 12 hours when zero
+	SessionTimeout time.Duration
+}
+
+func (c AuthConfig) enabled() bool {
+	return c.Issuer != ""
+}
+
+// user is who made a request and what they may see
+type user struct {
+	Name     string   `json:"name"`
+	Admin    bool     `json:"admin"`
+	Operator bool     `json:"operator"`
+	Clients  []string `json:"clients"`
+	Expires  int64    `json:"exp"`
+
+	clients map[string]bool
+}
+
+type userKey struct{}
+
+// requestUser returns who made a request, nil when sign-in is off
+func requestUser(r *http.Request) *user {
+	u, _ := r.Context().Value(userKey{}).(*user)
+	return u
+}
+
+// canView reports whether a user may see a client's transcriptions. Everyone
+// may when sign-in is off.
+func (s *Scribe) canView(u *user, clientID string) bool {
+	if u == nil || u.Admin || u.clients[allClients] {
+		return true
+	}
+	return len(u.clients) > 0 && s.selects(u.clients, clientID)
+}
+
+// canChange reports whether a user may change a client rather than only
+// read it. Everyone may when sign-in is off.
+func (s *Scribe) canChange(u *user, clientID string) bool {
+	if u == nil || u.Admin {
+		return true
+	}
+	return u.Operator && s.canView(u, clientID)
+}
+
+// auth signs users in and checks their sessions
+type auth struct {
+	config   AuthConfig
+	provider *oidc.Provider
+	ldap     *ldap.Client
+
+	// Signs cookies. It is created at startup, so restarting signs
+	// everyone out; the provider signs them back in without asking.
+	key []byte
+
+	// Cookies are only sent over TLS when the public URL uses it
+	secure bool
+
+	// Lowercased group names
+	admins    map[string]bool
+	operators map[string]bool
+	viewers   map[string][]string
+
+	mu     sync.Mutex
+	bearer map[string]*user
+}
+
+func newAuth(cfg AuthConfig) (*auth, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+	public, err := url.Parse(cfg.PublicURL)
+	if err != nil || public.Host == "" {
+		return nil, fmt.Errorf("sign-in needs the public URL of the scribe")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"profile", "email"}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.SessionTimeout <= 0 {
+		cfg.SessionTimeout = defaultSessionTimeout
+	}
+
+	provider, err := oidc.New(oidc.Config{
+		Issuer:       cfg.Issuer,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  strings.TrimSuffix(cfg.PublicURL, "/") + "/auth/callback",
+		Scopes:       cfg.Scopes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid sign-in provider: %w", err)
+	}
+
+	a := &auth{
+		config:    cfg,
+		provider:  provider,
+		key:       make([]byte, 32),
+		secure:    public.Scheme == "https",
+		admins:    make(map[string]bool),
+		operators: make(map[string]bool),
+		viewers:   make(map[string][]string),
+		bearer:    make(map[string]*user),
+	}
+	if cfg.LDAP.URL != "" {
+		if a.ldap, err = ldap.New(cfg.LDAP); err != nil {
+			return nil, fmt.Errorf("invalid LDAP directory: %w", err)
+		}
+	}
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, fmt.Errorf("failed to create session key: %w", err)
+	}
+	for _, group := range cfg.AdminGroups {
+		a.admins[strings.ToLower(group)] = true
+	}
+	for _, group := range cfg.OperatorGroups {
+		a.operators[strings.ToLower(group)] = true
+	}
+	for group, clients := range cfg.ViewerGroups {
+		group = strings.ToLower(group)
+		a.viewers[group] = append(a.viewers[group], clients...)
+	}
+	return a, nil
+}
+
+// resolve works out what a signed in user may see from their groups
+func (a *auth) resolve(ctx context.Context, token *oidc.Token) (*user, error) {
+	name := token.String("preferred_username")
+	if name == "" {
+		name = token.String("email")
+	}
+	if name == "" {
+		name = token.Subject
+	}
+
+	groups := token.Strings(a.config.GroupsClaim)
+	if a.ldap != nil {
+		found, err := a.ldap.Groups(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up groups of %s: %w", name, err)
+		}
+		groups = append(groups, found...)
+	}
+
+	u := &user{Name: name, Clients: make([]string, 0), clients: make(map[string]bool)}
+	for _, group := range append(groups, allClients) {
+		group = strings.ToLower(group)
+		u.Admin = u.Admin || a.admins[group]
+		u.Operator = u.Operator || a.operators[group]
+		for _, client := range a.viewers[group] {
+			if !u.clients[client] {
+				u.clients[client] = true
+				u.Clients = append(u.Clients, client)
+			}
+		}
+	}
+	if !u.Admin && len(u.Clients) == 0 {
+		return nil, fmt.Errorf("%w: %s", errNoAccess, name)
+	}
+	return u, nil
+}
+
+// authenticate returns the user of a request's session cookie or bearer
+// token, nil when it has neither or they are invalid
+func (a *auth) authenticate(r *http.Request) *user {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		var u user
+		if a.open(cookie.Value, &u) && time.Now().Unix() < u.Expires {
+			u.clients = make(map[string]bool)
+			for _, client := range u.Clients {
+				u.clients[client] = true
+			}
+			return &u
+		}
+	}
+
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || raw == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(raw))
+	cacheKey := string(sum[:])
+
+	a.mu.Lock()
+	cached, ok := a.bearer[cacheKey]
+	a.mu.Unlock()
+	if ok && time.Now().Unix() < cached.Expires {
+		return cached
+	}
+
+	token, err := a.provider.Verify(r.Context(), raw)
+	if err != nil {
+		slog.Debug("Rejected bearer token", "error", err)
+		return nil
+	}
+	u, err := a.resolve(r.Context(), token)
+	if err != nil {
+		slog.Warn("Rejected bearer token", "error", err)
+		return nil
+	}
+	u.Expires = token.Expiry.Unix()
+
+	a.mu.Lock()
+	now := time.Now().Unix()
+	for key, cached := range a.bearer {
+		if now >= cached.Expires || len(a.bearer) >= maxBearerCache {
+			delete(a.bearer, key)
+		}
+	}
+	a.bearer[cacheKey] = u
+	a.mu.Unlock()
+	return u
+}
+
+// seal signs a value for a cookie
+func (a *auth) seal(value any) (string, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// open checks the signature of a cookie sealed by seal and decodes it
+func (a *auth) open(sealed string, value any) bool {
+	encoded, signature, ok := strings.Cut(sealed, ".")
+	if !ok {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return false
+	}
+	return json.Unmarshal(payload, value) == nil
+}
+
+func (a *auth) setCookie(w http.ResponseWriter, name, value, path string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   a.secure,
+		// Lax so the cookie comes along when the provider redirects back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *auth) clearCookie(w http.ResponseWriter, name, path string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, HttpOnly: true, Secure: a.secure})
+}
+
+// authMiddleware lets only signed in users through. Unauthenticated API
+// and WebSocket requests get a 401, other pages redirect to the sign-in.
+// Per-client routes and admin routes are checked against the user's access.
+func (s *Scribe) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/auth/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := s.auth.authenticate(r)
+		if u == nil {
+			if strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/ws") {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="libas"`)
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+
+		if isAdminRoute(path) && !u.Admin {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		if clientID, ok := mux.Vars(r)["clientID"]; ok {
+			if !s.canView(u, clientID) {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
+			// Whatever the route, viewers only read clients
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.canChange(u, clientID) {
+				http.Error(w, "Operator access required", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+// pendingLogin is kept in a cookie while the user signs in at the provider
+type pendingLogin struct {
+	oidc.Login
+	Next    string `json:"next"`
+	Expires int64  `json:"exp"`
+}
+
+// handleLogin sends the user to the provider to sign in
+func (s *Scribe) handleLogin(w http.ResponseWriter, r *http.Request) {
+	login, err := oidc.NewLogin()
+	if err != nil {
+		slog.Error("Failed to start sign-in", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Only return to paths on this server after signing in
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	target, err := s.auth.provider.AuthURL(r.Context(), login)
+	if err != nil {
+		slog.Error("Failed to reach sign-in provider", "error", err)
+		http.Error(w, "Sign-in provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	expires := time.Now().Add(loginTimeout)
+	sealed, err := s.auth.seal(pendingLogin{Login: login, Next: next, Expires: expires.Unix()})
+	if err != nil {
+		slog.Error("Failed to start sign-in", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.auth.setCookie(w, loginCookie, sealed, "/auth/", expires)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleAuthCallback completes a sign-in when the provider redirects back
+func (s *Scribe) handleAuthCallback(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if reason := params.Get("error"); reason != "" {
+		slog.Warn("Sign-in refused by provider", "error", reason, "description", params.Get("error_description"))
+		http.Error(w, "Sign-in failed: "+reason, http.StatusUnauthorized)
+		return
+	}
+
+	var pending pendingLogin
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil || !s.auth.open(cookie.Value, &pending) || time.Now().Unix() > pending.Expires {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	s.auth.clearCookie(w, loginCookie, "/auth/")
+	if params.Get("state") != pending.State {
+		http.Error(w, "Sign-in state does not match", http.StatusBadRequest)
+		return
+	}
+
+	token, err := s.auth.provider.Exchange(r.Context(), params.Get("code"), pending.Login)
+	if err != nil {
+		slog.Warn("Failed to complete sign-in", "error", err)
+		s.report(fault.Wrap(fault.ErrAuthFailed, err), "sign_in")
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	u, err := s.auth.resolve(r.Context(), token)
+	if errors.Is(err, errNoAccess) {
+		slog.Warn("Refused sign-in", "error", err)
+		http.Error(w, "You have no access to this scribe", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to complete sign-in", "error", err)
+		s.report(err, "sign_in")
+		http.Error(w, "Directory unavailable", http.StatusBadGateway)
+		return
+	}
+
+	expires := time.Now().Add(s.auth.config.SessionTimeout)
+	u.Expires = expires.Unix()
+	sealed, err := s.auth.seal(u)
+	if err != nil {
+		slog.Error("Failed to create session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.auth.setCookie(w, sessionCookie, sealed, "/", expires)
+	slog.Info("User signed in", "user", u.Name, "admin", u.Admin, "clients", u.Clients)
+	http.Redirect(w, r, pending.Next, http.StatusFound)
+}
+
+// handleLogout ends the session. The user stays signed in at the provider,
+// so going back to the dashboard right away would sign them in again.
+func (s *Scribe) handleLogout(w http.ResponseWriter, r *http.Request) {
+	s.auth.clearCookie(w, sessionCookie, "/")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!DOCTYPE html><html><head><title>Signed out</title></head>`+
+		`<body style="font-family: Arial, sans-serif"><p>Signed out of the libas scribe.</p><p><a href="/">Sign in again</a></p></body></html>`)
+}
+
+// handleMe describes the signed in user
+func (s *Scribe) handleMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(requestUser(r)); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,335 @@
+package scribe
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/oidc"
+	"github.com/gorilla/mux"
+)
+
+// TestAuthClientMethods checks that viewers only read the clients they see,
+// whatever the route, while operators and admins may also change them
+func TestAuthClientMethods(t *testing.T) {
+	s := &Scribe{auth: &auth{key: []byte("0123456789abcdef0123456789abcdef")}}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/clients/{clientID}/{rest:.*}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.Use(s.authMiddleware)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	viewer := user{Name: "viewer", Clients: []string{"kitchen"}, Expires: expires}
+	operator := user{Name: "operator", Operator: true, Clients: []string{"kitchen"}, Expires: expires}
+	admin := user{Name: "admin", Admin: true, Clients: []string{}, Expires: expires}
+
+	tests := []struct {
+		user   user
+		method string
+		path   string
+		want   int
+	}{
+		{viewer, "GET", "/api/clients/kitchen/history", http.StatusNoContent},
+		{viewer, "HEAD", "/api/clients/kitchen/vocabulary", http.StatusNoContent},
+		{viewer, "GET", "/api/clients/garage/history", http.StatusForbidden},
+		{viewer, "POST", "/api/clients/kitchen/mute", http.StatusForbidden},
+		{viewer, "DELETE", "/api/clients/kitchen/mute", http.StatusForbidden},
+		{viewer, "PUT", "/api/clients/kitchen/transcriptions/3", http.StatusForbidden},
+		{viewer, "DELETE", "/api/clients/kitchen/vocabulary", http.StatusForbidden},
+		{viewer, "POST", "/api/clients/kitchen/say", http.StatusForbidden},
+		{viewer, "PATCH", "/api/clients/kitchen/anything", http.StatusForbidden},
+		{operator, "POST", "/api/clients/kitchen/mute", http.StatusNoContent},
+		{operator, "DELETE", "/api/clients/kitchen/mute", http.StatusNoContent},
+		{operator, "PUT", "/api/clients/kitchen/transcriptions/3", http.StatusNoContent},
+		{operator, "DELETE", "/api/clients/kitchen/vocabulary", http.StatusNoContent},
+		{operator, "POST", "/api/clients/kitchen/say", http.StatusNoContent},
+		{operator, "POST", "/api/clients/garage/mute", http.StatusForbidden},
+		{operator, "DELETE", "/api/clients/kitchen/data", http.StatusForbidden},
+		{admin, "POST", "/api/clients/garage/say", http.StatusNoContent},
+		{admin, "DELETE", "/api/clients/garage/data", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		cookie, err := s.auth.seal(tt.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookie})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s as %s: got %d, want %d", tt.method, tt.path, tt.user.Name, w.Code, tt.want)
+		}
+	}
+}
+
+// Access each route needs when sign-in is on
+const (
+	accessPublic   = "public"
+	accessSignedIn = "signed in"
+	accessViewer   = "viewer"
+	accessOperator = "operator"
+	accessAdmin    = "admin"
+)
+
+// TestAuthRouteGroups checks every route of the router against the access
+// it should need, so a route added without deciding on it fails
+func TestAuthRouteGroups(t *testing.T) {
+	routes := map[string]string{
+		"GET /api/clients":                                      accessSignedIn,
+		"GET /api/presence":                                     accessSignedIn,
+		"GET /api/clients/{clientID}":                           accessViewer,
+		"GET /api/clients/{clientID}/history":                   accessViewer,
+		"GET /api/clients/{clientID}/sessions":                  accessViewer,
+		"GET /api/clients/{clientID}/audio/{file}":              accessViewer,
+		"GET /api/clients/{clientID}/audio/{file}/waveform":     accessViewer,
+		"GET /api/clients/{clientID}/digest":                    accessViewer,
+		"GET /api/clients/{clientID}/feed":                      accessViewer,
+		"POST /api/clients/{clientID}/mute":                     accessOperator,
+		"DELETE /api/clients/{clientID}/mute":                   accessOperator,
+		"DELETE /api/clients/{clientID}/data":                   accessAdmin,
+		"PUT /api/clients/{clientID}/transcriptions/{sequence}": accessOperator,
+		"GET /api/clients/{clientID}/vocabulary":                accessViewer,
+		"DELETE /api/clients/{clientID}/vocabulary":             accessOperator,
+		"POST /api/clients/{clientID}/say":                      accessOperator,
+		"GET /api/integrity":                                    accessAdmin,
+		"GET /api/search":                                       accessSignedIn,
+		"GET /api/retention":                                    accessAdmin,
+		"GET /api/latency":                                      accessSignedIn,
+		"GET /api/analytics/talktime":                           accessSignedIn,
+		"GET /api/prompts":                                      accessAdmin,
+		"PUT /api/prompts/{client}":                             accessAdmin,
+		"DELETE /api/prompts/{client}":                          accessAdmin,
+		"GET /api/speakers":                                     accessAdmin,
+		"POST /api/speakers/{name}":                             accessAdmin,
+		"DELETE /api/speakers/{name}":                           accessAdmin,
+		"GET /api/intercom":                                     accessAdmin,
+		"POST /api/intercom":                                    accessAdmin,
+		"DELETE /api/intercom/{clientID}":                       accessAdmin,
+		"POST /api/transcribe":                                  accessAdmin,
+		"POST /api/uploads":                                     accessAdmin,
+		"GET /api/uploads/{id}":                                 accessAdmin,
+		"HEAD /api/uploads/{id}":                                accessAdmin,
+		"PATCH /api/uploads/{id}":                               accessAdmin,
+		"DELETE /api/uploads/{id}":                              accessAdmin,
+		"GET /api/meetings":                                     accessAdmin,
+		"POST /api/meetings":                                    accessAdmin,
+		"GET /api/meetings/{id}":                                accessAdmin,
+		"POST /api/meetings/{id}/end":                           accessAdmin,
+		"GET /api/version":                                      accessSignedIn,
+		"GET /api/openapi.json":                                 accessSignedIn,
+		"GET /ws":                                               accessSignedIn,
+		"GET /ws/{clientID}":                                    accessViewer,
+		"GET /auth/login":                                       accessPublic,
+		"GET /auth/callback":                                    accessPublic,
+		"GET /auth/logout":                                      accessPublic,
+		"POST /auth/logout":                                     accessPublic,
+		"GET /api/me":                                           accessSignedIn,
+		"GET /":                                                 accessSignedIn,
+	}
+
+	s := newTestScribe(t, Config{Synthesizer: CommandSynthesizer{}})
+	s.auth = &auth{key: []byte("0123456789abcdef0123456789abcdef")}
+
+	// The same routes, answering 204 past the middleware
+	stub := mux.NewRouter()
+	seen := make(map[string]bool)
+	err := s.newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		for _, method := range methods {
+			key := method + " " + template
+			if _, ok := routes[key]; !ok {
+				t.Errorf("%s: no access decided", key)
+			}
+			seen[key] = true
+		}
+		stub.HandleFunc(template, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}).Methods(methods...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range routes {
+		if !seen[key] {
+			t.Errorf("%s: not routed", key)
+		}
+	}
+	stub.Use(s.authMiddleware)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	users := []*user{
+		nil,
+		{Name: "viewer", Clients: []string{"kitchen"}, Expires: expires},
+		{Name: "other viewer", Clients: []string{"garage"}, Expires: expires},
+		{Name: "operator", Operator: true, Clients: []string{"kitchen"}, Expires: expires},
+		{Name: "admin", Admin: true, Clients: []string{}, Expires: expires},
+	}
+	// want returns the status a user gets for a route needing access
+	want := func(u *user, access, path string) int {
+		switch {
+		case access == accessPublic:
+			return http.StatusNoContent
+		case u == nil && (strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/ws")):
+			return http.StatusUnauthorized
+		case u == nil:
+			return http.StatusFound
+		case u.Admin, access == accessSignedIn:
+			return http.StatusNoContent
+		case access == accessViewer && slices.Contains(u.Clients, "kitchen"),
+			access == accessOperator && u.Operator && slices.Contains(u.Clients, "kitchen"):
+			return http.StatusNoContent
+		}
+		return http.StatusForbidden
+	}
+
+	vars := regexp.MustCompile(`\{[^}]+\}`)
+	for key, access := range routes {
+		method, template, _ := strings.Cut(key, " ")
+		path := strings.ReplaceAll(template, "{clientID}", "kitchen")
+		path = vars.ReplaceAllString(path, "1")
+		for _, u := range users {
+			r := httptest.NewRequest(method, path, nil)
+			name := "anonymous"
+			if u != nil {
+				cookie, err := s.auth.seal(u)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookie})
+				name = u.Name
+			}
+			w := httptest.NewRecorder()
+			stub.ServeHTTP(w, r)
+			if expected := want(u, access, path); w.Code != expected {
+				t.Errorf("%s %s as %s: got %d, want %d", method, path, name, w.Code, expected)
+			}
+		}
+	}
+}
+
+// TestSessionCookie checks that only cookies sealed with the key, unchanged
+// and unexpired, sign a user in
+func TestSessionCookie(t *testing.T) {
+	a := &auth{key: []byte("0123456789abcdef0123456789abcdef")}
+	other := &auth{key: []byte("fedcba9876543210fedcba9876543210")}
+	viewer := user{Name: "viewer", Clients: []string{"kitchen"}, Expires: time.Now().Add(time.Hour).Unix()}
+
+	seal := func(a *auth, u user) string {
+		sealed, err := a.seal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+	valid := seal(a, viewer)
+	payload, signature, _ := strings.Cut(valid, ".")
+
+	promoted := viewer
+	promoted.Admin = true
+	promotedPayload, _, _ := strings.Cut(seal(other, promoted), ".")
+
+	expired := viewer
+	expired.Expires = time.Now().Add(-time.Second).Unix()
+
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+
+	tests := []struct {
+		name   string
+		cookie string
+		ok     bool
+	}{
+		{"valid", valid, true},
+		{"payload changed", promotedPayload + "." + signature, false},
+		{"signature changed", payload + "." + string(flipped), false},
+		{"signature removed", payload + ".", false},
+		{"no signature", payload, false},
+		{"sealed with another key", seal(other, viewer), false},
+		{"expired", seal(a, expired), false},
+		{"malformed payload", "!." + signature, false},
+		{"malformed signature", payload + ".!", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/clients", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+		u := a.authenticate(r)
+		switch {
+		case tt.ok && u == nil:
+			t.Errorf("%s: not signed in", tt.name)
+		case tt.ok && (u.Name != "viewer" || u.Admin || !u.clients["kitchen"]):
+			t.Errorf("%s: signed in as %+v", tt.name, u)
+		case !tt.ok && u != nil:
+			t.Errorf("%s: signed in as %+v", tt.name, u)
+		}
+	}
+}
+
+// TestResolveGroups checks what users may see from their groups
+func TestResolveGroups(t *testing.T) {
+	a, err := newAuth(AuthConfig{
+		Issuer:         "https://auth.example.com",
+		ClientID:       "libas",
+		PublicURL:      "https://scribe.example.com",
+		AdminGroups:    []string{"Admins"},
+		OperatorGroups: []string{"ops"},
+		ViewerGroups: map[string][]string{
+			"ops":    {"kitchen", "garage"},
+			"family": {"kitchen"},
+			"*":      {"lobby"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		groups   any
+		admin    bool
+		operator bool
+		clients  []string
+	}{
+		{"admin, group case ignored", []any{"admins"}, true, false, []string{"lobby"}},
+		{"operator", []any{"ops"}, false, true, []string{"kitchen", "garage", "lobby"}},
+		{"viewer", "family", false, false, []string{"kitchen", "lobby"}},
+		{"overlapping groups", []any{"family", "ops"}, false, true, []string{"kitchen", "garage", "lobby"}},
+		{"no groups", nil, false, false, []string{"lobby"}},
+	}
+	for _, tt := range tests {
+		claims := map[string]any{"sub": "1", "preferred_username": "jo"}
+		if tt.groups != nil {
+			claims["groups"] = tt.groups
+		}
+		u, err := a.resolve(context.Background(), &oidc.Token{Subject: "1", Claims: claims})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if u.Name != "jo" || u.Admin != tt.admin || u.Operator != tt.operator || !slices.Equal(u.Clients, tt.clients) {
+			t.Errorf("%s: got %+v", tt.name, u)
+		}
+	}
+
+	// Without the everyone group, users in no group have no access
+	delete(a.viewers, allClients)
+	if u, err := a.resolve(context.Background(), &oidc.Token{Subject: "1", Claims: map[string]any{"sub": "1"}}); !errors.Is(err, errNoAccess) {
+		t.Errorf("user in no group: got %+v, %v", u, err)
+	}
+}
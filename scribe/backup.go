@@ -0,0 +1,363 @@
+package scribe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/s3"
+)
+
+const (
+	// How often new recordings are looked for when BackupConfig.Interval is
+	// zero
+	defaultBackupInterval = 5 * time.Minute
+
+	// Attempts at uploading one file in a pass, failures are retried on the
+	// next pass
+	backupAttempts = 3
+
+	// Ledger of uploaded files kept in each day directory
+	backupLedgerFile = "backup.jsonl"
+)
+
+// BackupConfig mirrors finalized recordings and the checksum manifests of
+// their days to a bucket as they arrive, keyed <day>/<client ID>/<file>
+// like the retention archive
+type BackupConfig struct {
+	// Bucket recordings are uploaded to, backups are disabled without one
+	Bucket s3.Config
+
+	// How often new recordings are looked for, defaults to 5 minutes
+	Interval time.Duration
+
+	// Days backed up recordings are kept locally, deleted by the retention
+	// policy before RetentionConfig.AudioDays. Zero leaves them to the
+	// retention policy.
+	LocalDays int
+}
+
+func (c BackupConfig) enabled() bool {
+	return c.Bucket.Enabled()
+}
+
+// backupEntry is one line of a day's ledger, a file as it was uploaded
+type backupEntry struct {
+	// Path relative to the day directory, as in the manifest
+	File   string    `json:"file"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+}
+
+// backup uploads what the manifests list and the ledgers do not
+type backup struct {
+	config BackupConfig
+	dir    string
+	bucket *s3.Client
+
+	mu sync.Mutex // Serializes passes and ledger writes with pruning
+
+	// Modification time of each day's manifest when the day was last fully
+	// backed up, so unchanged days are skipped
+	complete map[string]time.Time
+
+	// Set while uploads fail, so a lasting outage alerts once
+	failing bool
+
+	// Reports whether a client's recordings are kept out of the bucket
+	skip func(clientID string) bool
+}
+
+func newBackup(cfg BackupConfig, dir string) (*backup, error) {
+	if !cfg.enabled() {
+		if cfg.LocalDays > 0 {
+			return nil, fmt.Errorf("keeping backed up recordings for fewer days needs a backup bucket")
+		}
+		return nil, nil
+	}
+	if cfg.LocalDays < 0 {
+		return nil, fmt.Errorf("backup local days must not be negative")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultBackupInterval
+	}
+
+	bucket, err := s3.New(cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure backup: %w", err)
+	}
+	return &backup{config: cfg, dir: dir, bucket: bucket, complete: make(map[string]time.Time)}, nil
+}
+
+// runBackup uploads new recordings each interval until ctx is cancelled
+func (s *Scribe) runBackup(ctx context.Context) {
+	ticker := time.NewTicker(s.backup.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		uploaded, failed := s.backup.pass(ctx)
+		if uploaded > 0 || failed > 0 {
+			slog.Info("Backed up recordings", "uploaded", uploaded, "failed", failed, "bucket", s.backup.bucket.URL(""))
+		}
+
+		switch {
+		case failed > 0 && !s.backup.failing:
+			s.backup.failing = true
+			s.alert(fmt.Sprintf("Backup could not upload %d files", failed), nil)
+		case failed == 0 && s.backup.failing:
+			s.backup.failing = false
+			slog.Info("Backup uploads succeed again")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pass uploads the files of every day not yet in its ledger, returning how
+// many were uploaded and how many failed
+func (b *backup) pass(ctx context.Context) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		slog.Error("Failed to read recordings directory", "error", err)
+		return 0, 0
+	}
+
+	uploaded, failed := 0, 0
+	for _, entry := range entries {
+		if _, err := time.Parse("20060102", entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		dayUploaded, dayFailed := b.backupDay(ctx, entry.Name())
+		uploaded += dayUploaded
+		failed += dayFailed
+	}
+	return uploaded, failed
+}
+
+// backupDay uploads a day's new recordings and then its manifest
+func (b *backup) backupDay(ctx context.Context, day string) (int, int) {
+	dayDir := filepath.Join(b.dir, day)
+
+	manifestInfo, err := os.Stat(filepath.Join(dayDir, audio.ManifestFile))
+	if err != nil {
+		return 0, 0
+	}
+	if b.complete[day].Equal(manifestInfo.ModTime()) {
+		return 0, 0
+	}
+
+	manifest, err := audio.ReadManifest(dayDir)
+	if err != nil {
+		slog.Error("Failed to read manifest", "day", day, "error", err)
+		return 0, 1
+	}
+	ledger, err := readBackupLedger(dayDir)
+	if err != nil {
+		slog.Error("Failed to read backup ledger", "day", day, "error", err)
+		return 0, 1
+	}
+
+	files := make([]string, 0, len(manifest))
+	for file := range manifest {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	uploaded, failed := 0, 0
+	for _, file := range files {
+		entry := manifest[file]
+		if entry.Removed || ledger[file] == entry.SHA256 {
+			continue
+		}
+		if clientID, _, _ := strings.Cut(file, "/"); b.skip != nil && b.skip(clientID) {
+			continue
+		}
+		path := filepath.Join(dayDir, filepath.FromSlash(file))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// Replaced before it was backed up, e.g. by its FLAC copy
+			continue
+		}
+
+		if err := b.upload(ctx, day+"/"+file, path); err != nil {
+			slog.Warn("Failed to back up recording", "file", day+"/"+file, "error", err)
+			failed++
+			continue
+		}
+		if err := appendBackupLedger(dayDir, backupEntry{File: file, SHA256: entry.SHA256, Time: time.Now()}); err != nil {
+			slog.Error("Failed to write backup ledger", "day", day, "error", err)
+			return uploaded, failed + 1
+		}
+		uploaded++
+	}
+
+	// The manifest goes last and only once everything it lists is stored,
+	// so the bucket never lists a file it lacks
+	if failed > 0 {
+		return uploaded, failed
+	}
+	manifestPath := filepath.Join(dayDir, audio.ManifestFile)
+	sum, err := hashBackupFile(manifestPath)
+	if err != nil {
+		slog.Error("Failed to hash manifest", "day", day, "error", err)
+		return uploaded, failed + 1
+	}
+	if ledger[audio.ManifestFile] != sum {
+		if err := b.upload(ctx, day+"/"+audio.ManifestFile, manifestPath); err != nil {
+			slog.Warn("Failed to back up manifest", "day", day, "error", err)
+			return uploaded, failed + 1
+		}
+		if err := appendBackupLedger(dayDir, backupEntry{File: audio.ManifestFile, SHA256: sum, Time: time.Now()}); err != nil {
+			slog.Error("Failed to write backup ledger", "day", day, "error", err)
+			return uploaded, failed + 1
+		}
+	}
+	b.complete[day] = manifestInfo.ModTime()
+	return uploaded, failed
+}
+
+// upload puts a file in the bucket, retrying with backoff
+func (b *backup) upload(ctx context.Context, name, path string) error {
+	backoff := 2 * time.Second
+	for attempt := 1; ; attempt++ {
+		err := b.bucket.PutFile(ctx, name, path)
+		if err == nil || attempt == backupAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backedUp returns the checksums of a day's files that are in the bucket,
+// by path relative to the day directory
+func (b *backup) backedUp(dayDir string) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return readBackupLedger(dayDir)
+}
+
+// readBackupLedger returns the latest checksum uploaded of each file. A
+// missing ledger is empty.
+func readBackupLedger(dayDir string) (map[string]string, error) {
+	ledger := make(map[string]string)
+
+	file, err := os.Open(filepath.Join(dayDir, backupLedgerFile))
+	if os.IsNotExist(err) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup ledger: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry backupEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("Skipping unreadable backup ledger entry", "error", err)
+			continue
+		}
+		ledger[entry.File] = entry.SHA256
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read backup ledger: %w", err)
+	}
+	return ledger, nil
+}
+
+func appendBackupLedger(dayDir string, entry backupEntry) error {
+	file, err := os.OpenFile(filepath.Join(dayDir, backupLedgerFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open backup ledger: %w", err)
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write backup ledger: %w", err)
+	}
+	return nil
+}
+
+// eraseBackupLedger removes a client's files from a day's ledger,
+// returning how many entries were removed. The caller holds the backup's
+// lock when there is a backup.
+func eraseBackupLedger(dayDir, clientID string) (int, error) {
+	path := filepath.Join(dayDir, backupLedgerFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read backup ledger: %w", err)
+	}
+
+	erased := 0
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var entry backupEntry
+		if json.Unmarshal(line, &entry) == nil && strings.HasPrefix(entry.File, clientID+"/") {
+			erased++
+			continue
+		}
+		out.Write(line)
+	}
+	if erased == 0 {
+		return 0, nil
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, out.Bytes(), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write backup ledger: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to write backup ledger: %w", err)
+	}
+	return erased, nil
+}
+
+func hashBackupFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,197 @@
+package scribe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/messenger"
+	"github.com/google/uuid"
+)
+
+const (
+	// Delay before receiving again after a messenger failed, doubled after
+	// each failure up to the maximum
+	botRetry    = time.Second
+	maxBotRetry = time.Minute
+
+	// How long a voice note may wait for its transcription before the
+	// sender is told it failed
+	botTimeout = 30 * time.Minute
+)
+
+// Clients of senders are derived from the messenger and sender in this
+// namespace, so a sender always maps to the same client
+var botNamespace = uuid.MustParse("c3e81f5a-7d24-4b9e-a06c-5f8d2e1b4a97")
+
+// Messenger is a chat service voice notes reach the scribe through, like
+// messenger.Telegram and messenger.Signal
+type Messenger interface {
+	Name() string
+	Receive(ctx context.Context) ([]messenger.VoiceNote, error)
+	Download(ctx context.Context, note messenger.VoiceNote) (io.ReadCloser, error)
+	Reply(ctx context.Context, note messenger.VoiceNote, text string) error
+}
+
+// BotConfig has the scribe transcribe the voice notes sent or forwarded to
+// chat bots and reply to each with its transcription. The notes of a
+// sender are stored under a client of their own, derived from the
+// messenger and the sender.
+type BotConfig struct {
+	Messengers []Messenger
+
+	// Senders answered, by ID or handle: Telegram user IDs or usernames,
+	// Signal account UUIDs or phone numbers. Empty answers anyone who
+	// finds the bot.
+	Allow []string
+}
+
+// allows reports whether the sender of a voice note is answered
+func (c BotConfig) allows(note messenger.VoiceNote) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range c.Allow {
+		allowed = strings.TrimPrefix(allowed, "@")
+		if allowed == note.Sender || (note.Handle != "" && strings.EqualFold(allowed, note.Handle)) {
+			return true
+		}
+	}
+	return false
+}
+
+// transcriptionResult is how the transcription of a recording waited for
+// ended, with empty text when it held no speech
+type transcriptionResult struct {
+	text string
+	err  error
+}
+
+// awaitTranscription has the transcription of a recording handed over
+// once its job is done
+func (s *Scribe) awaitTranscription(path string) <-chan transcriptionResult {
+	done := make(chan transcriptionResult, 1)
+	s.awaiting.Store(path, done)
+	return done
+}
+
+// settle hands the transcription of a recording to whoever waits for it,
+// the first call for a job winning
+func (s *Scribe) settle(path, text string, err error) {
+	if done, ok := s.awaiting.LoadAndDelete(path); ok {
+		done.(chan transcriptionResult) <- transcriptionResult{text: text, err: err}
+	}
+}
+
+// runBot answers the voice notes arriving through a messenger until ctx
+// ends
+func (s *Scribe) runBot(ctx context.Context, m Messenger) {
+	slog.Info("Receiving voice notes", "messenger", m.Name())
+	if len(s.config.Bot.Allow) == 0 {
+		slog.Warn("Voice notes of anyone are transcribed, restrict the senders to keep strangers out", "messenger", m.Name())
+	}
+
+	retry := botRetry
+	for ctx.Err() == nil {
+		notes, err := m.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Failed to receive voice notes, retrying", "error", err, "messenger", m.Name(), "retryIn", retry)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry = min(2*retry, maxBotRetry)
+			continue
+		}
+		retry = botRetry
+		for _, note := range notes {
+			go s.answerVoiceNote(ctx, m, note)
+		}
+	}
+}
+
+// answerVoiceNote transcribes a voice note under the client of its sender
+// and replies with the transcription
+func (s *Scribe) answerVoiceNote(ctx context.Context, m Messenger, note messenger.VoiceNote) {
+	if !s.config.Bot.allows(note) {
+		slog.Warn("Ignoring voice note of sender not allowed",
+			"messenger", m.Name(),
+			"sender", note.Sender,
+			"handle", note.Handle,
+			"name", note.Name)
+		return
+	}
+	clientID := uuid.NewSHA1(botNamespace, []byte(m.Name()+":"+note.Sender)).String()
+
+	reply, err := s.transcribeVoiceNote(ctx, m, note, clientID)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to transcribe voice note", "error", err, "messenger", m.Name(), "sender", note.Sender, "clientID", clientID)
+		reply = "Sorry, the voice note could not be transcribed."
+	} else if reply == "" {
+		reply = "No speech was found in the voice note."
+	}
+	if err := m.Reply(ctx, note, reply); err != nil {
+		slog.Error("Failed to reply to voice note", "error", err, "messenger", m.Name(), "sender", note.Sender, "clientID", clientID)
+	}
+}
+
+// transcribeVoiceNote stores a voice note as a recording of the client,
+// queues it and waits for its transcription
+func (s *Scribe) transcribeVoiceNote(ctx context.Context, m Messenger, note messenger.VoiceNote, clientID string) (string, error) {
+	needsFFmpeg, ok := uploadExtensions[note.Ext]
+	if !ok {
+		needsFFmpeg, ok = inboxExtensions[note.Ext]
+	}
+	if !ok || (needsFFmpeg && !audio.FFmpegAvailable()) {
+		return "", fmt.Errorf("unsupported audio format %q", note.Ext)
+	}
+
+	body, err := m.Download(ctx, note)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	// Waiting starts before the recording exists, the watcher may queue it
+	// as soon as it does
+	path := s.uploadPath(clientID)
+	done := s.awaitTranscription(path)
+	defer s.awaiting.Delete(path)
+	if err := s.storeUploadAs(path, body, note.Ext); err != nil {
+		return "", err
+	}
+	s.clients.LoadOrStore(clientID, &ClientTranscriptions{
+		Messages: make([]TranscriptionMessage, 0),
+	})
+	if err := s.queueAudioFile(ctx, clientID, path); err != nil {
+		return "", err
+	}
+	slog.Info("Queued voice note",
+		"messenger", m.Name(),
+		"sender", note.Sender,
+		"clientID", clientID,
+		"file", filepath.Base(path))
+
+	timeout := time.NewTimer(botTimeout)
+	defer timeout.Stop()
+	select {
+	case result := <-done:
+		return result.text, result.err
+	case <-timeout.C:
+		return "", fmt.Errorf("transcription took longer than %s", botTimeout)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
@@ -0,0 +1,228 @@
+package scribe
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	// Limits of the transcription cache when CacheConfig leaves them zero
+	defaultCacheMessagesPerClient = 1000
+	defaultCacheMessages          = 50000
+	defaultCacheMaxAge            = 48 * time.Hour
+
+	// How often transcriptions past the age limit are evicted
+	cacheSweepInterval = time.Minute
+)
+
+// CacheConfig bounds the transcriptions kept in memory for the client list,
+// history and WebSocket catch-up. Evicted transcriptions stay in the
+// journal and are read from there when a request reaches past the cache.
+// A client's newest transcription is never evicted. Zero uses the default
+// of a limit, a negative value removes it.
+type CacheConfig struct {
+	// Transcriptions kept per client, defaults to 1000
+	MessagesPerClient int
+
+	// Transcriptions kept over all clients, the oldest are evicted first,
+	// defaults to 50000
+	Messages int
+
+	// Age after which transcriptions are evicted, defaults to 48 hours
+	MaxAge time.Duration
+}
+
+func (c CacheConfig) withDefaults() CacheConfig {
+	if c.MessagesPerClient == 0 {
+		c.MessagesPerClient = defaultCacheMessagesPerClient
+	}
+	if c.Messages == 0 {
+		c.Messages = defaultCacheMessages
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultCacheMaxAge
+	}
+	return c
+}
+
+// remember adds a transcription to the client's cache, evicting what no
+// longer fits
+func (s *Scribe) remember(clientID string, msg TranscriptionMessage) {
+	value, _ := s.clients.LoadOrStore(clientID, &ClientTranscriptions{
+		Messages: make([]TranscriptionMessage, 0),
+	})
+	ct := value.(*ClientTranscriptions)
+	ct.add(msg)
+	added := int64(1)
+	if limit := s.config.Cache.MessagesPerClient; limit > 0 {
+		added -= int64(ct.trim(limit))
+	}
+
+	if total := s.cached.Add(added); s.config.Cache.Messages > 0 && total > int64(s.config.Cache.Messages) {
+		s.evictOldest()
+	}
+}
+
+// evictOldest evicts the oldest transcriptions of all clients until the
+// cache is a tenth below its limit, so eviction does not run on every add
+func (s *Scribe) evictOldest() {
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+
+	limit := s.config.Cache.Messages
+	excess := int(s.cached.Load()) - limit + limit/10
+	if excess <= 0 {
+		return
+	}
+
+	// Every client's newest transcription stays
+	var timestamps []time.Time
+	s.clients.Range(func(_, value interface{}) bool {
+		messages := value.(*ClientTranscriptions).snapshot()
+		for _, msg := range messages[:max(len(messages)-1, 0)] {
+			timestamps = append(timestamps, msg.Timestamp)
+		}
+		return true
+	})
+	if len(timestamps) == 0 {
+		return
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i].Before(timestamps[j]) })
+	cutoff := timestamps[min(excess, len(timestamps))-1]
+
+	evicted := s.evictThrough(cutoff)
+	slog.Debug("Evicted oldest transcriptions from cache", "evicted", evicted, "through", cutoff)
+}
+
+// evictThrough evicts every client's transcriptions up to t, returning how
+// many were evicted
+func (s *Scribe) evictThrough(t time.Time) int {
+	evicted := 0
+	s.clients.Range(func(_, value interface{}) bool {
+		evicted += value.(*ClientTranscriptions).evictThrough(t)
+		return true
+	})
+	s.cached.Add(-int64(evicted))
+	return evicted
+}
+
+// runCacheSweep evicts transcriptions past the age limit
+func (s *Scribe) runCacheSweep(ctx context.Context) {
+	ticker := time.NewTicker(cacheSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if evicted := s.evictThrough(time.Now().Add(-s.config.Cache.MaxAge)); evicted > 0 {
+				slog.Debug("Evicted expired transcriptions from cache", "evicted", evicted)
+			}
+		}
+	}
+}
+
+// messagesFrom returns a client's transcriptions made at or after from,
+// oldest first, reading the journal when some were evicted from the cache
+func (s *Scribe) messagesFrom(clientID string, from time.Time) ([]TranscriptionMessage, bool, error) {
+	value, known := s.clients.Load(clientID)
+	if !known {
+		return nil, false, nil
+	}
+	ct := value.(*ClientTranscriptions)
+	messages := make([]TranscriptionMessage, 0)
+	if ct.cachedFrom(from) {
+		for _, msg := range ct.snapshot() {
+			if !msg.Timestamp.Before(from) {
+				messages = append(messages, msg)
+			}
+		}
+		return messages, true, nil
+	}
+
+	err := s.store.from(from, func(record StoredTranscription) bool {
+		if record.ClientID == clientID && !record.Message.Timestamp.Before(from) {
+			messages = append(messages, record.Message)
+		}
+		return true
+	})
+	return messages, true, err
+}
+
+// trim evicts the oldest messages beyond limit, returning how many were
+// evicted
+func (ct *ClientTranscriptions) trim(limit int) int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	n := len(ct.Messages) - max(limit, 1)
+	if n <= 0 {
+		return 0
+	}
+	ct.evict(n)
+	return n
+}
+
+// evictThrough evicts messages made up to t except the newest, returning
+// how many were evicted
+func (ct *ClientTranscriptions) evictThrough(t time.Time) int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	n := 0
+	for n < len(ct.Messages)-1 && !ct.Messages[n].Timestamp.After(t) {
+		n++
+	}
+	if n > 0 {
+		ct.evict(n)
+	}
+	return n
+}
+
+// evict drops the n oldest messages, remembering the newest time evicted.
+// The caller holds the lock.
+func (ct *ClientTranscriptions) evict(n int) {
+	for _, msg := range ct.Messages[:n] {
+		if msg.Timestamp.After(ct.evicted) {
+			ct.evicted = msg.Timestamp
+		}
+	}
+	ct.Messages = slices.Delete(ct.Messages, 0, n)
+}
+
+// erase drops the messages made on the days (YYYYMMDD) inRange accepts,
+// returning how many were dropped and how many are left
+func (ct *ClientTranscriptions) erase(inRange func(day string) bool) (int, int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	kept := ct.Messages[:0]
+	for _, msg := range ct.Messages {
+		if !inRange(msg.Timestamp.Format("20060102")) {
+			kept = append(kept, msg)
+		}
+	}
+	erased := len(ct.Messages) - len(kept)
+	ct.Messages = kept
+	return erased, len(kept)
+}
+
+// replace swaps the cached message of the same sequence number for msg
+func (ct *ClientTranscriptions) replace(msg TranscriptionMessage) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for i := range ct.Messages {
+		if ct.Messages[i].Sequence == msg.Sequence {
+			ct.Messages[i] = msg
+			return
+		}
+	}
+}
+
+// cachedFrom reports whether every message made at or after from is still
+// cached
+func (ct *ClientTranscriptions) cachedFrom(from time.Time) bool {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.evicted.IsZero() || ct.evicted.Before(from)
+}
@@ -0,0 +1,166 @@
+package scribe
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/calendar"
+)
+
+const (
+	// How often calendars are read when Config.CalendarInterval is zero
+	defaultCalendarInterval = 5 * time.Minute
+
+	// Events are read this far around now, covering recordings that wait
+	// in the queue
+	calendarWindow = 36 * time.Hour
+)
+
+// CalendarSource lists the events of a calendar, like calendar.Client
+type CalendarSource interface {
+	Events(ctx context.Context, from, to time.Time) ([]calendar.Event, error)
+
+	// URL describes the calendar for logs
+	URL() string
+}
+
+// Calendar labels the transcriptions made during its events with their
+// titles
+type Calendar struct {
+	Source CalendarSource
+
+	// Label only the transcriptions of these clients, by client ID or by
+	// the host they connect from. Every client when empty.
+	Clients []string
+}
+
+// OpenCalendar creates a calendar from a URL: an iCalendar feed over
+// https://, http:// or webcal://, such as the secret iCal address of a
+// Google calendar, or a CalDAV calendar collection over caldavs:// or
+// caldav://. Credentials go in the user info. The clients query parameter
+// limits the calendar to a comma separated list of client IDs or hosts.
+func OpenCalendar(rawURL string) (Calendar, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return Calendar{}, fmt.Errorf("invalid calendar URL %q", redactURL(rawURL))
+	}
+	query := u.Query()
+	result := Calendar{Clients: splitClients(query.Get("clients"))}
+	query.Del("clients")
+
+	cfg := calendar.Config{User: u.User.Username()}
+	cfg.Password, _ = u.User.Password()
+	switch u.Scheme {
+	case "https", "http":
+	case "webcal", "webcals":
+		u.Scheme = "https"
+	case "caldavs":
+		u.Scheme, cfg.CalDAV = "https", true
+	case "caldav":
+		u.Scheme, cfg.CalDAV = "http", true
+	default:
+		return Calendar{}, fmt.Errorf("unsupported calendar scheme %q, expected https, webcal or caldavs", u.Scheme)
+	}
+	u.User = nil
+	u.RawQuery = query.Encode()
+	cfg.URL = u.String()
+
+	result.Source, err = calendar.New(cfg)
+	if err != nil {
+		return Calendar{}, fmt.Errorf("invalid calendar %s: %w", redactURL(rawURL), err)
+	}
+	return result, nil
+}
+
+// calendarState is the latest events read from one calendar
+type calendarState struct {
+	Calendar
+	clients map[string]bool
+
+	mu     sync.Mutex
+	events []calendar.Event
+
+	// Set while reading fails, so a lasting outage alerts once
+	failing bool
+}
+
+func newCalendars(configured []Calendar) []*calendarState {
+	states := make([]*calendarState, 0, len(configured))
+	for _, cfg := range configured {
+		state := &calendarState{Calendar: cfg, clients: make(map[string]bool)}
+		for _, client := range cfg.Clients {
+			state.clients[client] = true
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// runCalendars rereads the calendars each interval until ctx is cancelled.
+// A calendar that cannot be read keeps its previous events.
+func (s *Scribe) runCalendars(ctx context.Context) {
+	interval := s.config.CalendarInterval
+	if interval <= 0 {
+		interval = defaultCalendarInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		for _, state := range s.calendars {
+			events, err := state.Source.Events(ctx, now.Add(-calendarWindow), now.Add(calendarWindow))
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Warn("Failed to read calendar", "calendar", state.Source.URL(), "error", err)
+				if !state.failing {
+					state.failing = true
+					s.alert("Calendar "+state.Source.URL()+" cannot be read", err)
+				}
+				continue
+			}
+			if state.failing {
+				state.failing = false
+				slog.Info("Calendar can be read again", "calendar", state.Source.URL())
+			}
+
+			state.mu.Lock()
+			state.events = events
+			state.mu.Unlock()
+			slog.Debug("Read calendar", "calendar", state.Source.URL(), "events", len(events))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// calendarEvents returns the titles of the events a client's recording
+// made at t falls in
+func (s *Scribe) calendarEvents(clientID string, t time.Time) []string {
+	var titles []string
+	seen := make(map[string]bool)
+	for _, state := range s.calendars {
+		if !s.selects(state.clients, clientID) {
+			continue
+		}
+		state.mu.Lock()
+		for _, event := range state.events {
+			if !t.Before(event.Start) && t.Before(event.End) && event.Title != "" && !seen[event.Title] {
+				seen[event.Title] = true
+				titles = append(titles, event.Title)
+			}
+		}
+		state.mu.Unlock()
+	}
+	return titles
+}
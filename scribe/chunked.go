@@ -0,0 +1,522 @@
+package scribe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Directory in the recordings directory chunked uploads are received in
+	uploadsDir = "uploads"
+
+	// Largest chunked upload, and chunk appended in one request
+	maxChunkedUploadSize = 4 << 30
+	maxUploadChunk       = 64 << 20
+
+	// Most samples decoded from a chunked upload, as much 16-bit audio as
+	// the largest one holds
+	maxChunkedSamples = maxChunkedUploadSize / 2
+
+	// Uploads untouched for this long are discarded
+	chunkedUploadExpiry = 24 * time.Hour
+
+	// Status of a chunked upload
+	uploadReceiving  = "receiving"
+	uploadProcessing = "processing"
+	uploadQueued     = "queued"
+	uploadFailed     = "failed"
+)
+
+// Chunked upload IDs, kept apart from UUIDs so pseudonyms leave them alone
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// ChunkedUpload is the state of a resumable upload of a long recording
+type ChunkedUpload struct {
+	ID       string `json:"id"`
+	ClientID string `json:"clientId"`
+	FileName string `json:"fileName"`
+
+	// Size of the whole file and how much of it was received
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset"`
+
+	// receiving, processing (converting for whisper), queued or failed
+	Status string `json:"status"`
+
+	// Whisper copy queued for transcription once the upload is complete
+	AudioFile string `json:"audioFile,omitempty"`
+
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// createUploadRequest is the body of POST /api/uploads
+type createUploadRequest struct {
+	ClientID string `json:"clientId"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+}
+
+// chunkedUploads keeps the state of each upload next to its data, so
+// uploads resume across restarts
+type chunkedUploads struct {
+	dir string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // Held while an upload is appended to or processed
+}
+
+func newChunkedUploads(recordingsDir string) *chunkedUploads {
+	return &chunkedUploads{
+		dir:   filepath.Join(recordingsDir, uploadsDir),
+		locks: make(map[string]*sync.Mutex),
+	}
+}
+
+func (u *chunkedUploads) statePath(id string) string {
+	return filepath.Join(u.dir, id+".json")
+}
+
+func (u *chunkedUploads) dataPath(id string) string {
+	return filepath.Join(u.dir, id+".part")
+}
+
+// lock returns the lock of an upload
+func (u *chunkedUploads) lock(id string) *sync.Mutex {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	lock, ok := u.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		u.locks[id] = lock
+	}
+	return lock
+}
+
+// load reads the state of an upload, taking the offset from the data
+// received so far
+func (u *chunkedUploads) load(id string) (*ChunkedUpload, error) {
+	data, err := os.ReadFile(u.statePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var upload ChunkedUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state: %w", err)
+	}
+	if upload.Status == uploadReceiving {
+		if info, err := os.Stat(u.dataPath(id)); err == nil {
+			upload.Offset = info.Size()
+		}
+	}
+	return &upload, nil
+}
+
+func (u *chunkedUploads) save(upload *ChunkedUpload) error {
+	upload.Updated = time.Now()
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload state: %w", err)
+	}
+	path := u.statePath(upload.ID)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	return nil
+}
+
+func (u *chunkedUploads) remove(id string) {
+	os.Remove(u.dataPath(id))
+	os.Remove(u.statePath(id))
+	u.mu.Lock()
+	delete(u.locks, id)
+	u.mu.Unlock()
+}
+
+// ids lists the uploads with a state file
+func (u *chunkedUploads) ids() []string {
+	matches, _ := filepath.Glob(filepath.Join(u.dir, "*.json"))
+	ids := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if id := strings.TrimSuffix(filepath.Base(match), ".json"); uploadIDPattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// expire discards uploads untouched for chunkedUploadExpiry
+func (u *chunkedUploads) expire() {
+	for _, id := range u.ids() {
+		lock := u.lock(id)
+		if !lock.TryLock() {
+			continue
+		}
+		upload, err := u.load(id)
+		if err == nil && upload.Status != uploadProcessing && time.Since(upload.Updated) > chunkedUploadExpiry {
+			slog.Info("Discarding expired upload", "upload", id, "clientID", upload.ClientID, "status", upload.Status)
+			u.remove(id)
+		}
+		lock.Unlock()
+	}
+}
+
+// erase discards a client's uploads started on the days inRange accepts,
+// returning how many were discarded and the IDs of those busy being
+// received or processed
+func (u *chunkedUploads) erase(clientID string, inRange func(day string) bool) (int, []string) {
+	erased := 0
+	var busy []string
+	for _, id := range u.ids() {
+		upload, err := u.load(id)
+		if err != nil || upload.ClientID != clientID || !inRange(upload.Created.Format("20060102")) {
+			continue
+		}
+		lock := u.lock(id)
+		if !lock.TryLock() {
+			busy = append(busy, id)
+			continue
+		}
+		u.remove(id)
+		lock.Unlock()
+		erased++
+	}
+	return erased, busy
+}
+
+// resumeUploads finishes the uploads a restart interrupted while they were
+// processed
+func (s *Scribe) resumeUploads() {
+	for _, id := range s.uploads.ids() {
+		upload, err := s.uploads.load(id)
+		if err != nil || upload.Status != uploadProcessing {
+			continue
+		}
+		slog.Info("Resuming processing of upload", "upload", id, "clientID", upload.ClientID)
+		lock := s.uploads.lock(id)
+		lock.Lock()
+		go s.finishUpload(upload, lock)
+	}
+}
+
+// handleCreateUpload starts a resumable upload of { "fileName", "size" }
+// and the optional "clientId", a new client ID being generated without
+func (s *Scribe) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	var req createUploadRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ClientID == "" {
+		req.ClientID = uuid.New().String()
+	} else if _, err := uuid.Parse(req.ClientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+	if req.Size <= 0 || req.Size > maxChunkedUploadSize {
+		http.Error(w, fmt.Sprintf("Size must be between 1 and %d bytes", maxChunkedUploadSize), http.StatusBadRequest)
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(req.FileName))
+	needsFFmpeg, ok := uploadExtensions[ext]
+	if !ok || req.FileName != filepath.Base(req.FileName) {
+		http.Error(w, "Unsupported audio format", http.StatusUnsupportedMediaType)
+		return
+	}
+	if needsFFmpeg && !audio.FFmpegAvailable() {
+		http.Error(w, "Unsupported audio format, "+ext+" uploads need ffmpeg", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.uploads.expire()
+	if err := os.MkdirAll(s.uploads.dir, 0755); err != nil {
+		slog.Error("Failed to create uploads directory", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	upload := &ChunkedUpload{
+		ID:       hex.EncodeToString(id),
+		ClientID: req.ClientID,
+		FileName: req.FileName,
+		Size:     req.Size,
+		Status:   uploadReceiving,
+		Created:  time.Now(),
+	}
+	if err := os.WriteFile(s.uploads.dataPath(upload.ID), nil, 0644); err != nil {
+		slog.Error("Failed to create upload", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.uploads.save(upload); err != nil {
+		slog.Error("Failed to create upload", "error", err)
+		os.Remove(s.uploads.dataPath(upload.ID))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Started chunked upload",
+		"upload", upload.ID,
+		"clientID", upload.ClientID,
+		"file", upload.FileName,
+		"size", upload.Size)
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID)
+	writeUpload(w, http.StatusCreated, upload)
+}
+
+// handleGetUpload reports how much of an upload was received, to resume
+// it, and once complete the recording queued for transcription
+func (s *Scribe) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := s.findUpload(w, r)
+	if !ok {
+		return
+	}
+	writeUpload(w, http.StatusOK, upload)
+}
+
+// handleAppendUpload appends the body to an upload at the "offset" query
+// parameter, which must be the amount received so far. What arrives of a
+// body cut off is kept, and nothing of one running past the upload's size.
+// The upload is processed once it is complete.
+func (s *Scribe) handleAppendUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !uploadIDPattern.MatchString(id) {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	lock := s.uploads.lock(id)
+	if !lock.TryLock() {
+		http.Error(w, "Upload is busy", http.StatusConflict)
+		return
+	}
+	upload, err := s.uploads.load(id)
+	if err != nil {
+		lock.Unlock()
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		slog.Error("Failed to read upload", "error", err, "upload", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if upload.Status != uploadReceiving {
+		lock.Unlock()
+		http.Error(w, "Upload is complete", http.StatusConflict)
+		return
+	}
+	if offset != upload.Offset {
+		lock.Unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, fmt.Sprintf("Offset mismatch, %d bytes were received", upload.Offset), http.StatusConflict)
+		return
+	}
+
+	file, err := os.OpenFile(s.uploads.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		lock.Unlock()
+		slog.Error("Failed to open upload", "error", err, "upload", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	start := upload.Offset
+	body := http.MaxBytesReader(w, r.Body, min(upload.Size-start, maxUploadChunk))
+	written, copyErr := io.Copy(file, body)
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += written
+
+	// Bytes past the declared size mean the chunk or the size is wrong, and
+	// keeping the rest would leave a full upload that can't be completed
+	var tooLarge *http.MaxBytesError
+	if errors.As(copyErr, &tooLarge) && upload.Offset == upload.Size {
+		if err := os.Truncate(s.uploads.dataPath(id), start); err != nil {
+			slog.Error("Failed to discard chunk", "error", err, "upload", id)
+		} else {
+			upload.Offset = start
+		}
+	}
+	if err := s.uploads.save(upload); err != nil {
+		slog.Error("Failed to save upload", "error", err, "upload", id)
+	}
+
+	if copyErr != nil {
+		lock.Unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		if errors.As(copyErr, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Chunk too large, at most %d bytes are taken at once and %d remain",
+				maxUploadChunk, upload.Size-upload.Offset), http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.Warn("Upload chunk cut off", "error", copyErr, "upload", id, "offset", upload.Offset)
+		http.Error(w, "Failed to read chunk", http.StatusBadRequest)
+		return
+	}
+
+	if upload.Offset < upload.Size {
+		lock.Unlock()
+		writeUpload(w, http.StatusOK, upload)
+		return
+	}
+
+	upload.Status = uploadProcessing
+	if err := s.uploads.save(upload); err != nil {
+		slog.Error("Failed to save upload", "error", err, "upload", id)
+	}
+	slog.Info("Chunked upload complete", "upload", id, "clientID", upload.ClientID, "size", upload.Size)
+	go s.finishUpload(upload, lock)
+	writeUpload(w, http.StatusAccepted, upload)
+}
+
+// handleDeleteUpload abandons an upload, or forgets a finished one
+func (s *Scribe) handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !uploadIDPattern.MatchString(id) {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+	lock := s.uploads.lock(id)
+	if !lock.TryLock() {
+		http.Error(w, "Upload is busy", http.StatusConflict)
+		return
+	}
+	defer lock.Unlock()
+	if _, err := os.Stat(s.uploads.statePath(id)); err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	s.uploads.remove(id)
+	slog.Info("Deleted chunked upload", "upload", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findUpload loads the upload of a request, answering the request when it
+// cannot
+func (s *Scribe) findUpload(w http.ResponseWriter, r *http.Request) (*ChunkedUpload, bool) {
+	id := mux.Vars(r)["id"]
+	if !uploadIDPattern.MatchString(id) {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return nil, false
+	}
+	upload, err := s.uploads.load(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return nil, false
+		}
+		slog.Error("Failed to read upload", "error", err, "upload", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return upload, true
+}
+
+func writeUpload(w http.ResponseWriter, status int, upload *ChunkedUpload) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(upload); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// finishUpload converts a complete upload for whisper and queues it,
+// releasing the upload's lock when done
+func (s *Scribe) finishUpload(upload *ChunkedUpload, lock *sync.Mutex) {
+	defer lock.Unlock()
+
+	file, err := s.storeChunkedUpload(upload)
+	if err != nil {
+		slog.Error("Failed to process chunked upload", "error", err, "upload", upload.ID, "clientID", upload.ClientID)
+		upload.Status = uploadFailed
+		upload.Error = err.Error()
+	} else {
+		upload.Status = uploadQueued
+		upload.AudioFile = file
+		os.Remove(s.uploads.dataPath(upload.ID))
+	}
+	if err := s.uploads.save(upload); err != nil {
+		slog.Error("Failed to save upload", "error", err, "upload", upload.ID)
+	}
+}
+
+// storeChunkedUpload writes the whisper copy of a complete upload into today's
+// directory for the client and queues it, returning its name. It waits for
+// room in a full queue. Segmentation cuts it into windows if it is long.
+func (s *Scribe) storeChunkedUpload(upload *ChunkedUpload) (string, error) {
+	// The converter needs the extension to pick a decoder
+	original := s.uploads.dataPath(upload.ID) + strings.ToLower(filepath.Ext(upload.FileName))
+	if _, err := os.Stat(original); err != nil {
+		if err := os.Rename(s.uploads.dataPath(upload.ID), original); err != nil {
+			return "", fmt.Errorf("failed to prepare upload: %w", err)
+		}
+	}
+	defer os.Rename(original, s.uploads.dataPath(upload.ID))
+
+	clientDir := filepath.Join(s.getCurrentDayPath(), upload.ClientID)
+	if err := os.MkdirAll(clientDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create client directory: %w", err)
+	}
+	name := fmt.Sprintf("upload_%s_%s_whisper.wav", time.Now().Format("150405"), upload.ID[:8])
+	path := filepath.Join(clientDir, name)
+	tmpPath := path + ".tmp"
+	if err := audio.ConvertForWhisper(original, tmpPath, audio.ConvertOptions{MaxSamples: maxChunkedSamples}); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to finalize upload: %w", err)
+	}
+	if err := audio.RecordChecksum(path); err != nil {
+		slog.Error("Failed to record checksum", "error", err, "file", path)
+	}
+
+	if err := s.queueAudioFile(context.Background(), upload.ClientID, path); err != nil {
+		// Stored all the same, the next start queues it
+		slog.Warn("Chunked upload left for the next start", "error", err, "upload", upload.ID, "clientID", upload.ClientID)
+		return name, nil
+	}
+	slog.Info("Queued chunked upload",
+		"upload", upload.ID,
+		"clientID", upload.ClientID,
+		"file", name)
+	return name, nil
+}
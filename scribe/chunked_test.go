@@ -0,0 +1,310 @@
+package scribe
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+	"github.com/google/uuid"
+)
+
+// uploadRequest sends a request to the chunked upload API
+func uploadRequest(t *testing.T, s *Scribe, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, httptest.NewRequest(method, target, body))
+	return w
+}
+
+// createUpload starts an upload and returns its state
+func createUpload(t *testing.T, s *Scribe, fileName string, size int) *ChunkedUpload {
+	t.Helper()
+	w := uploadRequest(t, s, "POST", "/api/uploads", strings.NewReader(`{"fileName":"`+fileName+`","size":`+strconv.Itoa(size)+`}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	var upload ChunkedUpload
+	if err := json.Unmarshal(w.Body.Bytes(), &upload); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") != "/api/uploads/"+upload.ID {
+		t.Errorf("Location is %q", w.Header().Get("Location"))
+	}
+	return &upload
+}
+
+// waitForUpload polls an upload until it is no longer processed
+func waitForUpload(t *testing.T, s *Scribe, id string) *ChunkedUpload {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w := uploadRequest(t, s, "GET", "/api/uploads/"+id, nil)
+		var upload ChunkedUpload
+		json.Unmarshal(w.Body.Bytes(), &upload)
+		if w.Code != http.StatusOK || upload.Status != uploadProcessing {
+			return &upload
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upload still processing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// cutOff is a request body that fails after its data
+type cutOff struct {
+	io.Reader
+}
+
+func (c cutOff) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestChunkedUpload(t *testing.T) {
+	var buf bytes.Buffer
+	if err := audio.EncodeWav(&buf, audiotest.Speech(16000, time.Second, -6)); err != nil {
+		t.Fatal(err)
+	}
+	wav := buf.Bytes()
+	s := newTestScribe(t, Config{})
+
+	upload := createUpload(t, s, "long.WAV", len(wav))
+	if !uploadIDPattern.MatchString(upload.ID) || upload.Status != uploadReceiving || upload.Offset != 0 || upload.Size != int64(len(wav)) {
+		t.Fatalf("got %+v", upload)
+	}
+	if _, err := uuid.Parse(upload.ClientID); err != nil {
+		t.Errorf("generated client ID %q: %v", upload.ClientID, err)
+	}
+	target := "/api/uploads/" + upload.ID
+
+	// Each step sends a chunk at an offset and checks what was received
+	steps := []struct {
+		name   string
+		offset string
+		body   io.Reader
+		status int
+		after  int // Bytes received after the step
+	}{
+		{"first chunk", "0", bytes.NewReader(wav[:1000]), http.StatusOK, 1000},
+		{"first chunk again", "0", bytes.NewReader(wav[:1000]), http.StatusConflict, 1000},
+		{"overlapping chunk", "500", bytes.NewReader(wav[500:2000]), http.StatusConflict, 1000},
+		{"chunk out of order", "2000", bytes.NewReader(wav[2000:3000]), http.StatusConflict, 1000},
+		{"empty chunk", "1000", bytes.NewReader(nil), http.StatusOK, 1000},
+		{"chunk cut off", "1000", cutOff{bytes.NewReader(wav[1000:1500])}, http.StatusBadRequest, 1500},
+		{"rest of the cut off chunk", "1500", bytes.NewReader(wav[1500:3000]), http.StatusOK, 3000},
+		{"chunk past the size", "3000", bytes.NewReader(append(bytes.Clone(wav[3000:]), 0, 0)), http.StatusRequestEntityTooLarge, 3000},
+		{"missing offset", "", bytes.NewReader(wav[3000:]), http.StatusBadRequest, 3000},
+		{"negative offset", "-1", bytes.NewReader(wav[3000:]), http.StatusBadRequest, 3000},
+		{"offset not a number", "0x0", bytes.NewReader(wav[3000:]), http.StatusBadRequest, 3000},
+	}
+	for _, step := range steps {
+		w := uploadRequest(t, s, "PATCH", target+"?offset="+step.offset, step.body)
+		if w.Code != step.status {
+			t.Errorf("%s: got %d %q, want %d", step.name, w.Code, strings.TrimSpace(w.Body.String()), step.status)
+		}
+		// Requests refused before reading the upload don't know its offset
+		offset := w.Header().Get("Upload-Offset")
+		if offset != strconv.Itoa(step.after) && (offset != "" || w.Code != http.StatusBadRequest) {
+			t.Errorf("%s: Upload-Offset %q, want %d", step.name, offset, step.after)
+		}
+		data, _ := os.ReadFile(s.uploads.dataPath(upload.ID))
+		if !bytes.Equal(data, wav[:step.after]) {
+			t.Errorf("%s: received %d bytes, want the first %d", step.name, len(data), step.after)
+		}
+	}
+
+	// Resuming asks where to continue
+	w := uploadRequest(t, s, "HEAD", target, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "3000" {
+		t.Errorf("HEAD got %d with Upload-Offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	w = uploadRequest(t, s, "PATCH", target+"?offset=3000", bytes.NewReader(wav[3000:]))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("last chunk: got %d %q", w.Code, w.Body.String())
+	}
+	done := waitForUpload(t, s, upload.ID)
+	if done.Status != uploadQueued || done.Offset != int64(len(wav)) || done.Error != "" {
+		t.Fatalf("got %+v", done)
+	}
+	if _, err := os.Stat(filepath.Join(s.getCurrentDayPath(), upload.ClientID, done.AudioFile)); err != nil {
+		t.Errorf("whisper copy: %v", err)
+	}
+	if len(s.queue) != 1 {
+		t.Errorf("%d jobs queued", len(s.queue))
+	}
+	if _, err := os.Stat(s.uploads.dataPath(upload.ID)); !os.IsNotExist(err) {
+		t.Errorf("received data left behind: %v", err)
+	}
+
+	w = uploadRequest(t, s, "PATCH", target+"?offset="+strconv.Itoa(len(wav)), bytes.NewReader(nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("appending to a complete upload got %d", w.Code)
+	}
+
+	w = uploadRequest(t, s, "DELETE", target, nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE got %d", w.Code)
+	}
+	if w := uploadRequest(t, s, "GET", target, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE got %d", w.Code)
+	}
+}
+
+// Nothing is kept of a chunk running past the size, so the upload can still
+// be completed
+func TestChunkedUploadPastSize(t *testing.T) {
+	s := newTestScribe(t, Config{})
+	upload := createUpload(t, s, "recording.wav", 10)
+	target := "/api/uploads/" + upload.ID
+
+	w := uploadRequest(t, s, "PATCH", target+"?offset=0", strings.NewReader("0123456789abc"))
+	if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("got %d with Upload-Offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// Not audio, so processing it fails
+	w = uploadRequest(t, s, "PATCH", target+"?offset=0", strings.NewReader("0123456789"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	done := waitForUpload(t, s, upload.ID)
+	if done.Status != uploadFailed || done.Error == "" || done.AudioFile != "" {
+		t.Errorf("got %+v", done)
+	}
+	if len(s.queue) != 0 {
+		t.Errorf("%d jobs queued", len(s.queue))
+	}
+}
+
+func TestChunkedUploadInvalid(t *testing.T) {
+	s := newTestScribe(t, Config{})
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`not json`, http.StatusBadRequest},
+		{`{"fileName":"a.wav","size":0}`, http.StatusBadRequest},
+		{`{"fileName":"a.wav","size":-5}`, http.StatusBadRequest},
+		{`{"fileName":"a.wav","size":` + strconv.Itoa(maxChunkedUploadSize+1) + `}`, http.StatusBadRequest},
+		{`{"fileName":"a.wav","size":10,"clientId":"kitchen"}`, http.StatusBadRequest},
+		{`{"fileName":"a.txt","size":10}`, http.StatusUnsupportedMediaType},
+		{`{"fileName":"wav","size":10}`, http.StatusUnsupportedMediaType},
+		{`{"fileName":"../a.wav","size":10}`, http.StatusUnsupportedMediaType},
+		{`{"fileName":"dir/a.wav","size":10}`, http.StatusUnsupportedMediaType},
+		{`{"fileName":"a.wav","size":10,"padding":"` + strings.Repeat("x", 4096) + `"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := uploadRequest(t, s, "POST", "/api/uploads", strings.NewReader(tt.body)); w.Code != tt.status {
+			t.Errorf("%.60s: got %d %q, want %d", tt.body, w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+		}
+	}
+	if files, _ := os.ReadDir(s.uploads.dir); len(files) != 0 {
+		t.Errorf("invalid uploads left %d files", len(files))
+	}
+
+	clientID := uuid.New().String()
+	w := uploadRequest(t, s, "POST", "/api/uploads", strings.NewReader(`{"fileName":"a.wav","size":10,"clientId":"`+clientID+`"}`))
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), clientID) {
+		t.Errorf("with a client ID got %d %q", w.Code, w.Body.String())
+	}
+
+	unknown := "/api/uploads/" + strings.Repeat("0", 32)
+	for _, request := range []struct{ method, target string }{
+		{"GET", unknown}, {"PATCH", unknown + "?offset=0"}, {"DELETE", unknown},
+	} {
+		if w := uploadRequest(t, s, request.method, request.target, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s of an unknown upload got %d", request.method, w.Code)
+		}
+	}
+	for _, method := range []string{"GET", "PATCH", "DELETE"} {
+		if w := uploadRequest(t, s, method, "/api/uploads/not-an-id?offset=0", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s with an invalid ID got %d", method, w.Code)
+		}
+	}
+}
+
+// An upload being appended to or processed turns other writers away
+func TestChunkedUploadBusy(t *testing.T) {
+	s := newTestScribe(t, Config{})
+	upload := createUpload(t, s, "a.wav", 10)
+	target := "/api/uploads/" + upload.ID
+
+	lock := s.uploads.lock(upload.ID)
+	lock.Lock()
+	if w := uploadRequest(t, s, "PATCH", target+"?offset=0", strings.NewReader("01234")); w.Code != http.StatusConflict {
+		t.Errorf("PATCH got %d", w.Code)
+	}
+	if w := uploadRequest(t, s, "DELETE", target, nil); w.Code != http.StatusConflict {
+		t.Errorf("DELETE got %d", w.Code)
+	}
+	if w := uploadRequest(t, s, "GET", target, nil); w.Code != http.StatusOK {
+		t.Errorf("GET got %d", w.Code)
+	}
+	lock.Unlock()
+
+	if w := uploadRequest(t, s, "PATCH", target+"?offset=0", strings.NewReader("01234")); w.Code != http.StatusOK {
+		t.Errorf("PATCH after unlocking got %d", w.Code)
+	}
+}
+
+// Uploads survive a restart: received data counts even when the state
+// wasn't saved after it, interrupted processing is finished and stale
+// uploads expire
+func TestChunkedUploadRestart(t *testing.T) {
+	var buf bytes.Buffer
+	if err := audio.EncodeWav(&buf, audiotest.Speech(16000, 200*time.Millisecond, -6)); err != nil {
+		t.Fatal(err)
+	}
+	wav := buf.Bytes()
+
+	s := newTestScribe(t, Config{})
+	receiving := createUpload(t, s, "a.wav", len(wav))
+	processing := createUpload(t, s, "b.wav", len(wav))
+	stale := createUpload(t, s, "c.wav", len(wav))
+
+	os.WriteFile(s.uploads.dataPath(receiving.ID), wav[:100], 0644)
+	os.WriteFile(s.uploads.dataPath(processing.ID), wav, 0644)
+	processing.Status = uploadProcessing
+	s.uploads.save(processing)
+	stale.Updated = time.Now().Add(-chunkedUploadExpiry - time.Minute)
+	data, _ := json.Marshal(stale)
+	os.WriteFile(s.uploads.statePath(stale.ID), data, 0644)
+
+	restarted := newTestScribe(t, Config{RecordingsDir: s.config.RecordingsDir})
+	restarted.resumeUploads()
+
+	w := uploadRequest(t, restarted, "GET", "/api/uploads/"+receiving.ID, nil)
+	if w.Header().Get("Upload-Offset") != "100" {
+		t.Errorf("resumed at %q, want 100", w.Header().Get("Upload-Offset"))
+	}
+	if done := waitForUpload(t, restarted, processing.ID); done.Status != uploadQueued {
+		t.Errorf("interrupted upload: got %+v", done)
+	}
+
+	createUpload(t, restarted, "d.wav", 10)
+	if w := uploadRequest(t, restarted, "GET", "/api/uploads/"+stale.ID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("stale upload still there: %d", w.Code)
+	}
+	if _, err := os.Stat(restarted.uploads.dataPath(stale.ID)); !os.IsNotExist(err) {
+		t.Errorf("stale upload data left: %v", err)
+	}
+	if w := uploadRequest(t, restarted, "GET", "/api/uploads/"+receiving.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("fresh upload expired: %d", w.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package scribe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/tracing"
+)
+
+// Classifier tells what kind of sound the whisper copy of a recording
+// holds. Recordings of anything but audio.SoundSpeech skip whisper and are
+// stored as sounds, silent ones are dropped.
+type Classifier interface {
+	Classify(ctx context.Context, path string) (audio.Classification, error)
+}
+
+// HeuristicClassifier tells speech from music, knocks, noise and silence
+// with audio.Classify
+type HeuristicClassifier struct{}
+
+func (HeuristicClassifier) Classify(ctx context.Context, path string) (audio.Classification, error) {
+	pcm, err := audio.ReadWav(path)
+	if err != nil {
+		return audio.Classification{}, err
+	}
+	return audio.Classify(pcm.Samples, pcm.SampleRate), nil
+}
+
+// CommandClassifier runs a command, e.g. a YAMNet script, with the path of
+// the recording appended. The first line it prints is the label, speech
+// for recordings to transcribe, optionally followed by a score from 0 to
+// 1, e.g. "dog-bark 0.87".
+type CommandClassifier struct {
+	Command string
+}
+
+func (c CommandClassifier) Classify(ctx context.Context, path string) (audio.Classification, error) {
+	args := strings.Fields(c.Command)
+	if len(args) == 0 {
+		return audio.Classification{}, fmt.Errorf("no classifier command")
+	}
+	output, err := exec.CommandContext(ctx, args[0], append(args[1:], path)...).Output()
+	if err != nil {
+		return audio.Classification{}, fmt.Errorf("failed to run classifier: %w", err)
+	}
+
+	line, _, _ := bytes.Cut(output, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return audio.Classification{}, fmt.Errorf("classifier printed no label")
+	}
+	classification := audio.Classification{Label: strings.ToLower(fields[0])}
+	if len(fields) > 1 {
+		if classification.Score, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return audio.Classification{}, fmt.Errorf("invalid classifier score %q", fields[1])
+		}
+	}
+	return classification, nil
+}
+
+// classify runs the configured classifier on a job's recording. Recordings
+// it fails on are taken for speech so whisper still transcribes them.
+func (s *Scribe) classify(ctx context.Context, job TranscriptionJob) audio.Classification {
+	_, span := s.config.Tracer.Start(ctx, "classify")
+	defer span.End()
+
+	classification, err := s.config.Classifier.Classify(ctx, job.FilePath)
+	if err != nil {
+		slog.Warn("Failed to classify recording, transcribing it",
+			"error", err,
+			"file", filepath.Base(job.FilePath),
+			"clientID", job.ClientID)
+		span.RecordError(err)
+		return audio.Classification{Label: audio.SoundSpeech}
+	}
+	span.SetAttributes(tracing.Attr("sound", classification.Label), tracing.Attr("score", classification.Score))
+	return classification
+}
+
+// soundMessage stores a recording of something other than speech, with the
+// label in brackets as its text the way whisper marks sounds
+func soundMessage(job TranscriptionJob, classification audio.Classification) TranscriptionMessage {
+	msg := TranscriptionMessage{
+		Timestamp:  job.Timestamp,
+		Text:       "[" + classification.Label + "]",
+		AudioFile:  filepath.Base(job.FilePath),
+		Confidence: float32(classification.Score),
+		Sound:      classification.Label,
+	}
+	if msg.Confidence == 0 {
+		msg.Confidence = 1.0
+	}
+	return msg
+}
@@ -0,0 +1,230 @@
+package scribe
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/tracing"
+)
+
+// ConfidenceConfig improves and filters transcriptions by whisper's
+// confidence, the mean probability of a segment's tokens from 0 to 1.
+// Segments whose confidence whisper did not report are left alone.
+type ConfidenceConfig struct {
+	// Larger whisper model, e.g. ggml-medium.bin, segments below
+	// EscalateBelow are transcribed again with before the transcription is
+	// stored. Escalation is off when empty.
+	EscalateModel string
+	EscalateBelow float64
+
+	// Segments still below this confidence are left out of the
+	// transcription, 0 keeps every segment
+	DropBelow float64
+
+	// Thresholds of single clients by ID or the host they connect from,
+	// overriding EscalateBelow and DropBelow
+	ClientEscalateBelow map[string]float64
+	ClientDropBelow     map[string]float64
+}
+
+func (c ConfidenceConfig) validate() error {
+	thresholds := []float64{c.EscalateBelow, c.DropBelow}
+	for _, threshold := range c.ClientEscalateBelow {
+		thresholds = append(thresholds, threshold)
+	}
+	for _, threshold := range c.ClientDropBelow {
+		thresholds = append(thresholds, threshold)
+	}
+	for _, threshold := range thresholds {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("confidence thresholds must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+// threshold looks up a client's threshold in clients by ID, then by host
+func (s *Scribe) threshold(clients map[string]float64, clientID string, fallback float64) float64 {
+	if threshold, ok := clients[clientID]; ok {
+		return threshold
+	}
+	if host, ok := s.hosts.Load(clientID); ok {
+		if threshold, ok := clients[host.(string)]; ok {
+			return threshold
+		}
+	}
+	return fallback
+}
+
+const (
+	// Audio kept around a low-confidence segment when it is cut out, as
+	// whisper's segment times are not exact
+	escalatePadding = 250 * time.Millisecond
+
+	// Clips shorter than this are padded with silence, whisper skips input
+	// under a second
+	escalateMinClip = 1100 * time.Millisecond
+)
+
+// transcribeSegments transcribes a client's recording with the configured
+// Transcriber and the client's prompt, in segments when it supports them
+func (s *Scribe) transcribeSegments(ctx context.Context, path, clientID string) ([]Segment, error) {
+	transcriber := s.forClient(s.config.Transcriber, clientID)
+	if segmenter, ok := transcriber.(SegmentTranscriber); ok {
+		return segmenter.TranscribeSegments(ctx, path)
+	}
+	text, err := transcriber.Transcribe(ctx, path)
+	if err != nil || text == "" {
+		return nil, err
+	}
+	return []Segment{{Text: text}}, nil
+}
+
+// forClient primes a transcriber with a client's prompt and has it detect
+// the language of clients with expected languages
+func (s *Scribe) forClient(transcriber Transcriber, clientID string) Transcriber {
+	return s.withLanguageDetection(s.withPrompt(transcriber, clientID), clientID)
+}
+
+// escalate transcribes a job's low-confidence segments again with the
+// escalation model, keeping the text it is more confident about, then
+// drops the segments still below the client's drop threshold
+func (s *Scribe) escalate(ctx context.Context, job TranscriptionJob, segments []Segment) []Segment {
+	below := s.threshold(s.config.Confidence.ClientEscalateBelow, job.ClientID, s.config.Confidence.EscalateBelow)
+	if s.escalation != nil && below > 0 {
+		var pcm *audio.PCM
+		for i, segment := range segments {
+			if segment.Confidence == 0 || float64(segment.Confidence) >= below || segment.End <= segment.Start {
+				continue
+			}
+			if pcm == nil {
+				var err error
+				if pcm, err = audio.ReadWav(job.FilePath); err != nil {
+					slog.Error("Failed to read recording for escalation", "error", err, "file", job.FilePath, "clientID", job.ClientID)
+					break
+				}
+			}
+			segments[i] = s.escalateSegment(ctx, job, pcm, segment)
+		}
+	}
+
+	drop := s.threshold(s.config.Confidence.ClientDropBelow, job.ClientID, s.config.Confidence.DropBelow)
+	if drop == 0 {
+		return segments
+	}
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment.Confidence != 0 && float64(segment.Confidence) < drop {
+			slog.Debug("Dropping low-confidence segment",
+				"clientID", job.ClientID,
+				"file", filepath.Base(job.FilePath),
+				"confidence", segment.Confidence,
+				"text", segment.Text)
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	return kept
+}
+
+// escalateSegment transcribes one segment cut from the recording with the
+// escalation model, returning the better of both transcriptions
+func (s *Scribe) escalateSegment(ctx context.Context, job TranscriptionJob, pcm *audio.PCM, segment Segment) Segment {
+	_, span := s.config.Tracer.Start(ctx, "escalate",
+		tracing.Attr("model", filepath.Base(s.config.Confidence.EscalateModel)),
+		tracing.Attr("confidence", float64(segment.Confidence)))
+	defer span.End()
+
+	from := max(segment.Start-escalatePadding, 0)
+	clip, err := cutClip(pcm, from, segment.End+escalatePadding)
+	if err != nil {
+		slog.Error("Failed to cut segment for escalation", "error", err, "clientID", job.ClientID)
+		span.RecordError(err)
+		return segment
+	}
+	defer os.Remove(clip)
+
+	escalation := s.escalation
+	if primed, ok := s.forClient(escalation, job.ClientID).(SegmentTranscriber); ok {
+		escalation = primed
+	}
+	escalated, err := escalation.TranscribeSegments(ctx, clip)
+	if err != nil {
+		slog.Error("Failed to transcribe segment with escalation model", "error", err, "clientID", job.ClientID)
+		span.RecordError(err)
+		return segment
+	}
+	text, confidence := joinSegments(escalated), meanConfidence(escalated)
+	span.SetAttributes(tracing.Attr("escalatedConfidence", float64(confidence)))
+	if text == "" || confidence <= segment.Confidence {
+		return segment
+	}
+
+	slog.Info("Transcribed low-confidence segment again",
+		"clientID", job.ClientID,
+		"file", filepath.Base(job.FilePath),
+		"confidence", segment.Confidence,
+		"escalatedConfidence", confidence,
+		"text", text)
+	segment.Text = text
+	segment.Confidence = confidence
+
+	// Word times are offsets into the clip, which starts at from. The
+	// silence the clip was padded with has no words.
+	segment.Words = nil
+	for _, escalatedSegment := range escalated {
+		for _, word := range escalatedSegment.Words {
+			word.StartMs += from.Milliseconds()
+			word.EndMs += from.Milliseconds()
+			segment.Words = append(segment.Words, word)
+		}
+	}
+	return segment
+}
+
+// cutClip writes the samples between from and to to a temporary WAV file,
+// padded with silence to the length whisper needs
+func cutClip(pcm *audio.PCM, from, to time.Duration) (string, error) {
+	offset := func(d time.Duration) int {
+		n := int(d.Seconds() * float64(pcm.SampleRate))
+		return min(max(n, 0), len(pcm.Samples))
+	}
+	samples := append([]int16(nil), pcm.Samples[offset(from):offset(to)]...)
+	if minimum := int(escalateMinClip.Seconds() * float64(pcm.SampleRate)); len(samples) < minimum {
+		samples = append(samples, make([]int16, minimum-len(samples))...)
+	}
+
+	file, err := os.CreateTemp("", "libas-escalate-*.wav")
+	if err != nil {
+		return "", fmt.Errorf("failed to create clip: %w", err)
+	}
+	file.Close()
+	if err := audio.WriteWav(file.Name(), &audio.PCM{Samples: samples, SampleRate: pcm.SampleRate}); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// meanConfidence weighs the confidence of segments by their duration,
+// zero when whisper reported none
+func meanConfidence(segments []Segment) float32 {
+	var sum, weights float64
+	for _, segment := range segments {
+		if segment.Confidence == 0 {
+			continue
+		}
+		weight := max((segment.End - segment.Start).Seconds(), 0.01)
+		sum += float64(segment.Confidence) * weight
+		weights += weight
+	}
+	if weights == 0 {
+		return 0
+	}
+	return float32(sum / weights)
+}
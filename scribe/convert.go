@@ -0,0 +1,55 @@
+package scribe
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bosley/libas/audio"
+)
+
+// isRawRecording reports whether a file in a client directory is audio that
+// still needs a whisper copy, as opposed to whisper files, their FLAC
+// archives and thumbnails
+func isRawRecording(name string) bool {
+	if strings.Contains(name, "_whisper") {
+		return false
+	}
+	_, ok := uploadExtensions[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// convertRecording writes the whisper copy of a recording made elsewhere.
+// The original is kept so tools like rsync do not transfer it again; the
+// watcher queues the copy once it is renamed into place.
+func (s *Scribe) convertRecording(clientID, path string) {
+	whisperPath := strings.TrimSuffix(path, filepath.Ext(path)) + "_whisper.wav"
+	tmpPath := whisperPath + ".tmp"
+
+	if err := audio.ConvertForWhisper(path, tmpPath, s.config.ConvertOptions); err != nil {
+		os.Remove(tmpPath)
+		slog.Error("Failed to convert recording",
+			"error", err,
+			"file", path,
+			"clientID", clientID)
+		return
+	}
+
+	if err := os.Rename(tmpPath, whisperPath); err != nil {
+		os.Remove(tmpPath)
+		slog.Error("Failed to convert recording",
+			"error", err,
+			"file", path,
+			"clientID", clientID)
+		return
+	}
+
+	if err := audio.RecordChecksum(whisperPath); err != nil {
+		slog.Error("Failed to record checksum", "error", err, "file", whisperPath)
+	}
+
+	slog.Info("Converted recording for Whisper",
+		"file", filepath.Base(whisperPath),
+		"clientID", clientID)
+}
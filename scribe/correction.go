@@ -0,0 +1,497 @@
+package scribe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// File in the recordings directory corrections are kept in
+	correctionsFile = "corrections.json"
+
+	// Learning from corrections when CorrectionConfig leaves it zero
+	defaultLearnAfter   = 2
+	defaultLearnedTerms = 30
+
+	// Corrections kept per client, the oldest are forgotten first
+	maxCorrections = 1000
+
+	// Longest corrected text accepted
+	maxCorrectionLength = 4096
+
+	// Words a term may have, longer replacements are rewording rather than
+	// a term whisper mis-heard
+	maxTermWords = 4
+)
+
+// CorrectionConfig learns a vocabulary of each client from the
+// transcriptions users correct, adding the terms corrected most often to
+// the client's prompt. Zero uses the default of a setting.
+type CorrectionConfig struct {
+	// Times a term must be corrected before it joins the prompt, defaults
+	// to 2. A negative value never adds learned terms.
+	LearnAfter int
+
+	// Learned terms added to a prompt, the most corrected first, defaults
+	// to 30. Whisper only reads the last 224 tokens of a prompt.
+	MaxTerms int
+}
+
+func (c CorrectionConfig) withDefaults() CorrectionConfig {
+	if c.LearnAfter == 0 {
+		c.LearnAfter = defaultLearnAfter
+	}
+	if c.MaxTerms <= 0 {
+		c.MaxTerms = defaultLearnedTerms
+	}
+	return c
+}
+
+// Correction is a transcription a user corrected
+type Correction struct {
+	Sequence uint64 `json:"sequence"`
+
+	// Time of the transcription
+	Timestamp time.Time `json:"timestamp"`
+
+	// Text whisper transcribed and the text it was corrected to
+	Heard     string `json:"heard"`
+	Corrected string `json:"corrected"`
+
+	// User who corrected it, empty when sign-in is off
+	CorrectedBy string    `json:"correctedBy,omitempty"`
+	CorrectedAt time.Time `json:"correctedAt"`
+}
+
+// LearnedTerm is a term of a client's vocabulary learned from corrections
+type LearnedTerm struct {
+	Term string `json:"term"`
+
+	// Times it was corrected
+	Count int `json:"count"`
+
+	// What whisper heard instead, the most frequent first
+	HeardAs []string `json:"heardAs"`
+
+	// Whether it is added to the client's prompt
+	Prompted bool `json:"prompted"`
+}
+
+// VocabularyResponse is the vocabulary learned from a client's corrections
+type VocabularyResponse struct {
+	ClientID string `json:"clientId"`
+
+	// Corrections learned from
+	Corrections int `json:"corrections"`
+
+	// Terms, the most corrected first
+	Terms []LearnedTerm `json:"terms"`
+
+	// Prompt whisper is given for the client, learned terms included
+	Prompt string `json:"prompt"`
+}
+
+// correctionRequest corrects the text of a transcription
+type correctionRequest struct {
+	Text string `json:"text"`
+}
+
+// corrections holds the corrections of each client and the vocabulary
+// learned from them, persisted as they change
+type corrections struct {
+	path   string
+	config CorrectionConfig
+
+	mu          sync.RWMutex
+	corrections map[string][]Correction
+	learned     map[string][]LearnedTerm
+}
+
+// loadCorrections reads the corrections
+func loadCorrections(recordingsDir string, config CorrectionConfig) (*corrections, error) {
+	c := &corrections{
+		path:        filepath.Join(recordingsDir, correctionsFile),
+		config:      config,
+		corrections: make(map[string][]Correction),
+		learned:     make(map[string][]LearnedTerm),
+	}
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read corrections: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.corrections); err != nil {
+		return nil, fmt.Errorf("failed to parse corrections: %w", err)
+	}
+	for clientID, list := range c.corrections {
+		c.learned[clientID] = learn(list, config)
+	}
+	return c, nil
+}
+
+// update applies fn to a copy of the corrections and persists it,
+// learning the vocabulary of the clients fn changed again
+func (c *corrections) update(fn func(corrections map[string][]Correction)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	updated := make(map[string][]Correction, len(c.corrections)+1)
+	for clientID, list := range c.corrections {
+		updated[clientID] = list
+	}
+	fn(updated)
+
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return fmt.Errorf("failed to marshal corrections: %w", err)
+	}
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write corrections: %w", err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write corrections: %w", err)
+	}
+
+	learned := make(map[string][]LearnedTerm, len(updated))
+	for clientID, list := range updated {
+		if previous, ok := c.corrections[clientID]; ok && sameCorrections(previous, list) {
+			learned[clientID] = c.learned[clientID]
+			continue
+		}
+		learned[clientID] = learn(list, c.config)
+	}
+	c.corrections, c.learned = updated, learned
+	return nil
+}
+
+// sameCorrections reports whether fn left a client's corrections alone,
+// replaced slices being changed
+func sameCorrections(a, b []Correction) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// record adds a correction of a client, replacing an earlier one of the
+// same transcription. Correcting a transcription back to what whisper
+// heard forgets it.
+func (c *corrections) record(clientID string, correction Correction) error {
+	return c.update(func(corrections map[string][]Correction) {
+		list := make([]Correction, 0, len(corrections[clientID])+1)
+		for _, existing := range corrections[clientID] {
+			if existing.Sequence != correction.Sequence {
+				list = append(list, existing)
+			}
+		}
+		if correction.Corrected != correction.Heard {
+			list = append(list, correction)
+		}
+		if len(list) > maxCorrections {
+			list = list[len(list)-maxCorrections:]
+		}
+		if len(list) == 0 {
+			delete(corrections, clientID)
+			return
+		}
+		corrections[clientID] = list
+	})
+}
+
+// forget removes the corrections of a client, returning how many there were
+func (c *corrections) forget(clientID string) (int, error) {
+	forgotten := 0
+	err := c.update(func(corrections map[string][]Correction) {
+		forgotten = len(corrections[clientID])
+		delete(corrections, clientID)
+	})
+	return forgotten, err
+}
+
+// erase removes a client's corrections of transcriptions made on the days
+// inRange accepts, returning how many were removed
+func (c *corrections) erase(clientID string, inRange func(day string) bool) (int, error) {
+	erased := 0
+	err := c.update(func(corrections map[string][]Correction) {
+		list, ok := corrections[clientID]
+		if !ok {
+			return
+		}
+		kept := make([]Correction, 0, len(list))
+		for _, correction := range list {
+			if inRange(correction.Timestamp.Format("20060102")) {
+				erased++
+				continue
+			}
+			kept = append(kept, correction)
+		}
+		switch {
+		case erased == 0:
+		case len(kept) == 0:
+			delete(corrections, clientID)
+		default:
+			corrections[clientID] = kept
+		}
+	})
+	return erased, err
+}
+
+// vocabulary returns the number of a client's corrections and the terms
+// learned from them
+func (c *corrections) vocabulary(clientID string) (int, []LearnedTerm) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.corrections[clientID]), c.learned[clientID]
+}
+
+// prompted returns the learned terms added to a client's prompt
+func (c *corrections) prompted(clientID string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var terms []string
+	for _, term := range c.learned[clientID] {
+		if term.Prompted {
+			terms = append(terms, term.Term)
+		}
+	}
+	return terms
+}
+
+// learn counts the terms of a client's corrections, marking those corrected
+// often enough for the prompt
+func learn(list []Correction, config CorrectionConfig) []LearnedTerm {
+	counts := make(map[string]int)
+	heard := make(map[string]map[string]int)
+	for _, correction := range list {
+		for _, substitution := range substitutions(correction.Heard, correction.Corrected) {
+			counts[substitution.term]++
+			if heard[substitution.term] == nil {
+				heard[substitution.term] = make(map[string]int)
+			}
+			if substitution.heard != "" {
+				heard[substitution.term][substitution.heard]++
+			}
+		}
+	}
+
+	terms := make([]LearnedTerm, 0, len(counts))
+	for term, count := range counts {
+		heardAs := make([]string, 0, len(heard[term]))
+		for variant := range heard[term] {
+			heardAs = append(heardAs, variant)
+		}
+		sort.Slice(heardAs, func(i, j int) bool {
+			a, b := heard[term][heardAs[i]], heard[term][heardAs[j]]
+			return a > b || (a == b && heardAs[i] < heardAs[j])
+		})
+		terms = append(terms, LearnedTerm{Term: term, Count: count, HeardAs: heardAs})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		return terms[i].Count > terms[j].Count || (terms[i].Count == terms[j].Count && terms[i].Term < terms[j].Term)
+	})
+
+	prompted := 0
+	for i := range terms {
+		if config.LearnAfter < 0 || terms[i].Count < config.LearnAfter || prompted == config.MaxTerms {
+			break
+		}
+		terms[i].Prompted = true
+		prompted++
+	}
+	return terms
+}
+
+// substitution is a term of a corrected text and what whisper heard in its
+// place, empty when it missed the term
+type substitution struct {
+	term  string
+	heard string
+}
+
+// substitutions finds the terms a correction put in place of what whisper
+// heard by aligning the words of both texts. Changes of punctuation alone,
+// removed words and long rewordings are left out.
+func substitutions(heard, corrected string) []substitution {
+	a, b := strings.Fields(heard), strings.Fields(corrected)
+	key := func(word string) string {
+		return strings.TrimFunc(word, unicode.IsPunct)
+	}
+
+	// Longest common subsequence of the words
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if key(a[i]) == key(b[j]) {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+
+	var found []substitution
+	add := func(from, to []string) {
+		term := strings.TrimFunc(strings.Join(to, " "), unicode.IsPunct)
+		if term == "" || len(to) > maxTermWords {
+			return
+		}
+		found = append(found, substitution{term: term, heard: strings.TrimFunc(strings.Join(from, " "), unicode.IsPunct)})
+	}
+	i, j, fromA, fromB := 0, 0, 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case key(a[i]) == key(b[j]):
+			if fromA < i || fromB < j {
+				add(a[fromA:i], b[fromB:j])
+			}
+			i++
+			j++
+			fromA, fromB = i, j
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	if fromA < len(a) || fromB < len(b) {
+		add(a[fromA:], b[fromB:])
+	}
+	return found
+}
+
+// learnedPrompt adds the terms learned from a client's corrections to its
+// prompt
+func (s *Scribe) learnedPrompt(clientID, prompt string) string {
+	terms := s.corrections.prompted(clientID)
+	if len(terms) == 0 {
+		return prompt
+	}
+	return strings.TrimSpace(prompt + " " + strings.Join(terms, ", ") + ".")
+}
+
+// handleCorrectTranscription replaces the text of a transcription with a
+// user's correction, learning the terms whisper mis-heard
+func (s *Scribe) handleCorrectTranscription(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientID := vars["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+	sequence, err := strconv.ParseUint(vars["sequence"], 10, 64)
+	if err != nil || sequence == 0 {
+		http.Error(w, "Invalid sequence number", http.StatusBadRequest)
+		return
+	}
+
+	var req correctionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxCorrectionLength)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" {
+		http.Error(w, "Text is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Text) > maxCorrectionLength {
+		http.Error(w, "Text too long", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := s.store.correct(clientID, sequence, req.Text)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Transcription not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotTranscribed) {
+		http.Error(w, "Transcription holds no text", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to correct transcription", "error", err, "clientID", clientID, "sequence", sequence)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if value, ok := s.clients.Load(clientID); ok {
+		value.(*ClientTranscriptions).replace(msg)
+	}
+
+	correction := Correction{
+		Sequence:    sequence,
+		Timestamp:   msg.Timestamp,
+		Heard:       msg.OriginalText,
+		Corrected:   msg.Text,
+		CorrectedAt: time.Now(),
+	}
+	if correction.Heard == "" {
+		// Corrected back to what whisper heard
+		correction.Heard = msg.Text
+	}
+	if u := requestUser(r); u != nil {
+		correction.CorrectedBy = u.Name
+	}
+	if err := s.corrections.record(clientID, correction); err != nil {
+		slog.Error("Failed to save correction", "error", err, "clientID", clientID, "sequence", sequence)
+	}
+	slog.Info("Transcription corrected", "clientID", clientID, "sequence", sequence, "by", correction.CorrectedBy)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// errNotTranscribed is returned for correcting a transcription of a sound
+var errNotTranscribed = fmt.Errorf("transcription holds no text")
+
+// handleGetVocabulary serves the vocabulary learned from a client's
+// corrections
+func (s *Scribe) handleGetVocabulary(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	count, terms := s.corrections.vocabulary(clientID)
+	if terms == nil {
+		terms = []LearnedTerm{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(VocabularyResponse{
+		ClientID:    clientID,
+		Corrections: count,
+		Terms:       terms,
+		Prompt:      s.promptFor(clientID),
+	}); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// handleDeleteVocabulary forgets a client's corrections and the terms
+// learned from them. The corrected transcriptions keep their text.
+func (s *Scribe) handleDeleteVocabulary(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	forgotten, err := s.corrections.forget(clientID)
+	if err != nil {
+		slog.Error("Failed to forget corrections", "error", err, "clientID", clientID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Learned vocabulary forgotten", "clientID", clientID, "corrections", forgotten)
+	w.WriteHeader(http.StatusNoContent)
+}
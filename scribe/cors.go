@@ -0,0 +1,109 @@
+package scribe
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "OPTIONS"}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization"}
+)
+
+// corsMiddleware adds CORS headers for allowed origins and answers
+// preflight requests. It wraps the whole router so preflights reach it even
+// for routes that only accept other methods.
+func (s *Scribe) corsMiddleware(next http.Handler) http.Handler {
+	if len(s.config.CORSAllowedOrigins) == 0 {
+		return next
+	}
+
+	methods := s.config.CORSAllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(defaultCORSHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.originAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		// New refuses credentials with "*", so they only go to origins
+		// listed
+		if s.allowsAnyOrigin() {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if s.config.CORSAllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", allowMethods)
+			requested := r.Header.Get("Access-Control-Request-Headers")
+			if requested != "" {
+				header.Set("Access-Control-Allow-Headers", requested)
+			} else {
+				header.Set("Access-Control-Allow-Headers", allowHeaders)
+			}
+			header.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Scribe) allowsAnyOrigin() bool {
+	for _, allowed := range s.config.CORSAllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scribe) originAllowed(origin string) bool {
+	return s.allowsAnyOrigin() || s.originListed(origin)
+}
+
+// originListed reports whether the origin is configured by name, not just
+// through "*"
+func (s *Scribe) originListed(origin string) bool {
+	for _, allowed := range s.config.CORSAllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin decides whether a WebSocket upgrade is allowed. Same-origin
+// and configured origins are. Without a CORS configuration every origin is
+// accepted too, unless sign-in is on: the session cookie would let any page
+// the user opens read their transcriptions. For the same reason "*" does not
+// count with sign-in on, only origins listed by name do.
+func (s *Scribe) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || (len(s.config.CORSAllowedOrigins) == 0 && s.auth == nil) {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	if s.auth != nil {
+		return s.originListed(origin)
+	}
+	return s.originAllowed(origin)
+}
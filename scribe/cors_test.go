@@ -0,0 +1,87 @@
+package scribe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bosley/libas/internal/testcert"
+)
+
+func TestCORSCredentialsNeedListedOrigins(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		CertFile:             filepath.Join(dir, "cert.pem"),
+		KeyFile:              filepath.Join(dir, "key.pem"),
+		RecordingsDir:        filepath.Join(dir, "recordings"),
+		CORSAllowedOrigins:   []string{"https://dashboard.example.com", "*"},
+		CORSAllowCredentials: true,
+	}
+	if _, err := testcert.Write(cfg.CertFile, cfg.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("New accepted credentials for every origin")
+	}
+}
+
+func TestCORSReflectsListedOrigins(t *testing.T) {
+	s := &Scribe{config: Config{
+		CORSAllowedOrigins:   []string{"https://dashboard.example.com"},
+		CORSAllowCredentials: true,
+	}}
+	handler := s.corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"https://dashboard.example.com", "https://dashboard.example.com"},
+		{"https://evil.example.com", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/clients", nil)
+		r.Header.Set("Origin", tt.origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("origin %s: allowed %q, want %q", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	open := &Scribe{}
+	signIn := &Scribe{auth: &auth{}}
+	listed := &Scribe{auth: &auth{}, config: Config{CORSAllowedOrigins: []string{"https://dashboard.example.com"}}}
+	anySignIn := &Scribe{auth: &auth{}, config: Config{CORSAllowedOrigins: []string{"*", "https://dashboard.example.com"}}}
+	anyOpen := &Scribe{config: Config{CORSAllowedOrigins: []string{"*"}}}
+
+	tests := []struct {
+		name   string
+		s      *Scribe
+		origin string
+		want   bool
+	}{
+		{"open, other origin", open, "https://evil.example.com", true},
+		{"sign-in, no origin", signIn, "", true},
+		{"sign-in, same origin", signIn, "https://scribe.example.com:8444", true},
+		{"sign-in, other origin", signIn, "https://evil.example.com", false},
+		{"listed origin", listed, "https://dashboard.example.com", true},
+		{"unlisted origin", listed, "https://evil.example.com", false},
+		{"sign-in with *, listed origin", anySignIn, "https://dashboard.example.com", true},
+		{"sign-in with *, same origin", anySignIn, "https://scribe.example.com:8444", true},
+		{"sign-in with *, other origin", anySignIn, "https://evil.example.com", false},
+		{"open with *, other origin", anyOpen, "https://evil.example.com", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://scribe.example.com:8444/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := tt.s.checkOrigin(r); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package scribe
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Silence inserted between utterances in a digest unless "gap" is given
+	defaultDigestGap = time.Second
+
+	// Upper bound on the "gap" query parameter
+	maxDigestGap = time.Minute
+)
+
+// handleGetDigest joins a client's recordings from one day into a single WAV
+// download. The optional "date" query parameter (YYYYMMDD) defaults to today
+// and "gap" sets the silence between utterances in milliseconds.
+func (s *Scribe) handleGetDigest(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = getCurrentDateDir()
+	} else if _, err := time.Parse("20060102", date); err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	gap := defaultDigestGap
+	if value := r.URL.Query().Get("gap"); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > maxDigestGap {
+			http.Error(w, "Invalid gap", http.StatusBadRequest)
+			return
+		}
+		gap = time.Duration(ms) * time.Millisecond
+	}
+
+	recordings, err := dayRecordings(filepath.Join(s.config.RecordingsDir, date, clientID))
+	if err != nil || len(recordings) == 0 {
+		http.Error(w, "No recordings found", http.StatusNotFound)
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "digest_*.wav")
+	if err != nil {
+		slog.Error("Failed to create digest file", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := audio.Concat(recordings, tmp.Name(), gap); err != nil {
+		slog.Error("Failed to build digest",
+			"error", err,
+			"clientID", clientID,
+			"date", date)
+		http.Error(w, "Failed to decode audio", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", clientID+"_"+date+".wav"))
+	http.ServeFile(w, r, tmp.Name())
+}
+
+// dayRecordings lists the transcribed recordings in a client directory in
+// the order they were made, including those archived as FLAC
+func dayRecordings(clientDir string) ([]string, error) {
+	entries, err := os.ReadDir(clientDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recordings []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stem := strings.TrimSuffix(name, filepath.Ext(name))
+		if entry.IsDir() || !strings.HasSuffix(stem, "_whisper") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext != ".wav" && ext != ".flac" {
+			continue
+		}
+		recordings = append(recordings, name)
+	}
+
+	// Recordings and uploads both carry their HHMMSS start time as the
+	// second field of the name
+	sort.Slice(recordings, func(i, j int) bool {
+		ti, tj := recordingClock(recordings[i]), recordingClock(recordings[j])
+		if ti != tj {
+			return ti < tj
+		}
+		return recordings[i] < recordings[j]
+	})
+
+	for i, name := range recordings {
+		recordings[i] = filepath.Join(clientDir, name)
+	}
+	return recordings, nil
+}
+
+func recordingClock(name string) string {
+	if parts := strings.Split(name, "_"); len(parts) > 1 {
+		return parts[1]
+	}
+	return name
+}
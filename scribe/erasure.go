@@ -0,0 +1,462 @@
+package scribe
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/s3"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Signed reports of every erasure, in the recordings directory
+const deletionLogFile = "deletions.jsonl"
+
+// DeletionReport records what erasing a client's data removed
+type DeletionReport struct {
+	ClientID string `json:"clientId"`
+
+	// Days erased (YYYYMMDD, inclusive), empty for no bound
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	Time time.Time `json:"time"`
+
+	// User who asked for the erasure, empty when sign-in is off
+	RequestedBy string `json:"requestedBy,omitempty"`
+
+	// Days anything was removed from
+	Days []string `json:"days"`
+
+	// Recordings, thumbnails and the like deleted and their total size
+	DeletedFiles int   `json:"deletedFiles"`
+	DeletedBytes int64 `json:"deletedBytes"`
+
+	// Transcriptions removed from the journals
+	Transcriptions int `json:"transcriptions"`
+
+	// Objects deleted from the backup and archive buckets
+	BackupObjects  int `json:"backupObjects"`
+	ArchiveObjects int `json:"archiveObjects"`
+
+	// Speaker enrollments made from deleted recordings
+	SpeakerSamples int `json:"speakerSamples"`
+
+	// Turns removed from meeting transcripts
+	MeetingTurns int `json:"meetingTurns"`
+
+	// Corrections of erased transcriptions, no longer learned from
+	Corrections int `json:"corrections"`
+
+	// Recordings and transcripts deleted from the outputs they were pushed
+	// to
+	OutputFiles int `json:"outputFiles"`
+
+	// Entries of the client's files removed from the backup ledgers, and
+	// errors naming them from the retention log
+	BackupLedgerEntries int `json:"backupLedgerEntries"`
+	RetentionErrors     int `json:"retentionErrors"`
+
+	// Chunked uploads discarded, and files taken from the inbox deleted
+	Uploads    int `json:"uploads"`
+	InboxFiles int `json:"inboxFiles"`
+
+	// What could not be deleted, asking again retries it
+	Errors []string `json:"errors,omitempty"`
+}
+
+// SignedDeletionReport is a DeletionReport signed with the private key of
+// the TLS certificate, to show later what was erased and when
+type SignedDeletionReport struct {
+	// The report exactly as signed
+	Report json.RawMessage `json:"report"`
+
+	// RSA-PKCS1v15-SHA256, ECDSA-SHA256 or Ed25519
+	Algorithm string `json:"algorithm"`
+
+	// Base64 signature of the report
+	Signature string `json:"signature"`
+}
+
+// handleDeleteData erases a client's recordings, transcriptions, speaker
+// enrollments, backups, uploads and inbox files made on the days from
+// "from" to "to" (YYYYMMDD, inclusive, either may be left out), answering
+// with a signed report
+func (s *Scribe) handleDeleteData(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+	params := r.URL.Query()
+	from, to := params.Get("from"), params.Get("to")
+	for _, date := range []string{from, to} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("20060102", date); err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
+		}
+	}
+	if from != "" && to != "" && from > to {
+		http.Error(w, "Invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	report := s.eraseClient(r.Context(), clientID, from, to)
+	if u := requestUser(r); u != nil {
+		report.RequestedBy = u.Name
+	}
+	signed, err := s.signDeletion(report)
+	if err != nil {
+		slog.Error("Failed to sign deletion report", "error", err, "clientID", clientID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.logDeletion(signed); err != nil {
+		slog.Error("Failed to log deletion report", "error", err, "clientID", clientID)
+	}
+
+	slog.Info("Client data erased",
+		"clientID", clientID,
+		"from", from,
+		"to", to,
+		"days", len(report.Days),
+		"deletedFiles", report.DeletedFiles,
+		"transcriptions", report.Transcriptions,
+		"backupObjects", report.BackupObjects,
+		"archiveObjects", report.ArchiveObjects,
+		"errors", len(report.Errors))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(signed); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// eraseClient deletes a client's data on the days from from to to. Retention
+// runs and backup passes wait for it.
+func (s *Scribe) eraseClient(ctx context.Context, clientID, from, to string) DeletionReport {
+	report := DeletionReport{ClientID: clientID, From: from, To: to, Time: time.Now(), Days: []string{}}
+	inRange := func(day string) bool {
+		return (from == "" || day >= from) && (to == "" || day <= to)
+	}
+
+	s.retention.mu.Lock()
+	defer s.retention.mu.Unlock()
+	if s.backup != nil {
+		s.backup.mu.Lock()
+		defer s.backup.mu.Unlock()
+	}
+
+	days := make(map[string]bool)
+	// Recordings deleted, as clientID/file without the extension, as a
+	// recording may have been enrolled before it was archived as FLAC
+	deleted := make(map[string]bool)
+	// Names the recordings and transcripts may have been pushed to outputs
+	// as, day/clientID/file
+	pushed := make(map[string]bool)
+
+	entries, err := os.ReadDir(s.config.RecordingsDir)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, entry := range entries {
+		day := entry.Name()
+		if _, err := time.Parse("20060102", day); err != nil || !entry.IsDir() || !inRange(day) {
+			continue
+		}
+		dayDir := filepath.Join(s.config.RecordingsDir, day)
+		if s.eraseFiles(dayDir, clientID, deleted, pushed, &report) {
+			days[day] = true
+		}
+
+		erased, err := s.store.erase(day, clientID)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		if len(erased) > 0 {
+			report.Transcriptions += len(erased)
+			days[day] = true
+		}
+		for _, file := range erased {
+			notePushed(pushed, day, clientID, file)
+		}
+
+		ledgerEntries, err := eraseBackupLedger(dayDir, clientID)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		report.BackupLedgerEntries += ledgerEntries
+
+		// Only succeeds once the day has nothing left
+		os.Remove(dayDir)
+	}
+
+	if s.backup != nil {
+		report.BackupObjects = eraseObjects(ctx, s.backup.bucket, clientID, from, to, inRange, days, &report)
+	}
+	if s.retention.archive != nil {
+		report.ArchiveObjects = eraseObjects(ctx, s.retention.archive, clientID, from, to, inRange, days, &report)
+	}
+	report.OutputFiles = s.eraseOutputs(ctx, pushed, &report)
+
+	if value, ok := s.clients.Load(clientID); ok {
+		erased, remaining := value.(*ClientTranscriptions).erase(inRange)
+		s.cached.Add(-int64(erased))
+		if remaining == 0 {
+			s.clients.Delete(clientID)
+		}
+	}
+
+	if len(deleted) > 0 {
+		err := s.speakers.update(func(speakers map[string]*enrolledSpeaker) {
+			for name, speaker := range speakers {
+				var prints [][]float64
+				var samples []string
+				for i, sample := range speaker.Samples {
+					if deleted[strings.TrimSuffix(sample, filepath.Ext(sample))] {
+						report.SpeakerSamples++
+						continue
+					}
+					samples = append(samples, sample)
+					if i < len(speaker.Prints) {
+						prints = append(prints, speaker.Prints[i])
+					}
+				}
+				if len(samples) == len(speaker.Samples) {
+					continue
+				}
+				if len(samples) == 0 {
+					delete(speakers, name)
+				} else {
+					speaker.Prints, speaker.Samples = prints, samples
+				}
+			}
+		})
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	erased, err := s.meetings.erase(clientID, inRange)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.MeetingTurns = erased
+
+	erased, err = s.corrections.erase(clientID, inRange)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Corrections = erased
+
+	erased, err = s.retention.erase(clientID, inRange)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.RetentionErrors = erased
+
+	erased, busy := s.uploads.erase(clientID, inRange)
+	for _, id := range busy {
+		report.Errors = append(report.Errors, fmt.Sprintf("upload %s is busy", id))
+	}
+	report.Uploads = erased
+
+	if s.inbox != nil {
+		erased, failed := s.inbox.erase(clientID, inRange)
+		report.Errors = append(report.Errors, failed...)
+		report.InboxFiles = erased
+	}
+
+	for day := range days {
+		report.Days = append(report.Days, day)
+	}
+	sort.Strings(report.Days)
+	return report
+}
+
+// eraseFiles deletes a client's directory of a day, noting the removal of
+// recordings in the manifest, and reports whether anything was deleted
+func (s *Scribe) eraseFiles(dayDir, clientID string, deleted, pushed map[string]bool, report *DeletionReport) bool {
+	clientDir := filepath.Join(dayDir, clientID)
+	files, err := os.ReadDir(clientDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		return false
+	}
+	manifest, err := audio.ReadManifest(dayDir)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	erased := false
+	for _, file := range files {
+		path := filepath.Join(clientDir, file.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		sample := clientID + "/" + file.Name()
+		if entry, ok := manifest[sample]; ok && !entry.Removed {
+			if err := audio.RecordRemoval(path); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			}
+		}
+		deleted[strings.TrimSuffix(sample, filepath.Ext(sample))] = true
+		notePushed(pushed, filepath.Base(dayDir), clientID, file.Name())
+		report.DeletedFiles++
+		report.DeletedBytes += info.Size()
+		erased = true
+	}
+	os.Remove(clientDir)
+	return erased
+}
+
+// eraseObjects deletes a client's objects, keyed <day>/<client ID>/<file>,
+// of the days inRange accepts from a bucket, returning how many were deleted
+func eraseObjects(ctx context.Context, bucket *s3.Client, clientID, from, to string, inRange func(string) bool, days map[string]bool, report *DeletionReport) int {
+	// Days share the leading digits of both bounds, e.g. the month
+	prefix := ""
+	if from != "" && to != "" {
+		for prefix != from && strings.HasPrefix(to, from[:len(prefix)+1]) {
+			prefix = from[:len(prefix)+1]
+		}
+	}
+
+	names, err := bucket.List(ctx, prefix)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return 0
+	}
+	erased := 0
+	for _, name := range names {
+		parts := strings.SplitN(name, "/", 3)
+		if len(parts) != 3 || parts[1] != clientID || !inRange(parts[0]) {
+			continue
+		}
+		if err := bucket.Delete(ctx, name); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		days[parts[0]] = true
+		erased++
+	}
+	return erased
+}
+
+// notePushed adds the names a recording and its transcript were pushed to
+// outputs as. Recordings are pushed before they are archived as FLAC.
+func notePushed(pushed map[string]bool, day, clientID, file string) {
+	stem := day + "/" + clientID + "/" + strings.TrimSuffix(file, filepath.Ext(file))
+	pushed[stem+".txt"] = true
+	if filepath.Ext(file) == ".flac" {
+		pushed[stem+".wav"] = true
+	} else {
+		pushed[day+"/"+clientID+"/"+file] = true
+	}
+}
+
+// eraseOutputs deletes files from every output, returning how many were
+// deleted. Outputs selecting clients by host are tried too, as the host of
+// a client that is gone is not known. An output failing is given up on
+// after its first error.
+func (s *Scribe) eraseOutputs(ctx context.Context, files map[string]bool, report *DeletionReport) int {
+	erased := 0
+	for _, target := range s.outputs.targets {
+		for name := range files {
+			err := target.Target.Delete(ctx, name)
+			if err == nil {
+				erased++
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to delete %s: %v", target.Target.URL(name), err))
+				break
+			}
+		}
+	}
+	return erased
+}
+
+// signDeletion signs a report with the private key of the TLS certificate.
+// Client IDs are pseudonymized first, when they are, so the response keeps
+// the signature valid.
+func (s *Scribe) signDeletion(report DeletionReport) (SignedDeletionReport, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return SignedDeletionReport{}, fmt.Errorf("failed to marshal deletion report: %w", err)
+	}
+	if s.config.Pseudonyms != nil {
+		data = []byte(s.config.Pseudonyms.Mask(string(data)))
+	}
+	if s.signer == nil {
+		return SignedDeletionReport{}, fmt.Errorf("TLS private key cannot sign")
+	}
+
+	digest := sha256.Sum256(data)
+	var algorithm string
+	var signature []byte
+	switch s.signer.Public().(type) {
+	case *rsa.PublicKey:
+		algorithm = "RSA-PKCS1v15-SHA256"
+		signature, err = s.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case *ecdsa.PublicKey:
+		algorithm = "ECDSA-SHA256"
+		signature, err = s.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		algorithm = "Ed25519"
+		signature, err = s.signer.Sign(rand.Reader, data, crypto.Hash(0))
+	default:
+		return SignedDeletionReport{}, fmt.Errorf("unsupported TLS key type %T", s.signer.Public())
+	}
+	if err != nil {
+		return SignedDeletionReport{}, fmt.Errorf("failed to sign deletion report: %w", err)
+	}
+	return SignedDeletionReport{
+		Report:    data,
+		Algorithm: algorithm,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}, nil
+}
+
+// logDeletion appends a signed report to the deletion log
+func (s *Scribe) logDeletion(signed SignedDeletionReport) error {
+	file, err := os.OpenFile(filepath.Join(s.config.RecordingsDir, deletionLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open deletion log: %w", err)
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write deletion log: %w", err)
+	}
+	return nil
+}
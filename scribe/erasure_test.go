@@ -0,0 +1,234 @@
+package scribe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryTarget is an output keeping files in memory
+type memoryTarget struct {
+	mu    sync.Mutex
+	files map[string]bool
+	err   error
+}
+
+func (m *memoryTarget) Put(ctx context.Context, name string, body io.Reader, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = true
+	return m.err
+}
+
+func (m *memoryTarget) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if !m.files[name] {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memoryTarget) URL(name string) string {
+	return "memory:///" + name
+}
+
+func TestEraseClientOutputs(t *testing.T) {
+	const clientID = "6f1c2a5e-8a5b-4c1e-9a43-0b8f6c1d2e3f"
+	const other = "0d2c9e4b-1f3a-4b5c-8d6e-7f8091a2b3c4"
+	pushed := &memoryTarget{files: map[string]bool{
+		"20250102/" + clientID + "/a.wav": true,
+		"20250102/" + clientID + "/a.txt": true,
+		"20250102/" + clientID + "/b.txt": true,
+		"20250102/" + other + "/c.wav":    true,
+	}}
+	down := &memoryTarget{files: map[string]bool{}, err: errors.New("connection refused")}
+	s := newTestScribe(t, Config{Outputs: []Output{{Target: pushed}, {Target: down, Clients: []string{"192.168.1.40"}}}})
+
+	// a was archived as FLAC after it was pushed, b was text only
+	clientDir := filepath.Join(s.config.RecordingsDir, "20250102", clientID)
+	if err := os.MkdirAll(clientDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(clientDir, "a.flac"), []byte("fLaC"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2025, 1, 2, 12, 0, 0, 0, time.Local)
+	for _, file := range []string{"a.wav", "b.wav"} {
+		if _, err := s.store.append(clientID, TranscriptionMessage{Text: "hello", AudioFile: file, Timestamp: timestamp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := s.eraseClient(context.Background(), clientID, "", "")
+	if report.OutputFiles != 3 {
+		t.Errorf("deleted %d output files, want 3", report.OutputFiles)
+	}
+	if len(pushed.files) != 1 || !pushed.files["20250102/"+other+"/c.wav"] {
+		t.Errorf("output left with %v, want only the other client's file", pushed.files)
+	}
+	if len(report.Errors) != 1 {
+		t.Errorf("got errors %q, want one for the failing output", report.Errors)
+	}
+}
+
+func TestEraseClientLedgersUploadsInbox(t *testing.T) {
+	const clientID = "6f1c2a5e-8a5b-4c1e-9a43-0b8f6c1d2e3f"
+	const other = "0d2c9e4b-1f3a-4b5c-8d6e-7f8091a2b3c4"
+	inboxDir := t.TempDir()
+	s := newTestScribe(t, Config{Inbox: InboxConfig{Dir: inboxDir}})
+	dir := s.config.RecordingsDir
+	january := time.Date(2025, 1, 2, 12, 0, 0, 0, time.Local)
+	march := time.Date(2025, 3, 1, 12, 0, 0, 0, time.Local)
+
+	// Errors of retention runs naming the client's files of the days
+	// erased, or the client without a day, go
+	runs := []RetentionRun{
+		{Time: january, Errors: []string{
+			"remove " + filepath.Join(dir, "20250102", clientID, "a.wav") + ": permission denied",
+			"remove " + filepath.Join(dir, "20250102", other, "c.wav") + ": permission denied",
+			"failed to upload 20250301/" + clientID + "/b.wav: timeout",
+			"open " + filepath.Join(dir, "sessions", clientID) + ": permission denied",
+		}},
+		{Time: march, AudioDays: []string{"20250101"}},
+	}
+	var log []byte
+	for _, run := range runs {
+		line, _ := json.Marshal(run)
+		log = append(append(log, line...), '\n')
+	}
+	log = append(log, "not json "+clientID+"\n"...)
+	if err := os.WriteFile(filepath.Join(dir, retentionLogFile), log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backup ledgers of a day erased and of one that is not
+	for _, day := range []string{"20250102", "20250301"} {
+		if err := os.MkdirAll(filepath.Join(dir, day), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []string{clientID + "/a.wav", other + "/c.wav", "manifest.json"} {
+			if err := appendBackupLedger(filepath.Join(dir, day), backupEntry{File: file, SHA256: "00", Time: january}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Uploads of the client, one started on a day not erased and one busy,
+	// and of another client
+	uploads := map[string]*ChunkedUpload{
+		"erased": {ID: strings.Repeat("1", 32), ClientID: clientID, Created: january, Status: uploadReceiving},
+		"later":  {ID: strings.Repeat("2", 32), ClientID: clientID, Created: march, Status: uploadReceiving},
+		"busy":   {ID: strings.Repeat("3", 32), ClientID: clientID, Created: january, Status: uploadProcessing},
+		"other":  {ID: strings.Repeat("4", 32), ClientID: other, Created: january, Status: uploadFailed},
+	}
+	if err := os.MkdirAll(s.uploads.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, upload := range uploads {
+		if err := s.uploads.save(upload); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(s.uploads.dataPath(upload.ID), []byte("RIFF"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	busy := s.uploads.lock(uploads["busy"].ID)
+	busy.Lock()
+	defer busy.Unlock()
+
+	// Files taken from the inbox, one of them already gone
+	taken := map[string]string{
+		filepath.Join(clientID, "a.m4a"): clientID,
+		"kitchen_0915.m4a":               clientID,
+		"gone.m4a":                       clientID,
+		"other_0915.m4a":                 other,
+	}
+	if err := os.MkdirAll(filepath.Join(inboxDir, clientID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, owner := range taken {
+		if name != "gone.m4a" {
+			if err := os.WriteFile(filepath.Join(inboxDir, name), []byte("m4a"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.inbox.take(name, inboxEntry{Size: 3, Modified: january, ClientID: owner})
+	}
+	if err := s.inbox.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := s.eraseClient(context.Background(), clientID, "", "20250201")
+
+	if report.RetentionErrors != 2 {
+		t.Errorf("removed %d retention errors, want 2", report.RetentionErrors)
+	}
+	r, err := newRetention(RetentionConfig{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged, err := r.runs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 2 || len(logged[1].Errors) != 2 || strings.Contains(logged[1].Errors[0], clientID) || !strings.Contains(logged[1].Errors[1], "20250301/"+clientID) {
+		t.Errorf("retention log left with %+v", logged)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, retentionLogFile)); !strings.HasSuffix(string(data), "not json "+clientID+"\n") {
+		t.Errorf("unreadable line not kept: %q", data)
+	}
+
+	if report.BackupLedgerEntries != 1 {
+		t.Errorf("removed %d ledger entries, want 1", report.BackupLedgerEntries)
+	}
+	for day, want := range map[string]int{"20250102": 2, "20250301": 3} {
+		ledger, err := readBackupLedger(filepath.Join(dir, day))
+		if err != nil || len(ledger) != want {
+			t.Errorf("%s: ledger left with %v, %v", day, ledger, err)
+		}
+	}
+
+	if report.Uploads != 1 {
+		t.Errorf("discarded %d uploads, want 1", report.Uploads)
+	}
+	for name, upload := range uploads {
+		_, err := s.uploads.load(upload.ID)
+		_, dataErr := os.Stat(s.uploads.dataPath(upload.ID))
+		if gone := os.IsNotExist(err) && os.IsNotExist(dataErr); gone != (name == "erased") {
+			t.Errorf("%s upload: gone is %v", name, gone)
+		}
+	}
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], uploads["busy"].ID) {
+		t.Errorf("got errors %q, want one for the busy upload", report.Errors)
+	}
+
+	if report.InboxFiles != 3 {
+		t.Errorf("deleted %d inbox files, want 3", report.InboxFiles)
+	}
+	for name, owner := range taken {
+		if _, err := os.Stat(filepath.Join(inboxDir, name)); os.IsNotExist(err) != (owner == clientID) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	loaded, err := loadInbox(dir, s.config.Inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.taken) != 1 || loaded.taken["other_0915.m4a"].ClientID != other {
+		t.Errorf("inbox left with %v", loaded.taken)
+	}
+}
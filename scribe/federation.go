@@ -0,0 +1,406 @@
+package scribe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/events"
+	"github.com/bosley/libas/scribeclient"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// File in the recordings directory the progress through each remote
+	// scribe is kept in
+	federationFile = "federation.json"
+
+	// Delay before reconnecting to a remote scribe, doubled after each
+	// failed attempt up to the maximum
+	federationRetry    = time.Second
+	maxFederationRetry = time.Minute
+
+	// Sequence numbers of a remote scribe remembered to drop those replay
+	// and the live feed both deliver
+	federationSeen = 4096
+)
+
+// FederationConfig has the scribe aggregate the transcriptions of remote
+// scribes, e.g. those of other sites, with its own. Their clients show up
+// in the client list, search, history and subscriptions like local ones,
+// labeled with the name of their site.
+type FederationConfig struct {
+	Sites []RemoteScribe
+}
+
+// RemoteScribe is a scribe whose transcriptions are aggregated
+type RemoteScribe struct {
+	// Name the site's transcriptions and clients are labeled with
+	Name string
+
+	// Client of the site's API. When the site requires sign-in, its token
+	// must see every client.
+	API *scribeclient.Client
+}
+
+func (c FederationConfig) validate() error {
+	names := make(map[string]bool)
+	for _, site := range c.Sites {
+		if site.Name == "" || site.API == nil {
+			return fmt.Errorf("remote scribes need a name and an API client")
+		}
+		if names[site.Name] {
+			return fmt.Errorf("remote scribe %q given twice", site.Name)
+		}
+		names[site.Name] = true
+	}
+	return nil
+}
+
+// federatedSite is the progress through a remote scribe
+type federatedSite struct {
+	// Newest sequence number of the site's transcriptions stored
+	Sequence uint64 `json:"sequence"`
+
+	// Clients of the site seen so far
+	Clients []string `json:"clients"`
+}
+
+// federation holds the progress through the remote scribes, persisted as
+// it changes
+type federation struct {
+	path  string
+	sites map[string]RemoteScribe
+
+	mu      sync.Mutex
+	state   map[string]*federatedSite
+	clients map[string]string
+}
+
+// loadFederation reads the progress through the remote scribes
+func loadFederation(recordingsDir string, config FederationConfig) (*federation, error) {
+	f := &federation{
+		path:    filepath.Join(recordingsDir, federationFile),
+		sites:   make(map[string]RemoteScribe),
+		state:   make(map[string]*federatedSite),
+		clients: make(map[string]string),
+	}
+	for _, site := range config.Sites {
+		f.sites[site.Name] = site
+	}
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read federation: %w", err)
+	}
+	if err := json.Unmarshal(data, &f.state); err != nil {
+		return nil, fmt.Errorf("failed to parse federation: %w", err)
+	}
+	for name, site := range f.state {
+		for _, clientID := range site.Clients {
+			f.clients[clientID] = name
+		}
+	}
+	return f, nil
+}
+
+// sequence returns the newest sequence number of a site's transcriptions
+// stored
+func (f *federation) sequence(name string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if site, ok := f.state[name]; ok {
+		return site.Sequence
+	}
+	return 0
+}
+
+// note records a client of a site and, when not zero, the newest sequence
+// number of its transcriptions stored, persisting them when they changed
+func (f *federation) note(name, clientID string, sequence uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	site, ok := f.state[name]
+	if !ok {
+		site = &federatedSite{}
+	}
+	updated := *site
+	changed := false
+	if clientID != "" && f.clients[clientID] != name {
+		updated.Clients = append(append([]string(nil), site.Clients...), clientID)
+		changed = true
+	}
+	if sequence > site.Sequence {
+		updated.Sequence = sequence
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	state := make(map[string]*federatedSite, len(f.state)+1)
+	for n, s := range f.state {
+		state[n] = s
+	}
+	state[name] = &updated
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal federation: %w", err)
+	}
+	tmpPath := f.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write federation: %w", err)
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write federation: %w", err)
+	}
+	f.state = state
+	if clientID != "" {
+		f.clients[clientID] = name
+	}
+	return nil
+}
+
+// siteOf finds the remote scribe a client belongs to
+func (f *federation) siteOf(clientID string) (RemoteScribe, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	site, ok := f.sites[f.clients[clientID]]
+	return site, ok
+}
+
+// federate follows a remote scribe until ctx ends, reconnecting when it is
+// lost
+func (s *Scribe) federate(ctx context.Context, site RemoteScribe) {
+	retry := federationRetry
+	for {
+		connected, err := s.followSite(ctx, site)
+		s.siteLost(site.Name)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			retry = federationRetry
+		}
+		slog.Warn("Lost remote scribe, reconnecting", "site", site.Name, "error", err, "retry", retry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, maxFederationRetry)
+	}
+}
+
+// followSite subscribes to every client of a remote scribe, replaying the
+// transcriptions made since the newest one stored, and stores what
+// arrives until the connection fails. It reports whether it subscribed.
+func (s *Scribe) followSite(ctx context.Context, site RemoteScribe) (bool, error) {
+	sub, err := site.API.Subscribe(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer sub.Close()
+	// Unblocks Next once ctx ends
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer stop()
+
+	from := s.federation.sequence(site.Name)
+	if err := sub.Send(scribeclient.SubscriptionCommand{Action: "subscribe", ClientIDs: []string{allClients}}); err != nil {
+		return false, err
+	}
+	if err := sub.Send(scribeclient.SubscriptionCommand{Action: "replay", Sequence: from}); err != nil {
+		return false, err
+	}
+	presence, err := site.API.Presence(ctx)
+	if err != nil {
+		return false, err
+	}
+	for clientID, p := range presence {
+		if p.Site != "" {
+			continue
+		}
+		s.remotePresence(site.Name, events.ClientConnected, clientID, PresenceMessage{
+			Connected:   p.Connected,
+			Addr:        p.Addr,
+			ConnectedAt: p.ConnectedAt,
+			Muted:       p.Muted,
+			MutedUntil:  p.MutedUntil,
+			Health:      p.Health,
+			HealthAt:    p.HealthAt,
+		})
+	}
+	slog.Info("Following remote scribe", "site", site.Name, "fromSequence", from)
+
+	// Live transcriptions arrive among the replayed ones, which end with
+	// the second acknowledgement. Until then the newest sequence number
+	// is not saved, so a restart does not skip what replay had left.
+	acks := 0
+	newest := from
+	seen := make(map[uint64]bool)
+	for {
+		msg, err := sub.Next()
+		if err != nil {
+			return true, err
+		}
+		switch msg.Type {
+		case "transcription":
+			if msg.Sequence <= from || seen[msg.Sequence] {
+				continue
+			}
+			var transcription TranscriptionMessage
+			if err := json.Unmarshal(msg.Payload, &transcription); err != nil {
+				slog.Warn("Skipping malformed transcription of remote scribe", "site", site.Name, "error", err)
+				continue
+			}
+			// Aggregating what a site aggregated itself could loop
+			if transcription.Site == "" {
+				if err := s.storeRemote(site.Name, msg.ClientID, transcription); err != nil {
+					return true, err
+				}
+			}
+			seen[msg.Sequence] = true
+			newest = max(newest, msg.Sequence)
+			if len(seen) > federationSeen {
+				for sequence := range seen {
+					if sequence+federationSeen/2 < newest {
+						delete(seen, sequence)
+					}
+				}
+			}
+			if acks >= 2 {
+				if err := s.federation.note(site.Name, "", msg.Sequence); err != nil {
+					return true, err
+				}
+			}
+
+		case "ack":
+			if acks++; acks == 2 {
+				if err := s.federation.note(site.Name, "", newest); err != nil {
+					return true, err
+				}
+			}
+
+		case events.ClientConnected, events.ClientDisconnected, events.ClientMuted, events.ClientUnmuted:
+			var p PresenceMessage
+			if err := json.Unmarshal(msg.Payload, &p); err == nil && p.Site == "" {
+				s.remotePresence(site.Name, msg.Type, msg.ClientID, p)
+			}
+
+		case "error":
+			slog.Warn("Remote scribe refused a command", "site", site.Name, "error", msg.Error())
+		}
+	}
+}
+
+// storeRemote persists a transcription of a remote scribe under a sequence
+// number of this one and hands it to the event sinks and subscribers
+func (s *Scribe) storeRemote(site, clientID string, msg TranscriptionMessage) error {
+	if err := s.federation.note(site, clientID, 0); err != nil {
+		return err
+	}
+	msg.Site = site
+	msg.RemoteSequence = msg.Sequence
+	msg.Sequence, msg.Session = 0, 0
+
+	s.sequenceMu.Lock()
+	defer s.sequenceMu.Unlock()
+	msg, err := s.appendToSession(clientID, msg)
+	if err != nil {
+		return fmt.Errorf("failed to persist transcription: %w", err)
+	}
+	s.remember(clientID, msg)
+
+	eventType := events.Transcription
+	if msg.Sound != "" {
+		eventType = events.Sound
+	}
+	s.events.Publish(events.Event{
+		ID:       fmt.Sprintf("%s-%d", clientID, msg.Sequence),
+		Type:     eventType,
+		Time:     msg.Timestamp,
+		ClientID: clientID,
+		Data:     msg,
+	})
+	return s.broadcast(WebSocketMessage{
+		Type:      "transcription",
+		ClientID:  clientID,
+		Sequence:  msg.Sequence,
+		Timestamp: msg.Timestamp,
+		Payload:   msg,
+	})
+}
+
+// remotePresence records a change of presence of a remote scribe's client
+// and notifies subscribers
+func (s *Scribe) remotePresence(site, eventType, clientID string, presence PresenceMessage) {
+	if err := s.federation.note(site, clientID, 0); err != nil {
+		slog.Warn("Failed to save client of remote scribe", "error", err, "site", site, "clientID", clientID)
+	}
+	presence.Site = site
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+	if presence.Connected {
+		s.presence.Store(clientID, presence)
+		s.clients.LoadOrStore(clientID, &ClientTranscriptions{
+			Messages: make([]TranscriptionMessage, 0),
+		})
+	} else {
+		s.presence.Delete(clientID)
+	}
+	s.publishPresence(eventType, clientID, presence)
+}
+
+// siteLost marks the clients of a remote scribe disconnected once the
+// connection to it is lost
+func (s *Scribe) siteLost(site string) {
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+	s.presence.Range(func(key, value interface{}) bool {
+		presence := value.(PresenceMessage)
+		if presence.Site == site {
+			s.presence.Delete(key)
+			s.publishPresence(events.ClientDisconnected, key.(string), PresenceMessage{Site: site})
+		}
+		return true
+	})
+}
+
+// serveRemoteAudio fetches a recording of a remote scribe's client from it
+func (s *Scribe) serveRemoteAudio(w http.ResponseWriter, r *http.Request, site RemoteScribe) {
+	vars := mux.Vars(r)
+	fileName := vars["file"]
+	if fileName != filepath.Base(fileName) || !strings.HasSuffix(fileName, ".wav") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	body, err := site.API.Audio(r.Context(), vars["clientID"], fileName, r.URL.Query().Get("date"))
+	var apiErr *scribeclient.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		http.Error(w, "Audio file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Warn("Failed to fetch recording of remote scribe", "error", err, "site", site.Name, "file", fileName)
+		http.Error(w, "Remote scribe unavailable", http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "audio/wav")
+	io.Copy(w, body)
+}
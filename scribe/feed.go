@@ -0,0 +1,267 @@
+package scribe
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Entries in a feed unless "limit" is given
+	defaultFeedLimit = 50
+
+	// Upper bound on the "limit" query parameter
+	maxFeedLimit = 500
+
+	// Longest entry title, the full text is the entry's content
+	feedTitleLength = 80
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Content    string         `xml:"content"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	GUID       rssGUID      `xml:"guid"`
+	Title      string       `xml:"title"`
+	Link       string       `xml:"link"`
+	PubDate    string       `xml:"pubDate"`
+	Categories []string     `xml:"category"`
+	Enclosure  rssEnclosure `xml:"enclosure"`
+	Content    string       `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int    `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// handleGetFeed serves a client's latest stored transcriptions as an Atom
+// feed, or RSS 2.0 with "format=rss", for feed readers and RSS automation.
+// Entries link to their recordings; "limit" caps how many are included.
+func (s *Scribe) handleGetFeed(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format != "" && format != "atom" && format != "rss" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+	limit := defaultFeedLimit
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxFeedLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records, err := s.store.search(searchQuery{clientID: clientID, limit: limit})
+	if err != nil {
+		slog.Error("Failed to read transcriptions for feed", "error", err, "clientID", clientID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, known := s.clients.Load(clientID); !known && len(records) == 0 {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	// Newest first, as feed readers expect
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	name := clientID
+	if host, ok := s.hosts.Load(clientID); ok {
+		name = host.(string)
+	}
+	base := feedBaseURL(r)
+	self := base + r.URL.RequestURI()
+
+	var updated time.Time
+	if len(records) > 0 {
+		updated = records[0].Message.Timestamp
+	}
+
+	var body any
+	contentType := "application/atom+xml; charset=utf-8"
+	if format == "rss" {
+		body = s.rssFeed(base, self, clientID, name, updated, records)
+		contentType = "application/rss+xml; charset=utf-8"
+	} else {
+		body = s.atomFeed(base, self, clientID, name, updated, records)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(body); err != nil {
+		slog.Error("Failed to encode feed", "error", err, "clientID", clientID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// ServeContent answers conditional requests from polling readers
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", updated, bytes.NewReader(buf.Bytes()))
+}
+
+func (s *Scribe) atomFeed(base, self, clientID, name string, updated time.Time, records []StoredTranscription) atomFeed {
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed := atomFeed{
+		ID:      "urn:uuid:" + clientID,
+		Title:   "Transcriptions from " + name,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}},
+		Author:  atomAuthor{Name: "libas"},
+		Entries: make([]atomEntry, 0, len(records)),
+	}
+	for _, record := range records {
+		msg := record.Message
+		audio := recordingURL(base, clientID, msg)
+		entry := atomEntry{
+			ID:      entryID(clientID, msg),
+			Title:   feedTitle(msg.Text),
+			Updated: msg.Timestamp.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Href: audio},
+				{Rel: "enclosure", Type: "audio/wav", Href: audio},
+			},
+			Content: msg.Text,
+		}
+		for _, event := range msg.Events {
+			entry.Categories = append(entry.Categories, atomCategory{Term: event})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+func (s *Scribe) rssFeed(base, self, clientID, name string, updated time.Time, records []StoredTranscription) rssFeed {
+	channel := rssChannel{
+		Title:       "Transcriptions from " + name,
+		Link:        self,
+		Description: "Speech transcribed from libas client " + clientID,
+		Items:       make([]rssItem, 0, len(records)),
+	}
+	if !updated.IsZero() {
+		channel.LastBuildDate = updated.Format(time.RFC1123Z)
+	}
+	for _, record := range records {
+		msg := record.Message
+		audio := recordingURL(base, clientID, msg)
+		channel.Items = append(channel.Items, rssItem{
+			GUID:       rssGUID{Value: entryID(clientID, msg)},
+			Title:      feedTitle(msg.Text),
+			Link:       audio,
+			PubDate:    msg.Timestamp.Format(time.RFC1123Z),
+			Categories: msg.Events,
+			// The size of a recording served from FLAC is not known up
+			// front, readers accept zero
+			Enclosure: rssEnclosure{URL: audio, Type: "audio/wav"},
+			Content:   msg.Text,
+		})
+	}
+	return rssFeed{Version: "2.0", Channel: channel}
+}
+
+// feedBaseURL is the scheme and host the request reached the scribe at,
+// so links work from outside
+func feedBaseURL(r *http.Request) string {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host
+}
+
+// entryID identifies a transcription for readers across polls
+func entryID(clientID string, msg TranscriptionMessage) string {
+	return fmt.Sprintf("urn:libas:%s:%d", clientID, msg.Sequence)
+}
+
+// recordingURL links to a transcription's recording
+func recordingURL(base, clientID string, msg TranscriptionMessage) string {
+	return base + "/api/clients/" + clientID + "/audio/" + url.PathEscape(msg.AudioFile)
+}
+
+// feedTitle shortens a transcription to an entry title at a word boundary
+func feedTitle(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= feedTitleLength {
+		return text
+	}
+	runes := []rune(text)[:feedTitleLength]
+	title := string(runes)
+	if i := strings.LastIndexByte(title, ' '); i > feedTitleLength/2 {
+		title = title[:i]
+	}
+	return title + "…"
+}
@@ -0,0 +1,235 @@
+package scribe
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bosley/libas/events"
+	"github.com/bosley/libas/internal/disk"
+)
+
+// How often the health checks run
+const healthInterval = time.Minute
+
+// HealthConfig sets when the built-in health alerts fire. They are
+// published as alert events, firing once when a check starts failing and
+// resolving once it recovers, so any event sink can deliver them. A zero
+// value turns its check off.
+type HealthConfig struct {
+	// Recordings have waited this long without a job starting or finishing
+	QueueStuck time.Duration
+
+	// Whisper failed this many times in a row
+	WhisperFailures int
+
+	// Less than this percentage of the recordings volume is free
+	DiskFreePercent float64
+
+	// A known client has sent no recording for this long
+	ClientSilence time.Duration
+}
+
+func (c HealthConfig) enabled() bool {
+	return c.QueueStuck > 0 || c.WhisperFailures > 0 || c.DiskFreePercent > 0 || c.ClientSilence > 0
+}
+
+// health follows the pipeline for the checks
+type health struct {
+	// Unix nanoseconds the queue last moved: a job started or finished,
+	// or arrived while nothing was waiting
+	progress atomic.Int64
+
+	// Jobs being transcribed
+	running atomic.Int32
+
+	// Whisper runs failed in a row and the latest error
+	failures  atomic.Int32
+	lastError atomic.Value // string
+
+	// Time of each client's latest recording
+	lastAudio sync.Map // map[string]time.Time
+}
+
+// healthAlert is a failing check
+type healthAlert struct {
+	name     string
+	message  string
+	err      string
+	clientID string
+	labels   map[string]string
+	startsAt time.Time
+}
+
+// jobStarted and jobFinished bracket the processing of a job
+func (h *health) jobStarted() {
+	h.running.Add(1)
+	h.progress.Store(time.Now().UnixNano())
+}
+
+func (h *health) jobFinished() {
+	h.running.Add(-1)
+	h.progress.Store(time.Now().UnixNano())
+}
+
+// jobQueued records a recording arriving, restarting the stuck queue clock
+// when nothing was waiting
+func (h *health) jobQueued(clientID string, idle bool) {
+	now := time.Now()
+	h.lastAudio.Store(clientID, now)
+	if idle {
+		h.progress.Store(now.UnixNano())
+	}
+}
+
+// transcribed counts whisper failures in a row
+func (h *health) transcribed(err error) {
+	if err == nil {
+		h.failures.Store(0)
+		return
+	}
+	h.lastError.Store(err.Error())
+	h.failures.Add(1)
+}
+
+// runHealth runs the health checks each interval until ctx is cancelled
+func (s *Scribe) runHealth(ctx context.Context) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	firing := make(map[string]healthAlert)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		failing := s.checkHealth(now)
+		for key, alert := range failing {
+			if _, ok := firing[key]; ok {
+				continue
+			}
+			alert.startsAt = now
+			firing[key] = alert
+			slog.Warn("Health alert firing", "name", alert.name, "message", alert.message, "clientID", alert.clientID)
+			s.publishHealth(alert, events.AlertFiring)
+			if alert.name == "disk_low" && s.retention.enabled() {
+				// Purge what has expired now rather than tonight
+				s.retention.runEarly()
+			}
+		}
+		for key, alert := range firing {
+			if _, ok := failing[key]; ok {
+				continue
+			}
+			delete(firing, key)
+			slog.Info("Health alert resolved", "name", alert.name, "message", alert.message, "clientID", alert.clientID)
+			s.publishHealth(alert, events.AlertResolved)
+		}
+	}
+}
+
+// checkHealth returns the failing checks by name and client
+func (s *Scribe) checkHealth(now time.Time) map[string]healthAlert {
+	cfg := s.config.Health
+	failing := make(map[string]healthAlert)
+	add := func(alert healthAlert) {
+		failing[alert.name+"/"+alert.clientID] = alert
+	}
+
+	if cfg.QueueStuck > 0 {
+		pending := len(s.queue) + int(s.health.running.Load())
+		since := now.Sub(time.Unix(0, s.health.progress.Load()))
+		if pending > 0 && since >= cfg.QueueStuck {
+			add(healthAlert{
+				name:    "queue_stuck",
+				message: fmt.Sprintf("Queue has not moved for %s, %d recordings waiting", since.Round(time.Minute), pending),
+				labels:  map[string]string{"severity": "critical"},
+			})
+		}
+	}
+
+	if cfg.WhisperFailures > 0 {
+		if failures := int(s.health.failures.Load()); failures >= cfg.WhisperFailures {
+			lastError, _ := s.health.lastError.Load().(string)
+			add(healthAlert{
+				name:    "whisper_failing",
+				message: fmt.Sprintf("Whisper failed %d times in a row", failures),
+				err:     lastError,
+				labels:  map[string]string{"severity": "critical"},
+			})
+		}
+	}
+
+	if cfg.DiskFreePercent > 0 {
+		free, total, err := disk.Space(s.config.RecordingsDir)
+		switch {
+		case err != nil:
+			add(healthAlert{
+				name:    "disk_low",
+				message: "Free space of the recordings volume cannot be checked",
+				err:     err.Error(),
+				labels:  map[string]string{"severity": "warning"},
+			})
+		case total > 0 && float64(free)/float64(total)*100 < cfg.DiskFreePercent:
+			add(healthAlert{
+				name: "disk_low",
+				message: fmt.Sprintf("Recordings volume is nearly full, %.1f%% (%d MB) free",
+					float64(free)/float64(total)*100, free>>20),
+				labels: map[string]string{"severity": "warning"},
+			})
+		}
+	}
+
+	if cfg.ClientSilence > 0 {
+		// Clients are followed from when they are first seen
+		s.clients.Range(func(key, _ interface{}) bool {
+			s.health.lastAudio.LoadOrStore(key, now)
+			return true
+		})
+		s.health.lastAudio.Range(func(key, value interface{}) bool {
+			clientID := key.(string)
+			since := now.Sub(value.(time.Time))
+			if since < cfg.ClientSilence {
+				return true
+			}
+			name := clientID
+			labels := map[string]string{"severity": "warning", "clientId": clientID}
+			if host, ok := s.hosts.Load(clientID); ok {
+				name = host.(string)
+				labels["host"] = name
+			}
+			add(healthAlert{
+				name:     "client_silent",
+				message:  fmt.Sprintf("No audio from %s for %s", name, since.Round(time.Minute)),
+				clientID: clientID,
+				labels:   labels,
+			})
+			return true
+		})
+	}
+
+	return failing
+}
+
+// publishHealth publishes a health alert as firing or resolved
+func (s *Scribe) publishHealth(alert healthAlert, status string) {
+	startsAt := alert.startsAt
+	s.events.Publish(events.Event{
+		Type:     events.Alert,
+		ClientID: alert.clientID,
+		Data: events.AlertData{
+			Message:  alert.message,
+			Error:    alert.err,
+			Name:     alert.name,
+			Status:   status,
+			Labels:   alert.labels,
+			StartsAt: &startsAt,
+		},
+	})
+}
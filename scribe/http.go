@@ -1,13 +1,21 @@
 package scribe
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/bosley/libas/audio"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -22,58 +30,159 @@ const (
 
 	// Send pings to peer with this period (must be less than pongWait)
 	pingPeriod = (pongWait * 9) / 10
+
+	// Maximum size of a command sent by a subscriber
+	maxCommandSize = 4096
+
+	// Time allowed for subscribers to drain and acknowledge close on shutdown
+	shutdownTimeout = 5 * time.Second
+
+	// Time to wait for the peer's close reply after sending a close frame
+	closeGracePeriod = time.Second
 )
 
 type wsConnection struct {
 	conn      *websocket.Conn
-	clientID  string
 	send      chan []byte
 	scribe    *Scribe
 	closeOnce sync.Once
+
+	// Who subscribed, only their clients are sent. Nil when sign-in is off.
+	user *user
+
+	// Closed to ask the write pump to drain and send a close frame
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	// Closed when the pumps exit
+	writeDone chan struct{}
+	readDone  chan struct{}
+
+	// Subscription state, changed by subscriber commands
+	mu            sync.Mutex
+	subscriptions map[string]bool
+	keywords      []string
 }
 
 func (s *Scribe) startHTTP(ctx context.Context) error {
+	s.server = &http.Server{
+		Addr:    s.config.HTTPAddr,
+		Handler: s.corsMiddleware(s.pseudonymMiddleware(s.newRouter())),
+	}
+
+	listener, err := net.Listen("tcp", s.config.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start HTTP server: %w", err)
+	}
+	s.addr = listener.Addr()
+	close(s.ready)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.server.ServeTLS(listener, s.config.CertFile, s.config.KeyFile)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("HTTP server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	s.closeSubscribers(shutdownCtx)
+	return s.server.Shutdown(shutdownCtx)
+}
+
+// newRouter routes the API, WebSocket and dashboard requests
+func (s *Scribe) newRouter() *mux.Router {
 	router := mux.NewRouter()
 
 	// API routes
 	router.HandleFunc("/api/clients", s.handleListClients).Methods("GET")
+	router.HandleFunc("/api/presence", s.handleListPresence).Methods("GET")
 	router.HandleFunc("/api/clients/{clientID}", s.handleGetClient).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/history", s.handleGetHistory).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/sessions", s.handleGetSessions).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/audio/{file}", s.handleGetAudio).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/audio/{file}/waveform", s.handleGetWaveform).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/digest", s.handleGetDigest).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/feed", s.handleGetFeed).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/mute", s.handleMute).Methods("POST")
+	router.HandleFunc("/api/clients/{clientID}/mute", s.handleUnmute).Methods("DELETE")
+	router.HandleFunc("/api/clients/{clientID}/data", s.handleDeleteData).Methods("DELETE")
+	router.HandleFunc("/api/clients/{clientID}/transcriptions/{sequence}", s.handleCorrectTranscription).Methods("PUT")
+	router.HandleFunc("/api/clients/{clientID}/vocabulary", s.handleGetVocabulary).Methods("GET")
+	router.HandleFunc("/api/clients/{clientID}/vocabulary", s.handleDeleteVocabulary).Methods("DELETE")
+	if s.config.Synthesizer != nil {
+		router.HandleFunc("/api/clients/{clientID}/say", s.handleSay).Methods("POST")
+	}
+	router.HandleFunc("/api/integrity", s.handleIntegrity).Methods("GET")
+	router.HandleFunc("/api/search", s.handleSearch).Methods("GET")
+	router.HandleFunc("/api/retention", s.handleRetention).Methods("GET")
+	router.HandleFunc("/api/latency", s.handleLatency).Methods("GET")
+	router.HandleFunc("/api/analytics/talktime", s.handleTalkTime).Methods("GET")
+	router.HandleFunc("/api/prompts", s.handleListPrompts).Methods("GET")
+	router.HandleFunc("/api/prompts/{client}", s.handleSetPrompt).Methods("PUT")
+	router.HandleFunc("/api/prompts/{client}", s.handleDeletePrompt).Methods("DELETE")
+	router.HandleFunc("/api/speakers", s.handleListSpeakers).Methods("GET")
+	router.HandleFunc("/api/speakers/{name}", s.handleEnrollSpeaker).Methods("POST")
+	router.HandleFunc("/api/speakers/{name}", s.handleDeleteSpeaker).Methods("DELETE")
+	router.HandleFunc("/api/intercom", s.handleListRoutes).Methods("GET")
+	router.HandleFunc("/api/intercom", s.handleRoute).Methods("POST")
+	router.HandleFunc("/api/intercom/{clientID}", s.handleUnroute).Methods("DELETE")
+	router.HandleFunc("/api/transcribe", s.handleTranscribeUpload).Methods("POST")
+	router.HandleFunc("/api/uploads", s.handleCreateUpload).Methods("POST")
+	router.HandleFunc("/api/uploads/{id}", s.handleGetUpload).Methods("GET", "HEAD")
+	router.HandleFunc("/api/uploads/{id}", s.handleAppendUpload).Methods("PATCH")
+	router.HandleFunc("/api/uploads/{id}", s.handleDeleteUpload).Methods("DELETE")
+	router.HandleFunc("/api/meetings", s.handleListMeetings).Methods("GET")
+	router.HandleFunc("/api/meetings", s.handleStartMeeting).Methods("POST")
+	router.HandleFunc("/api/meetings/{id}", s.handleGetMeeting).Methods("GET")
+	router.HandleFunc("/api/meetings/{id}/end", s.handleEndMeeting).Methods("POST")
+	router.HandleFunc("/api/version", s.handleVersion).Methods("GET")
+	router.HandleFunc("/api/openapi.json", handleOpenAPI).Methods("GET")
+	router.HandleFunc("/ws", s.handleWebSocket)
 	router.HandleFunc("/ws/{clientID}", s.handleWebSocket)
 
-	// Modify the static file serving to be more explicit:
-	staticFS := http.FileServer(http.Dir("scribe/static"))
-	router.PathPrefix("/").Handler(http.StripPrefix("/", staticFS))
-
-	s.server = &http.Server{
-		Addr:    s.config.HTTPAddr,
-		Handler: router,
+	if s.auth != nil {
+		router.HandleFunc("/auth/login", s.handleLogin).Methods("GET")
+		router.HandleFunc("/auth/callback", s.handleAuthCallback).Methods("GET")
+		router.HandleFunc("/auth/logout", s.handleLogout).Methods("GET", "POST")
+		router.HandleFunc("/api/me", s.handleMe).Methods("GET")
 	}
 
-	go func() {
-		if err := s.server.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile); err != http.ErrServerClosed {
-			slog.Error("HTTP server error", "error", err)
-		}
-	}()
+	// Dashboard is embedded in the binary
+	router.PathPrefix("/").Handler(staticHandler())
 
-	<-ctx.Done()
-	return s.server.Shutdown(context.Background())
+	if s.config.AccessLog {
+		router.Use(accessLogMiddleware)
+	}
+	if s.auth != nil {
+		router.Use(s.authMiddleware)
+	}
+	return router
 }
 
 // handleListClients returns a map of active clients and their most recent message from today
 func (s *Scribe) handleListClients(w http.ResponseWriter, r *http.Request) {
 	activeClients := make(map[string]TranscriptionMessage)
 	currentDate := getCurrentDateDir()
+	u := requestUser(r)
 
 	s.clients.Range(func(key, value interface{}) bool {
 		clientID := key.(string)
-		transcriptions := value.(*ClientTranscriptions)
+		if !s.canView(u, clientID) {
+			return true
+		}
+		messages := value.(*ClientTranscriptions).snapshot()
 
 		// Always add the client, even with a nil/empty message
 		activeClients[clientID] = TranscriptionMessage{}
 
 		// If they have messages, update with most recent
-		for i := len(transcriptions.Messages) - 1; i >= 0; i-- {
-			msg := transcriptions.Messages[i]
+		for i := len(messages) - 1; i >= 0; i-- {
+			msg := messages[i]
 			if msg.Timestamp.Format("20060102") == currentDate {
 				activeClients[clientID] = msg
 				break
@@ -102,12 +211,12 @@ func (s *Scribe) handleGetClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	transcriptions := value.(*ClientTranscriptions)
+	messages := value.(*ClientTranscriptions).snapshot()
 
 	// Find most recent message from today
 	var mostRecent *TranscriptionMessage
-	for i := len(transcriptions.Messages) - 1; i >= 0; i-- {
-		msg := transcriptions.Messages[i]
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
 		if msg.Timestamp.Format("20060102") == currentDate {
 			mostRecent = &msg
 			break
@@ -128,23 +237,27 @@ func (s *Scribe) handleGetHistory(w http.ResponseWriter, r *http.Request) {
 	clientID := vars["clientID"]
 	currentDate := getCurrentDateDir()
 
-	value, ok := s.clients.Load(clientID)
+	today, _ := time.ParseInLocation("20060102", currentDate, time.Local)
+	messages, ok, err := s.messagesFrom(clientID, today)
 	if !ok {
 		slog.Debug("Client not found in history request",
 			"clientID", clientID)
 		http.Error(w, "Client not found", http.StatusNotFound)
 		return
 	}
-
-	transcriptions := value.(*ClientTranscriptions)
+	if err != nil {
+		slog.Error("Failed to read transcriptions", "error", err, "clientID", clientID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	slog.Debug("Retrieved client transcriptions",
 		"clientID", clientID,
-		"totalMessages", len(transcriptions.Messages))
+		"totalMessages", len(messages))
 
 	// Filter messages for today only
 	todayMessages := make([]TranscriptionMessage, 0)
-	for _, msg := range transcriptions.Messages {
+	for _, msg := range messages {
 		if msg.Timestamp.Format("20060102") == currentDate {
 			todayMessages = append(todayMessages, msg)
 		}
@@ -164,16 +277,124 @@ func (s *Scribe) handleGetHistory(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Scribe) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+// handleGetAudio serves a stored recording so the dashboard can play it back.
+// The optional "date" query parameter (YYYYMMDD) selects the day directory,
+// otherwise the most recent day containing the file is used.
+func (s *Scribe) handleGetAudio(w http.ResponseWriter, r *http.Request) {
+	if site, ok := s.federation.siteOf(mux.Vars(r)["clientID"]); ok {
+		s.serveRemoteAudio(w, r, site)
+		return
+	}
+
+	path, fileName, ok := s.recordingPath(w, r)
+	if !ok {
+		return
+	}
+
+	if strings.HasSuffix(path, ".flac") {
+		s.serveFLACAsWav(w, r, path, fileName)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/wav")
+	http.ServeFile(w, r, path)
+}
+
+// recordingPath validates the client and file of an audio request and finds
+// the recording on disk, writing an error response when it cannot
+func (s *Scribe) recordingPath(w http.ResponseWriter, r *http.Request) (string, string, bool) {
 	vars := mux.Vars(r)
 	clientID := vars["clientID"]
+	fileName := vars["file"]
 
-	// Validate client ID
 	if _, err := uuid.Parse(clientID); err != nil {
 		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	if fileName != filepath.Base(fileName) || !strings.HasSuffix(fileName, ".wav") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	date := r.URL.Query().Get("date")
+	path, ok := s.findAudioFile(clientID, fileName, date)
+	if !ok {
+		// Archived recordings keep their WAV name in the journal
+		flacName := strings.TrimSuffix(fileName, ".wav") + ".flac"
+		if path, ok = s.findAudioFile(clientID, flacName, date); !ok {
+			http.Error(w, "Audio file not found", http.StatusNotFound)
+			return "", "", false
+		}
+	}
+
+	return path, fileName, true
+}
+
+// serveFLACAsWav decodes an archived recording and serves it as WAV
+func (s *Scribe) serveFLACAsWav(w http.ResponseWriter, r *http.Request, path, fileName string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "Audio file not found", http.StatusNotFound)
 		return
 	}
 
+	pcm, err := audio.ReadFLAC(path, maxDecodedSamples)
+	if err != nil {
+		slog.Error("Failed to decode archived recording", "file", path, "error", err)
+		http.Error(w, "Failed to decode audio", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := audio.EncodeWav(&buf, pcm); err != nil {
+		slog.Error("Failed to encode recording", "file", path, "error", err)
+		http.Error(w, "Failed to decode audio", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/wav")
+	http.ServeContent(w, r, fileName, info.ModTime(), bytes.NewReader(buf.Bytes()))
+}
+
+// findAudioFile locates a client's recording on disk
+func (s *Scribe) findAudioFile(clientID, fileName, date string) (string, bool) {
+	if date != "" {
+		if _, err := time.Parse("20060102", date); err != nil {
+			return "", false
+		}
+		path := filepath.Join(s.config.RecordingsDir, date, clientID, fileName)
+		if _, err := os.Stat(path); err != nil {
+			return "", false
+		}
+		return path, true
+	}
+
+	matches, err := filepath.Glob(filepath.Join(s.config.RecordingsDir, "*", clientID, fileName))
+	if err != nil || len(matches) == 0 {
+		return "", false
+	}
+
+	// Day directories sort chronologically, prefer the latest
+	sort.Strings(matches)
+	return matches[len(matches)-1], true
+}
+
+// handleWebSocket upgrades the connection for a subscriber. When a client ID is
+// part of the path the subscriber starts out subscribed to that client,
+// otherwise it must send a subscribe command.
+func (s *Scribe) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientID, hasClient := vars["clientID"]
+
+	// Validate client ID
+	if hasClient {
+		if _, err := uuid.Parse(clientID); err != nil {
+			http.Error(w, "Invalid client ID", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Upgrade connection to WebSocket
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -182,14 +403,25 @@ func (s *Scribe) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	wsConn := &wsConnection{
-		conn:     conn,
-		clientID: clientID,
-		send:     make(chan []byte, 256),
-		scribe:   s,
+		conn:          conn,
+		send:          make(chan []byte, 256),
+		scribe:        s,
+		user:          requestUser(r),
+		subscriptions: make(map[string]bool),
+		shutdown:      make(chan struct{}),
+		writeDone:     make(chan struct{}),
+		readDone:      make(chan struct{}),
 	}
 
+	// Hijacked connections are not closed by http.Server.Shutdown, track
+	// them so Stop can close them properly
+	s.connections.Store(wsConn, struct{}{})
+
 	// Register this connection for the client
-	s.registerSubscriber(clientID, wsConn)
+	if hasClient {
+		wsConn.subscriptions[clientID] = true
+		s.registerSubscriber(clientID, wsConn)
+	}
 
 	// Start the connection handlers
 	go wsConn.writePump()
@@ -197,30 +429,41 @@ func (s *Scribe) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Scribe) registerSubscriber(clientID string, wsConn *wsConnection) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+
 	value, _ := s.subscribers.LoadOrStore(clientID, make([]*wsConnection, 0))
 	connections := value.([]*wsConnection)
+	for _, conn := range connections {
+		if conn == wsConn {
+			return
+		}
+	}
 	connections = append(connections, wsConn)
 	s.subscribers.Store(clientID, connections)
 }
 
 func (s *Scribe) unregisterSubscriber(clientID string, wsConn *wsConnection) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+
 	value, ok := s.subscribers.Load(clientID)
 	if !ok {
 		return
 	}
 
 	connections := value.([]*wsConnection)
-	for i, conn := range connections {
-		if conn == wsConn {
-			connections = append(connections[:i], connections[i+1:]...)
-			break
+	remaining := make([]*wsConnection, 0, len(connections))
+	for _, conn := range connections {
+		if conn != wsConn {
+			remaining = append(remaining, conn)
 		}
 	}
 
-	if len(connections) == 0 {
+	if len(remaining) == 0 {
 		s.subscribers.Delete(clientID)
 	} else {
-		s.subscribers.Store(clientID, connections)
+		s.subscribers.Store(clientID, remaining)
 	}
 }
 
@@ -229,6 +472,7 @@ func (c *wsConnection) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.writeDone)
 	}()
 
 	for {
@@ -240,13 +484,7 @@ func (c *wsConnection) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			if err := w.Close(); err != nil {
+			if err := c.write(message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -254,17 +492,105 @@ func (c *wsConnection) writePump() {
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+		case <-c.shutdown:
+			c.closeGracefully()
+			return
+		}
+	}
+}
+
+func (c *wsConnection) write(message []byte) error {
+	if p := c.scribe.config.Pseudonyms; p != nil {
+		message = []byte(p.Mask(string(message)))
+	}
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	w.Write(message)
+	return w.Close()
+}
+
+// closeGracefully flushes queued messages, then sends a "going away" close
+// frame so subscribers can tell a server restart from a network failure
+func (c *wsConnection) closeGracefully() {
+	deadline := time.Now().Add(writeWait)
+	c.conn.SetWriteDeadline(deadline)
+
+drain:
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				break drain
+			}
+			if err := c.write(message); err != nil {
+				return
+			}
+		default:
+			break drain
+		}
+	}
+
+	c.closeOnce.Do(func() {
+		c.conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+	})
+
+	// Give the peer a moment to reply to the close frame
+	select {
+	case <-c.readDone:
+	case <-time.After(closeGracePeriod):
+	}
+}
+
+// requestShutdown asks the connection to close gracefully
+func (c *wsConnection) requestShutdown() {
+	c.shutdownOnce.Do(func() {
+		close(c.shutdown)
+	})
+}
+
+// closeSubscribers gracefully closes every WebSocket connection, forcing
+// the remaining ones closed when the context expires
+func (s *Scribe) closeSubscribers(ctx context.Context) {
+	connections := make([]*wsConnection, 0)
+	s.connections.Range(func(key, _ interface{}) bool {
+		connections = append(connections, key.(*wsConnection))
+		return true
+	})
+
+	if len(connections) == 0 {
+		return
+	}
+
+	slog.Info("Closing WebSocket subscribers", "count", len(connections))
+
+	for _, conn := range connections {
+		conn.requestShutdown()
+	}
+
+	for _, conn := range connections {
+		select {
+		case <-conn.writeDone:
+		case <-ctx.Done():
+			slog.Warn("Subscriber did not close in time, forcing close")
+			conn.conn.Close()
 		}
 	}
 }
 
 func (c *wsConnection) readPump() {
 	defer func() {
-		c.scribe.unregisterSubscriber(c.clientID, c)
-		c.conn.Close()
+		for _, clientID := range c.subscribedClients() {
+			c.scribe.unregisterSubscriber(clientID, c)
+		}
+		c.scribe.connections.Delete(c)
+		close(c.readDone)
+		c.requestShutdown()
 	}()
 
-	c.conn.SetReadLimit(512)
+	c.conn.SetReadLimit(maxCommandSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -272,12 +598,17 @@ func (c *wsConnection) readPump() {
 	})
 
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				slog.Error("WebSocket read error", "error", err)
 			}
 			break
 		}
+
+		if p := c.scribe.config.Pseudonyms; p != nil {
+			data = []byte(p.Unmask(string(data)))
+		}
+		c.handleCommand(data)
 	}
 }
@@ -0,0 +1,363 @@
+package scribe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+)
+
+const (
+	// File in the recordings directory the files taken from the inbox are
+	// listed in
+	inboxFile = "inbox.json"
+
+	// How often the inbox is scanned
+	inboxPoll = 5 * time.Second
+
+	// How long a file must stay unchanged before it is taken when
+	// InboxConfig leaves Settle zero
+	defaultInboxSettle = 10 * time.Second
+
+	// Client of files dropped without a name
+	defaultInboxName = "inbox"
+)
+
+// Extensions taken from the inbox beside those of uploads, all of them
+// decoded by ffmpeg, such as the recordings of phones
+var inboxExtensions = map[string]bool{
+	".m4a":  true,
+	".aac":  true,
+	".opus": true,
+	".amr":  true,
+	".3gp":  true,
+	".webm": true,
+}
+
+// Suffixes of files sync tools and browsers are still writing
+var inboxPartialSuffixes = []string{".tmp", ".part", ".partial", ".crdownload", ".download", ".filepart"}
+
+// Clients of names in the inbox that are not client IDs are derived from
+// the name in this namespace, so a name always maps to the same client
+var inboxNamespace = uuid.MustParse("6f0c3a52-8d1e-4b7f-9a45-2c1d7e9b0f63")
+
+// InboxConfig has the scribe transcribe audio files dropped into a
+// directory by scp, Syncthing, a phone's sync app or the like. A file
+// belongs to the client named by the subdirectory it is in, or else by
+// its name up to the first underscore, e.g. kitchen_0915.m4a, and to a
+// client named "inbox" without either. Names that are not client IDs are
+// looked up in Clients, then turned into a client ID of their own.
+type InboxConfig struct {
+	// Directory watched, off when empty
+	Dir string
+
+	// Client IDs of names
+	Clients map[string]string
+
+	// How long a file must stay unchanged before it is taken, defaults to
+	// 10 seconds
+	Settle time.Duration
+
+	// Delete files once they are queued. Otherwise they stay, listed in
+	// inbox.json in the recordings directory so they are taken once, and
+	// taken again when they change.
+	Remove bool
+}
+
+func (c InboxConfig) withDefaults() InboxConfig {
+	if c.Settle <= 0 {
+		c.Settle = defaultInboxSettle
+	}
+	return c
+}
+
+func (c InboxConfig) validate() error {
+	for name, clientID := range c.Clients {
+		if _, err := uuid.Parse(clientID); err != nil || name == "" {
+			return fmt.Errorf("invalid inbox client %q=%q, expected a name and a client ID", name, clientID)
+		}
+	}
+	return nil
+}
+
+// inboxEntry is a file taken from the inbox
+type inboxEntry struct {
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	ClientID string    `json:"clientId"`
+
+	// Whisper copy queued, or why the file could not be converted
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// inboxPending is a file seen in the inbox that is not taken yet
+type inboxPending struct {
+	size     int64
+	modified time.Time
+	since    time.Time
+}
+
+// inbox tracks the files of the inbox directory
+type inbox struct {
+	config InboxConfig
+	path   string
+
+	mu      sync.Mutex
+	taken   map[string]inboxEntry
+	pending map[string]inboxPending
+}
+
+// loadInbox reads the list of files taken from the inbox
+func loadInbox(recordingsDir string, config InboxConfig) (*inbox, error) {
+	b := &inbox{
+		config:  config,
+		path:    filepath.Join(recordingsDir, inboxFile),
+		taken:   make(map[string]inboxEntry),
+		pending: make(map[string]inboxPending),
+	}
+	data, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inbox: %w", err)
+	}
+	if err := json.Unmarshal(data, &b.taken); err != nil {
+		return nil, fmt.Errorf("failed to parse inbox: %w", err)
+	}
+	return b, nil
+}
+
+// forget drops the files no longer in the inbox, reporting whether one of
+// them was taken
+func (b *inbox) forget(present map[string]bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name := range b.pending {
+		if !present[name] {
+			delete(b.pending, name)
+		}
+	}
+	if len(b.taken) == 0 {
+		return false
+	}
+	taken := make(map[string]inboxEntry, len(b.taken))
+	for name, entry := range b.taken {
+		if present[name] {
+			taken[name] = entry
+		}
+	}
+	forgot := len(taken) < len(b.taken)
+	b.taken = taken
+	return forgot
+}
+
+// save writes the list of files taken
+func (b *inbox) save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := json.Marshal(b.taken)
+	if err != nil {
+		return fmt.Errorf("failed to marshal inbox: %w", err)
+	}
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write inbox: %w", err)
+	}
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write inbox: %w", err)
+	}
+	return nil
+}
+
+// clientOf finds the client a file of the inbox belongs to by its path
+// relative to the inbox
+func (b *inbox) clientOf(name string) string {
+	owner := defaultInboxName
+	if dir, _, ok := strings.Cut(filepath.ToSlash(name), "/"); ok {
+		owner = dir
+	} else if prefix, _, ok := strings.Cut(filepath.Base(name), "_"); ok && prefix != "" {
+		owner = prefix
+	}
+	if id, err := uuid.Parse(owner); err == nil {
+		return id.String()
+	}
+	if clientID, ok := b.config.Clients[owner]; ok {
+		return clientID
+	}
+	return uuid.NewSHA1(inboxNamespace, []byte(owner)).String()
+}
+
+// ready reports whether a file is complete: unchanged for the settle time
+// and not taken in this state before
+func (b *inbox) ready(name string, info fs.FileInfo) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if entry, ok := b.taken[name]; ok && entry.Size == info.Size() && entry.Modified.Equal(info.ModTime()) {
+		return false
+	}
+	pending, ok := b.pending[name]
+	if !ok || pending.size != info.Size() || !pending.modified.Equal(info.ModTime()) {
+		b.pending[name] = inboxPending{size: info.Size(), modified: info.ModTime(), since: time.Now()}
+		return false
+	}
+	return time.Since(pending.since) >= b.config.Settle
+}
+
+// take records a file as taken
+func (b *inbox) take(name string, entry inboxEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, name)
+	b.taken[name] = entry
+}
+
+// erase deletes the files of a client taken from the inbox, those last
+// modified on the days inRange accepts, returning how many were deleted.
+// A file that cannot be deleted stays listed, so it is not taken again.
+func (b *inbox) erase(clientID string, inRange func(day string) bool) (int, []string) {
+	b.mu.Lock()
+	erased := 0
+	var failed []string
+	for name, entry := range b.taken {
+		if entry.ClientID != clientID || !inRange(entry.Modified.Format("20060102")) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.config.Dir, name)); err != nil && !os.IsNotExist(err) {
+			failed = append(failed, err.Error())
+			continue
+		}
+		delete(b.taken, name)
+		erased++
+	}
+	b.mu.Unlock()
+
+	if erased > 0 {
+		if err := b.save(); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	return erased, failed
+}
+
+// runInbox takes the audio files dropped into the inbox until ctx ends
+func (s *Scribe) runInbox(ctx context.Context) {
+	if err := os.MkdirAll(s.config.Inbox.Dir, 0755); err != nil {
+		slog.Error("Failed to create inbox", "error", err, "path", s.config.Inbox.Dir)
+		return
+	}
+	slog.Info("Watching inbox", "path", s.config.Inbox.Dir)
+
+	ticker := time.NewTicker(inboxPoll)
+	defer ticker.Stop()
+	for {
+		s.scanInbox(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanInbox takes the files of the inbox that are complete
+func (s *Scribe) scanInbox(ctx context.Context) {
+	root := s.config.Inbox.Dir
+	present := make(map[string]bool)
+	changed := false
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || ctx.Err() != nil {
+			return nil
+		}
+		// Sync tools keep their state and partial files in hidden entries
+		if strings.HasPrefix(d.Name(), ".") && path != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		lower := strings.ToLower(name)
+		for _, suffix := range inboxPartialSuffixes {
+			if strings.HasSuffix(lower, suffix) {
+				return nil
+			}
+		}
+		needsFFmpeg, ok := uploadExtensions[filepath.Ext(lower)]
+		if !ok {
+			needsFFmpeg, ok = inboxExtensions[filepath.Ext(lower)]
+		}
+		if !ok || (needsFFmpeg && !audio.FFmpegAvailable()) {
+			return nil
+		}
+		present[name] = true
+		info, err := d.Info()
+		if err != nil || !s.inbox.ready(name, info) {
+			return nil
+		}
+
+		s.takeFromInbox(ctx, path, name, info)
+		changed = true
+		return nil
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if s.inbox.forget(present) || changed {
+		if err := s.inbox.save(); err != nil {
+			slog.Error("Failed to save inbox", "error", err)
+		}
+	}
+}
+
+// takeFromInbox converts a file of the inbox for whisper into today's
+// directory of its client and queues it, waiting for room in a full queue
+func (s *Scribe) takeFromInbox(ctx context.Context, path, name string, info fs.FileInfo) {
+	clientID := s.inbox.clientOf(name)
+	entry := inboxEntry{Size: info.Size(), Modified: info.ModTime(), ClientID: clientID}
+
+	file, err := os.Open(path)
+	if err == nil {
+		var stored string
+		stored, err = s.storeUpload(clientID, file, strings.ToLower(filepath.Ext(path)))
+		file.Close()
+		entry.File = filepath.Base(stored)
+		if err == nil {
+			s.clients.LoadOrStore(clientID, &ClientTranscriptions{
+				Messages: make([]TranscriptionMessage, 0),
+			})
+			s.queueAudioFile(ctx, clientID, stored)
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to take file from inbox", "error", err, "file", name, "clientID", clientID)
+		entry.File, entry.Error = "", err.Error()
+		s.inbox.take(name, entry)
+		return
+	}
+
+	slog.Info("Took file from inbox", "file", name, "clientID", clientID, "queued", entry.File)
+	s.inbox.take(name, entry)
+	if s.config.Inbox.Remove {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("Failed to remove file from inbox", "error", err, "file", name)
+		}
+	}
+}
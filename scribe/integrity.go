@@ -0,0 +1,65 @@
+package scribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bosley/libas/audio"
+)
+
+// handleIntegrity re-hashes stored recordings against their day manifests
+// and reports corrupted or missing files. The optional "date" query parameter
+// (YYYYMMDD) limits the check to one day, otherwise every day is verified.
+func (s *Scribe) handleIntegrity(w http.ResponseWriter, r *http.Request) {
+	var days []string
+	if date := r.URL.Query().Get("date"); date != "" {
+		if _, err := time.Parse("20060102", date); err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
+		}
+		days = []string{date}
+	} else {
+		manifests, err := filepath.Glob(filepath.Join(s.config.RecordingsDir, "*", audio.ManifestFile))
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for _, manifest := range manifests {
+			days = append(days, filepath.Base(filepath.Dir(manifest)))
+		}
+		sort.Strings(days)
+	}
+
+	reports := make([]*audio.VerifyReport, 0, len(days))
+	for _, day := range days {
+		dayDir := filepath.Join(s.config.RecordingsDir, day)
+		if _, err := os.Stat(dayDir); err != nil {
+			http.Error(w, "Day not found", http.StatusNotFound)
+			return
+		}
+
+		report, err := audio.VerifyManifest(dayDir)
+		if err != nil {
+			slog.Error("Failed to verify manifest", "day", day, "error", err)
+			http.Error(w, "Failed to verify recordings", http.StatusInternalServerError)
+			return
+		}
+		if !report.OK() {
+			slog.Warn("Recording integrity check failed",
+				"day", day,
+				"corrupted", len(report.Corrupted),
+				"missing", len(report.Missing))
+		}
+		reports = append(reports, report)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reports); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
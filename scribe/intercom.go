@@ -0,0 +1,124 @@
+package scribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Intercom routes the live audio of one audio client to another, as the
+// audio server does
+type Intercom interface {
+	// Route sends what from transmits to to, replacing the route of from
+	Route(from, to string) error
+
+	// Unroute stops sending what from transmits anywhere
+	Unroute(from string)
+
+	// Routes lists the current routes
+	Routes() []IntercomRoute
+}
+
+// IntercomRoute sends the audio of one client to another
+type IntercomRoute struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// intercomRequest is the body of POST /api/intercom
+type intercomRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Also route the audio of To to From
+	TwoWay bool `json:"twoWay"`
+}
+
+// HandleIntercom routes audio between clients for /api/intercom, e.g. the
+// audio server. Without it no audio can be routed. Call it before starting
+// the scribe.
+func (s *Scribe) HandleIntercom(intercom Intercom) {
+	s.intercom = intercom
+}
+
+// handleListRoutes lists where the audio of clients goes
+func (s *Scribe) handleListRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := make([]IntercomRoute, 0)
+	if s.intercom != nil {
+		routes = append(routes, s.intercom.Routes()...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(routes); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// handleRoute bridges the microphone of one client to the speaker of
+// another, and back when "twoWay" is set
+func (s *Scribe) handleRoute(w http.ResponseWriter, r *http.Request) {
+	var req intercomRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, clientID := range []string{req.From, req.To} {
+		if _, err := uuid.Parse(clientID); err != nil {
+			http.Error(w, "Invalid client ID", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.From == req.To {
+		http.Error(w, "Cannot route a client to itself", http.StatusBadRequest)
+		return
+	}
+	if s.intercom == nil {
+		http.Error(w, "No audio server to route audio", http.StatusServiceUnavailable)
+		return
+	}
+	for _, clientID := range []string{req.From, req.To} {
+		if _, ok := s.presence.Load(clientID); !ok {
+			http.Error(w, "Client is not connected", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := s.intercom.Route(req.From, req.To); err != nil {
+		http.Error(w, "Failed to route audio: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if req.TwoWay {
+		if err := s.intercom.Route(req.To, req.From); err != nil {
+			s.intercom.Unroute(req.From)
+			http.Error(w, "Failed to route audio: "+err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	slog.Info("Bridged clients", "from", req.From, "to", req.To, "twoWay", req.TwoWay)
+
+	s.handleListRoutes(w, r)
+}
+
+// handleUnroute stops routing the audio of a client and any audio routed to
+// it
+func (s *Scribe) handleUnroute(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+	if s.intercom == nil {
+		http.Error(w, "No audio server to route audio", http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, route := range s.intercom.Routes() {
+		if route.From == clientID || route.To == clientID {
+			s.intercom.Unroute(route.From)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
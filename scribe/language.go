@@ -0,0 +1,76 @@
+package scribe
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// LanguageConfig pins the languages clients are expected to speak. Whisper
+// detects the language of their recordings, and transcriptions in any
+// other are flagged, or left out with Skip, as whisper makes up text in a
+// random language from music, noise and other non-speech audio.
+type LanguageConfig struct {
+	// Languages expected from every client as whisper names them, e.g.
+	// en or de. Empty allows any and leaves whisper to assume its default.
+	Allow []string
+
+	// Languages of single clients by ID or the host they connect from,
+	// overriding Allow. An empty list allows any.
+	ClientAllow map[string][]string
+
+	// Leave transcriptions in other languages out instead of storing them
+	// flagged
+	Skip bool
+}
+
+func (c LanguageConfig) validate() error {
+	lists := [][]string{c.Allow}
+	for _, languages := range c.ClientAllow {
+		lists = append(lists, languages)
+	}
+	for _, languages := range lists {
+		for _, language := range languages {
+			if language == "" || language == "auto" || strings.ToLower(language) != language {
+				return fmt.Errorf("invalid language %q, expected a lower case code such as en", language)
+			}
+		}
+	}
+	return nil
+}
+
+// LanguageDetector is a Transcriber that can detect the language spoken
+// instead of assuming one, reporting it as Segment.Language
+type LanguageDetector interface {
+	DetectingLanguage() Transcriber
+}
+
+// allowedLanguages finds the languages expected from a client by ID, then
+// by host, falling back to those of every client
+func (s *Scribe) allowedLanguages(clientID string) []string {
+	if languages, ok := s.config.Languages.ClientAllow[clientID]; ok {
+		return languages
+	}
+	if host, ok := s.hosts.Load(clientID); ok {
+		if languages, ok := s.config.Languages.ClientAllow[host.(string)]; ok {
+			return languages
+		}
+	}
+	return s.config.Languages.Allow
+}
+
+// withLanguageDetection has a transcriber detect the language of clients
+// with expected languages when it can
+func (s *Scribe) withLanguageDetection(transcriber Transcriber, clientID string) Transcriber {
+	if detector, ok := transcriber.(LanguageDetector); ok && len(s.allowedLanguages(clientID)) > 0 {
+		return detector.DetectingLanguage()
+	}
+	return transcriber
+}
+
+// unexpectedLanguage reports whether a transcription in language is not
+// one the client is expected to speak. Unknown languages are not.
+func (s *Scribe) unexpectedLanguage(clientID, language string) bool {
+	allowed := s.allowedLanguages(clientID)
+	return language != "" && len(allowed) > 0 && !slices.Contains(allowed, language)
+}
@@ -0,0 +1,28 @@
+package scribe
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bosley/libas/latency"
+)
+
+// LatencyReport holds the latency histograms of each client by stage
+type LatencyReport struct {
+	Clients map[string]map[latency.Stage]latency.Summary `json:"clients"`
+}
+
+// handleLatency reports per client how long recordings spent in each stage
+// on their way to subscribers
+func (s *Scribe) handleLatency(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+	clients := s.config.Latency.Snapshot()
+	for clientID := range clients {
+		if !s.canView(u, clientID) {
+			delete(clients, clientID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LatencyReport{Clients: clients})
+}
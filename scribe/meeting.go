@@ -0,0 +1,837 @@
+package scribe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// File in the recordings directory meetings are kept in
+	meetingsFile = "meetings.json"
+
+	// Chapters of a meeting when MeetingConfig leaves them zero
+	defaultChapterGap    = 2 * time.Minute
+	defaultChapterLength = 10 * time.Minute
+
+	// Time given the last transmissions of a meeting to arrive once it
+	// ended, and the longest wait for them to be transcribed
+	meetingSettle            = 30 * time.Second
+	meetingTranscribeTimeout = 30 * time.Minute
+
+	// Pause between words after which they are printed as another turn
+	meetingTurnGap = time.Second
+
+	// Shortest turn a voice print is computed of, shorter ones keep the
+	// speaker of the turn before
+	minDiarizedTurn = 1500 * time.Millisecond
+
+	// Longest the action items command may run
+	actionItemsTimeout = 2 * time.Minute
+
+	// Longest meeting title accepted
+	maxMeetingTitle = 200
+
+	// Words of a chapter's first turn it is titled with
+	chapterTitleWords = 8
+
+	// Status of a meeting
+	meetingRecording  = "recording"
+	meetingProcessing = "processing"
+	meetingDone       = "done"
+	meetingFailed     = "failed"
+)
+
+// MeetingConfig shapes the transcripts of meetings started through
+// /api/meetings. Zero uses the default of a setting.
+type MeetingConfig struct {
+	// Command, split on spaces, that reads a meeting's transcript on stdin
+	// and prints its action items one per line, e.g. an LLM command line
+	// tool. None are listed when empty.
+	ActionItemsCommand string
+
+	// Pause after which a new chapter starts, defaults to 2 minutes
+	ChapterGap time.Duration
+
+	// Length after which a chapter ends at the next change of speaker,
+	// defaults to 10 minutes
+	ChapterLength time.Duration
+}
+
+// ContinuousRecorder has audio clients transmit continuously instead of
+// only when they hear speech, as the audio server does
+type ContinuousRecorder interface {
+	RecordContinuously(clientID string, on bool) error
+}
+
+// Meeting is a stretch of time the audio of some clients is recorded
+// continuously, transcribed into chapters once it ends
+type Meeting struct {
+	ID    string `json:"id"`
+	Title string `json:"title,omitempty"`
+
+	// Clients recorded, by ID or the host they connect from
+	Clients []string `json:"clients"`
+
+	// End is unset while the meeting is recording
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+
+	// recording, processing (waiting for transcriptions), done or failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Set once the meeting is done
+	Transcript *MeetingTranscript `json:"transcript,omitempty"`
+}
+
+// MeetingTranscript is what was said in a meeting, who said it and what is
+// to be done about it
+type MeetingTranscript struct {
+	Chapters []MeetingChapter `json:"chapters"`
+
+	// Talk time of each speaker, the most talkative first
+	Speakers []MeetingSpeaker `json:"speakers"`
+
+	// Printed by the action items command, empty without one
+	ActionItems []string `json:"actionItems"`
+
+	// Whether speakers were told apart by voice prints, otherwise turns
+	// are whole transcriptions of an enrolled speaker or a client
+	Diarized bool `json:"diarized"`
+}
+
+// MeetingChapter is a part of a meeting, separated from the others by a
+// pause or by its length
+type MeetingChapter struct {
+	// The chapter's first words
+	Title string        `json:"title"`
+	Start time.Time     `json:"start"`
+	End   time.Time     `json:"end"`
+	Turns []MeetingTurn `json:"turns"`
+}
+
+// MeetingTurn is what one speaker said without interruption
+type MeetingTurn struct {
+	// Enrolled speaker, or "Speaker N" for voices or clients told apart
+	Speaker string `json:"speaker"`
+
+	ClientID string    `json:"clientId"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Text     string    `json:"text"`
+
+	// Transcription the turn is taken from
+	Sequence uint64 `json:"sequence"`
+}
+
+// MeetingSpeaker sums up how much someone spoke in a meeting
+type MeetingSpeaker struct {
+	Speaker    string `json:"speaker"`
+	TalkTimeMs int64  `json:"talkTimeMs"`
+	Words      int    `json:"words"`
+	Turns      int    `json:"turns"`
+
+	// Share of the meeting's talk time, 0 to 1
+	Share float64 `json:"share"`
+}
+
+// startMeetingRequest is the body of POST /api/meetings
+type startMeetingRequest struct {
+	Title   string   `json:"title"`
+	Clients []string `json:"clients"`
+}
+
+// meetings holds the meetings, persisted as they change
+type meetings struct {
+	path string
+
+	mu       sync.Mutex
+	meetings map[string]*Meeting
+}
+
+// loadMeetings reads the meetings
+func loadMeetings(recordingsDir string) (*meetings, error) {
+	m := &meetings{
+		path:     filepath.Join(recordingsDir, meetingsFile),
+		meetings: make(map[string]*Meeting),
+	}
+	data, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meetings: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.meetings); err != nil {
+		return nil, fmt.Errorf("failed to parse meetings: %w", err)
+	}
+	return m, nil
+}
+
+// update applies fn to the meetings and persists them, keeping them as
+// they were when that fails
+func (m *meetings) update(fn func(meetings map[string]*Meeting) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	updated := make(map[string]*Meeting, len(m.meetings)+1)
+	for id, meeting := range m.meetings {
+		copied := *meeting
+		updated[id] = &copied
+	}
+	if err := fn(updated); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return fmt.Errorf("failed to marshal meetings: %w", err)
+	}
+	tmpPath := m.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write meetings: %w", err)
+	}
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write meetings: %w", err)
+	}
+	m.meetings = updated
+	return nil
+}
+
+// get returns a copy of a meeting
+func (m *meetings) get(id string) (Meeting, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meeting, ok := m.meetings[id]
+	if !ok {
+		return Meeting{}, false
+	}
+	return *meeting, true
+}
+
+// list returns copies of the meetings, the latest first
+func (m *meetings) list() []Meeting {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Meeting, 0, len(m.meetings))
+	for _, meeting := range m.meetings {
+		list = append(list, *meeting)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.After(list[j].Start) })
+	return list
+}
+
+// erase removes a client's turns from the transcripts of meetings, those
+// said on the days inRange accepts, returning how many were removed
+func (m *meetings) erase(clientID string, inRange func(day string) bool) (int, error) {
+	erased := 0
+	err := m.update(func(meetings map[string]*Meeting) error {
+		for _, meeting := range meetings {
+			if meeting.Transcript == nil {
+				continue
+			}
+			transcript := *meeting.Transcript
+			var turns []MeetingTurn
+			chapters := make([]MeetingChapter, 0, len(transcript.Chapters))
+			for _, chapter := range transcript.Chapters {
+				kept := make([]MeetingTurn, 0, len(chapter.Turns))
+				for _, turn := range chapter.Turns {
+					if turn.ClientID == clientID && inRange(turn.Start.Format("20060102")) {
+						erased++
+						continue
+					}
+					kept = append(kept, turn)
+				}
+				if len(kept) > 0 {
+					chapter.Turns = kept
+					chapters = append(chapters, chapter)
+					turns = append(turns, kept...)
+				}
+			}
+			transcript.Chapters = chapters
+			transcript.Speakers = speakerStats(turns)
+			meeting.Transcript = &transcript
+		}
+		return nil
+	})
+	return erased, err
+}
+
+// HandleContinuous has audio clients record continuously during meetings,
+// e.g. through the audio server. Without it meetings only hold what the
+// clients' voice detection passes. Call it before starting the scribe.
+func (s *Scribe) HandleContinuous(recorder ContinuousRecorder) {
+	s.recorder = recorder
+}
+
+// resumeMeetings finishes the meetings a restart interrupted processing
+func (s *Scribe) resumeMeetings(ctx context.Context) {
+	for _, meeting := range s.meetings.list() {
+		if meeting.Status == meetingProcessing {
+			go s.finishMeeting(ctx, meeting.ID)
+		}
+	}
+}
+
+// inMeeting reports whether a client is recorded by a running meeting
+func (s *Scribe) inMeeting(clientID string) bool {
+	for _, meeting := range s.meetings.list() {
+		if meeting.Status == meetingRecording && s.selects(clientSet(meeting.Clients), clientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordContinuously starts or stops continuous recording of the connected
+// clients a meeting selects
+func (s *Scribe) recordContinuously(meeting Meeting, on bool) {
+	if s.recorder == nil {
+		return
+	}
+	clients := clientSet(meeting.Clients)
+	s.presence.Range(func(key, _ any) bool {
+		clientID := key.(string)
+		if !s.selects(clients, clientID) || (!on && s.inMeeting(clientID)) {
+			return true
+		}
+		if err := s.recorder.RecordContinuously(clientID, on); err != nil {
+			slog.Warn("Failed to change continuous recording", "error", err, "clientID", clientID, "meeting", meeting.ID)
+		}
+		return true
+	})
+}
+
+// clientSet turns a list of client IDs and hosts into a set for selects
+func clientSet(clients []string) map[string]bool {
+	set := make(map[string]bool, len(clients))
+	for _, client := range clients {
+		set[client] = true
+	}
+	return set
+}
+
+// handleListMeetings lists the meetings without their transcripts, the
+// latest first
+func (s *Scribe) handleListMeetings(w http.ResponseWriter, r *http.Request) {
+	list := s.meetings.list()
+	for i := range list {
+		list[i].Transcript = nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// handleStartMeeting starts recording the clients of a meeting
+// continuously
+func (s *Scribe) handleStartMeeting(w http.ResponseWriter, r *http.Request) {
+	var req startMeetingRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if len(req.Title) > maxMeetingTitle {
+		http.Error(w, "Title too long", http.StatusBadRequest)
+		return
+	}
+	var clients []string
+	for _, client := range req.Clients {
+		if client = strings.TrimSpace(client); client != "" {
+			clients = append(clients, client)
+		}
+	}
+	if len(clients) == 0 {
+		http.Error(w, "A meeting needs clients", http.StatusBadRequest)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	meeting := Meeting{
+		ID:      hex.EncodeToString(id),
+		Title:   req.Title,
+		Clients: clients,
+		Start:   time.Now(),
+		Status:  meetingRecording,
+	}
+	err := s.meetings.update(func(meetings map[string]*Meeting) error {
+		for _, other := range meetings {
+			if other.Status != meetingRecording {
+				continue
+			}
+			for _, client := range other.Clients {
+				if clientSet(clients)[client] {
+					return errClientInMeeting
+				}
+			}
+		}
+		meetings[meeting.ID] = &meeting
+		return nil
+	})
+	if errors.Is(err, errClientInMeeting) {
+		http.Error(w, "A client is already in a meeting", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to start meeting", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.recordContinuously(meeting, true)
+
+	slog.Info("Started meeting", "meeting", meeting.ID, "title", meeting.Title, "clients", clients)
+	w.Header().Set("Location", "/api/meetings/"+meeting.ID)
+	writeMeeting(w, http.StatusCreated, meeting)
+}
+
+// errClientInMeeting is returned for a meeting sharing a client with one
+// that is recording
+var errClientInMeeting = fmt.Errorf("client is already in a meeting")
+
+// handleGetMeeting returns a meeting with its transcript once it is done
+func (s *Scribe) handleGetMeeting(w http.ResponseWriter, r *http.Request) {
+	meeting, ok := s.meetings.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Meeting not found", http.StatusNotFound)
+		return
+	}
+	writeMeeting(w, http.StatusOK, meeting)
+}
+
+// handleEndMeeting stops recording a meeting and transcribes it in the
+// background
+func (s *Scribe) handleEndMeeting(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var meeting Meeting
+	err := s.meetings.update(func(meetings map[string]*Meeting) error {
+		m, ok := meetings[id]
+		if !ok {
+			return os.ErrNotExist
+		}
+		if m.Status != meetingRecording {
+			return errMeetingEnded
+		}
+		end := time.Now()
+		m.End = &end
+		m.Status = meetingProcessing
+		meeting = *m
+		return nil
+	})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "Meeting not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errMeetingEnded):
+		http.Error(w, "Meeting already ended", http.StatusConflict)
+		return
+	case err != nil:
+		slog.Error("Failed to end meeting", "error", err, "meeting", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.recordContinuously(meeting, false)
+
+	slog.Info("Ended meeting", "meeting", id, "duration", meeting.End.Sub(meeting.Start).Round(time.Second))
+	go s.finishMeeting(s.ctx, id)
+	writeMeeting(w, http.StatusAccepted, meeting)
+}
+
+// errMeetingEnded is returned for a meeting ended twice
+var errMeetingEnded = fmt.Errorf("meeting already ended")
+
+func writeMeeting(w http.ResponseWriter, status int, meeting Meeting) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(meeting); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// finishMeeting waits for the transcriptions of an ended meeting and
+// builds its transcript
+func (s *Scribe) finishMeeting(ctx context.Context, id string) {
+	meeting, ok := s.meetings.get(id)
+	if !ok {
+		return
+	}
+	s.awaitMeeting(ctx, meeting)
+	if ctx.Err() != nil {
+		// Left processing, the next start resumes it
+		return
+	}
+
+	transcript, err := s.transcribeMeeting(ctx, meeting)
+	err = s.meetings.update(func(meetings map[string]*Meeting) error {
+		m, ok := meetings[id]
+		if !ok {
+			return nil
+		}
+		if err != nil {
+			m.Status, m.Error = meetingFailed, err.Error()
+			return nil
+		}
+		m.Status, m.Transcript = meetingDone, transcript
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save meeting", "error", err, "meeting", id)
+		return
+	}
+	slog.Info("Transcribed meeting", "meeting", id)
+}
+
+// awaitMeeting waits until the recordings of a meeting's clients are
+// transcribed, giving the last ones time to arrive
+func (s *Scribe) awaitMeeting(ctx context.Context, meeting Meeting) {
+	if wait := time.Until(meeting.End.Add(meetingSettle)); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+
+	clients := clientSet(meeting.Clients)
+	deadline := time.Now().Add(meetingTranscribeTimeout)
+	for time.Now().Before(deadline) {
+		pending := false
+		s.queued.Range(func(key, _ any) bool {
+			clientID := filepath.Base(filepath.Dir(key.(string)))
+			pending = s.selects(clients, clientID)
+			return !pending
+		})
+		if !pending {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	slog.Warn("Meeting recordings still waiting for transcription, leaving them out", "meeting", meeting.ID)
+}
+
+// transcribeMeeting builds the chaptered transcript of an ended meeting
+// from its clients' transcriptions
+func (s *Scribe) transcribeMeeting(ctx context.Context, meeting Meeting) (*MeetingTranscript, error) {
+	clients := clientSet(meeting.Clients)
+	var records []StoredTranscription
+	err := s.store.from(meeting.Start, func(record StoredTranscription) bool {
+		msg := record.Message
+		start := msg.Timestamp.Add(-time.Duration(msg.DurationMs) * time.Millisecond)
+		if msg.Text != "" && msg.Timestamp.After(meeting.Start) && start.Before(*meeting.End) && s.selects(clients, record.ClientID) {
+			records = append(records, record)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Message.Timestamp.Before(records[j].Message.Timestamp)
+	})
+
+	d := newDiarizer(s)
+	var turns []MeetingTurn
+	for _, record := range records {
+		turns = append(turns, d.turns(ctx, record)...)
+	}
+	sort.SliceStable(turns, func(i, j int) bool { return turns[i].Start.Before(turns[j].Start) })
+
+	transcript := &MeetingTranscript{
+		Chapters:    s.chapters(turns),
+		Speakers:    speakerStats(turns),
+		ActionItems: []string{},
+		Diarized:    d.printer != nil,
+	}
+	if command := strings.TrimSpace(s.config.Meetings.ActionItemsCommand); command != "" && len(turns) > 0 {
+		transcript.ActionItems = actionItems(ctx, command, meeting, turns)
+	}
+	return transcript, nil
+}
+
+// diarizer tells the speakers of a meeting apart, naming enrolled speakers
+// and numbering the other voices, or clients without voice prints
+type diarizer struct {
+	s       *Scribe
+	printer VoicePrinter
+
+	// Voice prints of the unknown voices, summed, and the labels of
+	// clients without voice prints
+	voices  []unknownVoice
+	clients map[string]string
+	labels  int
+}
+
+type unknownVoice struct {
+	label string
+	sum   []float64
+}
+
+func newDiarizer(s *Scribe) *diarizer {
+	return &diarizer{s: s, printer: s.config.Speakers.Printer, clients: make(map[string]string)}
+}
+
+// label numbers the next unknown speaker
+func (d *diarizer) label() string {
+	d.labels++
+	return fmt.Sprintf("Speaker %d", d.labels)
+}
+
+// turns splits a transcription into the turns of its speakers, at pauses
+// between its words. Without voice prints or word times it is one turn.
+func (d *diarizer) turns(ctx context.Context, record StoredTranscription) []MeetingTurn {
+	msg := record.Message
+	start := msg.Timestamp.Add(-time.Duration(msg.DurationMs) * time.Millisecond)
+	whole := MeetingTurn{
+		Speaker:  msg.Speaker,
+		ClientID: record.ClientID,
+		Start:    start,
+		End:      msg.Timestamp,
+		Text:     msg.Text,
+		Sequence: msg.Sequence,
+	}
+	if d.printer == nil || msg.AudioDiscarded || len(msg.Words) == 0 {
+		return []MeetingTurn{d.byClient(whole)}
+	}
+
+	path, ok := d.s.findAudioFile(record.ClientID, msg.AudioFile, start.Format("20060102"))
+	if !ok {
+		path, ok = d.s.findAudioFile(record.ClientID, strings.TrimSuffix(msg.AudioFile, ".wav")+".flac", "")
+	}
+	if !ok {
+		path, ok = d.s.findAudioFile(record.ClientID, msg.AudioFile, "")
+	}
+	if !ok {
+		return []MeetingTurn{d.byClient(whole)}
+	}
+	pcm, err := audio.ReadAudioLimit(path, maxDecodedSamples)
+	if err != nil {
+		slog.Warn("Failed to read meeting recording", "error", err, "file", msg.AudioFile, "clientID", record.ClientID)
+		return []MeetingTurn{d.byClient(whole)}
+	}
+
+	var turns []MeetingTurn
+	var words []string
+	var first, last Word
+	flush := func() {
+		if len(words) == 0 {
+			return
+		}
+		from := time.Duration(first.StartMs) * time.Millisecond
+		to := time.Duration(last.EndMs) * time.Millisecond
+		speaker := ""
+		if to-from >= minDiarizedTurn {
+			speaker = d.identify(ctx, pcm, from, to)
+		}
+		if speaker == "" && len(turns) > 0 {
+			speaker = turns[len(turns)-1].Speaker
+		}
+		if speaker == "" {
+			speaker = d.byClient(whole).Speaker
+		}
+		text := strings.Join(words, " ")
+		if n := len(turns); n > 0 && turns[n-1].Speaker == speaker {
+			turns[n-1].End = start.Add(to)
+			turns[n-1].Text += " " + text
+		} else {
+			turns = append(turns, MeetingTurn{
+				Speaker:  speaker,
+				ClientID: record.ClientID,
+				Start:    start.Add(from),
+				End:      start.Add(to),
+				Text:     text,
+				Sequence: msg.Sequence,
+			})
+		}
+		words = nil
+	}
+	for _, word := range msg.Words {
+		if len(words) > 0 && time.Duration(word.StartMs-last.EndMs)*time.Millisecond >= meetingTurnGap {
+			flush()
+		}
+		if len(words) == 0 {
+			first = word
+		}
+		words = append(words, strings.TrimSpace(word.Text))
+		last = word
+	}
+	flush()
+	return turns
+}
+
+// byClient names the speaker of a turn without a voice print after the
+// enrolled speaker of its transcription, or numbers them by client
+func (d *diarizer) byClient(turn MeetingTurn) MeetingTurn {
+	if turn.Speaker != "" {
+		return turn
+	}
+	if _, ok := d.clients[turn.ClientID]; !ok {
+		d.clients[turn.ClientID] = d.label()
+	}
+	turn.Speaker = d.clients[turn.ClientID]
+	return turn
+}
+
+// identify names the speaker of a stretch of a recording, an enrolled
+// speaker or an unknown voice heard before, empty when there is no voice
+// print of it
+func (d *diarizer) identify(ctx context.Context, pcm *audio.PCM, from, to time.Duration) string {
+	clip, err := cutClip(pcm, from, to)
+	if err != nil {
+		return ""
+	}
+	defer os.Remove(clip)
+	print, err := d.printer.VoicePrint(ctx, clip)
+	if err != nil || print == nil {
+		return ""
+	}
+
+	threshold := d.s.config.Speakers.Threshold
+	if threshold == 0 {
+		threshold = defaultSpeakerThreshold
+	}
+	if name, _, ok := d.s.speakers.identify(print, threshold); ok {
+		return name
+	}
+	best, bestSimilarity := -1, threshold
+	for i, voice := range d.voices {
+		if len(voice.sum) != len(print) {
+			continue
+		}
+		if similarity := cosineSimilarity(print, voice.sum); similarity >= bestSimilarity {
+			best, bestSimilarity = i, similarity
+		}
+	}
+	norm := vectorNorm(print)
+	if best < 0 {
+		d.voices = append(d.voices, unknownVoice{label: d.label(), sum: make([]float64, len(print))})
+		best = len(d.voices) - 1
+	}
+	for i, v := range print {
+		d.voices[best].sum[i] += v / norm
+	}
+	return d.voices[best].label
+}
+
+// chapters groups turns into chapters at pauses of the chapter gap, and
+// at the first change of speaker once a chapter is long enough
+func (s *Scribe) chapters(turns []MeetingTurn) []MeetingChapter {
+	gap, length := s.config.Meetings.ChapterGap, s.config.Meetings.ChapterLength
+	if gap <= 0 {
+		gap = defaultChapterGap
+	}
+	if length <= 0 {
+		length = defaultChapterLength
+	}
+
+	chapters := make([]MeetingChapter, 0)
+	for i, turn := range turns {
+		n := len(chapters)
+		if n == 0 || turn.Start.Sub(chapters[n-1].End) >= gap ||
+			(turn.Start.Sub(chapters[n-1].Start) >= length && turn.Speaker != turns[i-1].Speaker) {
+			chapters = append(chapters, MeetingChapter{Title: chapterTitle(turn.Text), Start: turn.Start})
+			n++
+		}
+		chapters[n-1].Turns = append(chapters[n-1].Turns, turn)
+		if turn.End.After(chapters[n-1].End) {
+			chapters[n-1].End = turn.End
+		}
+	}
+	return chapters
+}
+
+// chapterTitle is the first words of a chapter
+func chapterTitle(text string) string {
+	words := strings.Fields(text)
+	if len(words) <= chapterTitleWords {
+		return strings.Join(words, " ")
+	}
+	return strings.Join(words[:chapterTitleWords], " ") + "…"
+}
+
+// speakerStats sums up the turns of each speaker, the most talkative first
+func speakerStats(turns []MeetingTurn) []MeetingSpeaker {
+	index := make(map[string]int)
+	stats := make([]MeetingSpeaker, 0)
+	var total int64
+	for i, turn := range turns {
+		j, ok := index[turn.Speaker]
+		if !ok {
+			j = len(stats)
+			index[turn.Speaker] = j
+			stats = append(stats, MeetingSpeaker{Speaker: turn.Speaker})
+		}
+		talk := turn.End.Sub(turn.Start).Milliseconds()
+		stats[j].TalkTimeMs += talk
+		stats[j].Words += len(strings.Fields(turn.Text))
+		if i == 0 || turns[i-1].Speaker != turn.Speaker {
+			stats[j].Turns++
+		}
+		total += talk
+	}
+	for i := range stats {
+		if total > 0 {
+			stats[i].Share = float64(stats[i].TalkTimeMs) / float64(total)
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].TalkTimeMs > stats[j].TalkTimeMs })
+	return stats
+}
+
+// actionItems runs the action items command over a meeting's transcript,
+// returning none when it fails
+func actionItems(ctx context.Context, command string, meeting Meeting, turns []MeetingTurn) []string {
+	ctx, cancel := context.WithTimeout(ctx, actionItemsTimeout)
+	defer cancel()
+
+	var transcript strings.Builder
+	if meeting.Title != "" {
+		fmt.Fprintf(&transcript, "%s\n\n", meeting.Title)
+	}
+	for _, turn := range turns {
+		fmt.Fprintf(&transcript, "[%s] %s: %s\n", turn.Start.Local().Format("15:04:05"), turn.Speaker, turn.Text)
+	}
+
+	args := strings.Fields(command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(transcript.String())
+	output, err := cmd.Output()
+	if err != nil {
+		slog.Warn("Failed to list action items", "meeting", meeting.ID, "error", err)
+		return []string{}
+	}
+
+	items := make([]string, 0)
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*•"))
+		if line != "" {
+			items = append(items, line)
+		}
+	}
+	return items
+}
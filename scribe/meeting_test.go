@@ -0,0 +1,418 @@
+package scribe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+// fakeRecorder records the changes to continuous recording it is asked for
+type fakeRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeRecorder) RecordContinuously(clientID string, on bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("%s %v", clientID, on))
+	return nil
+}
+
+// take returns the calls since the last take, sorted
+func (f *fakeRecorder) take() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	sort.Strings(calls)
+	return calls
+}
+
+// loudPrinter tells loud voices from quiet ones by the peak of a clip
+type loudPrinter struct{}
+
+func (loudPrinter) VoicePrint(ctx context.Context, path string) ([]float64, error) {
+	pcm, err := audio.ReadWav(path)
+	if err != nil {
+		return nil, err
+	}
+	var peak int16
+	for _, sample := range pcm.Samples {
+		peak = max(peak, sample)
+	}
+	if peak > 8000 {
+		return []float64{1, 0}, nil
+	}
+	return []float64{0, 1}, nil
+}
+
+func TestMeetings(t *testing.T) {
+	const alice = "6f1c2a5e-8a5b-4c1e-9a43-0b8f6c1d2e3f"
+	const bob = "0d2c9e4b-1f3a-4b5c-8d6e-7f8091a2b3c4"
+	const carol = "5a6b7c8d-9e0f-4a1b-8c2d-3e4f5a6b7c8d"
+	s := newTestScribe(t, Config{})
+	recorder := &fakeRecorder{}
+	s.HandleContinuous(recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.ctx = ctx
+
+	s.ClientConnected(alice, "10.0.0.5:4000", time.Now())
+	s.ClientConnected(bob, "10.0.0.6:4000", time.Now())
+	s.ClientConnected(carol, "10.0.0.7:4000", time.Now())
+	if calls := recorder.take(); len(calls) != 0 {
+		t.Errorf("recorded continuously outside a meeting: %v", calls)
+	}
+
+	for _, body := range []string{
+		`not json`,
+		`{"title":"Sync"}`,
+		`{"clients":[" ", ""]}`,
+		`{"title":"` + strings.Repeat("x", maxMeetingTitle+1) + `","clients":["10.0.0.5"]}`,
+	} {
+		if w := uploadRequest(t, s, "POST", "/api/meetings", strings.NewReader(body)); w.Code != http.StatusBadRequest {
+			t.Errorf("%.40s: got %d", body, w.Code)
+		}
+	}
+
+	// Alice is selected by her host, Bob by his ID
+	w := uploadRequest(t, s, "POST", "/api/meetings", strings.NewReader(`{"title":" Weekly sync ","clients":["10.0.0.5"," ","`+bob+`"]}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	var meeting Meeting
+	if err := json.Unmarshal(w.Body.Bytes(), &meeting); err != nil {
+		t.Fatal(err)
+	}
+	if meeting.Title != "Weekly sync" || !reflect.DeepEqual(meeting.Clients, []string{"10.0.0.5", bob}) || meeting.Status != meetingRecording || meeting.End != nil {
+		t.Errorf("got %+v", meeting)
+	}
+	if w.Header().Get("Location") != "/api/meetings/"+meeting.ID {
+		t.Errorf("Location is %q", w.Header().Get("Location"))
+	}
+	if calls, want := recorder.take(), []string{bob + " true", alice + " true"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+	if !s.inMeeting(alice) || !s.inMeeting(bob) || s.inMeeting(carol) {
+		t.Error("wrong clients in the meeting")
+	}
+
+	if w := uploadRequest(t, s, "POST", "/api/meetings", strings.NewReader(`{"clients":["`+carol+`","`+bob+`"]}`)); w.Code != http.StatusConflict {
+		t.Errorf("second meeting of Bob: got %d", w.Code)
+	}
+
+	// Clients reconnecting during the meeting record continuously again
+	s.ClientConnected(alice, "10.0.0.5:4001", time.Now())
+	s.ClientConnected(carol, "10.0.0.7:4001", time.Now())
+	if calls, want := recorder.take(), []string{alice + " true"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+
+	w = uploadRequest(t, s, "GET", "/api/meetings", nil)
+	var list []Meeting
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].ID != meeting.ID {
+		t.Errorf("got %v, %v", list, err)
+	}
+	if w := uploadRequest(t, s, "GET", "/api/meetings/"+meeting.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := uploadRequest(t, s, "GET", "/api/meetings/unknown", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown meeting: got %d", w.Code)
+	}
+
+	w = uploadRequest(t, s, "POST", "/api/meetings/"+meeting.ID+"/end", nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &meeting)
+	if meeting.Status != meetingProcessing || meeting.End == nil || meeting.End.Before(meeting.Start) {
+		t.Errorf("got %+v", meeting)
+	}
+	if calls, want := recorder.take(), []string{bob + " false", alice + " false"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+	if w := uploadRequest(t, s, "POST", "/api/meetings/"+meeting.ID+"/end", nil); w.Code != http.StatusConflict {
+		t.Errorf("ended twice: got %d", w.Code)
+	}
+	if w := uploadRequest(t, s, "POST", "/api/meetings/unknown/end", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown meeting: got %d", w.Code)
+	}
+
+	// Bob is free for another meeting once this one ended
+	if w := uploadRequest(t, s, "POST", "/api/meetings", strings.NewReader(`{"clients":["`+bob+`"]}`)); w.Code != http.StatusCreated {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// Shutting down while the meeting settles leaves it processing, and
+	// the meetings persist
+	cancel()
+	s.finishMeeting(ctx, meeting.ID)
+	loaded, err := loadMeetings(s.config.RecordingsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.list()) != 2 {
+		t.Errorf("loaded %v", loaded.list())
+	}
+	if got, ok := loaded.get(meeting.ID); !ok || got.Status != meetingProcessing || got.Transcript != nil {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMeetingTranscript(t *testing.T) {
+	const alice = "6f1c2a5e-8a5b-4c1e-9a43-0b8f6c1d2e3f"
+	const bob = "0d2c9e4b-1f3a-4b5c-8d6e-7f8091a2b3c4"
+	const carol = "5a6b7c8d-9e0f-4a1b-8c2d-3e4f5a6b7c8d"
+	dir := t.TempDir()
+	script, input := filepath.Join(dir, "actions.sh"), filepath.Join(dir, "transcript.txt")
+	if err := os.WriteFile(script, []byte("cat > \"$1\"\nprintf '%s\\n' '- Send the notes' '* Book a room' '' '  • Ship it  '\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestScribe(t, Config{Meetings: MeetingConfig{ActionItemsCommand: " sh " + script + " " + input, ChapterGap: time.Minute}})
+	s.hosts.Store(alice, "10.0.0.5")
+
+	start := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	end := start.Add(5 * time.Minute)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	for _, record := range []StoredTranscription{
+		{alice, TranscriptionMessage{Text: "Too early", Timestamp: at(-time.Second), DurationMs: 2000}},
+		{alice, TranscriptionMessage{Text: "Hello everyone and welcome to the weekly sync meeting", Timestamp: at(10 * time.Second), DurationMs: 5000}},
+		{carol, TranscriptionMessage{Text: "Not in the meeting", Timestamp: at(12 * time.Second), DurationMs: 1000}},
+		{bob, TranscriptionMessage{Text: "Thanks", Speaker: "Dana", Timestamp: at(20 * time.Second), DurationMs: 2000}},
+		{alice, TranscriptionMessage{Text: "", Timestamp: at(25 * time.Second), DurationMs: 1000}},
+		{alice, TranscriptionMessage{Text: "First item", Timestamp: at(33 * time.Second), DurationMs: 3000}},
+		{bob, TranscriptionMessage{Text: "Next topic", Timestamp: at(3 * time.Minute), DurationMs: 4000}},
+		{alice, TranscriptionMessage{Text: "Too late", Timestamp: end.Add(10 * time.Second), DurationMs: 5000}},
+	} {
+		if _, err := s.store.append(record.ClientID, record.Message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const id = "0123456789abcdef0123456789abcdef"
+	meeting := Meeting{ID: id, Title: "Weekly sync", Clients: []string{"10.0.0.5", bob}, Start: start, End: &end, Status: meetingProcessing}
+	s.meetings.update(func(meetings map[string]*Meeting) error {
+		meetings[id] = &meeting
+		return nil
+	})
+	s.finishMeeting(context.Background(), id)
+
+	got, _ := s.meetings.get(id)
+	if got.Status != meetingDone || got.Transcript == nil {
+		t.Fatalf("got %+v", got)
+	}
+	transcript := got.Transcript
+	if transcript.Diarized {
+		t.Error("diarized without voice prints")
+	}
+
+	type turn struct {
+		speaker, clientID, text string
+		start, end              time.Time
+	}
+	want := [][]turn{
+		{
+			{"Speaker 1", alice, "Hello everyone and welcome to the weekly sync meeting", at(5 * time.Second), at(10 * time.Second)},
+			{"Dana", bob, "Thanks", at(18 * time.Second), at(20 * time.Second)},
+			{"Speaker 1", alice, "First item", at(30 * time.Second), at(33 * time.Second)},
+		},
+		{
+			{"Speaker 2", bob, "Next topic", at(3*time.Minute - 4*time.Second), at(3 * time.Minute)},
+		},
+	}
+	if len(transcript.Chapters) != len(want) {
+		t.Fatalf("got %d chapters, want %d: %+v", len(transcript.Chapters), len(want), transcript.Chapters)
+	}
+	for i, chapter := range transcript.Chapters {
+		if len(chapter.Turns) != len(want[i]) {
+			t.Errorf("chapter %d: got %+v", i, chapter.Turns)
+			continue
+		}
+		for j, turn := range chapter.Turns {
+			w := want[i][j]
+			if turn.Speaker != w.speaker || turn.ClientID != w.clientID || turn.Text != w.text || !turn.Start.Equal(w.start) || !turn.End.Equal(w.end) || turn.Sequence == 0 {
+				t.Errorf("chapter %d turn %d: got %+v, want %+v", i, j, turn, w)
+			}
+		}
+	}
+	if chapter := transcript.Chapters[0]; chapter.Title != "Hello everyone and welcome to the weekly sync…" || !chapter.Start.Equal(at(5*time.Second)) || !chapter.End.Equal(at(33*time.Second)) {
+		t.Errorf("got chapter %q %s-%s", chapter.Title, chapter.Start, chapter.End)
+	}
+	if title := transcript.Chapters[1].Title; title != "Next topic" {
+		t.Errorf("got chapter %q", title)
+	}
+
+	wantSpeakers := []MeetingSpeaker{
+		{Speaker: "Speaker 1", TalkTimeMs: 8000, Words: 11, Turns: 2, Share: 8.0 / 14},
+		{Speaker: "Speaker 2", TalkTimeMs: 4000, Words: 2, Turns: 1, Share: 4.0 / 14},
+		{Speaker: "Dana", TalkTimeMs: 2000, Words: 1, Turns: 1, Share: 2.0 / 14},
+	}
+	if !reflect.DeepEqual(transcript.Speakers, wantSpeakers) {
+		t.Errorf("got speakers %+v", transcript.Speakers)
+	}
+
+	if want := []string{"Send the notes", "Book a room", "Ship it"}; !reflect.DeepEqual(transcript.ActionItems, want) {
+		t.Errorf("got action items %q", transcript.ActionItems)
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := func(d time.Duration) string { return at(d).Local().Format("15:04:05") }
+	wantInput := "Weekly sync\n\n" +
+		"[" + clock(5*time.Second) + "] Speaker 1: Hello everyone and welcome to the weekly sync meeting\n" +
+		"[" + clock(18*time.Second) + "] Dana: Thanks\n" +
+		"[" + clock(30*time.Second) + "] Speaker 1: First item\n" +
+		"[" + clock(3*time.Minute-4*time.Second) + "] Speaker 2: Next topic\n"
+	if string(data) != wantInput {
+		t.Errorf("action items command read %q, want %q", data, wantInput)
+	}
+
+	// A failing command lists no action items
+	s.config.Meetings.ActionItemsCommand = "false"
+	if transcript, err := s.transcribeMeeting(context.Background(), meeting); err != nil || transcript.ActionItems == nil || len(transcript.ActionItems) != 0 {
+		t.Errorf("got %+v, %v", transcript, err)
+	}
+}
+
+func TestMeetingDiarization(t *testing.T) {
+	const clientID = "6f1c2a5e-8a5b-4c1e-9a43-0b8f6c1d2e3f"
+	s := newTestScribe(t, Config{Speakers: SpeakerConfig{Printer: loudPrinter{}}})
+	if err := s.speakers.update(func(speakers map[string]*enrolledSpeaker) {
+		speakers["Erin"] = &enrolledSpeaker{Prints: [][]float64{{1, 0}}}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Erin speaks loudly, then an unknown quiet voice, then Erin shortly
+	// again
+	const rate = 16000
+	pcm := audiotest.Concat(
+		audiotest.Tone(rate, 200, 3*time.Second, -6),
+		audiotest.Silence(rate, 1500*time.Millisecond),
+		audiotest.Tone(rate, 200, 2*time.Second, -30),
+		audiotest.Silence(rate, time.Second),
+		audiotest.Tone(rate, 200, time.Second, -6),
+	)
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-8500 * time.Millisecond)
+	if _, err := audiotest.WriteWav(filepath.Join(s.config.RecordingsDir, start.Format("20060102"), clientID), "a.wav", pcm); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDiarizer(s)
+	turns := d.turns(context.Background(), StoredTranscription{ClientID: clientID, Message: TranscriptionMessage{
+		Text:       "one two three four five",
+		AudioFile:  "a.wav",
+		Timestamp:  end,
+		DurationMs: 8500,
+		Sequence:   7,
+		Words: []Word{
+			{Text: "one", StartMs: 0, EndMs: 1000},
+			{Text: " two", StartMs: 1100, EndMs: 3000},
+			{Text: " three", StartMs: 4500, EndMs: 5500},
+			{Text: " four", StartMs: 5600, EndMs: 6500},
+			{Text: " five", StartMs: 7500, EndMs: 8500},
+		},
+	}})
+	want := []MeetingTurn{
+		{Speaker: "Erin", ClientID: clientID, Start: start, End: start.Add(3 * time.Second), Text: "one two", Sequence: 7},
+		// Five is too short for a voice print and keeps the speaker before
+		{Speaker: "Speaker 1", ClientID: clientID, Start: start.Add(4500 * time.Millisecond), End: end, Text: "three four five", Sequence: 7},
+	}
+	if !reflect.DeepEqual(turns, want) {
+		t.Errorf("got %+v, want %+v", turns, want)
+	}
+
+	// A transcription without words, or whose recording is gone, is one
+	// turn numbered by its client
+	for _, msg := range []TranscriptionMessage{
+		{Text: "no words", AudioFile: "a.wav", Timestamp: end, DurationMs: 8500},
+		{Text: "gone", AudioFile: "gone.wav", Timestamp: end, DurationMs: 8500, Words: []Word{{Text: "gone", StartMs: 0, EndMs: 8000}}},
+	} {
+		turns := d.turns(context.Background(), StoredTranscription{ClientID: clientID, Message: msg})
+		if len(turns) != 1 || turns[0].Speaker != "Speaker 2" || turns[0].Text != msg.Text || !turns[0].Start.Equal(start) {
+			t.Errorf("%s: got %+v", msg.Text, turns)
+		}
+	}
+}
+
+func TestChapters(t *testing.T) {
+	s := newTestScribe(t, Config{Meetings: MeetingConfig{ChapterGap: time.Minute, ChapterLength: 5 * time.Minute}})
+	base := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	turn := func(speaker string, from, to time.Duration) MeetingTurn {
+		return MeetingTurn{Speaker: speaker, Start: base.Add(from), End: base.Add(to), Text: speaker + " speaking"}
+	}
+	turns := []MeetingTurn{
+		turn("A", 0, time.Minute),
+		turn("B", time.Minute, 4*time.Minute),
+		// Past the length, but the same speaker
+		turn("B", 4*time.Minute+10*time.Second, 5*time.Minute+10*time.Second),
+		// Past the length at a change of speaker
+		turn("A", 5*time.Minute+20*time.Second, 6*time.Minute),
+		// After a pause
+		turn("A", 7*time.Minute, 8*time.Minute),
+	}
+	chapters := s.chapters(turns)
+	var got []int
+	for _, chapter := range chapters {
+		got = append(got, len(chapter.Turns))
+	}
+	if !reflect.DeepEqual(got, []int{3, 1, 1}) {
+		t.Fatalf("got chapters of %v turns", got)
+	}
+	if !chapters[0].End.Equal(base.Add(5*time.Minute+10*time.Second)) || chapters[0].Title != "A speaking" || chapters[1].Title != "A speaking" {
+		t.Errorf("got %+v", chapters[0])
+	}
+
+	// The defaults keep everything in one chapter
+	s.config.Meetings = MeetingConfig{}
+	if chapters := s.chapters(turns); len(chapters) != 1 {
+		t.Errorf("got %d chapters", len(chapters))
+	}
+	if chapters := s.chapters(nil); chapters == nil || len(chapters) != 0 {
+		t.Errorf("got %v", chapters)
+	}
+}
+
+func TestSpeakerStats(t *testing.T) {
+	base := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	stats := speakerStats([]MeetingTurn{
+		{Speaker: "A", Start: base, End: base, Text: "um"},
+		{Speaker: "B", Start: base, End: base, Text: ""},
+	})
+	want := []MeetingSpeaker{{Speaker: "A", Words: 1, Turns: 1}, {Speaker: "B", Turns: 1}}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("turns without talk time: got %+v", stats)
+	}
+	if stats := speakerStats(nil); stats == nil || len(stats) != 0 {
+		t.Errorf("got %v", stats)
+	}
+}
+
+func TestChapterTitle(t *testing.T) {
+	tests := map[string]string{
+		"":                 "",
+		"  Hello   there ": "Hello there",
+		"one two three four five six seven eight":      "one two three four five six seven eight",
+		"one two three four five six seven eight nine": "one two three four five six seven eight…",
+	}
+	for text, want := range tests {
+		if got := chapterTitle(text); got != want {
+			t.Errorf("%q: got %q, want %q", text, got, want)
+		}
+	}
+}
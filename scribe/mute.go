@@ -0,0 +1,112 @@
+package scribe
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Muter stops audio clients from being recorded, as the audio server does.
+// It reports changes through ClientMuted and ClientUnmuted.
+type Muter interface {
+	// Mute discards what a client transmits until the given time, or
+	// until Unmute when it is zero
+	Mute(clientID string, until time.Time) error
+	Unmute(clientID string) error
+}
+
+// muteRequest is the body of POST /api/clients/{id}/mute
+type muteRequest struct {
+	// How long the client stays muted, e.g. "30m", until unmuted when empty
+	Duration string `json:"duration"`
+}
+
+// HandleMute mutes clients for /api/clients/{id}/mute, e.g. the audio
+// server. Without it no client can be muted. Call it before starting the
+// scribe.
+func (s *Scribe) HandleMute(muter Muter) {
+	s.muter = muter
+}
+
+// handleMute stops recording a client, for a "duration" or until unmuted
+func (s *Scribe) handleMute(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	var req muteRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var until time.Time
+	if req.Duration != "" {
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		until = time.Now().Add(duration)
+	}
+
+	if !s.changeMute(w, clientID, func() error { return s.muter.Mute(clientID, until) }) {
+		return
+	}
+	slog.Info("Muted client through the API", "clientID", clientID, "until", until)
+	s.writePresence(w, clientID)
+}
+
+// handleUnmute records a muted client again
+func (s *Scribe) handleUnmute(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	if !s.changeMute(w, clientID, func() error { return s.muter.Unmute(clientID) }) {
+		return
+	}
+	slog.Info("Unmuted client through the API", "clientID", clientID)
+	s.writePresence(w, clientID)
+}
+
+// changeMute mutes or unmutes a connected client, answering the request
+// and returning false when that fails
+func (s *Scribe) changeMute(w http.ResponseWriter, clientID string, change func() error) bool {
+	if s.muter == nil {
+		http.Error(w, "No audio server to mute clients", http.StatusServiceUnavailable)
+		return false
+	}
+	if _, ok := s.presence.Load(clientID); !ok {
+		http.Error(w, "Client is not connected", http.StatusConflict)
+		return false
+	}
+	if err := change(); err != nil {
+		slog.Warn("Failed to change mute", "error", err, "clientID", clientID)
+		http.Error(w, "Failed to change mute: "+err.Error(), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// writePresence answers with the presence of a client
+func (s *Scribe) writePresence(w http.ResponseWriter, clientID string) {
+	presence := PresenceMessage{}
+	if value, ok := s.presence.Load(clientID); ok {
+		presence = value.(PresenceMessage)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.shownPresence(presence)); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,244 @@
+package scribe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/sftp"
+	"github.com/bosley/libas/webdav"
+)
+
+const (
+	// Attempts at pushing one file to an output
+	outputAttempts = 3
+
+	// Recordings waiting for each output before new ones are dropped
+	outputQueueSize = 64
+)
+
+// OutputTarget stores files pushed to it, like the clients of the webdav,
+// sftp and s3 packages
+type OutputTarget interface {
+	Put(ctx context.Context, name string, body io.Reader, size int64) error
+
+	// Delete removes a file, for erasing a client's data. A file that does
+	// not exist is an error wrapping fs.ErrNotExist.
+	Delete(ctx context.Context, name string) error
+
+	// URL is where a file is stored, for logs
+	URL(name string) string
+}
+
+// Output pushes each finalized recording and its transcript to a target as
+// <day>/<client ID>/<file>.wav and .txt, mirroring the recordings directory
+type Output struct {
+	Target OutputTarget
+
+	// Push only the recordings of these clients, by client ID or by the
+	// host they connect from. Every client when empty.
+	Clients []string
+}
+
+// OpenOutput creates an output from a URL: webdav:// or webdavs:// (plain
+// http:// and https:// too) for WebDAV and sftp:// for SFTP. Credentials go
+// in the user info. The clients query parameter limits the output to a
+// comma separated list of client IDs or hosts. SFTP URLs take key,
+// known_hosts and fingerprint parameters; their path is absolute unless it
+// starts with /~/, which is the user's home directory.
+func OpenOutput(rawURL string) (Output, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return Output{}, fmt.Errorf("invalid output URL %q", redactURL(rawURL))
+	}
+	query := u.Query()
+	output := Output{Clients: splitClients(query.Get("clients"))}
+	user := u.User.Username()
+	password, _ := u.User.Password()
+
+	switch u.Scheme {
+	case "webdav", "webdavs", "http", "https":
+		scheme := map[string]string{"webdav": "http", "webdavs": "https"}[u.Scheme]
+		if scheme == "" {
+			scheme = u.Scheme
+		}
+		query.Del("clients")
+		target := url.URL{Scheme: scheme, Host: u.Host, Path: u.Path, RawQuery: query.Encode()}
+		output.Target, err = webdav.New(webdav.Config{URL: target.String(), User: user, Password: password})
+
+	case "sftp":
+		dir := u.Path
+		if strings.HasPrefix(dir, "/~") {
+			dir = strings.TrimPrefix(strings.TrimPrefix(dir, "/~"), "/")
+		}
+		output.Target, err = sftp.New(sftp.Config{
+			Addr:               u.Host,
+			User:               user,
+			Password:           password,
+			KeyFile:            query.Get("key"),
+			KnownHostsFile:     query.Get("known_hosts"),
+			HostKeyFingerprint: query.Get("fingerprint"),
+			Dir:                dir,
+		})
+
+	default:
+		return Output{}, fmt.Errorf("unsupported output scheme %q, expected webdav, webdavs or sftp", u.Scheme)
+	}
+	if err != nil {
+		return Output{}, fmt.Errorf("invalid output %s: %w", redactURL(rawURL), err)
+	}
+	return output, nil
+}
+
+func splitClients(value string) []string {
+	clients := make([]string, 0)
+	for _, client := range strings.Split(value, ",") {
+		if client = strings.TrimSpace(client); client != "" {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// redactURL drops the credentials of a URL for messages
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// outputFile is a file waiting to be pushed
+type outputFile struct {
+	name string
+	data []byte
+}
+
+// output is the queue of one configured output
+type output struct {
+	Output
+	clients map[string]bool
+	queue   chan []outputFile
+
+	// Set while pushes fail, so a lasting outage alerts once
+	failing bool
+}
+
+// outputs queues finalized recordings for the configured outputs
+type outputs struct {
+	targets []*output
+}
+
+func newOutputs(configured []Output) *outputs {
+	o := &outputs{}
+	for _, cfg := range configured {
+		target := &output{Output: cfg, clients: make(map[string]bool), queue: make(chan []outputFile, outputQueueSize)}
+		for _, client := range cfg.Clients {
+			target.clients[client] = true
+		}
+		o.targets = append(o.targets, target)
+	}
+	return o
+}
+
+// push queues a transcribed recording and its transcript for the outputs
+// selecting its client. The recording is read now, before it may be
+// archived as FLAC.
+func (s *Scribe) push(job TranscriptionJob, msg TranscriptionMessage) {
+	var files []outputFile
+	for _, target := range s.outputs.targets {
+		if !s.selects(target.clients, job.ClientID) {
+			continue
+		}
+
+		if files == nil {
+			rel, err := filepath.Rel(s.config.RecordingsDir, job.FilePath)
+			if err != nil {
+				rel = filepath.Join(job.ClientID, filepath.Base(job.FilePath))
+			}
+			name := filepath.ToSlash(rel)
+			files = []outputFile{
+				{name: strings.TrimSuffix(name, path.Ext(name)) + ".txt", data: []byte(msg.Text + "\n")},
+			}
+			// Text-only clients' recordings are not pushed
+			if !msg.AudioDiscarded {
+				data, err := os.ReadFile(job.FilePath)
+				if err != nil {
+					slog.Error("Failed to read recording for outputs", "error", err, "file", job.FilePath)
+					return
+				}
+				files = append([]outputFile{{name: name, data: data}}, files...)
+			}
+		}
+
+		select {
+		case target.queue <- files:
+		default:
+			slog.Warn("Output queue full, dropping recording", "output", target.Target.URL(""), "file", files[0].name)
+		}
+	}
+}
+
+// runOutput pushes queued recordings to one output until ctx is cancelled
+func (s *Scribe) runOutput(ctx context.Context, target *output) {
+	if closer, ok := target.Target.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	for {
+		var files []outputFile
+		select {
+		case <-ctx.Done():
+			return
+		case files = <-target.queue:
+		}
+
+		var failed error
+		for _, file := range files {
+			if err := pushFile(ctx, target.Target, file); err != nil {
+				failed = err
+				slog.Warn("Failed to push to output", "url", target.Target.URL(file.name), "error", err)
+				break
+			}
+			slog.Debug("Pushed to output", "url", target.Target.URL(file.name))
+		}
+
+		switch {
+		case failed != nil && ctx.Err() == nil && !target.failing:
+			target.failing = true
+			s.alert("Output "+target.Target.URL("")+" is failing", failed)
+		case failed == nil && target.failing:
+			target.failing = false
+			slog.Info("Output pushes succeed again", "output", target.Target.URL(""))
+		}
+	}
+}
+
+// pushFile puts a file on a target, retrying with backoff
+func pushFile(ctx context.Context, target OutputTarget, file outputFile) error {
+	backoff := 2 * time.Second
+	for attempt := 1; ; attempt++ {
+		err := target.Put(ctx, file.name, bytes.NewReader(file.data), int64(len(file.data)))
+		if err == nil || attempt == outputAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
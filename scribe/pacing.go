@@ -0,0 +1,144 @@
+package scribe
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// PacingConfig keeps whisper from taking all the CPU of a shared machine,
+// independent of the number of workers. Zero values leave a limit off.
+type PacingConfig struct {
+	// Whisper processes running at once
+	MaxConcurrent int
+
+	// Whisper processes started per minute on average, with bursts of up
+	// to Burst, defaulting to one
+	StartsPerMinute float64
+	Burst           int
+
+	// Niceness whisper runs at, 1 to 19, lower priority than the scribe
+	// so the machine stays responsive. Not supported on Windows.
+	Nice int
+
+	// CPUs whisper processes may use together, e.g. 1.5, enforced with
+	// the cgroup v2 directory CGroup, which is created if missing and has
+	// to be writable. Linux only.
+	CPUQuota float64
+	CGroup   string
+}
+
+func (c PacingConfig) enabled() bool {
+	return c.MaxConcurrent > 0 || c.StartsPerMinute > 0 || c.Nice != 0 || c.CPUQuota > 0
+}
+
+// Pacer holds whisper processes back to the configured pace
+type Pacer struct {
+	config PacingConfig
+	slots  chan struct{} // nil without a concurrency limit
+
+	mu     sync.Mutex
+	tokens float64
+	filled time.Time
+}
+
+// NewPacer checks the configuration and sets up the CPU quota
+func NewPacer(cfg PacingConfig) (*Pacer, error) {
+	if cfg.MaxConcurrent < 0 || cfg.StartsPerMinute < 0 || cfg.Burst < 0 || cfg.CPUQuota < 0 {
+		return nil, fmt.Errorf("whisper pacing limits must not be negative")
+	}
+	if cfg.Nice < 0 || cfg.Nice > 19 {
+		return nil, fmt.Errorf("whisper niceness must be between 0 and 19")
+	}
+	if cfg.Nice > 0 && runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("whisper niceness is not supported on Windows")
+	}
+	if cfg.CPUQuota > 0 {
+		if cfg.CGroup == "" {
+			return nil, fmt.Errorf("a whisper CPU quota needs a cgroup directory")
+		}
+		if err := setupCGroup(cfg.CGroup, cfg.CPUQuota); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Burst == 0 {
+		cfg.Burst = 1
+	}
+
+	p := &Pacer{config: cfg, tokens: float64(cfg.Burst), filled: time.Now()}
+	if cfg.MaxConcurrent > 0 {
+		p.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	return p, nil
+}
+
+// wait blocks until a whisper process may start, returning a function to
+// call once it exited
+func (p *Pacer) wait(ctx context.Context) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+	if err := p.take(ctx); err != nil {
+		return nil, err
+	}
+	if p.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return func() { <-p.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// take takes a token from the bucket, waiting for one to be added when it
+// is empty
+func (p *Pacer) take(ctx context.Context) error {
+	if p.config.StartsPerMinute == 0 {
+		return nil
+	}
+	perToken := time.Duration(float64(time.Minute) / p.config.StartsPerMinute)
+	for {
+		p.mu.Lock()
+		now := time.Now()
+		p.tokens = math.Min(float64(p.config.Burst), p.tokens+float64(now.Sub(p.filled))/float64(perToken))
+		p.filled = now
+		if p.tokens >= 1 {
+			p.tokens--
+			p.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - p.tokens) * float64(perToken))
+		p.mu.Unlock()
+
+		slog.Debug("Pacing whisper, waiting to start", "delay", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// started lowers the priority of a whisper process and moves it into the
+// cgroup. Failures are logged, whisper still runs.
+func (p *Pacer) started(pid int) {
+	if p == nil {
+		return
+	}
+	if p.config.Nice > 0 {
+		if err := setNice(pid, p.config.Nice); err != nil {
+			slog.Warn("Failed to lower whisper priority", "error", err, "pid", pid)
+		}
+	}
+	if p.config.CPUQuota > 0 {
+		if err := joinCGroup(p.config.CGroup, pid); err != nil {
+			slog.Warn("Failed to limit whisper CPU", "error", err, "pid", pid, "cgroup", p.config.CGroup)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package scribe
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Period of the cgroup CPU quota in microseconds
+const cgroupPeriod = 100000
+
+// setNice sets the niceness of every thread of a process. Threads started
+// later inherit it.
+func setNice(pid, nice int) error {
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupCGroup creates a cgroup v2 directory limited to quota CPUs
+func setupCGroup(dir string, quota float64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	limit := fmt.Sprintf("%d %d\n", int(quota*cgroupPeriod), cgroupPeriod)
+	if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(limit), 0644); err != nil {
+		return fmt.Errorf("failed to set cgroup CPU quota, is the cpu controller enabled for %s: %w", filepath.Dir(dir), err)
+	}
+	return nil
+}
+
+// joinCGroup moves a process into the cgroup
+func joinCGroup(dir string, pid int) error {
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+
+package scribe
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setNice(pid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+}
+
+func setupCGroup(dir string, quota float64) error {
+	return fmt.Errorf("whisper CPU quotas need Linux cgroups")
+}
+
+func joinCGroup(dir string, pid int) error {
+	return fmt.Errorf("whisper CPU quotas need Linux cgroups")
+}
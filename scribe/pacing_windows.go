@@ -0,0 +1,17 @@
+//go:build windows
+
+package scribe
+
+import "fmt"
+
+func setNice(pid, nice int) error {
+	return fmt.Errorf("niceness is not supported on Windows")
+}
+
+func setupCGroup(dir string, quota float64) error {
+	return fmt.Errorf("whisper CPU quotas need Linux cgroups")
+}
+
+func joinCGroup(dir string, pid int) error {
+	return fmt.Errorf("whisper CPU quotas need Linux cgroups")
+}
@@ -0,0 +1,164 @@
+package scribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bosley/libas/events"
+)
+
+// PresenceMessage is the payload of client_connected and
+// client_disconnected WebSocket messages
+type PresenceMessage struct {
+	Connected   bool      `json:"connected"`
+	Addr        string    `json:"addr,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt,omitempty"`
+
+	// Set while what the client transmits is discarded, with the time it
+	// is unmuted unless that waits for an unmute
+	Muted      bool       `json:"muted,omitempty"`
+	MutedUntil *time.Time `json:"mutedUntil,omitempty"`
+
+	// Metrics the client last reported of its device, such as battery in
+	// percent, temperature in degrees Celsius and signal in dBm, and when
+	Health   map[string]float64 `json:"health,omitempty"`
+	HealthAt *time.Time         `json:"healthAt,omitempty"`
+
+	// Name of the remote scribe the client is connected to
+	Site string `json:"site,omitempty"`
+}
+
+// ClientConnected records that an audio client connected to the server and
+// notifies subscribers. It is called in-process by the audio server.
+func (s *Scribe) ClientConnected(clientID, addr string, connectedAt time.Time) {
+	presence := PresenceMessage{
+		Connected:   true,
+		Addr:        addr,
+		ConnectedAt: connectedAt,
+	}
+	s.presenceMu.Lock()
+	s.presence.Store(clientID, presence)
+	s.presenceMu.Unlock()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		s.hosts.Store(clientID, host)
+	}
+	if s.recorder != nil && s.inMeeting(clientID) {
+		if err := s.recorder.RecordContinuously(clientID, true); err != nil {
+			slog.Warn("Failed to record client of meeting continuously", "error", err, "clientID", clientID)
+		}
+	}
+
+	// Make the client visible in the client list before it transcribes anything
+	s.clients.LoadOrStore(clientID, &ClientTranscriptions{
+		Messages: make([]TranscriptionMessage, 0),
+	})
+
+	s.publishPresence(events.ClientConnected, clientID, presence)
+}
+
+// ClientDisconnected records that an audio client left and notifies subscribers
+func (s *Scribe) ClientDisconnected(clientID string) {
+	presence := PresenceMessage{Connected: false}
+	s.presenceMu.Lock()
+	if value, ok := s.presence.LoadAndDelete(clientID); ok {
+		previous := value.(PresenceMessage)
+		presence.Addr = previous.Addr
+		presence.ConnectedAt = previous.ConnectedAt
+	}
+	s.presenceMu.Unlock()
+
+	s.publishPresence(events.ClientDisconnected, clientID, presence)
+}
+
+// ClientMuted records that an audio client was muted until the given time,
+// zero for no end, and notifies subscribers. It is called in-process by the
+// audio server.
+func (s *Scribe) ClientMuted(clientID string, until time.Time) {
+	s.setMuted(events.ClientMuted, clientID, func(presence *PresenceMessage) {
+		presence.Muted = true
+		presence.MutedUntil = nil
+		if !until.IsZero() {
+			presence.MutedUntil = &until
+		}
+	})
+}
+
+// ClientUnmuted records that an audio client was unmuted and notifies
+// subscribers
+func (s *Scribe) ClientUnmuted(clientID string) {
+	s.setMuted(events.ClientUnmuted, clientID, func(presence *PresenceMessage) {
+		presence.Muted = false
+		presence.MutedUntil = nil
+	})
+}
+
+// ClientHealth records the metrics an audio client reported of its device.
+// It is called in-process by the audio server. Reports arrive every minute
+// or so, they are shown in /api/presence rather than published.
+func (s *Scribe) ClientHealth(clientID string, metrics map[string]float64, at time.Time) {
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+	value, ok := s.presence.Load(clientID)
+	if !ok {
+		return
+	}
+	presence := value.(PresenceMessage)
+	presence.Health, presence.HealthAt = metrics, &at
+	s.presence.Store(clientID, presence)
+}
+
+// setMuted changes the presence of a connected client. It is published
+// under the lock, so subscribers see mutes and unmutes in the order made.
+func (s *Scribe) setMuted(eventType, clientID string, change func(*PresenceMessage)) {
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+	value, ok := s.presence.Load(clientID)
+	if !ok {
+		return
+	}
+	presence := value.(PresenceMessage)
+	change(&presence)
+	s.presence.Store(clientID, presence)
+	s.publishPresence(eventType, clientID, presence)
+}
+
+// selects reports whether a client is among clients, by ID or by the host
+// it last connected from. An empty set selects every client.
+func (s *Scribe) selects(clients map[string]bool, clientID string) bool {
+	if len(clients) == 0 || clients[clientID] {
+		return true
+	}
+	host, ok := s.hosts.Load(clientID)
+	return ok && clients[host.(string)]
+}
+
+func (s *Scribe) publishPresence(eventType, clientID string, presence PresenceMessage) {
+	s.events.Publish(events.Event{Type: eventType, ClientID: clientID, Data: presence})
+
+	if err := s.broadcast(WebSocketMessage{
+		Type:      eventType,
+		ClientID:  clientID,
+		Timestamp: time.Now(),
+		Payload:   s.shownPresence(presence),
+	}); err != nil {
+		slog.Error("Failed to publish presence", "error", err, "clientID", clientID)
+	}
+}
+
+// handleListPresence returns the audio clients currently connected
+func (s *Scribe) handleListPresence(w http.ResponseWriter, r *http.Request) {
+	connected := make(map[string]PresenceMessage)
+	u := requestUser(r)
+	s.presence.Range(func(key, value interface{}) bool {
+		if s.canView(u, key.(string)) {
+			connected[key.(string)] = s.shownPresence(value.(PresenceMessage))
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connected)
+}
@@ -0,0 +1,35 @@
+package scribe
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Health reports and mutes arriving at once both stick
+func TestPresenceConcurrentChanges(t *testing.T) {
+	s := newTestScribe(t, Config{})
+	const rounds = 200
+	for i := range rounds {
+		clientID := "client"
+		s.ClientConnected(clientID, "192.168.1.40:51000", time.Now())
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.ClientHealth(clientID, map[string]float64{"battery": float64(i)}, time.Now())
+		}()
+		go func() {
+			defer wg.Done()
+			s.ClientMuted(clientID, time.Time{})
+		}()
+		wg.Wait()
+
+		value, _ := s.presence.Load(clientID)
+		presence := value.(PresenceMessage)
+		if !presence.Muted || presence.Health["battery"] != float64(i) {
+			t.Fatalf("round %d: got muted %v and health %v, want both changes", i, presence.Muted, presence.Health)
+		}
+	}
+}
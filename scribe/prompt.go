@@ -0,0 +1,199 @@
+package scribe
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// File in the recordings directory prompts set through the API are
+	// kept in
+	promptsFile = "prompts.json"
+
+	// Longest prompt accepted, whisper only reads the last 224 tokens
+	maxPromptLength = 4096
+)
+
+// PromptedTranscriber is a Transcriber that can be primed with an initial
+// prompt of names, terms and jargon the recordings are likely to contain
+type PromptedTranscriber interface {
+	WithPrompt(prompt string) Transcriber
+}
+
+// prompts holds the initial prompts of clients, those of the
+// configuration overlaid with those set through the API
+type prompts struct {
+	path   string
+	config map[string]string
+
+	mu  sync.RWMutex
+	api map[string]string
+}
+
+// loadPrompts reads the prompts set through the API
+func loadPrompts(recordingsDir string, config map[string]string) (*prompts, error) {
+	p := &prompts{
+		path:   filepath.Join(recordingsDir, promptsFile),
+		config: config,
+		api:    make(map[string]string),
+	}
+	data, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompts: %w", err)
+	}
+	if err := json.Unmarshal(data, &p.api); err != nil {
+		return nil, fmt.Errorf("failed to parse prompts: %w", err)
+	}
+	return p, nil
+}
+
+// lookup finds the prompt of a client ID or host
+func (p *prompts) lookup(client string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if prompt, ok := p.api[client]; ok {
+		return prompt, true
+	}
+	prompt, ok := p.config[client]
+	return prompt, ok
+}
+
+// all returns the prompts of every client
+func (p *prompts) all() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	all := make(map[string]string, len(p.config)+len(p.api))
+	for client, prompt := range p.config {
+		all[client] = prompt
+	}
+	for client, prompt := range p.api {
+		all[client] = prompt
+	}
+	return all
+}
+
+// set sets or, with remove, removes the prompt of a client and persists
+// the prompts set through the API
+func (p *prompts) set(client, prompt string, remove bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	updated := make(map[string]string, len(p.api)+1)
+	for c, existing := range p.api {
+		updated[c] = existing
+	}
+	if remove {
+		delete(updated, client)
+	} else {
+		updated[client] = prompt
+	}
+
+	data, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal prompts: %w", err)
+	}
+	tmpPath := p.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write prompts: %w", err)
+	}
+	if err := os.Rename(tmpPath, p.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write prompts: %w", err)
+	}
+	p.api = updated
+	return nil
+}
+
+// promptFor finds a client's prompt by ID, then by the host it connects
+// from, falling back to the prompt of all clients, and adds the terms
+// learned from the client's corrections
+func (s *Scribe) promptFor(clientID string) string {
+	if prompt, ok := s.prompts.lookup(clientID); ok {
+		return s.learnedPrompt(clientID, prompt)
+	}
+	if host, ok := s.hosts.Load(clientID); ok {
+		if prompt, ok := s.prompts.lookup(host.(string)); ok {
+			return s.learnedPrompt(clientID, prompt)
+		}
+	}
+	return s.learnedPrompt(clientID, s.config.Prompt)
+}
+
+// withPrompt primes a transcriber with a client's prompt when it supports
+// one
+func (s *Scribe) withPrompt(transcriber Transcriber, clientID string) Transcriber {
+	prompt := s.promptFor(clientID)
+	if prompted, ok := transcriber.(PromptedTranscriber); ok && prompt != "" {
+		return prompted.WithPrompt(prompt)
+	}
+	return transcriber
+}
+
+// PromptsResponse lists the initial prompts whisper is given
+type PromptsResponse struct {
+	// Prompt of clients without one of their own
+	Default string `json:"default"`
+
+	// Prompts by client ID or host
+	Clients map[string]string `json:"clients"`
+}
+
+// promptRequest sets the prompt of a client
+type promptRequest struct {
+	Prompt string `json:"prompt"`
+}
+
+// handleListPrompts serves the prompts of all clients
+func (s *Scribe) handleListPrompts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(PromptsResponse{Default: s.config.Prompt, Clients: s.prompts.all()}); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// handleSetPrompt sets the prompt of a client ID or host. An empty prompt
+// gives the client none, even when a default is configured.
+func (s *Scribe) handleSetPrompt(w http.ResponseWriter, r *http.Request) {
+	client := mux.Vars(r)["client"]
+
+	var req promptRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxPromptLength)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Prompt) > maxPromptLength {
+		http.Error(w, "Prompt too long", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.prompts.set(client, req.Prompt, false); err != nil {
+		slog.Error("Failed to save prompt", "error", err, "client", client)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Prompt set", "client", client, "length", len(req.Prompt))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeletePrompt removes the prompt set for a client through the API,
+// leaving it to the configuration
+func (s *Scribe) handleDeletePrompt(w http.ResponseWriter, r *http.Request) {
+	client := mux.Vars(r)["client"]
+	if err := s.prompts.set(client, "", true); err != nil {
+		slog.Error("Failed to remove prompt", "error", err, "client", client)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Prompt removed", "client", client)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+package scribe
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bosley/libas/pseudonym"
+)
+
+// Largest JSON request body whose pseudonyms are resolved
+const maxPseudonymBody = 1 << 20
+
+// Pseudonymizer replaces client IDs with pseudonyms, like
+// pseudonym.Pseudonymizer
+type Pseudonymizer interface {
+	Mask(text string) string
+	Unmask(text string) string
+}
+
+var _ Pseudonymizer = (*pseudonym.Pseudonymizer)(nil)
+
+// pseudonymMiddleware resolves the pseudonyms in requests to client IDs and
+// masks the client IDs in responses, so handlers only see client IDs and
+// callers only pseudonyms. WebSocket messages are masked as they are
+// written instead.
+func (s *Scribe) pseudonymMiddleware(next http.Handler) http.Handler {
+	p := s.config.Pseudonyms
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = p.Unmask(r.URL.Path)
+		r.URL.RawPath = p.Unmask(r.URL.RawPath)
+		r.URL.RawQuery = p.Unmask(r.URL.RawQuery)
+		if r.Body != nil && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxPseudonymBody))
+			if err != nil {
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(strings.NewReader(p.Unmask(string(data))))
+			r.ContentLength = -1
+		}
+
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		masking := &maskingWriter{ResponseWriter: w, p: p}
+		next.ServeHTTP(masking, r)
+		masking.finish()
+	})
+}
+
+// maskingWriter holds back text responses to mask the client IDs in them,
+// passing audio and images through
+type maskingWriter struct {
+	http.ResponseWriter
+	p           Pseudonymizer
+	status      int
+	body        bytes.Buffer
+	passThrough bool
+}
+
+func (m *maskingWriter) WriteHeader(status int) {
+	if m.status != 0 {
+		return
+	}
+	m.status = status
+	header := m.Header()
+	if disposition := header.Get("Content-Disposition"); disposition != "" {
+		header.Set("Content-Disposition", m.p.Mask(disposition))
+	}
+	if location := header.Get("Location"); location != "" {
+		header.Set("Location", m.p.Mask(location))
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "text/") &&
+		!strings.Contains(contentType, "json") && !strings.Contains(contentType, "xml") {
+		m.passThrough = true
+		m.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (m *maskingWriter) Write(data []byte) (int, error) {
+	if m.status == 0 {
+		m.WriteHeader(http.StatusOK)
+	}
+	if m.passThrough {
+		return m.ResponseWriter.Write(data)
+	}
+	return m.body.Write(data)
+}
+
+func (m *maskingWriter) Flush() {
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok && m.passThrough {
+		flusher.Flush()
+	}
+}
+
+// finish writes the masked response held back
+func (m *maskingWriter) finish() {
+	if m.status == 0 || m.passThrough {
+		return
+	}
+	m.Header().Del("Content-Length")
+	m.ResponseWriter.WriteHeader(m.status)
+	io.WriteString(m.ResponseWriter, m.p.Mask(m.body.String()))
+}
+
+// shownPresence leaves out the address of a client while client IDs are
+// pseudonymized, as it would tell the device
+func (s *Scribe) shownPresence(presence PresenceMessage) PresenceMessage {
+	if s.config.Pseudonyms != nil {
+		presence.Addr = ""
+	}
+	return presence
+}
@@ -0,0 +1,376 @@
+package scribe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/redis"
+	"github.com/google/uuid"
+)
+
+const (
+	// Keys are prefixed with this when QueueTranscriber and QueueWorker
+	// leave Prefix empty
+	defaultQueuePrefix = "libas:"
+
+	// How long a recording may wait for a worker and take to transcribe
+	// when QueueTranscriber leaves Timeout zero
+	defaultQueueTimeout = 10 * time.Minute
+
+	// How long a worker waits for a recording before asking again
+	queuePoll = 5 * time.Second
+
+	// How long a result no scribe collected is kept
+	queueResultTTL = 10 * time.Minute
+
+	// Time allowed for cleaning up a recording the scribe gave up on
+	queueCleanupTimeout = 5 * time.Second
+
+	// Delay before a worker asks again after Redis failed, doubled after
+	// each failure up to the maximum
+	queueRetry    = time.Second
+	maxQueueRetry = time.Minute
+)
+
+// QueueTranscriber is the Transcriber handing recordings to worker
+// processes, such as "libas worker" on GPU machines, through Redis and
+// waiting for their transcriptions. The recording is stored under
+// <prefix>audio:<id> and the job pushed onto the <prefix>jobs list; the
+// worker pushes the result onto <prefix>result:<id>. Config.Workers is the
+// number of recordings out with the workers at once, so it should match
+// their capacity.
+type QueueTranscriber struct {
+	Redis *redis.Client
+
+	// Prefix of the keys, "libas:" when empty, so several scribes can
+	// share a server
+	Prefix string
+
+	// How long a recording may wait for a worker and take to transcribe
+	// before it fails, defaults to 10 minutes
+	Timeout time.Duration
+
+	prompt         string
+	detectLanguage bool
+}
+
+// queueJob is a recording waiting for a worker
+type queueJob struct {
+	ID             string `json:"id"`
+	File           string `json:"file,omitempty"`
+	Prompt         string `json:"prompt,omitempty"`
+	DetectLanguage bool   `json:"detectLanguage,omitempty"`
+}
+
+// queueResult is a worker's transcription of a recording
+type queueResult struct {
+	Segments []queueSegment `json:"segments"`
+
+	// Why the worker failed, with Unavailable when its transcriber could
+	// not run
+	Error       string `json:"error,omitempty"`
+	Unavailable bool   `json:"unavailable,omitempty"`
+
+	// Name of the worker
+	Worker string `json:"worker,omitempty"`
+}
+
+// queueSegment is a Segment as it travels through the queue
+type queueSegment struct {
+	StartMs    int64   `json:"startMs"`
+	EndMs      int64   `json:"endMs"`
+	Text       string  `json:"text"`
+	Confidence float32 `json:"confidence,omitempty"`
+	Words      []Word  `json:"words,omitempty"`
+	Language   string  `json:"language,omitempty"`
+}
+
+func queuePrefix(prefix string) string {
+	if prefix == "" {
+		return defaultQueuePrefix
+	}
+	return prefix
+}
+
+// Transcribe has a worker transcribe path
+func (q QueueTranscriber) Transcribe(ctx context.Context, path string) (string, error) {
+	segments, err := q.TranscribeSegments(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return joinSegments(segments), nil
+}
+
+// TranscribeSegments has a worker transcribe path and returns its segments
+func (q QueueTranscriber) TranscribeSegments(ctx context.Context, path string) ([]Segment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	timeout := q.Timeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	prefix := queuePrefix(q.Prefix)
+	job := queueJob{
+		ID:             uuid.NewString(),
+		File:           filepath.Base(path),
+		Prompt:         q.prompt,
+		DetectLanguage: q.detectLanguage,
+	}
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal job: %w", err)
+	}
+	audioKey := prefix + "audio:" + job.ID
+
+	// Unclaimed jobs and recordings are removed however this ends
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queueCleanupTimeout)
+		defer cancel()
+		q.Redis.Do(ctx, "LREM", prefix+"jobs", 1, payload)
+		q.Redis.Do(ctx, "DEL", audioKey)
+	}()
+
+	expiry := int64((timeout + time.Minute) / time.Second)
+	if _, err := q.Redis.Do(ctx, "SET", audioKey, data, "EX", expiry); err != nil {
+		return nil, fmt.Errorf("%w: failed to queue recording: %w", fault.ErrTranscriberUnavailable, err)
+	}
+	if _, err := q.Redis.Do(ctx, "LPUSH", prefix+"jobs", payload); err != nil {
+		return nil, fmt.Errorf("%w: failed to queue recording: %w", fault.ErrTranscriberUnavailable, err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout+queuePoll)
+	defer cancel()
+	reply, err := q.Redis.Do(waitCtx, "BLPOP", prefix+"result:"+job.ID, int64(timeout/time.Second))
+	if err != nil && ctx.Err() == nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: failed to wait for worker: %w", fault.ErrTranscriberUnavailable, err)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	items, _ := reply.([]any)
+	if len(items) != 2 {
+		// Nothing is removed when a worker took the job and did not answer
+		if removed, _ := q.Redis.Do(ctx, "LREM", prefix+"jobs", 1, payload); removed == int64(1) {
+			return nil, fmt.Errorf("%w: no worker took the recording within %s", fault.ErrTranscriberUnavailable, timeout)
+		}
+		return nil, fmt.Errorf("worker did not transcribe the recording within %s", timeout)
+	}
+	body, _ := items[1].([]byte)
+	var result queueResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse worker result: %w", err)
+	}
+	if result.Unavailable {
+		reason := strings.TrimPrefix(result.Error, fault.ErrTranscriberUnavailable.Error()+": ")
+		return nil, fmt.Errorf("%w: worker %s: %s", fault.ErrTranscriberUnavailable, result.Worker, reason)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("worker %s failed: %s", result.Worker, result.Error)
+	}
+
+	slog.Debug("Recording transcribed by worker",
+		"worker", result.Worker,
+		"file", job.File,
+		"segments", len(result.Segments))
+	segments := make([]Segment, len(result.Segments))
+	for i, segment := range result.Segments {
+		segments[i] = Segment{
+			Start:      time.Duration(segment.StartMs) * time.Millisecond,
+			End:        time.Duration(segment.EndMs) * time.Millisecond,
+			Text:       segment.Text,
+			Confidence: segment.Confidence,
+			Words:      segment.Words,
+			Language:   segment.Language,
+		}
+	}
+	return segments, nil
+}
+
+// WithPrompt returns a copy of q whose workers are primed with prompt
+func (q QueueTranscriber) WithPrompt(prompt string) Transcriber {
+	q.prompt = prompt
+	return q
+}
+
+// DetectingLanguage returns a copy of q whose workers detect the language
+// spoken
+func (q QueueTranscriber) DetectingLanguage() Transcriber {
+	q.detectLanguage = true
+	return q
+}
+
+// QueueWorker transcribes the recordings QueueTranscriber hands out
+type QueueWorker struct {
+	Redis *redis.Client
+
+	// Prefix of the keys, as QueueTranscriber's
+	Prefix string
+
+	// Transcribes the recordings, primed with the prompt and detecting the
+	// language as the scribe asks when it is a PromptedTranscriber and a
+	// LanguageDetector
+	Transcriber Transcriber
+
+	// Name results are labeled with in the scribe's log, e.g. the host
+	Name string
+
+	// Recordings transcribed at once, defaults to one
+	Workers int
+}
+
+// Run transcribes recordings until ctx ends
+func (w QueueWorker) Run(ctx context.Context) error {
+	workers := max(w.Workers, 1)
+	done := make(chan struct{}, workers)
+	for range workers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			w.work(ctx)
+		}()
+	}
+	for range workers {
+		<-done
+	}
+	return nil
+}
+
+// work takes recordings one after another, waiting out failures of Redis
+func (w QueueWorker) work(ctx context.Context) {
+	prefix := queuePrefix(w.Prefix)
+	retry := queueRetry
+	for ctx.Err() == nil {
+		reply, err := w.Redis.Do(ctx, "BRPOP", prefix+"jobs", int64(queuePoll/time.Second))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Failed to take recording from queue", "error", err, "retry", retry)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, maxQueueRetry)
+			continue
+		}
+		retry = queueRetry
+		items, _ := reply.([]any)
+		if len(items) != 2 {
+			continue
+		}
+		body, _ := items[1].([]byte)
+		var job queueJob
+		if err := json.Unmarshal(body, &job); err != nil || job.ID == "" {
+			slog.Warn("Skipping malformed job", "error", err)
+			continue
+		}
+		if err := w.process(ctx, prefix, job, body); err != nil && ctx.Err() == nil {
+			slog.Error("Failed to return transcription", "error", err, "job", job.ID, "file", job.File)
+		}
+	}
+}
+
+// process transcribes the recording of a job and pushes the result. A job
+// cut short by ctx ending is handed back for another worker.
+func (w QueueWorker) process(ctx context.Context, prefix string, job queueJob, body []byte) error {
+	audioKey := prefix + "audio:" + job.ID
+	reply, err := w.Redis.Do(ctx, "GET", audioKey)
+	if err != nil {
+		return err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		slog.Debug("Skipping recording the scribe gave up on", "job", job.ID, "file", job.File)
+		return nil
+	}
+
+	start := time.Now()
+	result := w.transcribe(ctx, job, data)
+	if ctx.Err() != nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queueCleanupTimeout)
+		defer cancel()
+		_, err := w.Redis.Do(ctx, "RPUSH", prefix+"jobs", body)
+		return err
+	}
+	w.Redis.Do(ctx, "DEL", audioKey)
+	result.Worker = w.Name
+	if result.Error != "" {
+		slog.Error("Failed to transcribe recording", "error", result.Error, "job", job.ID, "file", job.File)
+	} else {
+		slog.Info("Transcribed recording",
+			"job", job.ID,
+			"file", job.File,
+			"segments", len(result.Segments),
+			"duration", time.Since(start).Round(time.Millisecond))
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	resultKey := prefix + "result:" + job.ID
+	if _, err := w.Redis.Do(ctx, "LPUSH", resultKey, payload); err != nil {
+		return err
+	}
+	_, err = w.Redis.Do(ctx, "EXPIRE", resultKey, int64(queueResultTTL/time.Second))
+	return err
+}
+
+// transcribe runs the transcriber on a job's recording
+func (w QueueWorker) transcribe(ctx context.Context, job queueJob, data []byte) queueResult {
+	file, err := os.CreateTemp("", "libas-worker-*.wav")
+	if err != nil {
+		return queueResult{Error: err.Error()}
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return queueResult{Error: err.Error()}
+	}
+
+	transcriber := w.Transcriber
+	if prompted, ok := transcriber.(PromptedTranscriber); ok && job.Prompt != "" {
+		transcriber = prompted.WithPrompt(job.Prompt)
+	}
+	if detector, ok := transcriber.(LanguageDetector); ok && job.DetectLanguage {
+		transcriber = detector.DetectingLanguage()
+	}
+	var segments []Segment
+	if segmenter, ok := transcriber.(SegmentTranscriber); ok {
+		segments, err = segmenter.TranscribeSegments(ctx, file.Name())
+	} else {
+		var text string
+		if text, err = transcriber.Transcribe(ctx, file.Name()); text != "" {
+			segments = []Segment{{Text: text}}
+		}
+	}
+	if err != nil {
+		return queueResult{Error: err.Error(), Unavailable: errors.Is(err, fault.ErrTranscriberUnavailable)}
+	}
+
+	result := queueResult{Segments: make([]queueSegment, len(segments))}
+	for i, segment := range segments {
+		result.Segments[i] = queueSegment{
+			StartMs:    segment.Start.Milliseconds(),
+			EndMs:      segment.End.Milliseconds(),
+			Text:       segment.Text,
+			Confidence: segment.Confidence,
+			Words:      segment.Words,
+			Language:   segment.Language,
+		}
+	}
+	return result
+}
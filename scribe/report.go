@@ -0,0 +1,281 @@
+package scribe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Time of day reports are sent when ReportConfig.At is empty
+	defaultReportAt = "23:55"
+
+	// How long the summary command may take for one client
+	reportSummaryTimeout = 2 * time.Minute
+)
+
+// ReportConfig schedules a daily email of each client's transcript. Reports
+// are disabled without recipients.
+type ReportConfig struct {
+	// Recipients of the report
+	To []string
+
+	// Sender address, defaults to the first recipient
+	From string
+
+	// SMTP server as host:port, STARTTLS is used when the server offers it
+	SMTPAddr string
+
+	// Credentials for PLAIN authentication, none when Username is empty
+	Username string
+	Password string
+
+	// Local time of day the report is sent as HH:MM, covering that day's
+	// transcriptions up to then. Defaults to 23:55.
+	At string
+
+	// Command, split on spaces, that reads a client's transcript on stdin
+	// and prints a summary to include, e.g. an LLM command line tool
+	SummaryCommand string
+}
+
+func (c ReportConfig) enabled() bool {
+	return len(c.To) > 0
+}
+
+func (c ReportConfig) sender() string {
+	if c.From != "" {
+		return c.From
+	}
+	return c.To[0]
+}
+
+// parseTimeOfDay parses a local time of day as HH:MM into an offset from
+// midnight, using fallback when empty
+func parseTimeOfDay(at, fallback string) (time.Duration, error) {
+	if at == "" {
+		at = fallback
+	}
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", at)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// nextTimeOfDay is the first time after now at the given offset from
+// midnight
+func nextTimeOfDay(now time.Time, at time.Duration) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := midnight.Add(at)
+	if !next.After(now) {
+		next = midnight.AddDate(0, 0, 1).Add(at)
+	}
+	return next
+}
+
+// runReports sends the daily report at the configured time until ctx is
+// cancelled
+func (s *Scribe) runReports(ctx context.Context) {
+	at, err := parseTimeOfDay(s.config.Report.At, defaultReportAt)
+	if err != nil {
+		slog.Error("Daily reports disabled", "error", err)
+		return
+	}
+
+	for {
+		next := nextTimeOfDay(time.Now(), at)
+		slog.Debug("Next daily report scheduled", "at", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := s.SendReport(ctx, next.Format("20060102")); err != nil {
+			slog.Error("Failed to send daily report", "error", err)
+			s.alert("Failed to send daily report", err)
+		}
+	}
+}
+
+// reportClient is one client's section of a daily report
+type reportClient struct {
+	ClientID string
+	Summary  string
+	Lines    []reportLine
+}
+
+type reportLine struct {
+	Time string
+	Text string
+}
+
+// SendReport emails the transcriptions of a day (YYYYMMDD) to the report
+// recipients. Nothing is sent for a day without transcriptions.
+func (s *Scribe) SendReport(ctx context.Context, date string) error {
+	cfg := s.config.Report
+	if !cfg.enabled() {
+		return fmt.Errorf("no report recipients configured")
+	}
+
+	day, err := time.ParseInLocation("20060102", date, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid date %q", date)
+	}
+
+	byClient := make(map[string]*reportClient)
+	err = s.store.readDay(date, func(record StoredTranscription) bool {
+		client, ok := byClient[record.ClientID]
+		if !ok {
+			client = &reportClient{ClientID: record.ClientID}
+			byClient[record.ClientID] = client
+		}
+		client.Lines = append(client.Lines, reportLine{
+			Time: record.Message.Timestamp.Local().Format("15:04:05"),
+			Text: record.Message.Text,
+		})
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read transcriptions: %w", err)
+	}
+
+	if len(byClient) == 0 {
+		slog.Info("No transcriptions to report", "date", date)
+		return nil
+	}
+
+	clients := make([]*reportClient, 0, len(byClient))
+	for _, client := range byClient {
+		if cfg.SummaryCommand != "" {
+			client.Summary = summarize(ctx, cfg.SummaryCommand, client)
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientID < clients[j].ClientID })
+
+	subject := "libas transcripts for " + day.Format("Monday, January 2, 2006")
+	message, err := buildReport(cfg, subject, clients)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	if err := smtp.SendMail(cfg.SMTPAddr, auth, cfg.sender(), cfg.To, message); err != nil {
+		return fmt.Errorf("failed to send report: %w", err)
+	}
+
+	slog.Info("Sent daily report", "date", date, "clients", len(clients), "recipients", len(cfg.To))
+	return nil
+}
+
+// summarize runs the summary command over a client's transcript, returning
+// an empty summary when it fails
+func summarize(ctx context.Context, command string, client *reportClient) string {
+	ctx, cancel := context.WithTimeout(ctx, reportSummaryTimeout)
+	defer cancel()
+
+	var transcript strings.Builder
+	for _, line := range client.Lines {
+		fmt.Fprintf(&transcript, "[%s] %s\n", line.Time, line.Text)
+	}
+
+	args := strings.Fields(command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(transcript.String())
+	output, err := cmd.Output()
+	if err != nil {
+		slog.Warn("Failed to summarize transcript", "clientID", client.ClientID, "error", err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+var reportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<h2>{{.Subject}}</h2>
+{{range .Clients}}
+<h3>{{.ClientID}}</h3>
+{{if .Summary}}<p style="white-space: pre-wrap"><em>{{.Summary}}</em></p>{{end}}
+<table>
+{{range .Lines}}<tr><td style="color: #666; vertical-align: top; padding-right: 1em">{{.Time}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// buildReport writes the report as a multipart email with text and HTML
+// versions
+func buildReport(cfg ReportConfig, subject string, clients []*reportClient) ([]byte, error) {
+	var text strings.Builder
+	for i, client := range clients {
+		if i > 0 {
+			text.WriteString("\n")
+		}
+		fmt.Fprintf(&text, "%s (%d transcriptions)\n\n", client.ClientID, len(client.Lines))
+		if client.Summary != "" {
+			fmt.Fprintf(&text, "%s\n\n", client.Summary)
+		}
+		for _, line := range client.Lines {
+			fmt.Fprintf(&text, "%s  %s\n", line.Time, line.Text)
+		}
+	}
+
+	var html bytes.Buffer
+	if err := reportHTML.Execute(&html, map[string]any{"Subject": subject, "Clients": clients}); err != nil {
+		return nil, fmt.Errorf("failed to render report: %w", err)
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", text.String()},
+		{"text/html; charset=utf-8", html.String()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write([]byte(part.content))
+		qp.Close()
+	}
+	parts.Close()
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", cfg.sender())
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
@@ -0,0 +1,511 @@
+package scribe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/s3"
+)
+
+const (
+	// Time of day the retention policy runs when RetentionConfig.At is empty
+	defaultRetentionAt = "03:00"
+
+	// Log of retention runs kept in the recordings directory
+	retentionLogFile = "retention.jsonl"
+)
+
+// RetentionConfig expires old recordings and transcriptions each night. A
+// day expires once it is more than the given number of days old, so 7 keeps
+// the last week on top of today.
+type RetentionConfig struct {
+	// Days recordings are kept, zero keeps them forever
+	AudioDays int
+
+	// Days transcription journals are kept, zero keeps them forever
+	TranscriptDays int
+
+	// Bucket expired recordings are uploaded to before they are deleted,
+	// e.g. with a GLACIER storage class. Without one they are only deleted.
+	Archive s3.Config
+
+	// Local time of day the policy runs as HH:MM, defaults to 03:00
+	At string
+}
+
+func (c RetentionConfig) enabled() bool {
+	return c.AudioDays > 0 || c.TranscriptDays > 0
+}
+
+// enabled reports whether there is anything to purge, by the policy or
+// because backed up recordings only stay for a while
+func (r *retention) enabled() bool {
+	return r.config.enabled() || (r.backup != nil && r.backup.config.LocalDays > 0)
+}
+
+// RetentionRun records what one run of the retention policy purged
+type RetentionRun struct {
+	Time time.Time `json:"time"`
+
+	// Days whose recordings and transcriptions were removed
+	AudioDays      []string `json:"audioDays"`
+	TranscriptDays []string `json:"transcriptDays"`
+
+	// Days whose backed up recordings were removed ahead of AudioDays
+	BackedUpDays []string `json:"backedUpDays,omitempty"`
+
+	// Files uploaded to the archive bucket
+	Archived int `json:"archived"`
+
+	// Files deleted and their total size
+	DeletedFiles int   `json:"deletedFiles"`
+	DeletedBytes int64 `json:"deletedBytes"`
+
+	// Files that could not be archived or deleted, they are kept and
+	// retried on the next run
+	Errors []string `json:"errors,omitempty"`
+}
+
+// RetentionResponse describes the policy and its recent runs
+type RetentionResponse struct {
+	AudioDays      int            `json:"audioDays"`
+	TranscriptDays int            `json:"transcriptDays"`
+	Archive        string         `json:"archive,omitempty"`
+	Backup         string         `json:"backup,omitempty"`
+	BackedUpDays   int            `json:"backedUpDays,omitempty"`
+	Runs           []RetentionRun `json:"runs"`
+}
+
+// retention applies the policy, remembering its runs in the recordings
+// directory
+type retention struct {
+	config  RetentionConfig
+	dir     string
+	archive *s3.Client
+
+	// Lets recordings in the backup bucket go early when set
+	backup *backup
+
+	// Asks for a run before the scheduled one, e.g. when the disk is
+	// nearly full
+	early chan struct{}
+
+	mu sync.Mutex // Serializes runs and the run log
+}
+
+func newRetention(cfg RetentionConfig, dir string) (*retention, error) {
+	if cfg.AudioDays < 0 || cfg.TranscriptDays < 0 {
+		return nil, fmt.Errorf("retention days must not be negative")
+	}
+	if _, err := parseTimeOfDay(cfg.At, defaultRetentionAt); err != nil {
+		return nil, fmt.Errorf("invalid retention time: %w", err)
+	}
+
+	r := &retention{config: cfg, dir: dir, early: make(chan struct{}, 1)}
+	if cfg.Archive.Enabled() {
+		client, err := s3.New(cfg.Archive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure archive: %w", err)
+		}
+		r.archive = client
+	}
+	return r, nil
+}
+
+// runRetention applies the retention policy each night, and when asked
+// to run early, until ctx is cancelled
+func (s *Scribe) runRetention(ctx context.Context) {
+	at, _ := parseTimeOfDay(s.retention.config.At, defaultRetentionAt)
+
+	for {
+		next := nextTimeOfDay(time.Now(), at)
+		slog.Debug("Next retention run scheduled", "at", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-s.retention.early:
+			timer.Stop()
+			slog.Info("Running retention early")
+		}
+
+		run, err := s.retention.run(ctx, time.Now())
+		if err != nil {
+			slog.Error("Retention run failed", "error", err)
+			s.alert("Retention run failed", err)
+		} else if len(run.Errors) > 0 {
+			s.alert(fmt.Sprintf("Retention could not purge %d files", len(run.Errors)), nil)
+		}
+	}
+}
+
+// runEarly asks for a run now, if the retention policy runs at all
+func (r *retention) runEarly() {
+	select {
+	case r.early <- struct{}{}:
+	default:
+	}
+}
+
+// run purges the days that expired by now and logs what was removed
+func (r *retention) run(ctx context.Context, now time.Time) (RetentionRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run := RetentionRun{
+		Time:           now,
+		AudioDays:      make([]string, 0),
+		TranscriptDays: make([]string, 0),
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return run, fmt.Errorf("failed to read recordings directory: %w", err)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, entry := range entries {
+		day, err := time.ParseInLocation("20060102", entry.Name(), now.Location())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		dayDir := filepath.Join(r.dir, entry.Name())
+		if r.expired(day, today, r.config.AudioDays) {
+			if r.purgeAudio(ctx, entry.Name(), &run) {
+				run.AudioDays = append(run.AudioDays, entry.Name())
+			}
+		} else if r.backup != nil && r.expired(day, today, r.backup.config.LocalDays) && r.purgeBackedUp(dayDir, &run) {
+			run.BackedUpDays = append(run.BackedUpDays, entry.Name())
+		}
+		if r.expired(day, today, r.config.TranscriptDays) && r.purgeTranscripts(dayDir, &run) {
+			run.TranscriptDays = append(run.TranscriptDays, entry.Name())
+		}
+
+		// Only succeeds once the day has nothing left
+		os.Remove(dayDir)
+	}
+
+	if len(run.AudioDays) == 0 && len(run.TranscriptDays) == 0 && len(run.BackedUpDays) == 0 && len(run.Errors) == 0 {
+		slog.Debug("Retention found nothing to purge")
+		return run, nil
+	}
+
+	slog.Info("Retention purged expired data",
+		"audioDays", run.AudioDays,
+		"transcriptDays", run.TranscriptDays,
+		"backedUpDays", run.BackedUpDays,
+		"archived", run.Archived,
+		"deletedFiles", run.DeletedFiles,
+		"deletedBytes", run.DeletedBytes,
+		"errors", len(run.Errors))
+	return run, r.log(run)
+}
+
+// expired reports whether a day is more than keep days before today
+func (r *retention) expired(day, today time.Time, keep int) bool {
+	return keep > 0 && day.Before(today.AddDate(0, 0, -keep))
+}
+
+// purgeAudio archives and deletes the recordings of a day, client
+// directories and the integrity manifest included, reporting whether
+// anything was removed
+func (r *retention) purgeAudio(ctx context.Context, day string, run *RetentionRun) bool {
+	dayDir := filepath.Join(r.dir, day)
+	clients, err := os.ReadDir(dayDir)
+	if err != nil {
+		run.Errors = append(run.Errors, err.Error())
+		return false
+	}
+
+	purged := false
+	for _, client := range clients {
+		if !client.IsDir() {
+			continue
+		}
+		clientDir := filepath.Join(dayDir, client.Name())
+		files, err := os.ReadDir(clientDir)
+		if err != nil {
+			run.Errors = append(run.Errors, err.Error())
+			continue
+		}
+		for _, file := range files {
+			name := day + "/" + client.Name() + "/" + file.Name()
+			// Thumbnails and temporary files are not worth archiving
+			archive := !strings.HasSuffix(file.Name(), ".png") && !strings.HasSuffix(file.Name(), ".tmp")
+			if r.purgeFile(ctx, filepath.Join(clientDir, file.Name()), name, archive, run) {
+				purged = true
+			}
+		}
+		os.Remove(clientDir)
+	}
+
+	manifest := filepath.Join(dayDir, audio.ManifestFile)
+	if _, err := os.Stat(manifest); err == nil {
+		r.purgeFile(ctx, manifest, day+"/"+audio.ManifestFile, true, run)
+	}
+	// Nothing is left for the backup ledger to describe
+	os.Remove(filepath.Join(dayDir, backupLedgerFile))
+	return purged
+}
+
+// purgeBackedUp deletes the recordings of a day that are in the backup
+// bucket as they are now, noting their removal in the manifest
+func (r *retention) purgeBackedUp(dayDir string, run *RetentionRun) bool {
+	manifest, err := audio.ReadManifest(dayDir)
+	if err != nil {
+		run.Errors = append(run.Errors, err.Error())
+		return false
+	}
+	ledger, err := r.backup.backedUp(dayDir)
+	if err != nil {
+		run.Errors = append(run.Errors, err.Error())
+		return false
+	}
+
+	purged := false
+	for file, entry := range manifest {
+		if entry.Removed || ledger[file] != entry.SHA256 {
+			continue
+		}
+		path := filepath.Join(dayDir, filepath.FromSlash(file))
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			run.Errors = append(run.Errors, err.Error())
+			continue
+		}
+		if err := audio.RecordRemoval(path); err != nil {
+			run.Errors = append(run.Errors, err.Error())
+		}
+		// Only succeeds once the client has nothing left that day
+		os.Remove(filepath.Dir(path))
+		run.DeletedFiles++
+		run.DeletedBytes += info.Size()
+		purged = true
+	}
+	return purged
+}
+
+// purgeTranscripts deletes the transcription journal of a day
+func (r *retention) purgeTranscripts(dayDir string, run *RetentionRun) bool {
+	path := filepath.Join(dayDir, journalFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if err := os.Remove(path); err != nil {
+		run.Errors = append(run.Errors, err.Error())
+		return false
+	}
+	run.DeletedFiles++
+	run.DeletedBytes += info.Size()
+	return true
+}
+
+// purgeFile uploads a file to the archive, when there is one, and deletes
+// it. A file that fails to upload is kept.
+func (r *retention) purgeFile(ctx context.Context, path, name string, archive bool, run *RetentionRun) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		run.Errors = append(run.Errors, err.Error())
+		return false
+	}
+
+	if archive && r.archive != nil {
+		if err := r.archive.PutFile(ctx, name, path); err != nil {
+			run.Errors = append(run.Errors, err.Error())
+			return false
+		}
+		run.Archived++
+		slog.Debug("Archived expired file", "file", name, "url", r.archive.URL(name))
+	}
+
+	if err := os.Remove(path); err != nil {
+		run.Errors = append(run.Errors, err.Error())
+		return false
+	}
+	run.DeletedFiles++
+	run.DeletedBytes += info.Size()
+	return true
+}
+
+// log appends a run to the retention log
+func (r *retention) log(run RetentionRun) error {
+	file, err := os.OpenFile(filepath.Join(r.dir, retentionLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open retention log: %w", err)
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write retention log: %w", err)
+	}
+	return nil
+}
+
+// erase removes the errors about a client's files of the days inRange
+// accepts from the logged runs, returning how many were removed. Errors
+// naming the client without a day go too. The caller holds r.mu.
+func (r *retention) erase(clientID string, inRange func(day string) bool) (int, error) {
+	path := filepath.Join(r.dir, retentionLogFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read retention log: %w", err)
+	}
+
+	days := regexp.MustCompile(`(\d{8})[/\\]` + regexp.QuoteMeta(clientID))
+	erased := 0
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var run RetentionRun
+		if !bytes.Contains(line, []byte(clientID)) || json.Unmarshal(line, &run) != nil {
+			out.Write(line)
+			continue
+		}
+		var kept []string
+		for _, message := range run.Errors {
+			if strings.Contains(message, clientID) && mentionsDay(days.FindAllStringSubmatch(message, -1), inRange) {
+				erased++
+				continue
+			}
+			kept = append(kept, message)
+		}
+		run.Errors = kept
+		line, err := json.Marshal(run)
+		if err != nil {
+			return 0, err
+		}
+		out.Write(append(line, '\n'))
+	}
+	if erased == 0 {
+		return 0, nil
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, out.Bytes(), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write retention log: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to write retention log: %w", err)
+	}
+	return erased, nil
+}
+
+// mentionsDay reports whether one of the days matched is accepted, or
+// there are none
+func mentionsDay(matches [][]string, inRange func(day string) bool) bool {
+	if len(matches) == 0 {
+		return true
+	}
+	for _, match := range matches {
+		if inRange(match[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// runs reads the most recent logged runs, newest first
+func (r *retention) runs(limit int) ([]RetentionRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	runs := make([]RetentionRun, 0)
+	file, err := os.Open(filepath.Join(r.dir, retentionLogFile))
+	if os.IsNotExist(err) {
+		return runs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open retention log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var run RetentionRun
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			slog.Warn("Skipping unreadable retention log entry", "error", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read retention log: %w", err)
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Time.After(runs[j].Time) })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+// handleRetention reports the retention policy and what recent runs purged
+func (s *Scribe) handleRetention(w http.ResponseWriter, r *http.Request) {
+	limit := 30
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	response := RetentionResponse{
+		AudioDays:      s.retention.config.AudioDays,
+		TranscriptDays: s.retention.config.TranscriptDays,
+		Runs:           make([]RetentionRun, 0),
+	}
+	if s.retention.archive != nil {
+		response.Archive = s.retention.archive.URL("")
+	}
+	if s.backup != nil {
+		response.Backup = s.backup.bucket.URL("")
+		response.BackedUpDays = s.backup.config.LocalDays
+	}
+
+	runs, err := s.retention.runs(limit)
+	if err != nil {
+		slog.Error("Failed to read retention log", "error", err)
+		http.Error(w, "Failed to read retention log", http.StatusInternalServerError)
+		return
+	}
+	response.Runs = runs
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
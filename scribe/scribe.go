@@ -1,12 +1,26 @@
+// Package scribe transcribes the recordings in a directory with whisper and
+// serves the results over HTTP and WebSocket. Create one with New and call
+// Start.
 package scribe
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/events"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/latency"
+	"github.com/bosley/libas/tracing"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
 )
@@ -29,8 +43,155 @@ type Config struct {
 	// Path to whisper model
 	WhisperModel string
 
+	// Transcribes the recordings, defaults to Whisper with WhisperPath and
+	// WhisperModel. Tests can substitute a stub to run without whisper.
+	Transcriber Transcriber
+
 	// Number of worker threads for processing
 	Workers int
+
+	// Limits the CPU the default Transcriber's whisper processes take
+	Pacing PacingConfig
+
+	// Initial prompt whisper is given for every client, names, terms and
+	// jargon the recordings are likely to contain, and prompts of single
+	// clients by ID or host. Prompts set through /api/prompts override
+	// ClientPrompts. Needs a PromptedTranscriber, as the default one is.
+	Prompt        string
+	ClientPrompts map[string]string
+
+	// Languages clients are expected to speak, transcriptions in others
+	// are flagged or skipped. Needs a LanguageDetector, as the default
+	// Transcriber is.
+	Languages LanguageConfig
+
+	// Tells speech from other sounds before whisper runs. Recordings of
+	// music, knocks and the like skip whisper and are stored as sounds,
+	// published as events.Sound. Off when nil.
+	Classifier Classifier
+
+	// Turns text posted to /api/clients/{id}/say into speech played on the
+	// client, see HandleSay. The endpoint is off when nil.
+	Synthesizer Synthesizer
+
+	// Sends subscribers a translation of every transcription
+	Translation TranslationConfig
+
+	// Names the enrolled speaker of each transcription by voice print
+	Speakers SpeakerConfig
+
+	// Replaces client IDs with pseudonyms in API responses and WebSocket
+	// messages, resolving them in requests, and leaves out client
+	// addresses. Off when nil.
+	Pseudonyms Pseudonymizer
+
+	// Transcribes low-confidence segments again with a larger model and
+	// drops those whisper is unsure of. Needs a SegmentTranscriber, as the
+	// default one is.
+	Confidence ConfidenceConfig
+
+	// Cuts long recordings into windows transcribed one by one
+	Segmentation SegmentationConfig
+
+	// Chapters and action items of meeting transcripts
+	Meetings MeetingConfig
+
+	// Learns the terms of each client from corrected transcriptions
+	Corrections CorrectionConfig
+
+	// Remote scribes whose transcriptions are aggregated with these
+	Federation FederationConfig
+
+	// Directory audio files dropped into are transcribed from
+	Inbox InboxConfig
+
+	// Chat bots voice notes are transcribed from
+	Bot BotConfig
+
+	// Origins allowed to call the API from a browser ("*" for any).
+	// Leave empty to disable CORS.
+	CORSAllowedOrigins []string
+
+	// Methods allowed for cross-origin requests, defaults to GET, POST, OPTIONS
+	CORSAllowedMethods []string
+
+	// Allow cookies and authorization headers on cross-origin requests from
+	// the origins listed, which may then not include "*"
+	CORSAllowCredentials bool
+
+	// Log every HTTP request (method, path, status, latency, remote IP)
+	AccessLog bool
+
+	// Sign-in for the dashboard and API, which are open when unset
+	Auth AuthConfig
+
+	// Convert recordings to FLAC once they are transcribed. The audio
+	// endpoint decodes them back to WAV transparently.
+	ArchiveFLAC bool
+
+	// Clients, by ID or the host they connect from, whose recordings are
+	// deleted once transcribed, keeping only the text. "*" selects every
+	// client. Recordings that fail to transcribe are kept to be retried,
+	// and none are backed up or pushed to outputs.
+	TextOnly []string
+
+	// Prepare whisper copies of any audio file that appears in a client
+	// directory, for recordings directories filled by another recorder or
+	// rsync instead of the audio server. Files must appear complete, e.g.
+	// by being renamed into place.
+	ConvertRecordings bool
+
+	// Processing applied when converting recordings
+	ConvertOptions audio.ConvertOptions
+
+	// Daily transcript email
+	Report ReportConfig
+
+	// Nightly expiry of old recordings and transcriptions
+	Retention RetentionConfig
+
+	// Limits of the transcriptions kept in memory
+	Cache CacheConfig
+
+	// Transmissions of a client following each other within this gap form
+	// a session, a conversation. Defaults to 5 minutes, negative starts a
+	// session with every transmission.
+	SessionGap time.Duration
+
+	// Mirroring of recordings to a bucket as they are finalized
+	Backup BackupConfig
+
+	// WebDAV and SFTP destinations, e.g. a NAS, transcribed recordings and
+	// their transcripts are pushed to
+	Outputs []Output
+
+	// Calendars whose event titles label the transcriptions made during
+	// the events
+	Calendars []Calendar
+
+	// How often calendars are read, defaults to 5 minutes
+	CalendarInterval time.Duration
+
+	// Records spans of queued, transcribed and broadcast recordings when
+	// set, continuing traces handed off by an audio server sharing it
+	Tracer *tracing.Tracer
+
+	// Latency of each stage from a recording being written to its
+	// transcription reaching subscribers, served on /api/latency. Sharing
+	// an audio server's recorder adds the time from the end of speech.
+	// Defaults to a recorder of its own.
+	Latency *latency.Recorder
+
+	// Receive transcriptions, alerts, client presence and failed jobs
+	EventSinks []events.Sink
+
+	// Alerts on a stuck queue, failing whisper, a full disk or silent
+	// clients, published to the event sinks
+	Health HealthConfig
+
+	// Receives failed transcriptions and sign-ins and the errors behind
+	// alerts, classified by the fault package
+	ErrorReporter fault.Reporter
 }
 
 // Scribe manages the transcription service
@@ -41,16 +202,102 @@ type Scribe struct {
 	watcher *fsnotify.Watcher
 
 	// Transcription management
-	clients     sync.Map // map[string]*ClientTranscriptions
-	subscribers sync.Map // map[string][]*wsConnection
+	store         *store
+	clients       sync.Map // map[string]*ClientTranscriptions
+	cached        atomic.Int64
+	evictMu       sync.Mutex
+	subscribers   sync.Map // map[string][]*wsConnection
+	subscribersMu sync.Mutex
+	connections   sync.Map   // map[*wsConnection]struct{} of every open WebSocket
+	presence      sync.Map   // map[string]PresenceMessage of connected audio clients
+	presenceMu    sync.Mutex // held to change presence, so changes made at once aren't lost
+	hosts         sync.Map   // map[string]string of the host each client last connected from
+	sessions      map[string]sessionState
+	sessionsMu    sync.Mutex
+
+	// Held from giving a transcription its sequence number until it is
+	// broadcast, so subscribers receive sequence numbers in order and a
+	// replay from the last one they saw misses nothing
+	sequenceMu sync.Mutex
 
 	// Processing queue
-	queue   chan TranscriptionJob
-	workers sync.WaitGroup
+	queue    chan TranscriptionJob
+	queued   sync.Map // map[string]struct{} of file paths waiting or in progress
+	awaiting sync.Map // map[string]chan transcriptionResult of file paths whose transcription is waited for
+	workers  sync.WaitGroup
+
+	// Set under queueMu when Stop closes the queue, so producers still
+	// running never send on it closed
+	queueMu     sync.RWMutex
+	queueClosed bool
 
 	// HTTP/Websocket
 	server   *http.Server
 	upgrader websocket.Upgrader
+
+	// Closed once the HTTP API is listening on addr
+	ready chan struct{}
+	addr  net.Addr
+
+	retention *retention
+	backup    *backup
+	outputs   *outputs
+	calendars []*calendarState
+
+	// Signs users in, nil when the API is open
+	auth *auth
+
+	// Private key of the TLS certificate, signs deletion reports
+	signer crypto.Signer
+
+	// Runs the escalation model, nil without one
+	escalation SegmentTranscriber
+
+	// Initial prompts of the clients
+	prompts *prompts
+
+	// Config.TextOnly as a set
+	textOnly map[string]bool
+
+	// Resumable uploads of long recordings
+	uploads *chunkedUploads
+
+	// Voice prints of the enrolled speakers
+	speakers *voicePrints
+
+	// Plays speech on audio clients, nil without an audio server
+	say func(clientID string, speech *audio.PCM) error
+
+	// Routes audio between audio clients, nil without an audio server
+	intercom Intercom
+
+	// Mutes audio clients, nil without an audio server
+	muter Muter
+
+	// Has audio clients record continuously during meetings, nil without
+	// an audio server
+	recorder ContinuousRecorder
+
+	// Meetings started through the API
+	meetings *meetings
+
+	// Corrected transcriptions and the vocabulary learned from them
+	corrections *corrections
+
+	// Progress through the remote scribes aggregated
+	federation *federation
+
+	// Files taken from the inbox, nil without one
+	inbox *inbox
+
+	// Context Start was called with, ending work handlers leave running
+	ctx context.Context
+
+	// Pipeline state for the health checks
+	health health
+
+	// Delivers events to the configured sinks
+	events *events.Bus
 }
 
 // New creates a new Scribe instance
@@ -58,6 +305,57 @@ func New(cfg Config) (*Scribe, error) {
 	if cfg.Workers <= 0 {
 		cfg.Workers = 2
 	}
+	var pacer *Pacer
+	if cfg.Pacing.enabled() && (cfg.Transcriber == nil || cfg.Confidence.EscalateModel != "") {
+		var err error
+		if pacer, err = NewPacer(cfg.Pacing); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Transcriber == nil {
+		cfg.Transcriber = Whisper{Path: cfg.WhisperPath, Model: cfg.WhisperModel, Pacer: pacer}
+	}
+	if err := cfg.Confidence.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Languages.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Speakers.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Translation.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Federation.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Inbox.validate(); err != nil {
+		return nil, err
+	}
+	cfg.Cache = cfg.Cache.withDefaults()
+	cfg.Segmentation = cfg.Segmentation.withDefaults()
+	cfg.Corrections = cfg.Corrections.withDefaults()
+	cfg.Inbox = cfg.Inbox.withDefaults()
+	if cfg.SessionGap == 0 {
+		cfg.SessionGap = defaultSessionGap
+	}
+	if cfg.Latency == nil {
+		cfg.Latency = latency.New()
+	}
+
+	if cfg.CORSAllowCredentials && slices.Contains(cfg.CORSAllowedOrigins, "*") {
+		return nil, fmt.Errorf("CORS credentials need the allowed origins listed, not \"*\"")
+	}
+
+	if cfg.Report.enabled() {
+		if cfg.Report.SMTPAddr == "" {
+			return nil, fmt.Errorf("daily reports need an SMTP server")
+		}
+		if _, err := parseTimeOfDay(cfg.Report.At, defaultReportAt); err != nil {
+			return nil, fmt.Errorf("invalid report time: %w", err)
+		}
+	}
 
 	// Load TLS certificates
 	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
@@ -69,31 +367,114 @@ func New(cfg Config) (*Scribe, error) {
 		Certificates: []tls.Certificate{cert},
 	}
 
+	st, err := newStore(cfg.RecordingsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transcription store: %w", err)
+	}
+
+	prompts, err := loadPrompts(cfg.RecordingsDir, cfg.ClientPrompts)
+	if err != nil {
+		return nil, err
+	}
+	speakers, err := loadVoicePrints(cfg.RecordingsDir)
+	if err != nil {
+		return nil, err
+	}
+	meetings, err := loadMeetings(cfg.RecordingsDir)
+	if err != nil {
+		return nil, err
+	}
+	corrections, err := loadCorrections(cfg.RecordingsDir, cfg.Corrections)
+	if err != nil {
+		return nil, err
+	}
+	federation, err := loadFederation(cfg.RecordingsDir, cfg.Federation)
+	if err != nil {
+		return nil, err
+	}
+	var inbox *inbox
+	if cfg.Inbox.Dir != "" {
+		if inbox, err = loadInbox(cfg.RecordingsDir, cfg.Inbox); err != nil {
+			return nil, err
+		}
+	}
+
+	retention, err := newRetention(cfg.Retention, cfg.RecordingsDir)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := newBackup(cfg.Backup, cfg.RecordingsDir)
+	if err != nil {
+		return nil, err
+	}
+	retention.backup = backup
+	auth, err := newAuth(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create watcher: %w", err)
 	}
 
 	s := &Scribe{
-		config:  cfg,
-		watcher: watcher,
-		queue:   make(chan TranscriptionJob, 100),
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // TODO: Implement proper origin checking
-			},
-		},
+		config:      cfg,
+		watcher:     watcher,
+		store:       st,
+		sessions:    make(map[string]sessionState),
+		prompts:     prompts,
+		speakers:    speakers,
+		meetings:    meetings,
+		corrections: corrections,
+		federation:  federation,
+		inbox:       inbox,
+		queue:       make(chan TranscriptionJob, 100),
+		ready:       make(chan struct{}),
+
+		textOnly:  make(map[string]bool),
+		uploads:   newChunkedUploads(cfg.RecordingsDir),
+		retention: retention,
+		backup:    backup,
+		outputs:   newOutputs(cfg.Outputs),
+		calendars: newCalendars(cfg.Calendars),
+		auth:      auth,
+		events:    events.NewBus(cfg.EventSinks...),
 		server: &http.Server{
 			Addr:      cfg.HTTPAddr,
 			TLSConfig: tlsConfig,
 		},
 	}
+	s.signer, _ = cert.PrivateKey.(crypto.Signer)
+	for _, client := range cfg.TextOnly {
+		s.textOnly[client] = true
+	}
+	if backup != nil {
+		backup.skip = s.discardsAudio
+	}
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin: s.checkOrigin,
+	}
+	if cfg.Confidence.EscalateModel != "" {
+		s.escalation = Whisper{Path: cfg.WhisperPath, Model: cfg.Confidence.EscalateModel, Pacer: pacer}
+	}
 
 	return s, nil
 }
 
 // Start begins the Scribe service
 func (s *Scribe) Start(ctx context.Context) error {
+	// Restore today's transcriptions from the journal
+	if err := s.loadToday(); err != nil {
+		return fmt.Errorf("failed to load transcriptions: %w", err)
+	}
+	s.resumeUploads()
+	s.ctx = ctx
+	s.resumeMeetings(ctx)
+	for _, site := range s.config.Federation.Sites {
+		go s.federate(ctx, site)
+	}
+
 	// Start the worker pool
 	for i := 0; i < s.config.Workers; i++ {
 		s.workers.Add(1)
@@ -102,15 +483,102 @@ func (s *Scribe) Start(ctx context.Context) error {
 
 	// Start the file system watcher
 	go s.watchFiles(ctx)
+	if s.inbox != nil {
+		go s.runInbox(ctx)
+	}
+	for _, m := range s.config.Bot.Messengers {
+		go s.runBot(ctx, m)
+	}
+
+	if s.config.Report.enabled() {
+		go s.runReports(ctx)
+	}
+	if s.retention.enabled() {
+		go s.runRetention(ctx)
+	}
+	if s.config.Cache.MaxAge > 0 {
+		go s.runCacheSweep(ctx)
+	}
+	if s.backup != nil {
+		go s.runBackup(ctx)
+	}
+	for _, target := range s.outputs.targets {
+		go s.runOutput(ctx, target)
+	}
+	if len(s.calendars) > 0 {
+		go s.runCalendars(ctx)
+	}
+	if s.config.Health.enabled() {
+		s.health.progress.Store(time.Now().UnixNano())
+		go s.runHealth(ctx)
+	}
 
 	// Start the HTTP server
 	return s.startHTTP(ctx)
 }
 
+// Ready is closed once Start has the HTTP API listening
+func (s *Scribe) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the address the HTTP API listens on, e.g. to find the port
+// chosen for an HTTPAddr of port 0, or nil until Ready is closed
+func (s *Scribe) Addr() net.Addr {
+	select {
+	case <-s.ready:
+		return s.addr
+	default:
+		return nil
+	}
+}
+
+// Stats is a snapshot of the scribe's load, for diagnostics
+type Stats struct {
+	// Recordings waiting for a worker and being transcribed
+	Queued       int `json:"queued"`
+	Transcribing int `json:"transcribing"`
+
+	// Open WebSocket connections
+	Subscribers int `json:"subscribers"`
+
+	// Audio clients known today and those connected
+	Clients   int `json:"clients"`
+	Connected int `json:"connected"`
+
+	// Transcriptions held in memory
+	Cached int `json:"cached"`
+}
+
+// Stats returns the current load
+func (s *Scribe) Stats() Stats {
+	stats := Stats{
+		Queued:       len(s.queue),
+		Transcribing: int(s.health.running.Load()),
+		Cached:       int(s.cached.Load()),
+	}
+	count := func(n *int) func(key, value interface{}) bool {
+		return func(key, value interface{}) bool {
+			*n++
+			return true
+		}
+	}
+	s.connections.Range(count(&stats.Subscribers))
+	s.clients.Range(count(&stats.Clients))
+	s.presence.Range(count(&stats.Connected))
+	return stats
+}
+
 // Stop gracefully shuts down the Scribe service
 func (s *Scribe) Stop(ctx context.Context) error {
-	// Stop accepting new jobs
-	close(s.queue)
+	// Stop accepting new jobs. Uploads, the inbox and bots may still be
+	// queueing, they get errStopping from now on.
+	s.queueMu.Lock()
+	if !s.queueClosed {
+		s.queueClosed = true
+		close(s.queue)
+	}
+	s.queueMu.Unlock()
 
 	// Wait for workers to finish
 	done := make(chan struct{})
@@ -126,6 +594,15 @@ func (s *Scribe) Stop(ctx context.Context) error {
 		return fmt.Errorf("shutdown timed out")
 	}
 
+	// Deliver the events of the last transcriptions
+	if err := s.events.Close(ctx); err != nil {
+		slog.Warn("Failed to deliver events", "error", err)
+	}
+
+	// Close subscribers with proper close frames, the HTTP server does
+	// not manage hijacked WebSocket connections
+	s.closeSubscribers(ctx)
+
 	// Stop the HTTP server
 	if s.server != nil {
 		if err := s.server.Shutdown(ctx); err != nil {
@@ -140,3 +617,44 @@ func (s *Scribe) Stop(ctx context.Context) error {
 
 	return nil
 }
+
+// alert publishes an alert event for something needing attention
+func (s *Scribe) alert(message string, err error) {
+	data := events.AlertData{Message: message}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	s.events.Publish(events.Event{Type: events.Alert, Data: data})
+	if err != nil {
+		s.report(err, message)
+	}
+}
+
+// report hands a failure to the error reporter, with tags as name, value
+// pairs
+func (s *Scribe) report(err error, op string, tags ...string) {
+	if s.config.ErrorReporter == nil {
+		return
+	}
+	reported := map[string]string{"component": "scribe", "op": op}
+	for i := 0; i+1 < len(tags); i += 2 {
+		reported[tags[i]] = tags[i+1]
+	}
+	s.config.ErrorReporter.Report(err, reported)
+}
+
+// loadToday fills the in-memory transcriptions from today's journal
+func (s *Scribe) loadToday() error {
+	count := 0
+	err := s.store.readDay(getCurrentDateDir(), func(record StoredTranscription) bool {
+		s.remember(record.ClientID, record.Message)
+		count++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Restored transcriptions from journal", "count", count)
+	return nil
+}
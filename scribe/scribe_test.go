@@ -0,0 +1,39 @@
+package scribe
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bosley/libas/internal/testcert"
+)
+
+// newTestScribe creates a scribe over a temporary recordings directory,
+// without starting it
+func newTestScribe(t *testing.T, cfg Config) *Scribe {
+	t.Helper()
+	dir := t.TempDir()
+	cfg.CertFile, cfg.KeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := testcert.Write(cfg.CertFile, cfg.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RecordingsDir == "" {
+		cfg.RecordingsDir = filepath.Join(dir, "recordings")
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// subscribe adds a subscriber of every client that is not connected, its
+// messages left in its send channel
+func subscribe(s *Scribe, size int) *wsConnection {
+	c := &wsConnection{
+		send:          make(chan []byte, size),
+		scribe:        s,
+		subscriptions: map[string]bool{allClients: true},
+	}
+	s.subscribers.Store(allClients, []*wsConnection{c})
+	return c
+}
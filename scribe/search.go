@@ -0,0 +1,159 @@
+package scribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Results returned by a search unless "limit" is given
+	defaultSearchLimit = 100
+
+	// Upper bound on the "limit" query parameter
+	maxSearchLimit = 1000
+)
+
+// searchQuery selects stored transcriptions. Every term must appear in the
+// text and the event in the title of a calendar event, ignoring case.
+type searchQuery struct {
+	terms    []string
+	event    string
+	clientID string
+	from     string
+	to       string
+	limit    int
+
+	// Limits results to the clients the searching user may view
+	visible func(clientID string) bool
+}
+
+func (q searchQuery) matches(record StoredTranscription) bool {
+	if q.clientID != "" && record.ClientID != q.clientID {
+		return false
+	}
+	if q.visible != nil && !q.visible(record.ClientID) {
+		return false
+	}
+	text := strings.ToLower(record.Message.Text)
+	for _, term := range q.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	if q.event == "" {
+		return true
+	}
+	for _, title := range record.Message.Events {
+		if strings.Contains(strings.ToLower(title), q.event) {
+			return true
+		}
+	}
+	return false
+}
+
+// search returns the most recent transcriptions matching the query, oldest
+// first
+func (st *store) search(q searchQuery) ([]StoredTranscription, error) {
+	days, err := st.days()
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk back from the newest day so the limit keeps the latest matches
+	results := make([]StoredTranscription, 0)
+	for i := len(days) - 1; i >= 0 && len(results) < q.limit; i-- {
+		day := days[i]
+		if (q.from != "" && day < q.from) || (q.to != "" && day > q.to) {
+			continue
+		}
+
+		matches := make([]StoredTranscription, 0)
+		if err := st.readDay(day, func(record StoredTranscription) bool {
+			if q.matches(record) {
+				matches = append(matches, record)
+			}
+			return true
+		}); err != nil {
+			return nil, err
+		}
+
+		for j := len(matches) - 1; j >= 0 && len(results) < q.limit; j-- {
+			results = append(results, matches[j])
+		}
+	}
+
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	return results, nil
+}
+
+// handleSearch finds stored transcriptions containing every word of the "q"
+// query parameter, or made during calendar events whose title contains
+// "event". "clientId", "from" and "to" (YYYYMMDD, inclusive) narrow the
+// search and "limit" caps the number of results, keeping the newest.
+func (s *Scribe) handleSearch(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	q := searchQuery{
+		terms:    strings.Fields(strings.ToLower(params.Get("q"))),
+		event:    strings.ToLower(strings.TrimSpace(params.Get("event"))),
+		clientID: params.Get("clientId"),
+		from:     params.Get("from"),
+		to:       params.Get("to"),
+		limit:    defaultSearchLimit,
+	}
+	u := requestUser(r)
+	q.visible = func(clientID string) bool { return s.canView(u, clientID) }
+	if len(q.terms) == 0 && q.event == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+	if q.clientID != "" {
+		if _, err := uuid.Parse(q.clientID); err != nil {
+			http.Error(w, "Invalid client ID", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, date := range []string{q.from, q.to} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("20060102", date); err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.limit = limit
+	}
+
+	results, err := s.store.search(q)
+	if err != nil {
+		slog.Error("Failed to search transcriptions", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Debug("Searched transcriptions",
+		"terms", q.terms,
+		"event", q.event,
+		"clientID", q.clientID,
+		"results", len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
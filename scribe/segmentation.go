@@ -0,0 +1,201 @@
+package scribe
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/audio"
+)
+
+const (
+	// Segmentation of long recordings when SegmentationConfig leaves it zero
+	defaultSegmentLongerThan = 10 * time.Minute
+	defaultSegmentWindow     = 5 * time.Minute
+	defaultSegmentOverlap    = 5 * time.Second
+)
+
+// SegmentationConfig cuts long recordings, such as chunked uploads, into
+// windows whisper transcribes one by one, stitching their transcriptions
+// back together in order with times into the whole recording. Zero uses
+// the default of a setting.
+type SegmentationConfig struct {
+	// Recordings longer than this are cut, defaults to 10 minutes. A
+	// negative value never cuts them.
+	LongerThan time.Duration
+
+	// Length of a window, defaults to 5 minutes
+	Window time.Duration
+
+	// Audio neighbouring windows share, so words at a cut are heard whole
+	// by one of them, defaults to 5 seconds. Segments are kept from the
+	// window they start in up to the middle of the overlap.
+	Overlap time.Duration
+
+	// Cut at the pause nearest the end of each window instead, without
+	// overlap. Speech running longer than a window is a window of its own.
+	AtSilence bool
+
+	// Windows transcribed at once, defaults to one
+	Parallel int
+}
+
+func (c SegmentationConfig) withDefaults() SegmentationConfig {
+	if c.LongerThan == 0 {
+		c.LongerThan = defaultSegmentLongerThan
+	}
+	if c.Window <= 0 {
+		c.Window = defaultSegmentWindow
+	}
+	if c.Overlap == 0 {
+		c.Overlap = defaultSegmentOverlap
+	}
+	c.Overlap = min(max(c.Overlap, 0), c.Window/2)
+	if c.Parallel <= 0 {
+		c.Parallel = 1
+	}
+	return c
+}
+
+// segmentWindow is a stretch of a recording transcribed on its own.
+// Segments starting between keepFrom and keepTo are kept.
+type segmentWindow struct {
+	from, to         time.Duration
+	keepFrom, keepTo time.Duration
+}
+
+// transcribeRecording transcribes a client's recording, in windows when
+// it is longer than segmentation allows
+func (s *Scribe) transcribeRecording(ctx context.Context, path, clientID string) ([]Segment, error) {
+	c := s.config.Segmentation
+	duration := recordingDuration(path)
+	if c.LongerThan < 0 || duration <= c.LongerThan {
+		return s.transcribeSegments(ctx, path, clientID)
+	}
+	pcm, err := audio.ReadWav(path)
+	if err != nil {
+		return nil, err
+	}
+
+	windows := fixedWindows(duration, c)
+	if c.AtSilence {
+		windows = silenceWindows(pcm, duration, c)
+	}
+	slog.Info("Transcribing long recording in windows",
+		"file", filepath.Base(path),
+		"clientID", clientID,
+		"duration", duration.Round(time.Second),
+		"windows", len(windows))
+
+	results := make([][]Segment, len(windows))
+	errs := make([]error, len(windows))
+	slots := make(chan struct{}, c.Parallel)
+	var wg sync.WaitGroup
+	for i, window := range windows {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i], errs[i] = s.transcribeWindow(ctx, pcm, clientID, window)
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var segments []Segment
+	for _, result := range results {
+		segments = append(segments, result...)
+	}
+	return segments, nil
+}
+
+// transcribeWindow transcribes one window of a recording, returning the
+// segments it keeps with times into the whole recording
+func (s *Scribe) transcribeWindow(ctx context.Context, pcm *audio.PCM, clientID string, window segmentWindow) ([]Segment, error) {
+	clip, err := cutClip(pcm, window.from, window.to)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(clip)
+
+	segments, err := s.transcribeSegments(ctx, clip, clientID)
+	if err != nil {
+		return nil, err
+	}
+	var kept []Segment
+	for _, segment := range segments {
+		// Untimed segments cannot be placed and are kept whole
+		if segment.End > segment.Start {
+			segment.Start += window.from
+			segment.End += window.from
+			if segment.Start < window.keepFrom || segment.Start >= window.keepTo {
+				continue
+			}
+		}
+		words := make([]Word, len(segment.Words))
+		for i, word := range segment.Words {
+			word.StartMs += window.from.Milliseconds()
+			word.EndMs += window.from.Milliseconds()
+			words[i] = word
+		}
+		if segment.Words != nil {
+			segment.Words = words
+		}
+		kept = append(kept, segment)
+	}
+	return kept, nil
+}
+
+// fixedWindows cuts a recording into windows of the configured length
+// sharing the overlap, each keeping segments up to the middle of it
+func fixedWindows(duration time.Duration, c SegmentationConfig) []segmentWindow {
+	var windows []segmentWindow
+	step := c.Window - c.Overlap
+	for from := time.Duration(0); ; from += step {
+		window := segmentWindow{from: from, to: min(from+c.Window, duration), keepTo: duration}
+		if from > 0 {
+			window.keepFrom = from + c.Overlap/2
+			windows[len(windows)-1].keepTo = window.keepFrom
+		}
+		windows = append(windows, window)
+		if window.to >= duration {
+			return windows
+		}
+	}
+}
+
+// silenceWindows cuts a recording in the middle of the pause nearest the
+// end of each window
+func silenceWindows(pcm *audio.PCM, duration time.Duration, c SegmentationConfig) []segmentWindow {
+	// SplitOnSilence only offsets a start that is set
+	base := time.Unix(1, 0)
+	utterances := audio.SplitOnSilence(&audio.Segment{PCM: *pcm, StartedAt: base}, audio.SilenceOptions{})
+
+	var windows []segmentWindow
+	from, end := time.Duration(0), time.Duration(0)
+	for _, utterance := range utterances {
+		start := utterance.StartedAt.Sub(base)
+		if end > from && start+utterance.Duration() > from+c.Window {
+			cut := end + (start-end)/2
+			windows = append(windows, segmentWindow{from: from, to: cut, keepFrom: from, keepTo: cut})
+			from = cut
+		}
+		end = start + utterance.Duration()
+	}
+	return append(windows, segmentWindow{from: from, to: duration, keepFrom: from, keepTo: duration})
+}
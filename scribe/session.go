@@ -0,0 +1,177 @@
+package scribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Gap between transmissions after which a new session starts, unless
+// SessionGap is given
+const defaultSessionGap = 5 * time.Minute
+
+// Session is a conversation, transmissions of a client following each
+// other within the session gap
+type Session struct {
+	// Sequence number of the session's first transcription
+	ID uint64 `json:"id"`
+
+	// Timestamps of the first and last transcription
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Text of all transcriptions joined in order
+	Text string `json:"text"`
+
+	Transcriptions []TranscriptionMessage `json:"transcriptions"`
+}
+
+// sessionState is the session a client's next transcription may continue
+type sessionState struct {
+	id   uint64
+	last time.Time
+}
+
+// appendToSession persists msg as part of the client's current session
+// when it follows the last transcription within the session gap, and as
+// the start of a new session otherwise
+func (s *Scribe) appendToSession(clientID string, msg TranscriptionMessage) (TranscriptionMessage, error) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	current, ok := s.sessions[clientID]
+	if !ok {
+		current, ok = s.lastSession(clientID)
+	}
+	if ok && s.continuesSession(current.last, msg.Timestamp) {
+		msg.Session = current.id
+	}
+
+	msg, err := s.store.append(clientID, msg)
+	if err != nil {
+		return msg, err
+	}
+
+	// Clients reconnect under new IDs, ended sessions are forgotten
+	for id, state := range s.sessions {
+		if !s.continuesSession(state.last, msg.Timestamp) {
+			delete(s.sessions, id)
+		}
+	}
+	if msg.Session == current.id && current.last.After(msg.Timestamp) {
+		return msg, nil
+	}
+	s.sessions[clientID] = sessionState{id: msg.Session, last: msg.Timestamp}
+	return msg, nil
+}
+
+// lastSession finds the session of a client's newest cached transcription,
+// for the first transcription after a restart
+func (s *Scribe) lastSession(clientID string) (sessionState, bool) {
+	value, ok := s.clients.Load(clientID)
+	if !ok {
+		return sessionState{}, false
+	}
+	messages := value.(*ClientTranscriptions).snapshot()
+	if len(messages) == 0 || messages[len(messages)-1].Session == 0 {
+		return sessionState{}, false
+	}
+	last := messages[len(messages)-1]
+	return sessionState{id: last.Session, last: last.Timestamp}, true
+}
+
+// continuesSession reports whether a transmission at t is close enough to
+// one at last to be part of the same conversation. Workers finish
+// recordings out of order, so t may come before last.
+func (s *Scribe) continuesSession(last, t time.Time) bool {
+	gap := t.Sub(last)
+	return s.config.SessionGap > 0 && gap < s.config.SessionGap && -gap < s.config.SessionGap
+}
+
+// groupSessions groups transcriptions into sessions in the order they were
+// made. Transcriptions stored before sessions existed are grouped by the
+// session gap.
+func (s *Scribe) groupSessions(messages []TranscriptionMessage) []Session {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+
+	sessions := make([]Session, 0)
+	index := make(map[uint64]int)
+	for _, msg := range messages {
+		id := msg.Session
+		if id == 0 {
+			id = msg.Sequence
+			if n := len(sessions); n > 0 {
+				previous := sessions[n-1].Transcriptions
+				if last := previous[len(previous)-1]; last.Session == 0 && s.continuesSession(last.Timestamp, msg.Timestamp) {
+					id = sessions[n-1].ID
+				}
+			}
+		}
+
+		i, ok := index[id]
+		if !ok {
+			i = len(sessions)
+			index[id] = i
+			sessions = append(sessions, Session{ID: id, Start: msg.Timestamp})
+		}
+		session := &sessions[i]
+		session.End = msg.Timestamp
+		if session.Text != "" {
+			session.Text += " "
+		}
+		session.Text += msg.Text
+		session.Transcriptions = append(session.Transcriptions, msg)
+	}
+	return sessions
+}
+
+// handleGetSessions serves a client's transcriptions from one day grouped
+// into sessions. The optional "date" query parameter (YYYYMMDD) defaults
+// to today.
+func (s *Scribe) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = getCurrentDateDir()
+	}
+	day, err := time.ParseInLocation("20060102", date, time.Local)
+	if err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	messages, ok, err := s.messagesFrom(clientID, day)
+	if !ok {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to read transcriptions", "error", err, "clientID", clientID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	dayMessages := make([]TranscriptionMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Timestamp.Before(day.AddDate(0, 0, 1)) {
+			dayMessages = append(dayMessages, msg)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.groupSessions(dayMessages)); err != nil {
+		slog.Error("Failed to encode response", "error", err, "clientID", clientID)
+	}
+}
@@ -0,0 +1,422 @@
+package scribe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/tracing"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// File in the recordings directory enrolled voice prints are kept in
+	speakersFile = "speakers.json"
+
+	// Similarity a voice print needs to an enrolled speaker's, unless
+	// Threshold is given
+	defaultSpeakerThreshold = 0.8
+
+	// Longest speaker name accepted
+	maxSpeakerName = 64
+)
+
+// VoicePrinter turns the speech in the whisper copy of a recording into a
+// speaker embedding, the recordings of one speaker giving vectors that
+// point the same way
+type VoicePrinter interface {
+	VoicePrint(ctx context.Context, path string) ([]float64, error)
+}
+
+// CepstralVoicePrinter computes voice prints with audio.VoicePrint
+type CepstralVoicePrinter struct{}
+
+func (CepstralVoicePrinter) VoicePrint(ctx context.Context, path string) ([]float64, error) {
+	pcm, err := audio.ReadWav(path)
+	if err != nil {
+		return nil, err
+	}
+	return audio.VoicePrint(pcm.Samples, pcm.SampleRate), nil
+}
+
+// CommandVoicePrinter runs a command, e.g. a SpeechBrain or Resemblyzer
+// script, with the path of the recording appended. It prints the embedding
+// as numbers separated by spaces or commas, or as a JSON array, and nothing
+// for a recording without speech.
+type CommandVoicePrinter struct {
+	Command string
+}
+
+func (c CommandVoicePrinter) VoicePrint(ctx context.Context, path string) ([]float64, error) {
+	args := strings.Fields(c.Command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no voice print command")
+	}
+	output, err := exec.CommandContext(ctx, args[0], append(args[1:], path)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run voice print command: %w", err)
+	}
+
+	fields := strings.FieldsFunc(string(output), func(r rune) bool {
+		return r == ',' || r == '[' || r == ']' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	print := make([]float64, 0, len(fields))
+	for _, field := range fields {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid voice print value %q", field)
+		}
+		print = append(print, v)
+	}
+	if len(print) == 0 {
+		return nil, nil
+	}
+	return print, nil
+}
+
+// SpeakerConfig identifies who is speaking by comparing the voice print of
+// each recording with those of speakers enrolled through /api/speakers
+type SpeakerConfig struct {
+	// Computes voice prints, identification is off when nil
+	Printer VoicePrinter
+
+	// Cosine similarity from -1 to 1 a voice print needs to an enrolled
+	// speaker's to be taken for them, 0.8 when zero
+	Threshold float64
+}
+
+func (c SpeakerConfig) validate() error {
+	if c.Threshold < -1 || c.Threshold > 1 {
+		return fmt.Errorf("speaker threshold must be between -1 and 1")
+	}
+	return nil
+}
+
+// enrolledSpeaker holds the voice prints of the samples a speaker was
+// enrolled with
+type enrolledSpeaker struct {
+	Prints [][]float64 `json:"prints"`
+
+	// Recordings enrolled, as clientID/file
+	Samples []string `json:"samples"`
+}
+
+// centroid is the mean direction of a speaker's voice prints
+func (e *enrolledSpeaker) centroid() []float64 {
+	if len(e.Prints) == 0 {
+		return nil
+	}
+	sum := make([]float64, len(e.Prints[0]))
+	for _, print := range e.Prints {
+		if len(print) != len(sum) {
+			continue
+		}
+		norm := vectorNorm(print)
+		for i, v := range print {
+			sum[i] += v / norm
+		}
+	}
+	return sum
+}
+
+// voicePrints holds the enrolled speakers
+type voicePrints struct {
+	path string
+
+	mu       sync.RWMutex
+	speakers map[string]*enrolledSpeaker
+}
+
+// loadVoicePrints reads the enrolled speakers
+func loadVoicePrints(recordingsDir string) (*voicePrints, error) {
+	v := &voicePrints{
+		path:     filepath.Join(recordingsDir, speakersFile),
+		speakers: make(map[string]*enrolledSpeaker),
+	}
+	data, err := os.ReadFile(v.path)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read speakers: %w", err)
+	}
+	if err := json.Unmarshal(data, &v.speakers); err != nil {
+		return nil, fmt.Errorf("failed to parse speakers: %w", err)
+	}
+	return v, nil
+}
+
+// update applies fn to a copy of the speakers and persists it
+func (v *voicePrints) update(fn func(speakers map[string]*enrolledSpeaker)) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	updated := make(map[string]*enrolledSpeaker, len(v.speakers)+1)
+	for name, speaker := range v.speakers {
+		copied := *speaker
+		updated[name] = &copied
+	}
+	fn(updated)
+
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return fmt.Errorf("failed to marshal speakers: %w", err)
+	}
+	tmpPath := v.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write speakers: %w", err)
+	}
+	if err := os.Rename(tmpPath, v.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write speakers: %w", err)
+	}
+	v.speakers = updated
+	return nil
+}
+
+// empty reports whether no speaker is enrolled
+func (v *voicePrints) empty() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.speakers) == 0
+}
+
+// identify finds the enrolled speaker whose voice print is most similar,
+// reporting false when none reaches the threshold
+func (v *voicePrints) identify(print []float64, threshold float64) (string, float64, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	best, bestSimilarity := "", math.Inf(-1)
+	for name, speaker := range v.speakers {
+		centroid := speaker.centroid()
+		if len(centroid) != len(print) {
+			continue
+		}
+		if similarity := cosineSimilarity(print, centroid); similarity > bestSimilarity {
+			best, bestSimilarity = name, similarity
+		}
+	}
+	return best, bestSimilarity, best != "" && bestSimilarity >= threshold
+}
+
+// identifySpeaker names the enrolled speaker of a job's recording, empty
+// when it is nobody enrolled
+func (s *Scribe) identifySpeaker(ctx context.Context, job TranscriptionJob) string {
+	if s.speakers.empty() {
+		return ""
+	}
+	ctx, span := s.config.Tracer.Start(ctx, "identify")
+	defer span.End()
+
+	print, err := s.config.Speakers.Printer.VoicePrint(ctx, job.FilePath)
+	if err != nil {
+		slog.Warn("Failed to compute voice print", "error", err, "file", filepath.Base(job.FilePath), "clientID", job.ClientID)
+		span.RecordError(err)
+		return ""
+	}
+	if print == nil {
+		return ""
+	}
+
+	threshold := s.config.Speakers.Threshold
+	if threshold == 0 {
+		threshold = defaultSpeakerThreshold
+	}
+	name, similarity, ok := s.speakers.identify(print, threshold)
+	span.SetAttributes(tracing.Attr("speaker", name), tracing.Attr("similarity", similarity))
+	slog.Debug("Compared voice print",
+		"clientID", job.ClientID,
+		"file", filepath.Base(job.FilePath),
+		"closest", name,
+		"similarity", similarity,
+		"identified", ok)
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+func vectorNorm(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Max(math.Sqrt(sum), 1e-12)
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	var dot float64
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return dot / (vectorNorm(a) * vectorNorm(b))
+}
+
+// Speaker is an enrolled speaker
+type Speaker struct {
+	Name string `json:"name"`
+
+	// Recordings the speaker was enrolled with, as clientID/file
+	Samples []string `json:"samples"`
+}
+
+// enrollRequest points at a stored recording of a speaker
+type enrollRequest struct {
+	ClientID  string `json:"clientId"`
+	AudioFile string `json:"audioFile"`
+
+	// Day (YYYYMMDD) of the recording, optional
+	Date string `json:"date,omitempty"`
+}
+
+// handleListSpeakers serves the enrolled speakers
+func (s *Scribe) handleListSpeakers(w http.ResponseWriter, r *http.Request) {
+	s.speakers.mu.RLock()
+	speakers := make([]Speaker, 0, len(s.speakers.speakers))
+	for name, speaker := range s.speakers.speakers {
+		speakers = append(speakers, Speaker{Name: name, Samples: speaker.Samples})
+	}
+	s.speakers.mu.RUnlock()
+	sort.Slice(speakers, func(i, j int) bool { return speakers[i].Name < speakers[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(speakers); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// handleEnrollSpeaker adds the voice print of a stored recording to a
+// speaker, enrolling them when new
+func (s *Scribe) handleEnrollSpeaker(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if strings.TrimSpace(name) == "" || len(name) > maxSpeakerName {
+		http.Error(w, "Invalid speaker name", http.StatusBadRequest)
+		return
+	}
+	if s.config.Speakers.Printer == nil {
+		http.Error(w, "Speaker identification is off", http.StatusBadRequest)
+		return
+	}
+
+	var req enrollRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, err := uuid.Parse(req.ClientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+	if req.AudioFile != filepath.Base(req.AudioFile) || !strings.HasSuffix(req.AudioFile, ".wav") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	path, ok := s.findAudioFile(req.ClientID, req.AudioFile, req.Date)
+	if !ok {
+		flacName := strings.TrimSuffix(req.AudioFile, ".wav") + ".flac"
+		if path, ok = s.findAudioFile(req.ClientID, flacName, req.Date); !ok {
+			http.Error(w, "Audio file not found", http.StatusNotFound)
+			return
+		}
+	}
+	if strings.HasSuffix(path, ".flac") {
+		wavPath, err := decodeToTemp(path)
+		if err != nil {
+			slog.Error("Failed to decode archived recording", "file", path, "error", err)
+			http.Error(w, "Failed to decode audio", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(wavPath)
+		path = wavPath
+	}
+
+	print, err := s.config.Speakers.Printer.VoicePrint(r.Context(), path)
+	if err != nil {
+		slog.Error("Failed to compute voice print", "error", err, "clientID", req.ClientID, "file", req.AudioFile)
+		http.Error(w, "Failed to compute voice print", http.StatusInternalServerError)
+		return
+	}
+	if print == nil {
+		http.Error(w, "Too little speech in the recording", http.StatusUnprocessableEntity)
+		return
+	}
+
+	sample := req.ClientID + "/" + req.AudioFile
+	var enrolled Speaker
+	err = s.speakers.update(func(speakers map[string]*enrolledSpeaker) {
+		speaker, ok := speakers[name]
+		if !ok {
+			speaker = &enrolledSpeaker{}
+			speakers[name] = speaker
+		}
+		speaker.Prints = append(append([][]float64(nil), speaker.Prints...), print)
+		speaker.Samples = append(append([]string(nil), speaker.Samples...), sample)
+		enrolled = Speaker{Name: name, Samples: speaker.Samples}
+	})
+	if err != nil {
+		slog.Error("Failed to save speakers", "error", err, "speaker", name)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Speaker enrolled", "speaker", name, "sample", sample, "samples", len(enrolled.Samples))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(enrolled); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// handleDeleteSpeaker forgets a speaker and their voice prints
+func (s *Scribe) handleDeleteSpeaker(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	s.speakers.mu.RLock()
+	_, ok := s.speakers.speakers[name]
+	s.speakers.mu.RUnlock()
+	if !ok {
+		http.Error(w, "Speaker not found", http.StatusNotFound)
+		return
+	}
+
+	err := s.speakers.update(func(speakers map[string]*enrolledSpeaker) {
+		delete(speakers, name)
+	})
+	if err != nil {
+		slog.Error("Failed to save speakers", "error", err, "speaker", name)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Speaker removed", "speaker", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeToTemp decodes an archived recording to a temporary WAV file
+func decodeToTemp(path string) (string, error) {
+	pcm, err := audio.ReadFLAC(path, maxDecodedSamples)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp("", "libas-enroll-*.wav")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	file.Close()
+	if err := audio.WriteWav(file.Name(), pcm); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,170 @@
+package scribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Longest text spoken at once
+	maxSayLength = 1000
+
+	// Longest synthesized speech read back, far above what maxSayLength
+	// characters take to say
+	maxSpeechSize = 64 << 20
+
+	// How long synthesizing may take
+	synthesizeTimeout = 30 * time.Second
+)
+
+// Synthesizer turns text into speech for /api/clients/{id}/say
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text string) (*audio.PCM, error)
+}
+
+// CommandSynthesizer runs a text-to-speech command such as espeak-ng or
+// piper with the text on its standard input and the path of the WAV file to
+// write appended, e.g. "espeak-ng --stdin -w" or "piper --model
+// en_US-lessac-medium.onnx --output_file".
+type CommandSynthesizer struct {
+	Command string
+}
+
+func (c CommandSynthesizer) Synthesize(ctx context.Context, text string) (*audio.PCM, error) {
+	args := strings.Fields(c.Command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no speech command")
+	}
+
+	file, err := os.CreateTemp("", "libas-speech-*.wav")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create speech file: %w", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], file.Name())...)
+	cmd.Stdin = strings.NewReader(text)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to run speech command: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return audio.ReadWav(file.Name())
+}
+
+// HTTPSynthesizer posts the text as text/plain to a speech service, such as
+// piper's HTTP server or a proxy to a cloud service, answering with a WAV
+// file
+type HTTPSynthesizer struct {
+	URL string
+}
+
+func (h HTTPSynthesizer) Synthesize(ctx context.Context, text string) (*audio.PCM, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, strings.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create speech request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Accept", "audio/wav")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach speech service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSpeechSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read speech: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("speech service answered %s", resp.Status)
+	}
+	return audio.DecodeWav(bytes.NewReader(data))
+}
+
+// SayRequest is the body of /api/clients/{id}/say
+type SayRequest struct {
+	Text string `json:"text"`
+}
+
+// SayResponse is returned once speech was sent to a client
+type SayResponse struct {
+	ClientID   string `json:"clientId"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// HandleSay delivers the speech of /api/clients/{id}/say to audio clients,
+// e.g. with the audio server's Say. Without it nothing can be said. Call it
+// before starting the scribe.
+func (s *Scribe) HandleSay(say func(clientID string, speech *audio.PCM) error) {
+	s.say = say
+}
+
+// handleSay synthesizes the "text" of the request and plays it on the
+// client's device
+func (s *Scribe) handleSay(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	var request SayRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16<<10)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	request.Text = strings.TrimSpace(request.Text)
+	if request.Text == "" || len(request.Text) > maxSayLength {
+		http.Error(w, fmt.Sprintf("Text must hold 1 to %d characters", maxSayLength), http.StatusBadRequest)
+		return
+	}
+
+	if s.say == nil {
+		http.Error(w, "No audio server to play speech", http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := s.presence.Load(clientID); !ok {
+		http.Error(w, "Client is not connected", http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), synthesizeTimeout)
+	defer cancel()
+	speech, err := s.config.Synthesizer.Synthesize(ctx, request.Text)
+	if err == nil && len(speech.Samples) == 0 {
+		err = fmt.Errorf("no speech synthesized")
+	}
+	if err != nil {
+		slog.Error("Failed to synthesize speech", "error", err, "clientID", clientID)
+		http.Error(w, "Failed to synthesize speech", http.StatusBadGateway)
+		return
+	}
+
+	if err := s.say(clientID, speech); err != nil {
+		slog.Warn("Failed to send speech", "error", err, "clientID", clientID)
+		http.Error(w, "Failed to send speech: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	duration := time.Duration(len(speech.Samples)) * time.Second / time.Duration(speech.SampleRate)
+	slog.Info("Said text on client", "clientID", clientID, "duration", duration)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(SayResponse{ClientID: clientID, DurationMs: duration.Milliseconds()}); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,33 @@
+package scribe
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// staticFiles holds the dashboard so the binary can run from any directory
+//
+//go:embed static
+var staticFiles embed.FS
+
+// openAPISpec describes the HTTP and WebSocket API
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// staticHandler serves the embedded dashboard files
+func staticHandler() http.Handler {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		// The embed directive guarantees the directory exists
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
+
+// handleOpenAPI serves the API specification
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,346 @@
+package scribe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/fault"
+)
+
+const (
+	// Name of the per-day transcription journal
+	journalFile = "transcriptions.jsonl"
+
+	// Highest sequence number handed out, kept once erasing transcriptions
+	// may have removed it from the journals
+	sequenceFile = "sequence"
+)
+
+// StoredTranscription is a single line of the transcription journal
+type StoredTranscription struct {
+	ClientID string               `json:"clientId"`
+	Message  TranscriptionMessage `json:"message"`
+}
+
+// store persists transcriptions to a per-day JSON lines journal inside the
+// recordings directory and hands out the sequence numbers used for replay
+type store struct {
+	dir      string
+	mu       sync.Mutex
+	sequence uint64
+}
+
+func newStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recordings directory: %w", err)
+	}
+
+	st := &store{dir: dir}
+
+	// Resume numbering from the newest journal entry
+	days, err := st.days()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(days) - 1; i >= 0; i-- {
+		last := uint64(0)
+		if err := st.readDay(days[i], func(record StoredTranscription) bool {
+			last = record.Message.Sequence
+			return true
+		}); err != nil {
+			return nil, err
+		}
+		if last > 0 {
+			st.sequence = last
+			break
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, sequenceFile)); err == nil {
+		if saved, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil && saved > st.sequence {
+			st.sequence = saved
+		}
+	}
+
+	slog.Debug("Transcription store opened", "path", dir, "sequence", st.sequence)
+	return st, nil
+}
+
+// append assigns the next sequence number to the message and persists it
+func (st *store) append(clientID string, msg TranscriptionMessage) (TranscriptionMessage, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	msg.Sequence = st.sequence + 1
+	if msg.Session == 0 {
+		// The transcription starts a session of its own
+		msg.Session = msg.Sequence
+	}
+
+	day := msg.Timestamp.Format("20060102")
+	if err := os.MkdirAll(filepath.Join(st.dir, day), 0755); err != nil {
+		return msg, fault.Storage(fmt.Errorf("failed to create day directory: %w", err))
+	}
+
+	file, err := os.OpenFile(st.journalPath(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return msg, fault.Storage(fmt.Errorf("failed to open journal: %w", err))
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(StoredTranscription{ClientID: clientID, Message: msg})
+	if err != nil {
+		return msg, fmt.Errorf("failed to marshal transcription: %w", err)
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return msg, fault.Storage(fmt.Errorf("failed to write journal: %w", err))
+	}
+
+	st.sequence = msg.Sequence
+	return msg, nil
+}
+
+// erase removes a client's transcriptions from a day's journal, returning
+// the audio files of those removed. Sequence numbers are never handed out
+// again.
+func (st *store) erase(day, clientID string) ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var kept [][]byte
+	var erased []string
+	if err := st.readDay(day, func(record StoredTranscription) bool {
+		if record.ClientID == clientID {
+			erased = append(erased, record.Message.AudioFile)
+			return true
+		}
+		line, err := json.Marshal(record)
+		if err == nil {
+			kept = append(kept, line)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if len(erased) == 0 {
+		return nil, nil
+	}
+
+	// Numbering resumes from the newest journal entry, which may be gone
+	if err := os.WriteFile(filepath.Join(st.dir, sequenceFile), []byte(strconv.FormatUint(st.sequence, 10)+"\n"), 0644); err != nil {
+		return nil, fault.Storage(fmt.Errorf("failed to write sequence: %w", err))
+	}
+
+	if err := st.writeDay(day, kept); err != nil {
+		return nil, err
+	}
+	return erased, nil
+}
+
+// correct replaces the text of a client's transcription, keeping the text
+// whisper heard in OriginalText, and returns the transcription as corrected
+func (st *store) correct(clientID string, sequence uint64, text string) (TranscriptionMessage, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	days, err := st.days()
+	if err != nil {
+		return TranscriptionMessage{}, err
+	}
+	for i := len(days) - 1; i >= 0; i-- {
+		var lines [][]byte
+		var corrected *TranscriptionMessage
+		first, sound := uint64(0), false
+		if err := st.readDay(days[i], func(record StoredTranscription) bool {
+			if first == 0 {
+				first = record.Message.Sequence
+			}
+			if record.Message.Sequence == sequence && record.ClientID == clientID {
+				if record.Message.Sound != "" {
+					sound = true
+					return false
+				}
+				if record.Message.OriginalText == "" {
+					record.Message.OriginalText = record.Message.Text
+				}
+				record.Message.Text = text
+				if text == record.Message.OriginalText {
+					record.Message.OriginalText = ""
+				}
+				corrected = &record.Message
+			}
+			line, err := json.Marshal(record)
+			if err == nil {
+				lines = append(lines, line)
+			}
+			return true
+		}); err != nil {
+			return TranscriptionMessage{}, err
+		}
+		if sound {
+			return TranscriptionMessage{}, errNotTranscribed
+		}
+		if corrected != nil {
+			if err := st.writeDay(days[i], lines); err != nil {
+				return TranscriptionMessage{}, err
+			}
+			return *corrected, nil
+		}
+		// Earlier days only hold earlier sequence numbers
+		if first != 0 && first <= sequence {
+			break
+		}
+	}
+	return TranscriptionMessage{}, os.ErrNotExist
+}
+
+// writeDay replaces the journal of a day with lines, removing it when there
+// are none
+func (st *store) writeDay(day string, lines [][]byte) error {
+	path := st.journalPath(day)
+	if len(lines) == 0 {
+		if err := os.Remove(path); err != nil {
+			return fault.Storage(fmt.Errorf("failed to remove journal: %w", err))
+		}
+		return nil
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(bytes.Join(lines, []byte("\n")), '\n'), 0644); err != nil {
+		return fault.Storage(fmt.Errorf("failed to write journal: %w", err))
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fault.Storage(fmt.Errorf("failed to write journal: %w", err))
+	}
+	return nil
+}
+
+// since calls fn, in order, for every stored transcription with a sequence
+// number greater than seq until fn returns false
+func (st *store) since(seq uint64, fn func(StoredTranscription) bool) error {
+	days, err := st.days()
+	if err != nil {
+		return err
+	}
+
+	// Walk back to the first day that may contain newer entries
+	start := 0
+	for i := len(days) - 1; i >= 0; i-- {
+		first := uint64(0)
+		if err := st.readDay(days[i], func(record StoredTranscription) bool {
+			first = record.Message.Sequence
+			return false
+		}); err != nil {
+			return err
+		}
+		if first != 0 && first <= seq {
+			start = i
+			break
+		}
+	}
+
+	for _, day := range days[start:] {
+		stopped := false
+		if err := st.readDay(day, func(record StoredTranscription) bool {
+			if record.Message.Sequence <= seq {
+				return true
+			}
+			if !fn(record) {
+				stopped = true
+				return false
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// from calls fn, in order, for every stored transcription in the journals
+// of t's day and later until fn returns false. Earlier entries of t's day
+// are included.
+func (st *store) from(t time.Time, fn func(StoredTranscription) bool) error {
+	days, err := st.days()
+	if err != nil {
+		return err
+	}
+	first := t.Format("20060102")
+	for _, day := range days {
+		if day < first {
+			continue
+		}
+		stopped := false
+		if err := st.readDay(day, func(record StoredTranscription) bool {
+			stopped = !fn(record)
+			return !stopped
+		}); err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// days returns the day directories holding a journal, oldest first
+func (st *store) days() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(st.dir, "*", journalFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journals: %w", err)
+	}
+
+	days := make([]string, 0, len(matches))
+	for _, match := range matches {
+		day := filepath.Base(filepath.Dir(match))
+		if _, err := time.Parse("20060102", day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (st *store) journalPath(day string) string {
+	return filepath.Join(st.dir, day, journalFile)
+}
+
+func (st *store) readDay(day string, fn func(StoredTranscription) bool) error {
+	file, err := os.Open(st.journalPath(day))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record StoredTranscription
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash may leave a partial trailing line
+			slog.Warn("Skipping malformed journal entry", "day", day, "error", err)
+			continue
+		}
+		if !fn(record) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
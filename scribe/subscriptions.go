@@ -0,0 +1,330 @@
+package scribe
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Subscription key matching every client
+	allClients = "*"
+)
+
+// broadcast delivers a message to every subscriber of the message's client,
+// including wildcard subscribers, honoring each subscriber's keyword filter
+func (s *Scribe) broadcast(msg WebSocketMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	connections := s.subscribersFor(msg.ClientID)
+	if len(connections) == 0 {
+		slog.Debug("No subscribers found for client", "clientID", msg.ClientID)
+		return nil
+	}
+
+	for i, conn := range connections {
+		if !conn.accepts(msg) {
+			continue
+		}
+		select {
+		case conn.send <- data:
+			slog.Debug("Sent message to subscriber",
+				"clientID", msg.ClientID,
+				"connectionIndex", i)
+		default:
+			// Dropping silently would leave a hole the subscriber cannot
+			// see, disconnect it so it reconnects and replays instead
+			slog.Warn("Subscriber channel full, disconnecting for replay",
+				"clientID", msg.ClientID,
+				"connectionIndex", i,
+				"sequence", msg.Sequence)
+			conn.closeLagging()
+		}
+	}
+	return nil
+}
+
+// subscribersFor returns the unique set of connections subscribed to a client
+func (s *Scribe) subscribersFor(clientID string) []*wsConnection {
+	seen := make(map[*wsConnection]bool)
+	result := make([]*wsConnection, 0)
+	for _, key := range []string{clientID, allClients} {
+		value, ok := s.subscribers.Load(key)
+		if !ok {
+			continue
+		}
+		for _, conn := range value.([]*wsConnection) {
+			if !seen[conn] {
+				seen[conn] = true
+				result = append(result, conn)
+			}
+		}
+	}
+	return result
+}
+
+// handleCommand applies a command received from the subscriber
+func (c *wsConnection) handleCommand(data []byte) {
+	var cmd SubscriptionCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		c.sendError(fmt.Sprintf("invalid command: %v", err))
+		return
+	}
+
+	for _, clientID := range cmd.ClientIDs {
+		if clientID == allClients {
+			continue
+		}
+		if _, err := uuid.Parse(clientID); err != nil {
+			c.sendError(fmt.Sprintf("invalid client ID: %s", clientID))
+			return
+		}
+		if !c.scribe.canView(c.user, clientID) {
+			c.sendError(fmt.Sprintf("access denied to client: %s", clientID))
+			return
+		}
+	}
+
+	slog.Debug("Received subscriber command",
+		"action", cmd.Action,
+		"clientIDs", cmd.ClientIDs)
+
+	switch cmd.Action {
+	case "subscribe":
+		for _, clientID := range cmd.ClientIDs {
+			c.mu.Lock()
+			c.subscriptions[clientID] = true
+			c.mu.Unlock()
+			c.scribe.registerSubscriber(clientID, c)
+		}
+
+	case "unsubscribe":
+		for _, clientID := range cmd.ClientIDs {
+			c.mu.Lock()
+			delete(c.subscriptions, clientID)
+			c.mu.Unlock()
+			c.scribe.unregisterSubscriber(clientID, c)
+		}
+
+	case "filter":
+		keywords := make([]string, 0, len(cmd.Keywords))
+		for _, keyword := range cmd.Keywords {
+			if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+				keywords = append(keywords, keyword)
+			}
+		}
+		c.mu.Lock()
+		c.keywords = keywords
+		c.mu.Unlock()
+
+	case "backfill":
+		c.backfill(cmd)
+
+	case "replay":
+		if err := c.replay(cmd); err != nil {
+			slog.Error("Failed to replay transcriptions", "error", err)
+			c.sendError(fmt.Sprintf("replay failed: %v", err))
+			return
+		}
+
+	default:
+		c.sendError(fmt.Sprintf("unknown action: %q", cmd.Action))
+		return
+	}
+
+	c.sendState(cmd.Action)
+}
+
+// backfill replays stored transcriptions newer than the command's start time.
+// Without explicit client IDs the current subscriptions are used.
+func (c *wsConnection) backfill(cmd SubscriptionCommand) {
+	clientIDs := cmd.ClientIDs
+	if len(clientIDs) == 0 {
+		clientIDs = c.subscribedClients()
+	}
+
+	wanted := make(map[string]bool)
+	for _, clientID := range clientIDs {
+		wanted[clientID] = true
+	}
+
+	c.scribe.clients.Range(func(key, _ interface{}) bool {
+		clientID := key.(string)
+		if !wanted[clientID] && !wanted[allClients] {
+			return true
+		}
+
+		messages, _, err := c.scribe.messagesFrom(clientID, cmd.Since)
+		if err != nil {
+			slog.Error("Failed to read transcriptions", "error", err, "clientID", clientID)
+		}
+		for _, msg := range messages {
+			if !msg.Timestamp.After(cmd.Since) {
+				continue
+			}
+			wsMsg := WebSocketMessage{
+				Type:      "transcription",
+				ClientID:  clientID,
+				Sequence:  msg.Sequence,
+				Timestamp: msg.Timestamp,
+				Payload:   msg,
+			}
+			if c.accepts(wsMsg) {
+				c.sendMessage(wsMsg)
+			}
+		}
+		return true
+	})
+}
+
+// replay resends every stored transcription with a sequence number greater
+// than the command's, matching the current subscriptions and filter
+func (c *wsConnection) replay(cmd SubscriptionCommand) error {
+	wanted := make(map[string]bool)
+	for _, clientID := range c.subscribedClients() {
+		wanted[clientID] = true
+	}
+
+	count := 0
+	err := c.scribe.store.since(cmd.Sequence, func(record StoredTranscription) bool {
+		if !wanted[record.ClientID] && !wanted[allClients] {
+			return true
+		}
+
+		wsMsg := WebSocketMessage{
+			Type:      "transcription",
+			ClientID:  record.ClientID,
+			Sequence:  record.Message.Sequence,
+			Timestamp: record.Message.Timestamp,
+			Payload:   record.Message,
+		}
+		if !c.accepts(wsMsg) {
+			return true
+		}
+
+		// Block rather than drop, the subscriber asked for these
+		data, err := json.Marshal(wsMsg)
+		if err != nil {
+			slog.Error("Failed to marshal replayed message", "error", err)
+			return true
+		}
+		select {
+		case c.send <- data:
+			count++
+			return true
+		case <-time.After(writeWait):
+			c.closeLagging()
+			return false
+		}
+	})
+
+	slog.Debug("Replayed transcriptions", "fromSequence", cmd.Sequence, "count", count)
+	return err
+}
+
+// closeLagging disconnects a subscriber that cannot keep up. The close
+// frame tells it to reconnect and replay from its last sequence number.
+func (c *wsConnection) closeLagging() {
+	c.closeOnce.Do(func() {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber too slow, replay from last sequence"),
+			time.Now().Add(writeWait))
+		c.conn.Close()
+	})
+}
+
+// accepts reports whether the subscriber may see the message's client and
+// the message passes its keyword filter
+func (c *wsConnection) accepts(msg WebSocketMessage) bool {
+	if msg.ClientID != "" && !c.scribe.canView(c.user, msg.ClientID) {
+		return false
+	}
+
+	c.mu.Lock()
+	keywords := c.keywords
+	c.mu.Unlock()
+
+	if len(keywords) == 0 {
+		return true
+	}
+
+	var text string
+	switch payload := msg.Payload.(type) {
+	case TranscriptionMessage:
+		text = strings.ToLower(payload.Text)
+	case TranslationMessage:
+		// Translations follow the transcription they translate
+		text = strings.ToLower(payload.Source)
+	default:
+		// Filters only apply to transcriptions
+		return true
+	}
+
+	for _, keyword := range keywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribedClients returns the client IDs the connection is subscribed to
+func (c *wsConnection) subscribedClients() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clientIDs := make([]string, 0, len(c.subscriptions))
+	for clientID := range c.subscriptions {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+	return clientIDs
+}
+
+func (c *wsConnection) sendState(action string) {
+	c.mu.Lock()
+	keywords := append([]string{}, c.keywords...)
+	c.mu.Unlock()
+
+	c.sendMessage(WebSocketMessage{
+		Type:      "ack",
+		Timestamp: time.Now(),
+		Payload: SubscriptionState{
+			Action:        action,
+			Subscriptions: c.subscribedClients(),
+			Keywords:      keywords,
+		},
+	})
+}
+
+func (c *wsConnection) sendError(reason string) {
+	c.sendMessage(WebSocketMessage{
+		Type:      "error",
+		Timestamp: time.Now(),
+		Payload:   reason,
+	})
+}
+
+// sendMessage queues a message for this subscriber only
+func (c *wsConnection) sendMessage(msg WebSocketMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Failed to marshal subscriber message", "error", err)
+		return
+	}
+
+	select {
+	case c.send <- data:
+	default:
+		slog.Warn("Failed to send to subscriber - channel full", "type", msg.Type)
+	}
+}
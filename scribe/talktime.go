@@ -0,0 +1,175 @@
+package scribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+)
+
+// TalkTimeResponse is how long clients spoke per hour or day
+type TalkTimeResponse struct {
+	// "hour" or "day"
+	Interval string `json:"interval"`
+
+	// First and last day (YYYYMMDD) covered, inclusive
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	Clients []ClientTalkTime `json:"clients"`
+}
+
+// ClientTalkTime is one client's talk time over the requested days
+type ClientTalkTime struct {
+	ClientID string `json:"clientId"`
+
+	// Host the client last connected from, when it connected since the
+	// scribe started
+	Host string `json:"host,omitempty"`
+
+	TalkMs        int64 `json:"talkMs"`
+	Transmissions int   `json:"transmissions"`
+
+	// Hours or days with transmissions, oldest first
+	Buckets []TalkTimeBucket `json:"buckets"`
+}
+
+// TalkTimeBucket is the talk time of one hour or day
+type TalkTimeBucket struct {
+	Start         time.Time `json:"start"`
+	TalkMs        int64     `json:"talkMs"`
+	Transmissions int       `json:"transmissions"`
+}
+
+// recordingDuration is how long the whisper copy of a recording, a 16kHz
+// mono WAV file, plays for, zero when it cannot be read
+func recordingDuration(path string) time.Duration {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() <= 44 {
+		return 0
+	}
+	samples := (info.Size() - 44) / 2
+	return time.Duration(samples) * time.Second / audio.WhisperSampleRate
+}
+
+// talkTime is how long a transmission lasted. Transcriptions stored before
+// durations were recorded count up to their last timed word.
+func talkTime(msg TranscriptionMessage) int64 {
+	if msg.DurationMs > 0 {
+		return msg.DurationMs
+	}
+	if len(msg.Words) > 0 {
+		return msg.Words[len(msg.Words)-1].EndMs
+	}
+	return 0
+}
+
+// handleTalkTime sums up the duration of the transmissions clients spoke
+// in per "interval" (hour, the default, or day) from "from" to "to"
+// (YYYYMMDD, inclusive, both defaulting to today). "clientId" limits the
+// totals to one client. Sounds other than speech do not count.
+func (s *Scribe) handleTalkTime(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	interval := params.Get("interval")
+	if interval == "" {
+		interval = "hour"
+	}
+	if interval != "hour" && interval != "day" {
+		http.Error(w, "Invalid interval", http.StatusBadRequest)
+		return
+	}
+	clientID := params.Get("clientId")
+	if clientID != "" {
+		if _, err := uuid.Parse(clientID); err != nil {
+			http.Error(w, "Invalid client ID", http.StatusBadRequest)
+			return
+		}
+	}
+	from, to := params.Get("from"), params.Get("to")
+	if from == "" {
+		from = getCurrentDateDir()
+	}
+	if to == "" {
+		to = getCurrentDateDir()
+	}
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse("20060102", date); err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	days, err := s.store.days()
+	if err != nil {
+		slog.Error("Failed to list transcription days", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	u := requestUser(r)
+	clients := make(map[string]*ClientTalkTime)
+	buckets := make(map[string]map[time.Time]*TalkTimeBucket)
+	for _, day := range days {
+		if day < from || day > to {
+			continue
+		}
+		err := s.store.readDay(day, func(record StoredTranscription) bool {
+			if (clientID != "" && record.ClientID != clientID) || record.Message.Sound != "" || !s.canView(u, record.ClientID) {
+				return true
+			}
+			client, ok := clients[record.ClientID]
+			if !ok {
+				client = &ClientTalkTime{ClientID: record.ClientID, Buckets: make([]TalkTimeBucket, 0)}
+				if host, ok := s.hosts.Load(record.ClientID); ok && s.config.Pseudonyms == nil {
+					client.Host = host.(string)
+				}
+				clients[record.ClientID] = client
+				buckets[record.ClientID] = make(map[time.Time]*TalkTimeBucket)
+			}
+
+			t := record.Message.Timestamp.Local()
+			start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+			if interval == "day" {
+				start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+			}
+			bucket, ok := buckets[record.ClientID][start]
+			if !ok {
+				bucket = &TalkTimeBucket{Start: start}
+				buckets[record.ClientID][start] = bucket
+			}
+
+			ms := talkTime(record.Message)
+			bucket.TalkMs += ms
+			bucket.Transmissions++
+			client.TalkMs += ms
+			client.Transmissions++
+			return true
+		})
+		if err != nil {
+			slog.Error("Failed to read transcriptions", "error", err, "day", day)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := TalkTimeResponse{Interval: interval, From: from, To: to, Clients: make([]ClientTalkTime, 0, len(clients))}
+	for id, client := range clients {
+		for _, bucket := range buckets[id] {
+			client.Buckets = append(client.Buckets, *bucket)
+		}
+		sort.Slice(client.Buckets, func(i, j int) bool { return client.Buckets[i].Start.Before(client.Buckets[j].Start) })
+		response.Clients = append(response.Clients, *client)
+	}
+	sort.Slice(response.Clients, func(i, j int) bool { return response.Clients[i].ClientID < response.Clients[j].ClientID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
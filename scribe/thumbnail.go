@@ -0,0 +1,80 @@
+package scribe
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+)
+
+const (
+	// Size of rendered thumbnails in pixels
+	thumbnailWidth  = 600
+	thumbnailHeight = 80
+)
+
+// Thumbnail renderers selectable with the "type" query parameter
+var thumbnailRenderers = map[string]func([]int16, int, int) *image.RGBA{
+	"waveform":    audio.RenderWaveform,
+	"spectrogram": audio.RenderSpectrogram,
+}
+
+// handleGetWaveform serves a PNG thumbnail of a stored recording, a waveform
+// by default or a spectrogram with type=spectrogram. Thumbnails are rendered
+// on first request and cached next to the recording.
+func (s *Scribe) handleGetWaveform(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = "waveform"
+	}
+	render, ok := thumbnailRenderers[kind]
+	if !ok {
+		http.Error(w, "Unknown thumbnail type", http.StatusBadRequest)
+		return
+	}
+
+	path, _, ok := s.recordingPath(w, r)
+	if !ok {
+		return
+	}
+
+	cachePath := strings.TrimSuffix(path, filepath.Ext(path)) + "." + kind + ".png"
+	if _, err := os.Stat(cachePath); err == nil {
+		w.Header().Set("Content-Type", "image/png")
+		http.ServeFile(w, r, cachePath)
+		return
+	}
+
+	pcm, err := audio.ReadAudioLimit(path, maxDecodedSamples)
+	if err != nil {
+		slog.Error("Failed to decode recording for thumbnail", "file", path, "error", err)
+		http.Error(w, "Failed to decode audio", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, render(pcm.Samples, thumbnailWidth, thumbnailHeight)); err != nil {
+		slog.Error("Failed to encode thumbnail", "file", path, "error", err)
+		http.Error(w, "Failed to render thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	// Caching is best effort, the thumbnail is served either way
+	tmpPath := cachePath + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		slog.Warn("Failed to cache thumbnail", "file", cachePath, "error", err)
+	} else if err := os.Rename(tmpPath, cachePath); err != nil {
+		os.Remove(tmpPath)
+		slog.Warn("Failed to cache thumbnail", "file", cachePath, "error", err)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeContent(w, r, filepath.Base(cachePath), time.Now(), bytes.NewReader(buf.Bytes()))
+}
@@ -0,0 +1,104 @@
+package scribe
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/bosley/libas/tracing"
+	"github.com/bosley/libas/translate"
+)
+
+// Translator translates the text of transcriptions, like translate.Client.
+// An empty from language has it detect the language.
+type Translator interface {
+	Translate(ctx context.Context, text, from, to string) (string, error)
+}
+
+// TranslationConfig sends subscribers a translation of every transcription
+// into a target language, right after the transcription
+type TranslationConfig struct {
+	// Translates transcriptions, off when nil
+	Translator Translator
+
+	// Language translations are made into, e.g. en. Transcriptions whisper
+	// detected in it are not translated.
+	Target string
+}
+
+func (c TranslationConfig) validate() error {
+	if c.Translator != nil && c.Target == "" {
+		return fmt.Errorf("translations need a target language")
+	}
+	return nil
+}
+
+// OpenTranslator creates a translator from a URL: a LibreTranslate server
+// over libretranslate:// or libretranslates:// (TLS), or the DeepL API over
+// deepl://, e.g. deepl://api-free.deepl.com. API keys go in the user info.
+func OpenTranslator(rawURL string) (Translator, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid translator URL %q", redactURL(rawURL))
+	}
+
+	cfg := translate.Config{Key: u.User.Username()}
+	switch u.Scheme {
+	case "libretranslate":
+		u.Scheme, cfg.Backend = "http", translate.LibreTranslate
+	case "libretranslates":
+		u.Scheme, cfg.Backend = "https", translate.LibreTranslate
+	case "deepl":
+		u.Scheme, cfg.Backend = "https", translate.DeepL
+	default:
+		return nil, fmt.Errorf("unsupported translator scheme %q, expected libretranslate, libretranslates or deepl", u.Scheme)
+	}
+	u.User = nil
+	cfg.URL = u.String()
+
+	client, err := translate.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid translator %s: %w", redactURL(rawURL), err)
+	}
+	return client, nil
+}
+
+// translate sends subscribers a translation of a transcription. Failures
+// are logged, the transcription stands without one.
+func (s *Scribe) translate(ctx context.Context, job TranscriptionJob, msg TranscriptionMessage) {
+	target := s.config.Translation.Target
+	if msg.Language == target {
+		return
+	}
+
+	ctx, span := s.config.Tracer.Start(ctx, "translate", tracing.Attr("from", msg.Language), tracing.Attr("to", target))
+	defer span.End()
+
+	text, err := s.config.Translation.Translator.Translate(ctx, msg.Text, msg.Language, target)
+	if err != nil {
+		slog.Warn("Failed to translate transcription",
+			"error", err,
+			"clientID", job.ClientID,
+			"sequence", msg.Sequence)
+		span.RecordError(err)
+		return
+	}
+
+	err = s.broadcast(WebSocketMessage{
+		Type:      "translation",
+		ClientID:  job.ClientID,
+		Timestamp: job.Timestamp,
+		Payload: TranslationMessage{
+			Sequence:       msg.Sequence,
+			Language:       target,
+			SourceLanguage: msg.Language,
+			Text:           text,
+			Source:         msg.Text,
+		},
+	})
+	if err != nil {
+		slog.Error("Failed to send translation", "error", err, "clientID", job.ClientID)
+		span.RecordError(err)
+	}
+}
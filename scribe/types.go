@@ -1,20 +1,99 @@
 package scribe
 
 import (
+	"sync"
 	"time"
+
+	"github.com/bosley/libas/tracing"
 )
 
-// ClientTranscriptions holds all transcriptions for a client
+// ClientTranscriptions holds the cached transcriptions of a client
 type ClientTranscriptions struct {
 	Messages []TranscriptionMessage
+	mu       sync.RWMutex
+
+	// Newest time of the messages evicted from the cache
+	evicted time.Time
+}
+
+// add appends a message to the client's transcriptions
+func (ct *ClientTranscriptions) add(msg TranscriptionMessage) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.Messages = append(ct.Messages, msg)
+}
+
+// snapshot returns a copy of the client's transcriptions safe for reading
+func (ct *ClientTranscriptions) snapshot() []TranscriptionMessage {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	messages := make([]TranscriptionMessage, len(ct.Messages))
+	copy(messages, ct.Messages)
+	return messages
 }
 
 // TranscriptionMessage represents a single transcribed message
 type TranscriptionMessage struct {
+	Sequence   uint64    `json:"sequence"`
 	Timestamp  time.Time `json:"timestamp"`
 	Text       string    `json:"text"`
 	AudioFile  string    `json:"audioFile"`
 	Confidence float32   `json:"confidence"`
+
+	// Text whisper transcribed, set once a user corrected Text
+	OriginalText string `json:"originalText,omitempty"`
+
+	// Length of the transmission in milliseconds
+	DurationMs int64 `json:"durationMs,omitempty"`
+
+	// Set when the recording was deleted once transcribed, the client
+	// being text-only
+	AudioDiscarded bool `json:"audioDiscarded,omitempty"`
+
+	// ID of the session the transcription belongs to, the sequence number
+	// of its first transcription
+	Session uint64 `json:"session,omitempty"`
+
+	// Timing of each word, for highlighting words during playback and
+	// captions, when whisper reported it
+	Words []Word `json:"words,omitempty"`
+
+	// Language whisper transcribed the recording in, and whether the
+	// client is not expected to speak it, likely making the text up
+	Language           string `json:"language,omitempty"`
+	UnexpectedLanguage bool   `json:"unexpectedLanguage,omitempty"`
+
+	// Kind of sound the classifier heard instead of speech, e.g. music or
+	// knock, for recordings whisper skipped
+	Sound string `json:"sound,omitempty"`
+
+	// Name of the enrolled speaker whose voice print the recording matches
+	Speaker string `json:"speaker,omitempty"`
+
+	// Titles of the calendar events the recording was made during
+	Events []string `json:"events,omitempty"`
+
+	// Name of the remote scribe the transcription was made by, and its
+	// sequence number there, for transcriptions aggregated from other sites
+	Site           string `json:"site,omitempty"`
+	RemoteSequence uint64 `json:"remoteSequence,omitempty"`
+}
+
+// TranslationMessage is a transcription translated into the configured
+// target language, sent to subscribers right after the transcription
+type TranslationMessage struct {
+	// Sequence number of the transcription translated
+	Sequence uint64 `json:"sequence"`
+
+	// Language translated into, and the one whisper detected, empty when
+	// it did not
+	Language       string `json:"language"`
+	SourceLanguage string `json:"sourceLanguage,omitempty"`
+
+	Text string `json:"text"`
+
+	// Text of the transcription
+	Source string `json:"source"`
 }
 
 // TranscriptionJob represents a job for the worker pool
@@ -22,12 +101,45 @@ type TranscriptionJob struct {
 	FilePath  string
 	ClientID  string
 	Timestamp time.Time
+
+	// Time spent waiting for a worker, ended when one takes the job
+	queueSpan *tracing.Span
+
+	// When speech ended, handed off by an audio server sharing the
+	// latency recorder
+	speechEnded time.Time
 }
 
 // WebSocketMessage represents a message sent over WebSocket
 type WebSocketMessage struct {
 	Type      string      `json:"type"`
 	ClientID  string      `json:"clientId"`
+	Sequence  uint64      `json:"sequence,omitempty"`
 	Timestamp time.Time   `json:"timestamp"`
 	Payload   interface{} `json:"payload"`
 }
+
+// SubscriptionCommand is sent by WebSocket subscribers to control what they receive
+type SubscriptionCommand struct {
+	// One of "subscribe", "unsubscribe", "backfill", "replay" or "filter"
+	Action string `json:"action"`
+
+	// Client IDs the command applies to, "*" matches every client
+	ClientIDs []string `json:"clientIds,omitempty"`
+
+	// Backfill start time, messages after this are replayed
+	Since time.Time `json:"since,omitempty"`
+
+	// Replay start, messages with a greater sequence number are replayed
+	Sequence uint64 `json:"sequence,omitempty"`
+
+	// Keyword filter, an empty list clears the filter
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+// SubscriptionState is returned to a subscriber after each command
+type SubscriptionState struct {
+	Action        string   `json:"action"`
+	Subscriptions []string `json:"subscriptions"`
+	Keywords      []string `json:"keywords"`
+}
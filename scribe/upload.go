@@ -0,0 +1,186 @@
+package scribe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/tracing"
+	"github.com/google/uuid"
+)
+
+const (
+	// Largest accepted upload
+	maxUploadSize = 512 << 20
+
+	// Most samples decoded from an upload or recording, as much 16-bit
+	// audio as the largest upload holds
+	maxDecodedSamples = maxUploadSize / 2
+
+	// Uploads larger than this are spooled to disk while parsing
+	uploadMemory = 32 << 20
+)
+
+// Extensions accepted by the upload endpoint, mapped to whether decoding
+// them needs ffmpeg
+var uploadExtensions = map[string]bool{
+	".wav":  false,
+	".flac": false,
+	".mp3":  true,
+	".ogg":  true,
+	".oga":  true,
+}
+
+// UploadResponse is returned once an uploaded file has been queued
+type UploadResponse struct {
+	ClientID  string `json:"clientId"`
+	AudioFile string `json:"audioFile"`
+	Status    string `json:"status"`
+}
+
+// handleTranscribeUpload accepts an audio file upload, converts it for
+// whisper inside the recordings directory and queues it for transcription.
+// The optional "clientId" form field assigns the upload to an existing
+// client, otherwise a new client ID is generated.
+func (s *Scribe) handleTranscribeUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(uploadMemory); err != nil {
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	clientID := r.FormValue("clientId")
+	if clientID == "" {
+		clientID = uuid.New().String()
+	} else if _, err := uuid.Parse(clientID); err != nil {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer upload.Close()
+
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	needsFFmpeg, ok := uploadExtensions[ext]
+	if !ok {
+		http.Error(w, "Unsupported audio format", http.StatusUnsupportedMediaType)
+		return
+	}
+	if needsFFmpeg && !audio.FFmpegAvailable() {
+		http.Error(w, "Unsupported audio format, "+ext+" uploads need ffmpeg", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	filePath, err := s.storeUpload(clientID, upload, ext)
+	if err != nil {
+		slog.Error("Failed to store upload",
+			"error", err,
+			"clientID", clientID,
+			"file", header.Filename)
+		if errors.Is(err, audio.ErrTooLong) {
+			http.Error(w, "Audio is too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to process audio", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Uploads from a traced caller continue its trace
+	parent, _ := tracing.ParseTraceParent(r.Header.Get("traceparent"))
+	s.config.Tracer.Handoff(filePath, parent)
+
+	if err := s.handleNewAudioFile(clientID, filePath); err != nil {
+		slog.Error("Failed to queue upload", "error", err, "clientID", clientID)
+		if errors.Is(err, errStopping) {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "Transcription queue is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	slog.Info("Accepted audio upload",
+		"clientID", clientID,
+		"upload", header.Filename,
+		"file", filepath.Base(filePath))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(UploadResponse{
+		ClientID:  clientID,
+		AudioFile: filepath.Base(filePath),
+		Status:    "queued",
+	})
+}
+
+// storeUpload writes the upload into today's directory for the client and
+// converts it to a whisper-ready WAV file, returning the converted path
+func (s *Scribe) storeUpload(clientID string, upload io.Reader, ext string) (string, error) {
+	finalPath := s.uploadPath(clientID)
+	if err := s.storeUploadAs(finalPath, upload, ext); err != nil {
+		return "", err
+	}
+	return finalPath, nil
+}
+
+// uploadPath names the whisper-ready WAV file of a new upload in today's
+// directory for the client
+func (s *Scribe) uploadPath(clientID string) string {
+	name := fmt.Sprintf("upload_%s_%s_whisper.wav", time.Now().Format("150405"), uuid.New().String()[:8])
+	return filepath.Join(s.getCurrentDayPath(), clientID, name)
+}
+
+// storeUploadAs writes the upload next to finalPath and converts it to a
+// whisper-ready WAV file there
+func (s *Scribe) storeUploadAs(finalPath string, upload io.Reader, ext string) error {
+	clientDir := filepath.Dir(finalPath)
+	if err := os.MkdirAll(clientDir, 0755); err != nil {
+		return fmt.Errorf("failed to create client directory: %w", err)
+	}
+
+	// Temporary files end in .tmp so the watcher ignores them
+	original, err := os.CreateTemp(clientDir, "upload_*"+ext+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create upload file: %w", err)
+	}
+	defer os.Remove(original.Name())
+
+	if _, err := io.Copy(original, upload); err != nil {
+		original.Close()
+		return fmt.Errorf("failed to write upload: %w", err)
+	}
+	if err := original.Close(); err != nil {
+		return fmt.Errorf("failed to write upload: %w", err)
+	}
+
+	tmpPath := finalPath + ".tmp"
+
+	if err := audio.ConvertForWhisper(original.Name(), tmpPath, audio.ConvertOptions{MaxSamples: maxDecodedSamples}); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to finalize upload: %w", err)
+	}
+
+	if err := audio.RecordChecksum(finalPath); err != nil {
+		slog.Error("Failed to record checksum", "error", err, "file", finalPath)
+	}
+
+	return nil
+}
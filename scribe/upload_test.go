@@ -0,0 +1,128 @@
+package scribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/internal/audiotest"
+)
+
+// postUpload sends a file to the upload endpoint and returns the response
+func postUpload(t *testing.T, s *Scribe, name string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/api/transcribe", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.handleTranscribeUpload(w, r)
+	return w
+}
+
+func TestUploadMalformedFLAC(t *testing.T) {
+	var buf bytes.Buffer
+	if err := audio.EncodeFLAC(&buf, audiotest.Speech(16000, time.Second, -6)); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	// STREAMINFO claiming 2^36 samples, the most it can
+	huge := bytes.Clone(valid)
+	fields := binary.BigEndian.Uint64(huge[18:26])
+	binary.BigEndian.PutUint64(huge[18:26], fields|1<<36-1)
+
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)/2] ^= 0x10
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"valid", valid, http.StatusAccepted},
+		{"truncated", valid[:100], http.StatusUnprocessableEntity},
+		{"bad CRC", corrupt, http.StatusUnprocessableEntity},
+		{"huge declared length with garbage frames", append(huge[:42], bytes.Repeat([]byte{0xFF}, 4096)...), http.StatusUnprocessableEntity},
+		{"not FLAC", []byte(strings.Repeat("garbage ", 64)), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		s := newTestScribe(t, Config{})
+		w := postUpload(t, s, "recording.flac", tt.data)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d %q, want %d", tt.name, w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			continue
+		}
+		if tt.want != http.StatusAccepted {
+			if len(s.queue) != 0 {
+				t.Errorf("%s: queued a job", tt.name)
+			}
+			// Nothing but the empty client directory is left behind
+			files, _ := filepath.Glob(filepath.Join(s.getCurrentDayPath(), "*", "*"))
+			if len(files) != 0 {
+				t.Errorf("%s: left %v", tt.name, files)
+			}
+		}
+	}
+}
+
+// Uploads arriving while the scribe stops are refused rather than sent on
+// the closed queue
+func TestUploadDuringStop(t *testing.T) {
+	var buf bytes.Buffer
+	if err := audio.EncodeWav(&buf, audiotest.Speech(16000, 100*time.Millisecond, -6)); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestScribe(t, Config{})
+
+	const uploaders = 4
+	var wg sync.WaitGroup
+	stopped := make(chan struct{})
+	refused := make([]bool, uploaders)
+	for i := range uploaders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopped:
+					w := postUpload(t, s, "recording.wav", buf.Bytes())
+					refused[i] = w.Code == http.StatusServiceUnavailable
+					return
+				default:
+					postUpload(t, s, "recording.wav", buf.Bytes())
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(stopped)
+	wg.Wait()
+	for i, ok := range refused {
+		if !ok {
+			t.Errorf("uploader %d was not refused after Stop", i)
+		}
+	}
+}
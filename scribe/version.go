@@ -0,0 +1,50 @@
+package scribe
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/version"
+)
+
+// Transcription backends built into this scribe
+var backends = []string{"whisper-cli"}
+
+// Backends returns the transcription backends built into this scribe
+func Backends() []string {
+	return slices.Clone(backends)
+}
+
+// VersionResponse describes the running build and what it can do
+type VersionResponse struct {
+	version.Info
+
+	// Transcription backends available
+	Backends []string `json:"backends"`
+
+	// Optional capabilities and whether they are enabled
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+// handleVersion reports the build, protocol revision and enabled features
+// so clients can check compatibility
+func (s *Scribe) handleVersion(w http.ResponseWriter, r *http.Request) {
+	response := VersionResponse{
+		Info:     version.Get(),
+		Backends: Backends(),
+		Features: map[string]bool{
+			"ffmpeg":            audio.FFmpegAvailable(),
+			"archiveFlac":       s.config.ArchiveFLAC,
+			"convertRecordings": s.config.ConvertRecordings,
+			"textOnly":          len(s.textOnly) > 0,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
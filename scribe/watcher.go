@@ -2,6 +2,7 @@ package scribe
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -9,6 +10,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/bosley/libas/latency"
+	"github.com/bosley/libas/tracing"
 	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
 )
@@ -53,6 +56,9 @@ func (s *Scribe) watchFiles(ctx context.Context) {
 
 	slog.Info("Watching current day directory", "path", currentDayPath)
 
+	// Pick up what arrived while scribe was not running
+	s.scanDay(currentDayPath)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -125,32 +131,123 @@ func (s *Scribe) handleFSEvent(event fsnotify.Event) error {
 	// Handle new WAV files
 	if len(parts) == 3 {
 		clientID := parts[1]
-		if _, err := uuid.Parse(clientID); err == nil && strings.HasSuffix(parts[2], ".wav") {
-			if strings.Contains(parts[2], "_whisper") {
-				slog.Info("Found new WAV file",
-					"clientID", clientID,
-					"file", parts[2])
-				return s.handleNewAudioFile(clientID, event.Name)
-			} else {
-				slog.Warn("WAV file does not contain '_whisper', skipping",
-					"clientID", clientID,
-					"file", parts[2])
-				return nil
+		if _, err := uuid.Parse(clientID); err != nil {
+			return nil
+		}
+
+		if strings.HasSuffix(parts[2], ".wav") && strings.Contains(parts[2], "_whisper") {
+			slog.Info("Found new WAV file",
+				"clientID", clientID,
+				"file", parts[2])
+			if err := s.handleNewAudioFile(clientID, event.Name); err != nil {
+				return err
 			}
+			// Only files written while scribe watches measure the delay
+			// until it notices them
+			if info, err := os.Stat(event.Name); err == nil {
+				s.config.Latency.Observe(clientID, latency.Queue, time.Since(info.ModTime()))
+			}
+			return nil
+		}
+
+		if s.config.ConvertRecordings && isRawRecording(parts[2]) {
+			go s.convertRecording(clientID, event.Name)
+			return nil
+		}
+
+		if strings.HasSuffix(parts[2], ".wav") {
+			slog.Warn("WAV file does not contain '_whisper', skipping",
+				"clientID", clientID,
+				"file", parts[2])
 		}
 	}
 
 	return nil
 }
 
+// scanDay watches the existing client directories of a day and queues
+// whisper files that have no transcription yet, converting raw recordings
+// first when ConvertRecordings is set
+func (s *Scribe) scanDay(dayPath string) {
+	clientDirs, err := os.ReadDir(dayPath)
+	if err != nil {
+		slog.Error("Failed to scan day directory", "error", err, "path", dayPath)
+		return
+	}
+
+	dayStart, err := time.ParseInLocation("20060102", filepath.Base(dayPath), time.Local)
+	if err != nil {
+		slog.Error("Failed to parse day directory", "error", err, "path", dayPath)
+		return
+	}
+
+	skipped := 0
+	for _, clientDir := range clientDirs {
+		clientID := clientDir.Name()
+		if !clientDir.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(clientID); err != nil {
+			continue
+		}
+
+		clientPath := filepath.Join(dayPath, clientID)
+		if err := s.watcher.Add(clientPath); err != nil {
+			slog.Error("Failed to watch client directory", "error", err, "path", clientPath)
+		}
+
+		files, err := os.ReadDir(clientPath)
+		if err != nil {
+			slog.Error("Failed to scan client directory", "error", err, "path", clientPath)
+			continue
+		}
+
+		present := make(map[string]bool, len(files))
+		for _, file := range files {
+			present[file.Name()] = true
+		}
+
+		transcribed := make(map[string]bool)
+		messages, _, err := s.messagesFrom(clientID, dayStart)
+		if err != nil {
+			slog.Error("Failed to read transcriptions", "error", err, "clientID", clientID)
+		}
+		for _, msg := range messages {
+			transcribed[msg.AudioFile] = true
+		}
+
+		for _, file := range files {
+			name := file.Name()
+			switch {
+			case strings.HasSuffix(name, "_whisper.wav"):
+				if !transcribed[name] && s.handleNewAudioFile(clientID, filepath.Join(clientPath, name)) != nil {
+					skipped++
+				}
+			case s.config.ConvertRecordings && isRawRecording(name):
+				stem := strings.TrimSuffix(name, filepath.Ext(name))
+				if !present[stem+"_whisper.wav"] && !present[stem+"_whisper.flac"] {
+					go s.convertRecording(clientID, filepath.Join(clientPath, name))
+				}
+			}
+		}
+	}
+
+	if skipped > 0 {
+		slog.Warn("Transcription queue full, remaining recordings are picked up on the next start",
+			"skipped", skipped,
+			"path", dayPath)
+	}
+}
+
 func (s *Scribe) handleNewClient(clientID, fullPath string) error {
 	// Add the client directory to the watcher using the full path
 	if err := s.watcher.Add(fullPath); err != nil {
 		return fmt.Errorf("failed to watch client directory: %w", err)
 	}
 
-	// Initialize client transcriptions
-	s.clients.Store(clientID, &ClientTranscriptions{
+	// Initialize client transcriptions, keeping those of earlier days until
+	// they are evicted
+	s.clients.LoadOrStore(clientID, &ClientTranscriptions{
 		Messages: make([]TranscriptionMessage, 0),
 	})
 
@@ -160,22 +257,66 @@ func (s *Scribe) handleNewClient(clientID, fullPath string) error {
 	return nil
 }
 
+// errStopping is returned for files queued once Stop has begun
+var errStopping = fmt.Errorf("scribe is stopping")
+
+// queueAudioFile queues a file, waiting for room in a full queue until ctx
+// is done or the scribe stops. A file left unqueued is picked up on the
+// next start.
+func (s *Scribe) queueAudioFile(ctx context.Context, clientID, filePath string) error {
+	for {
+		err := s.handleNewAudioFile(clientID, filePath)
+		if err == nil || errors.Is(err, errStopping) || ctx.Err() != nil {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
 func (s *Scribe) handleNewAudioFile(clientID, filePath string) error {
+	// Files queued directly (uploads) are also seen by the watcher
+	if _, queued := s.queued.LoadOrStore(filePath, struct{}{}); queued {
+		slog.Debug("Audio file already queued", "file", filepath.Base(filePath))
+		return nil
+	}
+
+	// Continue the trace of whatever produced the file
+	parent, _ := s.config.Tracer.Resume(filePath)
+	_, span := s.config.Tracer.StartWithParent(context.Background(), parent, "queue",
+		tracing.Attr("clientId", clientID),
+		tracing.Attr("file", filepath.Base(filePath)))
+
 	// Create a new transcription job
 	job := TranscriptionJob{
 		FilePath:  filePath,
 		ClientID:  clientID,
 		Timestamp: time.Now(),
+		queueSpan: span,
 	}
+	job.speechEnded, _ = s.config.Latency.Resume(filePath)
 
 	// Add the job to the processing queue
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.queueClosed {
+		s.queued.Delete(filePath)
+		span.RecordError(errStopping)
+		span.End()
+		return errStopping
+	}
+	idle := len(s.queue) == 0 && s.health.running.Load() == 0
 	select {
 	case s.queue <- job:
+		s.health.jobQueued(clientID, idle)
 		slog.Info("Queued new audio file for processing",
 			"clientID", clientID,
 			"file", filepath.Base(filePath))
 	default:
-		return fmt.Errorf("job queue is full")
+		s.queued.Delete(filePath)
+		err := fmt.Errorf("job queue is full")
+		span.RecordError(err)
+		span.End()
+		return err
 	}
 
 	return nil
@@ -0,0 +1,111 @@
+package scribe
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// whisperJSON is the part of whisper's full JSON output (-ojf) read for
+// segment times, words and token probabilities
+type whisperJSON struct {
+	Result struct {
+		Language string `json:"language"`
+	} `json:"result"`
+	Transcription []struct {
+		Offsets struct {
+			From int64 `json:"from"`
+			To   int64 `json:"to"`
+		} `json:"offsets"`
+		Text   string `json:"text"`
+		Tokens []struct {
+			Text    string `json:"text"`
+			Offsets struct {
+				From int64 `json:"from"`
+				To   int64 `json:"to"`
+			} `json:"offsets"`
+			P float64 `json:"p"`
+		} `json:"tokens"`
+	} `json:"transcription"`
+}
+
+// readWhisperJSON parses the segments of whisper's full JSON output, with
+// their words timed from the tokens
+func readWhisperJSON(path string) ([]Segment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var output whisperJSON
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("failed to parse whisper output: %w", err)
+	}
+
+	segments := make([]Segment, 0, len(output.Transcription))
+	for _, entry := range output.Transcription {
+		text := strings.TrimSpace(entry.Text)
+		if text == "" || strings.Contains(text, "[BLANK_AUDIO]") {
+			continue
+		}
+		segment := Segment{
+			Start: time.Duration(entry.Offsets.From) * time.Millisecond,
+			End:   time.Duration(entry.Offsets.To) * time.Millisecond,
+			Text:  text,
+
+			Language: output.Result.Language,
+		}
+
+		// Special tokens such as [_BEG_] and timestamps carry no text. A
+		// token starting with a space starts a word, others continue it.
+		var sum, wordSum float64
+		var tokens, wordTokens int
+		endWord := func() {
+			if n := len(segment.Words); n > 0 && wordTokens > 0 {
+				segment.Words[n-1].Confidence = float32(max(wordSum/float64(wordTokens), 1e-6))
+			}
+			wordSum, wordTokens = 0, 0
+		}
+		for _, token := range entry.Tokens {
+			if strings.HasPrefix(token.Text, "[_") {
+				continue
+			}
+			sum += token.P
+			tokens++
+
+			n := len(segment.Words)
+			if n == 0 || strings.HasPrefix(token.Text, " ") {
+				endWord()
+				segment.Words = append(segment.Words, Word{StartMs: token.Offsets.From})
+				n++
+			}
+			word := &segment.Words[n-1]
+			word.Text += token.Text
+			word.EndMs = max(word.EndMs, token.Offsets.To)
+			wordSum += token.P
+			wordTokens++
+		}
+		endWord()
+		if tokens > 0 {
+			segment.Confidence = float32(max(sum/float64(tokens), 1e-6))
+		}
+		segment.Words = trimWords(segment.Words)
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// trimWords drops the spaces around words and words left without text
+func trimWords(words []Word) []Word {
+	kept := words[:0]
+	for _, word := range words {
+		if word.Text = strings.TrimSpace(word.Text); word.Text != "" {
+			kept = append(kept, word)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
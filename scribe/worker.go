@@ -1,13 +1,25 @@
 package scribe
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/events"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/latency"
+	"github.com/bosley/libas/tracing"
 )
 
 func (s *Scribe) worker(ctx context.Context) {
@@ -29,55 +41,111 @@ func (s *Scribe) worker(ctx context.Context) {
 				return
 			}
 
-			if err := s.processJob(ctx, job); err != nil {
+			s.health.jobStarted()
+			err := s.processJob(ctx, job)
+			s.health.jobFinished()
+			s.settle(job.FilePath, "", err)
+			if err != nil {
 				slog.Error("Failed to process transcription job",
 					"error", err,
 					"file", job.FilePath,
 					"clientID", job.ClientID)
+				s.report(err, "transcribe", "clientId", job.ClientID, "file", filepath.Base(job.FilePath))
+				s.events.Publish(events.Event{
+					Type:     events.JobFailed,
+					ClientID: job.ClientID,
+					Data: events.JobFailure{
+						AudioFile: filepath.Base(job.FilePath),
+						Error:     err.Error(),
+					},
+				})
+				continue
+			}
+
+			if s.discardsAudio(job.ClientID) {
+				s.discardRecording(job)
+			} else if s.config.ArchiveFLAC {
+				s.archiveRecording(job)
 			}
 		}
 	}
 }
 
-func (s *Scribe) processJob(ctx context.Context, job TranscriptionJob) error {
+func (s *Scribe) processJob(ctx context.Context, job TranscriptionJob) (err error) {
+	defer s.queued.Delete(job.FilePath)
+
+	job.queueSpan.End()
+	ctx, span := s.config.Tracer.StartWithParent(ctx, job.queueSpan.Context(), "transcribe",
+		tracing.Attr("clientId", job.ClientID),
+		tracing.Attr("file", filepath.Base(job.FilePath)))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	slog.Info("Processing audio file",
 		"file", job.FilePath,
 		"clientID", job.ClientID)
 
-	// Execute whisper command
-	cmd := exec.CommandContext(ctx, s.config.WhisperPath,
-		"--model", s.config.WhisperModel,
-		job.FilePath)
+	if s.config.Classifier != nil {
+		switch classification := s.classify(ctx, job); classification.Label {
+		case audio.SoundSpeech:
+		case audio.SoundSilence:
+			slog.Info("No transcribable content found",
+				"file", job.FilePath,
+				"clientID", job.ClientID)
+			return nil
+		default:
+			slog.Info("Storing recording without speech as a sound",
+				"file", filepath.Base(job.FilePath),
+				"clientID", job.ClientID,
+				"sound", classification.Label,
+				"score", classification.Score)
+			return s.deliver(ctx, job, soundMessage(job, classification), time.Now())
+		}
+	}
 
-	slog.Debug("Executing whisper command",
-		"command", cmd.String(),
-		"args", cmd.Args)
+	_, whisperSpan := s.config.Tracer.Start(ctx, "whisper", tracing.Attr("model", filepath.Base(s.config.WhisperModel)))
+	segments, err := s.transcribeRecording(ctx, job.FilePath, job.ClientID)
+	text := joinSegments(segments)
+	whisperSpan.RecordError(err)
+	whisperSpan.SetAttributes(tracing.Attr("characters", len(text)))
+	whisperSpan.End()
+	transcribed := time.Now()
 
-	output, err := cmd.Output()
+	// A missing whisper executable is not a missing recording
+	missing := errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fault.ErrTranscriberUnavailable)
+	if ctx.Err() == nil && !missing {
+		s.health.transcribed(err)
+	}
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			stderr := string(exitErr.Stderr)
-			// Check for file not found error
-			if strings.Contains(stderr, "input file not found") {
-				slog.Info("Audio file not found (likely processed or deleted)",
-					"file", job.FilePath,
-					"clientID", job.ClientID)
-				return nil
-			}
-			slog.Debug("Whisper command failed",
-				"stderr", stderr,
-				"exitCode", exitErr.ExitCode())
+		if missing {
+			slog.Info("Audio file not found (likely processed or deleted)",
+				"file", job.FilePath,
+				"clientID", job.ClientID)
+			return nil
 		}
-		return fmt.Errorf("whisper execution failed: %w", err)
+		return err
 	}
 
-	outputStr := string(output)
-	slog.Debug("Whisper command output received",
-		"outputLength", len(output),
-		"output", outputStr)
+	var language string
+	if len(segments) > 0 {
+		language = segments[0].Language
+	}
+	unexpected := s.unexpectedLanguage(job.ClientID, language)
+	if unexpected && s.config.Languages.Skip {
+		slog.Info("Skipping transcription in unexpected language",
+			"file", job.FilePath,
+			"clientID", job.ClientID,
+			"language", language,
+			"text", text)
+		return nil
+	}
 
-	// Extract text from subtitle-style format
-	text := extractText(outputStr)
+	if len(segments) > 0 {
+		segments = s.escalate(ctx, job, segments)
+		text = joinSegments(segments)
+	}
 	if text == "" {
 		slog.Info("No transcribable content found",
 			"file", job.FilePath,
@@ -85,86 +153,397 @@ func (s *Scribe) processJob(ctx context.Context, job TranscriptionJob) error {
 		return nil
 	}
 
-	// Create transcription message
+	// Create transcription message, fully confident when whisper did not
+	// say otherwise
 	msg := TranscriptionMessage{
 		Timestamp:  job.Timestamp,
 		Text:       text,
 		AudioFile:  filepath.Base(job.FilePath),
-		Confidence: 1.0,
+		Confidence: meanConfidence(segments),
+		Words:      segmentWords(segments),
+		Language:   language,
+
+		UnexpectedLanguage: unexpected,
+	}
+	if msg.Confidence == 0 {
+		msg.Confidence = 1.0
+	}
+	if s.config.Speakers.Printer != nil {
+		msg.Speaker = s.identifySpeaker(ctx, job)
+	}
+	return s.deliver(ctx, job, msg, transcribed)
+}
+
+// deliver persists a job's transcription and hands it to the event sinks,
+// outputs and subscribers
+func (s *Scribe) deliver(ctx context.Context, job TranscriptionJob, msg TranscriptionMessage, transcribed time.Time) error {
+	msg.DurationMs = recordingDuration(job.FilePath).Milliseconds()
+	msg.AudioDiscarded = s.discardsAudio(job.ClientID)
+	if len(s.calendars) > 0 {
+		msg.Events = s.calendarEvents(job.ClientID, job.Timestamp)
+	}
+
+	// Persist the transcription, assigning its sequence number and session
+	s.sequenceMu.Lock()
+	msg, err := s.appendToSession(job.ClientID, msg)
+	if err != nil {
+		s.sequenceMu.Unlock()
+		return fmt.Errorf("failed to persist transcription: %w", err)
 	}
 
 	// Store the transcription
-	value, _ := s.clients.LoadOrStore(job.ClientID, &ClientTranscriptions{
-		Messages: make([]TranscriptionMessage, 0),
+	s.remember(job.ClientID, msg)
+	s.settle(job.FilePath, msg.Text, nil)
+
+	eventType := events.Transcription
+	if msg.Sound != "" {
+		eventType = events.Sound
+	}
+	s.events.Publish(events.Event{
+		ID:       fmt.Sprintf("%s-%d", job.ClientID, msg.Sequence),
+		Type:     eventType,
+		Time:     msg.Timestamp,
+		ClientID: job.ClientID,
+		Data:     msg,
 	})
-	transcriptions := value.(*ClientTranscriptions)
-	transcriptions.Messages = append(transcriptions.Messages, msg)
-	s.clients.Store(job.ClientID, transcriptions)
+	if len(s.outputs.targets) > 0 {
+		s.push(job, msg)
+	}
 
-	// Prepare message for websocket
-	wsMsg := WebSocketMessage{
+	// Notify subscribers
+	_, broadcastSpan := s.config.Tracer.Start(ctx, "broadcast", tracing.Attr("sequence", int64(msg.Sequence)))
+	err = s.broadcast(WebSocketMessage{
 		Type:      "transcription",
 		ClientID:  job.ClientID,
+		Sequence:  msg.Sequence,
 		Timestamp: job.Timestamp,
 		Payload:   msg,
+	})
+	s.sequenceMu.Unlock()
+	broadcastSpan.RecordError(err)
+	broadcastSpan.End()
+	if err != nil {
+		return err
+	}
+	s.observeLatency(job, transcribed)
+	if s.config.Translation.Translator != nil && msg.Sound == "" {
+		s.translate(ctx, job, msg)
+	}
+
+	slog.Info("Successfully transcribed audio",
+		"clientID", job.ClientID,
+		"file", filepath.Base(job.FilePath),
+		"text", msg.Text)
+
+	return nil
+}
+
+// observeLatency records how long a transcribed job waited and took to
+// transcribe and deliver, and from the end of speech when that is known
+func (s *Scribe) observeLatency(job TranscriptionJob, transcribed time.Time) {
+	s.config.Latency.Observe(job.ClientID, latency.Transcribe, transcribed.Sub(job.Timestamp))
+	s.config.Latency.Observe(job.ClientID, latency.Broadcast, time.Since(transcribed))
+	if !job.speechEnded.IsZero() {
+		s.config.Latency.Observe(job.ClientID, latency.Total, time.Since(job.speechEnded))
 	}
+}
+
+// Segment is one timed line of whisper output
+type Segment struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+
+	// Mean probability of the segment's tokens, 0 to 1, or zero when
+	// whisper did not report it
+	Confidence float32
+
+	// Timing of the segment's words, nil when whisper did not report it
+	Words []Word
+
+	// Language whisper transcribed the recording in, detected or as it
+	// was told, empty when it did not report it
+	Language string
+}
 
-	data, err := json.Marshal(wsMsg)
+// Word is one word of a transcription, timed in milliseconds from the
+// start of the recording
+type Word struct {
+	Text       string  `json:"text"`
+	StartMs    int64   `json:"startMs"`
+	EndMs      int64   `json:"endMs"`
+	Confidence float32 `json:"confidence,omitempty"`
+}
+
+// segmentWords joins the words of segments
+func segmentWords(segments []Segment) []Word {
+	var words []Word
+	for _, segment := range segments {
+		words = append(words, segment.Words...)
+	}
+	return words
+}
+
+// Transcriber turns the whisper copy of a recording, a 16kHz mono WAV
+// file, into text. A recording that no longer exists is reported as
+// fs.ErrNotExist, a transcriber that cannot run as
+// fault.ErrTranscriberUnavailable.
+type Transcriber interface {
+	Transcribe(ctx context.Context, path string) (string, error)
+}
+
+// SegmentTranscriber is a Transcriber that also returns the timed segments
+// of the text with their confidence, which escalation and filtering by
+// confidence need
+type SegmentTranscriber interface {
+	Transcriber
+	TranscribeSegments(ctx context.Context, path string) ([]Segment, error)
+}
+
+// Whisper is the Transcriber running whisper-cli
+type Whisper struct {
+	// Path to the whisper executable and its model
+	Path  string
+	Model string
+
+	// Holds whisper processes back to a pace when set
+	Pacer *Pacer
+
+	// Initial prompt priming whisper with the vocabulary to expect
+	Prompt string
+
+	// Language spoken, e.g. de, or "auto" to detect it. Whisper assumes
+	// English when empty.
+	Language string
+}
+
+// Transcribe runs whisper on path
+func (w Whisper) Transcribe(ctx context.Context, path string) (string, error) {
+	segments, err := w.TranscribeSegments(ctx, path)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		return "", err
 	}
+	return joinSegments(segments), nil
+}
 
-	// Notify subscribers
-	if value, ok := s.subscribers.Load(job.ClientID); ok {
-		connections := value.([]*wsConnection)
-		for i, conn := range connections {
-			select {
-			case conn.send <- data:
-				slog.Debug("Sent message to subscriber",
-					"clientID", job.ClientID,
-					"connectionIndex", i)
-			default:
-				slog.Warn("Failed to send to subscriber - channel full",
-					"clientID", job.ClientID,
-					"connectionIndex", i)
+// TranscribeSegments runs whisper on path and returns its segments
+func (w Whisper) TranscribeSegments(ctx context.Context, path string) ([]Segment, error) {
+	return transcribeSegments(ctx, w, path)
+}
+
+// WithPrompt returns a copy of w primed with prompt
+func (w Whisper) WithPrompt(prompt string) Transcriber {
+	w.Prompt = prompt
+	return w
+}
+
+// DetectingLanguage returns a copy of w detecting the language spoken
+func (w Whisper) DetectingLanguage() Transcriber {
+	w.Language = "auto"
+	return w
+}
+
+// Transcribe runs whisper on a 16kHz mono WAV file and returns the text it
+// recognized. A file whisper cannot find is reported as fs.ErrNotExist.
+func Transcribe(ctx context.Context, whisperPath, model, path string) (string, error) {
+	segments, err := TranscribeSegments(ctx, whisperPath, model, path)
+	if err != nil {
+		return "", err
+	}
+	return joinSegments(segments), nil
+}
+
+// TranscribeSegments runs whisper like Transcribe and returns the text
+// split into whisper's timed segments. Their confidence is read from
+// whisper's full JSON output, builds without it report none.
+func TranscribeSegments(ctx context.Context, whisperPath, model, path string) ([]Segment, error) {
+	return transcribeSegments(ctx, Whisper{Path: whisperPath, Model: model}, path)
+}
+
+func transcribeSegments(ctx context.Context, w Whisper, path string) ([]Segment, error) {
+	release, err := w.Pacer.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Whisper writes the token probabilities only to its JSON output
+	outDir, err := os.MkdirTemp("", "libas-whisper-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create whisper output directory: %w", err)
+	}
+	defer os.RemoveAll(outDir)
+	outPrefix := filepath.Join(outDir, "output")
+
+	args := []string{
+		"--model", w.Model,
+		"--output-json-full",
+		"--output-file", outPrefix,
+	}
+	if w.Prompt != "" {
+		args = append(args, "--prompt", w.Prompt)
+	}
+	if w.Language != "" {
+		args = append(args, "--language", w.Language)
+	}
+	cmd := exec.CommandContext(ctx, w.Path, append(args, path)...)
+	var stdout, stderrBuf bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderrBuf
+
+	slog.Debug("Executing whisper command",
+		"command", cmd.String(),
+		"args", cmd.Args)
+
+	err = cmd.Start()
+	if err == nil {
+		w.Pacer.started(cmd.Process.Pid)
+		err = cmd.Wait()
+	}
+	output := stdout.Bytes()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr := stderrBuf.String()
+			if strings.Contains(stderr, "input file not found") {
+				return nil, fmt.Errorf("whisper input %s: %w", path, fs.ErrNotExist)
+			}
+			if strings.Contains(stderr, "failed to initialize whisper context") {
+				return nil, fmt.Errorf("%w: whisper could not load model %s", fault.ErrTranscriberUnavailable, w.Model)
 			}
+			slog.Debug("Whisper command failed",
+				"stderr", stderr,
+				"exitCode", exitErr.ExitCode())
+		}
+		if _, exited := err.(*exec.ExitError); !exited && ctx.Err() == nil {
+			return nil, fmt.Errorf("%w: failed to start whisper: %w", fault.ErrTranscriberUnavailable, err)
 		}
-	} else {
-		slog.Debug("No subscribers found for client", "clientID", job.ClientID)
+		return nil, fmt.Errorf("whisper execution failed: %w", err)
 	}
 
-	slog.Info("Successfully transcribed audio",
-		"clientID", job.ClientID,
-		"file", filepath.Base(job.FilePath),
-		"text", text)
+	slog.Debug("Whisper command output received",
+		"outputLength", len(output),
+		"output", string(output))
 
-	return nil
+	segments, err := readWhisperJSON(outPrefix + ".json")
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to read whisper JSON output, confidence unknown", "error", err)
+		}
+		return parseSegments(string(output)), nil
+	}
+	return segments, nil
 }
 
-func extractText(output string) string {
-	var builder strings.Builder
-	lines := strings.Split(output, "\n")
+// archiveRecording replaces a transcribed recording with its FLAC encoding
+func (s *Scribe) archiveRecording(job TranscriptionJob) {
+	flacPath, err := audio.ArchiveFLAC(job.FilePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		slog.Error("Failed to archive recording",
+			"error", err,
+			"file", job.FilePath,
+			"clientID", job.ClientID)
+		return
+	}
 
-	for _, line := range lines {
+	// The manifest follows the recording to its archived form
+	if err := audio.RecordChecksum(flacPath); err != nil {
+		slog.Error("Failed to record checksum", "error", err, "file", flacPath)
+	}
+	if err := audio.RecordRemoval(job.FilePath); err != nil {
+		slog.Error("Failed to record removal", "error", err, "file", job.FilePath)
+	}
+
+	slog.Debug("Archived recording",
+		"file", flacPath,
+		"clientID", job.ClientID)
+}
+
+// discardsAudio reports whether a client's recordings are deleted once
+// transcribed
+func (s *Scribe) discardsAudio(clientID string) bool {
+	return len(s.textOnly) > 0 && (s.textOnly["*"] || s.selects(s.textOnly, clientID))
+}
+
+// discardRecording deletes a transcribed recording of a text-only client,
+// with the original it was converted from and its thumbnails
+func (s *Scribe) discardRecording(job TranscriptionJob) {
+	dir := filepath.Dir(job.FilePath)
+	stem := strings.TrimSuffix(filepath.Base(job.FilePath), "_whisper.wav")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Failed to discard recording", "error", err, "file", job.FilePath, "clientID", job.ClientID)
+		return
+	}
+	manifest, err := audio.ReadManifest(filepath.Dir(dir))
+	if err != nil {
+		slog.Error("Failed to read manifest", "error", err, "file", job.FilePath)
+	}
 
-		// Skip empty lines
-		if strings.TrimSpace(line) == "" {
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, stem+".") && !strings.HasPrefix(name, stem+"_whisper.") {
 			continue
 		}
-
-		// Skip blank audio markers
-		if strings.Contains(line, "[BLANK_AUDIO]") {
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed to discard recording", "error", err, "file", path, "clientID", job.ClientID)
 			continue
 		}
-
-		text := strings.TrimSpace(line)
-		if text != "" {
-			if builder.Len() > 0 {
-				builder.WriteString(" ")
+		if entry, ok := manifest[job.ClientID+"/"+name]; ok && !entry.Removed {
+			if err := audio.RecordRemoval(path); err != nil {
+				slog.Error("Failed to record removal", "error", err, "file", path)
 			}
-			builder.WriteString(text)
 		}
 	}
 
-	return strings.TrimSpace(builder.String())
+	slog.Debug("Discarded transcribed recording",
+		"file", filepath.Base(job.FilePath),
+		"clientID", job.ClientID)
+}
+
+// Matches the "[00:00:00.000 --> 00:00:02.500]" prefix of whisper lines
+var segmentTimes = regexp.MustCompile(`^\[(\d+):(\d{2}):(\d{2})\.(\d{3}) --> (\d+):(\d{2}):(\d{2})\.(\d{3})\]`)
+
+// parseSegments extracts the text from whisper's subtitle-style output.
+// Lines without timestamps are kept as untimed segments.
+func parseSegments(output string) []Segment {
+	segments := make([]Segment, 0)
+	for _, line := range strings.Split(output, "\n") {
+		var segment Segment
+		if m := segmentTimes.FindStringSubmatch(line); m != nil {
+			segment.Start = parseTimestamp(m[1:5])
+			segment.End = parseTimestamp(m[5:9])
+			line = line[len(m[0]):]
+		}
+
+		// Skip empty lines and blank audio markers
+		segment.Text = strings.TrimSpace(line)
+		if segment.Text == "" || strings.Contains(segment.Text, "[BLANK_AUDIO]") {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// parseTimestamp converts hours, minutes, seconds and milliseconds
+func parseTimestamp(parts []string) time.Duration {
+	units := []time.Duration{time.Hour, time.Minute, time.Second, time.Millisecond}
+	var d time.Duration
+	for i, part := range parts {
+		n, _ := strconv.Atoi(part)
+		d += time.Duration(n) * units[i]
+	}
+	return d
+}
+
+func joinSegments(segments []Segment) string {
+	texts := make([]string, len(segments))
+	for i, segment := range segments {
+		texts[i] = segment.Text
+	}
+	return strings.Join(texts, " ")
 }
@@ -0,0 +1,84 @@
+package scribe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Transcriptions delivered by concurrent workers reach subscribers in
+// sequence order, so replaying from the last one seen misses none
+func TestDeliverOrdersSequences(t *testing.T) {
+	// Workers have to run in parallel for the race to show on one CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	s := newTestScribe(t, Config{})
+	const workers, perWorker = 4, 100
+	live := subscribe(s, workers*perWorker)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				job := TranscriptionJob{
+					ClientID:  fmt.Sprintf("client-%d", w),
+					FilePath:  fmt.Sprintf("/nonexistent/audio_%d_%d.wav", w, i),
+					Timestamp: time.Now(),
+				}
+				msg := TranscriptionMessage{Timestamp: job.Timestamp, Text: fmt.Sprintf("worker %d message %d", w, i)}
+				if err := s.deliver(context.Background(), job, msg, time.Now()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sequences := received(t, live)
+	if len(sequences) != workers*perWorker {
+		t.Fatalf("received %d transcriptions, expected %d", len(sequences), workers*perWorker)
+	}
+	for i := 1; i < len(sequences); i++ {
+		if sequences[i] <= sequences[i-1] {
+			t.Fatalf("sequence %d broadcast after %d", sequences[i], sequences[i-1])
+		}
+	}
+
+	// A subscriber that saw up to the middle one replays the rest
+	middle := sequences[len(sequences)/2]
+	replayed := subscribe(s, workers*perWorker)
+	if err := replayed.replay(SubscriptionCommand{Action: "replay", Sequence: middle}); err != nil {
+		t.Fatal(err)
+	}
+	rest := received(t, replayed)
+	if want := sequences[len(sequences)/2+1:]; fmt.Sprint(rest) != fmt.Sprint(want) {
+		t.Fatalf("replay from %d returned %v, expected %v", middle, rest, want)
+	}
+}
+
+// received drains the sequence numbers of the transcriptions sent to a
+// subscriber
+func received(t *testing.T, c *wsConnection) []uint64 {
+	t.Helper()
+	var sequences []uint64
+	for {
+		select {
+		case data := <-c.send:
+			var msg WebSocketMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == "transcription" {
+				sequences = append(sequences, msg.Sequence)
+			}
+		default:
+			return sequences
+		}
+	}
+}
@@ -0,0 +1,717 @@
+// Package scribeclient is a typed Go client for the scribe REST and
+// WebSocket API described in scribe/openapi.json
+package scribeclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config for the scribe API client
+type Config struct {
+	// Base URL of the scribe HTTP server, e.g. https://localhost:8444
+	BaseURL string
+
+	// HTTP client to use, a default client is created when nil
+	HTTPClient *http.Client
+
+	// Skip certificate verification (self-signed development certificates)
+	InsecureSkipVerify bool
+
+	// Certificates to trust instead of the system pool, e.g. the scribe's
+	// self-signed certificate
+	RootCAs *x509.CertPool
+
+	// ID token from the scribe's OpenID Connect provider, sent as a bearer
+	// token when the scribe requires sign-in
+	BearerToken string
+}
+
+// Client talks to a scribe instance
+type Client struct {
+	baseURL     *url.URL
+	httpClient  *http.Client
+	tlsConfig   *tls.Config
+	bearerToken string
+}
+
+// APIError is returned when the server responds with a non-success status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("scribe API error %d: %s", e.StatusCode, e.Message)
+}
+
+// New creates a new Client
+func New(cfg Config) (*Client, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(cfg.BaseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("base URL must use http or https")
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		RootCAs:            cfg.RootCAs,
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+
+	return &Client{
+		baseURL:     baseURL,
+		httpClient:  httpClient,
+		tlsConfig:   tlsConfig,
+		bearerToken: cfg.BearerToken,
+	}, nil
+}
+
+// ListClients returns every client with its most recent transcription from today
+func (c *Client) ListClients(ctx context.Context) (map[string]TranscriptionMessage, error) {
+	var clients map[string]TranscriptionMessage
+	err := c.getJSON(ctx, "/api/clients", nil, &clients)
+	return clients, err
+}
+
+// Presence returns the audio clients currently connected to the server
+func (c *Client) Presence(ctx context.Context) (map[string]PresenceMessage, error) {
+	var connected map[string]PresenceMessage
+	err := c.getJSON(ctx, "/api/presence", nil, &connected)
+	return connected, err
+}
+
+// GetClient returns the most recent transcription for a client from today
+func (c *Client) GetClient(ctx context.Context, clientID string) (*TranscriptionMessage, error) {
+	var msg TranscriptionMessage
+	if err := c.getJSON(ctx, "/api/clients/"+url.PathEscape(clientID), nil, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// History returns all of today's transcriptions for a client
+func (c *Client) History(ctx context.Context, clientID string) ([]TranscriptionMessage, error) {
+	var messages []TranscriptionMessage
+	err := c.getJSON(ctx, "/api/clients/"+url.PathEscape(clientID)+"/history", nil, &messages)
+	return messages, err
+}
+
+// Sessions returns a client's transcriptions from one day grouped into
+// sessions. The date (YYYYMMDD) may be empty for today.
+func (c *Client) Sessions(ctx context.Context, clientID, date string) ([]Session, error) {
+	query := url.Values{}
+	if date != "" {
+		query.Set("date", date)
+	}
+	var sessions []Session
+	err := c.getJSON(ctx, "/api/clients/"+url.PathEscape(clientID)+"/sessions", query, &sessions)
+	return sessions, err
+}
+
+// Audio downloads a stored recording. The date (YYYYMMDD) may be empty.
+// The caller must close the returned reader.
+func (c *Client) Audio(ctx context.Context, clientID, file, date string) (io.ReadCloser, error) {
+	query := url.Values{}
+	if date != "" {
+		query.Set("date", date)
+	}
+	path := "/api/clients/" + url.PathEscape(clientID) + "/audio/" + url.PathEscape(file)
+
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Waveform downloads a PNG thumbnail of a stored recording. Kind is
+// "waveform" or "spectrogram" and, like date, may be empty for the default.
+// The caller must close the returned reader.
+func (c *Client) Waveform(ctx context.Context, clientID, file, date, kind string) (io.ReadCloser, error) {
+	query := url.Values{}
+	if date != "" {
+		query.Set("date", date)
+	}
+	if kind != "" {
+		query.Set("type", kind)
+	}
+	path := "/api/clients/" + url.PathEscape(clientID) + "/audio/" + url.PathEscape(file) + "/waveform"
+
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Digest downloads a client's recordings from one day joined into a single
+// WAV file. The date (YYYYMMDD) may be empty for today and a zero gap uses
+// the server default of one second. The caller must close the returned
+// reader.
+func (c *Client) Digest(ctx context.Context, clientID, date string, gap time.Duration) (io.ReadCloser, error) {
+	query := url.Values{}
+	if date != "" {
+		query.Set("date", date)
+	}
+	if gap > 0 {
+		query.Set("gap", strconv.FormatInt(gap.Milliseconds(), 10))
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/api/clients/"+url.PathEscape(clientID)+"/digest", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Integrity verifies stored recordings against their checksum manifests.
+// The date (YYYYMMDD) may be empty to check every day.
+func (c *Client) Integrity(ctx context.Context, date string) ([]IntegrityReport, error) {
+	query := url.Values{}
+	if date != "" {
+		query.Set("date", date)
+	}
+	var reports []IntegrityReport
+	err := c.getJSON(ctx, "/api/integrity", query, &reports)
+	return reports, err
+}
+
+// Search finds stored transcriptions containing every word of the query,
+// oldest first. The query may be empty when searching by event. Zero fields
+// of the options are left to the server defaults.
+func (c *Client) Search(ctx context.Context, query string, opts SearchOptions) ([]StoredTranscription, error) {
+	params := url.Values{}
+	if query != "" {
+		params.Set("q", query)
+	}
+	if opts.ClientID != "" {
+		params.Set("clientId", opts.ClientID)
+	}
+	if opts.Event != "" {
+		params.Set("event", opts.Event)
+	}
+	if opts.From != "" {
+		params.Set("from", opts.From)
+	}
+	if opts.To != "" {
+		params.Set("to", opts.To)
+	}
+	if opts.Limit > 0 {
+		params.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var results []StoredTranscription
+	err := c.getJSON(ctx, "/api/search", params, &results)
+	return results, err
+}
+
+// TalkTime returns how long clients spoke per hour or day. Zero fields of
+// the options are left to the server defaults.
+func (c *Client) TalkTime(ctx context.Context, opts TalkTimeOptions) (*TalkTime, error) {
+	params := url.Values{}
+	if opts.Interval != "" {
+		params.Set("interval", opts.Interval)
+	}
+	if opts.ClientID != "" {
+		params.Set("clientId", opts.ClientID)
+	}
+	if opts.From != "" {
+		params.Set("from", opts.From)
+	}
+	if opts.To != "" {
+		params.Set("to", opts.To)
+	}
+	var talkTime TalkTime
+	if err := c.getJSON(ctx, "/api/analytics/talktime", params, &talkTime); err != nil {
+		return nil, err
+	}
+	return &talkTime, nil
+}
+
+// Version returns the build, protocol revision and features of the scribe
+func (c *Client) Version(ctx context.Context) (*VersionInfo, error) {
+	var info VersionInfo
+	if err := c.getJSON(ctx, "/api/version", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Retention returns the retention policy and up to limit recent runs,
+// newest first. A limit of zero uses the server default.
+func (c *Client) Retention(ctx context.Context, limit int) (*RetentionReport, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var report RetentionReport
+	if err := c.getJSON(ctx, "/api/retention", query, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Prompts returns the initial prompts whisper is given for each client
+func (c *Client) Prompts(ctx context.Context) (*PromptsResponse, error) {
+	var prompts PromptsResponse
+	if err := c.getJSON(ctx, "/api/prompts", nil, &prompts); err != nil {
+		return nil, err
+	}
+	return &prompts, nil
+}
+
+// SetPrompt sets the initial prompt of a client ID or host. An empty prompt
+// gives the client none, even when the server has a default.
+func (c *Client) SetPrompt(ctx context.Context, client, prompt string) error {
+	body, err := json.Marshal(map[string]string{"prompt": prompt})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPut, "/api/prompts/"+url.PathEscape(client), nil, bytes.NewReader(body), "application/json")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeletePrompt removes the prompt set for a client ID or host through the
+// API, leaving it to the server configuration
+func (c *Client) DeletePrompt(ctx context.Context, client string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/prompts/"+url.PathEscape(client), nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CorrectTranscription replaces the text of a client's transcription, the
+// scribe learning the terms whisper mis-heard for the client's prompt
+func (c *Client) CorrectTranscription(ctx context.Context, clientID string, sequence uint64, text string) (*TranscriptionMessage, error) {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return nil, err
+	}
+	path := "/api/clients/" + url.PathEscape(clientID) + "/transcriptions/" + strconv.FormatUint(sequence, 10)
+	resp, err := c.do(ctx, http.MethodPut, path, nil, bytes.NewReader(body), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var msg TranscriptionMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &msg, nil
+}
+
+// Vocabulary returns the terms learned from a client's corrections
+func (c *Client) Vocabulary(ctx context.Context, clientID string) (*Vocabulary, error) {
+	var vocabulary Vocabulary
+	if err := c.getJSON(ctx, "/api/clients/"+url.PathEscape(clientID)+"/vocabulary", nil, &vocabulary); err != nil {
+		return nil, err
+	}
+	return &vocabulary, nil
+}
+
+// ForgetVocabulary forgets a client's corrections and the terms learned
+// from them. Corrected transcriptions keep their text.
+func (c *Client) ForgetVocabulary(ctx context.Context, clientID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/clients/"+url.PathEscape(clientID)+"/vocabulary", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Speakers returns the speakers enrolled for identification by voice print
+func (c *Client) Speakers(ctx context.Context) ([]Speaker, error) {
+	var speakers []Speaker
+	err := c.getJSON(ctx, "/api/speakers", nil, &speakers)
+	return speakers, err
+}
+
+// EnrollSpeaker adds a stored recording of a speaker to their voice prints,
+// enrolling them when new. The date (YYYYMMDD) may be empty.
+func (c *Client) EnrollSpeaker(ctx context.Context, name, clientID, file, date string) (*Speaker, error) {
+	body, err := json.Marshal(map[string]string{"clientId": clientID, "audioFile": file, "date": date})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/api/speakers/"+url.PathEscape(name), nil, bytes.NewReader(body), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var speaker Speaker
+	if err := json.NewDecoder(resp.Body).Decode(&speaker); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &speaker, nil
+}
+
+// Say speaks text on a client's device, which must be connected and play
+// speech
+func (c *Client) Say(ctx context.Context, clientID, text string) (*SayResponse, error) {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/api/clients/"+url.PathEscape(clientID)+"/say", nil, bytes.NewReader(body), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var said SayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&said); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &said, nil
+}
+
+// IntercomRoutes lists where the audio of clients is routed
+func (c *Client) IntercomRoutes(ctx context.Context) ([]IntercomRoute, error) {
+	var routes []IntercomRoute
+	err := c.getJSON(ctx, "/api/intercom", nil, &routes)
+	return routes, err
+}
+
+// Route sends the live audio of one client to another, and back when
+// twoWay is set, returning the routes
+func (c *Client) Route(ctx context.Context, from, to string, twoWay bool) ([]IntercomRoute, error) {
+	body, err := json.Marshal(map[string]any{"from": from, "to": to, "twoWay": twoWay})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/api/intercom", nil, bytes.NewReader(body), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var routes []IntercomRoute
+	if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return routes, nil
+}
+
+// Unroute stops routing the audio of a client and audio routed to it
+func (c *Client) Unroute(ctx context.Context, clientID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/intercom/"+url.PathEscape(clientID), nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Mute discards what a client transmits for the given duration, or until
+// Unmute when it is zero, returning its presence
+func (c *Client) Mute(ctx context.Context, clientID string, duration time.Duration) (*PresenceMessage, error) {
+	request := map[string]string{}
+	if duration > 0 {
+		request["duration"] = duration.String()
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return c.changeMute(ctx, http.MethodPost, clientID, bytes.NewReader(body))
+}
+
+// Unmute records a muted client again, returning its presence
+func (c *Client) Unmute(ctx context.Context, clientID string) (*PresenceMessage, error) {
+	return c.changeMute(ctx, http.MethodDelete, clientID, nil)
+}
+
+func (c *Client) changeMute(ctx context.Context, method, clientID string, body io.Reader) (*PresenceMessage, error) {
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+	resp, err := c.do(ctx, method, "/api/clients/"+url.PathEscape(clientID)+"/mute", nil, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var presence PresenceMessage
+	if err := json.NewDecoder(resp.Body).Decode(&presence); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &presence, nil
+}
+
+// DeleteData erases a client's recordings, transcriptions, backups and
+// speaker enrollments of the days from from to to (YYYYMMDD, inclusive,
+// empty for no bound). Check the report with SignedDeletionReport.Verify.
+func (c *Client) DeleteData(ctx context.Context, clientID, from, to string) (*SignedDeletionReport, error) {
+	params := url.Values{}
+	if from != "" {
+		params.Set("from", from)
+	}
+	if to != "" {
+		params.Set("to", to)
+	}
+	resp, err := c.do(ctx, http.MethodDelete, "/api/clients/"+url.PathEscape(clientID)+"/data", params, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var signed SignedDeletionReport
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &signed, nil
+}
+
+// DeleteSpeaker forgets an enrolled speaker and their voice prints
+func (c *Client) DeleteSpeaker(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/speakers/"+url.PathEscape(name), nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Transcribe uploads audio for transcription. The client ID may be empty to
+// have the server generate one.
+func (c *Client) Transcribe(ctx context.Context, clientID, fileName string, audio io.Reader) (*UploadResponse, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if clientID != "" {
+		if err := form.WriteField("clientId", clientID); err != nil {
+			return nil, err
+		}
+	}
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return nil, fmt.Errorf("failed to read audio: %w", err)
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/api/transcribe", nil, &body, form.FormDataContentType())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &result, nil
+}
+
+// Size of the chunks UploadResumable sends and how often it tries a chunk
+const (
+	uploadChunkSize = 8 << 20
+	uploadAttempts  = 5
+)
+
+// CreateUpload starts a resumable upload of a file of size bytes. The
+// client ID may be empty to have the server generate one.
+func (c *Client) CreateUpload(ctx context.Context, clientID, fileName string, size int64) (*ChunkedUpload, error) {
+	body, err := json.Marshal(map[string]interface{}{"clientId": clientID, "fileName": fileName, "size": size})
+	if err != nil {
+		return nil, err
+	}
+	return c.uploadRequest(ctx, http.MethodPost, "/api/uploads", nil, bytes.NewReader(body), "application/json")
+}
+
+// Upload returns the state of a resumable upload, how much of it the
+// server has and, once complete, the recording queued for transcription
+func (c *Client) Upload(ctx context.Context, id string) (*ChunkedUpload, error) {
+	var upload ChunkedUpload
+	err := c.getJSON(ctx, "/api/uploads/"+url.PathEscape(id), nil, &upload)
+	return &upload, err
+}
+
+// AppendUpload sends the next chunk of a resumable upload, offset being
+// how much the server already has
+func (c *Client) AppendUpload(ctx context.Context, id string, offset int64, chunk io.Reader) (*ChunkedUpload, error) {
+	query := url.Values{"offset": {strconv.FormatInt(offset, 10)}}
+	return c.uploadRequest(ctx, http.MethodPatch, "/api/uploads/"+url.PathEscape(id), query, chunk, "application/offset+octet-stream")
+}
+
+// UploadResumable uploads a long recording in chunks, picking up from what
+// the server received when a chunk fails, and returns the upload once it
+// is complete. It is queued for transcription shortly after, see Upload.
+func (c *Client) UploadResumable(ctx context.Context, clientID, fileName string, file io.ReaderAt, size int64) (*ChunkedUpload, error) {
+	upload, err := c.CreateUpload(ctx, clientID, fileName, size)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := 0
+	backoff := time.Second
+	for upload.Status == "receiving" {
+		chunk := io.NewSectionReader(file, upload.Offset, min(uploadChunkSize, size-upload.Offset))
+		next, err := c.AppendUpload(ctx, upload.ID, upload.Offset, chunk)
+		if err == nil {
+			upload, failures, backoff = next, 0, time.Second
+			continue
+		}
+
+		var apiErr *APIError
+		if failures++; failures == uploadAttempts || ctx.Err() != nil ||
+			(errors.As(err, &apiErr) && apiErr.StatusCode != http.StatusConflict && apiErr.StatusCode < 500) {
+			return upload, fmt.Errorf("failed to upload %s: %w", fileName, err)
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return upload, ctx.Err()
+		}
+		// Resume from whatever part of the chunk arrived
+		if current, err := c.Upload(ctx, upload.ID); err == nil {
+			upload = current
+		}
+	}
+	return upload, nil
+}
+
+func (c *Client) uploadRequest(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*ChunkedUpload, error) {
+	resp, err := c.do(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var upload ChunkedUpload
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &upload, nil
+}
+
+// Meetings lists the meetings without their transcripts, the latest first
+func (c *Client) Meetings(ctx context.Context) ([]Meeting, error) {
+	var meetings []Meeting
+	err := c.getJSON(ctx, "/api/meetings", nil, &meetings)
+	return meetings, err
+}
+
+// StartMeeting records clients, by ID or host, continuously until
+// EndMeeting
+func (c *Client) StartMeeting(ctx context.Context, title string, clients []string) (*Meeting, error) {
+	body, err := json.Marshal(map[string]any{"title": title, "clients": clients})
+	if err != nil {
+		return nil, err
+	}
+	return c.meetingRequest(ctx, http.MethodPost, "/api/meetings", bytes.NewReader(body))
+}
+
+// Meeting returns a meeting, with its transcript once it is done
+func (c *Client) Meeting(ctx context.Context, id string) (*Meeting, error) {
+	var meeting Meeting
+	err := c.getJSON(ctx, "/api/meetings/"+url.PathEscape(id), nil, &meeting)
+	return &meeting, err
+}
+
+// EndMeeting stops recording a meeting. Its transcript follows once the
+// last recordings are transcribed, see Meeting.
+func (c *Client) EndMeeting(ctx context.Context, id string) (*Meeting, error) {
+	return c.meetingRequest(ctx, http.MethodPost, "/api/meetings/"+url.PathEscape(id)+"/end", nil)
+}
+
+func (c *Client) meetingRequest(ctx context.Context, method, path string, body io.Reader) (*Meeting, error) {
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+	resp, err := c.do(ctx, method, path, nil, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var meeting Meeting
+	if err := json.NewDecoder(resp.Body).Decode(&meeting); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &meeting, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, out interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	endpoint := *c.baseURL
+	endpoint.Path += path
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.authorize(req.Header)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(message)),
+		}
+	}
+
+	return resp, nil
+}
+
+// authorize adds the bearer token to request headers when one is set
+func (c *Client) authorize(header http.Header) {
+	if c.bearerToken != "" {
+		header.Set("Authorization", "Bearer "+c.bearerToken)
+	}
+}
@@ -0,0 +1,72 @@
+package scribeclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subscription is a live WebSocket feed of scribe messages
+type Subscription struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// Subscribe opens a WebSocket feed. The feed starts without subscriptions,
+// use Send with a "subscribe" command to choose clients.
+func (c *Client) Subscribe(ctx context.Context) (*Subscription, error) {
+	endpoint := *c.baseURL
+	endpoint.Path += "/ws"
+	if endpoint.Scheme == "https" {
+		endpoint.Scheme = "wss"
+	} else {
+		endpoint.Scheme = "ws"
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:           websocket.DefaultDialer.Proxy,
+		TLSClientConfig: c.tlsConfig,
+	}
+
+	header := make(http.Header)
+	c.authorize(header)
+	conn, _, err := dialer.DialContext(ctx, endpoint.String(), header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", redact(endpoint), err)
+	}
+
+	return &Subscription{conn: conn}, nil
+}
+
+// Send issues a subscription command. The server answers with an "ack" or
+// "error" message delivered through Next.
+func (s *Subscription) Send(cmd SubscriptionCommand) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(cmd)
+}
+
+// Next blocks until the next message arrives
+func (s *Subscription) Next() (WebSocketMessage, error) {
+	var msg WebSocketMessage
+	err := s.conn.ReadJSON(&msg)
+	return msg, err
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() error {
+	s.writeMu.Lock()
+	s.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	s.writeMu.Unlock()
+	return s.conn.Close()
+}
+
+func redact(u url.URL) string {
+	u.User = nil
+	return u.String()
+}
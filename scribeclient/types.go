@@ -0,0 +1,479 @@
+package scribeclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The types in this file mirror the schemas in scribe/openapi.json, which
+// TestTypesMatchOpenAPI holds them to
+
+// TranscriptionMessage represents a single transcribed message
+type TranscriptionMessage struct {
+	Sequence   uint64    `json:"sequence"`
+	Timestamp  time.Time `json:"timestamp"`
+	Text       string    `json:"text"`
+	AudioFile  string    `json:"audioFile"`
+	Confidence float32   `json:"confidence"`
+
+	// Text whisper transcribed, set once a user corrected Text
+	OriginalText string `json:"originalText,omitempty"`
+
+	// Length of the transmission in milliseconds
+	DurationMs int64 `json:"durationMs,omitempty"`
+
+	// Set when the recording was deleted once transcribed, the client
+	// being text-only
+	AudioDiscarded bool `json:"audioDiscarded,omitempty"`
+
+	// ID of the session the transcription belongs to
+	Session uint64 `json:"session,omitempty"`
+
+	// Timing of each word, when whisper reported it
+	Words []Word `json:"words,omitempty"`
+
+	// Language whisper transcribed the recording in, and whether the
+	// client is not expected to speak it
+	Language           string `json:"language,omitempty"`
+	UnexpectedLanguage bool   `json:"unexpectedLanguage,omitempty"`
+
+	// Kind of sound heard instead of speech, e.g. music or knock
+	Sound string `json:"sound,omitempty"`
+
+	// Name of the enrolled speaker whose voice print the recording matches
+	Speaker string `json:"speaker,omitempty"`
+
+	// Titles of the calendar events the recording was made during
+	Events []string `json:"events,omitempty"`
+
+	// Remote scribe the transcription was aggregated from, and its
+	// sequence number there
+	Site           string `json:"site,omitempty"`
+	RemoteSequence uint64 `json:"remoteSequence,omitempty"`
+}
+
+// Word is one word of a transcription, timed in milliseconds from the
+// start of the recording
+type Word struct {
+	Text       string  `json:"text"`
+	StartMs    int64   `json:"startMs"`
+	EndMs      int64   `json:"endMs"`
+	Confidence float32 `json:"confidence,omitempty"`
+}
+
+// Session is a conversation, a client's transmissions following each
+// other within the scribe's session gap
+type Session struct {
+	ID             uint64                 `json:"id"`
+	Start          time.Time              `json:"start"`
+	End            time.Time              `json:"end"`
+	Text           string                 `json:"text"`
+	Transcriptions []TranscriptionMessage `json:"transcriptions"`
+}
+
+// PromptsResponse lists the initial prompts whisper is given
+type PromptsResponse struct {
+	// Prompt of clients without one of their own
+	Default string `json:"default"`
+
+	// Prompts by client ID or host
+	Clients map[string]string `json:"clients"`
+}
+
+// Vocabulary is what the scribe learned from a client's corrected
+// transcriptions
+type Vocabulary struct {
+	ClientID    string        `json:"clientId"`
+	Corrections int           `json:"corrections"`
+	Terms       []LearnedTerm `json:"terms"`
+
+	// Prompt whisper is given for the client, learned terms included
+	Prompt string `json:"prompt"`
+}
+
+// LearnedTerm is a term users corrected whisper's transcriptions to
+type LearnedTerm struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+
+	// What whisper heard instead, the most frequent first
+	HeardAs []string `json:"heardAs"`
+
+	// Whether the term is added to the client's prompt
+	Prompted bool `json:"prompted"`
+}
+
+// Speaker is a speaker enrolled for identification by voice print
+type Speaker struct {
+	Name string `json:"name"`
+
+	// Recordings the speaker was enrolled with, as clientID/file
+	Samples []string `json:"samples"`
+}
+
+// PresenceMessage describes whether an audio client is connected
+type PresenceMessage struct {
+	Connected   bool      `json:"connected"`
+	Addr        string    `json:"addr,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt,omitempty"`
+
+	// Whether what the client transmits is discarded, until MutedUntil
+	// when set
+	Muted      bool       `json:"muted,omitempty"`
+	MutedUntil *time.Time `json:"mutedUntil,omitempty"`
+
+	// Metrics the client last reported of its device and when
+	Health   map[string]float64 `json:"health,omitempty"`
+	HealthAt *time.Time         `json:"healthAt,omitempty"`
+
+	// Remote scribe the client is connected to, for aggregated clients
+	Site string `json:"site,omitempty"`
+}
+
+// TranslationMessage is a transcription translated into the target language
+// of the scribe, received after the transcription
+type TranslationMessage struct {
+	Sequence       uint64 `json:"sequence"`
+	Language       string `json:"language"`
+	SourceLanguage string `json:"sourceLanguage,omitempty"`
+	Text           string `json:"text"`
+	Source         string `json:"source"`
+}
+
+// SayResponse is returned once text was spoken on a client
+type SayResponse struct {
+	ClientID   string `json:"clientId"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// IntercomRoute sends the live audio of one client to another
+type IntercomRoute struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// UploadResponse is returned once an uploaded file has been queued
+type UploadResponse struct {
+	ClientID  string `json:"clientId"`
+	AudioFile string `json:"audioFile"`
+	Status    string `json:"status"`
+}
+
+// ChunkedUpload is the state of a resumable upload of a long recording
+type ChunkedUpload struct {
+	ID       string `json:"id"`
+	ClientID string `json:"clientId"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+
+	// receiving, processing, queued or failed
+	Status string `json:"status"`
+
+	// Whisper copy queued for transcription once the upload is complete
+	AudioFile string `json:"audioFile,omitempty"`
+
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Meeting is a stretch of time some clients were recorded continuously,
+// with its chaptered transcript once it is done
+type Meeting struct {
+	ID      string     `json:"id"`
+	Title   string     `json:"title,omitempty"`
+	Clients []string   `json:"clients"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+
+	// recording, processing, done or failed
+	Status     string             `json:"status"`
+	Error      string             `json:"error,omitempty"`
+	Transcript *MeetingTranscript `json:"transcript,omitempty"`
+}
+
+// MeetingTranscript is what was said in a meeting, who said it and what is
+// to be done about it
+type MeetingTranscript struct {
+	Chapters    []MeetingChapter `json:"chapters"`
+	Speakers    []MeetingSpeaker `json:"speakers"`
+	ActionItems []string         `json:"actionItems"`
+	Diarized    bool             `json:"diarized"`
+}
+
+// MeetingChapter is a part of a meeting
+type MeetingChapter struct {
+	Title string        `json:"title"`
+	Start time.Time     `json:"start"`
+	End   time.Time     `json:"end"`
+	Turns []MeetingTurn `json:"turns"`
+}
+
+// MeetingTurn is what one speaker said without interruption
+type MeetingTurn struct {
+	Speaker  string    `json:"speaker"`
+	ClientID string    `json:"clientId"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Text     string    `json:"text"`
+	Sequence uint64    `json:"sequence"`
+}
+
+// MeetingSpeaker sums up how much someone spoke in a meeting
+type MeetingSpeaker struct {
+	Speaker    string  `json:"speaker"`
+	TalkTimeMs int64   `json:"talkTimeMs"`
+	Words      int     `json:"words"`
+	Turns      int     `json:"turns"`
+	Share      float64 `json:"share"`
+}
+
+// IntegrityReport lists the recordings of one day that no longer match
+// their checksums
+type IntegrityReport struct {
+	Day       string   `json:"day"`
+	Verified  int      `json:"verified"`
+	Corrupted []string `json:"corrupted"`
+	Missing   []string `json:"missing"`
+}
+
+// StoredTranscription is a transcription returned by a search
+type StoredTranscription struct {
+	ClientID string               `json:"clientId"`
+	Message  TranscriptionMessage `json:"message"`
+}
+
+// TalkTime is how long clients spoke per hour or day
+type TalkTime struct {
+	Interval string           `json:"interval"`
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	Clients  []ClientTalkTime `json:"clients"`
+}
+
+// ClientTalkTime is one client's talk time over the requested days
+type ClientTalkTime struct {
+	ClientID      string           `json:"clientId"`
+	Host          string           `json:"host,omitempty"`
+	TalkMs        int64            `json:"talkMs"`
+	Transmissions int              `json:"transmissions"`
+	Buckets       []TalkTimeBucket `json:"buckets"`
+}
+
+// TalkTimeBucket is the talk time of one hour or day
+type TalkTimeBucket struct {
+	Start         time.Time `json:"start"`
+	TalkMs        int64     `json:"talkMs"`
+	Transmissions int       `json:"transmissions"`
+}
+
+// TalkTimeOptions selects the talk time returned
+type TalkTimeOptions struct {
+	// "hour" or "day", hours by default
+	Interval string
+
+	// Only count this client's transmissions
+	ClientID string
+
+	// First and last day (YYYYMMDD), inclusive, today by default
+	From string
+	To   string
+}
+
+// SearchOptions narrows a search
+type SearchOptions struct {
+	// Only search this client's transcriptions
+	ClientID string
+
+	// Only return transcriptions made during calendar events whose title
+	// contains this, ignoring case
+	Event string
+
+	// First and last day (YYYYMMDD) to search, inclusive
+	From string
+	To   string
+
+	// Maximum number of results, the newest are kept
+	Limit int
+}
+
+// VersionInfo describes the build a scribe runs
+type VersionInfo struct {
+	Version    string          `json:"version"`
+	Commit     string          `json:"commit,omitempty"`
+	CommitTime string          `json:"commitTime,omitempty"`
+	Modified   bool            `json:"modified,omitempty"`
+	GoVersion  string          `json:"goVersion"`
+	Protocol   int             `json:"protocol"`
+	Backends   []string        `json:"backends"`
+	Features   map[string]bool `json:"features,omitempty"`
+}
+
+// RetentionRun records what one nightly retention run purged
+type RetentionRun struct {
+	Time           time.Time `json:"time"`
+	AudioDays      []string  `json:"audioDays"`
+	TranscriptDays []string  `json:"transcriptDays"`
+	BackedUpDays   []string  `json:"backedUpDays,omitempty"`
+	Archived       int       `json:"archived"`
+	DeletedFiles   int       `json:"deletedFiles"`
+	DeletedBytes   int64     `json:"deletedBytes"`
+	Errors         []string  `json:"errors,omitempty"`
+}
+
+// RetentionReport is the retention policy of a scribe and its recent runs
+type RetentionReport struct {
+	AudioDays      int            `json:"audioDays"`
+	TranscriptDays int            `json:"transcriptDays"`
+	Archive        string         `json:"archive,omitempty"`
+	Backup         string         `json:"backup,omitempty"`
+	BackedUpDays   int            `json:"backedUpDays,omitempty"`
+	Runs           []RetentionRun `json:"runs"`
+}
+
+// DeletionReport records what erasing a client's data removed
+type DeletionReport struct {
+	ClientID            string    `json:"clientId"`
+	From                string    `json:"from,omitempty"`
+	To                  string    `json:"to,omitempty"`
+	Time                time.Time `json:"time"`
+	RequestedBy         string    `json:"requestedBy,omitempty"`
+	Days                []string  `json:"days"`
+	DeletedFiles        int       `json:"deletedFiles"`
+	DeletedBytes        int64     `json:"deletedBytes"`
+	Transcriptions      int       `json:"transcriptions"`
+	BackupObjects       int       `json:"backupObjects"`
+	ArchiveObjects      int       `json:"archiveObjects"`
+	SpeakerSamples      int       `json:"speakerSamples"`
+	MeetingTurns        int       `json:"meetingTurns"`
+	Corrections         int       `json:"corrections"`
+	OutputFiles         int       `json:"outputFiles"`
+	BackupLedgerEntries int       `json:"backupLedgerEntries"`
+	RetentionErrors     int       `json:"retentionErrors"`
+	Uploads             int       `json:"uploads"`
+	InboxFiles          int       `json:"inboxFiles"`
+	Errors              []string  `json:"errors,omitempty"`
+}
+
+// SignedDeletionReport is a DeletionReport signed with the private key of
+// the scribe's TLS certificate
+type SignedDeletionReport struct {
+	Report    json.RawMessage `json:"report"`
+	Algorithm string          `json:"algorithm"`
+	Signature string          `json:"signature"`
+}
+
+// Verify checks the signature against the public key of the scribe's
+// certificate and decodes the report
+func (s SignedDeletionReport) Verify(key crypto.PublicKey) (*DeletionReport, error) {
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	digest := sha256.Sum256(s.Report)
+	valid := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		valid = s.Algorithm == "RSA-PKCS1v15-SHA256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		valid = s.Algorithm == "ECDSA-SHA256" && ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = s.Algorithm == "Ed25519" && ed25519.Verify(key, s.Report, signature)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if !valid {
+		return nil, fmt.Errorf("deletion report signature is invalid")
+	}
+
+	var report DeletionReport
+	if err := json.Unmarshal(s.Report, &report); err != nil {
+		return nil, fmt.Errorf("failed to decode deletion report: %w", err)
+	}
+	return &report, nil
+}
+
+// WebSocketMessage is a message received from a subscription
+type WebSocketMessage struct {
+	Type      string          `json:"type"`
+	ClientID  string          `json:"clientId"`
+	Sequence  uint64          `json:"sequence,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Transcription decodes the payload of a "transcription" message
+func (m WebSocketMessage) Transcription() (TranscriptionMessage, error) {
+	var msg TranscriptionMessage
+	if m.Type != "transcription" {
+		return msg, fmt.Errorf("message type is %q, not transcription", m.Type)
+	}
+	err := json.Unmarshal(m.Payload, &msg)
+	return msg, err
+}
+
+// Translation decodes the payload of a "translation" message
+func (m WebSocketMessage) Translation() (TranslationMessage, error) {
+	var translation TranslationMessage
+	if m.Type != "translation" {
+		return translation, fmt.Errorf("message type is %q, not translation", m.Type)
+	}
+	err := json.Unmarshal(m.Payload, &translation)
+	return translation, err
+}
+
+// Presence decodes the payload of "client_connected",
+// "client_disconnected", "client_muted" and "client_unmuted" messages
+func (m WebSocketMessage) Presence() (PresenceMessage, error) {
+	var presence PresenceMessage
+	switch m.Type {
+	case "client_connected", "client_disconnected", "client_muted", "client_unmuted":
+	default:
+		return presence, fmt.Errorf("message type is %q, not a presence event", m.Type)
+	}
+	err := json.Unmarshal(m.Payload, &presence)
+	return presence, err
+}
+
+// State decodes the payload of an "ack" message
+func (m WebSocketMessage) State() (SubscriptionState, error) {
+	var state SubscriptionState
+	if m.Type != "ack" {
+		return state, fmt.Errorf("message type is %q, not ack", m.Type)
+	}
+	err := json.Unmarshal(m.Payload, &state)
+	return state, err
+}
+
+// Error decodes the payload of an "error" message
+func (m WebSocketMessage) Error() string {
+	var reason string
+	if err := json.Unmarshal(m.Payload, &reason); err != nil {
+		return string(m.Payload)
+	}
+	return reason
+}
+
+// SubscriptionCommand controls what a subscription receives
+type SubscriptionCommand struct {
+	Action    string    `json:"action"`
+	ClientIDs []string  `json:"clientIds,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	Sequence  uint64    `json:"sequence,omitempty"`
+	Keywords  []string  `json:"keywords,omitempty"`
+}
+
+// SubscriptionState is returned after each subscription command
+type SubscriptionState struct {
+	Action        string   `json:"action"`
+	Subscriptions []string `json:"subscriptions"`
+	Keywords      []string `json:"keywords"`
+}
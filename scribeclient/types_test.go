@@ -0,0 +1,168 @@
+package scribeclient
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Go types mirroring the schemas of scribe/openapi.json
+var schemaTypes = map[string]reflect.Type{
+	"PromptsResponse":      reflect.TypeFor[PromptsResponse](),
+	"Word":                 reflect.TypeFor[Word](),
+	"Session":              reflect.TypeFor[Session](),
+	"TranscriptionMessage": reflect.TypeFor[TranscriptionMessage](),
+	"UploadResponse":       reflect.TypeFor[UploadResponse](),
+	"WebSocketMessage":     reflect.TypeFor[WebSocketMessage](),
+	"SubscriptionCommand":  reflect.TypeFor[SubscriptionCommand](),
+	"SubscriptionState":    reflect.TypeFor[SubscriptionState](),
+	"PresenceMessage":      reflect.TypeFor[PresenceMessage](),
+	"TranslationMessage":   reflect.TypeFor[TranslationMessage](),
+	"SayResponse":          reflect.TypeFor[SayResponse](),
+	"IntercomRoute":        reflect.TypeFor[IntercomRoute](),
+	"IntegrityReport":      reflect.TypeFor[IntegrityReport](),
+	"StoredTranscription":  reflect.TypeFor[StoredTranscription](),
+	"VersionInfo":          reflect.TypeFor[VersionInfo](),
+	"RetentionRun":         reflect.TypeFor[RetentionRun](),
+	"RetentionReport":      reflect.TypeFor[RetentionReport](),
+	"Vocabulary":           reflect.TypeFor[Vocabulary](),
+	"LearnedTerm":          reflect.TypeFor[LearnedTerm](),
+	"Speaker":              reflect.TypeFor[Speaker](),
+	"TalkTimeResponse":     reflect.TypeFor[TalkTime](),
+	"ClientTalkTime":       reflect.TypeFor[ClientTalkTime](),
+	"TalkTimeBucket":       reflect.TypeFor[TalkTimeBucket](),
+	"DeletionReport":       reflect.TypeFor[DeletionReport](),
+	"SignedDeletionReport": reflect.TypeFor[SignedDeletionReport](),
+	"ChunkedUpload":        reflect.TypeFor[ChunkedUpload](),
+	"Meeting":              reflect.TypeFor[Meeting](),
+	"MeetingTranscript":    reflect.TypeFor[MeetingTranscript](),
+	"MeetingChapter":       reflect.TypeFor[MeetingChapter](),
+	"MeetingTurn":          reflect.TypeFor[MeetingTurn](),
+	"MeetingSpeaker":       reflect.TypeFor[MeetingSpeaker](),
+}
+
+// Schemas the client has no methods for
+var unmirroredSchemas = []string{"LatencyReport", "LatencySummary", "User"}
+
+// schema is the part of an OpenAPI schema the comparison needs
+type schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Properties map[string]*schema `json:"properties"`
+	Items      *schema            `json:"items"`
+}
+
+var rawMessage = reflect.TypeFor[json.RawMessage]()
+
+// TestTypesMatchOpenAPI checks every schema has a Go type with the same
+// JSON fields of matching types, so the hand-written client can't drift
+// from the API it talks to
+func TestTypesMatchOpenAPI(t *testing.T) {
+	data, err := os.ReadFile("../scribe/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Components struct {
+			Schemas map[string]*schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, s := range spec.Components.Schemas {
+		typ, ok := schemaTypes[name]
+		if !ok {
+			if !slices.Contains(unmirroredSchemas, name) {
+				t.Errorf("schema %s has no Go type", name)
+			}
+			continue
+		}
+		fields := jsonFields(typ)
+		for property, ps := range s.Properties {
+			field, ok := fields[property]
+			if !ok {
+				t.Errorf("%s.%s is missing from %s", name, property, typ.Name())
+				continue
+			}
+			if problem := compare(ps, field); problem != "" {
+				t.Errorf("%s.%s: %s", name, property, problem)
+			}
+		}
+		for property := range fields {
+			if _, ok := s.Properties[property]; !ok {
+				t.Errorf("%s.%s is not in schema %s", typ.Name(), property, name)
+			}
+		}
+	}
+}
+
+// jsonFields returns the types of a struct's fields by JSON name, those of
+// embedded structs included
+func jsonFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for _, f := range reflect.VisibleFields(typ) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// compare reports how a Go type does not fit a schema, or "" when it does
+func compare(s *schema, typ reflect.Type) string {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if typ == rawMessage || typ.Kind() == reflect.Interface {
+		return ""
+	}
+	if s.Ref != "" {
+		want := schemaTypes[path.Base(s.Ref)]
+		if typ != want {
+			return "is " + typ.String() + ", schema refers to " + path.Base(s.Ref)
+		}
+		return ""
+	}
+
+	var kind string
+	switch {
+	case typ == reflect.TypeFor[time.Time]():
+		kind = "string"
+	case typ.Kind() == reflect.String:
+		kind = "string"
+	case typ.Kind() == reflect.Bool:
+		kind = "boolean"
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Uint64:
+		kind = "integer"
+	case typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64:
+		kind = "number"
+	case typ.Kind() == reflect.Slice:
+		kind = "array"
+	case typ.Kind() == reflect.Map || typ.Kind() == reflect.Struct:
+		kind = "object"
+	}
+	if s.Type != "" && s.Type != kind {
+		return "is " + typ.String() + ", schema says " + s.Type
+	}
+	if kind == "array" && s.Items != nil {
+		if problem := compare(s.Items, typ.Elem()); problem != "" {
+			return "items: " + problem
+		}
+	}
+	return ""
+}
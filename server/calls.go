@@ -0,0 +1,32 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bosley/libas/sip"
+	"github.com/google/uuid"
+)
+
+// Longest recording of a call, cut even while the caller goes on talking
+const maxCallRecording = 5 * time.Minute
+
+// Clients of callers are derived from the caller in this namespace, so a
+// caller always maps to the same client
+var callNamespace = uuid.MustParse("0b7f5d1e-2c4a-4e8b-a6d3-9f1e5c7b3a20")
+
+// answerCall records a call leg the SIP bridge answered as a client of its
+// own, the same client for every call of a caller. A caller is on one call
+// at a time, a second call is rejected while the first goes on.
+func (s *Server) answerCall(call sip.Call) (sip.Leg, error) {
+	clientID := uuid.NewSHA1(callNamespace, []byte(call.Caller()))
+	if _, ok := s.clients.Get(clientID); ok {
+		return nil, fmt.Errorf("caller %s is already on a call", call.Caller())
+	}
+	s.clients.Add(&Client{ID: clientID, Addr: call.From})
+	slog.Info("Recording call", "clientID", clientID, "from", call.From, "to", call.To)
+
+	settings := s.config.settingsFor(clientID, call.Remote)
+	return s.newLiveAudio(clientID, "call", sip.SampleRate, maxCallRecording, settings), nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/latency"
+	"github.com/bosley/libas/sip"
+	"github.com/bosley/libas/tracing"
+	"github.com/google/uuid"
+)
+
+// Config for the audio ingest server
+type Config struct {
+	// Address to listen on, defaults to localhost:8443
+	Addr string
+
+	// Directory recordings are written to, defaults to "recordings". Scribe
+	// must watch the same directory.
+	RecordingsDir string
+
+	// Certificate files for TLS
+	CertFile string
+	KeyFile  string
+
+	// Shared secret clients send before streaming
+	Token string
+
+	// Address microcontroller clients connect to over plain TCP when set,
+	// authenticating each frame with LANKey rather than TLS and the token.
+	// Audio is not encrypted, for trusted networks only.
+	LANAddr string
+
+	// Pre-shared key of LANAddr clients, at least 16 bytes
+	LANKey string
+
+	// Processing applied to clients without an entry in Clients
+	Defaults ClientSettings
+
+	// Per-client overrides keyed by client ID or remote host
+	Clients map[string]ClientSettings
+
+	// Records spans of connections and transmissions when set, handing
+	// each finished recording's trace to a scribe sharing the tracer
+	Tracer *tracing.Tracer
+
+	// Records how long recordings take from the end of speech to their
+	// whisper copy when set, handing the end of speech to a scribe sharing
+	// the recorder
+	Latency *latency.Recorder
+
+	// Receives wrong tokens, protocol violations and recordings that
+	// cannot be written, classified by the fault package
+	ErrorReporter fault.Reporter
+
+	// Free space of the recordings volume, as a percentage, below which new
+	// transmissions are refused before anything is written, rather than
+	// failing part way. Zero disables the check.
+	MinFreePercent float64
+
+	// Recordings resampled for whisper at once, defaults to the number of
+	// CPUs
+	ResampleWorkers int
+
+	// Finished recordings waiting for a resampling worker before
+	// connections wait too, defaults to 64
+	ResampleQueue int
+
+	// Directory each client's protocol stream is dumped to with arrival
+	// times, as <client ID>.dump, for replaying with libas replay. For
+	// debugging, dumps grow as large as the audio and are never removed.
+	DumpDir string
+
+	// Phone calls answered and recorded beside clients when Addr is set,
+	// each caller as a client of its own. Answer is set by the server.
+	SIP sip.Config
+
+	// How often clients that announced reporting their health are asked
+	// to, in whole seconds. Zero asks none.
+	HealthInterval time.Duration
+
+	// URLs of internet radio, Icecast or HLS streams transcribed
+	// continuously, each as a client of its own. Decoding them needs
+	// ffmpeg.
+	Streams []string
+}
+
+// withDefaults fills in the address, recordings directory and resampling
+// when unset
+func (cfg Config) withDefaults() Config {
+	if cfg.Addr == "" {
+		cfg.Addr = defaultServerAddr
+	}
+	if cfg.RecordingsDir == "" {
+		cfg.RecordingsDir = defaultRecordingsDir
+	}
+	if cfg.ResampleWorkers <= 0 {
+		cfg.ResampleWorkers = runtime.NumCPU()
+	}
+	if cfg.ResampleQueue <= 0 {
+		cfg.ResampleQueue = defaultResampleQueue
+	}
+	return cfg
+}
+
+// ClientSettings tunes how one client's recordings are processed
+type ClientSettings struct {
+	// Cutoff in Hz of the high-pass filter removing DC offset and rumble
+	// from cheap microphones, zero disables it
+	HighPassHz float64 `json:"highPassHz"`
+
+	// Normalize loudness before resampling for whisper, improving
+	// transcription of quiet microphones
+	NormalizeLoudness bool `json:"normalizeLoudness"`
+
+	// Integrated loudness target in LUFS, zero uses audio.DefaultTargetLUFS
+	TargetLUFS float64 `json:"targetLufs"`
+
+	// Trim the silence clients send after speech ends
+	TrimSilence bool `json:"trimSilence"`
+
+	// Level in dBFS below which audio counts as silence, zero uses -45
+	SilenceThresholdDB float64 `json:"silenceThresholdDb"`
+
+	// Transmissions shorter than this many milliseconds are dropped, zero
+	// uses one second and a negative value keeps every transmission
+	MinTransmissionMs int `json:"minTransmissionMs"`
+
+	// Keep transmissions too short to record and put them in front of the
+	// client's next transmission if it starts within 10 seconds, so short
+	// answers like "yes" or "stop" are transcribed with what follows
+	JoinShort bool `json:"joinShort"`
+}
+
+// settingsFor returns the settings for a client, matching its ID first and
+// then the host it connected from
+func (cfg Config) settingsFor(clientID uuid.UUID, addr net.Addr) ClientSettings {
+	if settings, ok := cfg.Clients[clientID.String()]; ok {
+		return settings
+	}
+	if addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			if settings, ok := cfg.Clients[host]; ok {
+				return settings
+			}
+		}
+	}
+	return cfg.Defaults
+}
+
+// minTransmission is how long a transmission has to be to be recorded
+func (s ClientSettings) minTransmission() time.Duration {
+	switch {
+	case s.MinTransmissionMs < 0:
+		return 0
+	case s.MinTransmissionMs == 0:
+		return defaultMinTransmission
+	}
+	return time.Duration(s.MinTransmissionMs) * time.Millisecond
+}
+
+func (s ClientSettings) convertOptions() audio.ConvertOptions {
+	return audio.ConvertOptions{
+		HighPassHz:        s.HighPassHz,
+		NormalizeLoudness: s.NormalizeLoudness,
+		TargetLUFS:        s.TargetLUFS,
+		TrimSilence:       s.TrimSilence,
+		Silence: audio.SilenceOptions{
+			ThresholdDB: s.SilenceThresholdDB,
+		},
+	}
+}
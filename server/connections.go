@@ -1,19 +1,53 @@
-package libaserv
+package server
 
 import (
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type Client struct {
-	ID   uuid.UUID
-	Addr string
+	ID          uuid.UUID
+	Addr        string
+	ConnectedAt time.Time
+
+	// Whether what the client transmits is discarded, see Server.Mute, and
+	// until when, zero for no end
+	Muted      bool
+	MutedUntil time.Time
+
+	// Metrics the client last reported of its device, such as battery in
+	// percent, temperature in degrees Celsius and signal in dBm, and when
+	Health   map[string]float64
+	HealthAt time.Time
+}
+
+// ClientEventType identifies a change in the client list
+type ClientEventType int
+
+const (
+	ClientConnected ClientEventType = iota
+	ClientDisconnected
+
+	// A client was muted or unmuted, see Client.Muted
+	ClientMuted
+	ClientUnmuted
+
+	// A client reported its health, see Client.Health
+	ClientHealth
+)
+
+// ClientEvent is delivered to client list listeners
+type ClientEvent struct {
+	Type   ClientEventType
+	Client Client
 }
 
 type ClientList struct {
-	clients map[uuid.UUID]*Client
-	mu      sync.RWMutex
+	clients   map[uuid.UUID]*Client
+	listeners []func(ClientEvent)
+	mu        sync.RWMutex
 }
 
 func NewClientList() *ClientList {
@@ -23,16 +57,58 @@ func NewClientList() *ClientList {
 	return cl
 }
 
-func (cl *ClientList) Add(client *Client) {
+// AddListener registers a function called whenever a client is added,
+// removed, muted, unmuted or reports its health. Listeners run on the connection's goroutine and must not block.
+func (cl *ClientList) AddListener(fn func(ClientEvent)) {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
+	cl.listeners = append(cl.listeners, fn)
+}
+
+func (cl *ClientList) Add(client *Client) {
+	cl.mu.Lock()
+	if client.ConnectedAt.IsZero() {
+		client.ConnectedAt = time.Now()
+	}
 	cl.clients[client.ID] = client
+	listeners := cl.listeners
+	cl.mu.Unlock()
+
+	cl.notify(listeners, ClientEvent{Type: ClientConnected, Client: *client})
 }
 
 func (cl *ClientList) Remove(id uuid.UUID) {
 	cl.mu.Lock()
-	defer cl.mu.Unlock()
+	client, ok := cl.clients[id]
 	delete(cl.clients, id)
+	listeners := cl.listeners
+	cl.mu.Unlock()
+
+	if ok {
+		cl.notify(listeners, ClientEvent{Type: ClientDisconnected, Client: *client})
+	}
+}
+
+// setMuted records whether a client is muted and notifies listeners
+func (cl *ClientList) setMuted(id uuid.UUID, muted bool, until time.Time) {
+	cl.mu.Lock()
+	client, ok := cl.clients[id]
+	var snapshot Client
+	if ok {
+		client.Muted, client.MutedUntil = muted, until
+		snapshot = *client
+	}
+	listeners := cl.listeners
+	cl.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	event := ClientEvent{Type: ClientUnmuted, Client: snapshot}
+	if muted {
+		event.Type = ClientMuted
+	}
+	cl.notify(listeners, event)
 }
 
 func (cl *ClientList) Get(id uuid.UUID) (*Client, bool) {
@@ -41,3 +117,20 @@ func (cl *ClientList) Get(id uuid.UUID) (*Client, bool) {
 	client, ok := cl.clients[id]
 	return client, ok
 }
+
+// List returns a snapshot of the connected clients
+func (cl *ClientList) List() []Client {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	clients := make([]Client, 0, len(cl.clients))
+	for _, client := range cl.clients {
+		clients = append(clients, *client)
+	}
+	return clients
+}
+
+func (cl *ClientList) notify(listeners []func(ClientEvent), event ClientEvent) {
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// RecordContinuously has a client transmit back to back whether or not
+// anyone speaks, e.g. for a meeting, until called again with on false.
+// Clients older than this server go on transmitting only speech.
+func (s *Server) RecordContinuously(clientID uuid.UUID, on bool) error {
+	value, ok := s.controls.Load(clientID)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	control := value.(*clientControl)
+
+	control.mu.Lock()
+	var err error
+	if control.continuous.Swap(on) != on && control.obeysContinuous {
+		err = control.writeLocked(protocol.AppendContinuous(nil, on))
+	}
+	control.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send continuous recording: %w", err)
+	}
+
+	slog.Info("Changed continuous recording", "clientID", clientID, "continuous", on)
+	return nil
+}
+
+// recordsContinuously marks the client as recording continuously when
+// asked, telling it when it already is
+func (c *clientControl) recordsContinuously() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.obeysContinuous = true
+	if !c.continuous.Load() {
+		return nil
+	}
+	return c.writeLocked(protocol.AppendContinuous(nil, true))
+}
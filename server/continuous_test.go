@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// Continuous recording is sent to clients that asked to obey it, once per
+// change, and on announcing when it was turned on before
+func TestRecordContinuously(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	control := newClientControl(local)
+
+	var s Server
+	clientID := uuid.New()
+	s.controls.Store(clientID, control)
+	if err := s.RecordContinuously(uuid.New(), true); err == nil {
+		t.Error("recorded a client that is not connected")
+	}
+
+	frames := make(chan []byte, 8)
+	go func() {
+		for {
+			frame := make([]byte, 8)
+			if _, err := io.ReadFull(remote, frame); err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame
+		}
+	}()
+	expect := func(want []byte) {
+		t.Helper()
+		select {
+		case frame := <-frames:
+			if want == nil || !bytes.Equal(frame, want) {
+				t.Fatalf("got % x, want % x", frame, want)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want != nil {
+				t.Fatalf("nothing sent, want % x", want)
+			}
+		}
+	}
+
+	// The client did not announce it obeys yet
+	if err := s.RecordContinuously(clientID, true); err != nil {
+		t.Fatal(err)
+	}
+	expect(nil)
+	if err := control.recordsContinuously(); err != nil {
+		t.Fatal(err)
+	}
+	expect(protocol.AppendContinuous(nil, true))
+
+	if err := s.RecordContinuously(clientID, true); err != nil {
+		t.Fatal(err)
+	}
+	expect(nil)
+	if err := s.RecordContinuously(clientID, false); err != nil {
+		t.Fatal(err)
+	}
+	expect(protocol.AppendContinuous(nil, false))
+	if err := s.RecordContinuously(clientID, false); err != nil {
+		t.Fatal(err)
+	}
+	expect(nil)
+
+	// Announcing while off sends nothing
+	if err := control.recordsContinuously(); err != nil {
+		t.Fatal(err)
+	}
+	expect(nil)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// Time a write to a client may take, plus a second for every minWriteRate
+// bytes, before the client is taken as stalled and its connection closed
+const (
+	controlWriteTimeout = 10 * time.Second
+	minWriteRate        = 64 << 10
+)
+
+// clientControl writes settings to a connected client. Settings wait until
+// the client has finished negotiating its capture format, since it reads
+// the format reply before anything else.
+type clientControl struct {
+	conn net.Conn
+
+	// Base of the deadline of each write, controlWriteTimeout
+	writeTimeout time.Duration
+
+	mu      sync.Mutex
+	open    bool
+	pending []byte
+
+	// Set once the client announced it plays speech or live audio, or that
+	// it stops transmitting while muted
+	speaks    bool
+	live      bool
+	obeysMute bool
+
+	// Whether what the client transmits is discarded, and the timer ending
+	// it
+	muted  atomic.Bool
+	unmute *time.Timer
+
+	// Whether the client is to record continuously, and whether it
+	// announced that it can
+	continuous      atomic.Bool
+	obeysContinuous bool
+
+	// Live audio routed from other clients waiting to be written, created
+	// with the first chunk, until done is closed with the connection
+	liveOnce  sync.Once
+	liveQueue chan []byte
+	done      chan struct{}
+}
+
+// newClientControl creates the control of a client's connection
+func newClientControl(conn net.Conn) *clientControl {
+	return &clientControl{conn: conn, writeTimeout: controlWriteTimeout, done: make(chan struct{})}
+}
+
+// close stops writing live audio and the unmute timer once the connection
+// is closed
+func (c *clientControl) close() {
+	close(c.done)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.unmute != nil {
+		c.unmute.Stop()
+	}
+}
+
+// playsSpeech marks the client as playing the speech it is sent
+func (c *clientControl) playsSpeech() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.speaks = true
+}
+
+// playsLive marks the client as playing live audio routed to it
+func (c *clientControl) playsLive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.live = true
+}
+
+// mutes marks the client as stopping transmissions while muted, telling
+// it when it already is
+func (c *clientControl) mutes() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.obeysMute = true
+	if !c.muted.Load() {
+		return nil
+	}
+	return c.writeLocked(protocol.AppendMute(nil, time.Time{}))
+}
+
+// acceptsLive tells whether the client announced it plays live audio
+func (c *clientControl) acceptsLive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.live
+}
+
+// sendLive queues live audio for the client, false when the queue is full
+func (c *clientControl) sendLive(message []byte) bool {
+	c.liveOnce.Do(func() {
+		c.liveQueue = make(chan []byte, liveQueueSize)
+		go c.writeLive()
+	})
+	select {
+	case c.liveQueue <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeLive writes queued live audio until the connection closes or a
+// write fails
+func (c *clientControl) writeLive() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case message := <-c.liveQueue:
+			if err := c.write(message); err != nil {
+				slog.Debug("Failed to write live audio", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// negotiated marks the client as reading settings and sends what waited
+func (c *clientControl) negotiated() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open {
+		return
+	}
+	c.open = true
+	if c.pending != nil {
+		c.writeLocked(c.pending)
+		c.pending = nil
+	}
+}
+
+// send writes a message now or once the client is negotiated, replacing
+// one still waiting
+func (c *clientControl) send(message []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.open {
+		c.pending = message
+		return nil
+	}
+	return c.writeLocked(message)
+}
+
+// write sends handshake replies, serialized with settings
+func (c *clientControl) write(message []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked(message)
+}
+
+// writeLocked writes a message with c.mu held, within a deadline so a
+// client that stops reading cannot hold c.mu. A failed write may have sent
+// part of the message, so the connection is closed for the client to
+// reconnect.
+func (c *clientControl) writeLocked(message []byte) error {
+	timeout := c.writeTimeout + time.Duration(len(message)/minWriteRate)*time.Second
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(message); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// SetVADThreshold changes the speech threshold of a connected client, as a
+// ratio over its background noise. Clients older than this server ignore it.
+func (s *Server) SetVADThreshold(clientID uuid.UUID, threshold float64) error {
+	if threshold <= 0 || math.IsInf(threshold, 0) || math.IsNaN(threshold) {
+		return fmt.Errorf("invalid VAD threshold %v", threshold)
+	}
+	value, ok := s.controls.Load(clientID)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+
+	if err := value.(*clientControl).send(protocol.AppendVAD(nil, threshold)); err != nil {
+		return fmt.Errorf("failed to send VAD threshold: %w", err)
+	}
+
+	slog.Info("Changed client VAD threshold", "clientID", clientID, "threshold", threshold)
+	return nil
+}
+
+// Say plays speech on a connected client, which must have announced that it
+// plays speech. Clients play speech one after another, muting their voice
+// detection meanwhile.
+func (s *Server) Say(clientID uuid.UUID, speech *audio.PCM) error {
+	size := 2 * len(speech.Samples)
+	if size == 0 || size > protocol.MaxSpeechSize || speech.SampleRate <= 0 {
+		return fmt.Errorf("invalid speech of %d samples at %dHz", len(speech.Samples), speech.SampleRate)
+	}
+	value, ok := s.controls.Load(clientID)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	control := value.(*clientControl)
+
+	message := protocol.AppendAudio(make([]byte, 0, 12+size), protocol.Speech, speech.SampleRate, speech.Samples)
+
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if !control.speaks {
+		return fmt.Errorf("client %s does not play speech", clientID)
+	}
+	if err := control.writeLocked(message); err != nil {
+		return fmt.Errorf("failed to send speech: %w", err)
+	}
+
+	slog.Info("Sent speech to client",
+		"clientID", clientID,
+		"duration", time.Duration(len(speech.Samples))*time.Second/time.Duration(speech.SampleRate))
+	return nil
+}
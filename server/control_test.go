@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+)
+
+// Speech to a client that stopped reading fails once the write deadline
+// passes, closing the connection and leaving the control usable
+func TestSayStalledClient(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	control := newClientControl(local)
+	control.writeTimeout = 50 * time.Millisecond
+	control.playsSpeech()
+	control.negotiated()
+
+	var s Server
+	clientID := uuid.New()
+	s.controls.Store(clientID, control)
+
+	// Over a second of slack for its size, the write still ends in time
+	speech := &audio.PCM{Samples: make([]int16, minWriteRate), SampleRate: 16000}
+	failed := make(chan error, 1)
+	go func() { failed <- s.Say(clientID, speech) }()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatal("speech to a stalled client succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("speech to a stalled client blocked")
+	}
+
+	// Settings no longer wait on the lock, and the client sees the
+	// connection closed rather than half a message
+	done := make(chan struct{})
+	go func() {
+		control.acceptsLive()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("control still locked after the failed write")
+	}
+	if _, err := io.ReadAll(remote); err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/internal/disk"
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// How often the free space of the recordings volume is checked
+const diskCheckInterval = 10 * time.Second
+
+// watchDisk keeps diskLow up to date until ctx is cancelled
+func (s *Server) watchDisk(ctx context.Context) {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.checkDisk()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkDisk compares the free space of the recordings volume with the
+// minimum, logging and reporting when it crosses it
+func (s *Server) checkDisk() {
+	free, err := disk.FreePercent(s.config.RecordingsDir)
+	if err != nil {
+		slog.Warn("Failed to check free space of recordings volume", "error", err, "path", s.config.RecordingsDir)
+		return
+	}
+
+	low := free < s.config.MinFreePercent
+	if s.diskLow.Swap(low) == low {
+		return
+	}
+	if low {
+		err := fmt.Errorf("%w: %.1f%% of the recordings volume free, below %.1f%%", fault.ErrStorageFull, free, s.config.MinFreePercent)
+		slog.Error("Recordings volume nearly full, refusing new transmissions", "error", err, "path", s.config.RecordingsDir)
+		s.report(err, "check_disk")
+	} else {
+		slog.Info("Recordings volume has space again, accepting transmissions", "free", fmt.Sprintf("%.1f%%", free))
+	}
+}
+
+// refuse tells a client its transmission will not be recorded, its audio
+// is read and discarded. Clients that predate refusals stop reading
+// settings.
+func refuse(control *clientControl, clientID uuid.UUID, reason uint32) {
+	message := protocol.AppendRefused(nil, reason)
+	if err := control.send(message); err != nil {
+		slog.Error("Failed to refuse transmission", "error", err, "clientID", clientID)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// First line of a session dump, before its JSON header
+const dumpMagic = "libas-session-dump 1\n"
+
+// DumpHeader describes the connection a session dump was taken from
+type DumpHeader struct {
+	ClientID   string    `json:"clientId"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Started    time.Time `json:"started"`
+}
+
+// DumpRecord is one read from the client, At after the dump started
+type DumpRecord struct {
+	At   time.Duration
+	Data []byte
+}
+
+// Dump is a client's protocol stream as the server received it, from after
+// its token up to the disconnect
+type Dump struct {
+	Header  DumpHeader
+	Records []DumpRecord
+}
+
+// sessionDump tees what a client sends into a dump file. Records are an
+// 8 byte big endian offset in nanoseconds, a 4 byte length and the data.
+type sessionDump struct {
+	r       io.Reader
+	file    *os.File
+	writer  *bufio.Writer
+	started time.Time
+
+	mu     sync.Mutex
+	failed bool
+}
+
+// newSessionDump creates <dir>/<clientID>.dump and returns it wrapping r,
+// or nil when it cannot be created
+func newSessionDump(dir string, clientID uuid.UUID, addr net.Addr, r io.Reader) *sessionDump {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("Failed to create dump directory", "error", err, "path", dir)
+		return nil
+	}
+	path := filepath.Join(dir, clientID.String()+".dump")
+	file, err := os.Create(path)
+	if err != nil {
+		slog.Error("Failed to create session dump", "error", err, "path", path)
+		return nil
+	}
+
+	d := &sessionDump{r: r, file: file, writer: bufio.NewWriter(file), started: time.Now()}
+	header, _ := json.Marshal(DumpHeader{ClientID: clientID.String(), RemoteAddr: addr.String(), Started: d.started})
+	d.writer.WriteString(dumpMagic)
+	d.writer.Write(append(header, '\n'))
+	slog.Info("Dumping client session", "clientID", clientID, "path", path)
+	return d
+}
+
+// Read reads from the client, recording what was read
+func (d *sessionDump) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n > 0 {
+		d.record(p[:n])
+	}
+	return n, err
+}
+
+func (d *sessionDump) record(data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failed {
+		return
+	}
+	var prefix [12]byte
+	binary.BigEndian.PutUint64(prefix[0:8], uint64(time.Since(d.started)))
+	binary.BigEndian.PutUint32(prefix[8:12], uint32(len(data)))
+	d.writer.Write(prefix[:])
+	if _, err := d.writer.Write(data); err != nil {
+		d.failed = true
+		slog.Error("Failed to write session dump", "error", err, "path", d.file.Name())
+	}
+}
+
+// Close flushes and closes the dump file
+func (d *sessionDump) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.writer.Flush()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadDump loads a session dump written by a server with a DumpDir. A dump
+// cut short by a crash is returned up to its last complete record.
+func ReadDump(path string) (*Dump, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dump: %w", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	magic, err := reader.ReadString('\n')
+	if err != nil || magic != dumpMagic {
+		return nil, fmt.Errorf("%s is not a session dump", path)
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dump header: %w", err)
+	}
+	dump := &Dump{}
+	if err := json.Unmarshal(line, &dump.Header); err != nil {
+		return nil, fmt.Errorf("failed to parse dump header: %w", err)
+	}
+
+	var prefix [12]byte
+	for {
+		if _, err := io.ReadFull(reader, prefix[:]); err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(prefix[8:12])
+		if size > protocol.MaxChunkSize {
+			return nil, fmt.Errorf("corrupt dump record of %d bytes", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			break
+		}
+		dump.Records = append(dump.Records, DumpRecord{
+			At:   time.Duration(binary.BigEndian.Uint64(prefix[0:8])),
+			Data: data,
+		})
+	}
+	return dump, nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"log/slog"
+	"maps"
+	"time"
+
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// reportsHealth asks a client that announced reporting its health to do so
+// every interval
+func (c *clientControl) reportsHealth(interval time.Duration) error {
+	return c.write(protocol.AppendHealth(nil, interval))
+}
+
+// setHealth records the metrics a client reported and notifies listeners
+func (cl *ClientList) setHealth(id uuid.UUID, metrics map[string]float64) {
+	cl.mu.Lock()
+	client, ok := cl.clients[id]
+	var snapshot Client
+	if ok {
+		// Replaced rather than changed, snapshots share the map
+		client.Health, client.HealthAt = maps.Clone(metrics), time.Now()
+		snapshot = *client
+	}
+	listeners := cl.listeners
+	cl.mu.Unlock()
+
+	if ok {
+		cl.notify(listeners, ClientEvent{Type: ClientHealth, Client: snapshot})
+	}
+}
+
+// recordHealth keeps a health report of a client
+func (s *Server) recordHealth(clientID uuid.UUID, metrics map[string]float64) {
+	s.clients.setHealth(clientID, metrics)
+	slog.Debug("Client reported health", "clientID", clientID, "metrics", metrics)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// Chunks of live audio waiting to be written to a client, about four
+// seconds. Chunks arriving while it is full are dropped.
+const liveQueueSize = 64
+
+// Route sends the audio the client from transmits, as it arrives, to the
+// client to, which must be connected and announce that it plays live audio.
+// Each client's audio goes to one other client at most, routing it again
+// replaces the route. Routes end when either client disconnects.
+func (s *Server) Route(from, to uuid.UUID) error {
+	if from == to {
+		return fmt.Errorf("cannot route client %s to itself", from)
+	}
+	value, ok := s.controls.Load(to)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", to)
+	}
+	if !value.(*clientControl).acceptsLive() {
+		return fmt.Errorf("client %s does not play live audio", to)
+	}
+
+	s.routes.Store(from, to)
+	slog.Info("Routed client audio", "from", from, "to", to)
+	return nil
+}
+
+// Unroute stops sending the audio of a client to another
+func (s *Server) Unroute(from uuid.UUID) {
+	if to, ok := s.routes.LoadAndDelete(from); ok {
+		slog.Info("Stopped routing client audio", "from", from, "to", to)
+	}
+}
+
+// unrouteClient removes the routes from and to a client that disconnected
+func (s *Server) unrouteClient(clientID uuid.UUID) {
+	s.routes.Range(func(from, to any) bool {
+		if from == clientID || to == clientID {
+			s.Unroute(from.(uuid.UUID))
+		}
+		return true
+	})
+}
+
+// Routes lists where the audio of clients goes, by the client it comes from
+func (s *Server) Routes() map[uuid.UUID]uuid.UUID {
+	routes := make(map[uuid.UUID]uuid.UUID)
+	s.routes.Range(func(from, to any) bool {
+		routes[from.(uuid.UUID)] = to.(uuid.UUID)
+		return true
+	})
+	return routes
+}
+
+// forward queues a chunk of audio received from a client for the client it
+// is routed to, if any. It never waits on the other connection.
+func (s *Server) forward(from uuid.UUID, sampleRate int, parts [][]byte) {
+	to, ok := s.routes.Load(from)
+	if !ok {
+		return
+	}
+	value, ok := s.controls.Load(to)
+	if !ok {
+		return
+	}
+
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	message := protocol.AppendAudioHeader(make([]byte, 0, 12+size), protocol.Live, sampleRate, size)
+	for _, part := range parts {
+		message = append(message, part...)
+	}
+
+	if !value.(*clientControl).sendLive(message) {
+		slog.Debug("Live audio queue full, dropping chunk", "from", from, "to", to)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/tracing"
+	"github.com/google/uuid"
+)
+
+const (
+	// Silence that ends a recording of live audio, and the silence kept
+	// before and after its speech
+	livePause  = time.Second
+	liveLeadIn = 300 * time.Millisecond
+
+	// Level in dBFS below which live audio is silence unless
+	// ClientSettings say otherwise
+	defaultLiveSilenceDB = -45.0
+)
+
+// liveAudio cuts audio arriving continuously, from phone calls and
+// streams, into recordings at pauses, as clients cut theirs into
+// transmissions. The client is shown as connected until it is closed.
+type liveAudio struct {
+	server     *Server
+	clientID   uuid.UUID
+	source     string
+	sampleRate int
+	maxLength  time.Duration
+	settings   ClientSettings
+	threshold  float64
+
+	// Audio of the recording in progress, with the samples of speech in
+	// it and of the silence since the last speech
+	samples   []int16
+	speech    int
+	silence   int
+	startedAt time.Time
+}
+
+// newLiveAudio creates the recorder of a client's live audio, cutting
+// recordings at maxLength even while speech goes on
+func (s *Server) newLiveAudio(clientID uuid.UUID, source string, sampleRate int, maxLength time.Duration, settings ClientSettings) *liveAudio {
+	threshold := settings.SilenceThresholdDB
+	if threshold == 0 {
+		threshold = defaultLiveSilenceDB
+	}
+	return &liveAudio{
+		server:     s,
+		clientID:   clientID,
+		source:     source,
+		sampleRate: sampleRate,
+		maxLength:  maxLength,
+		settings:   settings,
+		threshold:  threshold,
+	}
+}
+
+// Write adds the next samples, finishing the recording in progress at a
+// pause
+func (l *liveAudio) Write(samples []int16) {
+	speaking := levelDB(samples) >= l.threshold
+	leadIn := l.samplesOf(liveLeadIn)
+	if l.speech == 0 && !speaking {
+		// Only the lead-in of the silence before speech is kept
+		l.samples = append(l.samples, samples...)
+		if excess := len(l.samples) - leadIn; excess > 0 {
+			l.samples = append(l.samples[:0], l.samples[excess:]...)
+		}
+		return
+	}
+	if l.speech == 0 {
+		l.startedAt = time.Now().Add(-l.durationOf(len(l.samples)))
+	}
+
+	l.samples = append(l.samples, samples...)
+	if speaking {
+		l.speech += len(samples)
+		l.silence = 0
+	} else {
+		l.silence += len(samples)
+	}
+	if l.silence >= l.samplesOf(livePause) || len(l.samples) >= l.samplesOf(l.maxLength) {
+		l.finish()
+	}
+}
+
+// Close finishes the recording in progress and shows the client as
+// disconnected
+func (l *liveAudio) Close() {
+	if l.speech > 0 {
+		l.finish()
+	}
+	l.server.clients.Remove(l.clientID)
+}
+
+// finish hands the recording in progress on to whisper, trimming the
+// silence after speech to the lead-in
+func (l *liveAudio) finish() {
+	trailing := max(0, l.silence-l.samplesOf(liveLeadIn))
+	samples := l.samples[:len(l.samples)-trailing]
+	speechEnded := time.Now().Add(-l.durationOf(l.silence))
+	startedAt := l.startedAt
+	l.samples, l.speech, l.silence = nil, 0, 0
+
+	duration := l.durationOf(len(samples))
+	if duration < l.settings.minTransmission() {
+		slog.Debug("Dropping short live recording", "source", l.source, "duration", duration.Seconds(), "clientID", l.clientID)
+		return
+	}
+	l.server.recordLive(l, samples, startedAt, speechEnded)
+}
+
+func (l *liveAudio) samplesOf(d time.Duration) int {
+	return int(d * time.Duration(l.sampleRate) / time.Second)
+}
+
+func (l *liveAudio) durationOf(samples int) time.Duration {
+	return time.Duration(samples) * time.Second / time.Duration(l.sampleRate)
+}
+
+// recordLive writes a recording of live audio and queues it for its
+// whisper copy
+func (s *Server) recordLive(l *liveAudio, samples []int16, startedAt, speechEnded time.Time) {
+	if s.diskLow.Load() {
+		slog.Warn("Dropped live recording, recordings volume nearly full", "source", l.source, "clientID", l.clientID)
+		return
+	}
+	ctx, span := s.config.Tracer.Start(context.Background(), "transmission",
+		tracing.Attr("clientId", l.clientID.String()),
+		tracing.Attr("source", l.source))
+	defer span.End()
+
+	file, err := s.createWavFile(l.clientID)
+	if err == nil {
+		err = audio.EncodeWav(file, &audio.PCM{Samples: samples, SampleRate: l.sampleRate})
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to write live recording", "error", err, "source", l.source, "clientID", l.clientID)
+		span.RecordError(err)
+		s.report(fault.Storage(err), "write_recording", "clientId", l.clientID.String())
+		return
+	}
+	slog.Info("Finished receiving live recording",
+		"source", l.source,
+		"duration", l.durationOf(len(samples)).Seconds(),
+		"clientID", l.clientID)
+
+	segment := audio.NewSegment(samples, l.sampleRate)
+	segment.ClientID = l.clientID.String()
+	segment.StartedAt = startedAt
+	s.queueResample(resampleJob{
+		segment:     segment,
+		fileName:    file.Name(),
+		opts:        l.settings.convertOptions(),
+		clientID:    l.clientID,
+		speechEnded: speechEnded,
+		ctx:         ctx,
+		trace:       span.Context(),
+	})
+}
+
+// levelDB returns the RMS level of samples in dBFS
+func levelDB(samples []int16) float64 {
+	if len(samples) == 0 {
+		return math.Inf(-1)
+	}
+	var sum float64
+	for _, sample := range samples {
+		v := float64(sample) / 32768
+		sum += v * v
+	}
+	return 10 * math.Log10(sum/float64(len(samples)))
+}
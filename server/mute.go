@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bosley/libas/protocol"
+	"github.com/google/uuid"
+)
+
+// Mute discards what a client transmits, asking it to stop transmitting,
+// until the given time or, when it is zero, until Unmute. Muting again
+// replaces the end. Clients older than this server go on transmitting, what
+// they send is discarded all the same.
+func (s *Server) Mute(clientID uuid.UUID, until time.Time) error {
+	value, ok := s.controls.Load(clientID)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	control := value.(*clientControl)
+
+	message := protocol.AppendMute(nil, until)
+
+	control.mu.Lock()
+	control.muted.Store(true)
+	if control.unmute != nil {
+		control.unmute.Stop()
+		control.unmute = nil
+	}
+	if !until.IsZero() {
+		control.unmute = time.AfterFunc(time.Until(until), func() {
+			if err := s.Unmute(clientID); err != nil {
+				slog.Debug("Failed to unmute client", "error", err, "clientID", clientID)
+			}
+		})
+	}
+	var err error
+	if control.obeysMute {
+		err = control.writeLocked(message)
+	}
+	control.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send mute: %w", err)
+	}
+
+	s.clients.setMuted(clientID, true, until)
+	slog.Info("Muted client", "clientID", clientID, "until", until)
+	return nil
+}
+
+// Unmute records what a client transmits again
+func (s *Server) Unmute(clientID uuid.UUID) error {
+	value, ok := s.controls.Load(clientID)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	control := value.(*clientControl)
+
+	message := protocol.AppendMarker(nil, protocol.Unmute)
+
+	control.mu.Lock()
+	wasMuted := control.muted.Swap(false)
+	if control.unmute != nil {
+		control.unmute.Stop()
+		control.unmute = nil
+	}
+	var err error
+	if wasMuted && control.obeysMute {
+		err = control.writeLocked(message)
+	}
+	control.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send unmute: %w", err)
+	}
+
+	if wasMuted {
+		s.clients.setMuted(clientID, false, time.Time{})
+		slog.Info("Unmuted client", "clientID", clientID)
+	}
+	return nil
+}
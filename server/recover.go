@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+)
+
+// Names the server gives recordings, audio_HHMMSS.wav, with the suffix of
+// a transmission cut short by a disconnect
+var recordingName = regexp.MustCompile(`^audio_(\d{6})\.wav(\.incomplete)?$`)
+
+// recoverRecordings finishes the recordings a crash left behind before any
+// client connects. Recordings whose header was never updated, and
+// transmissions saved as .incomplete, have their header repaired from the
+// file size and are prepared for whisper like a finished transmission.
+func (s *Server) recoverRecordings(ctx context.Context) {
+	days, err := os.ReadDir(s.config.RecordingsDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to scan recordings for recovery", "error", err, "path", s.config.RecordingsDir)
+		}
+		return
+	}
+
+	recovered := 0
+	for _, day := range days {
+		if !day.IsDir() {
+			continue
+		}
+		if _, err := time.Parse("20060102", day.Name()); err != nil {
+			continue
+		}
+		dayPath := filepath.Join(s.config.RecordingsDir, day.Name())
+		clients, err := os.ReadDir(dayPath)
+		if err != nil {
+			slog.Error("Failed to scan recordings for recovery", "error", err, "path", dayPath)
+			continue
+		}
+		for _, client := range clients {
+			clientID, err := uuid.Parse(client.Name())
+			if err != nil || !client.IsDir() {
+				continue
+			}
+			recovered += s.recoverClient(ctx, filepath.Join(dayPath, client.Name()), day.Name(), clientID)
+		}
+	}
+
+	if recovered > 0 {
+		slog.Info("Recovered recordings left by an earlier run", "count", recovered)
+	}
+}
+
+// recoverClient recovers the recordings in one client's day directory,
+// returning how many were handed on to whisper
+func (s *Server) recoverClient(ctx context.Context, dir, day string, clientID uuid.UUID) int {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Failed to scan recordings for recovery", "error", err, "path", dir)
+		return 0
+	}
+	present := make(map[string]bool, len(files))
+	for _, file := range files {
+		present[file.Name()] = true
+	}
+
+	recovered := 0
+	for _, file := range files {
+		name := file.Name()
+		path := filepath.Join(dir, name)
+
+		// Whisper copies are renamed into place once written, a leftover
+		// temporary file is the part written before the crash
+		if strings.HasSuffix(name, "_whisper.wav.tmp") {
+			os.Remove(path)
+			continue
+		}
+
+		match := recordingName.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		stem := strings.TrimSuffix(strings.TrimSuffix(name, ".incomplete"), ".wav")
+		if present[stem+"_whisper.wav"] || present[stem+"_whisper.flac"] {
+			// The whisper copy was written, only removing the raw
+			// recording was missed
+			os.Remove(path)
+			continue
+		}
+		startedAt, _ := time.ParseInLocation("20060102150405", day+match[1], time.Local)
+		if s.recoverRecording(ctx, path, clientID, startedAt) {
+			recovered++
+		}
+	}
+	return recovered
+}
+
+// recoverRecording repairs a recording and hands it on to whisper,
+// reporting whether it was
+func (s *Server) recoverRecording(ctx context.Context, path string, clientID uuid.UUID, startedAt time.Time) bool {
+	rewritten, err := audio.RepairWavHeader(path, audio.RecordingSampleRate)
+	if err != nil {
+		slog.Error("Failed to repair recording", "error", err, "file", path, "clientID", clientID)
+		return false
+	}
+	if rewritten {
+		slog.Warn("Recording lost its header, assuming the default sample rate",
+			"file", path,
+			"sampleRate", audio.RecordingSampleRate,
+			"clientID", clientID)
+	}
+
+	fileName := strings.TrimSuffix(path, ".incomplete")
+	if fileName != path {
+		if err := os.Rename(path, fileName); err != nil {
+			slog.Error("Failed to rename recovered recording", "error", err, "file", path, "clientID", clientID)
+			return false
+		}
+	}
+
+	pcm, err := audio.ReadWav(fileName)
+	if err != nil {
+		slog.Error("Failed to read recovered recording", "error", err, "file", fileName, "clientID", clientID)
+		return false
+	}
+	segment := &audio.Segment{PCM: *pcm, ClientID: clientID.String(), StartedAt: startedAt}
+
+	// Transmissions this short are dropped when they end normally
+	settings := s.config.settingsFor(clientID, nil)
+	if segment.Duration() < settings.minTransmission() {
+		slog.Debug("Dropping short recovered recording", "file", fileName, "duration", segment.Duration().Seconds(), "clientID", clientID)
+		os.Remove(fileName)
+		return false
+	}
+
+	slog.Info("Recovering recording", "file", fileName, "duration", segment.Duration().Seconds(), "clientID", clientID)
+	opts := settings.convertOptions()
+	if pcm.SampleRate == audio.WhisperSampleRate && opts.Passthrough() {
+		if err := os.Rename(fileName, audio.WhisperPath(fileName)); err != nil {
+			slog.Error("Failed to hand recording to Whisper", "error", err, "clientID", clientID)
+			return false
+		}
+		recordChecksum(audio.WhisperPath(fileName), clientID)
+		return true
+	}
+
+	s.queueResample(resampleJob{
+		segment:  segment,
+		fileName: fileName,
+		opts:     opts,
+		clientID: clientID,
+		ctx:      ctx,
+	})
+	return true
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/latency"
+	"github.com/bosley/libas/tracing"
+	"github.com/google/uuid"
+)
+
+// resampleJob is a finished recording waiting for its whisper copy
+type resampleJob struct {
+	segment  *audio.Segment
+	fileName string
+	opts     audio.ConvertOptions
+	clientID uuid.UUID
+
+	// When the client's end marker arrived, zero for recovered recordings
+	speechEnded time.Time
+
+	// Trace of the transmission, continued by the resampling span and
+	// handed to the scribe
+	ctx   context.Context
+	trace tracing.SpanContext
+}
+
+// runResampler prepares recordings for whisper until the queue is closed
+func (s *Server) runResampler() {
+	defer s.resamplers.Done()
+	for job := range s.resampleQueue {
+		s.resample(job)
+	}
+}
+
+// queueResample hands a recording to the resampling workers. The connection
+// only waits when the queue is full.
+func (s *Server) queueResample(job resampleJob) {
+	select {
+	case s.resampleQueue <- job:
+		return
+	default:
+	}
+	slog.Warn("Resampling queue full, waiting for a worker", "clientID", job.clientID, "queued", len(s.resampleQueue))
+	s.resampleQueue <- job
+}
+
+func (s *Server) resample(job resampleJob) {
+	_, span := s.config.Tracer.Start(job.ctx, "resample", tracing.Attr("sampleRate", job.segment.SampleRate))
+	defer span.End()
+
+	// Handed off before the whisper copy appears for scribe to pick up
+	s.config.Latency.Handoff(audio.WhisperPath(job.fileName), job.speechEnded)
+	started := time.Now()
+	if err := audio.SaveForWhisper(job.segment, job.fileName, job.opts); err != nil {
+		slog.Error("Failed to resample audio for Whisper", "error", err, "clientID", job.clientID)
+		span.RecordError(err)
+		s.report(fault.Storage(err), "finalize_recording", "clientId", job.clientID.String())
+		return
+	}
+	s.config.Tracer.Handoff(audio.WhisperPath(job.fileName), job.trace)
+	s.observeFinalized(job.clientID, job.speechEnded)
+	slog.Info("Audio resampled for Whisper", "file", job.fileName, "elapsed", time.Since(started))
+	recordChecksum(audio.WhisperPath(job.fileName), job.clientID)
+}
+
+// observeFinalized records how long a recording took from the end of
+// speech to its whisper copy
+func (s *Server) observeFinalized(clientID uuid.UUID, speechEnded time.Time) {
+	if !speechEnded.IsZero() {
+		s.config.Latency.Observe(clientID.String(), latency.Finalize, time.Since(speechEnded))
+	}
+}
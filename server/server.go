@@ -1,132 +1,405 @@
-package libaserv
+// Package server is the libas audio server, accepting capture clients over
+// TLS and recording their speech for scribe. Create one with New and call
+// Run, or Listen and Serve to know when it accepts clients.
+package server
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/fault"
+	"github.com/bosley/libas/protocol"
+	"github.com/bosley/libas/sip"
+	"github.com/bosley/libas/tracing"
 	"github.com/google/uuid"
 )
 
 const (
-	defaultServerAddr = "localhost:8443"
-)
+	defaultServerAddr    = "localhost:8443"
+	defaultRecordingsDir = "recordings"
+
+	// Buffer between received chunks and the recording file
+	fileBufferSize = 64 << 10
+
+	// Recordings waiting for a resampling worker when Config leaves it zero
+	defaultResampleQueue = 64
+
+	// Transmissions shorter than this are dropped unless ClientSettings
+	// say otherwise, most are clicks and coughs
+	defaultMinTransmission = time.Second
 
-var (
-	dailyDirMutex sync.Mutex
-	currentDay    string
+	// How long a LAN client has to prove it has the key
+	lanHandshakeTimeout = 10 * time.Second
+
+	// How soon after a short transmission the next has to start to be
+	// joined to it, and the silence put between them
+	joinWindow = 10 * time.Second
+	joinGap    = 300 * time.Millisecond
 )
 
-func Launch(ctx context.Context, certFile, token, keyFile string, clientList *ClientList) {
-	slog.Debug("Starting server", "address", defaultServerAddr)
+// Server accepts audio clients over TLS and records their transmissions
+// into the recordings directory
+type Server struct {
+	config    Config
+	tlsConfig *tls.Config
+	clients   *ClientList
+	controls  sync.Map // map[uuid.UUID]*clientControl of connected clients
+	routes    sync.Map // map[uuid.UUID]uuid.UUID of where clients' audio goes
+
+	// Day directory recordings currently go to, YYYYMMDD
+	dayMu      sync.Mutex
+	currentDay string
+
+	// Whether the recordings volume has less than MinFreePercent free
+	diskLow atomic.Bool
+
+	// Finished recordings waiting to be resampled for whisper, so
+	// connections keep reading while earlier audio is prepared
+	resampleQueue chan resampleJob
+	resamplers    sync.WaitGroup
 
-	updateCurrentDay()
+	// Answers phone calls when configured
+	bridge *sip.Bridge
 
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	// Accepts LAN clients when configured, opened by Listen
+	lanListener net.Listener
+}
+
+// New creates a server, loading its certificate
+func New(cfg Config) (*Server, error) {
+	cfg = cfg.withDefaults()
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("a token is required")
+	}
+	if cfg.LANAddr != "" && len(cfg.LANKey) < protocol.MinKeySize {
+		return nil, fmt.Errorf("a LAN key of at least %d bytes is required", protocol.MinKeySize)
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 	if err != nil {
-		slog.Error("Failed to load server certificate and key", "error", err)
-		slog.Error("Please ensure you're using proper TLS certificates. If you're testing locally, you can generate self-signed certificates or use the -insecure flag for non-TLS connections.")
-		return
+		return nil, fmt.Errorf("failed to load server certificate and key: %w", err)
+	}
+
+	s := &Server{
+		config:    cfg,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		clients:   NewClientList(),
+
+		resampleQueue: make(chan resampleJob, cfg.ResampleQueue),
+	}
+	if len(cfg.Streams) > 0 && !audio.FFmpegAvailable() {
+		return nil, fmt.Errorf("transcribing streams needs ffmpeg: %w", audio.ErrFFmpegUnavailable)
+	}
+	if cfg.SIP.Addr != "" {
+		cfg.SIP.Answer = s.answerCall
+		if s.bridge, err = sip.New(cfg.SIP); err != nil {
+			return nil, err
+		}
 	}
+	return s, nil
+}
+
+// Clients lists the connected audio clients, add a listener to follow
+// connects and disconnects
+func (s *Server) Clients() *ClientList {
+	return s.clients
+}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+// Run listens and serves until ctx is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := s.Listen()
+	if err != nil {
+		return err
 	}
+	return s.Serve(ctx, listener)
+}
 
-	listener, err := tls.Listen("tcp", defaultServerAddr, tlsConfig)
+// Listen opens the TLS listener audio clients connect to, the LAN listener
+// when LANAddr is set, and the SIP socket when phone calls are answered
+func (s *Server) Listen() (net.Listener, error) {
+	listener, err := tls.Listen("tcp", s.config.Addr, s.tlsConfig)
 	if err != nil {
-		slog.Error("Failed to start TLS server", "error", err)
-		return
+		return nil, fmt.Errorf("failed to start TLS server: %w", err)
+	}
+	if s.config.LANAddr != "" {
+		if s.lanListener, err = net.Listen("tcp", s.config.LANAddr); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to start LAN server: %w", err)
+		}
+		slog.Warn("Accepting LAN clients without TLS, audio crosses the network unencrypted", "address", s.lanListener.Addr())
+	}
+	if s.bridge != nil {
+		if err := s.bridge.Listen(); err != nil {
+			listener.Close()
+			if s.lanListener != nil {
+				s.lanListener.Close()
+			}
+			return nil, err
+		}
 	}
+	return listener, nil
+}
+
+// Serve accepts audio clients on the listener until ctx is cancelled, then
+// closes their connections and waits for the recordings in progress to be
+// saved and resampled. Recordings a crash left behind are recovered before
+// the first client is accepted. A server serves once.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	slog.Debug("Starting server", "address", listener.Addr())
+
+	for i := 0; i < s.config.ResampleWorkers; i++ {
+		s.resamplers.Add(1)
+		go s.runResampler()
+	}
+	// Runs after the connections are done queueing recordings
+	defer func() {
+		close(s.resampleQueue)
+		s.resamplers.Wait()
+	}()
+	s.recoverRecordings(ctx)
 
-	done := make(chan struct{})
+	s.updateCurrentDay()
+	if s.config.MinFreePercent > 0 {
+		go s.watchDisk(ctx)
+	}
 
-	go func() {
-		<-ctx.Done()
+	stopListener := context.AfterFunc(ctx, func() {
 		slog.Debug("Server shutting down")
 		listener.Close()
-		close(done)
-	}()
+	})
+	defer stopListener()
+
+	var connections sync.WaitGroup
+	defer connections.Wait()
+	if s.lanListener != nil {
+		// Closed however serving ends, before its connections are waited for
+		defer s.lanListener.Close()
+	}
+
+	// Calls and streams are waited for as connections, their recordings
+	// are queued before the resampling workers stop
+	for _, url := range s.config.Streams {
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			s.runStream(ctx, url)
+		}()
+	}
+	if s.bridge != nil {
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			if err := s.bridge.Serve(ctx); err != nil {
+				slog.Error("SIP bridge failed", "error", err)
+			}
+		}()
+	}
+	if s.lanListener != nil {
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			if err := s.accept(ctx, s.lanListener, &connections, s.handleLANConnection); err != nil {
+				slog.Error("LAN server failed", "error", err)
+			}
+		}()
+	}
+
+	return s.accept(ctx, listener, &connections, s.handleNewConnection)
+}
 
+// accept hands each connection of the listener to handle until ctx is
+// cancelled, counting them in connections
+func (s *Server) accept(ctx context.Context, listener net.Listener, connections *sync.WaitGroup, handle func(context.Context, net.Conn)) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				slog.Debug("Server stopped accepting new connections")
-				os.Exit(0)
+				return nil
 			default:
-				slog.Error("Failed to accept connection", "error", err)
-				break
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("listener closed: %w", err)
+			}
+			slog.Error("Failed to accept connection", "error", err)
+			continue
 		}
 
-		go handleNewConnection(token, ctx, conn, clientList)
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			// Reads block without deadlines, closing the connection ends
+			// them so the handler can save what it received
+			stopConn := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stopConn()
+			handle(ctx, conn)
+		}()
 	}
 }
 
-func handleNewConnection(token string, ctx context.Context, conn net.Conn, clientList *ClientList) {
+func (s *Server) handleNewConnection(ctx context.Context, conn net.Conn) {
 	defer func() {
 		if conn != nil {
 			conn.Close()
 		}
 	}()
 
-	if conn == nil || clientList == nil {
+	if conn == nil {
 		return
 	}
 
-	tokenBuffer := make([]byte, len(token))
-	_, err := io.ReadFull(conn, tokenBuffer)
+	ctx, span := s.config.Tracer.Start(ctx, "accept", tracing.Attr("remoteAddr", conn.RemoteAddr().String()))
+
+	token, err := protocol.NewClientDecoder(conn).Token(len(s.config.Token))
 	if err != nil {
 		slog.Error("Failed to read token from client", "error", err, "remoteAddr", conn.RemoteAddr())
+		span.RecordError(err)
+		span.End()
 		return
 	}
 
-	if string(tokenBuffer) != token {
+	if token != s.config.Token {
 		slog.Warn("Invalid token received", "remoteAddr", conn.RemoteAddr())
+		err := fmt.Errorf("%w: invalid token", fault.ErrAuthFailed)
+		span.RecordError(err)
+		span.End()
+		s.report(err, "authenticate", "remoteAddr", conn.RemoteAddr().String())
+		return
+	}
+
+	s.admit(ctx, span, conn)
+}
+
+// handleLANConnection checks that a LAN client has the key, then serves it
+// like a client over TLS
+func (s *Server) handleLANConnection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	ctx, span := s.config.Tracer.Start(ctx, "accept",
+		tracing.Attr("remoteAddr", conn.RemoteAddr().String()),
+		tracing.Attr("lan", true))
+
+	conn.SetDeadline(time.Now().Add(lanHandshakeTimeout))
+	psk, err := protocol.ServerPSK(conn, []byte(s.config.LANKey))
+	if err != nil {
+		span.RecordError(err)
+		span.End()
+		if errors.Is(err, fault.ErrAuthFailed) {
+			slog.Warn("Invalid LAN key received", "remoteAddr", conn.RemoteAddr())
+			s.report(err, "authenticate", "remoteAddr", conn.RemoteAddr().String())
+		} else {
+			slog.Error("Failed to open LAN connection", "error", err, "remoteAddr", conn.RemoteAddr())
+		}
 		return
 	}
+	conn.SetDeadline(time.Time{})
 
+	s.admit(ctx, span, psk)
+}
+
+// admit serves an authenticated client under a new ID, ending the span of
+// its acceptance
+func (s *Server) admit(ctx context.Context, span *tracing.Span, conn net.Conn) {
 	clientID := uuid.New()
+	span.SetAttributes(tracing.Attr("clientId", clientID.String()))
+	span.End()
 	client := &Client{
 		ID:   clientID,
 		Addr: conn.RemoteAddr().String(),
 	}
-	clientList.Add(client)
 
-	handleConnection(ctx, conn, clientID, clientList)
+	// Registered before listeners hear of the client so they can send it
+	// settings right away
+	control := newClientControl(conn)
+	s.controls.Store(clientID, control)
+	s.clients.Add(client)
+
+	s.handleConnection(ctx, conn, clientID, control, s.config.settingsFor(clientID, conn.RemoteAddr()))
 }
 
-func handleConnection(ctx context.Context, conn net.Conn, clientID uuid.UUID, clientList *ClientList) {
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, clientID uuid.UUID, control *clientControl, settings ClientSettings) {
 	slog.Debug("New client connected", "clientID", clientID, "remoteAddr", conn.RemoteAddr())
 	defer func() {
 		conn.Close()
-		clientList.Remove(clientID)
+		control.close()
+		s.controls.Delete(clientID)
+		s.unrouteClient(clientID)
+		s.clients.Remove(clientID)
 		slog.Debug("Client connection closed", "clientID", clientID, "remoteAddr", conn.RemoteAddr())
 	}()
 
-	if err := sendClientID(conn, clientID); err != nil {
+	if err := protocol.NewServerEncoder(conn).ClientID(clientID); err != nil {
 		slog.Error("Failed to send client ID", "error", err, "clientID", clientID)
 		return
 	}
 
-	transmissionBuffer := []byte{}
+	// What the client sends is read through in, which tees it into a
+	// session dump when DumpDir is set
+	var in io.Reader = conn
+	if s.config.DumpDir != "" {
+		if dump := newSessionDump(s.config.DumpDir, clientID, conn.RemoteAddr(), conn); dump != nil {
+			defer dump.Close()
+			in = dump
+		}
+	}
+
+	var received transmission
+	defer received.reset()
 	isReceivingTransmission := false
+
+	// Whether the current transmission was refused, its audio is read and
+	// discarded
+	discarding := false
+	sampleRate := audio.RecordingSampleRate
 	var file *os.File
+	writer := bufio.NewWriterSize(nil, fileBufferSize)
 	var transmissionStartTime time.Time
 
+	// When the end marker of the last transmission arrived
+	var speechEnded time.Time
+
+	// Audio of short transmissions kept to join to the next one when
+	// settings.JoinShort is set, with when they started and ended
+	var held []int16
+	var heldStarted, heldEnded time.Time
+	minTransmission := settings.minTransmission()
+
+	// Whether writing the current transmission failed, reported once
+	writeFailed := false
+
+	// Spans of the transmission being received, continuing the trace of
+	// the accepted connection
+	transmissionCtx := ctx
+	var transmissionSpan *tracing.Span
+	defer func() { transmissionSpan.End() }()
+
+	// flushFile writes the buffered audio out to the recording
+	flushFile := func() {
+		if err := writer.Flush(); err != nil && !writeFailed {
+			writeFailed = true
+			slog.Error("Failed to write chunk data to file", "error", err, "clientID", clientID)
+			s.report(fault.Storage(err), "write_recording", "clientId", clientID.String())
+		}
+	}
+
 	defer func() {
 		if file != nil {
+			flushFile()
 			file.Close()
 			slog.Debug("Closed file due to connection end", "clientID", clientID)
 		}
@@ -136,102 +409,274 @@ func handleConnection(ctx context.Context, conn net.Conn, clientID uuid.UUID, cl
 
 	finishCurrentFile := func() {
 		if file != nil {
+			_, span := s.config.Tracer.Start(transmissionCtx, "finalize", tracing.Attr("sampleRate", sampleRate))
+			defer span.End()
+
 			// Update WAV header with final file size
-			if err := audio.UpdateWavHeader(file, uint32(len(transmissionBuffer))); err != nil {
+			flushFile()
+			if err := audio.UpdateWavHeader(file, uint32(received.size)); err != nil {
 				slog.Error("Failed to update WAV header", "error", err, "clientID", clientID)
+				s.report(fault.Storage(err), "finalize_recording", "clientId", clientID.String())
 			}
 			fileName := file.Name()
 			file.Close()
 			file = nil
 
-			// Resample the file for Whisper
-			if err := audio.ResampleForWhisper(fileName); err != nil {
-				slog.Error("Failed to resample audio for Whisper", "error", err, "clientID", clientID)
-			} else {
-				slog.Info("Audio resampled for Whisper", "file", fileName)
+			opts := settings.convertOptions()
+			joined := len(held) > 0 && transmissionStartTime.Sub(heldEnded) <= joinWindow
+			if sampleRate == audio.WhisperSampleRate && opts.Passthrough() && !joined {
+				held = nil
+				// Captured at the rate whisper wants, the recording only has
+				// to move to where the watcher picks it up
+				s.config.Latency.Handoff(audio.WhisperPath(fileName), speechEnded)
+				if err := os.Rename(fileName, audio.WhisperPath(fileName)); err != nil {
+					slog.Error("Failed to hand recording to Whisper", "error", err, "clientID", clientID)
+					span.RecordError(err)
+					s.report(err, "finalize_recording", "clientId", clientID.String())
+				} else {
+					s.config.Tracer.Handoff(audio.WhisperPath(fileName), transmissionSpan.Context())
+					s.observeFinalized(clientID, speechEnded)
+					slog.Info("Audio ready for Whisper", "file", fileName)
+					recordChecksum(audio.WhisperPath(fileName), clientID)
+				}
+				return
+			}
+
+			// Prepare the whisper copy from the samples already in memory
+			// rather than reading the recording back from disk, off the
+			// connection so it keeps reading
+			segment := audio.NewSegment(received.samples(), sampleRate)
+			segment.ClientID = clientID.String()
+			segment.StartedAt = transmissionStartTime
+			if joined {
+				segment.Samples = slices.Concat(held, joinGapSamples(sampleRate), segment.Samples)
+				segment.StartedAt = heldStarted
+				slog.Info("Joined short transmission to the next", "file", fileName, "clientID", clientID)
 			}
+			held = nil
+			s.queueResample(resampleJob{
+				segment:     segment,
+				fileName:    fileName,
+				opts:        opts,
+				clientID:    clientID,
+				speechEnded: speechEnded,
+				ctx:         transmissionCtx,
+				trace:       transmissionSpan.Context(),
+			})
 		}
 		//	lastFileFinish = time.Now()
 	}
 
 	startFile := func() error {
 		var err error
-		file, err = createWavFile(clientID)
+		file, err = s.createWavFile(clientID)
 		if err != nil {
 			slog.Error("Failed to create WAV file", "error", err, "clientID", clientID)
+			err = fault.Storage(err)
+			s.report(err, "create_recording", "clientId", clientID.String())
 			return err
 		}
+		writer.Reset(file)
+
 		// Write WAV header
-		if err := audio.WriteWavHeader(file, 0); err != nil {
+		if err := audio.WriteWavHeader(file, uint32(sampleRate), 0); err != nil {
 			slog.Error("Failed to write WAV header", "error", err, "clientID", clientID)
+			err = fault.Storage(err)
+			s.report(err, "create_recording", "clientId", clientID.String())
 			return err
 		}
 		return err
 	}
 
+	decoder := protocol.NewClientDecoder(in)
 	for {
-		marker := make([]byte, 4)
-		_, err := io.ReadFull(conn, marker)
+		message, err := decoder.Next()
 		if err != nil {
-			if err == io.EOF {
+			switch {
+			case errors.Is(err, fault.ErrProtocol):
+				slog.Error("Protocol violation, closing connection", "error", err, "clientID", clientID, "remoteAddr", conn.RemoteAddr())
+				transmissionSpan.RecordError(err)
+				s.report(err, "receive", "clientId", clientID.String(), "remoteAddr", conn.RemoteAddr().String())
+			case err == io.EOF:
 				slog.Debug("Client disconnected", "clientID", clientID, "remoteAddr", conn.RemoteAddr())
-			} else {
-				slog.Error("Failed to read marker", "error", err, "clientID", clientID, "remoteAddr", conn.RemoteAddr())
+			default:
+				slog.Error("Failed to read message", "error", err, "clientID", clientID, "remoteAddr", conn.RemoteAddr())
 			}
 			if isReceivingTransmission && file != nil {
-				handleIncompleteTransmission(file, transmissionStartTime, clientID)
+				flushFile()
+				handleIncompleteTransmission(file, transmissionStartTime, minTransmission, clientID)
+				transmissionSpan.SetAttributes(tracing.Attr("incomplete", true))
 			}
 			return
 		}
 
-		if binary.BigEndian.Uint32(marker) == 0xFFFFFFFF {
+		switch message.Kind {
+		case protocol.Format:
+			requested := message.SampleRate
+			sampleRate = acceptSampleRate(requested)
+			if err := writeFormatReply(control, sampleRate); err != nil {
+				slog.Error("Failed to accept capture format", "error", err, "clientID", clientID)
+				return
+			}
+			control.negotiated()
+			slog.Info("Negotiated capture format", "sampleRate", sampleRate, "requested", requested, "clientID", clientID)
+		case protocol.Speech:
+			// Clients announce it once past the format reply
+			control.playsSpeech()
+			control.negotiated()
+			slog.Debug("Client plays speech", "clientID", clientID)
+		case protocol.Live:
+			control.playsLive()
+			control.negotiated()
+			slog.Debug("Client plays live audio", "clientID", clientID)
+		case protocol.Mute:
+			control.negotiated()
+			if err := control.mutes(); err != nil {
+				slog.Error("Failed to send mute", "error", err, "clientID", clientID)
+				return
+			}
+			slog.Debug("Client stops transmitting while muted", "clientID", clientID)
+		case protocol.Continuous:
+			control.negotiated()
+			if err := control.recordsContinuously(); err != nil {
+				slog.Error("Failed to send continuous recording", "error", err, "clientID", clientID)
+				return
+			}
+			slog.Debug("Client records continuously on request", "clientID", clientID)
+		case protocol.Health:
+			control.negotiated()
+			if s.config.HealthInterval <= 0 {
+				continue
+			}
+			if err := control.reportsHealth(s.config.HealthInterval); err != nil {
+				slog.Error("Failed to ask for health reports", "error", err, "clientID", clientID)
+				return
+			}
+			slog.Debug("Client reports health", "clientID", clientID, "interval", s.config.HealthInterval)
+		case protocol.HealthReport:
+			s.recordHealth(clientID, message.Metrics)
+		case protocol.Start:
 			isReceivingTransmission = true
-			transmissionBuffer = make([]byte, 0)
+			writeFailed = false
+			control.negotiated()
+
+			if control.muted.Load() {
+				discarding = true
+				slog.Debug("Discarding transmission of muted client", "clientID", clientID, "remoteAddr", conn.RemoteAddr())
+				continue
+			}
+
+			if s.diskLow.Load() {
+				discarding = true
+				refuse(control, clientID, protocol.RefusedStorageFull)
+				slog.Warn("Refused transmission, recordings volume nearly full", "clientID", clientID, "remoteAddr", conn.RemoteAddr())
+				continue
+			}
+			received.reset()
 			transmissionStartTime = time.Now()
 
+			transmissionSpan.End()
+			transmissionCtx, transmissionSpan = s.config.Tracer.Start(ctx, "transmission", tracing.Attr("clientId", clientID.String()))
+
 			if err := startFile(); err != nil {
+				transmissionSpan.RecordError(err)
 				return
 			}
 
 			slog.Info("Started receiving new transmission", "clientID", clientID, "remoteAddr", conn.RemoteAddr())
-		} else if binary.BigEndian.Uint32(marker) == 0x00000000 {
+		case protocol.End:
 			isReceivingTransmission = false
+			speechEnded = time.Now()
+			if discarding {
+				discarding = false
+				slog.Debug("Discarded refused transmission", "clientID", clientID, "remoteAddr", conn.RemoteAddr())
+				continue
+			}
 			transmissionDuration := time.Since(transmissionStartTime)
 
-			if transmissionDuration < time.Second {
-				slog.Debug("Dropping short transmission",
-					"duration", transmissionDuration.Seconds(),
-					"bytes", len(transmissionBuffer),
-					"clientID", clientID,
-					"remoteAddr", conn.RemoteAddr())
+			if transmissionDuration < minTransmission {
+				if settings.JoinShort {
+					if len(held) > 0 && transmissionStartTime.Sub(heldEnded) <= joinWindow {
+						held = append(held, joinGapSamples(sampleRate)...)
+					} else {
+						held, heldStarted = nil, transmissionStartTime
+					}
+					held = append(held, received.samples()...)
+					heldEnded = speechEnded
+					slog.Debug("Holding short transmission for the next",
+						"duration", transmissionDuration.Seconds(),
+						"bytes", received.size,
+						"clientID", clientID,
+						"remoteAddr", conn.RemoteAddr())
+				} else {
+					slog.Debug("Dropping short transmission",
+						"duration", transmissionDuration.Seconds(),
+						"bytes", received.size,
+						"clientID", clientID,
+						"remoteAddr", conn.RemoteAddr())
+				}
 				if file != nil {
+					// Buffered audio of the dropped file is never written
+					writer.Reset(nil)
 					file.Close()
 					os.Remove(file.Name())
+					file = nil
 				}
+				transmissionSpan.SetAttributes(tracing.Attr("dropped", true))
 			} else {
 				slog.Info("Finished receiving transmission",
 					"duration", transmissionDuration.Seconds(),
-					"bytes", len(transmissionBuffer),
+					"bytes", received.size,
 					"clientID", clientID,
 					"remoteAddr", conn.RemoteAddr())
 
 				finishCurrentFile()
 			}
-		} else if isReceivingTransmission {
-			chunkSize := binary.BigEndian.Uint32(marker)
+			transmissionSpan.SetAttributes(
+				tracing.Attr("duration", transmissionDuration),
+				tracing.Attr("bytes", received.size))
+			transmissionSpan.End()
+			transmissionSpan = nil
+			received.reset()
+		case protocol.Chunk:
+			if !discarding && control.muted.Load() {
+				// Muted while transmitting, what was received is dropped too
+				discarding = true
+				if file != nil {
+					writer.Reset(nil)
+					file.Close()
+					os.Remove(file.Name())
+					file = nil
+				}
+				received.reset()
+				transmissionSpan.SetAttributes(tracing.Attr("muted", true))
+				slog.Info("Discarded transmission of client muted while transmitting", "clientID", clientID)
+			}
+			if discarding {
+				// The decoder skips the unread chunk
+				continue
+			}
 
-			chunkData := make([]byte, chunkSize)
-			_, err := io.ReadFull(conn, chunkData)
+			parts, err := received.readChunk(decoder, message.Size)
 			if err != nil {
 				slog.Error("Failed to read chunk data", "error", err, "clientID", clientID, "remoteAddr", conn.RemoteAddr())
 				return
 			}
 
-			transmissionBuffer = append(transmissionBuffer, chunkData...)
+			s.forward(clientID, sampleRate, parts)
+
 			if file != nil {
-				_, err = file.Write(chunkData)
+				for _, part := range parts {
+					if _, err = writer.Write(part); err != nil {
+						break
+					}
+				}
 				if err != nil {
 					slog.Error("Failed to write chunk data to file", "error", err, "clientID", clientID)
+					if !writeFailed {
+						writeFailed = true
+						s.report(fault.Storage(err), "write_recording", "clientId", clientID.String())
+					}
 				}
 			}
 
@@ -244,7 +689,6 @@ func handleConnection(ctx context.Context, conn net.Conn, clientID uuid.UUID, cl
 			//				return
 			//			}
 			//		}
-
 		}
 
 		select {
@@ -256,52 +700,93 @@ func handleConnection(ctx context.Context, conn net.Conn, clientID uuid.UUID, cl
 	}
 }
 
-func createWavFile(clientID uuid.UUID) (*os.File, error) {
-	updateCurrentDay()
+// report hands a failure to the error reporter, with tags as name, value
+// pairs
+func (s *Server) report(err error, op string, tags ...string) {
+	if s.config.ErrorReporter == nil {
+		return
+	}
+	reported := map[string]string{"component": "server", "op": op}
+	for i := 0; i+1 < len(tags); i += 2 {
+		reported[tags[i]] = tags[i+1]
+	}
+	s.config.ErrorReporter.Report(err, reported)
+}
 
-	dailyDir := filepath.Join("recordings", currentDay)
-	clientDir := filepath.Join(dailyDir, clientID.String())
+// recordChecksum adds a finalized recording to its day's integrity manifest
+func recordChecksum(path string, clientID uuid.UUID) {
+	if err := audio.RecordChecksum(path); err != nil {
+		slog.Error("Failed to record checksum", "error", err, "file", path, "clientID", clientID)
+	}
+}
 
-	dailyDirMutex.Lock()
-	defer dailyDirMutex.Unlock()
+func (s *Server) createWavFile(clientID uuid.UUID) (*os.File, error) {
+	day := s.updateCurrentDay()
+	clientDir := filepath.Join(s.config.RecordingsDir, day, clientID.String())
 
-	err := os.MkdirAll(clientDir, 0755)
-	if err != nil {
+	if err := os.MkdirAll(clientDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create client directory: %w", err)
 	}
 
-	timestamp := time.Now().Format("150405") // HHMMSS
-	filename := fmt.Sprintf("audio_%s.wav", timestamp)
-	return os.Create(filepath.Join(clientDir, filename))
+	// Recordings of live audio can finish within the same second, a taken
+	// name moves on to the next second rather than overwriting it
+	started := time.Now()
+	for i := 0; ; i++ {
+		timestamp := started.Add(time.Duration(i) * time.Second).Format("150405") // HHMMSS
+		path := filepath.Join(clientDir, fmt.Sprintf("audio_%s.wav", timestamp))
+		if _, err := os.Stat(audio.WhisperPath(path)); err == nil && i < 60 {
+			continue
+		}
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 60 {
+			continue
+		}
+		return file, err
+	}
 }
 
-func updateCurrentDay() {
+// updateCurrentDay creates the day directory when the date changes and
+// returns the current day
+func (s *Server) updateCurrentDay() string {
+	s.dayMu.Lock()
+	defer s.dayMu.Unlock()
+
 	newDay := time.Now().Format("20060102") // YYYYMMDD
-	if newDay != currentDay {
-		dailyDirMutex.Lock()
-		defer dailyDirMutex.Unlock()
-
-		if newDay != currentDay {
-			currentDay = newDay
-			dailyDir := filepath.Join("recordings", currentDay)
-			err := os.MkdirAll(dailyDir, 0755)
-			if err != nil {
-				slog.Error("Failed to create daily directory", "error", err, "path", dailyDir)
-			} else {
-				slog.Info("Created new daily directory", "path", dailyDir)
-			}
+	if newDay != s.currentDay {
+		s.currentDay = newDay
+		dailyDir := filepath.Join(s.config.RecordingsDir, s.currentDay)
+		err := os.MkdirAll(dailyDir, 0755)
+		if err != nil {
+			slog.Error("Failed to create daily directory", "error", err, "path", dailyDir)
+		} else {
+			slog.Info("Created new daily directory", "path", dailyDir)
 		}
 	}
+	return s.currentDay
+}
+
+// acceptSampleRate picks the capture rate for a client request. Whisper's
+// rate is recorded as is, anything else falls back to the default rate.
+func acceptSampleRate(requested int) int {
+	switch requested {
+	case audio.WhisperSampleRate, audio.RecordingSampleRate:
+		return requested
+	}
+	return audio.RecordingSampleRate
+}
+
+func writeFormatReply(control *clientControl, sampleRate int) error {
+	return control.write(binary.BigEndian.AppendUint32(nil, uint32(sampleRate)))
 }
 
-func sendClientID(conn net.Conn, clientID uuid.UUID) error {
-	_, err := conn.Write(clientID[:])
-	return err
+// joinGapSamples is the silence put between joined transmissions
+func joinGapSamples(sampleRate int) []int16 {
+	return make([]int16, int(joinGap)*sampleRate/int(time.Second))
 }
 
-func handleIncompleteTransmission(file *os.File, startTime time.Time, clientID uuid.UUID) {
+func handleIncompleteTransmission(file *os.File, startTime time.Time, minDuration time.Duration, clientID uuid.UUID) {
 	transmissionDuration := time.Since(startTime)
-	if transmissionDuration < time.Second {
+	if transmissionDuration < minDuration {
 		slog.Debug("Dropping incomplete short transmission",
 			"duration", transmissionDuration.Seconds(),
 			"clientID", clientID)
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/google/uuid"
+)
+
+const (
+	// Longest recording of a stream, cut even while speech or music goes
+	// on, so a stream is transcribed at least this often
+	maxStreamRecording = time.Minute
+
+	// Samples read from a stream at once, 100ms
+	streamReadSamples = audio.WhisperSampleRate / 10
+
+	// Wait before reconnecting to a stream that ended, doubling up to the
+	// maximum while it keeps failing
+	streamRetry    = time.Second
+	maxStreamRetry = 5 * time.Minute
+
+	// How long a stream has to play for its wait to start over
+	streamStable = time.Minute
+)
+
+// Clients of streams are derived from their URL in this namespace, so a
+// stream always maps to the same client
+var streamNamespace = uuid.MustParse("5e2a9c47-1b3d-4f60-8e7a-c4d2b1f09a36")
+
+// runStream records a stream until ctx ends, reconnecting whenever it ends
+func (s *Server) runStream(ctx context.Context, url string) {
+	clientID := uuid.NewSHA1(streamNamespace, []byte(url))
+	retry := streamRetry
+	for {
+		started := time.Now()
+		err := s.recordStream(ctx, clientID, url)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > streamStable {
+			retry = streamRetry
+		}
+		slog.Warn("Stream ended, reconnecting", "error", err, "url", url, "clientID", clientID, "retryIn", retry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, maxStreamRetry)
+	}
+}
+
+// recordStream decodes a stream, cutting it into recordings at pauses,
+// until it ends or ctx does
+func (s *Server) recordStream(ctx context.Context, clientID uuid.UUID, url string) error {
+	decoder, err := audio.DecodeStream(ctx, url, audio.WhisperSampleRate)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	samples := make([]int16, streamReadSamples)
+	n, err := decoder.Read(samples)
+	if n == 0 {
+		if err == nil {
+			err = fmt.Errorf("stream sent no audio")
+		}
+		return err
+	}
+
+	s.clients.Add(&Client{ID: clientID, Addr: url})
+	slog.Info("Recording stream", "url", url, "clientID", clientID)
+	live := s.newLiveAudio(clientID, "stream", audio.WhisperSampleRate, maxStreamRecording, s.config.settingsFor(clientID, nil))
+	defer live.Close()
+	for {
+		live.Write(samples[:n])
+		if err != nil {
+			return err
+		}
+		n, err = decoder.Read(samples)
+	}
+}
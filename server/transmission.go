@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// Size of the blocks a transmission is received into
+const transmissionBlockSize = 64 << 10
+
+// blockPool holds the blocks of transmissions, shared by all connections
+var blockPool = sync.Pool{
+	New: func() any {
+		block := make([]byte, transmissionBlockSize)
+		return &block
+	},
+}
+
+// transmission holds the audio of the transmission being received. Chunks
+// are read from the connection straight into fixed size blocks, so the
+// audio is never copied to grow the buffer and the same bytes are written
+// to the recording.
+type transmission struct {
+	blocks []*[]byte
+	size   int // bytes received
+
+	// Parts of the blocks the latest chunk was read into
+	parts [][]byte
+}
+
+// readChunk reads n bytes from r into the blocks, returning the parts they
+// were read into. The parts are valid until reset.
+func (t *transmission) readChunk(r io.Reader, n int) ([][]byte, error) {
+	t.parts = t.parts[:0]
+	for n > 0 {
+		offset := t.size % transmissionBlockSize
+		if offset == 0 && t.size/transmissionBlockSize == len(t.blocks) {
+			t.blocks = append(t.blocks, blockPool.Get().(*[]byte))
+		}
+		block := *t.blocks[len(t.blocks)-1]
+		part := block[offset:min(offset+n, transmissionBlockSize)]
+		if _, err := io.ReadFull(r, part); err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, part)
+		t.size += len(part)
+		n -= len(part)
+	}
+	return t.parts, nil
+}
+
+// samples decodes the received audio as little endian 16-bit samples
+func (t *transmission) samples() []int16 {
+	samples := make([]int16, t.size/2)
+	remaining := t.size
+	i := 0
+	var low byte
+	odd := false // a sample's low byte ended the previous block
+	for _, block := range t.blocks {
+		data := (*block)[:min(remaining, transmissionBlockSize)]
+		remaining -= len(data)
+		if odd && len(data) > 0 {
+			samples[i] = int16(uint16(low) | uint16(data[0])<<8)
+			i++
+			data = data[1:]
+			odd = false
+		}
+		for ; len(data) >= 2; data = data[2:] {
+			samples[i] = int16(uint16(data[0]) | uint16(data[1])<<8)
+			i++
+		}
+		if len(data) == 1 {
+			low, odd = data[0], true
+		}
+	}
+	return samples
+}
+
+// reset empties the transmission, returning its blocks to the pool
+func (t *transmission) reset() {
+	for i, block := range t.blocks {
+		blockPool.Put(block)
+		t.blocks[i] = nil
+	}
+	t.blocks = t.blocks[:0]
+	t.size = 0
+}
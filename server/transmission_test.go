@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/bosley/libas/protocol"
+)
+
+// Chunks of a transmission of five seconds at 16 kHz, of the 1024 samples
+// clients send
+const (
+	benchmarkChunkSize = 2048
+	benchmarkChunks    = 5 * 16000 * 2 / benchmarkChunkSize
+)
+
+func TestTransmissionSamples(t *testing.T) {
+	samples := make([]int16, 3*transmissionBlockSize/2+1)
+	for i := range samples {
+		samples[i] = int16(i*7 - 30000)
+	}
+	data := protocol.AppendChunk(nil, samples)[4:]
+
+	// Odd chunk sizes split samples across blocks
+	for _, size := range []int{1, 3, 2047, 4096, len(data)} {
+		var received transmission
+		r := bytes.NewReader(data)
+		for r.Len() > 0 {
+			parts, err := received.readChunk(r, min(size, r.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) == 0 {
+				t.Fatal("read a chunk into no parts")
+			}
+		}
+		if received.size != len(data) {
+			t.Errorf("chunks of %d: received %d bytes, want %d", size, received.size, len(data))
+		}
+		if !slices.Equal(received.samples(), samples) {
+			t.Errorf("chunks of %d: samples differ from those sent", size)
+		}
+		received.reset()
+		if received.size != 0 || len(received.blocks) != 0 {
+			t.Errorf("chunks of %d: reset left %d bytes in %d blocks", size, received.size, len(received.blocks))
+		}
+	}
+}
+
+// BenchmarkReceivePooled receives transmissions into pooled blocks, as
+// connections do
+func BenchmarkReceivePooled(b *testing.B) {
+	data := make([]byte, benchmarkChunkSize)
+	r := bytes.NewReader(data)
+	var received transmission
+	b.ReportAllocs()
+	b.SetBytes(benchmarkChunkSize * benchmarkChunks)
+	for range b.N {
+		for range benchmarkChunks {
+			r.Reset(data)
+			if _, err := received.readChunk(r, benchmarkChunkSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+		received.reset()
+	}
+}
+
+// BenchmarkReceiveAllocating receives transmissions the way connections did
+// before pooling, allocating every chunk and growing one buffer for each
+// transmission
+func BenchmarkReceiveAllocating(b *testing.B) {
+	data := make([]byte, benchmarkChunkSize)
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.SetBytes(benchmarkChunkSize * benchmarkChunks)
+	for range b.N {
+		transmissionBuffer := make([]byte, 0)
+		for range benchmarkChunks {
+			r.Reset(data)
+			chunkData := make([]byte, benchmarkChunkSize)
+			if _, err := io.ReadFull(r, chunkData); err != nil {
+				b.Fatal(err)
+			}
+			transmissionBuffer = append(transmissionBuffer, chunkData...)
+		}
+	}
+}
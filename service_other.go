@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// runService reports that the process is never a Windows service here
+func runService(name string, run func() error) (bool, error) {
+	return false, nil
+}
+
+func installWindowsService(svc service) error {
+	return fmt.Errorf("Windows services can only be installed on Windows")
+}
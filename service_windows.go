@@ -0,0 +1,143 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Environment variable install-service sets on Windows services to the
+// directory relative paths are resolved against, services otherwise start
+// in the system directory
+const workDirEnv = "LIBAS_WORKDIR"
+
+var stopOnce sync.Once
+
+// runService runs the command under the service control manager when it
+// started the process, translating stop requests into shutdownContext
+// cancellation
+func runService(name string, run func() error) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+
+	if dir := os.Getenv(workDirEnv); dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			return true, fmt.Errorf("failed to change to working directory: %w", err)
+		}
+	}
+
+	handler := &windowsService{run: run}
+	if err := svc.Run("libas-"+name, handler); err != nil {
+		return true, err
+	}
+	return true, handler.err
+}
+
+// windowsService adapts a command to the service control manager
+type windowsService struct {
+	run func() error
+	err error
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run()
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			s.err = err
+			if err != nil {
+				slog.Error("Service failed", "error", err)
+				return false, 1
+			}
+			return false, 0
+
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				stopOnce.Do(func() { close(serviceStop) })
+			}
+		}
+	}
+}
+
+// installWindowsService registers the command with the service control
+// manager, starting automatically and restarting after failures
+func installWindowsService(s service) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	if existing, err := m.OpenService(s.Name); err == nil {
+		existing.Close()
+		return fmt.Errorf("service %s already exists, remove it with \"sc.exe delete %s\"", s.Name, s.Name)
+	}
+
+	// Without a console there is nowhere for stderr to go
+	args := s.Args
+	if !hasFlag(args, "log-file") {
+		args = append(args[:1:1], append([]string{"-log-file", filepath.Join(s.WorkingDir, s.Name+".log")}, args[1:]...)...)
+	}
+
+	service, err := m.CreateService(s.Name, s.Executable, mgr.Config{
+		DisplayName: "libas " + s.Command,
+		Description: "libas " + s.Command + " (" + s.WorkingDir + ")",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer service.Close()
+
+	if err := service.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, uint32((24 * time.Hour).Seconds())); err != nil {
+		slog.Warn("Failed to set service restart policy", "error", err)
+	}
+
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+s.Name, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to open service registry key: %w", err)
+	}
+	defer key.Close()
+	if err := key.SetStringsValue("Environment", []string{workDirEnv + "=" + s.WorkingDir}); err != nil {
+		return fmt.Errorf("failed to set service working directory: %w", err)
+	}
+
+	fmt.Printf("Installed service %s\n\nStart it with:\n  sc.exe start %s\n", s.Name, s.Name)
+	return nil
+}
+
+// hasFlag reports whether args set the named flag
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
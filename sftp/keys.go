@@ -0,0 +1,425 @@
+package sftp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+)
+
+// Fingerprint returns the SHA256 fingerprint of a public key blob in the
+// form ssh-keygen -l prints
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// parsePublicKey reads a public key blob, reporting its type
+func parsePublicKey(blob []byte) (string, crypto.PublicKey, error) {
+	r := reader{data: blob}
+	keyType := r.string()
+
+	var key crypto.PublicKey
+	switch keyType {
+	case "ssh-ed25519":
+		point := r.bytes()
+		if r.err == nil && len(point) != ed25519.PublicKeySize {
+			return "", nil, errors.New("invalid ed25519 key")
+		}
+		key = ed25519.PublicKey(point)
+	case "ssh-rsa":
+		e, n := r.mpint(), r.mpint()
+		if r.err == nil && (!e.IsInt64() || e.Int64() > 1<<31) {
+			return "", nil, errors.New("invalid RSA exponent")
+		}
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "ecdsa-sha2-nistp256":
+		r.string()
+		point := r.bytes()
+		if r.err != nil {
+			break
+		}
+		// crypto/ecdh validates the point before it is used
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return "", nil, fmt.Errorf("invalid ECDSA key: %w", err)
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), point)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if r.err != nil {
+		return "", nil, fmt.Errorf("malformed %s key: %w", keyType, r.err)
+	}
+	return keyType, key, nil
+}
+
+// verifySignature checks a signature made with the negotiated host key
+// algorithm over data
+func verifySignature(blob []byte, algorithm string, data, signature []byte) error {
+	keyType, key, err := parsePublicKey(blob)
+	if err != nil {
+		return err
+	}
+	r := reader{data: signature}
+	sigType, sig := r.string(), r.bytes()
+	if r.err != nil {
+		return fmt.Errorf("malformed signature: %w", r.err)
+	}
+	if sigType != algorithm {
+		return fmt.Errorf("signature is %s, negotiated %s", sigType, algorithm)
+	}
+
+	switch sigType {
+	case "ssh-ed25519":
+		if keyType != "ssh-ed25519" || !ed25519.Verify(key.(ed25519.PublicKey), data, sig) {
+			return errors.New("verification failed")
+		}
+		return nil
+	case "rsa-sha2-256", "rsa-sha2-512":
+		if keyType != "ssh-rsa" {
+			return errors.New("verification failed")
+		}
+		hash, digest := rsaDigest(sigType, data)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), hash, digest, sig)
+	case "ecdsa-sha2-nistp256":
+		if keyType != "ecdsa-sha2-nistp256" {
+			return errors.New("verification failed")
+		}
+		s := reader{data: sig}
+		rInt, sInt := s.mpint(), s.mpint()
+		digest := sha256.Sum256(data)
+		if s.err != nil || !ecdsa.Verify(key.(*ecdsa.PublicKey), digest[:], rInt, sInt) {
+			return errors.New("verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signature %q", sigType)
+}
+
+func rsaDigest(algorithm string, data []byte) (crypto.Hash, []byte) {
+	if algorithm == "rsa-sha2-512" {
+		sum := sha512.Sum512(data)
+		return crypto.SHA512, sum[:]
+	}
+	sum := sha256.Sum256(data)
+	return crypto.SHA256, sum[:]
+}
+
+// hostKeyChecker accepts a server's host key when it matches the pinned
+// fingerprint or the known hosts file
+func hostKeyChecker(cfg Config, addr string) func(key []byte) error {
+	return func(key []byte) error {
+		fingerprint := Fingerprint(key)
+		if cfg.HostKeyFingerprint != "" {
+			if strings.TrimRight(cfg.HostKeyFingerprint, "=") == fingerprint {
+				return nil
+			}
+			return fmt.Errorf("host key of %s is %s, not the configured fingerprint", addr, fingerprint)
+		}
+
+		known, err := checkKnownHosts(cfg.KnownHostsFile, addr, key)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("host key of %s (%s) is not in %s, add it with ssh-keyscan or set its fingerprint", addr, fingerprint, cfg.KnownHostsFile)
+		}
+		return nil
+	}
+}
+
+// checkKnownHosts reports whether an OpenSSH known_hosts file lists key
+// for addr. A revoked key or a different key for the host is an error.
+func checkKnownHosts(path, addr string, key []byte) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open known hosts: %w", err)
+	}
+	defer file.Close()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+	name := host
+	if port != "22" {
+		name = "[" + host + "]:" + port
+	}
+
+	found, mismatch := false, false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		marker := ""
+		if strings.HasPrefix(fields[0], "@") {
+			marker, fields = fields[0], fields[1:]
+		}
+		if len(fields) < 3 {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+
+		if marker == "@revoked" && bytes.Equal(blob, key) {
+			return false, fmt.Errorf("host key of %s is revoked in %s", addr, path)
+		}
+		if marker != "" || !knownHostMatches(fields[0], name) {
+			continue
+		}
+		if bytes.Equal(blob, key) {
+			found = true
+		} else if keyTypeOf(blob) == keyTypeOf(key) {
+			mismatch = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+	if !found && mismatch {
+		return false, fmt.Errorf("host key of %s (%s) does not match %s, it may have been replaced or the connection intercepted", addr, Fingerprint(key), path)
+	}
+	return found, nil
+}
+
+// knownHostMatches matches a known_hosts host list, plain or hashed, that
+// may contain negated patterns but no wildcards
+func knownHostMatches(patterns, name string) bool {
+	if strings.HasPrefix(patterns, "|1|") {
+		parts := strings.Split(patterns[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err1 := base64.StdEncoding.DecodeString(parts[0])
+		want, err2 := base64.StdEncoding.DecodeString(parts[1])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(name))
+		return hmac.Equal(mac.Sum(nil), want)
+	}
+
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		if negated := strings.HasPrefix(pattern, "!"); negated {
+			if pattern[1:] == name {
+				return false
+			}
+		} else if pattern == name {
+			matched = true
+		}
+	}
+	return matched
+}
+
+func keyTypeOf(blob []byte) string {
+	r := reader{data: blob}
+	return r.string()
+}
+
+// signer signs user authentication requests with a private key
+type signer struct {
+	algorithm string // Signature algorithm
+	publicKey []byte // Public key blob
+	sign      func(data []byte) ([]byte, error)
+}
+
+// loadSigner reads an unencrypted private key in OpenSSH or PEM format
+func loadSigner(path string) (*signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM encoded private key", path)
+	}
+	if _, encrypted := block.Headers["Proc-Type"]; encrypted {
+		return nil, errors.New("passphrase protected private keys are not supported")
+	}
+
+	var key crypto.PrivateKey
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		key, err = parseOpenSSHKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return newSigner(key)
+}
+
+func newSigner(key crypto.PrivateKey) (*signer, error) {
+	var blob builder
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		blob.string("ssh-ed25519")
+		blob.bytes(key.Public().(ed25519.PublicKey))
+		return &signer{
+			algorithm: "ssh-ed25519",
+			publicKey: blob.buf,
+			sign: func(data []byte) ([]byte, error) {
+				return ed25519.Sign(key, data), nil
+			},
+		}, nil
+
+	case *rsa.PrivateKey:
+		blob.string("ssh-rsa")
+		blob.mpint(big.NewInt(int64(key.E)))
+		blob.mpint(key.N)
+		return &signer{
+			algorithm: "rsa-sha2-256",
+			publicKey: blob.buf,
+			sign: func(data []byte) ([]byte, error) {
+				hash, digest := rsaDigest("rsa-sha2-256", data)
+				return rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+			},
+		}, nil
+
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		public, err := key.PublicKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		blob.string("ecdsa-sha2-nistp256")
+		blob.string("nistp256")
+		blob.bytes(public.Bytes())
+		return &signer{
+			algorithm: "ecdsa-sha2-nistp256",
+			publicKey: blob.buf,
+			sign: func(data []byte) ([]byte, error) {
+				digest := sha256.Sum256(data)
+				r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+				if err != nil {
+					return nil, err
+				}
+				var sig builder
+				sig.mpint(r)
+				sig.mpint(s)
+				return sig.buf, nil
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported private key %T", key)
+}
+
+// parseOpenSSHKey reads the openssh-key-v1 format ssh-keygen writes by
+// default
+func parseOpenSSHKey(data []byte) (crypto.PrivateKey, error) {
+	const magic = "openssh-key-v1\x00"
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, errors.New("not an openssh-key-v1 key")
+	}
+	r := reader{data: data[len(magic):]}
+	cipherName, _, _ := r.string(), r.string(), r.string()
+	if r.err == nil && cipherName != "none" {
+		return nil, errors.New("passphrase protected private keys are not supported")
+	}
+	if count := r.uint32(); r.err == nil && count != 1 {
+		return nil, fmt.Errorf("expected one key, found %d", count)
+	}
+	r.bytes()
+	private := reader{data: r.bytes()}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if check1, check2 := private.uint32(), private.uint32(); check1 != check2 {
+		return nil, errors.New("corrupt private key")
+	}
+	keyType := private.string()
+
+	var key crypto.PrivateKey
+	switch keyType {
+	case "ssh-ed25519":
+		private.bytes()
+		seed := private.bytes()
+		if private.err == nil && len(seed) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		key = ed25519.PrivateKey(seed)
+	case "ssh-rsa":
+		n, e, d, _, p, q := private.mpint(), private.mpint(), private.mpint(), private.mpint(), private.mpint(), private.mpint()
+		if private.err != nil {
+			break
+		}
+		rsaKey := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := rsaKey.Validate(); err != nil {
+			return nil, err
+		}
+		rsaKey.Precompute()
+		key = rsaKey
+	case "ecdsa-sha2-nistp256":
+		private.string()
+		private.bytes()
+		d := private.bytes()
+		if private.err != nil {
+			break
+		}
+		ecdhKey, err := ecdh.P256().NewPrivateKey(leftPad(d, 32))
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), ecdhKey.PublicKey().Bytes())
+		key = &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+			D:         new(big.Int).SetBytes(d),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if private.err != nil {
+		return nil, fmt.Errorf("malformed %s key: %w", keyType, private.err)
+	}
+	return key, nil
+}
+
+// leftPad strips an mpint's sign byte or pads it to size bytes
+func leftPad(b []byte, size int) []byte {
+	for len(b) > size && b[0] == 0 {
+		b = b[1:]
+	}
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,482 @@
+package sftp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testServer is an SSH server running the parts of the SFTP subsystem the
+// client uses, keeping files in memory. It follows RFC 4253, 4252, 4254 and
+// draft-ietf-secsh-filexfer-02 on its own, sharing only the wire encoding
+// and packet ciphers with the client.
+type testServer struct {
+	addr    string
+	hostKey *signer
+
+	// Algorithms offered, every one the client knows when empty
+	hostKeyAlgorithms []string
+	ciphers           []string
+
+	user        string
+	password    string
+	userKey     []byte // Public key blob accepted for user, if any
+	posixRename bool
+
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+// startTestServer listens on loopback with the host key in testdata,
+// stopping when the test ends
+func startTestServer(t *testing.T, hostKeyFile string, configure func(s *testServer)) *testServer {
+	t.Helper()
+	hostKey, err := loadSigner(hostKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		hostKey:     hostKey,
+		user:        "libas",
+		password:    "secret",
+		posixRename: true,
+		files:       make(map[string][]byte),
+		dirs:        map[string]bool{".": true, "/": true},
+	}
+	if configure != nil {
+		configure(s)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s.addr = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Clients giving up on the host key hang up
+				if err := s.serve(conn); err != nil && !errors.Is(err, io.EOF) {
+					t.Logf("test server: %v", err)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// file returns a stored file and whether it exists
+func (s *testServer) file(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+func (s *testServer) serve(conn net.Conn) error {
+	t, err := s.handshake(conn)
+	if err != nil {
+		return err
+	}
+	if err := s.authenticate(t); err != nil {
+		return err
+	}
+	return s.session(t)
+}
+
+// handshake is the server side of the version and key exchange
+func (s *testServer) handshake(conn net.Conn) (*transport, error) {
+	t := &transport{conn: conn, reader: bufio.NewReader(conn), readCipher: plainCipher{}, writeCipher: plainCipher{}}
+	serverVersion := "SSH-2.0-libas_test_server"
+	if _, err := conn.Write([]byte("Test server\r\n" + serverVersion + "\r\n")); err != nil {
+		return nil, err
+	}
+	clientVersion, err := t.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	clientVersion = strings.TrimRight(clientVersion, "\r\n")
+
+	offer := func(configured, all []string) string {
+		if len(configured) == 0 {
+			configured = all
+		}
+		return strings.Join(configured, ",")
+	}
+	var serverInit builder
+	serverInit.byte(msgKexInit)
+	serverInit.buf = append(serverInit.buf, make([]byte, 16)...)
+	rand.Read(serverInit.buf[1:])
+	serverInit.string("curve25519-sha256,ecdh-sha2-nistp256")
+	serverInit.string(offer(s.hostKeyAlgorithms, []string{s.hostKey.algorithm}))
+	serverInit.string(offer(s.ciphers, cipherAlgorithms))
+	serverInit.string(offer(s.ciphers, cipherAlgorithms))
+	serverInit.string("hmac-sha2-256")
+	serverInit.string("hmac-sha2-256")
+	serverInit.string("none")
+	serverInit.string("none")
+	serverInit.string("")
+	serverInit.string("")
+	serverInit.bool(false)
+	serverInit.uint32(0)
+	if err := t.writePacket(serverInit.buf); err != nil {
+		return nil, err
+	}
+	// readPacket refuses KEXINIT, which only starts a key exchange here
+	clientInit, err := t.readCipher.readPacket(t.reader, t.readSeq)
+	t.readSeq++
+	if err != nil {
+		return nil, err
+	}
+	if clientInit[0] != msgKexInit {
+		return nil, fmt.Errorf("expected KEXINIT, got %d", clientInit[0])
+	}
+
+	// The first algorithm of the client the server also has
+	client := reader{data: clientInit[17:]}
+	server := reader{data: serverInit.buf[17:]}
+	chosen := make([]string, 4)
+	for i := range chosen {
+		ours := strings.Split(server.string(), ",")
+		for _, a := range strings.Split(client.string(), ",") {
+			if chosen[i] == "" && strings.Contains(","+strings.Join(ours, ",")+",", ","+a+",") {
+				chosen[i] = a
+			}
+		}
+		if chosen[i] == "" {
+			return nil, fmt.Errorf("no common algorithm in list %d", i)
+		}
+	}
+	kex, hostKeyAlgorithm, cipherName := chosen[0], chosen[1], chosen[2]
+
+	init, err := t.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	r := reader{data: init[1:]}
+	clientPublic := r.bytes()
+	if init[0] != msgKexECDHInit || r.err != nil {
+		return nil, errors.New("malformed KEXECDH_INIT")
+	}
+	var curve ecdh.Curve = ecdh.X25519()
+	if kex == "ecdh-sha2-nistp256" {
+		curve = ecdh.P256()
+	}
+	private, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := curve.NewPublicKey(clientPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	var k builder
+	k.mpint(new(big.Int).SetBytes(secret))
+
+	var exchange builder
+	exchange.string(clientVersion)
+	exchange.string(serverVersion)
+	exchange.bytes(clientInit)
+	exchange.bytes(serverInit.buf)
+	exchange.bytes(s.hostKey.publicKey)
+	exchange.bytes(clientPublic)
+	exchange.bytes(private.PublicKey().Bytes())
+	exchange.buf = append(exchange.buf, k.buf...)
+	h := sha256.Sum256(exchange.buf)
+
+	if hostKeyAlgorithm != s.hostKey.algorithm {
+		return nil, fmt.Errorf("client chose %s for a %s key", hostKeyAlgorithm, s.hostKey.algorithm)
+	}
+	signature, err := s.hostKey.sign(h[:])
+	if err != nil {
+		return nil, err
+	}
+	var sig builder
+	sig.string(s.hostKey.algorithm)
+	sig.bytes(signature)
+	var reply builder
+	reply.byte(msgKexECDHReply)
+	reply.bytes(s.hostKey.publicKey)
+	reply.bytes(private.PublicKey().Bytes())
+	reply.bytes(sig.buf)
+	if err := t.writePacket(reply.buf); err != nil {
+		return nil, err
+	}
+	if err := t.writePacket([]byte{msgNewKeys}); err != nil {
+		return nil, err
+	}
+	newKeys, err := t.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if newKeys[0] != msgNewKeys {
+		return nil, fmt.Errorf("expected NEWKEYS, got %d", newKeys[0])
+	}
+
+	t.sessionID = h[:]
+	derive := func(letter byte, size int) []byte {
+		return deriveKey(k.buf, h[:], t.sessionID, letter, size)
+	}
+	ivSize := aes.BlockSize
+	if strings.HasSuffix(cipherName, "-gcm@openssh.com") {
+		ivSize = 12
+	}
+	if t.readCipher, err = newPacketCipher(cipherName, derive('A', ivSize), derive('C', 32), derive('E', 32)); err != nil {
+		return nil, err
+	}
+	if t.writeCipher, err = newPacketCipher(cipherName, derive('B', ivSize), derive('D', 32), derive('F', 32)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// authenticate accepts the password or the user key
+func (s *testServer) authenticate(t *transport) error {
+	request, err := t.readPacket()
+	if err != nil {
+		return err
+	}
+	r := reader{data: request[1:]}
+	if request[0] != msgServiceRequest || r.string() != "ssh-userauth" {
+		return errors.New("expected a request for ssh-userauth")
+	}
+	var accept builder
+	accept.byte(msgServiceAccept)
+	accept.string("ssh-userauth")
+	if err := t.writePacket(accept.buf); err != nil {
+		return err
+	}
+
+	for {
+		request, err := t.readPacket()
+		if err != nil {
+			return err
+		}
+		r := reader{data: request[1:]}
+		user, service, method := r.string(), r.string(), r.string()
+		ok := false
+		switch method {
+		case "password":
+			r.byte()
+			ok = r.string() == s.password
+		case "publickey":
+			r.byte()
+			algorithm, blob := r.string(), r.bytes()
+			signature := r.bytes()
+			var signed builder
+			signed.bytes(t.sessionID)
+			signed.buf = append(signed.buf, request[:len(request)-len(r.data)-4-len(signature)]...)
+			ok = r.err == nil && bytes.Equal(blob, s.userKey) && verifySignature(blob, algorithm, signed.buf, signature) == nil
+		}
+		if ok && user == s.user && service == "ssh-connection" {
+			return t.writePacket([]byte{msgUserAuthSuccess})
+		}
+		var failure builder
+		failure.byte(msgUserAuthFailure)
+		failure.string("publickey,password")
+		failure.bool(false)
+		if err := t.writePacket(failure.buf); err != nil {
+			return err
+		}
+	}
+}
+
+// session serves one session channel running the sftp subsystem
+func (s *testServer) session(t *transport) error {
+	open, err := t.readPacket()
+	if err != nil {
+		return err
+	}
+	r := reader{data: open[1:]}
+	if open[0] != msgChannelOpen || r.string() != "session" {
+		return errors.New("expected a session to be opened")
+	}
+	clientChannel := r.uint32()
+	var confirm builder
+	confirm.byte(msgChannelOpenConfirm)
+	confirm.uint32(clientChannel)
+	confirm.uint32(0)
+	confirm.uint32(1 << 30)
+	confirm.uint32(32 * 1024)
+	if err := t.writePacket(confirm.buf); err != nil {
+		return err
+	}
+
+	subsystem, err := t.readPacket()
+	if err != nil {
+		return err
+	}
+	r = reader{data: subsystem[1:]}
+	r.uint32()
+	if subsystem[0] != msgChannelRequest || r.string() != "subsystem" || !(r.byte() == 1) || r.string() != "sftp" {
+		return errors.New("expected a request for the sftp subsystem")
+	}
+	var success builder
+	success.byte(msgChannelSuccess)
+	success.uint32(clientChannel)
+	if err := t.writePacket(success.buf); err != nil {
+		return err
+	}
+
+	var pending []byte
+	for {
+		message, err := t.readPacket()
+		if err != nil {
+			return err
+		}
+		switch message[0] {
+		case msgChannelData:
+			r := reader{data: message[1:]}
+			r.uint32()
+			pending = append(pending, r.bytes()...)
+		case msgChannelWindowAdjust:
+			continue
+		case msgChannelEOF, msgChannelClose:
+			return nil
+		default:
+			return fmt.Errorf("unexpected SSH message %d in session", message[0])
+		}
+
+		for len(pending) >= 4 {
+			r := reader{data: pending}
+			length := r.uint32()
+			if uint32(len(r.data)) < length {
+				break
+			}
+			response := s.handleSFTP(r.data[:length])
+			pending = pending[4+length:]
+
+			var packet builder
+			packet.bytes(response)
+			var data builder
+			data.byte(msgChannelData)
+			data.uint32(clientChannel)
+			data.bytes(packet.buf)
+			if err := t.writePacket(data.buf); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleSFTP answers one SFTP request
+func (s *testServer) handleSFTP(request []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := reader{data: request[1:]}
+	if request[0] == fxpInit {
+		var version builder
+		version.byte(fxpVersion)
+		version.uint32(3)
+		if s.posixRename {
+			version.string("posix-rename@openssh.com")
+			version.string("1")
+		}
+		return version.buf
+	}
+
+	id := r.uint32()
+	status := func(code uint32, message string) []byte {
+		var b builder
+		b.byte(fxpStatus)
+		b.uint32(id)
+		b.uint32(code)
+		b.string(message)
+		b.string("")
+		return b.buf
+	}
+	const fxFailure = 4
+	rename := func(from, to string, replace bool) []byte {
+		data, ok := s.files[from]
+		if !ok {
+			return status(fxNoSuchFile, "No such file")
+		}
+		if _, exists := s.files[to]; exists && !replace {
+			return status(fxFailure, "File exists")
+		}
+		delete(s.files, from)
+		s.files[to] = data
+		return status(fxOK, "")
+	}
+
+	switch request[0] {
+	case fxpStat:
+		name := r.string()
+		_, isFile := s.files[name]
+		if !s.dirs[name] && !isFile {
+			return status(fxNoSuchFile, "No such file")
+		}
+		var attrs builder
+		attrs.byte(fxpAttrs)
+		attrs.uint32(id)
+		attrs.uint32(0)
+		return attrs.buf
+	case fxpMkdir:
+		name := r.string()
+		if !s.dirs[path.Dir(name)] {
+			return status(fxNoSuchFile, "No such file")
+		}
+		s.dirs[name] = true
+		return status(fxOK, "")
+	case fxpOpen:
+		name := r.string()
+		if !s.dirs[path.Dir(name)] {
+			return status(fxNoSuchFile, "No such file")
+		}
+		s.files[name] = nil
+		var handle builder
+		handle.byte(fxpHandle)
+		handle.uint32(id)
+		handle.string(name)
+		return handle.buf
+	case fxpWrite:
+		name, offset, data := r.string(), r.uint64(), r.bytes()
+		file := s.files[name]
+		if end := int(offset) + len(data); end > len(file) {
+			file = append(file, make([]byte, end-len(file))...)
+		}
+		copy(file[offset:], data)
+		s.files[name] = file
+		return status(fxOK, "")
+	case fxpClose:
+		return status(fxOK, "")
+	case fxpRemove:
+		name := r.string()
+		if _, ok := s.files[name]; !ok {
+			return status(fxNoSuchFile, "No such file")
+		}
+		delete(s.files, name)
+		return status(fxOK, "")
+	case fxpRename:
+		return rename(r.string(), r.string(), false)
+	case fxpExtended:
+		if r.string() == "posix-rename@openssh.com" && s.posixRename {
+			return rename(r.string(), r.string(), true)
+		}
+	}
+	return status(8, "Operation unsupported")
+}
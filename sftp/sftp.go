@@ -0,0 +1,672 @@
+// Package sftp uploads files over SFTP with a minimal SSH client built on
+// the standard library. It authenticates with a password or an unencrypted
+// private key and checks host keys against known_hosts or a pinned
+// fingerprint.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SFTP packet types, version 3
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpWrite    = 6
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+const (
+	fxfWrite = 0x02
+	fxfCreat = 0x08
+	fxfTrunc = 0x10
+
+	fxOK         = 0
+	fxNoSuchFile = 2
+
+	// Data sent in one SFTP write, the most every server accepts
+	writeChunk = 32 * 1024
+
+	// Bytes the server may send before the window is adjusted
+	windowSize = 1 << 20
+)
+
+// Config describes an SFTP destination
+type Config struct {
+	// Host and port, port 22 when missing
+	Addr string
+
+	User     string
+	Password string
+
+	// Unencrypted private key in OpenSSH or PEM format, tried before the
+	// password
+	KeyFile string
+
+	// OpenSSH known_hosts file the host key must be in, ~/.ssh/known_hosts
+	// when empty
+	KnownHostsFile string
+
+	// SHA256 fingerprint the host key must have instead, as printed by
+	// ssh-keygen -l
+	HostKeyFingerprint string
+
+	// Remote directory files are put under
+	Dir string
+}
+
+// Client puts files on an SFTP server, connecting on first use and again
+// after a failure
+type Client struct {
+	config Config
+	signer *signer
+
+	mu   sync.Mutex
+	conn *conn
+}
+
+// New validates cfg, connecting happens on the first Put
+func New(cfg Config) (*Client, error) {
+	if cfg.Addr == "" || cfg.User == "" {
+		return nil, errors.New("SFTP needs a host and a user")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		cfg.Addr = net.JoinHostPort(strings.Trim(cfg.Addr, "[]"), "22")
+	}
+	if cfg.KeyFile == "" && cfg.Password == "" {
+		return nil, errors.New("SFTP needs a password or a private key")
+	}
+	if cfg.KnownHostsFile == "" && cfg.HostKeyFingerprint == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known hosts: %w", err)
+		}
+		cfg.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	c := &Client{config: cfg}
+	if cfg.KeyFile != "" {
+		signer, err := loadSigner(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.signer = signer
+	}
+	return c, nil
+}
+
+// URL is where a file is stored, for logs and reports
+func (c *Client) URL(name string) string {
+	name = path.Join(c.config.Dir, name)
+	if !path.IsAbs(name) {
+		name = "/~/" + name
+	}
+	return "sftp://" + c.config.User + "@" + c.config.Addr + name
+}
+
+// Put writes body to name under the configured directory, creating parent
+// directories. It is written to a temporary name and renamed, so the file
+// never appears partially written.
+func (c *Client) Put(ctx context.Context, name string, body io.Reader, size int64) error {
+	return c.do(ctx, func(conn *conn) error {
+		return conn.put(path.Join(c.config.Dir, name), body)
+	})
+}
+
+// Delete removes name under the configured directory. A file that does not
+// exist is an error wrapping fs.ErrNotExist.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	name = path.Join(c.config.Dir, name)
+	return c.do(ctx, func(conn *conn) error {
+		return conn.simple(fxpRemove, "remove "+name, func(b *builder) { b.string(name) })
+	})
+}
+
+// do runs op on the connection, connecting first when there is none. The
+// connection is dropped when op fails other than by a status from the
+// server.
+func (c *Client) do(ctx context.Context, op func(conn *conn) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+
+	// Abort a stalled transfer when ctx ends
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.transport.conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	err := op(c.conn)
+	var statusErr *statusError
+	if err != nil && !errors.As(err, &statusErr) {
+		c.conn.close()
+		c.conn = nil
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// Close ends the connection, if any
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.close()
+	c.conn = nil
+	return err
+}
+
+// conn is an SFTP session on an SSH channel
+type conn struct {
+	transport *transport
+
+	localChannel  uint32
+	remoteChannel uint32
+	remoteWindow  uint32
+	remoteMaxData uint32
+	localWindow   uint32
+
+	pending     []byte // Channel data read but not yet consumed
+	nextID      uint32
+	posixRename bool // Server has posix-rename@openssh.com
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", c.config.Addr, err)
+	}
+	netConn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	t, err := handshake(netConn, hostKeyChecker(c.config, c.config.Addr))
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", c.config.Addr, err)
+	}
+	sc := &conn{transport: t}
+	if err := c.authenticate(t); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := sc.openSFTP(); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to start SFTP on %s: %w", c.config.Addr, err)
+	}
+	netConn.SetDeadline(time.Time{})
+	return sc, nil
+}
+
+// authenticate tries the private key and then the password
+func (c *Client) authenticate(t *transport) error {
+	var request builder
+	request.byte(msgServiceRequest)
+	request.string("ssh-userauth")
+	if err := t.writePacket(request.buf); err != nil {
+		return err
+	}
+	reply, err := t.readPacket()
+	if err != nil {
+		return err
+	}
+	if reply[0] != msgServiceAccept {
+		return fmt.Errorf("server refused authentication service (message %d)", reply[0])
+	}
+
+	if c.signer != nil {
+		var signed builder
+		signed.bytes(t.sessionID)
+		signed.byte(msgUserAuthRequest)
+		signed.string(c.config.User)
+		signed.string("ssh-connection")
+		signed.string("publickey")
+		signed.bool(true)
+		signed.string(c.signer.algorithm)
+		signed.bytes(c.signer.publicKey)
+
+		signature, err := c.signer.sign(signed.buf)
+		if err != nil {
+			return fmt.Errorf("failed to sign authentication: %w", err)
+		}
+		var sig builder
+		sig.string(c.signer.algorithm)
+		sig.bytes(signature)
+
+		request := builder{buf: signed.buf[4+len(t.sessionID):]}
+		request.bytes(sig.buf)
+		ok, err := authRequest(t, request.buf)
+		if err != nil || ok {
+			return err
+		}
+	}
+
+	if c.config.Password != "" {
+		var request builder
+		request.byte(msgUserAuthRequest)
+		request.string(c.config.User)
+		request.string("ssh-connection")
+		request.string("password")
+		request.bool(false)
+		request.string(c.config.Password)
+		ok, err := authRequest(t, request.buf)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return fmt.Errorf("SSH authentication as %s failed", c.config.User)
+}
+
+// authRequest sends one authentication attempt, reporting whether it
+// succeeded
+func authRequest(t *transport, request []byte) (bool, error) {
+	if err := t.writePacket(request); err != nil {
+		return false, err
+	}
+	for {
+		reply, err := t.readPacket()
+		if err != nil {
+			return false, err
+		}
+		switch reply[0] {
+		case msgUserAuthSuccess:
+			return true, nil
+		case msgUserAuthFailure:
+			return false, nil
+		case msgUserAuthBanner:
+			continue
+		default:
+			return false, fmt.Errorf("unexpected SSH message %d during authentication", reply[0])
+		}
+	}
+}
+
+// openSFTP opens a session channel running the sftp subsystem
+func (c *conn) openSFTP() error {
+	c.localWindow = windowSize
+	var open builder
+	open.byte(msgChannelOpen)
+	open.string("session")
+	open.uint32(c.localChannel)
+	open.uint32(c.localWindow)
+	open.uint32(maxPacket / 2)
+	if err := c.transport.writePacket(open.buf); err != nil {
+		return err
+	}
+
+	reply, err := c.readChannelMessage()
+	if err != nil {
+		return err
+	}
+	r := reader{data: reply[1:]}
+	switch reply[0] {
+	case msgChannelOpenConfirm:
+		r.uint32()
+		c.remoteChannel = r.uint32()
+		c.remoteWindow = r.uint32()
+		c.remoteMaxData = r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+	case msgChannelOpenFailure:
+		r.uint32()
+		r.uint32()
+		return fmt.Errorf("server refused session: %s", r.string())
+	default:
+		return fmt.Errorf("unexpected SSH message %d opening session", reply[0])
+	}
+
+	var subsystem builder
+	subsystem.byte(msgChannelRequest)
+	subsystem.uint32(c.remoteChannel)
+	subsystem.string("subsystem")
+	subsystem.bool(true)
+	subsystem.string("sftp")
+	if err := c.transport.writePacket(subsystem.buf); err != nil {
+		return err
+	}
+	for {
+		reply, err := c.readChannelMessage()
+		if err != nil {
+			return err
+		}
+		if reply[0] == msgChannelSuccess {
+			break
+		}
+		if reply[0] == msgChannelFailure {
+			return errors.New("server has no sftp subsystem")
+		}
+		if reply[0] != msgChannelWindowAdjust {
+			return fmt.Errorf("unexpected SSH message %d requesting sftp", reply[0])
+		}
+	}
+
+	var init builder
+	init.byte(fxpInit)
+	init.uint32(3)
+	if err := c.send(init.buf); err != nil {
+		return err
+	}
+	version, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if version[0] != fxpVersion {
+		return fmt.Errorf("unexpected SFTP packet %d instead of version", version[0])
+	}
+	r = reader{data: version[1:]}
+	r.uint32()
+	for len(r.data) > 0 && r.err == nil {
+		if name, _ := r.string(), r.string(); name == "posix-rename@openssh.com" {
+			c.posixRename = true
+		}
+	}
+	return nil
+}
+
+// readChannelMessage reads the next connection protocol message, handling
+// window adjustments and refusing global requests
+func (c *conn) readChannelMessage() ([]byte, error) {
+	for {
+		packet, err := c.transport.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		r := reader{data: packet[1:]}
+		switch packet[0] {
+		case msgGlobalRequest:
+			r.string()
+			if r.byte() != 0 {
+				if err := c.transport.writePacket([]byte{msgRequestFailure}); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case msgChannelWindowAdjust:
+			r.uint32()
+			c.remoteWindow += r.uint32()
+		case msgChannelEOF, msgChannelClose:
+			return nil, errors.New("server closed the SFTP channel")
+		case msgChannelRequest:
+			// exit-status and the like, nothing wants a reply
+			continue
+		}
+		return packet, nil
+	}
+}
+
+// send writes an SFTP packet as channel data, within the server's window
+func (c *conn) send(payload []byte) error {
+	var packet builder
+	packet.bytes(payload)
+	data := packet.buf
+
+	for len(data) > 0 {
+		for c.remoteWindow == 0 {
+			message, err := c.readChannelMessage()
+			if err != nil {
+				return err
+			}
+			if message[0] == msgChannelData {
+				if err := c.bufferData(message); err != nil {
+					return err
+				}
+			}
+		}
+		n := min(uint32(len(data)), c.remoteWindow, c.remoteMaxData)
+		var message builder
+		message.byte(msgChannelData)
+		message.uint32(c.remoteChannel)
+		message.bytes(data[:n])
+		if err := c.transport.writePacket(message.buf); err != nil {
+			return err
+		}
+		c.remoteWindow -= n
+		data = data[n:]
+	}
+	return nil
+}
+
+// bufferData keeps the data of a channel message, adjusting our window
+// once half of it is used
+func (c *conn) bufferData(message []byte) error {
+	r := reader{data: message[1:]}
+	r.uint32()
+	data := r.bytes()
+	if r.err != nil {
+		return r.err
+	}
+	c.pending = append(c.pending, data...)
+
+	c.localWindow -= min(c.localWindow, uint32(len(data)))
+	if c.localWindow < windowSize/2 {
+		var adjust builder
+		adjust.byte(msgChannelWindowAdjust)
+		adjust.uint32(c.remoteChannel)
+		adjust.uint32(windowSize - c.localWindow)
+		c.localWindow = windowSize
+		return c.transport.writePacket(adjust.buf)
+	}
+	return nil
+}
+
+// receive reads the next SFTP packet
+func (c *conn) receive() ([]byte, error) {
+	for {
+		if len(c.pending) >= 4 {
+			r := reader{data: c.pending}
+			length := r.uint32()
+			if length == 0 || length > maxPacket {
+				return nil, fmt.Errorf("invalid SFTP packet length %d", length)
+			}
+			if uint32(len(r.data)) >= length {
+				packet := append([]byte(nil), r.data[:length]...)
+				c.pending = c.pending[4+length:]
+				return packet, nil
+			}
+		}
+
+		message, err := c.readChannelMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch message[0] {
+		case msgChannelData:
+			if err := c.bufferData(message); err != nil {
+				return nil, err
+			}
+		case msgChannelExtendedData, msgChannelWindowAdjust:
+		default:
+			return nil, fmt.Errorf("unexpected SSH message %d during SFTP", message[0])
+		}
+	}
+}
+
+// call sends a request with a fresh ID and returns the response
+func (c *conn) call(kind byte, fields func(b *builder)) ([]byte, error) {
+	c.nextID++
+	var request builder
+	request.byte(kind)
+	request.uint32(c.nextID)
+	fields(&request)
+	if err := c.send(request.buf); err != nil {
+		return nil, err
+	}
+
+	response, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 5 {
+		return nil, errors.New("short SFTP response")
+	}
+	r := reader{data: response[1:5]}
+	if id := r.uint32(); id != c.nextID {
+		return nil, fmt.Errorf("SFTP response for request %d, expected %d", id, c.nextID)
+	}
+	return response, nil
+}
+
+// statusError is a failure status from the server
+type statusError struct {
+	code    uint32
+	message string
+}
+
+func (e *statusError) Error() string {
+	if e.message != "" {
+		return e.message
+	}
+	return fmt.Sprintf("SFTP error %d", e.code)
+}
+
+// Is makes a missing file match fs.ErrNotExist
+func (e *statusError) Is(target error) bool {
+	return target == fs.ErrNotExist && e.code == fxNoSuchFile
+}
+
+// status returns the error a status response carries, if any
+func status(response []byte, op string) error {
+	if response[0] != fxpStatus {
+		return fmt.Errorf("%s: unexpected SFTP packet %d", op, response[0])
+	}
+	r := reader{data: response[5:]}
+	code, message := r.uint32(), r.string()
+	if code == fxOK {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", op, &statusError{code: code, message: message})
+}
+
+func (c *conn) simple(kind byte, op string, fields func(b *builder)) error {
+	response, err := c.call(kind, fields)
+	if err != nil {
+		return err
+	}
+	return status(response, op)
+}
+
+// mkdirAll creates dir and its parents that do not exist
+func (c *conn) mkdirAll(dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	response, err := c.call(fxpStat, func(b *builder) { b.string(dir) })
+	if err != nil {
+		return err
+	}
+	if response[0] == fxpAttrs {
+		return nil
+	}
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	return c.simple(fxpMkdir, "mkdir "+dir, func(b *builder) {
+		b.string(dir)
+		b.uint32(0)
+	})
+}
+
+// put writes body to name through a temporary file
+func (c *conn) put(name string, body io.Reader) error {
+	if err := c.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	temp := name + ".part"
+	response, err := c.call(fxpOpen, func(b *builder) {
+		b.string(temp)
+		b.uint32(fxfWrite | fxfCreat | fxfTrunc)
+		b.uint32(0)
+	})
+	if err != nil {
+		return err
+	}
+	if response[0] != fxpHandle {
+		return status(response, "open "+temp)
+	}
+	r := reader{data: response[5:]}
+	handle := r.bytes()
+	if r.err != nil {
+		return r.err
+	}
+
+	buf := make([]byte, writeChunk)
+	var offset uint64
+	for {
+		n, readErr := io.ReadFull(body, buf)
+		if n > 0 {
+			err := c.simple(fxpWrite, "write "+temp, func(b *builder) {
+				b.bytes(handle)
+				b.uint64(offset)
+				b.bytes(buf[:n])
+			})
+			if err != nil {
+				return err
+			}
+			offset += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	if err := c.simple(fxpClose, "close "+temp, func(b *builder) { b.bytes(handle) }); err != nil {
+		return err
+	}
+
+	if c.posixRename {
+		return c.simple(fxpExtended, "rename "+temp, func(b *builder) {
+			b.string("posix-rename@openssh.com")
+			b.string(temp)
+			b.string(name)
+		})
+	}
+	// Plain SFTP rename fails when the target exists
+	c.simple(fxpRemove, "remove "+name, func(b *builder) { b.string(name) })
+	return c.simple(fxpRename, "rename "+temp, func(b *builder) {
+		b.string(temp)
+		b.string(name)
+	})
+}
+
+func (c *conn) close() error {
+	var message builder
+	message.byte(msgChannelClose)
+	message.uint32(c.remoteChannel)
+	c.transport.writePacket(message.buf)
+	return c.transport.conn.Close()
+}
@@ -0,0 +1,349 @@
+package sftp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// publicKey reads the key blob of an OpenSSH .pub file
+func publicKey(t *testing.T, file string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		t.Fatalf("%s is not a public key", file)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+// Fingerprints as ssh-keygen -l -E sha256 prints them
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"host_ed25519.pub", "SHA256:YCv/NkvBjpxl0aIUQPj8Mx5UXXopzTwRV75Rlk5a9Wk"},
+		{"host_ecdsa.pub", "SHA256:JkGwCW2FbdgYGsEGSS/J+BseCsRwaMYs4xwbbkYfgCo"},
+		{"host_rsa.pub", "SHA256:c4VW14SiIf3/Uam1+mubOIuiEwj4KG3ddinASgEXyPQ"},
+		{"user_rsa_pem.pub", "SHA256:7teDOUfawLFESksieORZuN4xM/AKQJlLaGXjF4zMdeg"},
+	}
+	for _, tt := range tests {
+		if got := Fingerprint(publicKey(t, filepath.Join("testdata", tt.file))); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.file, got, tt.want)
+		}
+	}
+}
+
+// Private keys written by ssh-keygen, in its default format and as PEM
+func TestLoadSigner(t *testing.T) {
+	for _, name := range []string{"user_ed25519", "user_ecdsa", "user_rsa_pem", "host_rsa"} {
+		file := filepath.Join("testdata", name)
+		s, err := loadSigner(file)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(s.publicKey, publicKey(t, file+".pub")) {
+			t.Errorf("%s: public key differs from %s.pub", name, name)
+		}
+		data := []byte("session and request")
+		signature, err := s.sign(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sig builder
+		sig.string(s.algorithm)
+		sig.bytes(signature)
+		if err := verifySignature(s.publicKey, s.algorithm, data, sig.buf); err != nil {
+			t.Errorf("%s: signature does not verify: %v", name, err)
+		}
+	}
+}
+
+// testdata/known_hosts was written by ssh-keygen, hashing with -H, and
+// what it lists for each host matches ssh-keygen -F
+func TestKnownHosts(t *testing.T) {
+	file := filepath.Join("testdata", "known_hosts")
+	tests := []struct {
+		addr    string
+		key     string
+		known   bool
+		failure string
+	}{
+		{"nas.local:22", "host_ed25519.pub", true, ""},
+		{"192.168.1.20:22", "host_ed25519.pub", true, ""},
+		{"nas.local:2222", "host_ecdsa.pub", true, ""},
+		{"hashed.local:22", "host_ed25519.pub", true, ""},
+		{"hashed.local:2222", "host_ecdsa.pub", true, ""},
+		{"backup.local:22", "host_ecdsa.pub", true, ""},
+		// Negated in the backup.local entry
+		{"nas.local:22", "host_ecdsa.pub", false, ""},
+		{"unknown.local:22", "host_ed25519.pub", false, ""},
+		{"hashed.local:2200", "host_ecdsa.pub", false, ""},
+		{"changed.local:22", "host_ed25519.pub", false, "does not match"},
+		{"nas.local:22", "host_rsa.pub", false, "revoked"},
+		// Only a @cert-authority entry, certificates are not supported
+		{"signed.local:22", "user_ed25519.pub", false, ""},
+	}
+	for _, tt := range tests {
+		known, err := checkKnownHosts(file, tt.addr, publicKey(t, filepath.Join("testdata", tt.key)))
+		if tt.failure != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.failure) {
+				t.Errorf("%s with %s: got %v, want an error saying %q", tt.addr, tt.key, err, tt.failure)
+			}
+			continue
+		}
+		if err != nil || known != tt.known {
+			t.Errorf("%s with %s: got %v, %v, want %v", tt.addr, tt.key, known, err, tt.known)
+		}
+	}
+}
+
+func TestPutDelete(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostKey     string
+		ciphers     []string
+		posixRename bool
+	}{
+		{"ed25519 aes128-gcm", "host_ed25519", []string{"aes128-gcm@openssh.com"}, true},
+		{"ecdsa aes256-gcm", "host_ecdsa", []string{"aes256-gcm@openssh.com"}, true},
+		{"rsa aes128-ctr", "host_rsa", []string{"aes128-ctr"}, false},
+		{"ed25519 aes256-ctr", "host_ed25519", []string{"aes256-ctr"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startTestServer(t, filepath.Join("testdata", tt.hostKey), func(s *testServer) {
+				s.ciphers = tt.ciphers
+				s.posixRename = tt.posixRename
+				s.dirs["upload"] = true
+			})
+			client, err := New(Config{
+				Addr:               server.addr,
+				User:               "libas",
+				Password:           "secret",
+				HostKeyFingerprint: Fingerprint(publicKey(t, filepath.Join("testdata", tt.hostKey+".pub"))),
+				Dir:                "upload",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			ctx := context.Background()
+
+			// Larger than a channel window, written over and again
+			data := bytes.Repeat([]byte("recording "), 150*1024)
+			for range 2 {
+				if err := client.Put(ctx, "20250102/client/a.wav", bytes.NewReader(data), int64(len(data))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, ok := server.file("upload/20250102/client/a.wav"); !ok || !bytes.Equal(got, data) {
+				t.Fatalf("stored %d bytes, want %d", len(got), len(data))
+			}
+			if _, ok := server.file("upload/20250102/client/a.wav.part"); ok {
+				t.Error("temporary file left behind")
+			}
+
+			if err := client.Delete(ctx, "20250102/client/a.wav"); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := server.file("upload/20250102/client/a.wav"); ok {
+				t.Error("file still stored after Delete")
+			}
+			if err := client.Delete(ctx, "20250102/client/a.wav"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("deleting a missing file: got %v, want fs.ErrNotExist", err)
+			}
+			// The connection survives the failed delete
+			if err := client.Put(ctx, "b.txt", strings.NewReader("text"), 4); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	userKey := publicKey(t, filepath.Join("testdata", "user_ecdsa.pub"))
+	server := startTestServer(t, filepath.Join("testdata", "host_ed25519"), func(s *testServer) {
+		s.userKey = userKey
+	})
+	fingerprint := Fingerprint(publicKey(t, filepath.Join("testdata", "host_ed25519.pub")))
+
+	tests := []struct {
+		name     string
+		password string
+		key      string
+		ok       bool
+	}{
+		{"password", "secret", "", true},
+		{"wrong password", "guess", "", false},
+		{"key", "", "user_ecdsa", true},
+		{"unknown key, then password", "secret", "user_ed25519", true},
+		{"unknown key", "", "user_rsa_pem", false},
+	}
+	for _, tt := range tests {
+		cfg := Config{Addr: server.addr, User: "libas", Password: tt.password, HostKeyFingerprint: fingerprint}
+		if tt.key != "" {
+			cfg.KeyFile = filepath.Join("testdata", tt.key)
+		}
+		client, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Put(context.Background(), "a.txt", strings.NewReader("text"), 4)
+		client.Close()
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && (err == nil || !strings.Contains(err.Error(), "authentication")) {
+			t.Errorf("%s: got %v, want an authentication failure", tt.name, err)
+		}
+	}
+}
+
+func TestHostKeyChecks(t *testing.T) {
+	server := startTestServer(t, filepath.Join("testdata", "host_ed25519"), nil)
+	host, port, _ := net.SplitHostPort(server.addr)
+	hostKey := strings.Join(strings.Fields(readFile(t, filepath.Join("testdata", "host_ed25519.pub")))[:2], " ")
+	otherKey := strings.Join(strings.Fields(readFile(t, filepath.Join("testdata", "user_ed25519.pub")))[:2], " ")
+	entry := "[" + host + "]:" + port
+
+	tests := []struct {
+		name        string
+		knownHosts  string
+		fingerprint string
+		failure     string
+	}{
+		{"known host", entry + " " + hostKey + "\n", "", ""},
+		{"unknown host", "[" + host + "]:1 " + hostKey + "\n", "", "is not in"},
+		{"changed key", entry + " " + otherKey + "\n", "", "does not match"},
+		{"revoked key", "@revoked * " + hostKey + "\n" + entry + " " + hostKey + "\n", "", "revoked"},
+		{"pinned fingerprint", "", Fingerprint(publicKey(t, filepath.Join("testdata", "host_ed25519.pub"))), ""},
+		{"other fingerprint", "", Fingerprint(publicKey(t, filepath.Join("testdata", "user_ed25519.pub"))), "not the configured fingerprint"},
+	}
+	for _, tt := range tests {
+		cfg := Config{Addr: server.addr, User: "libas", Password: "secret", HostKeyFingerprint: tt.fingerprint}
+		if tt.knownHosts != "" {
+			cfg.KnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(cfg.KnownHostsFile, []byte(tt.knownHosts), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		client, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Put(context.Background(), "a.txt", strings.NewReader("text"), 4)
+		client.Close()
+		if tt.failure == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.failure != "" && (err == nil || !strings.Contains(err.Error(), tt.failure)) {
+			t.Errorf("%s: got %v, want an error saying %q", tt.name, err, tt.failure)
+		}
+	}
+}
+
+// TestOpenSSHServer puts and deletes a file on a real server, such as
+// OpenSSH's in a container:
+//
+//	docker run -d -p 2222:22 atmoz/sftp libas:secret:::upload
+//	LIBAS_SFTP_TEST_ADDR=127.0.0.1:2222 LIBAS_SFTP_TEST_PASSWORD=secret \
+//	LIBAS_SFTP_TEST_DIR=upload LIBAS_SFTP_TEST_KNOWN_HOSTS=<(ssh-keyscan -p 2222 127.0.0.1) \
+//	go test ./sftp -run OpenSSH
+//
+// LIBAS_SFTP_TEST_USER defaults to libas, LIBAS_SFTP_TEST_KEY authenticates
+// with a private key instead of the password.
+func TestOpenSSHServer(t *testing.T) {
+	addr := os.Getenv("LIBAS_SFTP_TEST_ADDR")
+	if addr == "" {
+		t.Skip("LIBAS_SFTP_TEST_ADDR is not set")
+	}
+	user := os.Getenv("LIBAS_SFTP_TEST_USER")
+	if user == "" {
+		user = "libas"
+	}
+	client, err := New(Config{
+		Addr:           addr,
+		User:           user,
+		Password:       os.Getenv("LIBAS_SFTP_TEST_PASSWORD"),
+		KeyFile:        os.Getenv("LIBAS_SFTP_TEST_KEY"),
+		KnownHostsFile: os.Getenv("LIBAS_SFTP_TEST_KNOWN_HOSTS"),
+		Dir:            os.Getenv("LIBAS_SFTP_TEST_DIR"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("recording "), 150*1024)
+	for range 2 {
+		if err := client.Put(ctx, "libas-test/a.wav", bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Delete(ctx, "libas-test/a.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(ctx, "libas-test/a.wav"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("deleting a missing file: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func readFile(t *testing.T, file string) string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// A server sending a truncated or empty KEXINIT fails the handshake rather
+// than the client
+func TestMalformedKeyExchange(t *testing.T) {
+	for _, payload := range [][]byte{
+		{},
+		{msgKexInit},
+		append([]byte{msgKexInit}, make([]byte, 15)...),
+		append([]byte{msgKexInit}, make([]byte, 16)...),
+		append(append([]byte{msgKexInit}, make([]byte, 16)...), 0, 0, 1, 0),
+	} {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			reader := bufio.NewReader(server)
+			if _, err := reader.ReadString('\n'); err != nil {
+				return
+			}
+			server.Write([]byte("SSH-2.0-test\r\n"))
+			if _, err := (plainCipher{}).readPacket(reader, 0); err != nil {
+				return
+			}
+			(plainCipher{}).writePacket(server, 0, payload)
+		}()
+
+		_, err := handshake(client, func([]byte) error { return nil })
+		client.Close()
+		if err == nil {
+			t.Errorf("KEXINIT of %d bytes: handshake succeeded", len(payload))
+		}
+	}
+}
@@ -0,0 +1,644 @@
+package sftp
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/bosley/libas/version"
+)
+
+// SSH message numbers
+const (
+	msgDisconnect          = 1
+	msgIgnore              = 2
+	msgUnimplemented       = 3
+	msgDebug               = 4
+	msgServiceRequest      = 5
+	msgServiceAccept       = 6
+	msgExtInfo             = 7
+	msgKexInit             = 20
+	msgNewKeys             = 21
+	msgKexECDHInit         = 30
+	msgKexECDHReply        = 31
+	msgUserAuthRequest     = 50
+	msgUserAuthFailure     = 51
+	msgUserAuthSuccess     = 52
+	msgUserAuthBanner      = 53
+	msgGlobalRequest       = 80
+	msgRequestFailure      = 82
+	msgChannelOpen         = 90
+	msgChannelOpenConfirm  = 91
+	msgChannelOpenFailure  = 92
+	msgChannelWindowAdjust = 93
+	msgChannelData         = 94
+	msgChannelExtendedData = 95
+	msgChannelEOF          = 96
+	msgChannelClose        = 97
+	msgChannelRequest      = 98
+	msgChannelSuccess      = 99
+	msgChannelFailure      = 100
+)
+
+// Algorithms offered, in order of preference. Only what the standard
+// library implements: no chacha20-poly1305 and no rekeying, which servers
+// only start after gigabytes on these ciphers.
+var (
+	kexAlgorithms     = []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"}
+	hostKeyAlgorithms = []string{"ssh-ed25519", "ecdsa-sha2-nistp256", "rsa-sha2-512", "rsa-sha2-256"}
+	cipherAlgorithms  = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr"}
+	macAlgorithms     = []string{"hmac-sha2-256"}
+)
+
+// Largest packet accepted, RFC 4253 requires at least 35000
+const maxPacket = 256 * 1024
+
+// transport is an SSH connection after key exchange, reading and writing
+// whole packets. Reads and writes may happen on different goroutines.
+type transport struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	sessionID []byte
+
+	readCipher  packetCipher
+	writeCipher packetCipher
+	readSeq     uint32
+	writeSeq    uint32
+}
+
+// packetCipher encrypts and decrypts the binary packet protocol
+type packetCipher interface {
+	writePacket(w io.Writer, seq uint32, payload []byte) error
+	readPacket(r io.Reader, seq uint32) ([]byte, error)
+}
+
+func (t *transport) writePacket(payload []byte) error {
+	err := t.writeCipher.writePacket(t.conn, t.writeSeq, payload)
+	t.writeSeq++
+	return err
+}
+
+// readPacket returns the next packet that is not transport chatter
+func (t *transport) readPacket() ([]byte, error) {
+	for {
+		packet, err := t.readCipher.readPacket(t.reader, t.readSeq)
+		t.readSeq++
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) == 0 {
+			return nil, errors.New("empty SSH packet")
+		}
+
+		switch packet[0] {
+		case msgIgnore, msgDebug, msgUnimplemented, msgExtInfo:
+			continue
+		case msgDisconnect:
+			r := reader{data: packet[1:]}
+			r.uint32()
+			return nil, fmt.Errorf("server disconnected: %s", r.string())
+		case msgKexInit:
+			return nil, errors.New("server started a key re-exchange, which is not supported")
+		}
+		return packet, nil
+	}
+}
+
+// handshake exchanges versions and keys over conn, checking the server's
+// host key with verify
+func handshake(conn net.Conn, verify func(key []byte) error) (*transport, error) {
+	t := &transport{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		readCipher:  plainCipher{},
+		writeCipher: plainCipher{},
+	}
+
+	clientVersion := "SSH-2.0-libas_" + strings.ReplaceAll(version.Get().Version, " ", "_")
+	if _, err := conn.Write([]byte(clientVersion + "\r\n")); err != nil {
+		return nil, err
+	}
+	serverVersion, err := t.readVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	clientInit := kexInit()
+	if err := t.writePacket(clientInit); err != nil {
+		return nil, err
+	}
+	serverInit, err := t.readCipher.readPacket(t.reader, t.readSeq)
+	t.readSeq++
+	for err == nil && len(serverInit) > 0 && serverInit[0] != msgKexInit {
+		// Servers may send chatter such as SSH_MSG_IGNORE first
+		serverInit, err = t.readCipher.readPacket(t.reader, t.readSeq)
+		t.readSeq++
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key exchange: %w", err)
+	}
+	algorithms, err := negotiate(serverInit)
+	if err != nil {
+		return nil, err
+	}
+
+	// ECDH with an ephemeral key
+	var curve ecdh.Curve = ecdh.X25519()
+	if algorithms.kex == "ecdh-sha2-nistp256" {
+		curve = ecdh.P256()
+	}
+	private, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var init builder
+	init.byte(msgKexECDHInit)
+	init.bytes(private.PublicKey().Bytes())
+	if err := t.writePacket(init.buf); err != nil {
+		return nil, err
+	}
+
+	reply, err := t.readPacket()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key exchange reply: %w", err)
+	}
+	if reply[0] != msgKexECDHReply {
+		return nil, fmt.Errorf("unexpected SSH message %d during key exchange", reply[0])
+	}
+	r := reader{data: reply[1:]}
+	hostKey, serverPublic, signature := r.bytes(), r.bytes(), r.bytes()
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed key exchange reply: %w", r.err)
+	}
+
+	peer, err := curve.NewPublicKey(serverPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server key exchange value: %w", err)
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %w", err)
+	}
+	var shared builder
+	shared.mpint(new(big.Int).SetBytes(secret))
+
+	var exchange builder
+	exchange.string(clientVersion)
+	exchange.string(serverVersion)
+	exchange.bytes(clientInit)
+	exchange.bytes(serverInit)
+	exchange.bytes(hostKey)
+	exchange.bytes(private.PublicKey().Bytes())
+	exchange.bytes(serverPublic)
+	exchange.buf = append(exchange.buf, shared.buf...)
+	sum := sha256.Sum256(exchange.buf)
+	h := sum[:]
+
+	if err := verifySignature(hostKey, algorithms.hostKey, h, signature); err != nil {
+		return nil, fmt.Errorf("server host key signature is invalid: %w", err)
+	}
+	if err := verify(hostKey); err != nil {
+		return nil, err
+	}
+
+	if err := t.writePacket([]byte{msgNewKeys}); err != nil {
+		return nil, err
+	}
+	newKeys, err := t.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if newKeys[0] != msgNewKeys {
+		return nil, fmt.Errorf("unexpected SSH message %d instead of NEWKEYS", newKeys[0])
+	}
+
+	t.sessionID = h
+	derive := func(letter byte, size int) []byte {
+		return deriveKey(shared.buf, h, t.sessionID, letter, size)
+	}
+	ivSize := aes.BlockSize
+	if strings.HasSuffix(algorithms.cipher, "-gcm@openssh.com") {
+		ivSize = 12
+	}
+	if t.writeCipher, err = newPacketCipher(algorithms.cipher, derive('A', ivSize), derive('C', 32), derive('E', 32)); err != nil {
+		return nil, err
+	}
+	if t.readCipher, err = newPacketCipher(algorithms.cipher, derive('B', ivSize), derive('D', 32), derive('F', 32)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *transport) readVersion() (string, error) {
+	// Servers may send other lines before the version
+	for i := 0; i < 32; i++ {
+		line, err := t.reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("failed to read SSH version: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "SSH-") {
+			if !strings.HasPrefix(line, "SSH-2.0-") && !strings.HasPrefix(line, "SSH-1.99-") {
+				return "", fmt.Errorf("unsupported SSH version %q", line)
+			}
+			return line, nil
+		}
+	}
+	return "", errors.New("server did not send an SSH version")
+}
+
+func kexInit() []byte {
+	var b builder
+	b.byte(msgKexInit)
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	b.buf = append(b.buf, cookie...)
+	b.string(strings.Join(kexAlgorithms, ","))
+	b.string(strings.Join(hostKeyAlgorithms, ","))
+	b.string(strings.Join(cipherAlgorithms, ","))
+	b.string(strings.Join(cipherAlgorithms, ","))
+	b.string(strings.Join(macAlgorithms, ","))
+	b.string(strings.Join(macAlgorithms, ","))
+	b.string("none")
+	b.string("none")
+	b.string("")
+	b.string("")
+	b.byte(0) // No guessed packet follows
+	b.uint32(0)
+	return b.buf
+}
+
+// algorithms negotiated for the connection
+type algorithms struct {
+	kex     string
+	hostKey string
+	cipher  string
+}
+
+// negotiate picks the first of our algorithms the server also offers
+func negotiate(serverInit []byte) (algorithms, error) {
+	// The message number and 16 byte cookie come before the lists
+	if len(serverInit) < 17 {
+		return algorithms{}, fmt.Errorf("malformed key exchange: %w", io.ErrUnexpectedEOF)
+	}
+	r := reader{data: serverInit[17:]}
+	lists := make([][]string, 6)
+	for i := range lists {
+		lists[i] = strings.Split(r.string(), ",")
+	}
+	if r.err != nil {
+		return algorithms{}, fmt.Errorf("malformed key exchange: %w", r.err)
+	}
+
+	pick := func(what string, ours, theirs []string) (string, error) {
+		for _, a := range ours {
+			for _, b := range theirs {
+				if a == b {
+					return a, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no common %s algorithm, server offers %s", what, strings.Join(theirs, ","))
+	}
+
+	var a algorithms
+	var err error
+	if a.kex, err = pick("key exchange", kexAlgorithms, lists[0]); err != nil {
+		return a, err
+	}
+	if a.hostKey, err = pick("host key", hostKeyAlgorithms, lists[1]); err != nil {
+		return a, err
+	}
+	clientCipher, err := pick("cipher", cipherAlgorithms, lists[2])
+	if err != nil {
+		return a, err
+	}
+	serverCipher, err := pick("cipher", cipherAlgorithms, lists[3])
+	if err != nil {
+		return a, err
+	}
+	if clientCipher != serverCipher {
+		return a, fmt.Errorf("server chose different ciphers per direction (%s, %s)", clientCipher, serverCipher)
+	}
+	a.cipher = clientCipher
+	if !strings.HasSuffix(a.cipher, "-gcm@openssh.com") {
+		if _, err := pick("MAC", macAlgorithms, lists[4]); err != nil {
+			return a, err
+		}
+		if _, err := pick("MAC", macAlgorithms, lists[5]); err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// deriveKey computes a key from the shared secret as in RFC 4253 section
+// 7.2, extending it until it is size bytes
+func deriveKey(k, h, sessionID []byte, letter byte, size int) []byte {
+	digest := sha256.New()
+	digest.Write(k)
+	digest.Write(h)
+	digest.Write([]byte{letter})
+	digest.Write(sessionID)
+	key := digest.Sum(nil)
+	for len(key) < size {
+		digest.Reset()
+		digest.Write(k)
+		digest.Write(h)
+		digest.Write(key)
+		key = digest.Sum(key)
+	}
+	return key[:size]
+}
+
+func newPacketCipher(name string, iv, key, macKey []byte) (packetCipher, error) {
+	keySize := 16
+	if strings.HasPrefix(name, "aes256") {
+		keySize = 32
+	}
+	block, err := aes.NewCipher(key[:keySize])
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(name, "-gcm@openssh.com") {
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return &gcmCipher{aead: aead, nonce: iv}, nil
+	}
+
+	return &ctrCipher{
+		stream: cipher.NewCTR(block, iv),
+		mac:    hmac.New(sha256.New, macKey),
+	}, nil
+}
+
+// plainCipher is the unencrypted packet format used before NEWKEYS
+type plainCipher struct{}
+
+func (plainCipher) writePacket(w io.Writer, seq uint32, payload []byte) error {
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+	packet := make([]byte, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+padding))
+	packet[4] = byte(padding)
+	copy(packet[5:], payload)
+	_, err := w.Write(packet)
+	return err
+}
+
+func (plainCipher) readPacket(r io.Reader, seq uint32) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxPacket || length < 5 {
+		return nil, fmt.Errorf("invalid SSH packet length %d", length)
+	}
+	rest := make([]byte, length-1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	padding := int(header[4])
+	if padding >= len(rest) {
+		return nil, errors.New("invalid SSH packet padding")
+	}
+	return rest[:len(rest)-padding], nil
+}
+
+// gcmCipher implements aes-gcm@openssh.com (RFC 5647), where the length is
+// authenticated but not encrypted
+type gcmCipher struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func (c *gcmCipher) next() {
+	counter := binary.BigEndian.Uint64(c.nonce[4:])
+	binary.BigEndian.PutUint64(c.nonce[4:], counter+1)
+}
+
+func (c *gcmCipher) writePacket(w io.Writer, seq uint32, payload []byte) error {
+	padding := 16 - (1+len(payload))%16
+	if padding < 4 {
+		padding += 16
+	}
+	plain := make([]byte, 1+len(payload)+padding)
+	plain[0] = byte(padding)
+	copy(plain[1:], payload)
+	rand.Read(plain[1+len(payload):])
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(plain)))
+	packet := c.aead.Seal(length, c.nonce, plain, length)
+	c.next()
+	_, err := w.Write(packet)
+	return err
+}
+
+func (c *gcmCipher) readPacket(r io.Reader, seq uint32) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length)
+	if size > maxPacket || size < 16 || size%16 != 0 {
+		return nil, fmt.Errorf("invalid SSH packet length %d", size)
+	}
+	sealed := make([]byte, int(size)+c.aead.Overhead())
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	plain, err := c.aead.Open(sealed[:0], c.nonce, sealed, length)
+	if err != nil {
+		return nil, errors.New("SSH packet failed authentication")
+	}
+	c.next()
+
+	padding := int(plain[0])
+	if padding >= len(plain) {
+		return nil, errors.New("invalid SSH packet padding")
+	}
+	return plain[1 : len(plain)-padding], nil
+}
+
+// ctrCipher implements aes-ctr with hmac-sha2-256 over the sequence number
+// and plaintext packet
+type ctrCipher struct {
+	stream cipher.Stream
+	mac    hash.Hash
+}
+
+func (c *ctrCipher) sum(seq uint32, packet []byte) []byte {
+	c.mac.Reset()
+	var seqBytes [4]byte
+	binary.BigEndian.PutUint32(seqBytes[:], seq)
+	c.mac.Write(seqBytes[:])
+	c.mac.Write(packet)
+	return c.mac.Sum(nil)
+}
+
+func (c *ctrCipher) writePacket(w io.Writer, seq uint32, payload []byte) error {
+	padding := 16 - (5+len(payload))%16
+	if padding < 4 {
+		padding += 16
+	}
+	packet := make([]byte, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+padding))
+	packet[4] = byte(padding)
+	copy(packet[5:], payload)
+	rand.Read(packet[5+len(payload):])
+
+	mac := c.sum(seq, packet)
+	c.stream.XORKeyStream(packet, packet)
+	_, err := w.Write(append(packet, mac...))
+	return err
+}
+
+func (c *ctrCipher) readPacket(r io.Reader, seq uint32) ([]byte, error) {
+	first := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, err
+	}
+	c.stream.XORKeyStream(first, first)
+	length := binary.BigEndian.Uint32(first)
+	if length > maxPacket || length < 12 || (length+4)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid SSH packet length %d", length)
+	}
+
+	packet := make([]byte, 4+int(length))
+	copy(packet, first)
+	rest := packet[aes.BlockSize:]
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	c.stream.XORKeyStream(rest, rest)
+
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, mac); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(mac, c.sum(seq, packet)) != 1 {
+		return nil, errors.New("SSH packet failed authentication")
+	}
+
+	padding := int(packet[4])
+	if 5+padding > len(packet) {
+		return nil, errors.New("invalid SSH packet padding")
+	}
+	return packet[5 : len(packet)-padding], nil
+}
+
+// builder encodes SSH wire data types
+type builder struct {
+	buf []byte
+}
+
+func (b *builder) byte(v byte) {
+	b.buf = append(b.buf, v)
+}
+
+func (b *builder) bool(v bool) {
+	if v {
+		b.byte(1)
+	} else {
+		b.byte(0)
+	}
+}
+
+func (b *builder) uint32(v uint32) {
+	b.buf = binary.BigEndian.AppendUint32(b.buf, v)
+}
+
+func (b *builder) uint64(v uint64) {
+	b.buf = binary.BigEndian.AppendUint64(b.buf, v)
+}
+
+func (b *builder) bytes(v []byte) {
+	b.uint32(uint32(len(v)))
+	b.buf = append(b.buf, v...)
+}
+
+func (b *builder) string(v string) {
+	b.bytes([]byte(v))
+}
+
+// mpint encodes a non-negative integer in two's complement, with a
+// leading zero when the top bit is set
+func (b *builder) mpint(v *big.Int) {
+	value := v.Bytes()
+	if len(value) > 0 && value[0]&0x80 != 0 {
+		value = append([]byte{0}, value...)
+	}
+	b.bytes(value)
+}
+
+// reader decodes SSH wire data types, remembering the first error
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *reader) bytes() []byte {
+	return r.take(int(r.uint32()))
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func (r *reader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.bytes())
+}
@@ -0,0 +1,169 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Time allowed for the response to a BYE
+const byeTimeout = 4 * time.Second
+
+// call is an answered call leg
+type call struct {
+	bridge *Bridge
+	info   Call
+	leg    Leg
+	rtp    *net.UDPConn
+	remote *net.UDPAddr
+
+	// CSeq of the INVITE, whose retransmissions get the 200 OK again
+	cseq int
+	ok   *message
+
+	// Where requests within the call go
+	target string
+	routes []string
+
+	acked   chan struct{}
+	ackOnce sync.Once
+
+	// Closed when the caller hung up
+	done    chan struct{}
+	endOnce sync.Once
+}
+
+// ack notes the ACK of the 200 OK
+func (c *call) ack() {
+	c.ackOnce.Do(func() { close(c.acked) })
+}
+
+// end ends the call as the caller hung up
+func (c *call) end() {
+	c.endOnce.Do(func() { close(c.done) })
+}
+
+// reinvite answers an INVITE within the call, a retransmission of the
+// first or a re-INVITE putting the call on hold or changing the codec,
+// with the same stream
+func (c *call) reinvite(m *message) {
+	if cseq, _ := m.cseq(); cseq == c.cseq {
+		c.bridge.send(c.ok, c.remote)
+		return
+	}
+	ok := m.response(200, "OK")
+	ok.setTag(param(c.ok.get("To"), "tag"))
+	for _, name := range []string{"Contact", "Allow", "Content-Type"} {
+		ok.add(name, c.ok.get(name))
+	}
+	ok.body = c.ok.body
+	c.bridge.send(ok, c.remote)
+}
+
+// run hands the audio of the call to its leg until the caller hangs up,
+// the audio stops for the media timeout or ctx ends, retransmitting the
+// 200 OK until it is acknowledged
+func (c *call) run(ctx context.Context) {
+	b := c.bridge
+	reason := "caller hung up"
+	defer func() {
+		c.rtp.Close()
+		c.leg.Close()
+		b.mu.Lock()
+		delete(b.calls, c.info.ID)
+		b.mu.Unlock()
+		slog.Info("SIP call ended", "callID", c.info.ID, "from", c.info.From, "reason", reason)
+		b.running.Done()
+	}()
+
+	var stream rtpStream
+	buf := make([]byte, 2048)
+	answered := time.Now()
+	lastAudio := answered
+	interval := timerT1
+	retransmit := answered.Add(interval)
+	for {
+		// A caller that hung up gets no BYE, even when shutdown began too
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			reason = "shutting down"
+			c.bye()
+			return
+		default:
+		}
+
+		now := time.Now()
+		select {
+		case <-c.acked:
+		default:
+			if now.Sub(answered) > transactionTimeout {
+				reason = "answer not acknowledged"
+				c.bye()
+				return
+			}
+			if now.After(retransmit) {
+				b.send(c.ok, c.remote)
+				interval = min(2*interval, timerT2)
+				retransmit = now.Add(interval)
+			}
+		}
+		if now.Sub(lastAudio) > b.config.MediaTimeout {
+			reason = "no audio"
+			c.bye()
+			return
+		}
+
+		c.rtp.SetReadDeadline(now.Add(100 * time.Millisecond))
+		n, _, err := c.rtp.ReadFromUDP(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to read call audio", "error", err, "callID", c.info.ID)
+			reason = "audio failed"
+			c.bye()
+			return
+		}
+		packet, err := parseRTP(buf[:n])
+		if err != nil {
+			continue
+		}
+		if samples := stream.decode(packet); len(samples) > 0 {
+			lastAudio = now
+			c.leg.Write(samples)
+		}
+	}
+}
+
+// bye hangs up the call
+func (c *call) bye() {
+	via, _ := c.bridge.via(c.remote)
+	m := &message{method: "BYE", uri: c.target}
+	m.add("Via", via)
+	m.add("Max-Forwards", "70")
+	for _, route := range c.routes {
+		m.add("Route", route)
+	}
+	// The dialog as seen from the bridge, the caller's From is its To
+	m.add("From", c.ok.get("To"))
+	m.add("To", c.ok.get("From"))
+	m.add("Call-ID", c.info.ID)
+	m.add("CSeq", "1 BYE")
+
+	ctx, cancel := context.WithTimeout(context.Background(), byeTimeout)
+	defer cancel()
+	if response, err := c.bridge.request(ctx, m, c.remote); err != nil {
+		slog.Warn("Failed to hang up SIP call", "error", err, "callID", c.info.ID)
+	} else if response.status >= 300 {
+		slog.Debug("SIP call hangup refused", "status", response.status, "callID", c.info.ID)
+	}
+}
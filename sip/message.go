@@ -0,0 +1,273 @@
+package sip
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Cookie every branch of RFC 3261 starts with
+const branchCookie = "z9hG4bK"
+
+// Full names of the headers with a compact form
+var compactHeaders = map[string]string{
+	"i": "Call-ID",
+	"f": "From",
+	"t": "To",
+	"v": "Via",
+	"m": "Contact",
+	"l": "Content-Length",
+	"c": "Content-Type",
+	"k": "Supported",
+}
+
+// header is a header line of a message
+type header struct {
+	name  string
+	value string
+}
+
+// message is a SIP request or response
+type message struct {
+	// Request line, empty for responses
+	method string
+	uri    string
+
+	// Status line, zero for requests
+	status int
+	reason string
+
+	headers []header
+	body    []byte
+}
+
+// parseMessage reads a message from a datagram
+func parseMessage(data []byte) (*message, error) {
+	head, body, ok := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, fmt.Errorf("message has no end of headers")
+	}
+	lines := strings.Split(string(head), "\r\n")
+	m := &message{}
+	first := strings.SplitN(lines[0], " ", 3)
+	if len(first) != 3 {
+		return nil, fmt.Errorf("invalid start line %q", lines[0])
+	}
+	if first[0] == "SIP/2.0" {
+		status, err := strconv.Atoi(first[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid status line %q", lines[0])
+		}
+		m.status, m.reason = status, first[2]
+	} else if first[2] == "SIP/2.0" {
+		m.method, m.uri = first[0], first[1]
+	} else {
+		return nil, fmt.Errorf("invalid start line %q", lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		// Folded continuation of the previous header
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(m.headers) > 0 {
+			m.headers[len(m.headers)-1].value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if full, ok := compactHeaders[strings.ToLower(name)]; ok {
+			name = full
+		}
+		m.headers = append(m.headers, header{name: name, value: strings.TrimSpace(value)})
+	}
+
+	if length := m.get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > len(body) {
+			return nil, fmt.Errorf("invalid Content-Length %q", length)
+		}
+		body = body[:n]
+	}
+	m.body = body
+	return m, nil
+}
+
+// get returns the first value of a header, empty when missing
+func (m *message) get(name string) string {
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+	return ""
+}
+
+// all returns every value of a header, splitting comma separated values of
+// Via and Record-Route
+func (m *message) all(name string) []string {
+	var values []string
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, name) {
+			values = append(values, splitHeader(h.value)...)
+		}
+	}
+	return values
+}
+
+// add appends a header
+func (m *message) add(name, value string) {
+	m.headers = append(m.headers, header{name: name, value: value})
+}
+
+// cseq returns the number and method of the CSeq header
+func (m *message) cseq() (int, string) {
+	number, method, _ := strings.Cut(m.get("CSeq"), " ")
+	n, _ := strconv.Atoi(number)
+	return n, strings.TrimSpace(method)
+}
+
+// bytes encodes the message, setting Content-Length and User-Agent
+func (m *message) bytes() []byte {
+	var b bytes.Buffer
+	if m.status != 0 {
+		fmt.Fprintf(&b, "SIP/2.0 %d %s\r\n", m.status, m.reason)
+	} else {
+		fmt.Fprintf(&b, "%s %s SIP/2.0\r\n", m.method, m.uri)
+	}
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, "Content-Length") || strings.EqualFold(h.name, "User-Agent") {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", h.name, h.value)
+	}
+	fmt.Fprintf(&b, "User-Agent: libas\r\nContent-Length: %d\r\n\r\n", len(m.body))
+	b.Write(m.body)
+	return b.Bytes()
+}
+
+// response creates a response to a request, copying the headers that
+// identify the transaction
+func (m *message) response(status int, reason string) *message {
+	r := &message{status: status, reason: reason}
+	for _, h := range m.headers {
+		switch strings.ToLower(h.name) {
+		case "via", "from", "to", "call-id", "cseq", "record-route":
+			r.headers = append(r.headers, h)
+		}
+	}
+	return r
+}
+
+// setTag adds a tag to the To header of a response unless it has one
+func (m *message) setTag(tag string) {
+	for i, h := range m.headers {
+		if strings.EqualFold(h.name, "To") {
+			if param(h.value, "tag") == "" {
+				m.headers[i].value += ";tag=" + tag
+			}
+			return
+		}
+	}
+}
+
+// splitHeader splits a header value at the commas outside of quotes and
+// angle brackets
+func splitHeader(value string) []string {
+	var parts []string
+	quoted, bracketed := false, false
+	start := 0
+	for i, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '<' && !quoted:
+			bracketed = true
+		case r == '>' && !quoted:
+			bracketed = false
+		case r == ',' && !quoted && !bracketed:
+			parts = append(parts, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(value[start:]))
+}
+
+// param returns a parameter of a header value such as the tag of From,
+// skipping the URI in angle brackets
+func param(value, name string) string {
+	if _, rest, ok := strings.Cut(value, ">"); ok {
+		value = rest
+	} else if _, rest, ok := strings.Cut(value, ";"); ok {
+		value = ";" + rest
+	}
+	for _, p := range strings.Split(value, ";") {
+		key, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(key, name) {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
+
+// addressURI returns the URI of a From, To or Contact value, e.g.
+// sip:alice@example.com from "Alice" <sip:alice@example.com>;tag=1
+func addressURI(value string) string {
+	if _, rest, ok := strings.Cut(value, "<"); ok {
+		uri, _, _ := strings.Cut(rest, ">")
+		return uri
+	}
+	uri, _, _ := strings.Cut(value, ";")
+	return strings.TrimSpace(uri)
+}
+
+// uriUser returns user@host of a SIP URI, dropping the scheme, port and
+// parameters
+func uriUser(uri string) string {
+	_, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		rest = uri
+	}
+	rest, _, _ = strings.Cut(rest, ";")
+	rest, _, _ = strings.Cut(rest, "?")
+	user, host, ok := strings.Cut(rest, "@")
+	if !ok {
+		host, user = user, ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if user == "" {
+		return host
+	}
+	return user + "@" + host
+}
+
+// uriAddr returns the host and port a SIP URI is reached at, 5060 when it
+// has none
+func uriAddr(uri string) string {
+	_, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		rest = uri
+	}
+	rest, _, _ = strings.Cut(rest, ";")
+	rest, _, _ = strings.Cut(rest, "?")
+	if _, host, ok := strings.Cut(rest, "@"); ok {
+		rest = host
+	}
+	if _, _, err := net.SplitHostPort(rest); err == nil {
+		return rest
+	}
+	return net.JoinHostPort(strings.Trim(rest, "[]"), "5060")
+}
+
+// randomToken returns a random hex string for tags, branches and Call-IDs
+func randomToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
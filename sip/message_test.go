@@ -0,0 +1,198 @@
+package sip
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// crlf turns the lines of a message written with \n into a datagram
+func crlf(s string) []byte {
+	return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+}
+
+func TestParseMessage(t *testing.T) {
+	invite := crlf(`INVITE sip:libas@192.0.2.10 SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK776asdhds
+v: SIP/2.0/UDP 192.0.2.2;branch=z9hG4bKnashds8
+Max-Forwards: 70
+f: "Alice" <sip:+4930123456@pbx.example.com>;tag=1928301774
+To: <sip:libas@192.0.2.10>
+i: a84b4c76e66710@pbx.example.com
+CSeq: 314159 INVITE
+Contact: <sip:alice@192.0.2.1:5060>
+Subject: a folded
+ header
+Record-Route: <sip:p1.example.com;lr>, <sip:p2.example.com;lr>
+c: application/sdp
+l: 13
+
+v=0
+s=call
+trailing bytes past the length
+`)
+	m, err := parseMessage(invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.method != "INVITE" || m.uri != "sip:libas@192.0.2.10" || m.status != 0 {
+		t.Errorf("got request line %q %q, status %d", m.method, m.uri, m.status)
+	}
+	if got := m.get("call-id"); got != "a84b4c76e66710@pbx.example.com" {
+		t.Errorf("compact Call-ID is %q", got)
+	}
+	if got := m.all("Via"); len(got) != 2 || param(got[1], "branch") != "z9hG4bKnashds8" {
+		t.Errorf("got Via %q", got)
+	}
+	if got := m.all("Record-Route"); !slices.Equal(got, []string{"<sip:p1.example.com;lr>", "<sip:p2.example.com;lr>"}) {
+		t.Errorf("got Record-Route %q", got)
+	}
+	if got := m.get("Subject"); got != "a folded header" {
+		t.Errorf("folded header is %q", got)
+	}
+	if n, method := m.cseq(); n != 314159 || method != "INVITE" {
+		t.Errorf("got CSeq %d %s", n, method)
+	}
+	if string(m.body) != "v=0\r\ns=call\r\n" {
+		t.Errorf("got body %q, want the Content-Length bytes", m.body)
+	}
+	if got := param(m.get("From"), "tag"); got != "1928301774" {
+		t.Errorf("From tag is %q", got)
+	}
+	if got := addressURI(m.get("From")); got != "sip:+4930123456@pbx.example.com" {
+		t.Errorf("From URI is %q", got)
+	}
+	if got := (Call{From: addressURI(m.get("From"))}).Caller(); got != "+4930123456@pbx.example.com" {
+		t.Errorf("caller is %q", got)
+	}
+
+	response, err := parseMessage(crlf("SIP/2.0 180 Ringing\nVia: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1\nContent-Length: 0\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.status != 180 || response.reason != "Ringing" || response.method != "" {
+		t.Errorf("got status %d %q", response.status, response.reason)
+	}
+}
+
+func TestParseMalformedMessage(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"\n\n",
+		"INVITE sip:libas@192.0.2.10 SIP/2.0\nVia: SIP/2.0/UDP 192.0.2.1\n",
+		"INVITE sip:libas@192.0.2.10\n\n",
+		"INVITE sip:libas@192.0.2.10 HTTP/1.1\n\n",
+		"SIP/2.0 abc OK\n\n",
+		"GET / HTTP/1.1\nHost: example.com\n\n",
+		"INVITE sip:libas@192.0.2.10 SIP/2.0\nContent-Length: 100\n\nshort",
+		"INVITE sip:libas@192.0.2.10 SIP/2.0\nContent-Length: -1\n\n",
+		"INVITE sip:libas@192.0.2.10 SIP/2.0\nContent-Length: many\n\n",
+	} {
+		if m, err := parseMessage(crlf(data)); err == nil {
+			t.Errorf("parsed %q as %+v", data, m)
+		}
+	}
+}
+
+// Responses copy the headers of the transaction and encode with a
+// Content-Length of their body
+func TestResponse(t *testing.T) {
+	request, err := parseMessage(crlf(`BYE sip:libas@192.0.2.10 SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK2
+From: <sip:alice@pbx.example.com>;tag=a
+To: <sip:libas@192.0.2.10>
+Call-ID: c1
+CSeq: 2 BYE
+Contact: <sip:alice@192.0.2.1>
+
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := request.response(200, "OK")
+	response.setTag("b")
+	response.body = []byte("hi")
+
+	parsed, err := parseMessage(response.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Via", "From", "Call-ID", "CSeq"} {
+		if parsed.get(name) != request.get(name) {
+			t.Errorf("%s is %q, want %q", name, parsed.get(name), request.get(name))
+		}
+	}
+	if param(parsed.get("To"), "tag") != "b" {
+		t.Errorf("To is %q, want the tag added", parsed.get("To"))
+	}
+	if parsed.get("Contact") != "" {
+		t.Error("response copied the Contact of the request")
+	}
+	if parsed.get("Content-Length") != "2" || string(parsed.body) != "hi" {
+		t.Errorf("got Content-Length %q and body %q", parsed.get("Content-Length"), parsed.body)
+	}
+}
+
+func TestParseSDP(t *testing.T) {
+	tests := []struct {
+		body string
+		want []int
+	}{
+		{"v=0\nm=audio 4000 RTP/AVP 8 0 101\na=rtpmap:101 telephone-event/8000\n", []int{payloadPCMA, payloadPCMU}},
+		{"v=0\nm=video 5000 RTP/AVP 0\nm=audio 4000 RTP/AVP 9 0\n", []int{payloadPCMU}},
+		{"v=0\nm=audio 4000 RTP/AVP 9 18\n", nil},
+		{"m=audio", nil},
+	}
+	for _, tt := range tests {
+		if got := parseSDP(crlf(tt.body)).payloadTypes; !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got payload types %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestParseRTP(t *testing.T) {
+	packet := []byte{0x80, payloadPCMU, 0, 7, 0, 0, 0, 160, 0, 0, 0, 1, 0xFF, 0x7F}
+	p, err := parseRTP(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.payloadType != payloadPCMU || p.sequence != 7 || p.timestamp != 160 || p.ssrc != 1 || len(p.payload) != 2 {
+		t.Errorf("got %+v", p)
+	}
+
+	for _, data := range [][]byte{
+		packet[:11],
+		append([]byte{0x40}, packet[1:]...),               // version 1
+		append([]byte{0x8F}, packet[1:12]...),             // 15 CSRCs missing
+		append([]byte{0x90}, packet[1:12]...),             // extension missing
+		append([]byte{0xA0}, append(packet[1:12], 50)...), // padding past the packet
+	} {
+		if _, err := parseRTP(data); err == nil {
+			t.Errorf("parsed % x", data)
+		}
+	}
+}
+
+func TestRTPStream(t *testing.T) {
+	var s rtpStream
+	packet := func(sequence uint16, timestamp uint32, n int) rtpPacket {
+		return rtpPacket{payloadType: payloadPCMU, sequence: sequence, timestamp: timestamp, ssrc: 1, payload: make([]byte, n)}
+	}
+	if got := len(s.decode(packet(1, 0, 160))); got != 160 {
+		t.Errorf("first packet decoded to %d samples", got)
+	}
+	// Packet 2 was lost, its samples are filled with silence
+	if got := len(s.decode(packet(3, 320, 160))); got != 320 {
+		t.Errorf("packet after a loss decoded to %d samples, want 320", got)
+	}
+	if got := s.decode(packet(2, 160, 160)); got != nil {
+		t.Errorf("late packet decoded to %d samples", len(got))
+	}
+	// A long gap is hold, skipped rather than filled
+	if got := len(s.decode(packet(4, 480+10*SampleRate, 160))); got != 160 {
+		t.Errorf("packet after hold decoded to %d samples, want 160", got)
+	}
+	if got := s.decode(rtpPacket{payloadType: 101, sequence: 5, ssrc: 1, payload: make([]byte, 4)}); got != nil {
+		t.Error("decoded a DTMF event")
+	}
+}
@@ -0,0 +1,180 @@
+package sip
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Registration length when Config leaves Expiry zero
+	defaultRegisterExpiry = 5 * time.Minute
+
+	// Wait before registering again after a failure
+	registerRetry = 30 * time.Second
+
+	// Time allowed for unregistering on shutdown
+	unregisterTimeout = 5 * time.Second
+)
+
+// registration is the state kept across the REGISTER requests of a bridge
+type registration struct {
+	callID string
+	tag    string
+	cseq   int
+}
+
+// register keeps the bridge registered until ctx ends, then unregisters
+func (b *Bridge) register(ctx context.Context) {
+	r := &registration{callID: randomToken(), tag: randomToken()}
+	registered := false
+	for {
+		expires, err := b.registerOnce(ctx, r, b.config.Expiry)
+		wait := registerRetry
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			slog.Warn("Failed to register with SIP registrar", "error", err, "registrar", b.config.Registrar)
+			registered = false
+		default:
+			if !registered {
+				slog.Info("Registered with SIP registrar", "registrar", b.config.Registrar, "user", b.config.User, "expires", expires)
+			}
+			registered = true
+			// Renewed well before it lapses
+			wait = expires * 3 / 4
+		}
+		select {
+		case <-ctx.Done():
+			if registered {
+				ctx, cancel := context.WithTimeout(context.Background(), unregisterTimeout)
+				if _, err := b.registerOnce(ctx, r, 0); err != nil {
+					slog.Warn("Failed to unregister from SIP registrar", "error", err, "registrar", b.config.Registrar)
+				}
+				cancel()
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// registerOnce sends a REGISTER, answering a digest challenge, and returns
+// how long the registrar keeps it. An expiry of zero unregisters.
+func (b *Bridge) registerOnce(ctx context.Context, r *registration, expiry time.Duration) (time.Duration, error) {
+	addr, err := net.ResolveUDPAddr("udp", uriAddr(b.config.Registrar))
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve registrar: %w", err)
+	}
+	registrarHost := uriUser(b.config.Registrar)
+	if _, host, ok := strings.Cut(registrarHost, "@"); ok {
+		registrarHost = host
+	}
+	aor := fmt.Sprintf("sip:%s@%s", b.config.User, registrarHost)
+	contact := fmt.Sprintf("<sip:%s@%s>", b.config.User, net.JoinHostPort(b.host(addr), strconv.Itoa(b.port())))
+	seconds := strconv.Itoa(int(expiry / time.Second))
+
+	var authorization header
+	for attempt := 0; attempt < 2; attempt++ {
+		r.cseq++
+		via, _ := b.via(addr)
+		m := &message{method: "REGISTER", uri: b.config.Registrar}
+		m.add("Via", via)
+		m.add("Max-Forwards", "70")
+		m.add("From", fmt.Sprintf("<%s>;tag=%s", aor, r.tag))
+		m.add("To", fmt.Sprintf("<%s>", aor))
+		m.add("Call-ID", r.callID)
+		m.add("CSeq", fmt.Sprintf("%d REGISTER", r.cseq))
+		m.add("Contact", contact)
+		m.add("Expires", seconds)
+		if authorization.name != "" {
+			m.headers = append(m.headers, authorization)
+		}
+
+		response, err := b.request(ctx, m, addr)
+		if err != nil {
+			return 0, err
+		}
+		switch response.status {
+		case 200:
+			return registeredFor(response, expiry), nil
+		case 401, 407:
+			if authorization.name != "" {
+				return 0, fmt.Errorf("registrar refused the credentials of %s", b.config.User)
+			}
+			challenge, name := response.get("WWW-Authenticate"), "Authorization"
+			if response.status == 407 {
+				challenge, name = response.get("Proxy-Authenticate"), "Proxy-Authorization"
+			}
+			value, err := digestAuthorization(challenge, "REGISTER", b.config.Registrar, b.config.User, b.config.Password)
+			if err != nil {
+				return 0, err
+			}
+			authorization = header{name: name, value: value}
+		default:
+			return 0, fmt.Errorf("registrar answered %d %s", response.status, response.reason)
+		}
+	}
+	return 0, fmt.Errorf("registrar refused the credentials of %s", b.config.User)
+}
+
+// registeredFor returns how long a successful registration lasts, from
+// the expires parameter of the contact or the Expires header
+func registeredFor(response *message, requested time.Duration) time.Duration {
+	seconds := param(response.get("Contact"), "expires")
+	if seconds == "" {
+		seconds = response.get("Expires")
+	}
+	if n, err := strconv.Atoi(seconds); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return requested
+}
+
+// digestAuthorization answers an HTTP digest challenge of RFC 2617 with
+// MD5, the only algorithm registrars commonly use
+func digestAuthorization(challenge, method, uri, user, password string) (string, error) {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", fmt.Errorf("unsupported authentication scheme %q", scheme)
+	}
+	params := make(map[string]string)
+	for _, part := range splitHeader(rest) {
+		key, value, _ := strings.Cut(part, "=")
+		params[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+
+	hash := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	realm, nonce := params["realm"], params["nonce"]
+	ha1 := hash(user + ":" + realm + ":" + password)
+	ha2 := hash(method + ":" + uri)
+
+	value := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5`, user, realm, nonce, uri)
+	qopAuth := false
+	for _, qop := range strings.Split(params["qop"], ",") {
+		qopAuth = qopAuth || strings.TrimSpace(qop) == "auth"
+	}
+	if qopAuth {
+		cnonce := randomToken()
+		response := hash(ha1 + ":" + nonce + ":00000001:" + cnonce + ":auth:" + ha2)
+		value += fmt.Sprintf(`, response="%s", qop=auth, nc=00000001, cnonce="%s"`, response, cnonce)
+	} else {
+		value += fmt.Sprintf(`, response="%s"`, hash(ha1+":"+nonce+":"+ha2))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		value += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return value, nil
+}
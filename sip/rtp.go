@@ -0,0 +1,174 @@
+package sip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RTP payload types of G.711, the codecs the bridge accepts
+const (
+	payloadPCMU = 0
+	payloadPCMA = 8
+)
+
+// Largest gap in a stream filled with silence, longer gaps are hold or
+// silence suppression and are skipped, 2 seconds at 8 kHz
+const maxGapSamples = 2 * SampleRate
+
+// rtpPacket is the part of an RTP packet the bridge uses
+type rtpPacket struct {
+	payloadType byte
+	sequence    uint16
+	timestamp   uint32
+	ssrc        uint32
+	payload     []byte
+}
+
+// parseRTP reads an RTP packet, skipping CSRCs, the header extension and
+// padding
+func parseRTP(data []byte) (rtpPacket, error) {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return rtpPacket{}, fmt.Errorf("not an RTP packet")
+	}
+	p := rtpPacket{
+		payloadType: data[1] & 0x7F,
+		sequence:    binary.BigEndian.Uint16(data[2:4]),
+		timestamp:   binary.BigEndian.Uint32(data[4:8]),
+		ssrc:        binary.BigEndian.Uint32(data[8:12]),
+	}
+	offset := 12 + 4*int(data[0]&0x0F)
+	if data[0]&0x10 != 0 {
+		if len(data) < offset+4 {
+			return rtpPacket{}, fmt.Errorf("truncated RTP header extension")
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+	}
+	end := len(data)
+	if data[0]&0x20 != 0 && end > 0 {
+		end -= int(data[end-1])
+	}
+	if offset > end {
+		return rtpPacket{}, fmt.Errorf("truncated RTP packet")
+	}
+	p.payload = data[offset:end]
+	return p, nil
+}
+
+// rtpStream puts the packets of a stream in order, filling lost packets
+// with silence
+type rtpStream struct {
+	started   bool
+	ssrc      uint32
+	sequence  uint16
+	timestamp uint32 // of the sample after the last one decoded
+}
+
+// decode returns the samples of a packet and the silence before it, nil
+// for packets arriving too late or that are not G.711 audio, such as DTMF
+// events and comfort noise
+func (s *rtpStream) decode(p rtpPacket) []int16 {
+	var decode func(byte) int16
+	switch p.payloadType {
+	case payloadPCMU:
+		decode = ulaw
+	case payloadPCMA:
+		decode = alaw
+	default:
+		return nil
+	}
+
+	gap := 0
+	// A new source, e.g. after a transfer, starts a new stream
+	if s.started && p.ssrc == s.ssrc {
+		if int16(p.sequence-s.sequence) <= 0 {
+			return nil
+		}
+		// Jumps of the timestamp resynchronize without filling them
+		if ahead := int32(p.timestamp - s.timestamp); ahead > 0 && ahead <= maxGapSamples {
+			gap = int(ahead)
+		}
+	}
+	s.started, s.ssrc, s.sequence = true, p.ssrc, p.sequence
+	s.timestamp = p.timestamp + uint32(len(p.payload))
+
+	samples := make([]int16, gap, gap+len(p.payload))
+	for _, b := range p.payload {
+		samples = append(samples, decode(b))
+	}
+	return samples
+}
+
+// ulaw decodes a G.711 µ-law sample
+func ulaw(b byte) int16 {
+	b = ^b
+	magnitude := (int16(b&0x0F)<<3 + 0x84) << ((b >> 4) & 0x07)
+	if b&0x80 != 0 {
+		return 0x84 - magnitude
+	}
+	return magnitude - 0x84
+}
+
+// alaw decodes a G.711 A-law sample
+func alaw(b byte) int16 {
+	b ^= 0x55
+	magnitude := int16(b&0x0F) << 4
+	switch exponent := (b >> 4) & 0x07; exponent {
+	case 0:
+		magnitude += 8
+	case 1:
+		magnitude += 0x108
+	default:
+		magnitude = (magnitude + 0x108) << (exponent - 1)
+	}
+	if b&0x80 != 0 {
+		return magnitude
+	}
+	return -magnitude
+}
+
+// sdpOffer is what the bridge uses of a session description
+type sdpOffer struct {
+	payloadTypes []int
+}
+
+// parseSDP reads the G.711 payload types of the first audio stream offered
+func parseSDP(body []byte) sdpOffer {
+	var offer sdpOffer
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "m=audio ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for _, field := range fields[min(3, len(fields)):] {
+			if pt, err := strconv.Atoi(field); err == nil && (pt == payloadPCMU || pt == payloadPCMA) {
+				offer.payloadTypes = append(offer.payloadTypes, pt)
+			}
+		}
+		break
+	}
+	return offer
+}
+
+// answerSDP describes the stream the bridge receives on, offering both
+// G.711 variants when the caller made no offer
+func answerSDP(host string, port int, session string, payloadTypes []int) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=libas %s 1 IN IP4 %s\r\ns=libas\r\nc=IN IP4 %s\r\nt=0 0\r\n", session, host, host)
+	fmt.Fprintf(&b, "m=audio %d RTP/AVP", port)
+	for _, pt := range payloadTypes {
+		fmt.Fprintf(&b, " %d", pt)
+	}
+	b.WriteString("\r\n")
+	for _, pt := range payloadTypes {
+		if pt == payloadPCMU {
+			b.WriteString("a=rtpmap:0 PCMU/8000\r\n")
+		} else {
+			b.WriteString("a=rtpmap:8 PCMA/8000\r\n")
+		}
+	}
+	b.WriteString("a=ptime:20\r\na=recvonly\r\n")
+	return []byte(b.String())
+}
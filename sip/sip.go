@@ -0,0 +1,568 @@
+// Package sip bridges phone calls into libas. The bridge answers the calls
+// a PBX such as Asterisk sends it, or that reach it through a SIP trunk it
+// registers with, and hands the G.711 audio of each call leg on as 8 kHz
+// samples. It only receives audio, over UDP, and never calls out.
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Rate of the samples handed to legs
+	SampleRate = 8000
+
+	// How long a call may go without audio before it is hung up when
+	// Config leaves MediaTimeout zero
+	defaultMediaTimeout = time.Minute
+
+	// Retransmission timers of RFC 3261 over UDP
+	timerT1            = 500 * time.Millisecond
+	timerT2            = 4 * time.Second
+	transactionTimeout = 64 * timerT1
+
+	// Largest datagram read
+	maxDatagram = 65535
+
+	// Calls answered at once when Config leaves MaxCalls zero
+	defaultMaxCalls = 16
+
+	// How often the names of allowed hosts are resolved again
+	allowRefresh = time.Minute
+)
+
+// Config of a bridge
+type Config struct {
+	// UDP address SIP is received on, e.g. :5060
+	Addr string
+
+	// Address put in the Contact header and the session description, the
+	// public address when behind NAT. Defaults to the local address the
+	// peer is reached from.
+	Host string
+
+	// Ports call audio is received on, any free port when zero
+	RTPPortMin int
+	RTPPortMax int
+
+	// SIP URI of a registrar to register with, e.g. sip:pbx.example.com,
+	// as User authenticated by Password. When empty the bridge waits for
+	// the calls a PBX sends it.
+	Registrar string
+	User      string
+	Password  string
+
+	// How long a registration lasts before it is renewed, defaults to 5
+	// minutes. The registrar may shorten it.
+	Expiry time.Duration
+
+	// Hosts, as names or IP addresses, calls are answered from, e.g. the
+	// PBX or the trunk. Required, names are resolved again every minute.
+	Allow []string
+
+	// Most calls answered at once, further calls are rejected as busy.
+	// Defaults to 16.
+	MaxCalls int
+
+	// How long a call may go without audio before it is hung up, defaults
+	// to a minute
+	MediaTimeout time.Duration
+
+	// Answer is called for each call leg, which is rejected as busy when it
+	// returns an error
+	Answer func(Call) (Leg, error)
+}
+
+// Call describes an answered call leg
+type Call struct {
+	// Call-ID of the leg
+	ID string
+
+	// URIs of the caller and the callee, e.g. sip:+4930123456@pbx
+	From string
+	To   string
+
+	// Address the call came from
+	Remote net.Addr
+}
+
+// Caller returns the caller as user@host, e.g. +4930123456@pbx
+func (c Call) Caller() string {
+	return uriUser(c.From)
+}
+
+// Leg receives the audio of an answered call leg
+type Leg interface {
+	// Write is given the audio of the call as it arrives, lost packets
+	// filled with silence, at SampleRate
+	Write(samples []int16)
+
+	// Close is called once the call ended
+	Close()
+}
+
+// Bridge answers calls and hands their audio to legs
+type Bridge struct {
+	config Config
+	conn   *net.UDPConn
+
+	mu      sync.Mutex
+	calls   map[string]*call
+	closing bool
+
+	// Responses to the requests the bridge sent, by branch
+	pending map[string]chan *message
+
+	// Addresses of the hosts of Config.Allow by host, resolved away from
+	// the read loop
+	allowMu sync.RWMutex
+	allowed map[string][]net.IP
+
+	// Call goroutines, waited for on shutdown
+	running sync.WaitGroup
+}
+
+// New creates a bridge, checking the configuration
+func New(cfg Config) (*Bridge, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("a SIP bridge needs an address to listen on")
+	}
+	if cfg.Answer == nil {
+		return nil, fmt.Errorf("a SIP bridge needs a function answering calls")
+	}
+	if len(cfg.Allow) == 0 {
+		return nil, fmt.Errorf("a SIP bridge needs the hosts calls are answered from")
+	}
+	if cfg.MaxCalls < 0 {
+		return nil, fmt.Errorf("invalid maximum of %d calls", cfg.MaxCalls)
+	}
+	if cfg.RTPPortMin < 0 || cfg.RTPPortMax > 65535 || cfg.RTPPortMin > cfg.RTPPortMax {
+		return nil, fmt.Errorf("invalid RTP port range %d-%d", cfg.RTPPortMin, cfg.RTPPortMax)
+	}
+	if cfg.Registrar != "" {
+		if !strings.HasPrefix(cfg.Registrar, "sip:") {
+			cfg.Registrar = "sip:" + cfg.Registrar
+		}
+		if cfg.User == "" {
+			return nil, fmt.Errorf("registering with %s needs a user", cfg.Registrar)
+		}
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = defaultRegisterExpiry
+	}
+	if cfg.MediaTimeout <= 0 {
+		cfg.MediaTimeout = defaultMediaTimeout
+	}
+	if cfg.MaxCalls == 0 {
+		cfg.MaxCalls = defaultMaxCalls
+	}
+	return &Bridge{
+		config:  cfg,
+		calls:   make(map[string]*call),
+		pending: make(map[string]chan *message),
+		allowed: make(map[string][]net.IP),
+	}, nil
+}
+
+// Listen opens the UDP socket SIP is received on
+func (b *Bridge) Listen() error {
+	addr, err := net.ResolveUDPAddr("udp", b.config.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid SIP address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SIP: %w", err)
+	}
+	b.conn = conn
+	return nil
+}
+
+// Serve answers calls until ctx is cancelled, listening first unless
+// Listen was called, then hangs up the calls in progress, waits for their
+// legs to close and unregisters
+func (b *Bridge) Serve(ctx context.Context) error {
+	if b.conn == nil {
+		if err := b.Listen(); err != nil {
+			return err
+		}
+	}
+	slog.Info("Answering SIP calls", "address", b.conn.LocalAddr())
+
+	// Calls are answered once the allowed hosts are known
+	b.resolveAllowed(ctx)
+	resolving := make(chan struct{})
+	go func() {
+		defer close(resolving)
+		ticker := time.NewTicker(allowRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				b.resolveAllowed(ctx)
+			}
+		}
+	}()
+
+	reading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		b.read(ctx)
+	}()
+
+	registered := make(chan struct{})
+	if b.config.Registrar != "" {
+		go func() {
+			defer close(registered)
+			b.register(ctx)
+		}()
+	} else {
+		close(registered)
+	}
+
+	// Calls hang up once ctx ends, no call is answered after
+	<-ctx.Done()
+	b.mu.Lock()
+	b.closing = true
+	b.mu.Unlock()
+	b.running.Wait()
+	<-registered
+	<-resolving
+
+	b.conn.Close()
+	<-reading
+	return nil
+}
+
+// read handles the datagrams received until the socket is closed
+func (b *Bridge) read(ctx context.Context) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Failed to read SIP message", "error", err)
+			}
+			return
+		}
+		// Keep-alives are blank lines
+		if strings.TrimSpace(string(buf[:n])) == "" {
+			continue
+		}
+		m, err := parseMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			slog.Debug("Ignoring invalid SIP message", "error", err, "remoteAddr", addr)
+			continue
+		}
+		if m.status != 0 {
+			b.dispatch(m)
+			continue
+		}
+		b.handle(ctx, m, addr)
+	}
+}
+
+// dispatch hands a response to the request it answers
+func (b *Bridge) dispatch(m *message) {
+	branch := param(m.get("Via"), "branch")
+	b.mu.Lock()
+	responses, ok := b.pending[branch]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case responses <- m:
+	default:
+	}
+}
+
+// handle answers a request
+func (b *Bridge) handle(ctx context.Context, m *message, addr *net.UDPAddr) {
+	b.mu.Lock()
+	c := b.calls[m.get("Call-ID")]
+	b.mu.Unlock()
+
+	switch m.method {
+	case "INVITE":
+		if c != nil {
+			c.reinvite(m)
+			return
+		}
+		b.invite(ctx, m, addr)
+	case "ACK":
+		if c != nil {
+			c.ack()
+		}
+	case "BYE":
+		if c == nil {
+			b.reply(m, addr, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+		b.reply(m, addr, 200, "OK")
+		c.end()
+	case "CANCEL":
+		// Calls are answered at once, the caller hangs up with a BYE
+		if c == nil {
+			b.reply(m, addr, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+		b.reply(m, addr, 200, "OK")
+	case "OPTIONS":
+		response := m.response(200, "OK")
+		response.add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS, INFO")
+		response.add("Accept", "application/sdp")
+		b.send(response, addr)
+	case "INFO":
+		b.reply(m, addr, 200, "OK")
+	default:
+		response := m.response(501, "Not Implemented")
+		response.add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS, INFO")
+		b.send(response, addr)
+	}
+}
+
+// resolveAllowed looks up the addresses of the allowed hosts, keeping
+// those of a name that fails to resolve
+func (b *Bridge) resolveAllowed(ctx context.Context) {
+	for _, host := range b.config.Allow {
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			var err error
+			if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to resolve host allowed to call", "error", err, "host", host)
+				}
+				continue
+			}
+		}
+		b.allowMu.Lock()
+		b.allowed[host] = ips
+		b.allowMu.Unlock()
+	}
+}
+
+// isAllowed reports whether calls are answered from addr
+func (b *Bridge) isAllowed(addr *net.UDPAddr) bool {
+	b.allowMu.RLock()
+	defer b.allowMu.RUnlock()
+	for _, ips := range b.allowed {
+		for _, ip := range ips {
+			if ip.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// invite answers a new call
+func (b *Bridge) invite(ctx context.Context, m *message, addr *net.UDPAddr) {
+	if !b.isAllowed(addr) {
+		slog.Warn("Rejected SIP call from host not allowed", "remoteAddr", addr, "from", addressURI(m.get("From")))
+		b.reply(m, addr, 403, "Forbidden")
+		return
+	}
+	// Calls are only added here, on the read loop, so the count cannot
+	// grow before the call is
+	b.mu.Lock()
+	busy := len(b.calls) >= b.config.MaxCalls
+	b.mu.Unlock()
+	if busy {
+		slog.Warn("Rejected SIP call, too many calls", "remoteAddr", addr, "from", addressURI(m.get("From")), "maxCalls", b.config.MaxCalls)
+		b.reply(m, addr, 486, "Busy Here")
+		return
+	}
+	b.reply(m, addr, 100, "Trying")
+
+	payloadTypes := []int{payloadPCMU, payloadPCMA}
+	if len(m.body) > 0 {
+		offer := parseSDP(m.body)
+		if len(offer.payloadTypes) == 0 {
+			slog.Warn("Rejected SIP call without G.711 audio", "remoteAddr", addr, "from", addressURI(m.get("From")))
+			b.reply(m, addr, 488, "Not Acceptable Here")
+			return
+		}
+		payloadTypes = offer.payloadTypes[:1]
+	}
+
+	rtp, err := b.listenRTP()
+	if err != nil {
+		slog.Error("Failed to open RTP port for call", "error", err)
+		b.reply(m, addr, 503, "Service Unavailable")
+		return
+	}
+
+	info := Call{
+		ID:     m.get("Call-ID"),
+		From:   addressURI(m.get("From")),
+		To:     addressURI(m.get("To")),
+		Remote: addr,
+	}
+	leg, err := b.config.Answer(info)
+	if err != nil {
+		rtp.Close()
+		slog.Warn("Rejected SIP call", "error", err, "from", info.From, "to", info.To)
+		b.reply(m, addr, 486, "Busy Here")
+		return
+	}
+
+	host := b.host(addr)
+	ok := m.response(200, "OK")
+	ok.setTag(randomToken())
+	ok.add("Contact", fmt.Sprintf("<sip:%s>", net.JoinHostPort(host, strconv.Itoa(b.port()))))
+	ok.add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS, INFO")
+	ok.add("Content-Type", "application/sdp")
+	session := strconv.FormatInt(time.Now().Unix(), 10)
+	ok.body = answerSDP(host, rtp.LocalAddr().(*net.UDPAddr).Port, session, payloadTypes)
+
+	cseq, _ := m.cseq()
+	c := &call{
+		bridge: b,
+		info:   info,
+		leg:    leg,
+		rtp:    rtp,
+		remote: addr,
+		cseq:   cseq,
+		ok:     ok,
+		target: addressURI(m.get("Contact")),
+		routes: m.all("Record-Route"),
+		acked:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if c.target == "" {
+		c.target = info.From
+	}
+	b.mu.Lock()
+	if b.closing {
+		b.mu.Unlock()
+		rtp.Close()
+		leg.Close()
+		b.reply(m, addr, 503, "Service Unavailable")
+		return
+	}
+	b.calls[info.ID] = c
+	b.running.Add(1)
+	b.mu.Unlock()
+
+	b.send(ok, addr)
+	slog.Info("Answered SIP call", "callID", info.ID, "from", info.From, "to", info.To, "remoteAddr", addr)
+	go c.run(ctx)
+}
+
+// listenRTP opens a socket for the audio of a call within the port range
+func (b *Bridge) listenRTP() (*net.UDPConn, error) {
+	host := ""
+	if addr, err := net.ResolveUDPAddr("udp", b.config.Addr); err == nil && addr.IP != nil {
+		host = addr.IP.String()
+	}
+	if b.config.RTPPortMin == 0 {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+	}
+	// Ports are tried from a random one on, RTP takes even ports
+	count := (b.config.RTPPortMax-b.config.RTPPortMin)/2 + 1
+	start := rand.IntN(count)
+	var err error
+	for i := 0; i < count; i++ {
+		port := b.config.RTPPortMin + 2*((start+i)%count)
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host), Port: port}); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no free RTP port in %d-%d: %w", b.config.RTPPortMin, b.config.RTPPortMax, err)
+}
+
+// host returns the address the peer at addr reaches the bridge at
+func (b *Bridge) host(addr *net.UDPAddr) string {
+	if b.config.Host != "" {
+		return b.config.Host
+	}
+	// Connecting a UDP socket sends nothing but picks the local address
+	// of the route to the peer
+	if conn, err := net.DialUDP("udp", nil, addr); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+	return b.conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// port returns the port SIP is received on
+func (b *Bridge) port() int {
+	return b.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// via returns a Via header for a request sent to addr, with a new branch
+func (b *Bridge) via(addr *net.UDPAddr) (string, string) {
+	branch := branchCookie + randomToken()
+	return fmt.Sprintf("SIP/2.0/UDP %s;branch=%s;rport", net.JoinHostPort(b.host(addr), strconv.Itoa(b.port())), branch), branch
+}
+
+// reply sends a response without a body to a request
+func (b *Bridge) reply(m *message, addr *net.UDPAddr, status int, reason string) {
+	response := m.response(status, reason)
+	if status > 100 {
+		response.setTag(randomToken())
+	}
+	b.send(response, addr)
+}
+
+// send writes a message to addr
+func (b *Bridge) send(m *message, addr *net.UDPAddr) {
+	if _, err := b.conn.WriteToUDP(m.bytes(), addr); err != nil {
+		slog.Warn("Failed to send SIP message", "error", err, "remoteAddr", addr)
+	}
+}
+
+// request sends a request to addr, retransmitting it until a final
+// response arrives, and returns that response
+func (b *Bridge) request(ctx context.Context, m *message, addr *net.UDPAddr) (*message, error) {
+	branch := param(m.get("Via"), "branch")
+	responses := make(chan *message, 8)
+	b.mu.Lock()
+	b.pending[branch] = responses
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, branch)
+		b.mu.Unlock()
+	}()
+
+	data := m.bytes()
+	ctx, cancel := context.WithTimeout(ctx, transactionTimeout)
+	defer cancel()
+	interval := timerT1
+	for {
+		if _, err := b.conn.WriteToUDP(data, addr); err != nil {
+			return nil, fmt.Errorf("failed to send %s: %w", m.method, err)
+		}
+		timer := time.NewTimer(interval)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("no response to %s from %s", m.method, addr)
+			case response := <-responses:
+				if response.status >= 200 {
+					timer.Stop()
+					return response, nil
+				}
+			case <-timer.C:
+				break wait
+			}
+		}
+		interval = min(2*interval, timerT2)
+	}
+}
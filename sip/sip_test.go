@@ -0,0 +1,361 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLeg records the audio of a call
+type testLeg struct {
+	mu      sync.Mutex
+	samples int
+	closed  chan struct{}
+}
+
+func (l *testLeg) Write(samples []int16) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples += len(samples)
+}
+
+func (l *testLeg) Close() {
+	close(l.closed)
+}
+
+func (l *testLeg) received() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.samples
+}
+
+// phone is the calling side of a test, a PBX sending requests to a bridge
+type phone struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	bridge *net.UDPAddr
+}
+
+// startBridge serves a bridge on the loopback interface and returns a phone
+// calling it, and the legs of the calls answered by Call-ID
+func startBridge(t *testing.T, configure func(cfg *Config)) (*phone, *sync.Map) {
+	t.Helper()
+	legs := &sync.Map{}
+	cfg := Config{
+		Addr:  "127.0.0.1:0",
+		Host:  "127.0.0.1",
+		Allow: []string{"127.0.0.1"},
+		Answer: func(c Call) (Leg, error) {
+			if strings.Contains(c.From, "busy") {
+				return nil, errors.New("busy")
+			}
+			leg := &testLeg{closed: make(chan struct{})}
+			legs.Store(c.ID, leg)
+			return leg, nil
+		},
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		b.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &phone{t: t, conn: conn, bridge: b.conn.LocalAddr().(*net.UDPAddr)}, legs
+}
+
+// send writes a datagram to the bridge
+func (p *phone) send(data []byte) {
+	p.t.Helper()
+	if _, err := p.conn.WriteToUDP(data, p.bridge); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// request sends a request of a call
+func (p *phone) request(method, callID string, cseq int, from string, body string) {
+	p.t.Helper()
+	m := &message{method: method, uri: "sip:libas@" + p.bridge.String()}
+	m.add("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=%s%s%d", p.conn.LocalAddr(), branchCookie, callID, cseq))
+	m.add("From", fmt.Sprintf("<sip:%s@127.0.0.1>;tag=%s", from, callID))
+	m.add("To", "<sip:libas@127.0.0.1>")
+	m.add("Call-ID", callID)
+	m.add("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	m.add("Contact", "<sip:"+from+"@"+p.conn.LocalAddr().String()+">")
+	if body != "" {
+		m.add("Content-Type", "application/sdp")
+	}
+	m.body = []byte(body)
+	p.send(m.bytes())
+}
+
+// next returns the next message from the bridge
+func (p *phone) next() *message {
+	p.t.Helper()
+	buf := make([]byte, maxDatagram)
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := p.conn.ReadFromUDP(buf)
+	if err != nil {
+		p.t.Fatalf("no message from the bridge: %v", err)
+	}
+	m, err := parseMessage(buf[:n])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return m
+}
+
+// final returns the next final response, skipping provisional ones
+func (p *phone) final() *message {
+	p.t.Helper()
+	for {
+		m := p.next()
+		if m.status >= 200 {
+			return m
+		}
+	}
+}
+
+// quiet checks the bridge sends nothing for a while
+func (p *phone) quiet() {
+	p.t.Helper()
+	buf := make([]byte, maxDatagram)
+	p.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := p.conn.ReadFromUDP(buf); err == nil {
+		p.t.Fatalf("bridge sent %q", buf[:n])
+	}
+}
+
+// answeredPort returns the RTP port of a 200 OK's session description
+func answeredPort(t *testing.T, ok *message) int {
+	t.Helper()
+	for _, line := range strings.Split(string(ok.body), "\r\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "m=audio" {
+			port, err := strconv.Atoi(fields[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return port
+		}
+	}
+	t.Fatalf("no audio stream in %q", ok.body)
+	return 0
+}
+
+const offer = "v=0\r\nc=IN IP4 127.0.0.1\r\nm=audio 4000 RTP/AVP 0 101\r\n"
+
+func TestCall(t *testing.T) {
+	p, legs := startBridge(t, nil)
+
+	p.request("INVITE", "call1", 1, "alice", offer)
+	if trying := p.next(); trying.status != 100 {
+		t.Fatalf("got %d before the answer, want 100", trying.status)
+	}
+	ok := p.next()
+	if ok.status != 200 || param(ok.get("To"), "tag") == "" {
+		t.Fatalf("got %d %s with To %q, want 200 with a tag", ok.status, ok.reason, ok.get("To"))
+	}
+	if got := parseSDP(ok.body).payloadTypes; len(got) != 1 || got[0] != payloadPCMU {
+		t.Errorf("answered with payload types %v, want PCMU", got)
+	}
+	p.request("ACK", "call1", 1, "alice", "")
+
+	value, answered := legs.Load("call1")
+	if !answered {
+		t.Fatal("no leg for the call")
+	}
+	leg := value.(*testLeg)
+
+	// Two packets of 20ms of audio
+	rtp, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: answeredPort(t, ok)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Close()
+	for i := range 2 {
+		packet := make([]byte, 12+160)
+		packet[0], packet[1] = 0x80, payloadPCMU
+		binary.BigEndian.PutUint16(packet[2:], uint16(i))
+		binary.BigEndian.PutUint32(packet[4:], uint32(160*i))
+		rtp.Write(packet)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for leg.received() < 320 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := leg.received(); got != 320 {
+		t.Errorf("leg received %d samples, want 320", got)
+	}
+
+	// A retransmitted INVITE gets the same answer
+	p.request("INVITE", "call1", 1, "alice", offer)
+	if again := p.final(); again.status != 200 || again.get("To") != ok.get("To") {
+		t.Errorf("retransmitted INVITE got %d with To %q", again.status, again.get("To"))
+	}
+
+	p.request("BYE", "call1", 2, "alice", "")
+	if bye := p.final(); bye.status != 200 {
+		t.Errorf("BYE got %d", bye.status)
+	}
+	select {
+	case <-leg.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leg not closed after BYE")
+	}
+
+	// The call is gone
+	p.request("BYE", "call1", 3, "alice", "")
+	if bye := p.final(); bye.status != 481 {
+		t.Errorf("BYE of an ended call got %d, want 481", bye.status)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	p, legs := startBridge(t, nil)
+
+	p.request("CANCEL", "unknown", 1, "alice", "")
+	if response := p.final(); response.status != 481 {
+		t.Errorf("CANCEL of no call got %d, want 481", response.status)
+	}
+
+	// Calls are answered at once, a CANCEL crossing the 200 OK is
+	// acknowledged and the call goes on until the BYE
+	p.request("INVITE", "call2", 1, "alice", offer)
+	if ok := p.final(); ok.status != 200 {
+		t.Fatalf("INVITE got %d", ok.status)
+	}
+	p.request("ACK", "call2", 1, "alice", "")
+	p.request("CANCEL", "call2", 1, "alice", "")
+	if response := p.final(); response.status != 200 {
+		t.Errorf("CANCEL got %d, want 200", response.status)
+	}
+	p.request("BYE", "call2", 2, "alice", "")
+	if response := p.final(); response.status != 200 {
+		t.Errorf("BYE after CANCEL got %d, want 200", response.status)
+	}
+	leg, _ := legs.Load("call2")
+	select {
+	case <-leg.(*testLeg).closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leg not closed after BYE")
+	}
+}
+
+func TestRejectedCalls(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(cfg *Config)
+		from      string
+		body      string
+		want      int
+	}{
+		{"host not allowed", func(cfg *Config) { cfg.Allow = []string{"192.0.2.1"} }, "alice", offer, 403},
+		{"no G.711", nil, "alice", "v=0\r\nm=audio 4000 RTP/AVP 9\r\n", 488},
+		{"leg refused", nil, "busy", offer, 486},
+	}
+	for _, tt := range tests {
+		p, legs := startBridge(t, tt.configure)
+		p.request("INVITE", "rejected", 1, tt.from, tt.body)
+		if response := p.final(); response.status != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.name, response.status, response.reason, tt.want)
+		}
+		if _, ok := legs.Load("rejected"); ok {
+			t.Errorf("%s: answered a leg", tt.name)
+		}
+	}
+}
+
+func TestMaxCalls(t *testing.T) {
+	p, _ := startBridge(t, func(cfg *Config) { cfg.MaxCalls = 1 })
+
+	p.request("INVITE", "first", 1, "alice", offer)
+	if ok := p.final(); ok.status != 200 {
+		t.Fatalf("first call got %d", ok.status)
+	}
+	p.request("ACK", "first", 1, "alice", "")
+	p.request("INVITE", "second", 1, "bob", offer)
+	if response := p.final(); response.status != 486 {
+		t.Fatalf("call past the limit got %d, want 486", response.status)
+	}
+
+	p.request("BYE", "first", 2, "alice", "")
+	if response := p.final(); response.status != 200 {
+		t.Fatalf("BYE got %d", response.status)
+	}
+	// The ended call makes room once its goroutine is done
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.request("INVITE", "third", 1, "carol", offer)
+		response := p.final()
+		if response.status == 200 {
+			break
+		}
+		if response.status != 486 || time.Now().After(deadline) {
+			t.Fatalf("call after a hangup got %d, want 200", response.status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	p.request("ACK", "third", 1, "carol", "")
+	p.request("BYE", "third", 2, "carol", "")
+	p.final()
+}
+
+// Malformed datagrams are dropped without an answer and the bridge goes on
+func TestMalformedRequests(t *testing.T) {
+	p, _ := startBridge(t, nil)
+	for _, data := range []string{
+		"\r\n\r\n",
+		"garbage",
+		"INVITE sip:libas@127.0.0.1 SIP/2.0\r\nCall-ID: x\r\n",
+		"INVITE sip:libas@127.0.0.1 SIP/2.0\r\nContent-Length: 99\r\n\r\nv=0",
+		"SIP/2.0 200 OK\r\nVia: SIP/2.0/UDP 127.0.0.1;branch=z9hG4bKnone\r\n\r\n",
+	} {
+		p.send([]byte(data))
+	}
+	p.quiet()
+
+	p.request("OPTIONS", "options", 1, "alice", "")
+	if response := p.final(); response.status != 200 || !strings.Contains(response.get("Allow"), "INVITE") {
+		t.Errorf("OPTIONS got %d with Allow %q", response.status, response.get("Allow"))
+	}
+	p.request("SUBSCRIBE", "subscribe", 1, "alice", "")
+	if response := p.final(); response.status != 501 {
+		t.Errorf("SUBSCRIBE got %d, want 501", response.status)
+	}
+}
+
+func TestNewNeedsAllow(t *testing.T) {
+	answer := func(Call) (Leg, error) { return nil, errors.New("busy") }
+	if _, err := New(Config{Addr: ":0", Answer: answer}); err == nil {
+		t.Error("created a bridge answering calls from any host")
+	}
+	if _, err := New(Config{Addr: ":0", Answer: answer, Allow: []string{"pbx"}, MaxCalls: -1}); err == nil {
+		t.Error("created a bridge with a negative call limit")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	runtimepprof "runtime/pprof"
+	"sync"
+	"time"
+
+	libaserv "github.com/bosley/libas/server"
+)
+
+// How long components get to stop, together, once shutdown begins
+const shutdownTimeout = 30 * time.Second
+
+// component is one long running part of a command, such as the audio server
+// or scribe
+type component struct {
+	name string
+
+	// run blocks until ctx is cancelled or the component fails, calling
+	// ready once it is serving
+	run func(ctx context.Context, ready func()) error
+
+	// stop, when set, releases the component after run returned
+	stop func(ctx context.Context) error
+}
+
+// supervisor starts components in order, each once the previous one is
+// ready, and stops all of them in reverse order when any fails or the
+// context is cancelled
+type supervisor struct {
+	components []component
+}
+
+func (s *supervisor) add(c component) {
+	s.components = append(s.components, c)
+}
+
+// componentState tracks a started component
+type componentState struct {
+	component
+	ready chan struct{}
+	done  chan struct{}
+	err   error
+}
+
+// run starts the components and blocks until shutdown is complete,
+// returning the first failure
+func (s *supervisor) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failures := make(chan error, len(s.components))
+	started := make([]*componentState, 0, len(s.components))
+
+	var failure error
+	for _, c := range s.components {
+		state := s.start(ctx, c, failures)
+		started = append(started, state)
+
+		select {
+		case <-state.ready:
+			slog.Debug("Component ready", "component", c.name)
+			continue
+		case failure = <-failures:
+		case <-ctx.Done():
+		}
+		break
+	}
+
+	if failure == nil && ctx.Err() == nil {
+		if _, err := libaserv.SdNotify("READY=1"); err != nil {
+			slog.Warn("Failed to signal readiness", "error", err)
+		}
+		go libaserv.Watchdog(ctx)
+
+		select {
+		case failure = <-failures:
+		case <-ctx.Done():
+		}
+	}
+
+	libaserv.SdNotify("STOPPING=1")
+	cancel()
+
+	if err := s.shutdown(started); err != nil && failure == nil {
+		return err
+	}
+	return failure
+}
+
+func (s *supervisor) start(ctx context.Context, c component, failures chan<- error) *componentState {
+	state := &componentState{
+		component: c,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	var once sync.Once
+	ready := func() { once.Do(func() { close(state.ready) }) }
+
+	go runtimepprof.Do(ctx, runtimepprof.Labels(subsystemLabel, c.name), func(ctx context.Context) {
+		defer close(state.done)
+		state.err = c.run(ctx, ready)
+
+		// Returning before shutdown is a failure even without an error
+		if ctx.Err() == nil {
+			if state.err == nil {
+				state.err = fmt.Errorf("stopped unexpectedly")
+			}
+			failures <- fmt.Errorf("%s: %w", c.name, state.err)
+		} else if state.err != nil {
+			slog.Error("Component failed while stopping", "component", c.name, "error", state.err)
+		}
+	})
+
+	return state
+}
+
+// shutdown waits for the components to return, newest first, and stops
+// them, giving up once shutdownTimeout has passed
+func (s *supervisor) shutdown(started []*componentState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(started) - 1; i >= 0; i-- {
+		state := started[i]
+
+		select {
+		case <-state.done:
+		case <-ctx.Done():
+			return errors.Join(append(errs, fmt.Errorf("%s did not stop within %s", state.name, shutdownTimeout))...)
+		}
+
+		if state.stop != nil {
+			if err := state.stop(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("failed to stop %s: %w", state.name, err))
+			}
+		}
+		slog.Debug("Component stopped", "component", state.name)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML reads the subset of TOML used by libas configuration files:
+// comments, [table] headers, and key = value pairs whose values are strings,
+// integers, floats, booleans or arrays of those. Keys before the first table
+// are returned under "".
+func parseTOML(r io.Reader) (map[string]map[string]any, error) {
+	tables := map[string]map[string]any{"": {}}
+	current := tables[""]
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	var pending strings.Builder
+	pendingLine := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+
+		// Arrays may span several lines, collect until the brackets close
+		if pending.Len() > 0 {
+			pending.WriteString(" ")
+			pending.WriteString(line)
+			if !bracketsBalanced(pending.String()) {
+				continue
+			}
+			line = pending.String()
+			pending.Reset()
+		} else if line == "" {
+			continue
+		} else {
+			pendingLine = lineNumber
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header %q", lineNumber, line)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" {
+				return nil, fmt.Errorf("line %d: empty table name", lineNumber)
+			}
+			if _, exists := tables[name]; exists {
+				return nil, fmt.Errorf("line %d: table [%s] defined twice", lineNumber, name)
+			}
+			current = make(map[string]any)
+			tables[name] = current
+			continue
+		}
+
+		key, rawValue, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key, err := parseKey(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		rawValue = strings.TrimSpace(rawValue)
+		if strings.HasPrefix(rawValue, "[") && !bracketsBalanced(rawValue) {
+			pending.WriteString(line)
+			continue
+		}
+
+		value, rest, err := parseValue(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", pendingLine, err)
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("line %d: unexpected %q after value", pendingLine, rest)
+		}
+		if _, exists := current[key]; exists {
+			return nil, fmt.Errorf("line %d: key %q defined twice", pendingLine, key)
+		}
+		current[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unterminated array", pendingLine)
+	}
+
+	return tables, nil
+}
+
+func parseKey(key string) (string, error) {
+	if strings.HasPrefix(key, `"`) {
+		value, rest, err := parseBasicString(key)
+		if err != nil || rest != "" {
+			return "", fmt.Errorf("invalid key %s", key)
+		}
+		return value, nil
+	}
+	if key == "" {
+		return "", fmt.Errorf("empty key")
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return key, nil
+}
+
+// parseValue parses one value from the start of s and returns what follows
+func parseValue(s string) (any, string, error) {
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("missing value")
+	case strings.HasPrefix(s, `"`):
+		return parseBasicString(s)
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case strings.HasPrefix(s, "["):
+		return parseArray(s)
+	}
+
+	end := strings.IndexAny(s, ",]")
+	if end < 0 {
+		end = len(s)
+	}
+	token, rest := strings.TrimSpace(s[:end]), s[end:]
+
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+
+	number := strings.ReplaceAll(token, "_", "")
+	if i, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return i, rest, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, rest, nil
+	}
+	return nil, "", fmt.Errorf("invalid value %q", token)
+}
+
+func parseArray(s string) (any, string, error) {
+	values := make([]any, 0)
+	s = strings.TrimSpace(s[1:])
+	for {
+		if strings.HasPrefix(s, "]") {
+			return values, s[1:], nil
+		}
+
+		value, rest, err := parseValue(s)
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, value)
+
+		s = strings.TrimSpace(rest)
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if !strings.HasPrefix(s, "]") {
+			return nil, "", fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+func parseBasicString(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", "", fmt.Errorf("unterminated string")
+			}
+			i++
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'u', 'U':
+				digits := 4
+				if s[i] == 'U' {
+					digits = 8
+				}
+				if i+digits >= len(s) {
+					return "", "", fmt.Errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(s[i+1:i+1+digits], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", "", fmt.Errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(code))
+				i += digits
+			default:
+				return "", "", fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// stripComment removes a # comment that is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// bracketsBalanced reports whether every [ outside strings has been closed
+func bracketsBalanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		case quote == 0 && c == '[':
+			depth++
+		case quote == 0 && c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
@@ -0,0 +1,353 @@
+// Package tracing records spans of work across libas components and exports
+// them to an OpenTelemetry collector with OTLP over HTTP. A nil *Tracer is
+// valid and records nothing, so components can trace unconditionally.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Spans exported in one request at most
+	maxBatchSize = 512
+
+	// How often finished spans are exported
+	exportInterval = 5 * time.Second
+
+	// Finished spans waiting for export before new ones are dropped
+	maxQueuedSpans = 8192
+
+	// How long a handed off span context waits to be resumed
+	handoffTTL = 10 * time.Minute
+)
+
+// Config for exporting spans
+type Config struct {
+	// OTLP/HTTP endpoint of the collector, e.g. http://localhost:4318.
+	// Spans are posted to <endpoint>/v1/traces.
+	Endpoint string
+
+	// Headers sent with every export, e.g. for authentication
+	Headers map[string]string
+
+	// Reported as the service.name resource attribute, defaults to libas
+	ServiceName string
+}
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext is what a span passes on to its children, within a process
+// through a context.Context or across processes as a W3C traceparent
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// Valid reports whether the span context belongs to a trace
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{}
+}
+
+// TraceParent formats the span context as a W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceParent reads a W3C traceparent header value
+func ParseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	return sc, sc.Valid() && sc.SpanID != SpanID{}
+}
+
+// Attribute is a key and a string, bool, integer or float value recorded on
+// a span
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Attr creates an attribute
+func Attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Tracer creates spans and exports them in batches
+type Tracer struct {
+	config   Config
+	exporter *exporter
+
+	startOnce sync.Once
+	queue     chan *Span
+	flush     chan chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+
+	handoffMu sync.Mutex
+	handoff   map[string]handoffEntry
+}
+
+type handoffEntry struct {
+	context SpanContext
+	created time.Time
+}
+
+// New creates a tracer exporting to the configured collector
+func New(cfg Config) (*Tracer, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("an OTLP endpoint is required")
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "libas"
+	}
+
+	exp, err := newExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tracer{
+		config:   cfg,
+		exporter: exp,
+		queue:    make(chan *Span, maxQueuedSpans),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		handoff:  make(map[string]handoffEntry),
+	}, nil
+}
+
+// Start begins a span, a child of the span in ctx if there is one, and
+// returns a context carrying it. End the span when the work is done.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	return t.StartWithParent(ctx, SpanContextFromContext(ctx), name, attrs...)
+}
+
+// StartWithParent begins a span continuing a span context received from
+// elsewhere, e.g. another process or a handoff
+func (t *Tracer) StartWithParent(ctx context.Context, parent SpanContext, name string, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	t.startOnce.Do(func() { go t.run() })
+
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		start:      time.Now(),
+		attributes: attrs,
+	}
+	if parent.Valid() {
+		span.context.TraceID = parent.TraceID
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+	}
+	rand.Read(span.context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Handoff remembers a span context under a key, such as a file path, for
+// work another component picks up without a context to pass it in
+func (t *Tracer) Handoff(key string, sc SpanContext) {
+	if t == nil || !sc.Valid() {
+		return
+	}
+	t.handoffMu.Lock()
+	defer t.handoffMu.Unlock()
+
+	now := time.Now()
+	for k, entry := range t.handoff {
+		if now.Sub(entry.created) > handoffTTL {
+			delete(t.handoff, k)
+		}
+	}
+	t.handoff[key] = handoffEntry{context: sc, created: now}
+}
+
+// Resume takes the span context handed off under a key
+func (t *Tracer) Resume(key string) (SpanContext, bool) {
+	if t == nil {
+		return SpanContext{}, false
+	}
+	t.handoffMu.Lock()
+	defer t.handoffMu.Unlock()
+
+	entry, ok := t.handoff[key]
+	delete(t.handoff, key)
+	return entry.context, ok
+}
+
+// Shutdown exports the spans that ended and stops the tracer
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	select {
+	case <-t.done:
+		return nil
+	default:
+	}
+
+	t.startOnce.Do(func() { go t.run() })
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	t.stopOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+// run exports finished spans in batches until the tracer is shut down
+func (t *Tracer) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportInterval)
+		defer cancel()
+		t.exporter.export(ctx, batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			for drained := false; !drained; {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= maxBatchSize {
+						export()
+					}
+				default:
+					drained = true
+				}
+			}
+			export()
+			close(flushed)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Span is one timed piece of work. Its methods do nothing on a nil span.
+type Span struct {
+	tracer  *Tracer
+	name    string
+	context SpanContext
+	parent  SpanID
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []Attribute
+	err        error
+}
+
+// Context is the span context children and other processes continue from
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttributes records attributes on the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attrs...)
+}
+
+// RecordError marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.tracer.queue <- s:
+	default:
+		// The collector is not keeping up, losing spans beats blocking
+	}
+}
+
+type spanKey struct{}
+
+// SpanContextFromContext returns the span context of the span in ctx
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return span.context
+	}
+	return SpanContext{}
+}
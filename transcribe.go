@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bosley/libas/audio"
+	"github.com/bosley/libas/scribe"
+)
+
+// Extensions picked up when transcribing a directory
+var transcribeExtensions = map[string]bool{
+	".wav":  true,
+	".flac": true,
+	".mp3":  true,
+	".ogg":  true,
+	".oga":  true,
+}
+
+// Output formats of the transcribe command and the extension of the files
+// written with -output-dir
+var transcribeFormats = map[string]string{
+	"text": ".txt",
+	"json": ".json",
+	"srt":  ".srt",
+	"vtt":  ".vtt",
+}
+
+// transcript is the JSON output of the transcribe command
+type transcript struct {
+	File     string              `json:"file"`
+	Text     string              `json:"text"`
+	Language string              `json:"language,omitempty"`
+	Segments []transcriptSegment `json:"segments"`
+}
+
+type transcriptSegment struct {
+	Start float64          `json:"start"`
+	End   float64          `json:"end"`
+	Text  string           `json:"text"`
+	Words []transcriptWord `json:"words,omitempty"`
+}
+
+type transcriptWord struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+func runTranscribe(args []string) error {
+	fs := newFlagSet("transcribe")
+	whisperPath := fs.String("whisper", "", "Path to whisper executable (required)")
+	whisperModel := fs.String("model", "", "Path to whisper model file (required)")
+	prompt := fs.String("prompt", "", "Initial prompt priming whisper with names, terms and jargon to expect")
+	language := fs.String("language", "", "Language spoken, e.g. de, or auto to detect it (whisper assumes English)")
+	recursive := fs.Bool("recursive", false, "Also transcribe audio in subdirectories of directory arguments")
+	format := fs.String("format", "text", "Output format: text, json, srt or vtt (WebVTT captions highlighting each word as it is spoken)")
+	outputDir := fs.String("output-dir", "", "Write one transcript per file into this directory instead of printing")
+	processing := addProcessingFlags(fs)
+	ffmpegPath := addFFmpegFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return usageError(fs, "expected at least one audio file or directory")
+	}
+	if *whisperPath == "" || *whisperModel == "" {
+		return usageError(fs, "whisper executable and model paths must be provided")
+	}
+	if _, ok := transcribeFormats[*format]; !ok {
+		return usageError(fs, "unknown format %q", *format)
+	}
+
+	files, err := collectAudioFiles(fs.Args(), *recursive)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no audio files found")
+	}
+	if (*format == "srt" || *format == "vtt") && *outputDir == "" && len(files) > 1 {
+		return usageError(fs, "%s output of several files needs -output-dir", *format)
+	}
+
+	if err := configureFFmpeg(*ffmpegPath); err != nil {
+		return fmt.Errorf("invalid ffmpeg path: %w", err)
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	tmpDir, err := os.MkdirTemp("", "libas-transcribe-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := processing.convertOptions()
+	failed := 0
+	for i, file := range files {
+		path := file.path
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		whisperFile := filepath.Join(tmpDir, fmt.Sprintf("%d.wav", i))
+		whisper := scribe.Whisper{Path: *whisperPath, Model: *whisperModel, Prompt: *prompt, Language: *language}
+		segments, err := transcribeFile(ctx, path, whisperFile, whisper, opts)
+		os.Remove(whisperFile)
+		if err != nil {
+			if len(files) == 1 {
+				return err
+			}
+			slog.Error("Failed to transcribe file", "file", path, "error", err)
+			failed++
+			continue
+		}
+
+		if *outputDir == "" {
+			if err := writeTranscript(os.Stdout, *format, path, segments, len(files) > 1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		output := filepath.Join(*outputDir, strings.TrimSuffix(file.rel, filepath.Ext(file.rel))+transcribeFormats[*format])
+		if err := writeTranscriptFile(output, *format, path, segments); err != nil {
+			return err
+		}
+		slog.Info("Transcribed file", "file", path, "output", output)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to transcribe %d of %d files", failed, len(files))
+	}
+	return nil
+}
+
+// audioFile is an input of the transcribe command
+type audioFile struct {
+	path string
+
+	// Path relative to the directory argument it was found in, mirrored
+	// under -output-dir
+	rel string
+}
+
+// collectAudioFiles expands directory arguments to the audio files they
+// contain, in name order. Files given explicitly are kept whatever their
+// extension.
+func collectAudioFiles(args []string, recursive bool) ([]audioFile, error) {
+	files := make([]audioFile, 0, len(args))
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, audioFile{path: arg, rel: filepath.Base(arg)})
+			continue
+		}
+
+		err = filepath.WalkDir(arg, func(path string, d iofs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != arg && !recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if transcribeExtensions[strings.ToLower(filepath.Ext(path))] {
+				rel, err := filepath.Rel(arg, path)
+				if err != nil {
+					return err
+				}
+				files = append(files, audioFile{path: path, rel: rel})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", arg, err)
+		}
+	}
+	return files, nil
+}
+
+func transcribeFile(ctx context.Context, path, whisperFile string, whisper scribe.Whisper, opts audio.ConvertOptions) ([]scribe.Segment, error) {
+	if err := audio.ConvertForWhisper(path, whisperFile, opts); err != nil {
+		return nil, fmt.Errorf("failed to convert %s: %w", path, err)
+	}
+	segments, err := whisper.TranscribeSegments(ctx, whisperFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transcribe %s: %w", path, err)
+	}
+	return segments, nil
+}
+
+func writeTranscriptFile(path, format, source string, segments []scribe.Segment) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create transcript: %w", err)
+	}
+	if err := writeTranscript(file, format, source, segments, false); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+	return nil
+}
+
+// writeTranscript writes the segments of one file. Text output is prefixed
+// with the file name when several files are printed together.
+func writeTranscript(w io.Writer, format, source string, segments []scribe.Segment, named bool) error {
+	var err error
+	switch format {
+	case "json":
+		t := transcript{
+			File:     source,
+			Segments: make([]transcriptSegment, len(segments)),
+		}
+		texts := make([]string, len(segments))
+		for i, segment := range segments {
+			t.Segments[i] = transcriptSegment{
+				Start: segment.Start.Seconds(),
+				End:   segment.End.Seconds(),
+				Text:  segment.Text,
+			}
+			for _, word := range segment.Words {
+				t.Segments[i].Words = append(t.Segments[i].Words, transcriptWord{
+					Start: float64(word.StartMs) / 1000,
+					End:   float64(word.EndMs) / 1000,
+					Text:  word.Text,
+				})
+			}
+			texts[i] = segment.Text
+			t.Language = segment.Language
+		}
+		t.Text = strings.Join(texts, " ")
+		err = json.NewEncoder(w).Encode(t)
+
+	case "srt":
+		for i, segment := range segments {
+			_, err = fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", i+1,
+				srtTimestamp(segment.Start), srtTimestamp(segment.End), segment.Text)
+			if err != nil {
+				break
+			}
+		}
+
+	case "vtt":
+		_, err = fmt.Fprint(w, "WEBVTT\n\n")
+		for _, segment := range segments {
+			if err != nil {
+				break
+			}
+			_, err = fmt.Fprintf(w, "%s --> %s\n%s\n\n",
+				vttTimestamp(segment.Start), vttTimestamp(segment.End), karaokeText(segment))
+		}
+
+	default:
+		texts := make([]string, len(segments))
+		for i, segment := range segments {
+			texts[i] = segment.Text
+		}
+		text := strings.Join(texts, " ")
+		if named {
+			_, err = fmt.Fprintf(w, "%s: %s\n", source, text)
+		} else {
+			_, err = fmt.Fprintln(w, text)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+	return nil
+}
+
+// srtTimestamp formats an offset as HH:MM:SS,mmm
+func srtTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// vttTimestamp formats an offset as HH:MM:SS.mmm
+func vttTimestamp(d time.Duration) string {
+	return strings.Replace(srtTimestamp(d), ",", ".", 1)
+}
+
+// Escapes the characters WebVTT cue text reserves for tags
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// karaokeText is the text of a caption with a timestamp tag before each
+// word after the first, which players use to highlight the spoken word
+func karaokeText(segment scribe.Segment) string {
+	if len(segment.Words) == 0 {
+		return vttEscaper.Replace(segment.Text)
+	}
+	var b strings.Builder
+	for i, word := range segment.Words {
+		start := time.Duration(word.StartMs) * time.Millisecond
+		if i > 0 {
+			b.WriteString(" ")
+			if start > segment.Start && start < segment.End {
+				fmt.Fprintf(&b, "<%s>", vttTimestamp(start))
+			}
+		}
+		b.WriteString(vttEscaper.Replace(word.Text))
+	}
+	return b.String()
+}
+
+func runSplit(args []string) error {
+	fs := newFlagSet("split")
+	silenceThreshold := fs.Float64("silence-threshold", -45, "Level in dBFS below which audio counts as silence")
+	ffmpegPath := addFFmpegFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected one audio file")
+	}
+
+	if err := configureFFmpeg(*ffmpegPath); err != nil {
+		return fmt.Errorf("invalid ffmpeg path: %w", err)
+	}
+
+	parts, err := audio.SplitFile(fs.Arg(0), audio.SilenceOptions{ThresholdDB: *silenceThreshold})
+	if err != nil {
+		return fmt.Errorf("failed to split audio file: %w", err)
+	}
+	for _, part := range parts {
+		fmt.Println(part)
+	}
+	return nil
+}
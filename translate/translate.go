@@ -0,0 +1,155 @@
+// Package translate translates text with a LibreTranslate server, which
+// runs open models locally, or with the DeepL API
+package translate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Backends a Client talks to
+const (
+	LibreTranslate = "libretranslate"
+	DeepL          = "deepl"
+)
+
+// Largest response read, translations of a transcription are short
+const maxResponseSize = 1 << 20
+
+// Config for a translation service
+type Config struct {
+	// LibreTranslate or DeepL
+	Backend string
+
+	// Base URL of the service, e.g. http://localhost:5000 or
+	// https://api-free.deepl.com
+	URL string
+
+	// API key, optional for LibreTranslate servers that do not require one
+	Key string
+}
+
+// Client translates text with one service
+type Client struct {
+	config Config
+	http   *http.Client
+}
+
+// New creates a client for the configured service
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid translation URL")
+	}
+	switch cfg.Backend {
+	case LibreTranslate:
+	case DeepL:
+		if cfg.Key == "" {
+			return nil, fmt.Errorf("DeepL needs an API key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported translation backend %q", cfg.Backend)
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	return &Client{config: cfg, http: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// URL describes the service for logs, without credentials
+func (c *Client) URL() string {
+	u, err := url.Parse(c.config.URL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Translate translates text from one language into another, both given as
+// ISO 639-1 codes such as en. An empty from has the service detect it.
+func (c *Client) Translate(ctx context.Context, text, from, to string) (string, error) {
+	if c.config.Backend == DeepL {
+		return c.deepL(ctx, text, from, to)
+	}
+	return c.libreTranslate(ctx, text, from, to)
+}
+
+// libreTranslate calls POST /translate of a LibreTranslate server
+func (c *Client) libreTranslate(ctx context.Context, text, from, to string) (string, error) {
+	if from == "" {
+		from = "auto"
+	}
+	request := map[string]string{"q": text, "source": from, "target": to, "format": "text"}
+	if c.config.Key != "" {
+		request["api_key"] = c.config.Key
+	}
+
+	var response struct {
+		TranslatedText string `json:"translatedText"`
+	}
+	if err := c.post(ctx, "/translate", request, nil, &response); err != nil {
+		return "", err
+	}
+	return response.TranslatedText, nil
+}
+
+// deepL calls POST /v2/translate of the DeepL API
+func (c *Client) deepL(ctx context.Context, text, from, to string) (string, error) {
+	request := map[string]any{"text": []string{text}, "target_lang": strings.ToUpper(to)}
+	if from != "" {
+		request["source_lang"] = strings.ToUpper(from)
+	}
+	header := http.Header{"Authorization": {"DeepL-Auth-Key " + c.config.Key}}
+
+	var response struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := c.post(ctx, "/v2/translate", request, header, &response); err != nil {
+		return "", err
+	}
+	if len(response.Translations) == 0 {
+		return "", fmt.Errorf("DeepL returned no translation")
+	}
+	return response.Translations[0].Text, nil
+}
+
+// post sends a JSON request and decodes the JSON response
+func (c *Client) post(ctx context.Context, path string, request any, header http.Header, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode translation request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create translation request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", c.URL(), err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to read translation: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s: %s", c.URL(), resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to parse translation: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bosley/libas/scribe"
+	"github.com/bosley/libas/version"
+)
+
+func runVersion(args []string) error {
+	fs := newFlagSet("version")
+	asJSON := fs.Bool("json", false, "Print the build information as JSON")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	info := version.Get()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(scribe.VersionResponse{
+			Info:     info,
+			Backends: scribe.Backends(),
+		})
+	}
+
+	fmt.Printf("libas %s\n", info.Version)
+	if info.Commit != "" {
+		modified := ""
+		if info.Modified {
+			modified = " (modified)"
+		}
+		fmt.Printf("commit:   %s%s %s\n", info.Commit, modified, info.CommitTime)
+	}
+	fmt.Printf("go:       %s\n", info.GoVersion)
+	fmt.Printf("protocol: %d\n", info.Protocol)
+	fmt.Printf("backends: %s\n", strings.Join(scribe.Backends(), ", "))
+	return nil
+}
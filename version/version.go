@@ -0,0 +1,64 @@
+// Package version reports which libas build is running
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Version of libas, set when building a release with
+// -ldflags "-X github.com/bosley/libas/version.Version=v1.2.3". Falls back
+// to the module version recorded by go install.
+var Version = ""
+
+// Protocol is the revision of the audio stream protocol between capture
+// clients and the server. Revision 2 added sample rate negotiation,
+// revision 3 speech played on clients, revision 4 live audio routed
+// between them, revision 5 muting clients, revision 6 continuous
+// recording and revision 7 health reports.
+const Protocol = 7
+
+// Info describes a build
+type Info struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commitTime,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	GoVersion  string `json:"goVersion"`
+	Protocol   int    `json:"protocol"`
+}
+
+// Get returns the version and the VCS details Go embedded in the binary
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		Protocol:  Protocol,
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "unknown"
+		}
+		return info
+	}
+
+	if info.Version == "" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.CommitTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	if info.Version == "" || info.Version == "(devel)" {
+		info.Version = "devel"
+	}
+	return info
+}
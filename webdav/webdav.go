@@ -0,0 +1,166 @@
+// Package webdav uploads files to WebDAV servers (Nextcloud, ownCloud, the
+// WebDAV servers of Synology and QNAP devices) with basic authentication
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config for a WebDAV destination
+type Config struct {
+	// URL of the collection files are put under, e.g.
+	// https://nas.local:5006/home/libas
+	URL string
+
+	// Basic authentication credentials, none when User is empty
+	User     string
+	Password string
+}
+
+// Client uploads files under one collection
+type Client struct {
+	config Config
+	base   *url.URL
+	http   *http.Client
+
+	mu      sync.Mutex
+	created map[string]bool // Collections known to exist
+}
+
+// New creates a client for the configured collection
+func New(cfg Config) (*Client, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("invalid WebDAV URL %q", cfg.URL)
+	}
+	base.User = nil
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return &Client{
+		config:  cfg,
+		base:    base,
+		http:    &http.Client{Timeout: 5 * time.Minute},
+		created: make(map[string]bool),
+	}, nil
+}
+
+// URL is where a file is stored, for logs and reports
+func (c *Client) URL(name string) string {
+	return c.fileURL(name).String()
+}
+
+func (c *Client) fileURL(name string) *url.URL {
+	u := *c.base
+	u.Path = c.base.Path + "/" + strings.TrimPrefix(name, "/")
+	return &u
+}
+
+// Put uploads size bytes of body as name, creating the collections above
+// it
+func (c *Client) Put(ctx context.Context, name string, body io.Reader, size int64) error {
+	if err := c.mkcolAll(ctx, path.Dir(strings.TrimPrefix(name, "/"))); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.URL(name), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WebDAV PUT %s returned %s", name, resp.Status)
+	}
+	return nil
+}
+
+// Delete removes name. A file that does not exist is an error wrapping
+// fs.ErrNotExist.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.URL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusAccepted:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("WebDAV DELETE %s: %w", name, fs.ErrNotExist)
+	}
+	return fmt.Errorf("WebDAV DELETE %s returned %s", name, resp.Status)
+}
+
+// mkcolAll creates dir and the collections above it that do not exist yet
+func (c *Client) mkcolAll(ctx context.Context, dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+	c.mu.Lock()
+	known := c.created[dir]
+	c.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	if err := c.mkcolAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", c.URL(dir)+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// 405 is the answer for an existing collection
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("WebDAV MKCOL %s returned %s", dir, resp.Status)
+	}
+	c.mu.Lock()
+	c.created[dir] = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.config.User != "" {
+		req.SetBasicAuth(c.config.User, c.config.Password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// Keep credentials a redirect may have put in the URL out of errors
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("WebDAV request failed: %w", err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, fmt.Errorf("WebDAV server refused the credentials (%s)", resp.Status)
+	}
+	return resp, nil
+}
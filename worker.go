@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/bosley/libas/scribe"
+)
+
+// workerConfig is what the worker command runs with
+type workerConfig struct {
+	worker  scribe.QueueWorker
+	whisper scribe.Whisper
+	pacing  scribe.PacingConfig
+}
+
+// parseWorker reads the flags of the worker command
+func parseWorker(args []string) (workerConfig, error) {
+	fs := newFlagSet("worker")
+	queue := addQueueFlags(fs, false)
+	whisperPath := fs.String("whisper", "", "Path to whisper executable (required)")
+	whisperModel := fs.String("model", "", "Path to whisper model file (required)")
+	language := fs.String("language", "", "Language spoken, e.g. de, unless the scribe asks to detect it (whisper assumes English)")
+	workers := fs.Int("workers", 1, "Number of concurrent whisper transcriptions")
+	name := fs.String("name", "", "Name the scribe logs transcriptions of this worker with (defaults to the host name)")
+	pacing := addPacingFlags(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return workerConfig{}, err
+	}
+
+	if *queue.url == "" {
+		return workerConfig{}, usageError(fs, "-queue must be provided")
+	}
+	if *whisperPath == "" || *whisperModel == "" {
+		return workerConfig{}, usageError(fs, "whisper executable and model paths must be provided")
+	}
+	if *workers < 1 {
+		return workerConfig{}, usageError(fs, "-workers must be at least 1")
+	}
+	if err := queue.validate(fs); err != nil {
+		return workerConfig{}, err
+	}
+	if err := pacing.validate(fs); err != nil {
+		return workerConfig{}, err
+	}
+
+	client, err := queue.client()
+	if err != nil {
+		return workerConfig{}, err
+	}
+	if *name == "" {
+		*name, _ = os.Hostname()
+	}
+	return workerConfig{
+		worker: scribe.QueueWorker{
+			Redis:   client,
+			Prefix:  *queue.prefix,
+			Name:    *name,
+			Workers: *workers,
+		},
+		whisper: scribe.Whisper{Path: *whisperPath, Model: *whisperModel, Language: *language},
+		pacing:  pacing.config(),
+	}, nil
+}
+
+// runWorker transcribes the recordings a scribe started with -queue hands
+// out, e.g. on a GPU machine
+func runWorker(args []string) error {
+	cfg, err := parseWorker(args)
+	if err != nil {
+		return err
+	}
+	defer cfg.worker.Redis.Close()
+
+	pacer, err := scribe.NewPacer(cfg.pacing)
+	if err != nil {
+		return fmt.Errorf("failed to set up whisper pacing: %w", err)
+	}
+	cfg.whisper.Pacer = pacer
+	cfg.worker.Transcriber = cfg.whisper
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	slog.Info("Transcribing recordings from queue", "name", cfg.worker.Name, "workers", cfg.worker.Workers)
+	return cfg.worker.Run(ctx)
+}
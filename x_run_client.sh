@@ -1,2 +1,2 @@
 export LIBAS_TOKEN="THIS_IS_MY_TOKEN_THERE_ARE_MANY_LIKE_IT_BUT_THIS_ONE_IS_MINE"
-./libas --insecure --server localhost:8443
\ No newline at end of file
+./libas capture --insecure --server localhost:8443
\ No newline at end of file